@@ -22,6 +22,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/urfave/cli/v2"
 	"golang.org/x/term"
@@ -29,6 +30,14 @@ import (
 	"c2FmZQ/internal/client"
 )
 
+const (
+	// The maximum time spent looking for file names to complete. On large
+	// libraries, the terminal shouldn't be blocked longer than this.
+	fileOptionsTimeout = 500 * time.Millisecond
+	// The maximum number of options to display.
+	maxDisplayOptions = 100
+)
+
 type autoCompleteOption struct {
 	name    string
 	display string
@@ -72,8 +81,18 @@ func escape(s string) string {
 }
 
 func (a *App) fileOptions(currentWord string) []autoCompleteOption {
-	li, err := a.client.GlobFiles([]string{currentWord + "*"}, client.GlobOptions{Quiet: true})
-	if err != nil {
+	ch := make(chan []client.ListItem, 1)
+	go func() {
+		li, err := a.client.GlobFiles([]string{currentWord + "*"}, client.GlobOptions{Quiet: true})
+		if err != nil {
+			li = nil
+		}
+		ch <- li
+	}()
+	var li []client.ListItem
+	select {
+	case li = <-ch:
+	case <-time.After(fileOptionsTimeout):
 		return nil
 	}
 	if len(li) == 0 {
@@ -118,6 +137,11 @@ func (a *App) displayOptions(t *term.Terminal, width int, options []autoComplete
 		}
 	}
 	fmt.Fprintln(t, "\nOptions:")
+	var more int
+	if len(options) > maxDisplayOptions {
+		more = len(options) - maxDisplayOptions
+		options = options[:maxDisplayOptions]
+	}
 	var out []string
 	line := "  "
 	for _, n := range options {
@@ -130,5 +154,8 @@ func (a *App) displayOptions(t *term.Terminal, width int, options []autoComplete
 	if len(line) > 2 {
 		out = append(out, string(t.Escape.Blue)+line+string(t.Escape.Reset))
 	}
+	if more > 0 {
+		out = append(out, fmt.Sprintf("  ... and %d more", more))
+	}
 	fmt.Fprintln(t, strings.Join(out, "\n"))
 }
@@ -19,16 +19,24 @@ package internal
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/c2FmZQ/storage"
 	"github.com/c2FmZQ/storage/crypto"
@@ -38,13 +46,37 @@ import (
 
 	"c2FmZQ/internal/client"
 	"c2FmZQ/internal/client/web"
+	"c2FmZQ/internal/client/webdav"
+	"c2FmZQ/internal/fileperm"
 	"c2FmZQ/internal/log"
 	"c2FmZQ/internal/pp"
+	"c2FmZQ/internal/server/basicauth"
 	"c2FmZQ/licenses"
 )
 
 var enableFuse = false
 
+// Process exit codes. Scripts can use them to react to specific failures.
+const (
+	exitGeneral    = 1
+	exitAuth       = 2
+	exitNotFound   = 3
+	exitPermission = 4
+	exitNetwork    = 5
+	// The operation was interrupted, e.g. with Ctrl-C. This is the usual
+	// exit code of a process killed by SIGINT.
+	exitInterrupted = 130
+)
+
+const exitCodesHelp = `Exit codes:
+   0  Success
+   1  General error
+   2  Authentication error, e.g. not logged in
+   3  File or album not found
+   4  Permission denied
+   5  Network error
+ 130  Interrupted, e.g. with Ctrl-C`
+
 type App struct {
 	cli    *cli.App
 	client *client.Client
@@ -57,7 +89,28 @@ type App struct {
 	flagPassphraseCmd  string
 	flagPassphrase     string
 	flagAPIServer      string
+	flagCACert         string
+	flagInsecure       bool
+	flagTimeout        time.Duration
+	flagDurability     string
+	flagBlobMode       string
+	flagBlobGroup      string
+	flagTempDir        string
+	flagKeyBundle      string
+	flagTokenFile      string
+	flagKeyBundlePass  string
+	flagTrace          bool
+	flagAdjustClock    bool
+	flagAcceptNewKey   bool
+	flagParallelSets   bool
+	flagKeepLocal      bool
+	flagOffline        bool
 	flagAutoUpdate     bool
+	flagQuiet          bool
+	flagJSON           bool
+
+	// The result of the current command, reported with --json.
+	result interface{}
 }
 
 func New() *App {
@@ -69,12 +122,16 @@ func New() *App {
 
 	var app App
 	app.cli = &cli.App{
-		Name:     "c2FmZQ",
-		Usage:    "Keep your files away from prying eyes.",
-		HideHelp: true,
+		Name:        "c2FmZQ",
+		Usage:       "Keep your files away from prying eyes.",
+		Description: exitCodesHelp,
+		HideHelp:    true,
 		CommandNotFound: func(ctx *cli.Context, cmd string) {
 			fmt.Fprintf(app.cli.Writer, "Unknown command %q. Try \"help\"\n", cmd)
 		},
+		// Errors are returned to the caller instead of exiting, so that
+		// the shell keeps running.
+		ExitErrHandler:         func(*cli.Context, error) {},
 		UseShortOptionHandling: true,
 	}
 	app.cli.Flags = []cli.Flag{
@@ -123,12 +180,126 @@ func New() *App {
 			EnvVars:     []string{"C2FMZQ_API_SERVER"},
 			Destination: &app.flagAPIServer,
 		},
+		&cli.StringFlag{
+			Name:        "ca-cert",
+			Value:       "",
+			Usage:       "Also trust the root certificates in `FILE` (PEM) when connecting to the API server.",
+			EnvVars:     []string{"C2FMZQ_CA_CERT"},
+			TakesFile:   true,
+			Destination: &app.flagCACert,
+		},
+		&cli.BoolFlag{
+			Name:        "insecure",
+			Usage:       "Don't verify the API server's TLS certificate. This is NOT secure, use only for testing.",
+			Destination: &app.flagInsecure,
+		},
+		&cli.DurationFlag{
+			Name:        "timeout",
+			Value:       client.DefaultTimeouts().Request,
+			Usage:       "The maximum duration of a request to the API server. Uploads and downloads are only interrupted when they stop making progress.",
+			EnvVars:     []string{"C2FMZQ_TIMEOUT"},
+			Destination: &app.flagTimeout,
+		},
+		&cli.StringFlag{
+			Name:        "durability",
+			Value:       "sync",
+			Usage:       "How files written locally are flushed to disk: sync (every write), fsync (once when the file is closed), or none. fsync and none are faster, but files written just before a crash or power loss can be lost or corrupted.",
+			EnvVars:     []string{"C2FMZQ_DURABILITY"},
+			Destination: &app.flagDurability,
+		},
+		&cli.StringFlag{
+			Name:        "blob-mode",
+			Value:       "0600",
+			Usage:       "The permission of new blobs, e.g. 0640 to let a reverse proxy or backup user in the same group read them. Blob directories also get the search permission. Access by others is never allowed. Existing blobs and metadata files are not changed.",
+			EnvVars:     []string{"C2FMZQ_BLOB_MODE"},
+			Destination: &app.flagBlobMode,
+		},
+		&cli.StringFlag{
+			Name:        "blob-group",
+			Usage:       "The group of new blobs and blob directories, as a name or ID. (default: the user's primary group)",
+			EnvVars:     []string{"C2FMZQ_BLOB_GROUP"},
+			Destination: &app.flagBlobGroup,
+		},
+		&cli.StringFlag{
+			Name:        "temp-dir",
+			Usage:       "Write new local encrypted files in `DIR` before moving them to the data directory. It is faster when DIR is on the same filesystem. (default: the data directory)",
+			EnvVars:     []string{"C2FMZQ_TEMPDIR"},
+			TakesFile:   true,
+			Destination: &app.flagTempDir,
+		},
+		&cli.StringFlag{
+			Name:        "key-bundle",
+			Usage:       "Use the secret key in `FILE`, written by export-login, instead of the saved login state. Requires --token-file.",
+			EnvVars:     []string{"C2FMZQ_KEY_BUNDLE"},
+			TakesFile:   true,
+			Destination: &app.flagKeyBundle,
+		},
+		&cli.StringFlag{
+			Name:        "token-file",
+			Usage:       "Use the server token in `FILE`, written by export-login, instead of the saved login state. Requires --key-bundle. The login state isn't saved in the data directory.",
+			EnvVars:     []string{"C2FMZQ_TOKEN_FILE"},
+			TakesFile:   true,
+			Destination: &app.flagTokenFile,
+		},
+		&cli.StringFlag{
+			Name:        "key-bundle-password",
+			Usage:       "Use value as the password of --key-bundle.",
+			EnvVars:     []string{"C2FMZQ_KEY_BUNDLE_PASSWORD"},
+			Destination: &app.flagKeyBundlePass,
+		},
+		&cli.BoolFlag{
+			Name:        "adjust-clock",
+			Usage:       "Adjust the timestamps of new files, albums, and requests when the local clock doesn't match the server's clock.",
+			EnvVars:     []string{"C2FMZQ_ADJUST_CLOCK"},
+			Destination: &app.flagAdjustClock,
+		},
+		&cli.BoolFlag{
+			Name:        "accept-new-server-key",
+			Usage:       "Accept a server public key that is different from the one that was used before, e.g. after the account was moved to a new server.",
+			EnvVars:     []string{"C2FMZQ_ACCEPT_NEW_SERVER_KEY"},
+			Destination: &app.flagAcceptNewKey,
+		},
+		&cli.BoolFlag{
+			Name:        "parallel-sets",
+			Usage:       "Apply the metadata updates to the gallery, trash, and albums concurrently, and save them together.",
+			EnvVars:     []string{"C2FMZQ_PARALLEL_SETS"},
+			Destination: &app.flagParallelSets,
+		},
+		&cli.BoolFlag{
+			Name:        "keep-local-on-conflict",
+			Usage:       "When a file was changed both locally and on the server, keep the local version instead of the server's version. See the conflicts command.",
+			EnvVars:     []string{"C2FMZQ_KEEP_LOCAL_ON_CONFLICT"},
+			Destination: &app.flagKeepLocal,
+		},
+		&cli.BoolFlag{
+			Name:        "offline",
+			Usage:       "Don't connect to the server. Only the files that are available locally can be read, and the changes are synced later.",
+			EnvVars:     []string{"C2FMZQ_OFFLINE"},
+			Destination: &app.flagOffline,
+		},
+		&cli.BoolFlag{
+			Name:        "trace",
+			Usage:       "Log the metadata of every request to the API server, with the tokens and passwords redacted. Useful to debug interop issues.",
+			EnvVars:     []string{"C2FMZQ_TRACE"},
+			Destination: &app.flagTrace,
+		},
 		&cli.BoolFlag{
 			Name:        "auto-update",
 			Value:       true,
 			Usage:       "Automatically fetch metadata updates from the remote server before each command.",
 			Destination: &app.flagAutoUpdate,
 		},
+		&cli.BoolFlag{
+			Name:        "quiet",
+			Aliases:     []string{"q"},
+			Usage:       "Don't show progress and informational messages.",
+			Destination: &app.flagQuiet,
+		},
+		&cli.BoolFlag{
+			Name:        "json",
+			Usage:       "Show the result of each command as a JSON object. Implies --quiet.",
+			Destination: &app.flagJSON,
+		},
 	}
 	app.cli.Commands = []*cli.Command{
 		&cli.Command{
@@ -137,6 +308,55 @@ func New() *App {
 			Action:   app.licenses,
 			Category: "Misc",
 		},
+		&cli.Command{
+			Name:      "encrypt",
+			Usage:     "Encrypt a local file with the current secret key, or a passphrase.",
+			ArgsUsage: "<input file> <output file>",
+			Action:    app.encryptFile,
+			Category:  "Misc",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "with-passphrase",
+					Usage: "Use a passphrase instead of the current secret key.",
+				},
+			},
+		},
+		&cli.Command{
+			Name:      "decrypt",
+			Usage:     "Decrypt a local file that was encrypted with the encrypt command.",
+			ArgsUsage: "<input file> <output file>",
+			Action:    app.decryptFile,
+			Category:  "Misc",
+		},
+		&cli.Command{
+			Name:      "reshard",
+			Usage:     "Move the local encrypted files to a layout with this many levels of directories.",
+			ArgsUsage: "<depth>",
+			Action:    app.reshard,
+			Category:  "Misc",
+		},
+		&cli.Command{
+			Name:      "dump",
+			Usage:     "Show the decrypted content of a data file, for debugging.",
+			ArgsUsage: "<relative path or name>",
+			Action:    app.dump,
+			Category:  "Developer",
+			Hidden:    true,
+		},
+		&cli.Command{
+			Name:      "raw-updates",
+			Usage:     "Show one page of updates from the server, without applying them, for debugging.",
+			ArgsUsage: "[cursor]",
+			Action:    app.rawUpdates,
+			Category:  "Developer",
+			Hidden:    true,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "from-start",
+					Usage: "Request all the updates, instead of the updates since the last sync.",
+				},
+			},
+		},
 		&cli.Command{
 			Name:     "shell",
 			Usage:    "Run in shell mode.",
@@ -155,10 +375,15 @@ func New() *App {
 					Value: true,
 					Usage: "Backup encrypted secret key on remote server.",
 				},
+				&cli.StringFlag{
+					Name:  "invite-code",
+					Usage: "The invite code to use, if the server requires one.",
+				},
 			},
 		},
 		&cli.Command{
 			Name:      "recover-account",
+			Aliases:   []string{"recover"},
 			Usage:     "Recover an account with backup phrase.",
 			ArgsUsage: "<email>",
 			Action:    app.recoverAccount,
@@ -205,6 +430,13 @@ func New() *App {
 			Action:    app.logout,
 			Category:  "Account",
 		},
+		&cli.Command{
+			Name:      "set-server",
+			Usage:     "Change the URL of the server used by the current account.",
+			ArgsUsage: "<url>",
+			Action:    app.setServer,
+			Category:  "Account",
+		},
 		&cli.Command{
 			Name:      "status",
 			Usage:     "Show the client's status.",
@@ -214,11 +446,19 @@ func New() *App {
 		},
 		&cli.Command{
 			Name:      "backup-phrase",
+			Aliases:   []string{"recovery-phrase"},
 			Usage:     "Show the backup phrase for the current account. The backup phrase must be kept secret.",
 			ArgsUsage: " ",
 			Action:    app.backupPhrase,
 			Category:  "Account",
 		},
+		&cli.Command{
+			Name:      "export-login",
+			Usage:     "Write the login state and the encrypted secret key to files, for use with --token-file and --key-bundle. The files must be kept secret.",
+			ArgsUsage: "<token file> <key bundle file>",
+			Action:    app.exportLogin,
+			Category:  "Account",
+		},
 		&cli.Command{
 			Name:      "delete-account",
 			Usage:     "Delete the account and wipe all data.",
@@ -255,6 +495,22 @@ func New() *App {
 					Value:   true,
 					Usage:   "Pull files recursively.",
 				},
+				&cli.BoolFlag{
+					Name:  "from-stdin",
+					Usage: "Read the exact file names from the standard input, one per line. Same as using - as the only argument.",
+				},
+				&cli.BoolFlag{
+					Name:  "thumbs-first",
+					Usage: "Download the thumbnails of all the files before their content.",
+				},
+				&cli.BoolFlag{
+					Name:  "include-trash",
+					Usage: "Also download the files in the trash when matching wildcards.",
+				},
+				&cli.BoolFlag{
+					Name:  "include-hidden",
+					Usage: "Also download the files in hidden albums when matching wildcards.",
+				},
 			},
 		},
 		&cli.Command{
@@ -269,6 +525,44 @@ func New() *App {
 					Value: false,
 					Usage: "Show what would be synced without actually syncing.",
 				},
+				&cli.BoolFlag{
+					Name:  "thumbs-first",
+					Usage: "Download the thumbnails of all the files that aren't available locally, so that they can be browsed right away. The files' content is downloaded when it is needed, or with pull.",
+				},
+				&cli.BoolFlag{
+					Name:  "include-trash",
+					Usage: "With --thumbs-first, also download the thumbnails of the files in the trash.",
+				},
+				&cli.BoolFlag{
+					Name:  "include-hidden",
+					Usage: "With --thumbs-first, also download the thumbnails of the files in hidden albums.",
+				},
+			},
+		},
+		&cli.Command{
+			Name:      "resync",
+			Usage:     "Discard the local metadata and download it again from the server. Local changes that aren't synced are lost.",
+			ArgsUsage: " ",
+			Action:    app.resync,
+			Category:  "Sync",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "undo",
+					Usage: "Restore the metadata that was saved in this directory by a previous resync.",
+				},
+			},
+		},
+		&cli.Command{
+			Name:      "conflicts",
+			Usage:     "Show the files that were changed both locally and on the server before the local changes were synced.",
+			ArgsUsage: " ",
+			Action:    app.conflicts,
+			Category:  "Sync",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "clear",
+					Usage: "Forget the conflicts that were detected.",
+				},
 			},
 		},
 		&cli.Command{
@@ -284,8 +578,50 @@ func New() *App {
 					Value:   true,
 					Usage:   "Remove files recursively.",
 				},
+				&cli.BoolFlag{
+					Name:  "force",
+					Usage: "Also remove files in locked directories (albums).",
+				},
+				&cli.BoolFlag{
+					Name:  "include-trash",
+					Usage: "Also remove the files in the trash when matching wildcards.",
+				},
+				&cli.BoolFlag{
+					Name:  "include-hidden",
+					Usage: "Also remove the files in hidden albums when matching wildcards.",
+				},
+				&cli.BoolFlag{
+					Name:  "from-stdin",
+					Usage: "Read the exact file names from the standard input, one per line. Same as using - as the only argument.",
+				},
+				&cli.BoolFlag{
+					Name:    "yes",
+					Aliases: []string{"y"},
+					Usage:   "Don't ask for confirmation.",
+				},
 			},
 		},
+		&cli.Command{
+			Name:      "cache-limit",
+			Usage:     "Show or set the maximum size of the local copies of files that are backed up.",
+			ArgsUsage: "[bytes] (0 means no limit)",
+			Action:    app.cacheLimit,
+			Category:  "Sync",
+		},
+		&cli.Command{
+			Name:      "pin",
+			Usage:     "Keep the local copy of files, or directories (albums), even when they are backed up.",
+			ArgsUsage: `"<glob>" ...`,
+			Action:    app.pinFiles,
+			Category:  "Sync",
+		},
+		&cli.Command{
+			Name:      "unpin",
+			Usage:     "Let the local copy of files, or directories (albums), be freed again.",
+			ArgsUsage: `"<glob>" ...`,
+			Action:    app.unpinFiles,
+			Category:  "Sync",
+		},
 		&cli.Command{
 			Name:      "create-album",
 			Aliases:   []string{"mkdir"},
@@ -301,21 +637,61 @@ func New() *App {
 			ArgsUsage: `<name> ...`,
 			Action:    app.removeAlbum,
 			Category:  "Albums",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:    "yes",
+					Aliases: []string{"y"},
+					Usage:   "Don't ask for confirmation.",
+				},
+			},
 		},
 		&cli.Command{
 			Name:      "rename",
-			Usage:     "Rename a directory (album).",
+			Usage:     "Rename a directory (album), or a file without moving it.",
 			ArgsUsage: `<old name> <new name>`,
-			Action:    app.renameAlbum,
+			Action:    app.rename,
+			Category:  "Albums",
+		},
+		&cli.Command{
+			Name:      "lock-album",
+			Usage:     "Lock directories (albums) to protect their files from delete and free.",
+			ArgsUsage: `"<glob>" ...`,
+			Action:    app.lockAlbums,
+			Category:  "Albums",
+		},
+		&cli.Command{
+			Name:      "unlock-album",
+			Usage:     "Unlock directories (albums).",
+			ArgsUsage: `"<glob>" ...`,
+			Action:    app.unlockAlbums,
+			Category:  "Albums",
+		},
+		&cli.Command{
+			Name:      "set-cover",
+			Usage:     "Set the file to use as a directory's (album's) cover.",
+			ArgsUsage: `<album> [<file>]`,
+			Action:    app.setCover,
 			Category:  "Albums",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "clear",
+					Usage: "Revert to the default cover.",
+				},
+			},
 		},
 		&cli.Command{
 			Name:      "list",
 			Aliases:   []string{"ls"},
 			Usage:     "List files and directories.",
 			ArgsUsage: `["glob"] ... (default "*")`,
-			Action:    app.listFiles,
-			Category:  "Files",
+			Description: "The patterns are matched against each part of the path separately, i.e.\n" +
+				"the parts between slashes. By default, they are shell globs that must match\n" +
+				"the whole name, e.g. \"photo\" only matches a file named photo, and \"*photo*\"\n" +
+				"matches all the names that contain photo. With --match=substring, \"photo\"\n" +
+				"matches all the names that contain photo. With --match=regexp, the names\n" +
+				"must contain a match of the regular expression; use ^ and $ to anchor it.",
+			Action:   app.listFiles,
+			Category: "Files",
 			Flags: []cli.Flag{
 				&cli.BoolFlag{
 					Name:    "all",
@@ -341,6 +717,24 @@ func New() *App {
 					Value:   false,
 					Usage:   "Show directories, not their content.",
 				},
+				&cli.StringFlag{
+					Name:  "match",
+					Value: "glob",
+					Usage: "How the patterns are matched against names: glob, substring, or regexp.",
+				},
+				&cli.StringFlag{
+					Name:  "sort",
+					Value: "name",
+					Usage: "The order of the items: name, created or modified (most recent first), or count (albums with the most files first).",
+				},
+				&cli.BoolFlag{
+					Name:  "include-trash",
+					Usage: "Show the trash with the other directories.",
+				},
+				&cli.BoolFlag{
+					Name:  "include-hidden",
+					Usage: "Show the hidden albums with the other directories.",
+				},
 			},
 		},
 		&cli.Command{
@@ -366,6 +760,21 @@ func New() *App {
 			ArgsUsage: `<"glob"> ...`,
 			Action:    app.deleteFiles,
 			Category:  "Files",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "force",
+					Usage: "Also delete files in locked directories (albums).",
+				},
+				&cli.BoolFlag{
+					Name:  "from-stdin",
+					Usage: "Read the exact file names from the standard input, one per line. Same as using - as the only argument.",
+				},
+				&cli.BoolFlag{
+					Name:    "yes",
+					Aliases: []string{"y"},
+					Usage:   "Don't ask for confirmation.",
+				},
+			},
 		},
 		&cli.Command{
 			Name:      "cat",
@@ -375,6 +784,34 @@ func New() *App {
 			Action:    app.catFiles,
 			Category:  "Files",
 		},
+		&cli.Command{
+			Name:      "regen-thumbnails",
+			Usage:     "Create new thumbnails for files that are downloaded.",
+			ArgsUsage: `<"glob"> ...`,
+			Action:    app.regenThumbnails,
+			Category:  "Files",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:    "recursive",
+					Aliases: []string{"R"},
+					Value:   true,
+					Usage:   "Process files recursively.",
+				},
+			},
+		},
+		&cli.Command{
+			Name:      "backup",
+			Usage:     "Copy all the encrypted files, albums, and keys to a directory, in a format that Stingle-compatible apps can import.",
+			ArgsUsage: `<output directory>`,
+			Action:    app.fullBackup,
+			Category:  "Import/Export",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "with-secret-key",
+					Usage: "Include the secret key in the backup, encrypted with a password.",
+				},
+			},
+		},
 		&cli.Command{
 			Name:      "export",
 			Usage:     "Decrypt and export files.",
@@ -388,8 +825,89 @@ func New() *App {
 					Value:   true,
 					Usage:   "Export files recursively.",
 				},
+				&cli.StringFlag{
+					Name:  "on-conflict",
+					Value: "rename",
+					Usage: "What to do when a file already exists: skip, overwrite, or rename (append a numeric suffix).",
+				},
+				&cli.StringFlag{
+					Name:      "manifest",
+					Value:     "",
+					Usage:     "Write the paths and SHA256 hashes of the exported files to `FILE`. Use verify-export to verify them later.",
+					TakesFile: true,
+				},
+				&cli.BoolFlag{
+					Name:  "from-stdin",
+					Usage: "Read the exact file names from the standard input, one per line. Same as using - as the only argument.",
+				},
+			},
+		},
+		&cli.Command{
+			Name:      "export-album",
+			Usage:     "Write one album to a single encrypted file that can be given to someone without sharing it on the server.",
+			ArgsUsage: `<album> <output file>`,
+			Action:    app.exportAlbumBundle,
+			Category:  "Import/Export",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "recipient",
+					Usage: "The email address, or public key, of the user who can import the album. The default is the current user.",
+				},
+				&cli.BoolFlag{
+					Name:  "with-passphrase",
+					Usage: "Use a passphrase instead of the recipient's public key.",
+				},
 			},
 		},
+		&cli.Command{
+			Name:      "export-metadata",
+			Usage:     "Write the decrypted metadata of files to a JSON file, without decrypting their content.",
+			ArgsUsage: `"<glob>" ... <output file>`,
+			Action:    app.exportMetadata,
+			Category:  "Import/Export",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:    "recursive",
+					Aliases: []string{"R"},
+					Value:   true,
+					Usage:   "Export the metadata of files recursively.",
+				},
+			},
+		},
+		&cli.Command{
+			Name:     "index",
+			Usage:    "Write the decrypted metadata of all the files to the standard output.",
+			Action:   app.streamIndex,
+			Category: "Import/Export",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "ndjson",
+					Value: false,
+					Usage: "Write newline-delimited JSON, one object per file. This is currently the only format.",
+				},
+			},
+		},
+		&cli.Command{
+			Name:      "restore",
+			Usage:     "Add the encrypted files and albums from a backup to the current account.",
+			ArgsUsage: `<backup directory>`,
+			Action:    app.fullRestore,
+			Category:  "Import/Export",
+		},
+		&cli.Command{
+			Name:      "import-album-bundle",
+			Usage:     "Add the album from a file written by export-album as a new album.",
+			ArgsUsage: `<input file> [album name]`,
+			Action:    app.importAlbumBundle,
+			Category:  "Import/Export",
+		},
+		&cli.Command{
+			Name:      "verify-export",
+			Usage:     "Verify exported files against a manifest.",
+			ArgsUsage: `<directory> <manifest>`,
+			Action:    app.verifyExport,
+			Category:  "Import/Export",
+		},
 		&cli.Command{
 			Name:      "import",
 			Usage:     "Encrypt and import files.",
@@ -403,8 +921,43 @@ func New() *App {
 					Value:   true,
 					Usage:   "Import files recursively.",
 				},
+				&cli.BoolFlag{
+					Name:  "date-from-mtime",
+					Usage: "Use the file modification time as creation date when the file has no EXIF or video metadata.",
+				},
+				&cli.StringSliceFlag{
+					Name:  "date",
+					Usage: "Set the creation date of a file, e.g. --date=IMG_0001.jpg=2006-01-02T15:04:05Z. Can be repeated.",
+				},
+				&cli.StringFlag{
+					Name:  "date-manifest",
+					Usage: "Read the creation dates of files from this file, one <file>=<date> per line.",
+				},
+				&cli.IntFlag{
+					Name:  "max-dimension",
+					Usage: "Downscale JPEG images so that neither side exceeds `N` pixels. This is lossy. Only the key EXIF fields are kept, without GPS coordinates.",
+				},
+				&cli.BoolFlag{
+					Name:  "follow-symlinks",
+					Usage: "Import the targets of symbolic links. By default, symbolic links are skipped.",
+				},
+				&cli.BoolFlag{
+					Name:  "delete-source",
+					Usage: "Delete each source file after it was imported. The files that fail to import are not deleted.",
+				},
+				&cli.BoolFlag{
+					Name:  "delete-after-upload",
+					Usage: "Sync the imported files, and delete each source file only after it was uploaded to the server.",
+				},
 			},
 		},
+		&cli.Command{
+			Name:      "watch",
+			Usage:     "Watch a directory and import new files as they appear, until interrupted.",
+			ArgsUsage: `<local directory> <directory>`,
+			Action:    app.watch,
+			Category:  "Import/Export",
+		},
 		&cli.Command{
 			Name:      "share",
 			Usage:     "Share a directory (album) with other people.",
@@ -420,12 +973,25 @@ func New() *App {
 				},
 			},
 		},
+		&cli.Command{
+			Name:      "complete-shares",
+			Usage:     "Share directories (albums) with invited people who now have an account.",
+			ArgsUsage: " ",
+			Action:    app.completeShares,
+			Category:  "Share",
+		},
 		&cli.Command{
 			Name:      "unshare",
 			Usage:     "Stop sharing a directory (album).",
 			ArgsUsage: `"<glob>" ...`,
 			Action:    app.unshareAlbum,
 			Category:  "Share",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "rotate-key",
+					Usage: "Replace the album key and re-encrypt the headers of all the files. This is slow for large albums.",
+				},
+			},
 		},
 		&cli.Command{
 			Name:      "leave",
@@ -440,23 +1006,57 @@ func New() *App {
 			ArgsUsage: `"<glob>" <email> ...`,
 			Action:    app.removeMember,
 			Category:  "Share",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "rotate-key",
+					Usage: "Replace the album key and re-encrypt the headers of all the files. This is slow for large albums.",
+				},
+			},
 		},
 		&cli.Command{
-			Name:      "change-permissions",
-			Aliases:   []string{"chmod"},
-			Usage:     "Change the permissions on a shared directory (album).",
-			ArgsUsage: `<comma-separated permissions> "<glob>" ...   e.g. +Add,-Share MyAlbum`,
-			Action:    app.changePermissions,
+			Name:      "album-members",
+			Usage:     "List the members of a shared directory (album) and their permissions.",
+			ArgsUsage: `"<album>"`,
+			Action:    app.albumMembers,
 			Category:  "Share",
 		},
 		&cli.Command{
-			Name:      "contacts",
-			Usage:     "List contacts.",
-			ArgsUsage: `"<glob>" ...`,
-			Action:    app.listContacts,
+			Name:      "set-permissions",
+			Usage:     "Set the permissions of a member of a shared directory (album). They apply to all members.",
+			ArgsUsage: `"<album>" <email>`,
+			Action:    app.setPermissions,
 			Category:  "Share",
-		},
-		&cli.Command{
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "add",
+					Usage: "Allow members to add files.",
+				},
+				&cli.BoolFlag{
+					Name:  "share",
+					Usage: "Allow members to share the album.",
+				},
+				&cli.BoolFlag{
+					Name:  "copy",
+					Usage: "Allow members to copy files out of the album.",
+				},
+			},
+		},
+		&cli.Command{
+			Name:      "change-permissions",
+			Aliases:   []string{"chmod"},
+			Usage:     "Change the permissions on a shared directory (album).",
+			ArgsUsage: `<comma-separated permissions> "<glob>" ...   e.g. +Add,-Share MyAlbum`,
+			Action:    app.changePermissions,
+			Category:  "Share",
+		},
+		&cli.Command{
+			Name:      "contacts",
+			Usage:     "List contacts.",
+			ArgsUsage: `"<glob>" ...`,
+			Action:    app.listContacts,
+			Category:  "Share",
+		},
+		&cli.Command{
 			Name:      "webserver-config",
 			Usage:     "Update the web server configuration.",
 			ArgsUsage: " ",
@@ -502,6 +1102,49 @@ func New() *App {
 				},
 			},
 		},
+		&cli.Command{
+			Name:      "daemon",
+			Usage:     "Run in the background, periodically syncing with the remote server.",
+			ArgsUsage: " ",
+			Action:    app.daemon,
+			Category:  "Mode",
+			Flags: []cli.Flag{
+				&cli.DurationFlag{
+					Name:  "interval",
+					Value: 5 * time.Minute,
+					Usage: "The time between two syncs.",
+				},
+				&cli.DurationFlag{
+					Name:  "max-backoff",
+					Value: time.Hour,
+					Usage: "The maximum time between two attempts after failures.",
+				},
+				&cli.StringSliceFlag{
+					Name:  "pull",
+					Usage: "Also download a local copy of the files that match this glob. Can be repeated.",
+				},
+			},
+		},
+		&cli.Command{
+			Name:      "mount-webdav",
+			Usage:     "Run a read-only WebDAV server to access the decrypted files.",
+			ArgsUsage: " ",
+			Action:    app.webDAV,
+			Category:  "Mode",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "address",
+					Aliases: []string{"addr"},
+					Value:   "localhost:8081",
+					Usage:   "The address to listen on.",
+				},
+				&cli.StringFlag{
+					Name:      "htdigest",
+					Usage:     "Require authentication with the users and passwords in `FILE` (htdigest format, realm c2FmZQ).",
+					TakesFile: true,
+				},
+			},
+		},
 		&cli.Command{
 			Name:      "webserver",
 			Usage:     "Run web server to access the files.",
@@ -524,10 +1167,18 @@ func New() *App {
 						Aliases: []string{"ro"},
 						Usage:   "Mount filesystem read-only.",
 					},
+					&cli.Int64Flag{
+						Name:  "cache-size",
+						Value: 64,
+						Usage: "The maximum size, in MiB, of the decrypted file data kept in memory. 0 disables the cache.",
+					},
 				},
 			},
 		)
 	}
+	for _, cmd := range app.cli.Commands {
+		cmd.Action = app.wrapAction(cmd.Name, cmd.Action)
+	}
 	sort.Sort(cli.CommandsByName(app.cli.Commands))
 
 	return &app
@@ -537,6 +1188,61 @@ func (a *App) Run(args []string) error {
 	return a.cli.Run(args)
 }
 
+// wrapAction wraps a command action so that its result is reported as JSON
+// when --json is set, and so that known client errors are translated into
+// distinct process exit codes.
+func (a *App) wrapAction(name string, action cli.ActionFunc) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		a.result = nil
+		err := action(ctx)
+		if a.flagJSON && name != "shell" {
+			a.reportJSON(name, err)
+		}
+		return exitError(err)
+	}
+}
+
+// reportJSON writes the result of a command as a JSON object.
+func (a *App) reportJSON(name string, err error) {
+	out := struct {
+		Command string      `json:"command"`
+		Status  string      `json:"status"`
+		Error   string      `json:"error,omitempty"`
+		Result  interface{} `json:"result,omitempty"`
+	}{Command: name, Status: "ok", Result: a.result}
+	if err != nil {
+		out.Status = "error"
+		out.Error = err.Error()
+	}
+	if err := json.NewEncoder(a.cli.Writer).Encode(out); err != nil {
+		log.Errorf("json.Encode: %v", err)
+	}
+}
+
+// exitError translates known client errors into distinct process exit codes.
+func exitError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return cli.Exit(err, exitInterrupted)
+	case errors.Is(err, client.ErrNotLoggedIn):
+		return cli.Exit(err, exitAuth)
+	case errors.Is(err, client.ErrServerKeyChanged):
+		return cli.Exit(fmt.Errorf("%w: use --accept-new-server-key if the new key is expected", err), exitAuth)
+	case errors.Is(err, client.ErrFileNotFound), errors.Is(err, client.ErrAlbumNotFound):
+		return cli.Exit(err, exitNotFound)
+	case errors.Is(err, client.ErrPermissionDenied):
+		return cli.Exit(err, exitPermission)
+	case errors.As(err, &netErr):
+		return cli.Exit(err, exitNetwork)
+	default:
+		return cli.Exit(err, exitGeneral)
+	}
+}
+
 func (a *App) init(ctx *cli.Context, update bool) error {
 	if a.client == nil {
 		log.Level = a.flagLogLevel
@@ -566,16 +1272,68 @@ func (a *App) init(ctx *cli.Context, update bool) error {
 		}
 		storage := storage.New(a.flagDataDir, masterKey)
 
-		c, err := client.Load(masterKey, storage)
-		if err != nil {
-			if c, err = client.Create(masterKey, storage); err != nil {
+		var loadOpts []client.LoadOption
+		if a.flagKeyBundle != "" || a.flagTokenFile != "" {
+			if a.flagKeyBundle == "" || a.flagTokenFile == "" {
+				return errors.New("--key-bundle and --token-file must be used together")
+			}
+			password := a.flagKeyBundlePass
+			if password == "" {
+				if password, err = a.promptPass("Enter key bundle password: "); err != nil {
+					return err
+				}
+			}
+			loadOpts = append(loadOpts, client.WithLogin(a.flagTokenFile, a.flagKeyBundle, []byte(password)))
+		}
+		c, err := client.Load(masterKey, storage, loadOpts...)
+		if errors.Is(err, os.ErrNotExist) {
+			if _, err = client.Create(masterKey, storage); err != nil {
 				log.Fatalf("client.Create: %v", err)
 			}
+			c, err = client.Load(masterKey, storage, loadOpts...)
+		}
+		if err != nil {
+			return err
 		}
 		a.client = c
 		a.client.SetPrompt(a.prompt)
+		timeouts := client.DefaultTimeouts()
+		timeouts.Request = a.flagTimeout
+		a.client.SetTimeouts(timeouts)
+		durability, err := client.ParseDurability(a.flagDurability)
+		if err != nil {
+			return err
+		}
+		a.client.SetDurability(durability)
+		blobPerm, err := fileperm.Parse(a.flagBlobMode, a.flagBlobGroup)
+		if err != nil {
+			return err
+		}
+		if err := a.client.SetBlobPerm(blobPerm); err != nil {
+			return err
+		}
+		if err := a.client.SetTempDir(a.flagTempDir); err != nil {
+			return err
+		}
+		if a.flagTrace && log.Level < log.InfoLevel {
+			log.Level = log.InfoLevel
+		}
+		a.client.SetTrace(a.flagTrace)
+		a.client.SetAdjustClock(a.flagAdjustClock)
+		a.client.SetAcceptNewServerKey(a.flagAcceptNewKey)
+		a.client.SetParallelSets(a.flagParallelSets)
+		a.client.SetKeepLocalOnConflict(a.flagKeepLocal)
+		a.client.SetOffline(a.flagOffline)
+		if a.flagCACert != "" || a.flagInsecure {
+			cfg, err := a.tlsConfig()
+			if err != nil {
+				return err
+			}
+			a.client.SetTLSConfig(cfg)
+		}
 	}
-	if update && a.flagAutoUpdate && a.client.Account != nil {
+	a.client.SetQuiet(a.flagQuiet || a.flagJSON)
+	if update && a.flagAutoUpdate && !a.flagOffline && a.client.Account != nil {
 		if err := a.client.GetUpdates(true); err != nil {
 			return err
 		}
@@ -583,20 +1341,82 @@ func (a *App) init(ctx *cli.Context, update bool) error {
 	return nil
 }
 
-func (a *App) setupTerminal() (*term.Terminal, func()) {
+// tlsConfig returns the TLS settings from --ca-cert and --insecure.
+func (a *App) tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{}
+	if a.flagCACert != "" {
+		pem, err := os.ReadFile(a.flagCACert)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", a.flagCACert)
+		}
+		cfg.RootCAs = pool
+	}
+	if a.flagInsecure {
+		fmt.Fprintln(os.Stderr, "WARNING: TLS certificate verification is DISABLED. The connection to the server is NOT secure.")
+		cfg.InsecureSkipVerify = true
+	}
+	return cfg, nil
+}
+
+// setupTerminal puts the terminal in raw mode and returns a term.Terminal with
+// history preloaded.
+func (a *App) setupTerminal(history []string) (*term.Terminal, func()) {
 	oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
 	if err != nil {
 		panic(err)
 	}
 
-	screen := struct {
+	// term.Terminal doesn't have a way to set the history directly. The
+	// lines are replayed as if they had been typed, with the output
+	// discarded.
+	var replay strings.Builder
+	for _, line := range history {
+		line = strings.Map(func(r rune) rune {
+			if r < 0x20 || r == 0x7f {
+				return -1
+			}
+			return r
+		}, line)
+		if line != "" {
+			replay.WriteString(line + "\r")
+		}
+	}
+	screen := &struct {
 		io.Reader
 		io.Writer
-	}{os.Stdin, os.Stdout}
+	}{io.MultiReader(strings.NewReader(replay.String()), os.Stdin), io.Discard}
 	t := term.NewTerminal(screen, "> ")
+	for n := strings.Count(replay.String(), "\r"); n > 0; n-- {
+		if _, err := t.ReadLine(); err != nil {
+			break
+		}
+	}
+	screen.Writer = os.Stdout
 	return t, func() { term.Restore(int(os.Stdin.Fd()), oldState) }
 }
 
+// saveHistory adds line to the shell history, unless it contains a password.
+func (a *App) saveHistory(history []string, line string, args []string) []string {
+	for _, arg := range args {
+		name, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if strings.HasPrefix(arg, "-") && (name == "password" || name == "passphrase") {
+			return history
+		}
+	}
+	history = append(history, line)
+	if err := a.client.SaveShellHistory(history); err != nil {
+		a.client.Infof("Unable to save history: %v\n", err)
+	}
+	return history
+}
+
 func (a *App) shell(ctx *cli.Context) error {
 	if err := a.init(ctx, false); err != nil {
 		return err
@@ -610,7 +1430,11 @@ func (a *App) shell(ctx *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	t, reset := a.setupTerminal()
+	history, err := a.client.ShellHistory()
+	if err != nil {
+		a.client.Infof("Unable to load history: %v\n", err)
+	}
+	t, reset := a.setupTerminal(history)
 	defer reset()
 	t.SetSize(width, height)
 	t.AutoCompleteCallback = func(line string, pos int, key rune) (newLine string, newPos int, ok bool) {
@@ -679,6 +1503,7 @@ func (a *App) shell(ctx *cli.Context) error {
 		if len(args) == 0 {
 			continue
 		}
+		history = a.saveHistory(history, line, args)
 		switch args[0] {
 		case "exit":
 			return nil
@@ -707,7 +1532,7 @@ func (a *App) shell(ctx *cli.Context) error {
 func (a *App) promptPass(msg string) (string, error) {
 	t := a.term
 	if t == nil {
-		tt, reset := a.setupTerminal()
+		tt, reset := a.setupTerminal(nil)
 		defer reset()
 		t = tt
 	}
@@ -750,7 +1575,7 @@ func (a *App) createAccount(ctx *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	return a.client.CreateAccount(server, email, password, ctx.Bool("backup"))
+	return a.client.CreateAccountWithInviteCode(server, email, password, ctx.String("invite-code"), ctx.Bool("backup"))
 }
 
 func (a *App) recoverAccount(ctx *cli.Context) error {
@@ -882,6 +1707,32 @@ func (a *App) status(ctx *cli.Context) error {
 	if err := a.init(ctx, false); err != nil {
 		return err
 	}
+	if a.flagJSON {
+		status := struct {
+			LoggedIn   bool          `json:"loggedIn"`
+			Email      string        `json:"email,omitempty"`
+			Server     string        `json:"server,omitempty"`
+			IsBackedUp bool          `json:"isBackedUp"`
+			PublicKey  string        `json:"publicKey"`
+			LocalUsage int64         `json:"localUsage"`
+			Usage      *client.Usage `json:"usage,omitempty"`
+			ClockSkew  string        `json:"clockSkew,omitempty"`
+		}{PublicKey: hex.EncodeToString(a.client.PublicKey().ToBytes())}
+		status.LocalUsage, _ = a.client.LocalUsage()
+		if acc := a.client.Account; acc != nil {
+			status.LoggedIn = true
+			status.Email = acc.Email
+			status.Server = acc.ServerBaseURL
+			status.IsBackedUp = acc.IsBackedUp
+			// Usage is omitted when the server can't be reached.
+			status.Usage, _ = a.client.ServerUsage()
+			if status.Usage != nil {
+				status.ClockSkew = a.client.ClockSkew().String()
+			}
+		}
+		a.result = status
+		return nil
+	}
 	return a.client.Status()
 }
 
@@ -922,6 +1773,39 @@ func (a *App) deleteAccount(ctx *cli.Context) error {
 	return a.client.DeleteAccount(password)
 }
 
+func (a *App) setServer(ctx *cli.Context) error {
+	if err := a.init(ctx, false); err != nil {
+		return err
+	}
+	if ctx.Args().Len() != 1 {
+		cli.ShowSubcommandHelp(ctx)
+		return nil
+	}
+	return a.client.SetServerURL(ctx.Args().Get(0))
+}
+
+func (a *App) exportLogin(ctx *cli.Context) error {
+	if err := a.init(ctx, false); err != nil {
+		return err
+	}
+	if ctx.Args().Len() != 2 {
+		cli.ShowSubcommandHelp(ctx)
+		return nil
+	}
+	password, err := a.promptPass("Enter key bundle password: ")
+	if err != nil {
+		return err
+	}
+	password2, err := a.promptPass("Re-enter key bundle password: ")
+	if err != nil {
+		return err
+	}
+	if password != password2 {
+		return errors.New("passwords do not match")
+	}
+	return a.client.ExportLogin(ctx.Args().Get(0), ctx.Args().Get(1), []byte(password))
+}
+
 func (a *App) wipeAccount(ctx *cli.Context) error {
 	if err := a.init(ctx, false); err != nil {
 		return err
@@ -968,11 +1852,32 @@ func (a *App) pullFiles(ctx *cli.Context) error {
 	if ctx.Args().Len() > 0 {
 		patterns = ctx.Args().Slice()
 	}
-	opt := client.GlobOptions{}
+	patterns, exact, err := a.fileNames(ctx, patterns)
+	if err != nil {
+		return err
+	}
+	opt := client.GlobOptions{
+		ExactMatch:    exact,
+		IncludeTrash:  ctx.Bool("include-trash"),
+		IncludeHidden: ctx.Bool("include-hidden"),
+	}
 	if ctx.Bool("recursive") {
 		opt.Recursive = true
 	}
-	_, err := a.client.Pull(patterns, opt)
+	if ctx.Bool("thumbs-first") {
+		if _, err := a.client.PullThumbnails(patterns, opt); err != nil {
+			return err
+		}
+	}
+	// Ctrl-C stops the downloads. The files that were already downloaded
+	// are kept.
+	c, stop := a.interruptContext(ctx.Context)
+	defer stop()
+	n, err := a.client.PullContext(c, patterns, opt)
+	a.result = countResult{n}
+	if c.Err() != nil {
+		return fmt.Errorf("interrupted after downloading %d file(s): %w", n, context.Canceled)
+	}
 	return err
 }
 
@@ -984,122 +1889,142 @@ func (a *App) syncFiles(ctx *cli.Context) error {
 		a.client.Print("Sync requires logging in to a remote server.")
 		return nil
 	}
-	return a.client.Sync(ctx.Bool("dryrun"))
-}
-
-func (a *App) freeFiles(ctx *cli.Context) error {
-	if err := a.init(ctx, true); err != nil {
+	// Ctrl-C stops the sync. The changes that were not synced yet are
+	// synced the next time.
+	c, stop := a.interruptContext(ctx.Context)
+	defer stop()
+	if err := a.client.SyncContext(c, ctx.Bool("dryrun")); err != nil {
+		if c.Err() != nil {
+			return fmt.Errorf("interrupted, the remaining changes will be synced next time: %w", context.Canceled)
+		}
 		return err
 	}
-	patterns := []string{"*"}
-	if ctx.Args().Len() > 0 {
-		patterns = ctx.Args().Slice()
-	}
-	opt := client.GlobOptions{}
-	if ctx.Bool("recursive") {
-		opt.Recursive = true
+	if ctx.Bool("thumbs-first") && !ctx.Bool("dryrun") {
+		_, err := a.client.PullThumbnails([]string{"*"}, client.GlobOptions{
+			Recursive:     true,
+			IncludeTrash:  ctx.Bool("include-trash"),
+			IncludeHidden: ctx.Bool("include-hidden"),
+		})
+		return err
 	}
-	_, err := a.client.Free(patterns, opt)
-	return err
+	return nil
 }
 
-func (a *App) createAlbum(ctx *cli.Context) error {
-	if err := a.init(ctx, true); err != nil {
+func (a *App) resync(ctx *cli.Context) error {
+	if err := a.init(ctx, false); err != nil {
 		return err
 	}
-	names := ctx.Args().Slice()
-	if len(names) == 0 {
-		cli.ShowSubcommandHelp(ctx)
-		return nil
+	if dir := ctx.String("undo"); dir != "" {
+		return a.client.UndoResync(dir)
 	}
-	return a.client.AddAlbums(names)
+	dir, err := a.client.FullResync()
+	if dir != "" {
+		a.client.Infof("To undo: resync --undo=%q\n", dir)
+	}
+	return err
 }
 
-func (a *App) removeAlbum(ctx *cli.Context) error {
-	if err := a.init(ctx, true); err != nil {
+func (a *App) conflicts(ctx *cli.Context) error {
+	if err := a.init(ctx, false); err != nil {
 		return err
 	}
-	patterns := ctx.Args().Slice()
-	if len(patterns) == 0 {
-		cli.ShowSubcommandHelp(ctx)
-		return nil
+	if ctx.Bool("clear") {
+		return a.client.ClearConflicts()
 	}
-	return a.client.RemoveAlbums(patterns)
-}
-
-func (a *App) renameAlbum(ctx *cli.Context) error {
-	if err := a.init(ctx, true); err != nil {
+	if a.flagJSON {
+		conflicts, err := a.client.Conflicts()
+		if conflicts == nil {
+			conflicts = []client.Conflict{}
+		}
+		a.result = conflicts
 		return err
 	}
-	args := ctx.Args().Slice()
-	if len(args) < 2 {
-		cli.ShowSubcommandHelp(ctx)
-		return nil
-	}
-	return a.client.RenameAlbum(args[:len(args)-1], args[len(args)-1])
+	return a.client.ListConflicts()
 }
 
-func (a *App) listFiles(ctx *cli.Context) error {
+func (a *App) freeFiles(ctx *cli.Context) error {
 	if err := a.init(ctx, true); err != nil {
 		return err
 	}
-	patterns := []string{""}
+	patterns := []string{"*"}
 	if ctx.Args().Len() > 0 {
 		patterns = ctx.Args().Slice()
 	}
-	opt := client.GlobOptions{}
-	if ctx.Bool("all") {
-		opt.MatchDot = true
+	patterns, exact, err := a.fileNames(ctx, patterns)
+	if err != nil {
+		return err
 	}
-	if ctx.Bool("long") {
-		opt.Long = true
+	opt := client.GlobOptions{
+		ExactMatch:    exact,
+		IncludeTrash:  ctx.Bool("include-trash"),
+		IncludeHidden: ctx.Bool("include-hidden"),
 	}
 	if ctx.Bool("recursive") {
 		opt.Recursive = true
 	}
-	if ctx.Bool("directory") {
-		opt.Directory = true
+	if err := a.confirm(ctx, "Free", patterns, opt, func(item client.ListItem) bool { return !item.LocalOnly }); err != nil {
+		return err
 	}
-	return a.client.ListFiles(patterns, opt)
+	n, err := a.client.Free(patterns, opt, ctx.Bool("force"))
+	a.result = countResult{n}
+	return err
 }
 
-func (a *App) copyFiles(ctx *cli.Context) error {
+func (a *App) regenThumbnails(ctx *cli.Context) error {
 	if err := a.init(ctx, true); err != nil {
 		return err
 	}
 	args := ctx.Args().Slice()
-	if len(args) < 2 {
+	if len(args) == 0 {
 		cli.ShowSubcommandHelp(ctx)
 		return nil
 	}
-	return a.client.Copy(args[:len(args)-1], args[len(args)-1], false)
+	opt := client.GlobOptions{Recursive: ctx.Bool("recursive")}
+	n, err := a.client.RegenerateThumbnails(args, opt)
+	a.result = countResult{n}
+	return err
 }
 
-func (a *App) moveFiles(ctx *cli.Context) error {
-	if err := a.init(ctx, true); err != nil {
+func (a *App) cacheLimit(ctx *cli.Context) error {
+	if err := a.init(ctx, false); err != nil {
 		return err
 	}
-	args := ctx.Args().Slice()
-	if len(args) < 2 {
+	switch ctx.Args().Len() {
+	case 0:
+	case 1:
+		limit, err := strconv.ParseInt(ctx.Args().Get(0), 10, 64)
+		if err != nil {
+			return err
+		}
+		if err := a.client.SetCacheLimit(limit); err != nil {
+			return err
+		}
+	default:
 		cli.ShowSubcommandHelp(ctx)
 		return nil
 	}
-	return a.client.Move(args[:len(args)-1], args[len(args)-1], false)
+	a.result = struct {
+		Limit int64 `json:"limit"`
+	}{a.client.CacheLimit}
+	switch {
+	case a.flagJSON:
+	case a.client.CacheLimit == 0:
+		a.client.Print("Cache limit: none")
+	default:
+		a.client.Printf("Cache limit: %d bytes\n", a.client.CacheLimit)
+	}
+	return nil
 }
 
-func (a *App) deleteFiles(ctx *cli.Context) error {
-	if err := a.init(ctx, true); err != nil {
-		return err
-	}
-	args := ctx.Args().Slice()
-	if len(args) == 0 {
-		cli.ShowSubcommandHelp(ctx)
-		return nil
-	}
-	return a.client.Delete(args, false)
+func (a *App) pinFiles(ctx *cli.Context) error {
+	return a.setPinned(ctx, true)
 }
 
-func (a *App) catFiles(ctx *cli.Context) error {
+func (a *App) unpinFiles(ctx *cli.Context) error {
+	return a.setPinned(ctx, false)
+}
+
+func (a *App) setPinned(ctx *cli.Context, pinned bool) error {
 	if err := a.init(ctx, true); err != nil {
 		return err
 	}
@@ -1108,40 +2033,677 @@ func (a *App) catFiles(ctx *cli.Context) error {
 		cli.ShowSubcommandHelp(ctx)
 		return nil
 	}
-	return a.client.Cat(args)
+	n, err := a.client.Pin(args, client.GlobOptions{}, pinned)
+	a.result = countResult{n}
+	return err
 }
 
-func (a *App) exportFiles(ctx *cli.Context) error {
+func (a *App) createAlbum(ctx *cli.Context) error {
 	if err := a.init(ctx, true); err != nil {
 		return err
 	}
-	args := ctx.Args().Slice()
-	if len(args) < 2 {
+	names := ctx.Args().Slice()
+	if len(names) == 0 {
 		cli.ShowSubcommandHelp(ctx)
 		return nil
 	}
-	patterns := args[:len(args)-1]
-	dir := args[len(args)-1]
-	_, err := a.client.ExportFiles(patterns, dir, ctx.Bool("recursive"))
-	return err
+	return a.client.AddAlbums(names)
 }
 
-func (a *App) importFiles(ctx *cli.Context) error {
+func (a *App) removeAlbum(ctx *cli.Context) error {
 	if err := a.init(ctx, true); err != nil {
 		return err
 	}
-	args := ctx.Args().Slice()
-	if len(args) < 2 {
+	patterns := ctx.Args().Slice()
+	if len(patterns) == 0 {
 		cli.ShowSubcommandHelp(ctx)
 		return nil
 	}
-	patterns := args[:len(args)-1]
-	dir := args[len(args)-1]
-	_, err := a.client.ImportFiles(patterns, dir, ctx.Bool("recursive"))
-	return err
+	if err := a.confirm(ctx, "Delete", patterns, client.GlobOptions{Recursive: true}, nil); err != nil {
+		return err
+	}
+	return a.client.RemoveAlbums(patterns)
 }
 
-func (a *App) shareAlbum(ctx *cli.Context) error {
+func (a *App) rename(ctx *cli.Context) error {
+	if err := a.init(ctx, true); err != nil {
+		return err
+	}
+	args := ctx.Args().Slice()
+	if len(args) < 2 {
+		cli.ShowSubcommandHelp(ctx)
+		return nil
+	}
+	if len(args) == 2 {
+		li, err := a.client.GlobFiles(args[:1], client.GlobOptions{Quiet: true})
+		if err != nil {
+			return err
+		}
+		if len(li) == 1 && !li[0].IsDir {
+			return a.client.RenameFile(args[0], args[1], false)
+		}
+	}
+	return a.client.RenameAlbum(args[:len(args)-1], args[len(args)-1])
+}
+
+func (a *App) lockAlbums(ctx *cli.Context) error {
+	return a.setAlbumsLocked(ctx, true)
+}
+
+func (a *App) unlockAlbums(ctx *cli.Context) error {
+	return a.setAlbumsLocked(ctx, false)
+}
+
+func (a *App) setAlbumsLocked(ctx *cli.Context, locked bool) error {
+	if err := a.init(ctx, true); err != nil {
+		return err
+	}
+	args := ctx.Args().Slice()
+	if len(args) == 0 {
+		cli.ShowSubcommandHelp(ctx)
+		return nil
+	}
+	li, err := a.client.GlobFiles(args, client.GlobOptions{})
+	if err != nil {
+		return err
+	}
+	n := 0
+	for _, item := range li {
+		if !item.IsDir || item.Album == nil {
+			continue
+		}
+		if err := a.client.SetAlbumLocked(item.Album.AlbumID, locked); err != nil {
+			return fmt.Errorf("%s: %w", item.Filename, err)
+		}
+		if locked {
+			a.client.Infof("Locked %s (not synced)\n", item.Filename)
+		} else {
+			a.client.Infof("Unlocked %s (not synced)\n", item.Filename)
+		}
+		n++
+	}
+	a.result = countResult{n}
+	if n == 0 {
+		return fmt.Errorf("%w: %s", client.ErrAlbumNotFound, strings.Join(args, " "))
+	}
+	return nil
+}
+
+func (a *App) setCover(ctx *cli.Context) error {
+	if err := a.init(ctx, true); err != nil {
+		return err
+	}
+	args := ctx.Args().Slice()
+	if (ctx.Bool("clear") && len(args) != 1) || (!ctx.Bool("clear") && len(args) != 2) {
+		cli.ShowSubcommandHelp(ctx)
+		return nil
+	}
+	li, err := a.client.GlobFiles(args[:1], client.GlobOptions{ExactMatch: true})
+	if err != nil {
+		return err
+	}
+	if len(li) != 1 || li[0].Album == nil {
+		return fmt.Errorf("%w: %s", client.ErrAlbumNotFound, args[0])
+	}
+	album := li[0]
+	if ctx.Bool("clear") {
+		return a.client.SetAlbumCover(album.Album.AlbumID, "")
+	}
+	fi, err := a.client.GlobFiles([]string{filepath.Join(album.Filename, args[1])}, client.GlobOptions{ExactMatchExceptLast: true})
+	if err != nil {
+		return err
+	}
+	if len(fi) != 1 || fi[0].IsDir {
+		return fmt.Errorf("%w: %s must match exactly one file", client.ErrFileNotFound, args[1])
+	}
+	return a.client.SetAlbumCover(album.Album.AlbumID, fi[0].FSFile.File)
+}
+
+func (a *App) listFiles(ctx *cli.Context) error {
+	match, err := client.ParseMatchMode(ctx.String("match"))
+	if err != nil {
+		return err
+	}
+	order, err := client.ParseSortOrder(ctx.String("sort"))
+	if err != nil {
+		return err
+	}
+	if err := a.init(ctx, true); err != nil {
+		return err
+	}
+	patterns := []string{""}
+	if ctx.Args().Len() > 0 {
+		patterns = ctx.Args().Slice()
+	}
+	opt := client.GlobOptions{
+		Match:         match,
+		Sort:          order,
+		IncludeTrash:  ctx.Bool("include-trash"),
+		IncludeHidden: ctx.Bool("include-hidden"),
+	}
+	if ctx.Bool("all") {
+		opt.MatchDot = true
+	}
+	if ctx.Bool("long") {
+		opt.Long = true
+	}
+	if ctx.Bool("recursive") {
+		opt.Recursive = true
+	}
+	if ctx.Bool("directory") {
+		opt.Directory = true
+	}
+	if a.flagJSON {
+		return a.listFilesJSON(patterns, opt)
+	}
+	return a.client.ListFiles(patterns, opt)
+}
+
+// countResult is the --json result of commands that process files.
+type countResult struct {
+	Files int `json:"files"`
+}
+
+// listFilesJSON sets the --json result of the ls command.
+func (a *App) listFilesJSON(patterns []string, opt client.GlobOptions) error {
+	for i := range patterns {
+		if patterns[i] == "" && opt.Match == client.MatchGlob {
+			patterns[i] = "*"
+		}
+	}
+	type entry struct {
+		Name        string `json:"name"`
+		IsDir       bool   `json:"isDir"`
+		Size        int64  `json:"size,omitempty"`
+		DirSize     int    `json:"dirSize,omitempty"`
+		DateCreated string `json:"dateCreated,omitempty"`
+		LocalOnly   bool   `json:"localOnly,omitempty"`
+		Pinned      bool   `json:"pinned,omitempty"`
+		Cover       bool   `json:"cover,omitempty"`
+	}
+	pl, err := a.client.Pins()
+	if err != nil {
+		return err
+	}
+	var items []client.ListItem
+	if err := a.client.IterateFiles(patterns, opt, func(item client.ListItem) error {
+		items = append(items, item)
+		return nil
+	}); err != nil {
+		return err
+	}
+	client.SortItems(items, opt.Sort)
+	entries := []entry{}
+	for _, item := range items {
+		entries = append(entries, entry{
+			Name:        item.Filename,
+			IsDir:       item.IsDir,
+			Size:        item.Size,
+			DirSize:     item.DirSize,
+			DateCreated: item.FSFile.DateCreated.String(),
+			LocalOnly:   item.LocalOnly,
+			Pinned:      pl.IsPinned(item),
+			Cover:       item.IsCover(),
+		})
+	}
+	a.result = entries
+	return nil
+}
+
+func (a *App) copyFiles(ctx *cli.Context) error {
+	if err := a.init(ctx, true); err != nil {
+		return err
+	}
+	args := ctx.Args().Slice()
+	if len(args) < 2 {
+		cli.ShowSubcommandHelp(ctx)
+		return nil
+	}
+	return a.client.Copy(args[:len(args)-1], args[len(args)-1], false)
+}
+
+func (a *App) moveFiles(ctx *cli.Context) error {
+	if err := a.init(ctx, true); err != nil {
+		return err
+	}
+	args := ctx.Args().Slice()
+	if len(args) < 2 {
+		cli.ShowSubcommandHelp(ctx)
+		return nil
+	}
+	return a.client.Move(args[:len(args)-1], args[len(args)-1], false)
+}
+
+func (a *App) deleteFiles(ctx *cli.Context) error {
+	if err := a.init(ctx, true); err != nil {
+		return err
+	}
+	args := ctx.Args().Slice()
+	if len(args) == 0 && !ctx.Bool("from-stdin") {
+		cli.ShowSubcommandHelp(ctx)
+		return nil
+	}
+	args, exact, err := a.fileNames(ctx, args)
+	if err != nil {
+		return err
+	}
+	if err := a.confirm(ctx, "Delete", args, client.GlobOptions{ExactMatch: exact}, nil); err != nil {
+		return err
+	}
+	return a.client.Delete(args, exact, ctx.Bool("force"))
+}
+
+// confirm asks the user to confirm a destructive action on the files that
+// match patterns, showing how many files and bytes are affected. Only the
+// files for which keep returns true are counted, if keep isn't nil. The
+// confirmation is skipped with --yes, and refused when there is nobody to ask.
+func (a *App) confirm(ctx *cli.Context, action string, patterns []string, opt client.GlobOptions, keep func(client.ListItem) bool) error {
+	if ctx.Bool("yes") {
+		return nil
+	}
+	opt.Quiet = true
+	li, err := a.client.GlobFiles(patterns, opt)
+	if err != nil {
+		return err
+	}
+	var count, size int64
+	for _, item := range li {
+		if item.IsDir || (keep != nil && !keep(item)) {
+			continue
+		}
+		count++
+		size += item.Size
+	}
+	if count == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("%s %d file(s) (%s)", action, count, client.HumanSize(size))
+	// With exact matches, the file names came from stdin.
+	if a.term == nil && (opt.ExactMatch || !term.IsTerminal(int(os.Stdin.Fd()))) {
+		return fmt.Errorf("%s: use --yes to confirm when not running interactively", msg)
+	}
+	reply, err := a.prompt(msg + "? [y/N] ")
+	if err != nil {
+		return err
+	}
+	if r := strings.ToLower(reply); r != "y" && r != "yes" {
+		return errors.New("not confirmed")
+	}
+	return nil
+}
+
+// fileNames returns the file patterns of a command, and whether they are exact
+// names. With --from-stdin, or when the only pattern is -, the exact names are
+// read from the standard input, one per line, and they must all exist.
+func (a *App) fileNames(ctx *cli.Context, patterns []string) ([]string, bool, error) {
+	if !ctx.Bool("from-stdin") && !(len(patterns) == 1 && patterns[0] == "-") {
+		return patterns, false, nil
+	}
+	if a.term != nil {
+		// The terminal is in raw mode and is used for commands.
+		return nil, false, errors.New("reading file names from stdin is not available in shell mode")
+	}
+	var names []string
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		if name := strings.TrimSuffix(scanner.Text(), "\r"); name != "" {
+			names = append(names, name)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, false, err
+	}
+	if _, err := a.client.ResolveNames(names); err != nil {
+		return nil, false, err
+	}
+	return names, true, nil
+}
+
+func (a *App) catFiles(ctx *cli.Context) error {
+	if err := a.init(ctx, true); err != nil {
+		return err
+	}
+	args := ctx.Args().Slice()
+	if len(args) == 0 {
+		cli.ShowSubcommandHelp(ctx)
+		return nil
+	}
+	return a.client.Cat(args)
+}
+
+func (a *App) exportFiles(ctx *cli.Context) error {
+	if err := a.init(ctx, true); err != nil {
+		return err
+	}
+	args := ctx.Args().Slice()
+	if len(args) < 2 && !(len(args) == 1 && ctx.Bool("from-stdin")) {
+		cli.ShowSubcommandHelp(ctx)
+		return nil
+	}
+	patterns, exact, err := a.fileNames(ctx, args[:len(args)-1])
+	if err != nil {
+		return err
+	}
+	dir := args[len(args)-1]
+	onConflict, err := client.ParseExportConflictPolicy(ctx.String("on-conflict"))
+	if err != nil {
+		return err
+	}
+	n, err := a.client.ExportFiles(patterns, dir, client.ExportOptions{
+		Recursive:  ctx.Bool("recursive"),
+		OnConflict: onConflict,
+		Manifest:   ctx.String("manifest"),
+		ExactMatch: exact,
+	})
+	a.result = countResult{n}
+	return err
+}
+
+func (a *App) fullBackup(ctx *cli.Context) error {
+	if err := a.init(ctx, true); err != nil {
+		return err
+	}
+	if ctx.Args().Len() != 1 {
+		cli.ShowSubcommandHelp(ctx)
+		return nil
+	}
+	var password string
+	if ctx.Bool("with-secret-key") {
+		var err error
+		if password, err = a.promptPass("Enter password: "); err != nil {
+			return err
+		}
+		password2, err := a.promptPass("Re-enter password: ")
+		if err != nil {
+			return err
+		}
+		if password != password2 {
+			return errors.New("passwords do not match")
+		}
+		if password == "" {
+			return errors.New("password is empty")
+		}
+	}
+	n, err := a.client.FullBackup(ctx.Args().Get(0), password)
+	a.result = countResult{n}
+	return err
+}
+
+func (a *App) fullRestore(ctx *cli.Context) error {
+	if err := a.init(ctx, true); err != nil {
+		return err
+	}
+	if ctx.Args().Len() != 1 {
+		cli.ShowSubcommandHelp(ctx)
+		return nil
+	}
+	dir := ctx.Args().Get(0)
+	n, err := a.client.FullRestore(dir, "")
+	if errors.Is(err, client.ErrBackupPasswordRequired) {
+		var password string
+		if password, err = a.promptPass("Enter backup password: "); err != nil {
+			return err
+		}
+		n, err = a.client.FullRestore(dir, password)
+	}
+	a.result = countResult{n}
+	return err
+}
+
+func (a *App) exportAlbumBundle(ctx *cli.Context) error {
+	if err := a.init(ctx, true); err != nil {
+		return err
+	}
+	if ctx.Args().Len() != 2 {
+		cli.ShowSubcommandHelp(ctx)
+		return nil
+	}
+	opts := client.AlbumBundleOptions{
+		Recipient: ctx.String("recipient"),
+	}
+	if ctx.Bool("with-passphrase") {
+		passphrase, err := a.promptPass("Enter passphrase: ")
+		if err != nil {
+			return err
+		}
+		passphrase2, err := a.promptPass("Re-enter passphrase: ")
+		if err != nil {
+			return err
+		}
+		if passphrase != passphrase2 {
+			return errors.New("passphrases do not match")
+		}
+		if passphrase == "" {
+			return errors.New("passphrase is empty")
+		}
+		opts.Passphrase = []byte(passphrase)
+	}
+	n, err := a.client.ExportAlbumBundle(ctx.Args().Get(0), ctx.Args().Get(1), opts)
+	a.result = countResult{n}
+	return err
+}
+
+func (a *App) importAlbumBundle(ctx *cli.Context) error {
+	if err := a.init(ctx, true); err != nil {
+		return err
+	}
+	if n := ctx.Args().Len(); n != 1 && n != 2 {
+		cli.ShowSubcommandHelp(ctx)
+		return nil
+	}
+	in, name := ctx.Args().Get(0), ctx.Args().Get(1)
+	n, err := a.client.ImportAlbumBundle(in, name, nil)
+	if errors.Is(err, client.ErrPassphraseRequired) {
+		var passphrase string
+		if passphrase, err = a.promptPass("Enter passphrase: "); err != nil {
+			return err
+		}
+		n, err = a.client.ImportAlbumBundle(in, name, []byte(passphrase))
+	}
+	a.result = countResult{n}
+	return err
+}
+
+func (a *App) exportMetadata(ctx *cli.Context) error {
+	if err := a.init(ctx, true); err != nil {
+		return err
+	}
+	args := ctx.Args().Slice()
+	if len(args) < 2 {
+		cli.ShowSubcommandHelp(ctx)
+		return nil
+	}
+	n, err := a.client.ExportMetadata(args[:len(args)-1], args[len(args)-1], client.GlobOptions{Recursive: ctx.Bool("recursive")})
+	a.result = countResult{n}
+	return err
+}
+
+func (a *App) streamIndex(ctx *cli.Context) error {
+	if err := a.init(ctx, true); err != nil {
+		return err
+	}
+	if ctx.Args().Len() != 0 || !ctx.Bool("ndjson") {
+		cli.ShowSubcommandHelp(ctx)
+		return nil
+	}
+	n, err := a.client.StreamIndex(a.cli.Writer)
+	a.result = countResult{n}
+	return err
+}
+
+func (a *App) verifyExport(ctx *cli.Context) error {
+	if err := a.init(ctx, false); err != nil {
+		return err
+	}
+	args := ctx.Args().Slice()
+	if len(args) != 2 {
+		cli.ShowSubcommandHelp(ctx)
+		return nil
+	}
+	n, err := a.client.VerifyExport(args[0], args[1])
+	a.result = countResult{n}
+	return err
+}
+
+func (a *App) importFiles(ctx *cli.Context) error {
+	if err := a.init(ctx, true); err != nil {
+		return err
+	}
+	args := ctx.Args().Slice()
+	if len(args) < 2 {
+		cli.ShowSubcommandHelp(ctx)
+		return nil
+	}
+	patterns := args[:len(args)-1]
+	dir := args[len(args)-1]
+	opts := client.ImportOptions{
+		Recursive:         ctx.Bool("recursive"),
+		DateFromMtime:     ctx.Bool("date-from-mtime"),
+		MaxDimension:      ctx.Int("max-dimension"),
+		FollowSymlinks:    ctx.Bool("follow-symlinks"),
+		DeleteSource:      ctx.Bool("delete-source"),
+		DeleteAfterUpload: ctx.Bool("delete-after-upload"),
+		Dates:             make(map[string]time.Time),
+	}
+	if m := ctx.String("date-manifest"); m != "" {
+		dates, err := client.ReadDateManifest(m)
+		if err != nil {
+			return err
+		}
+		opts.Dates = dates
+	}
+	for _, d := range ctx.StringSlice("date") {
+		i := strings.LastIndex(d, "=")
+		if i <= 0 {
+			return fmt.Errorf("invalid --date value, expected <file>=<date>: %q", d)
+		}
+		t, err := client.ParseImportDate(d[i+1:])
+		if err != nil {
+			return err
+		}
+		opts.Dates[d[:i]] = t
+	}
+	// Ctrl-C stops the import. The files that were already encrypted are
+	// kept.
+	c, stop := a.interruptContext(ctx.Context)
+	defer stop()
+	n, err := a.client.ImportFilesWithOptionsContext(c, patterns, dir, opts)
+	a.result = countResult{n}
+	if c.Err() != nil {
+		return fmt.Errorf("interrupted after importing %d file(s): %w", n, context.Canceled)
+	}
+	return err
+}
+
+func (a *App) watch(ctx *cli.Context) error {
+	if err := a.init(ctx, true); err != nil {
+		return err
+	}
+	args := ctx.Args().Slice()
+	if len(args) != 2 {
+		cli.ShowSubcommandHelp(ctx)
+		return nil
+	}
+	if a.term != nil {
+		// The terminal is in raw mode. There is no way to interrupt.
+		return errors.New("watch is not available in shell mode")
+	}
+	c, cancel := signal.NotifyContext(ctx.Context, os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	return a.client.Watch(c, args[0], args[1])
+}
+
+func (a *App) encryptFile(ctx *cli.Context) error {
+	if err := a.init(ctx, false); err != nil {
+		return err
+	}
+	if ctx.Args().Len() != 2 {
+		cli.ShowSubcommandHelp(ctx)
+		return nil
+	}
+	var passphrase string
+	if ctx.Bool("with-passphrase") {
+		var err error
+		if passphrase, err = a.promptPass("Enter passphrase: "); err != nil {
+			return err
+		}
+		passphrase2, err := a.promptPass("Re-enter passphrase: ")
+		if err != nil {
+			return err
+		}
+		if passphrase != passphrase2 {
+			return errors.New("passphrases do not match")
+		}
+		if passphrase == "" {
+			return errors.New("passphrase is empty")
+		}
+	}
+	return a.client.EncryptLocalFile(ctx.Args().Get(0), ctx.Args().Get(1), []byte(passphrase))
+}
+
+func (a *App) decryptFile(ctx *cli.Context) error {
+	if err := a.init(ctx, false); err != nil {
+		return err
+	}
+	if ctx.Args().Len() != 2 {
+		cli.ShowSubcommandHelp(ctx)
+		return nil
+	}
+	in, out := ctx.Args().Get(0), ctx.Args().Get(1)
+	err := a.client.DecryptLocalFile(in, out, nil)
+	if errors.Is(err, client.ErrPassphraseRequired) {
+		var passphrase string
+		if passphrase, err = a.promptPass("Enter passphrase: "); err != nil {
+			return err
+		}
+		err = a.client.DecryptLocalFile(in, out, []byte(passphrase))
+	}
+	return err
+}
+
+func (a *App) reshard(ctx *cli.Context) error {
+	if err := a.init(ctx, false); err != nil {
+		return err
+	}
+	if ctx.Args().Len() != 1 {
+		cli.ShowSubcommandHelp(ctx)
+		return nil
+	}
+	depth, err := strconv.Atoi(ctx.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	n, err := a.client.ReshardBlobs(depth)
+	a.result = countResult{n}
+	return err
+}
+
+func (a *App) dump(ctx *cli.Context) error {
+	if err := a.init(ctx, false); err != nil {
+		return err
+	}
+	if ctx.Args().Len() != 1 {
+		cli.ShowSubcommandHelp(ctx)
+		return nil
+	}
+	return a.client.DumpFile(ctx.Args().Get(0))
+}
+
+func (a *App) rawUpdates(ctx *cli.Context) error {
+	if err := a.init(ctx, false); err != nil {
+		return err
+	}
+	if ctx.Args().Len() > 1 {
+		cli.ShowSubcommandHelp(ctx)
+		return nil
+	}
+	return a.client.RawUpdates(client.RawUpdatesOptions{
+		Cursor:    ctx.Args().Get(0),
+		FromStart: ctx.Bool("from-start"),
+	})
+}
+
+func (a *App) shareAlbum(ctx *cli.Context) error {
 	if err := a.init(ctx, true); err != nil {
 		return err
 	}
@@ -1159,6 +2721,13 @@ func (a *App) shareAlbum(ctx *cli.Context) error {
 	return a.client.Share(pattern, emails, perms)
 }
 
+func (a *App) completeShares(ctx *cli.Context) error {
+	if err := a.init(ctx, true); err != nil {
+		return err
+	}
+	return a.client.CompletePendingShares()
+}
+
 func (a *App) unshareAlbum(ctx *cli.Context) error {
 	if err := a.init(ctx, true); err != nil {
 		return err
@@ -1168,7 +2737,7 @@ func (a *App) unshareAlbum(ctx *cli.Context) error {
 		cli.ShowSubcommandHelp(ctx)
 		return nil
 	}
-	return a.client.Unshare(args)
+	return a.client.Unshare(args, ctx.Bool("rotate-key"))
 }
 
 func (a *App) leaveAlbum(ctx *cli.Context) error {
@@ -1194,7 +2763,7 @@ func (a *App) removeMember(ctx *cli.Context) error {
 	}
 	pattern := args[0]
 	emails := args[1:]
-	return a.client.RemoveMembers(pattern, emails)
+	return a.client.RemoveMembers(pattern, emails, ctx.Bool("rotate-key"))
 }
 
 func (a *App) changePermissions(ctx *cli.Context) error {
@@ -1211,6 +2780,52 @@ func (a *App) changePermissions(ctx *cli.Context) error {
 	return a.client.ChangePermissions(patterns, perms)
 }
 
+func (a *App) albumMembers(ctx *cli.Context) error {
+	if err := a.init(ctx, true); err != nil {
+		return err
+	}
+	if ctx.Args().Len() != 1 {
+		cli.ShowSubcommandHelp(ctx)
+		return nil
+	}
+	members, err := a.client.AlbumMembers(ctx.Args().First())
+	if err != nil {
+		return err
+	}
+	a.result = members
+	if len(members) == 0 {
+		a.client.Print("Not shared.")
+		return nil
+	}
+	maxSize := 5
+	for _, m := range members {
+		if len(m.Email) > maxSize {
+			maxSize = len(m.Email)
+		}
+	}
+	a.client.Printf("%*s %s\n", -maxSize, "Email", "Permissions")
+	for _, m := range members {
+		perms := "Owner"
+		if !m.IsOwner {
+			perms = m.Permissions.Human()
+		}
+		a.client.Printf("%*s %s\n", -maxSize, m.Email, perms)
+	}
+	return nil
+}
+
+func (a *App) setPermissions(ctx *cli.Context) error {
+	if err := a.init(ctx, true); err != nil {
+		return err
+	}
+	args := ctx.Args().Slice()
+	if len(args) != 2 {
+		cli.ShowSubcommandHelp(ctx)
+		return nil
+	}
+	return a.client.SetMemberPermissions(args[0], args[1], ctx.Bool("add"), ctx.Bool("share"), ctx.Bool("copy"))
+}
+
 func (a *App) listContacts(ctx *cli.Context) error {
 	if err := a.init(ctx, true); err != nil {
 		return err
@@ -1285,6 +2900,51 @@ func (a *App) webServerConfig(ctx *cli.Context) error {
 	return a.client.Save()
 }
 
+func (a *App) webDAV(ctx *cli.Context) error {
+	if err := a.init(ctx, true); err != nil {
+		return err
+	}
+	if args := ctx.Args().Slice(); len(args) > 0 {
+		cli.ShowSubcommandHelp(ctx)
+		return nil
+	}
+	handler := webdav.NewHandler(a.client)
+	if fn := ctx.String("htdigest"); fn != "" {
+		ba, err := basicauth.New(fn)
+		if err != nil {
+			return err
+		}
+		handler = ba.Handler("c2FmZQ", handler)
+	}
+	srv := &http.Server{
+		Addr:              ctx.String("address"),
+		Handler:           handler,
+		ReadHeaderTimeout: 30 * time.Second,
+		ErrorLog:          log.GoLogger(),
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGINT)
+		signal.Notify(ch, syscall.SIGTERM)
+		sig := <-ch
+		log.Infof("Received signal %d (%s)", sig, sig)
+		if err := srv.Shutdown(context.Background()); err != nil {
+			log.Errorf("srv.Shutdown: %v", err)
+		}
+		close(done)
+	}()
+
+	log.Infof("Starting WebDAV server on %s", srv.Addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	<-done
+	log.Info("Server exited cleanly.")
+	return nil
+}
+
 func (a *App) webServer(ctx *cli.Context) error {
 	if err := a.init(ctx, true); err != nil {
 		return err
@@ -0,0 +1,144 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli/v2" // cli
+
+	"c2FmZQ/internal/client"
+	"c2FmZQ/internal/log"
+)
+
+// The time to wait before retrying after the first failure. It doubles after
+// each consecutive failure, up to --max-backoff.
+const daemonMinBackoff = 30 * time.Second
+
+// daemonStatus is the state of the daemon, reported with statusSignal.
+type daemonStatus struct {
+	mu       sync.Mutex
+	started  time.Time
+	lastOK   time.Time
+	lastErr  error
+	failures int
+	next     time.Time
+}
+
+func (s *daemonStatus) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := fmt.Sprintf("Running since %s\n", s.started.Format(time.RFC3339))
+	if s.lastOK.IsZero() {
+		out += "Last successful sync: never\n"
+	} else {
+		out += fmt.Sprintf("Last successful sync: %s\n", s.lastOK.Format(time.RFC3339))
+	}
+	if s.failures > 0 {
+		out += fmt.Sprintf("Consecutive failures: %d, last error: %v\n", s.failures, s.lastErr)
+	}
+	out += fmt.Sprintf("Next sync: %s\n", s.next.Format(time.RFC3339))
+	return out
+}
+
+func (a *App) daemon(ctx *cli.Context) error {
+	if err := a.init(ctx, false); err != nil {
+		return err
+	}
+	if a.client.Account == nil {
+		return fmt.Errorf("%w: daemon requires logging in to a remote server", client.ErrNotLoggedIn)
+	}
+	if a.term != nil {
+		return errors.New("daemon is not available in shell mode")
+	}
+	interval := ctx.Duration("interval")
+	maxBackoff := ctx.Duration("max-backoff")
+	if interval <= 0 || maxBackoff <= 0 {
+		return errors.New("--interval and --max-backoff must be positive")
+	}
+	pull := ctx.StringSlice("pull")
+
+	c, cancel := signal.NotifyContext(ctx.Context, os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	status := &daemonStatus{started: time.Now()}
+	if sig := statusSignal(); sig != nil {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, sig)
+		defer signal.Stop(ch)
+		go func() {
+			for range ch {
+				a.client.Print(status.String())
+			}
+		}()
+	}
+
+	for {
+		err := a.daemonSync(pull)
+		delay := interval
+		status.mu.Lock()
+		if err == nil {
+			status.lastOK = time.Now()
+			status.failures = 0
+		} else {
+			status.failures++
+			status.lastErr = err
+			delay = daemonMinBackoff
+			for i := 1; i < status.failures && delay < maxBackoff; i++ {
+				delay *= 2
+			}
+			if delay > maxBackoff {
+				delay = maxBackoff
+			}
+			log.Errorf("Sync failed (%d): %v", status.failures, err)
+		}
+		status.next = time.Now().Add(delay)
+		status.mu.Unlock()
+		if errors.Is(err, client.ErrNotLoggedIn) {
+			return err
+		}
+		select {
+		case <-c.Done():
+			return nil
+		case <-time.After(delay):
+		}
+	}
+}
+
+// daemonSync pulls metadata updates, uploads local changes, and downloads the
+// files that match the pull patterns.
+func (a *App) daemonSync(pull []string) error {
+	if err := a.client.GetUpdates(true); err != nil {
+		return err
+	}
+	if err := a.client.Sync(false); err != nil {
+		return err
+	}
+	if len(pull) > 0 {
+		if _, err := a.client.Pull(pull, client.GlobOptions{Recursive: true}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -38,5 +38,5 @@ func (a *App) mount(ctx *cli.Context) error {
 		cli.ShowSubcommandHelp(ctx)
 		return nil
 	}
-	return fuse.Mount(a.client, ctx.Args().Get(0), ctx.Bool("read-only"))
+	return fuse.Mount(a.client, ctx.Args().Get(0), ctx.Bool("read-only"), ctx.Int64("cache-size")<<20)
 }
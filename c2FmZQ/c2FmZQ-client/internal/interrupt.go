@@ -0,0 +1,59 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// interruptContext returns a context that is canceled when the process
+// receives SIGINT, e.g. when the user presses Ctrl-C, or SIGTERM. Long
+// operations use it to stop cleanly: the blobs being written are either
+// committed or removed, and the file sets that were already updated are
+// saved. After the first signal, the default behavior is restored so that a
+// second Ctrl-C quits immediately.
+//
+// The returned function must be called when the operation is done.
+func (a *App) interruptContext(ctx context.Context) (context.Context, func()) {
+	c, cancel := context.WithCancel(ctx)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			signal.Stop(ch)
+			close(done)
+			cancel()
+		})
+	}
+	go func() {
+		select {
+		case <-ch:
+			signal.Stop(ch)
+			a.client.Print("\nInterrupted. Stopping cleanly, press Ctrl-C again to quit now.")
+			cancel()
+		case <-done:
+		}
+	}()
+	return c, stop
+}
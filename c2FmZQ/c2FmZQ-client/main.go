@@ -23,8 +23,11 @@
 package main
 
 import (
+	"errors"
 	"os"
 
+	"github.com/urfave/cli/v2" // cli
+
 	"c2FmZQ/c2FmZQ-client/internal"
 	"c2FmZQ/internal/log"
 )
@@ -32,6 +35,11 @@ import (
 func main() {
 	app := internal.New()
 	if err := app.Run(os.Args); err != nil {
-		log.Fatal(err)
+		log.Error(err)
+		var exitErr cli.ExitCoder
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.ExitCode())
+		}
+		os.Exit(1)
 	}
 }
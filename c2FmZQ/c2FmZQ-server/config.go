@@ -0,0 +1,80 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v2" // cli
+)
+
+// secretFlags are the flags whose values are never shown.
+var secretFlags = []string{"passphrase", "smtp-password"}
+
+// printConfig shows the effective value of all the flags, and where each value
+// comes from, i.e. the command line, an environment variable, or the default.
+func printConfig(w io.Writer, c *cli.Context, args []string) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SETTING\tVALUE\tSOURCE")
+	for _, f := range c.App.Flags {
+		name := f.Names()[0]
+		if name == "licenses" || name == "print-config" {
+			continue
+		}
+		value := fmt.Sprint(c.Value(name))
+		if slices.Contains(secretFlags, name) && value != "" {
+			value = "<redacted>"
+		}
+		fmt.Fprintf(tw, "--%s\t%s\t%s\n", name, value, flagSource(f, args))
+	}
+	tls := "off"
+	switch {
+	case flagAutocertDomain != "":
+		tls = "autocert (" + flagAutocertDomain + ")"
+	case flagTLSCert != "":
+		tls = "on (" + flagTLSCert + ")"
+	}
+	fmt.Fprintf(tw, "TLS\t%s\t\n", tls)
+	return tw.Flush()
+}
+
+// flagSource returns where the value of f comes from.
+func flagSource(f cli.Flag, args []string) string {
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if strings.HasPrefix(arg, "-") && slices.Contains(f.Names(), name) {
+			return "command line"
+		}
+	}
+	if df, ok := f.(cli.DocGenerationFlag); ok {
+		for _, env := range df.GetEnvVars() {
+			if _, ok := os.LookupEnv(env); ok {
+				return "$" + env
+			}
+		}
+	}
+	return "default"
+}
@@ -29,8 +29,10 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/c2FmZQ/storage"
 	"github.com/c2FmZQ/storage/crypto"
@@ -51,6 +53,7 @@ var (
 	flagPassphraseFile string
 	flagPassphraseCmd  string
 	flagPassphrase     string
+	flagBlobDir        string
 )
 
 func main() {
@@ -101,6 +104,14 @@ func main() {
 				EnvVars:     []string{"C2FMZQ_PASSPHRASE"},
 				Destination: &flagPassphrase,
 			},
+			&cli.StringFlag{
+				Name:        "blob-dir",
+				Value:       "",
+				Usage:       "The directory where the blobs are stored, if the server uses --blob-dir.",
+				EnvVars:     []string{"C2FMZQ_BLOB_DIR"},
+				TakesFile:   true,
+				Destination: &flagBlobDir,
+			},
 		},
 		Commands: []*cli.Command{
 			&cli.Command{
@@ -210,6 +221,23 @@ func main() {
 					},
 				},
 			},
+			&cli.Command{
+				Name:     "gc",
+				Category: "System",
+				Usage:    "Find blobs that aren't referenced by any file set, and the leftovers of interrupted uploads.",
+				Action:   collectGarbage,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "delete",
+						Usage: "Delete the unreferenced blobs.",
+					},
+					&cli.DurationFlag{
+						Name:  "min-age",
+						Value: 24 * time.Hour,
+						Usage: "Ignore the blobs modified more recently than this. They may belong to uploads in progress if the server is running.",
+					},
+				},
+			},
 			&cli.Command{
 				Name:     "change-passphrase",
 				Category: "System",
@@ -246,6 +274,24 @@ func main() {
 					},
 				},
 			},
+			&cli.Command{
+				Name:     "rotate-token-keys",
+				Category: "System",
+				Usage:    "Replace the keys used to issue tokens. The tokens issued with the old keys remain valid until they expire.",
+				Action:   rotateTokenKeys,
+				Flags: []cli.Flag{
+					&cli.Int64Flag{
+						Name:    "userid",
+						Usage:   "Only rotate the key of this userid.",
+						Aliases: []string{"u"},
+					},
+					&cli.DurationFlag{
+						Name:  "max-token-age",
+						Value: 180 * 24 * time.Hour,
+						Usage: "How long the old keys remain valid. This must be at least the lifetime of the tokens.",
+					},
+				},
+			},
 			&cli.Command{
 				Name:     "approve",
 				Category: "Users",
@@ -259,6 +305,22 @@ func main() {
 					},
 				},
 			},
+			&cli.Command{
+				Name:     "invite-codes",
+				Category: "Users",
+				Usage:    "Show, add, or create account invite codes.",
+				Action:   inviteCodes,
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:  "create",
+						Usage: "Create `N` new random invite codes.",
+					},
+					&cli.StringSliceFlag{
+						Name:  "add",
+						Usage: "Add this invite code. Can be repeated.",
+					},
+				},
+			},
 			&cli.Command{
 				Name:     "rename",
 				Category: "Users",
@@ -340,7 +402,11 @@ func initDB(c *cli.Context) (*database.Database, error) {
 	if err != nil {
 		return nil, err
 	}
-	return database.New(flagDatabase, pass), nil
+	db := database.New(flagDatabase, pass)
+	if flagBlobDir != "" {
+		db.SetBlobStore(database.NewFileBlobStore(flagBlobDir))
+	}
+	return db, nil
 }
 
 func createParent(filename string) {
@@ -399,6 +465,30 @@ func findOrphanFiles(c *cli.Context) error {
 	return db.FindOrphanFiles(c.Bool("delete"))
 }
 
+func collectGarbage(c *cli.Context) error {
+	db, err := initDB(c)
+	if err != nil {
+		return err
+	}
+	del := c.Bool("delete")
+	res, err := db.CollectGarbage(del, c.Duration("min-age"))
+	if err != nil {
+		return err
+	}
+	for _, o := range res.Orphans {
+		fmt.Printf("%s %d %s\n", o.Name, o.Size, o.ModTime.Format(time.RFC3339))
+	}
+	if res.Skipped > 0 {
+		fmt.Printf("Skipped %d recent unreferenced blob(s)\n", res.Skipped)
+	}
+	if del {
+		fmt.Printf("Deleted %d blob(s), reclaimed %d bytes\n", len(res.Orphans), res.Bytes)
+	} else {
+		fmt.Printf("Found %d unreferenced blob(s), %d bytes. Use --delete to delete them.\n", len(res.Orphans), res.Bytes)
+	}
+	return nil
+}
+
 func cryptoOptions() []crypto.Option {
 	opts := []crypto.Option{
 		crypto.WithAlgo(crypto.PickFastest),
@@ -663,6 +753,11 @@ func changeMasterKey(c *cli.Context) error {
 		if err != nil {
 			return err
 		}
+		for i := range u.OldTokenKeys {
+			if u.OldTokenKeys[i].Key, err = reEncryptString(u.OldTokenKeys[i].Key); err != nil {
+				return err
+			}
+		}
 		for _, v := range u.Decoys {
 			np, err := reEncryptString(v.Password)
 			if err != nil {
@@ -678,6 +773,24 @@ func changeMasterKey(c *cli.Context) error {
 	return nil
 }
 
+func rotateTokenKeys(c *cli.Context) error {
+	db, err := initDB(c)
+	if err != nil {
+		return err
+	}
+	maxAge := c.Duration("max-token-age")
+	if id := c.Int64("userid"); id > 0 {
+		if err := db.RotateTokenKey(id, maxAge); err != nil {
+			return err
+		}
+		log.Infof("Rotated token key of user %d", id)
+		return nil
+	}
+	n, err := db.RotateTokenKeys(maxAge)
+	log.Infof("Rotated token keys of %d users", n)
+	return err
+}
+
 func approveUser(c *cli.Context) error {
 	db, err := initDB(c)
 	if err != nil {
@@ -690,6 +803,40 @@ func approveUser(c *cli.Context) error {
 	return db.ApproveUser(id)
 }
 
+func inviteCodes(c *cli.Context) error {
+	db, err := initDB(c)
+	if err != nil {
+		return err
+	}
+	if add := c.StringSlice("add"); len(add) > 0 {
+		if err := db.AddInviteCodes(add); err != nil {
+			return err
+		}
+	}
+	if n := c.Int("create"); n > 0 {
+		if _, err := db.NewInviteCodes(n); err != nil {
+			return err
+		}
+	}
+	codes, err := db.InviteCodes()
+	if err != nil {
+		return err
+	}
+	var list []string
+	for code, ic := range codes {
+		if ic.DateUsed == 0 {
+			list = append(list, fmt.Sprintf("%s unused", code))
+			continue
+		}
+		list = append(list, fmt.Sprintf("%s used by %s", code, ic.UsedBy))
+	}
+	sort.Strings(list)
+	for _, l := range list {
+		fmt.Println(l)
+	}
+	return nil
+}
+
 func renameUser(c *cli.Context) error {
 	db, err := initDB(c)
 	if err != nil {
@@ -943,6 +1090,7 @@ func changeUserDecoy(c *cli.Context) error {
 				return err
 			}
 			du.TokenKey = etk
+			du.OldTokenKeys = nil
 			if err := db.UpdateUser(du); err != nil {
 				return err
 			}
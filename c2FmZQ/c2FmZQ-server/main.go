@@ -28,21 +28,25 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/urfave/cli/v2" // cli
 
 	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/fileperm"
 	"c2FmZQ/internal/log"
 	"c2FmZQ/internal/pp"
 	"c2FmZQ/internal/server"
+	"c2FmZQ/internal/server/limit"
 	"c2FmZQ/licenses"
 )
 
 var (
 	flagDatabase                string
 	flagAddress                 string
+	flagListen                  string
 	flagBaseURL                 string
 	flagRedirect404             string
 	flagPathPrefix              string
@@ -50,7 +54,11 @@ var (
 	flagTLSKey                  string
 	flagAllowNewAccounts        bool
 	flagsAutoApproveNewAccounts bool
+	flagRequireInviteCode       bool
 	flagLogLevel                int
+	flagLogFile                 string
+	flagLogMaxSize              int
+	flagLogFormat               string
 	flagPassphraseFile          string
 	flagPassphraseCmd           string
 	flagPassphrase              string
@@ -58,7 +66,25 @@ var (
 	flagAutocertDomain          string
 	flagAutocertAddr            string
 	flagMaxConcurrentRequests   int
+	flagIPRateLimit             int
+	flagIPBanFailures           int
+	flagIPBanDuration           time.Duration
+	flagClientIPHeader          string
+	flagForwardedHostHeader     string
+	flagForwardedProtoHeader    string
+	flagUserAgentMetrics        bool
 	flagEnableWebApp            bool
+	flagAllowedOrigins          string
+	flagBlobShardDepth          int
+	flagBlobDir                 string
+	flagBlobMode                string
+	flagBlobGroup               string
+	flagRequireSignedRequests   bool
+	flagEnablePasswordReset     bool
+	flagSMTPAddr                string
+	flagSMTPUsername            string
+	flagSMTPPassword            string
+	flagSMTPFrom                string
 )
 
 func main() {
@@ -85,10 +111,17 @@ func main() {
 				Name:        "address",
 				Aliases:     []string{"addr"},
 				Value:       "127.0.0.1:8080",
-				Usage:       "The local address to use.",
+				Usage:       "The local address to use, e.g. 127.0.0.1:8080, [::1]:8080, or :8080 for all the interfaces (IPv4 and IPv6).",
 				EnvVars:     []string{"C2FMZQ_ADDRESS"},
 				Destination: &flagAddress,
 			},
+			&cli.StringFlag{
+				Name:        "listen",
+				Value:       "",
+				Usage:       "A comma-separated list of local addresses to use, e.g. 127.0.0.1:8080,[::1]:8080. When set, it is used instead of --address.",
+				EnvVars:     []string{"C2FMZQ_LISTEN"},
+				Destination: &flagListen,
+			},
 			&cli.StringFlag{
 				Name:        "path-prefix",
 				Value:       "",
@@ -153,6 +186,13 @@ func main() {
 				EnvVars:     []string{"C2FMZQ_AUTO_APPROVE_NEW_ACCOUNTS"},
 				Destination: &flagsAutoApproveNewAccounts,
 			},
+			&cli.BoolFlag{
+				Name:        "require-invite-code",
+				Value:       false,
+				Usage:       "New account registrations require a single-use invite code. Use the inspect command to create codes.",
+				EnvVars:     []string{"C2FMZQ_REQUIRE_INVITE_CODE"},
+				Destination: &flagRequireInviteCode,
+			},
 			&cli.IntFlag{
 				Name:        "verbose",
 				Aliases:     []string{"v"},
@@ -162,6 +202,28 @@ func main() {
 				EnvVars:     []string{"C2FMZQ_VERBOSE"},
 				Destination: &flagLogLevel,
 			},
+			&cli.StringFlag{
+				Name:        "log-file",
+				Value:       "",
+				Usage:       "Write the logs to `FILE` instead of stderr. The file is rotated when it reaches --log-max-size.",
+				EnvVars:     []string{"C2FMZQ_LOG_FILE"},
+				TakesFile:   true,
+				Destination: &flagLogFile,
+			},
+			&cli.IntFlag{
+				Name:        "log-max-size",
+				Value:       100,
+				Usage:       "The maximum size of the log file in MB before it is rotated.",
+				EnvVars:     []string{"C2FMZQ_LOG_MAX_SIZE"},
+				Destination: &flagLogMaxSize,
+			},
+			&cli.StringFlag{
+				Name:        "log-format",
+				Value:       "text",
+				Usage:       "The format of the logs: text or json.",
+				EnvVars:     []string{"C2FMZQ_LOG_FORMAT"},
+				Destination: &flagLogFormat,
+			},
 			&cli.StringFlag{
 				Name:        "passphrase-command",
 				Value:       "",
@@ -197,6 +259,123 @@ func main() {
 				EnvVars:     []string{"C2FMZQ_MAX_CONCURRENT_REQUESTS"},
 				Destination: &flagMaxConcurrentRequests,
 			},
+			&cli.IntFlag{
+				Name:        "ip-rate-limit",
+				Value:       20,
+				Usage:       "The maximum number of unauthenticated requests per minute from each IP address, e.g. login or account creation. 0 means no limit.",
+				EnvVars:     []string{"C2FMZQ_IP_RATE_LIMIT"},
+				Destination: &flagIPRateLimit,
+			},
+			&cli.IntFlag{
+				Name:        "ip-ban-failures",
+				Value:       10,
+				Usage:       "The number of failed unauthenticated requests after which an IP address is temporarily banned.",
+				EnvVars:     []string{"C2FMZQ_IP_BAN_FAILURES"},
+				Destination: &flagIPBanFailures,
+			},
+			&cli.DurationFlag{
+				Name:        "ip-ban-duration",
+				Value:       15 * time.Minute,
+				Usage:       "How long IP addresses are banned after too many failed requests.",
+				EnvVars:     []string{"C2FMZQ_IP_BAN_DURATION"},
+				Destination: &flagIPBanDuration,
+			},
+			&cli.StringFlag{
+				Name:        "client-ip-header",
+				Value:       "",
+				Usage:       "The HTTP `HEADER` that contains the client IP address, e.g. X-Forwarded-For. Only use this behind a trusted reverse proxy that sets it.",
+				EnvVars:     []string{"C2FMZQ_CLIENT_IP_HEADER"},
+				Destination: &flagClientIPHeader,
+			},
+			&cli.StringFlag{
+				Name:        "forwarded-host-header",
+				Value:       "",
+				Usage:       "The HTTP `HEADER` that contains the host name used by the clients, e.g. X-Forwarded-Host. It is used in the download links when --base-url is empty. Only use this behind a trusted reverse proxy that sets it.",
+				EnvVars:     []string{"C2FMZQ_FORWARDED_HOST_HEADER"},
+				Destination: &flagForwardedHostHeader,
+			},
+			&cli.StringFlag{
+				Name:        "forwarded-proto-header",
+				Value:       "",
+				Usage:       "The HTTP `HEADER` that contains the scheme used by the clients, e.g. X-Forwarded-Proto. It is used in the download links when --base-url is empty. Only use this behind a trusted reverse proxy that sets it.",
+				EnvVars:     []string{"C2FMZQ_FORWARDED_PROTO_HEADER"},
+				Destination: &flagForwardedProtoHeader,
+			},
+			&cli.BoolFlag{
+				Name:        "user-agent-metrics",
+				Value:       false,
+				Usage:       "Export the number of requests for each client software, as identified by the User-Agent header. The clients choose the values, which could add many metrics.",
+				EnvVars:     []string{"C2FMZQ_USER_AGENT_METRICS"},
+				Destination: &flagUserAgentMetrics,
+			},
+			&cli.IntFlag{
+				Name:        "blob-shard-depth",
+				Value:       1,
+				Usage:       "The number of directory levels used to store new blobs, e.g. 2 for aa/bb/<blob>. Existing blobs are not moved.",
+				EnvVars:     []string{"C2FMZQ_BLOB_SHARD_DEPTH"},
+				Destination: &flagBlobShardDepth,
+			},
+			&cli.StringFlag{
+				Name:        "blob-dir",
+				Usage:       "Store the blobs in `DIR` instead of the database directory. Existing blobs are not moved.",
+				EnvVars:     []string{"C2FMZQ_BLOB_DIR"},
+				Destination: &flagBlobDir,
+			},
+			&cli.StringFlag{
+				Name:        "blob-mode",
+				Value:       "0600",
+				Usage:       "The permission of new blobs, e.g. 0640 to let a reverse proxy or backup user in the same group read them. Blob directories also get the search permission. Access by others is never allowed. Existing blobs and metadata files are not changed.",
+				EnvVars:     []string{"C2FMZQ_BLOB_MODE"},
+				Destination: &flagBlobMode,
+			},
+			&cli.StringFlag{
+				Name:        "blob-group",
+				Usage:       "The group of new blobs and blob directories, as a name or ID. (default: the user's primary group)",
+				EnvVars:     []string{"C2FMZQ_BLOB_GROUP"},
+				Destination: &flagBlobGroup,
+			},
+			&cli.BoolFlag{
+				Name:        "require-signed-requests",
+				Value:       false,
+				Usage:       "Reject authenticated API requests that aren't signed. The Stingle app doesn't sign its requests.",
+				EnvVars:     []string{"C2FMZQ_REQUIRE_SIGNED_REQUESTS"},
+				Destination: &flagRequireSignedRequests,
+			},
+			&cli.BoolFlag{
+				Name:        "enable-password-reset",
+				Value:       false,
+				Usage:       "Enable password reset. The reset tokens are sent by email when --smtp-addr is set. Otherwise, they are written to the server log, for the administrator to relay to the users.",
+				EnvVars:     []string{"C2FMZQ_ENABLE_PASSWORD_RESET"},
+				Destination: &flagEnablePasswordReset,
+			},
+			&cli.StringFlag{
+				Name:        "smtp-addr",
+				Value:       "",
+				Usage:       "The address of the SMTP server to use to send emails, e.g. smtp.example.com:587. When empty, the emails are written to the server log.",
+				EnvVars:     []string{"C2FMZQ_SMTP_ADDR"},
+				Destination: &flagSMTPAddr,
+			},
+			&cli.StringFlag{
+				Name:        "smtp-username",
+				Value:       "",
+				Usage:       "The username to authenticate with the SMTP server.",
+				EnvVars:     []string{"C2FMZQ_SMTP_USERNAME"},
+				Destination: &flagSMTPUsername,
+			},
+			&cli.StringFlag{
+				Name:        "smtp-password",
+				Value:       "",
+				Usage:       "The password to authenticate with the SMTP server.",
+				EnvVars:     []string{"C2FMZQ_SMTP_PASSWORD"},
+				Destination: &flagSMTPPassword,
+			},
+			&cli.StringFlag{
+				Name:        "smtp-from",
+				Value:       "",
+				Usage:       "The sender address of the emails.",
+				EnvVars:     []string{"C2FMZQ_SMTP_FROM"},
+				Destination: &flagSMTPFrom,
+			},
 			&cli.BoolFlag{
 				Name:        "enable-webapp",
 				Value:       true,
@@ -204,6 +383,17 @@ func main() {
 				EnvVars:     []string{"C2FMZQ_ENABLE_WEBAPP"},
 				Destination: &flagEnableWebApp,
 			},
+			&cli.StringFlag{
+				Name:        "allowed-origins",
+				Value:       "",
+				Usage:       "A comma-separated list of `ORIGINS` of browser-based clients that can call the API from a different origin, e.g. a web app hosted elsewhere. Use * to allow all origins, or an empty value to refuse cross-origin requests.",
+				EnvVars:     []string{"C2FMZQ_ALLOWED_ORIGINS"},
+				Destination: &flagAllowedOrigins,
+			},
+			&cli.BoolFlag{
+				Name:  "print-config",
+				Usage: "Show the effective configuration, and where each value comes from, then exit.",
+			},
 			&cli.BoolFlag{
 				Name:  "licenses",
 				Usage: "Show the software licenses.",
@@ -225,23 +415,105 @@ func startServer(c *cli.Context) error {
 		cli.ShowSubcommandHelp(c)
 		return nil
 	}
+	if c.Bool("print-config") {
+		return printConfig(os.Stdout, c, os.Args[1:])
+	}
 	log.Level = flagLogLevel
+	switch flagLogFormat {
+	case "text":
+	case "json":
+		log.SetFormat(log.JSON)
+	default:
+		log.Fatalf("Invalid --log-format value: %q", flagLogFormat)
+	}
+	if flagLogFile != "" {
+		f, err := log.NewRotatingFile(flagLogFile, int64(flagLogMaxSize)<<20)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		log.SetOutput(f)
+		defer log.SetOutput(nil)
+	}
 	if (flagTLSCert == "") != (flagTLSKey == "") {
 		log.Fatal("--tlscert and --tlskey must either both be set or unset.")
 	}
+	if flagSMTPAddr != "" && flagSMTPFrom == "" {
+		log.Fatal("--smtp-from must be set with --smtp-addr.")
+	}
 	pass, err := pp.Passphrase(flagPassphraseCmd, flagPassphraseFile, flagPassphrase)
 	if err != nil {
 		return err
 	}
+	if flagBlobShardDepth < 1 || flagBlobShardDepth > database.MaxBlobShardDepth {
+		log.Fatalf("--blob-shard-depth must be between 1 and %d.", database.MaxBlobShardDepth)
+	}
 	db := database.New(flagDatabase, pass)
+	db.BlobShardDepth = flagBlobShardDepth
+	if flagBlobDir != "" {
+		db.SetBlobStore(database.NewFileBlobStore(flagBlobDir))
+	}
+	blobPerm, err := fileperm.Parse(flagBlobMode, flagBlobGroup)
+	if err != nil {
+		log.Fatalf("--blob-mode, --blob-group: %v", err)
+	}
+	if err := db.SetBlobPerm(blobPerm); err != nil {
+		log.Fatalf("db.SetBlobPerm: %v", err)
+	}
+	if err := db.RecordBlobStore(); err != nil {
+		log.Fatalf("db.RecordBlobStore: %v", err)
+	}
+	report, err := db.Recover()
+	if err != nil {
+		log.Fatalf("db.Recover: %v", err)
+	}
+	log.Infof("Database recovery: %s", report)
+	for _, f := range report.TempFilesRemoved {
+		log.Debugf("Removed temp file: %s", f)
+	}
+	for _, f := range report.BackupFilesRemoved {
+		log.Debugf("Removed backup file: %s", f)
+	}
+	for _, f := range report.UploadsRemoved {
+		log.Debugf("Removed partial upload: %s", f)
+	}
 
-	s := server.New(db, flagAddress, flagHTDigestFile, flagPathPrefix)
+	addr := flagAddress
+	if flagListen != "" {
+		addr = flagListen
+	}
+	s := server.New(db, addr, flagHTDigestFile, flagPathPrefix)
 	s.AllowCreateAccount = flagAllowNewAccounts
 	s.AutoApproveNewAccounts = flagsAutoApproveNewAccounts
+	s.RequireInviteCode = flagRequireInviteCode
 	s.BaseURL = flagBaseURL
 	s.Redirect404 = flagRedirect404
 	s.MaxConcurrentRequests = flagMaxConcurrentRequests
+	if flagIPRateLimit > 0 {
+		s.IPThrottle = limit.NewIPThrottle(flagIPRateLimit, flagIPBanFailures, flagIPBanDuration)
+	}
+	s.ClientIPHeader = flagClientIPHeader
+	s.ForwardedHostHeader = flagForwardedHostHeader
+	s.ForwardedProtoHeader = flagForwardedProtoHeader
+	s.UserAgentMetrics = flagUserAgentMetrics
 	s.EnableWebApp = flagEnableWebApp
+	for _, o := range strings.Split(flagAllowedOrigins, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			s.AllowedOrigins = append(s.AllowedOrigins, o)
+		}
+	}
+	s.RequireSignedRequests = flagRequireSignedRequests
+	s.EnablePasswordReset = flagEnablePasswordReset
+	var sender server.EmailSender = server.LogEmailSender{}
+	if flagSMTPAddr != "" {
+		sender = server.SMTPEmailSender{
+			Addr:     flagSMTPAddr,
+			Username: flagSMTPUsername,
+			Password: flagSMTPPassword,
+			From:     flagSMTPFrom,
+		}
+	}
+	s.Notifier = server.EmailNotifier{Sender: sender}
 
 	done := make(chan struct{})
 	go func() {
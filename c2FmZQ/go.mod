@@ -10,6 +10,7 @@ require (
 	github.com/aead/ecdh v0.2.0
 	github.com/c2FmZQ/storage v0.2.4
 	github.com/disintegration/imaging v1.6.2
+	github.com/fsnotify/fsnotify v1.7.0
 	github.com/fxamacker/cbor/v2 v2.7.0
 	github.com/go-test/deep v1.0.7
 	github.com/hashicorp/golang-lru v1.0.2
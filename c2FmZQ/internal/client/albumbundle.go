@@ -0,0 +1,313 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"archive/zip"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"c2FmZQ/internal/stingle"
+)
+
+// albumBundleVersion is the version of the album bundle format.
+const albumBundleVersion = 1
+
+// albumBundle is the content of the bundle.json file written by
+// ExportAlbumBundle.
+type albumBundle struct {
+	Version   int    `json:"version"`
+	PublicKey string `json:"publicKey"`
+	Metadata  string `json:"metadata"`
+	Cover     string `json:"cover,omitempty"`
+	// EncPrivateKey is the album's secret key, encrypted with the
+	// recipient's public key, or with the key derived from the passphrase
+	// and Salt.
+	EncPrivateKey string `json:"encPrivateKey"`
+	Salt          []byte `json:"salt,omitempty"`
+	// The files, in the Stingle API format. Their headers are encrypted
+	// with the album's public key.
+	Files []stingle.File `json:"files"`
+}
+
+// AlbumBundleOptions contains the options of ExportAlbumBundle.
+type AlbumBundleOptions struct {
+	// Recipient is the email address, or the hex-encoded public key, of
+	// the user who can import the bundle. When empty, the bundle can only
+	// be imported by the current user.
+	Recipient string
+	// Passphrase is used to encrypt the album key instead of the
+	// recipient's public key.
+	Passphrase []byte
+}
+
+// ExportAlbumBundle writes one album to out as a single file that can be
+// given to someone without sharing the album on the server, e.g. on a USB
+// drive. The files stay encrypted with the album's key, which is itself
+// encrypted for the recipient, or with a passphrase. The files that are not
+// available locally are downloaded. Returns the number of files in the
+// bundle.
+//
+// The bundle is a zip file with the following layout:
+//
+//	bundle.json     The album's keys and metadata, and the files.
+//	files/<name>    The encrypted content of each file.
+//	thumbs/<name>   The encrypted thumbnail of each file.
+func (c *Client) ExportAlbumBundle(pattern, out string, opts AlbumBundleOptions) (int, error) {
+	item, err := c.oneAlbum(pattern)
+	if err != nil {
+		return 0, err
+	}
+	if item.Album.IsOwner != "1" && !stingle.Permissions(item.Album.Permissions).AllowCopy() {
+		return 0, fmt.Errorf("%w: copying is not allowed: %s", ErrPermissionDenied, item.Filename)
+	}
+	b := albumBundle{
+		Version:   albumBundleVersion,
+		PublicKey: item.Album.PublicKey,
+		Metadata:  item.Album.Metadata,
+		Cover:     item.Album.Cover,
+		Files:     []stingle.File{},
+	}
+	var pk stingle.PublicKey
+	switch {
+	case len(opts.Passphrase) > 0:
+		b.Salt = make([]byte, passphraseSaltSize)
+		if _, err := rand.Read(b.Salt); err != nil {
+			return 0, err
+		}
+		sk := passphraseKey(opts.Passphrase, b.Salt)
+		pk = sk.PublicKey()
+		sk.Wipe()
+	case opts.Recipient != "":
+		if pk, err = c.recipientKey(opts.Recipient); err != nil {
+			return 0, err
+		}
+	default:
+		pk = c.PublicKey()
+	}
+	ask, err := c.SKForAlbum(item.Album)
+	if err != nil {
+		return 0, err
+	}
+	b.EncPrivateKey = pk.SealBoxBase64(ask.ToBytes())
+	ask.Wipe()
+
+	li, err := c.glob(filepath.Join(item.Filename, "*"), GlobOptions{ExactMatchExceptLast: true, MatchDot: true})
+	if err != nil {
+		return 0, err
+	}
+	var files []ListItem
+	for _, f := range li {
+		if f.IsDir {
+			continue
+		}
+		b.Files = append(b.Files, f.FSFile)
+		files = append(files, f)
+	}
+	err = c.writeAtomically(out, func(w io.Writer) error {
+		zw := zip.NewWriter(w)
+		jw, err := zw.Create("bundle.json")
+		if err != nil {
+			return err
+		}
+		if err := json.NewEncoder(jw).Encode(b); err != nil {
+			return err
+		}
+		for _, f := range files {
+			c.Infof("Bundling %s\n", f.Filename)
+			for _, thumb := range []bool{false, true} {
+				if err := c.addBlobToBundle(zw, f, thumb); err != nil {
+					return fmt.Errorf("%s: %w", f.Filename, err)
+				}
+			}
+		}
+		return zw.Close()
+	})
+	if err != nil {
+		return 0, err
+	}
+	c.Infof("Exported %d file(s) from %s to %s\n", len(files), item.Filename, out)
+	return len(files), nil
+}
+
+// addBlobToBundle adds the encrypted content, or thumbnail, of item to the
+// bundle. The blobs are already encrypted, so they are not compressed.
+func (c *Client) addBlobToBundle(zw *zip.Writer, item ListItem, thumb bool) error {
+	r, err := c.openBlob(item, thumb)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	dir := "files"
+	if thumb {
+		dir = "thumbs"
+	}
+	w, err := zw.CreateHeader(&zip.FileHeader{
+		Name:   dir + "/" + item.FSFile.File,
+		Method: zip.Store,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// recipientKey returns the public key of a recipient, which is either an
+// email address of a user on the same server, or a hex-encoded public key,
+// e.g. as shown by the status command.
+func (c *Client) recipientKey(recipient string) (stingle.PublicKey, error) {
+	if strings.Contains(recipient, "@") {
+		contact, err := c.sendGetContact(recipient)
+		if err != nil {
+			return stingle.PublicKey{}, err
+		}
+		return contact.PK()
+	}
+	b, err := hex.DecodeString(strings.NewReplacer(" ", "", ":", "").Replace(recipient))
+	if err != nil || len(b) != 32 {
+		return stingle.PublicKey{}, fmt.Errorf("invalid recipient %q, must be an email address or a public key", recipient)
+	}
+	return stingle.PublicKeyFromBytes(b), nil
+}
+
+// ImportAlbumBundle adds the album from a bundle written by ExportAlbumBundle
+// as a new album. When name is empty, the album's original name is used. The
+// passphrase is only needed if the bundle was made with one. The files are
+// added locally, and uploaded with the next sync. Returns the number of files
+// imported.
+func (c *Client) ImportAlbumBundle(bundle, name string, passphrase []byte) (int, error) {
+	zr, err := zip.OpenReader(bundle)
+	if err != nil {
+		return 0, err
+	}
+	defer zr.Close()
+	var b albumBundle
+	if err := readBundleJSON(&zr.Reader, &b); err != nil {
+		return 0, err
+	}
+	if b.Version != albumBundleVersion {
+		return 0, fmt.Errorf("unsupported bundle version %d", b.Version)
+	}
+	var sk *stingle.SecretKey
+	if len(b.Salt) > 0 {
+		if len(passphrase) == 0 {
+			return 0, ErrPassphraseRequired
+		}
+		sk = passphraseKey(passphrase, b.Salt)
+	} else {
+		sk = c.SecretKey()
+	}
+	askBytes, err := sk.SealBoxOpenBase64(b.EncPrivateKey)
+	sk.Wipe()
+	if err != nil {
+		return 0, fmt.Errorf("%w: the bundle is not for this key", ErrDecrypt)
+	}
+	ask := stingle.SecretKeyFromBytes(askBytes)
+	defer ask.Wipe()
+	if base64.StdEncoding.EncodeToString(ask.PublicKey().ToBytes()) != b.PublicKey {
+		return 0, fmt.Errorf("%s: the album key doesn't match", bundle)
+	}
+	if name == "" {
+		md, err := stingle.DecryptAlbumMetadata(b.Metadata, ask)
+		if err != nil {
+			return 0, err
+		}
+		name = md.Name
+	}
+	li, err := c.GlobFiles([]string{name}, GlobOptions{Quiet: true, ExactMatch: true})
+	if err != nil {
+		return 0, err
+	}
+	if len(li) > 0 {
+		return 0, fmt.Errorf("already exists: %s", li[0].Filename)
+	}
+
+	blobs := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		blobs[f.Name] = f
+	}
+	for _, f := range b.Files {
+		for _, thumb := range []bool{false, true} {
+			n := "files/" + f.File
+			if thumb {
+				n = "thumbs/" + f.File
+			}
+			zf := blobs[n]
+			if zf == nil {
+				return 0, fmt.Errorf("%s: %s is missing", bundle, n)
+			}
+			if err := c.importBundleBlob(zf, c.blobPath(f.File, thumb)); err != nil {
+				return 0, err
+			}
+		}
+	}
+	album, err := c.createAlbum(name, ask)
+	if err != nil {
+		return 0, err
+	}
+	commit, fs, err := c.fileSetForUpdate(albumPrefix + album.AlbumID)
+	if err != nil {
+		return 0, err
+	}
+	if fs.Files == nil {
+		fs.Files = make(map[string]*stingle.File)
+	}
+	for _, f := range b.Files {
+		f := f
+		f.AlbumID = album.AlbumID
+		fs.Files[f.File] = &f
+	}
+	if err := commit(true, nil); err != nil {
+		return 0, err
+	}
+	if b.Cover != "" && len(b.Files) > 0 {
+		if err := c.SetAlbumCover(album.AlbumID, b.Cover); err != nil && !errors.Is(err, ErrFileNotFound) {
+			return 0, err
+		}
+	}
+	c.Infof("Imported %d file(s) from %s to %s\n", len(b.Files), bundle, name)
+	return len(b.Files), nil
+}
+
+// readBundleJSON decodes the bundle.json file of an album bundle.
+func readBundleJSON(zr *zip.Reader, b *albumBundle) error {
+	f, err := zr.Open("bundle.json")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(b)
+}
+
+// importBundleBlob copies a blob from a bundle to the local storage as fn.
+func (c *Client) importBundleBlob(zf *zip.File, fn string) error {
+	r, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return c.writeBlob(r, fn)
+}
@@ -0,0 +1,102 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"c2FmZQ/internal/client"
+)
+
+func TestAlbumBundle(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 3); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if err := c.AddAlbums([]string{"trip"}); err != nil {
+		t.Fatalf("c.AddAlbums: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "*.jpg")}, "trip", false); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+	// The export must download the files that aren't available locally.
+	if _, err := c.Free([]string{"trip/*"}, client.GlobOptions{}, false); err != nil {
+		t.Fatalf("c.Free: %v", err)
+	}
+
+	bundle := filepath.Join(t.TempDir(), "trip.kbundle")
+	if n, err := c.ExportAlbumBundle("trip", bundle, client.AlbumBundleOptions{Passphrase: []byte("secret")}); err != nil {
+		t.Fatalf("c.ExportAlbumBundle: %v", err)
+	} else if want, got := 3, n; want != got {
+		t.Errorf("Unexpected ExportAlbumBundle result. Want %d, got %d", want, got)
+	}
+
+	c2, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	if err := c2.CreateAccount(url, "bob@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	if _, err := c2.ImportAlbumBundle(bundle, "", nil); !errors.Is(err, client.ErrPassphraseRequired) {
+		t.Errorf("c2.ImportAlbumBundle() = %v, want ErrPassphraseRequired", err)
+	}
+	if _, err := c2.ImportAlbumBundle(bundle, "", []byte("wrong")); !errors.Is(err, client.ErrDecrypt) {
+		t.Errorf("c2.ImportAlbumBundle() = %v, want ErrDecrypt", err)
+	}
+	if n, err := c2.ImportAlbumBundle(bundle, "", []byte("secret")); err != nil {
+		t.Fatalf("c2.ImportAlbumBundle: %v", err)
+	} else if want, got := 3, n; want != got {
+		t.Errorf("Unexpected ImportAlbumBundle result. Want %d, got %d", want, got)
+	}
+	if err := c2.Sync(false); err != nil {
+		t.Fatalf("c2.Sync: %v", err)
+	}
+	if n, err := c2.ExportFiles([]string{"trip/*"}, t.TempDir(), client.ExportOptions{}); err != nil {
+		t.Fatalf("c2.ExportFiles: %v", err)
+	} else if want, got := 3, n; want != got {
+		t.Errorf("Unexpected ExportFiles result. Want %d, got %d", want, got)
+	}
+	if _, err := c2.ImportAlbumBundle(bundle, "", []byte("secret")); err == nil {
+		t.Error("c2.ImportAlbumBundle() succeeded, want already exists")
+	}
+
+	// Without a passphrase, only the recipient can import the bundle.
+	bundle2 := filepath.Join(t.TempDir(), "trip2.kbundle")
+	if _, err := c.ExportAlbumBundle("trip", bundle2, client.AlbumBundleOptions{Recipient: "bob@"}); err != nil {
+		t.Fatalf("c.ExportAlbumBundle: %v", err)
+	}
+	if _, err := c.ImportAlbumBundle(bundle2, "copy", nil); !errors.Is(err, client.ErrDecrypt) {
+		t.Errorf("c.ImportAlbumBundle() = %v, want ErrDecrypt", err)
+	}
+	if n, err := c2.ImportAlbumBundle(bundle2, "trip2", nil); err != nil {
+		t.Fatalf("c2.ImportAlbumBundle: %v", err)
+	} else if want, got := 3, n; want != got {
+		t.Errorf("Unexpected ImportAlbumBundle result. Want %d, got %d", want, got)
+	}
+}
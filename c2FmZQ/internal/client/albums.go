@@ -54,21 +54,26 @@ func (c *Client) addAlbum(name string) (*stingle.Album, error) {
 	if name == "" || name == "." || strings.ToLower(name) == "shared" || strings.HasPrefix(strings.ToLower(name), "shared/") {
 		return nil, fmt.Errorf("%s: %w", name, syscall.EPERM)
 	}
+	ask := stingle.MakeSecretKey()
+	defer ask.Wipe()
+	return c.createAlbum(name, ask)
+}
+
+// createAlbum adds a new album with the secret key ask.
+func (c *Client) createAlbum(name string, ask *stingle.SecretKey) (*stingle.Album, error) {
 	b := make([]byte, 32)
 	if _, err := rand.Read(b); err != nil {
 		return nil, err
 	}
 	albumID := base64.RawURLEncoding.EncodeToString(b)
-	ask := stingle.MakeSecretKey()
 	encPrivateKey := c.PublicKey().SealBoxBase64(ask.ToBytes())
 	metadata := stingle.EncryptAlbumMetadata(stingle.AlbumMetadata{Name: name}, ask.PublicKey())
 	publicKey := base64.StdEncoding.EncodeToString(ask.PublicKey().ToBytes())
-	ask.Wipe()
 
 	album := stingle.Album{
 		AlbumID:       albumID,
-		DateCreated:   nowJSON(),
-		DateModified:  nowJSON(),
+		DateCreated:   c.nowJSON(),
+		DateModified:  c.nowJSON(),
 		EncPrivateKey: encPrivateKey,
 		Metadata:      metadata,
 		PublicKey:     publicKey,
@@ -96,7 +101,7 @@ func (c *Client) addAlbum(name string) (*stingle.Album, error) {
 	if err := commit(true, nil); err != nil {
 		return nil, err
 	}
-	c.Printf("Created %s (not synced)\n", name)
+	c.Infof("Created %s (not synced)\n", name)
 	return &album, nil
 }
 
@@ -123,7 +128,7 @@ func (c *Client) removeAlbum(item ListItem) (retErr error) {
 	if !item.IsDir || item.Album == nil {
 		return fmt.Errorf("cannot remove: %s", item.Filename)
 	}
-	c.Printf("Removing %s (not synced)\n", item.Filename)
+	c.Infof("Removing %s (not synced)\n", item.Filename)
 	var al AlbumList
 	commit, err := c.storage.OpenForUpdate(c.fileHash(albumList), &al)
 	if err != nil {
@@ -159,7 +164,7 @@ func (c *Client) RenameAlbum(patterns []string, dest string) error {
 		return err
 	}
 	if len(si) == 0 {
-		return fmt.Errorf("no match for: %s", strings.Join(patterns, " "))
+		return fmt.Errorf("%w: %s", ErrFileNotFound, strings.Join(patterns, " "))
 	}
 	if len(si) > 1 {
 		return fmt.Errorf("more than one match for: %s", strings.Join(patterns, " "))
@@ -170,6 +175,80 @@ func (c *Client) RenameAlbum(patterns []string, dest string) error {
 	return c.renameDir(si[0], dest, true)
 }
 
+// SetAlbumCover sets the file to use as the album's cover. The file must be
+// in the album. An empty fileName reverts to the default cover.
+func (c *Client) SetAlbumCover(albumID, fileName string) (retErr error) {
+	var al AlbumList
+	commit, err := c.storage.OpenForUpdate(c.fileHash(albumList), &al)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	album, ok := al.Albums[albumID]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrAlbumNotFound, albumID)
+	}
+	if album.IsOwner != "1" {
+		return fmt.Errorf("%w: only the album owner can set the cover", ErrPermissionDenied)
+	}
+	if fileName != "" {
+		var fs FileSet
+		if err := c.storage.ReadDataFile(c.fileHash(albumPrefix+albumID), &fs); err != nil {
+			return err
+		}
+		if fs.Files[fileName] == nil {
+			return fmt.Errorf("%w: %s is not in the album", ErrFileNotFound, fileName)
+		}
+	}
+	album.Cover = fileName
+	album.DateModified = c.nowJSON()
+	return commit(true, nil)
+}
+
+// SetAlbumLocked locks or unlocks an album. Files in locked albums can't be
+// deleted or freed unless forced.
+func (c *Client) SetAlbumLocked(albumID string, locked bool) (retErr error) {
+	var al AlbumList
+	commit, err := c.storage.OpenForUpdate(c.fileHash(albumList), &al)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	album, ok := al.Albums[albumID]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrAlbumNotFound, albumID)
+	}
+	if album.IsOwner != "1" {
+		return fmt.Errorf("%w: only the album owner can lock or unlock it", ErrPermissionDenied)
+	}
+	album.IsLocked = "0"
+	if locked {
+		album.IsLocked = "1"
+	}
+	album.DateModified = c.nowJSON()
+	return commit(true, nil)
+}
+
+func isLocked(album *stingle.Album) bool {
+	return album != nil && album.IsLocked == "1"
+}
+
+// clearAlbumCover reverts the album to the default cover if fileName is its
+// current cover.
+func (c *Client) clearAlbumCover(albumID, fileName string) (retErr error) {
+	var al AlbumList
+	commit, err := c.storage.OpenForUpdate(c.fileHash(albumList), &al)
+	if err != nil {
+		return err
+	}
+	defer commit(true, &retErr)
+	if album, ok := al.Albums[albumID]; ok && album.Cover == fileName {
+		album.Cover = ""
+		album.DateModified = c.nowJSON()
+	}
+	return nil
+}
+
 // Copy copies items from one place to another.
 //
 // There are multiple scenarios depending on whether the source and destination
@@ -195,7 +274,7 @@ func (c *Client) Copy(patterns []string, dest string, exact bool) error {
 		return err
 	}
 	if len(si) == 0 {
-		return fmt.Errorf("no match for: %s", strings.Join(patterns, " "))
+		return fmt.Errorf("%w: %s", ErrFileNotFound, strings.Join(patterns, " "))
 	}
 	for _, item := range si {
 		if item.IsDir {
@@ -205,7 +284,7 @@ func (c *Client) Copy(patterns []string, dest string, exact bool) error {
 			return fmt.Errorf("cannot copy from trash, only move: %s", item.Filename)
 		}
 		if item.Album != nil && item.Album.IsOwner != "1" && !stingle.Permissions(item.Album.Permissions).AllowCopy() {
-			return fmt.Errorf("copying is not allowed: %s", item.Filename)
+			return fmt.Errorf("%w: copying is not allowed: %s", ErrPermissionDenied, item.Filename)
 		}
 	}
 
@@ -230,7 +309,7 @@ func (c *Client) Copy(patterns []string, dest string, exact bool) error {
 		rename = file
 	}
 	if len(di) == 0 {
-		return fmt.Errorf("no match for: %s", dest)
+		return fmt.Errorf("%w: %s", ErrFileNotFound, dest)
 	}
 	if len(di) != 1 || !di[0].IsDir {
 		return fmt.Errorf("destination must be a directory: %s", dest)
@@ -251,7 +330,7 @@ func (c *Client) Copy(patterns []string, dest string, exact bool) error {
 
 	// Shared album may not allow files to be added to it.
 	if dst.Album != nil && dst.Album.IsOwner != "1" && !stingle.Permissions(dst.Album.Permissions).AllowAdd() {
-		return fmt.Errorf("adding is not allowed: %s", dest)
+		return fmt.Errorf("%w: adding is not allowed: %s", ErrPermissionDenied, dest)
 	}
 	// Check that we're not trying to copy to trash.
 	if dst.Set == stingle.TrashSet {
@@ -302,11 +381,11 @@ func (c *Client) Move(patterns []string, dest string, exact bool) error {
 		return err
 	}
 	if len(si) == 0 {
-		return fmt.Errorf("no match for: %s", strings.Join(patterns, " "))
+		return fmt.Errorf("%w: %s", ErrFileNotFound, strings.Join(patterns, " "))
 	}
 	for _, item := range si {
 		if item.Album != nil && item.Album.IsOwner != "1" {
-			return fmt.Errorf("moving is not allowed: %s", item.Filename)
+			return fmt.Errorf("%w: moving is not allowed: %s", ErrPermissionDenied, item.Filename)
 		}
 	}
 
@@ -326,7 +405,7 @@ func (c *Client) Move(patterns []string, dest string, exact bool) error {
 	var rename string
 	if len(si) == 1 && !si[0].IsDir && (len(di) == 0 || (len(di) == 1 && !di[0].IsDir)) {
 		if len(di) == 1 {
-			if err := c.Delete([]string{di[0].Filename}, true); err != nil {
+			if err := c.Delete([]string{di[0].Filename}, true, false); err != nil {
 				return err
 			}
 			di = nil
@@ -358,7 +437,7 @@ func (c *Client) Move(patterns []string, dest string, exact bool) error {
 
 	// Shared album may not allow files to be added to it.
 	if dst.Album != nil && dst.Album.IsOwner != "1" && !stingle.Permissions(dst.Album.Permissions).AllowAdd() {
-		return fmt.Errorf("adding is not allowed: %s", dest)
+		return fmt.Errorf("%w: adding is not allowed: %s", ErrPermissionDenied, dest)
 	}
 
 	// Renaming/moving directories.
@@ -401,8 +480,49 @@ func (c *Client) Move(patterns []string, dest string, exact bool) error {
 	return nil
 }
 
-// Delete moves files trash, or deletes them from trash.
-func (c *Client) Delete(patterns []string, exact bool) error {
+// RenameFile changes the name of one file without moving it. Only the file's
+// headers are re-encrypted, the content is unchanged. Like all other local
+// changes, the new name is sent to the server on the next sync.
+func (c *Client) RenameFile(pattern, newName string, exact bool) error {
+	if newName == "" || newName == "." || newName == ".." || strings.ContainsAny(newName, "/\\") {
+		return fmt.Errorf("illegal name: %q", newName)
+	}
+	si, err := c.GlobFiles([]string{pattern}, GlobOptions{ExactMatch: exact})
+	if err != nil {
+		return err
+	}
+	if len(si) == 0 {
+		return fmt.Errorf("%w: %s", ErrFileNotFound, pattern)
+	}
+	if len(si) != 1 {
+		return fmt.Errorf("%s matches %d files, can only rename one file at a time", pattern, len(si))
+	}
+	item := si[0]
+	if item.IsDir {
+		return fmt.Errorf("not a file: %s", item.Filename)
+	}
+	if item.Album != nil && item.Album.IsOwner != "1" {
+		return fmt.Errorf("%w: renaming is not allowed: %s", ErrPermissionDenied, item.Filename)
+	}
+	dir, _ := filepath.Split(item.Filename)
+	if di, err := c.glob(filepath.Join(dir, newName), GlobOptions{ExactMatch: true}); err != nil {
+		return err
+	} else if len(di) > 0 {
+		return fmt.Errorf("already exists: %s", di[0].Filename)
+	}
+	di, err := c.glob(dir, GlobOptions{ExactMatch: true})
+	if err != nil {
+		return err
+	}
+	if len(di) != 1 || !di[0].IsDir {
+		return fmt.Errorf("%w: %s", ErrFileNotFound, dir)
+	}
+	return c.moveFiles(si, di[0], newName, true)
+}
+
+// Delete moves files trash, or deletes them from trash. Files in locked albums
+// and pinned files are only deleted when force is true.
+func (c *Client) Delete(patterns []string, exact, force bool) error {
 	si, err := c.GlobFiles(patterns, GlobOptions{ExactMatch: exact})
 	if err != nil {
 		return err
@@ -410,6 +530,16 @@ func (c *Client) Delete(patterns []string, exact bool) error {
 	if len(si) == 0 {
 		return nil
 	}
+	if !force {
+		for _, item := range si {
+			if isLocked(item.Album) {
+				return fmt.Errorf("%w: %s is in a locked album", ErrPermissionDenied, item.Filename)
+			}
+		}
+		if err := c.checkNotPinned(si); err != nil {
+			return err
+		}
+	}
 	di, err := c.glob(".trash", GlobOptions{})
 	if err != nil || len(di) != 1 {
 		return err
@@ -457,7 +587,7 @@ func (c *Client) renameDir(item ListItem, name string, recursive bool) (retErr e
 			return err
 		}
 
-		c.Printf("Renaming %s -> %s (not synced)\n", strings.TrimSuffix(item.Filename, "/"), name)
+		c.Infof("Renaming %s -> %s (not synced)\n", strings.TrimSuffix(item.Filename, "/"), name)
 
 		var al AlbumList
 		commit, err := c.storage.OpenForUpdate(c.fileHash(albumList), &al)
@@ -466,7 +596,7 @@ func (c *Client) renameDir(item ListItem, name string, recursive bool) (retErr e
 		}
 		md := stingle.EncryptAlbumMetadata(stingle.AlbumMetadata{Name: name}, pk)
 		al.Albums[item.Album.AlbumID].Metadata = md
-		al.Albums[item.Album.AlbumID].DateModified = nowJSON()
+		al.Albums[item.Album.AlbumID].DateModified = c.nowJSON()
 		if err := commit(true, nil); err != nil {
 			return err
 		}
@@ -538,22 +668,13 @@ func (c *Client) moveFiles(fromItems []ListItem, toItem ListItem, rename string,
 			}
 		}
 	}
-	var (
-		commit func(bool, *error) error
-		fs     []*FileSet
-		err    error
-	)
-	if fromSet == toSet && fromAlbumID == toAlbumID {
-		c, f, e := c.fileSetForUpdate(fromItems[0].FileSet)
-		commit, fs, err = c, []*FileSet{f, f}, e
-	} else {
-		commit, fs, err = c.fileSetsForUpdate([]string{fromItems[0].FileSet, toItem.FileSet})
-	}
+	commit, fs, err := c.fileSetsForUpdate([]string{fromItems[0].FileSet, toItem.FileSet})
 	if err != nil {
 		return err
 	}
 	defer commit(false, &retErr)
 
+	var coverMoved bool
 	for _, item := range fromItems {
 		var ff stingle.File
 		if f, ok := fs[0].Files[item.FSFile.File]; ok && f != nil {
@@ -569,10 +690,10 @@ func (c *Client) moveFiles(fromItems []ListItem, toItem ListItem, rename string,
 			if item.Album != nil && item.Album.IsOwner != "1" {
 				return fmt.Errorf("only the album owner can move files: %s", item.Filename)
 			}
-			c.Printf("Moving %s -> %s (not synced)\n", item.Filename, d)
+			c.Infof("Moving %s -> %s (not synced)\n", item.Filename, d)
 			delete(fs[0].Files, ff.File)
 		} else {
-			c.Printf("Copying %s -> %s (not synced)\n", item.Filename, d)
+			c.Infof("Copying %s -> %s (not synced)\n", item.Filename, d)
 		}
 		if needHeaders {
 			// Re-encrypt headers for destination.
@@ -605,11 +726,21 @@ func (c *Client) moveFiles(fromItems []ListItem, toItem ListItem, rename string,
 			}
 			ff.Headers = h
 		}
-		ff.DateModified = nowJSON()
+		ff.DateModified = c.nowJSON()
 		ff.AlbumID = toAlbumID
 		fs[1].Files[ff.File] = &ff
+		if moving && fromAlbum != nil && fromAlbum.Cover == ff.File && fromAlbumID != toAlbumID {
+			coverMoved = true
+		}
 	}
-	return commit(true, nil)
+	if err := commit(true, nil); err != nil {
+		return err
+	}
+	if coverMoved {
+		// The file used as cover is no longer in the album.
+		return c.clearAlbumCover(fromAlbumID, fromAlbum.Cover)
+	}
+	return nil
 }
 
 func (c *Client) deleteFiles(li []ListItem) (retErr error) {
@@ -625,7 +756,7 @@ func (c *Client) deleteFiles(li []ListItem) (retErr error) {
 
 	for _, item := range li {
 		if _, ok := fs.Files[item.FSFile.File]; ok {
-			c.Printf("Deleting %s (not synced)\n", item.Filename)
+			c.Infof("Deleting %s (not synced)\n", item.Filename)
 			delete(fs.Files, item.FSFile.File)
 			if refs[item.FSFile.File] {
 				continue
@@ -0,0 +1,401 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"c2FmZQ/internal/stingle"
+)
+
+// backupVersion is the version of the FullBackup format.
+const backupVersion = 1
+
+// ErrBackupPasswordRequired is returned by FullRestore when the backup was made
+// with a different key and no password was given.
+var ErrBackupPasswordRequired = errors.New("the backup was made with a different key, its password is required")
+
+// backupManifest is the content of the backup.json file written by
+// FullBackup.
+type backupManifest struct {
+	Version int              `json:"version"`
+	Email   string           `json:"email,omitempty"`
+	Albums  []*stingle.Album `json:"albums"`
+	Files   []backupFile     `json:"files"`
+}
+
+// backupFile is a file in backupManifest, with the set it belongs to.
+type backupFile struct {
+	Set string `json:"set"`
+	stingle.File
+}
+
+// FullBackup writes a copy of the whole account to dir, without decrypting
+// anything, so that it can be imported again by a Stingle-compatible app or
+// server. Files that are not available locally are downloaded, but they are not
+// added to the local storage. Returns the number of files in the backup.
+//
+// The backup has the following layout:
+//
+//	keybundle       The key bundle, in the Stingle API format. It contains the
+//	                secret key, encrypted with password, only when password
+//	                isn't empty.
+//	backup.json     The albums and the files, in the Stingle API format. Each
+//	                file also has the set it belongs to, i.e. "0" for gallery,
+//	                "1" for trash, "2" for albums.
+//	files/<name>    The encrypted content of each file, e.g. files/abc.sp.
+//	thumbs/<name>   The encrypted thumbnail of each file.
+//
+// Existing files in dir are kept, so an interrupted backup can be resumed.
+func (c *Client) FullBackup(dir, password string) (int, error) {
+	for _, d := range []string{"files", "thumbs"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0700); err != nil {
+			return 0, err
+		}
+	}
+	al, err := c.albumList()
+	if err != nil {
+		return 0, err
+	}
+	li, err := c.GlobFiles([]string{"*"}, GlobOptions{Recursive: true, MatchDot: true, Quiet: true})
+	if err != nil {
+		return 0, err
+	}
+	m := backupManifest{
+		Version: backupVersion,
+		Albums:  []*stingle.Album{},
+		Files:   []backupFile{},
+	}
+	if c.Account != nil {
+		m.Email = c.Account.Email
+	}
+	for _, a := range al.Albums {
+		m.Albums = append(m.Albums, a)
+	}
+	sort.Slice(m.Albums, func(i, j int) bool {
+		return m.Albums[i].AlbumID < m.Albums[j].AlbumID
+	})
+	seen := make(map[string]bool)
+	for _, item := range li {
+		if item.IsDir {
+			continue
+		}
+		m.Files = append(m.Files, backupFile{Set: item.Set, File: item.FSFile})
+		if seen[item.FSFile.File] {
+			continue
+		}
+		seen[item.FSFile.File] = true
+		c.Infof("Backing up %s\n", item.Filename)
+		if err := c.backupBlob(item, false, filepath.Join(dir, "files", item.FSFile.File)); err != nil {
+			return 0, err
+		}
+		if err := c.backupBlob(item, true, filepath.Join(dir, "thumbs", item.FSFile.File)); err != nil {
+			return 0, err
+		}
+	}
+
+	bundle := stingle.MakeKeyBundle(c.PublicKey())
+	if password != "" {
+		sk := c.SecretKey()
+		bundle = stingle.MakeSecretKeyBundle([]byte(password), sk)
+		sk.Wipe()
+	}
+	for _, f := range []struct {
+		name    string
+		content func(w io.Writer) error
+	}{
+		{"keybundle", func(w io.Writer) error {
+			_, err := io.WriteString(w, bundle)
+			return err
+		}},
+		{"backup.json", func(w io.Writer) error {
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			return enc.Encode(m)
+		}},
+	} {
+		fn := filepath.Join(dir, f.name)
+		os.Remove(fn)
+		if err := c.writeAtomically(fn, f.content); err != nil {
+			return 0, err
+		}
+	}
+	c.Infof("Backed up %d file(s) to %s\n", len(seen), dir)
+	return len(seen), nil
+}
+
+// backupBlob copies the encrypted content, or thumbnail, of item to dst. It is
+// downloaded when it isn't available locally.
+func (c *Client) backupBlob(item ListItem, thumb bool, dst string) error {
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+	r, err := c.openBlob(item, thumb)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return c.writeAtomically(dst, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+}
+
+// openBlob opens the encrypted content, or thumbnail, of item. It is
+// downloaded, without being added to the local storage, when it isn't
+// available locally.
+func (c *Client) openBlob(item ListItem, thumb bool) (io.ReadCloser, error) {
+	f, err := os.Open(c.blobPath(item.FSFile.File, thumb))
+	if err == nil {
+		return f, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) || item.LocalOnly {
+		return nil, err
+	}
+	t := "0"
+	if thumb {
+		t = "1"
+	}
+	return c.download(context.Background(), item.FSFile.File, item.Set, t)
+}
+
+// FullRestore adds the albums and files from a backup made with FullBackup to
+// the current account, and syncs them with the server. When the account has a
+// different key than the backup, e.g. a new account on another server, the
+// backup must contain the secret key, and password is used to decrypt it. The
+// file headers and album keys are then encrypted again for the current key.
+// Albums that were shared with the account by other users can't be restored.
+//
+// Albums and files that the server already has are skipped, so an interrupted
+// restore can be resumed. Returns the number of files restored.
+func (c *Client) FullRestore(dir, password string) (int, error) {
+	if c.Account == nil {
+		return 0, ErrNotLoggedIn
+	}
+	bundle, err := os.ReadFile(filepath.Join(dir, "keybundle"))
+	if err != nil {
+		return 0, err
+	}
+	pk, _, err := stingle.DecodeKeyBundle(string(bundle))
+	if err != nil {
+		return 0, err
+	}
+	// oldSK is the backup's secret key, when it isn't the current key.
+	var oldSK *stingle.SecretKey
+	if !bytes.Equal(pk.ToBytes(), c.PublicKey().ToBytes()) {
+		if password == "" {
+			return 0, ErrBackupPasswordRequired
+		}
+		if oldSK, err = stingle.DecodeSecretKeyBundle([]byte(password), string(bundle)); err != nil {
+			return 0, err
+		}
+		defer oldSK.Wipe()
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "backup.json"))
+	if err != nil {
+		return 0, err
+	}
+	var m backupManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return 0, err
+	}
+	if m.Version != backupVersion {
+		return 0, fmt.Errorf("unsupported backup version %d", m.Version)
+	}
+	if err := c.GetUpdates(true); err != nil {
+		return 0, err
+	}
+	albums, err := c.restoreAlbums(m.Albums, oldSK)
+	if err != nil {
+		return 0, err
+	}
+
+	fileSets := make(map[string][]stingle.File)
+	var names []string
+	for _, f := range m.Files {
+		var name string
+		switch f.Set {
+		case stingle.GallerySet:
+			name = galleryFile
+		case stingle.TrashSet:
+			name = trashFile
+		case stingle.AlbumSet:
+			if !albums[f.AlbumID] {
+				continue
+			}
+			name = albumPrefix + f.AlbumID
+		default:
+			return 0, fmt.Errorf("invalid set %q for %s", f.Set, f.File.File)
+		}
+		if fileSets[name] == nil {
+			names = append(names, name)
+		}
+		fileSets[name] = append(fileSets[name], f.File)
+	}
+	count := 0
+	for _, name := range names {
+		// The headers of the files in albums are encrypted with the
+		// album's key, which doesn't change.
+		rekey := oldSK
+		if strings.HasPrefix(name, albumPrefix) {
+			rekey = nil
+		}
+		n, err := c.restoreFiles(dir, name, fileSets[name], rekey)
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+	if err := c.Sync(false); err != nil {
+		return count, err
+	}
+	c.Infof("Restored %d file(s) from %s\n", count, dir)
+	return count, nil
+}
+
+// restoreAlbums adds the albums that don't exist yet. When oldSK isn't nil,
+// the album keys are encrypted again for the current key. Returns the IDs of
+// the albums that exist after the restore.
+func (c *Client) restoreAlbums(albums []*stingle.Album, oldSK *stingle.SecretKey) (ids map[string]bool, retErr error) {
+	var al AlbumList
+	commit, err := c.storage.OpenForUpdate(c.fileHash(albumList), &al)
+	if err != nil {
+		return nil, err
+	}
+	defer commit(false, &retErr)
+	if al.Albums == nil {
+		al.Albums = make(map[string]*stingle.Album)
+	}
+	ids = make(map[string]bool)
+	for _, a := range albums {
+		if al.Albums[a.AlbumID] != nil {
+			ids[a.AlbumID] = true
+			continue
+		}
+		if a.IsOwner != "1" {
+			c.Infof("Skipped album %s (not owner)\n", a.AlbumID)
+			continue
+		}
+		album := *a
+		album.IsShared = "0"
+		album.Members = ""
+		album.SharingKeys = nil
+		if oldSK != nil {
+			ask, err := a.SK(oldSK)
+			if err != nil {
+				return nil, err
+			}
+			album.EncPrivateKey = c.PublicKey().SealBoxBase64(ask.ToBytes())
+			ask.Wipe()
+		}
+		al.Albums[album.AlbumID] = &album
+		if err := c.storage.CreateEmptyFile(c.fileHash(albumPrefix+album.AlbumID), &FileSet{}); err != nil {
+			return nil, err
+		}
+		ids[album.AlbumID] = true
+	}
+	return ids, commit(true, nil)
+}
+
+// restoreFiles adds the files that don't exist yet to the file set name, and
+// copies their content from the backup in dir to the local storage. When rekey
+// isn't nil, the file headers are decrypted with it and encrypted again for the
+// current key. Returns the number of files added.
+func (c *Client) restoreFiles(dir, name string, files []stingle.File, rekey *stingle.SecretKey) (n int, retErr error) {
+	commit, fs, err := c.fileSetForUpdate(name)
+	if err != nil {
+		return 0, err
+	}
+	defer commit(false, &retErr)
+	if fs.Files == nil {
+		fs.Files = make(map[string]*stingle.File)
+	}
+	for _, f := range files {
+		if fs.Files[f.File] != nil {
+			continue
+		}
+		if err := c.restoreBlob(filepath.Join(dir, "files", f.File), c.blobPath(f.File, false)); err != nil {
+			return 0, err
+		}
+		if err := c.restoreBlob(filepath.Join(dir, "thumbs", f.File), c.blobPath(f.File, true)); err != nil {
+			return 0, err
+		}
+		f := f
+		if rekey != nil {
+			hdrs, err := stingle.DecryptBase64Headers(f.Headers, rekey)
+			if err != nil {
+				return 0, err
+			}
+			f.Headers, err = stingle.EncryptBase64Headers(hdrs, c.PublicKey())
+			for _, h := range hdrs {
+				h.Wipe()
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+		fs.Files[f.File] = &f
+		n++
+	}
+	return n, commit(true, nil)
+}
+
+// restoreBlob copies the encrypted file src to the local storage as fn, unless
+// it is already there.
+func (c *Client) restoreBlob(src, fn string) error {
+	if _, err := os.Stat(fn); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return c.writeBlob(in, fn)
+}
+
+// writeBlob copies the encrypted content from in to the local storage as fn.
+func (c *Client) writeBlob(in io.Reader, fn string) error {
+	d, _ := filepath.Split(fn)
+	if err := c.blobPerm.MkdirAll(d); err != nil {
+		return err
+	}
+	f, tmp, err := c.createBlobTemp(fn)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, in); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return c.commitBlobTemp(tmp, fn)
+}
@@ -0,0 +1,197 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"c2FmZQ/internal/client"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestFullBackup(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 3); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "image000.jpg")}, "gallery", false); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "image001.jpg")}, "album", true); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+	// The backup must download the files that aren't available locally.
+	if _, err := c.Free([]string{"*"}, client.GlobOptions{Recursive: true}, false); err != nil {
+		t.Fatalf("c.Free: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "image002.jpg")}, "album", true); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+
+	dir := t.TempDir()
+	if n, err := c.FullBackup(dir, "secret"); err != nil {
+		t.Fatalf("c.FullBackup: %v", err)
+	} else if want, got := 3, n; want != got {
+		t.Errorf("Unexpected FullBackup result. Want %d, got %d", want, got)
+	}
+
+	bundle, err := os.ReadFile(filepath.Join(dir, "keybundle"))
+	if err != nil {
+		t.Fatalf("os.ReadFile: %v", err)
+	}
+	sk, err := stingle.DecodeSecretKeyBundle([]byte("secret"), string(bundle))
+	if err != nil {
+		t.Fatalf("stingle.DecodeSecretKeyBundle: %v", err)
+	}
+	if want, got := c.PublicKey().ToBytes(), sk.PublicKey().ToBytes(); !bytes.Equal(want, got) {
+		t.Error("Unexpected public key in key bundle")
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "backup.json"))
+	if err != nil {
+		t.Fatalf("os.ReadFile: %v", err)
+	}
+	var m struct {
+		Albums []stingle.Album `json:"albums"`
+		Files  []struct {
+			Set string `json:"set"`
+			stingle.File
+		} `json:"files"`
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if len(m.Albums) != 1 || len(m.Files) != 3 {
+		t.Fatalf("Unexpected backup.json: %s", b)
+	}
+	for _, f := range m.Files {
+		for _, d := range []string{"files", "thumbs"} {
+			if _, err := os.Stat(filepath.Join(dir, d, f.File.File)); err != nil {
+				t.Errorf("%s/%s: %v", d, f.File.File, err)
+			}
+		}
+		if f.Set != stingle.GallerySet {
+			continue
+		}
+		in, err := os.Open(filepath.Join(dir, "files", f.File.File))
+		if err != nil {
+			t.Fatalf("os.Open: %v", err)
+		}
+		hdr, err := stingle.DecryptHeader(in, sk)
+		in.Close()
+		if err != nil {
+			t.Fatalf("stingle.DecryptHeader: %v", err)
+		}
+		fi, err := os.Stat(filepath.Join(testdir, "image000.jpg"))
+		if err != nil {
+			t.Fatalf("os.Stat: %v", err)
+		}
+		if want, got := fi.Size(), hdr.DataSize; want != got {
+			t.Errorf("DataSize = %d, want %d", got, want)
+		}
+	}
+}
+
+func TestFullRestore(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 3); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "image000.jpg")}, "gallery", false); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "image00[12].jpg")}, "album", true); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+	dir := t.TempDir()
+	if _, err := c.FullBackup(dir, "secret"); err != nil {
+		t.Fatalf("c.FullBackup: %v", err)
+	}
+
+	// Restore to a new account, with a different key, on another server.
+	c2, url2, done2 := startServer(t)
+	defer done2()
+	if err := c2.CreateAccount(url2, "bob@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	if _, err := c2.FullRestore(dir, ""); !errors.Is(err, client.ErrBackupPasswordRequired) {
+		t.Fatalf("c2.FullRestore() = %v, want ErrBackupPasswordRequired", err)
+	}
+	if n, err := c2.FullRestore(dir, "secret"); err != nil {
+		t.Fatalf("c2.FullRestore: %v", err)
+	} else if want, got := 3, n; want != got {
+		t.Errorf("Unexpected FullRestore result. Want %d, got %d", want, got)
+	}
+	if n, err := c2.FullRestore(dir, "secret"); err != nil || n != 0 {
+		t.Errorf("c2.FullRestore() again = %d, %v, want 0, nil", n, err)
+	}
+
+	// Another client gets the restored files from the server.
+	c3, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	if err := c3.Login(url2, "bob@", "pass"); err != nil {
+		t.Fatalf("c3.Login: %v", err)
+	}
+	if err := c3.GetUpdates(false); err != nil {
+		t.Fatalf("c3.GetUpdates: %v", err)
+	}
+	exportDir := t.TempDir()
+	if n, err := c3.ExportFiles([]string{"*"}, exportDir, client.ExportOptions{Recursive: true}); err != nil {
+		t.Fatalf("c3.ExportFiles: %v", err)
+	} else if want, got := 3, n; want != got {
+		t.Errorf("Unexpected ExportFiles result. Want %d, got %d", want, got)
+	}
+	for _, fn := range []string{"gallery/image000.jpg", "album/image001.jpg", "album/image002.jpg"} {
+		want, err := os.ReadFile(filepath.Join(testdir, filepath.Base(fn)))
+		if err != nil {
+			t.Fatalf("os.ReadFile: %v", err)
+		}
+		got, err := os.ReadFile(filepath.Join(exportDir, fn))
+		if err != nil {
+			t.Errorf("os.ReadFile: %v", err)
+			continue
+		}
+		if !bytes.Equal(want, got) {
+			t.Errorf("%s: content mismatch", fn)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/c2FmZQ/storage"
+
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+// cachedStorage is the client's storage. It invalidates the glob cache
+// every time a data file is modified, and the album cache every time the
+// album list is modified.
+type cachedStorage struct {
+	*storage.Storage
+	cache  *globCache
+	albums *albumCache
+}
+
+func newCachedStorage(s *storage.Storage) cachedStorage {
+	return cachedStorage{Storage: s, cache: &globCache{}, albums: &albumCache{}}
+}
+
+func (s cachedStorage) OpenForUpdate(f string, obj interface{}) (func(commit bool, errp *error) error, error) {
+	commit, err := s.Storage.OpenForUpdate(f, obj)
+	if err != nil {
+		return nil, err
+	}
+	return s.invalidateOnCommit(commit, f), nil
+}
+
+func (s cachedStorage) OpenManyForUpdate(files []string, objects interface{}) (func(commit bool, errp *error) error, error) {
+	commit, err := s.Storage.OpenManyForUpdate(files, objects)
+	if err != nil {
+		return nil, err
+	}
+	return s.invalidateOnCommit(commit, files...), nil
+}
+
+func (s cachedStorage) invalidateOnCommit(commit func(bool, *error) error, files ...string) func(bool, *error) error {
+	return func(c bool, errp *error) error {
+		defer s.invalidate(files...)
+		return commit(c, errp)
+	}
+}
+
+func (s cachedStorage) invalidate(files ...string) {
+	s.cache.invalidate()
+	for _, f := range files {
+		s.albums.invalidate(f)
+	}
+}
+
+func (s cachedStorage) SaveDataFile(filename string, obj interface{}) error {
+	defer s.invalidate(filename)
+	return s.Storage.SaveDataFile(filename, obj)
+}
+
+func (s cachedStorage) CreateEmptyFile(filename string, empty interface{}) error {
+	defer s.invalidate(filename)
+	return s.Storage.CreateEmptyFile(filename, empty)
+}
+
+func (s cachedStorage) EditDataFile(filename string, obj interface{}) error {
+	defer s.invalidate(filename)
+	return s.Storage.EditDataFile(filename, obj)
+}
+
+// albumCache keeps the album list in memory. Unlike the glob cache, it is
+// only invalidated when the album list itself is modified, not when files are
+// added to file sets, e.g. during imports.
+type albumCache struct {
+	mu         sync.Mutex
+	generation int64
+	file       string
+	al         *AlbumList
+	// The number of times the album list was read from storage.
+	reads int
+}
+
+func (ac *albumCache) invalidate(file string) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if ac.file != "" && file != ac.file {
+		return
+	}
+	ac.generation++
+	ac.al = nil
+}
+
+func (ac *albumCache) get(file string) (*AlbumList, int64) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if ac.file != file {
+		return nil, ac.generation
+	}
+	return ac.al, ac.generation
+}
+
+func (ac *albumCache) set(file string, al *AlbumList, gen int64) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	ac.reads++
+	if gen != ac.generation {
+		return
+	}
+	ac.file = file
+	ac.al = al
+}
+
+// albumList returns the album list. It is shared with other callers and must
+// not be modified. Use OpenForUpdate to modify the album list.
+func (c *Client) albumList() (*AlbumList, error) {
+	fn := c.fileHash(albumList)
+	if al, _ := c.storage.albums.get(fn); al != nil {
+		return al, nil
+	}
+	_, gen := c.storage.albums.get(fn)
+	var al AlbumList
+	if err := c.storage.ReadDataFile(fn, &al); err != nil {
+		return nil, err
+	}
+	c.storage.albums.set(fn, &al, gen)
+	return &al, nil
+}
+
+// globCache keeps the decrypted album list and file sets used by glob in
+// memory so that back-to-back commands don't need to read and decrypt them
+// again. The generation is incremented every time the cache is invalidated.
+// Values that were read from an older generation are never added to the
+// cache.
+type globCache struct {
+	mu         sync.Mutex
+	generation int64
+	dirs       []globDir
+	haveDirs   bool
+	files      map[string][]globFile
+}
+
+// globDir is an album, as seen by glob.
+type globDir struct {
+	name  string
+	album *stingle.Album
+	local bool
+}
+
+// globFile is a file in a file set, as seen by glob.
+type globFile struct {
+	name  string
+	size  int64
+	f     *stingle.File
+	local bool
+}
+
+func (gc *globCache) invalidate() {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	gc.generation++
+	gc.dirs = nil
+	gc.haveDirs = false
+	gc.files = nil
+}
+
+func (gc *globCache) getDirs() ([]globDir, int64, bool) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	return gc.dirs, gc.generation, gc.haveDirs
+}
+
+func (gc *globCache) setDirs(dirs []globDir, gen int64) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	if gen != gc.generation {
+		return
+	}
+	gc.dirs = dirs
+	gc.haveDirs = true
+}
+
+func (gc *globCache) getFiles(fileSet string) ([]globFile, int64, bool) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	files, ok := gc.files[fileSet]
+	return files, gc.generation, ok
+}
+
+func (gc *globCache) setFiles(fileSet string, files []globFile, gen int64) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	if gen != gc.generation {
+		return
+	}
+	if gc.files == nil {
+		gc.files = make(map[string][]globFile)
+	}
+	gc.files[fileSet] = files
+}
+
+// globDirs returns the albums, sorted by albumID, with their decrypted names.
+func (c *Client) globDirs() ([]globDir, error) {
+	dirs, gen, ok := c.storage.cache.getDirs()
+	if ok {
+		return dirs, nil
+	}
+	al, err := c.albumList()
+	if err != nil {
+		return nil, err
+	}
+	var albumIDs []string
+	for albumID := range al.Albums {
+		albumIDs = append(albumIDs, albumID)
+	}
+	sort.Strings(albumIDs)
+	dirs = nil
+	for _, albumID := range albumIDs {
+		album := al.Albums[albumID]
+		local := al.RemoteAlbums[albumID] == nil
+		ask, err := c.SKForAlbum(album)
+		if err != nil {
+			log.Errorf("Unable to decrypt the secret key for %s: %v", albumID, err)
+			continue
+		}
+		md, err := stingle.DecryptAlbumMetadata(album.Metadata, ask)
+		ask.Wipe()
+		if err != nil {
+			log.Errorf("Unable to decrypt the metadata for %s: %v", albumID, err)
+			md = &stingle.AlbumMetadata{Name: "###ERR###"}
+		}
+		dirs = append(dirs, globDir{name: md.Name, album: album, local: local})
+	}
+	c.storage.cache.setDirs(dirs, gen)
+	return dirs, nil
+}
+
+// globFiles returns the files in a file set, sorted by file, with their
+// decrypted names and sizes.
+func (c *Client) globFiles(fileSet string, album *stingle.Album) ([]globFile, error) {
+	files, gen, ok := c.storage.cache.getFiles(fileSet)
+	if ok {
+		return files, nil
+	}
+	var fs FileSet
+	if err := c.storage.ReadDataFile(c.fileHash(fileSet), &fs); err != nil {
+		return nil, err
+	}
+	var names []string
+	for file := range fs.Files {
+		names = append(names, file)
+	}
+	sort.Strings(names)
+	sk, err := c.SKForAlbum(album)
+	if err != nil {
+		log.Errorf("SKForAlbum: %v", err)
+		return nil, err
+	}
+	defer sk.Wipe()
+
+	// Decrypting the headers is the most expensive part of glob with large
+	// file sets. Split the work between all the CPUs.
+	decrypted := make([]*globFile, len(names))
+	numWorkers := runtime.NumCPU()
+	var wg sync.WaitGroup
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(names); i += numWorkers {
+				f := fs.Files[names[i]]
+				hdr, err := stingle.DecryptBase64FileHeader(f.Headers, sk)
+				if err != nil {
+					log.Errorf("DecryptBase64FileHeader: %v", err)
+					continue
+				}
+				decrypted[i] = &globFile{name: string(hdr.Filename), size: hdr.DataSize, f: f, local: fs.RemoteFiles[f.File] == nil}
+				hdr.Wipe()
+			}
+		}(w)
+	}
+	wg.Wait()
+	for _, f := range decrypted {
+		if f != nil {
+			files = append(files, *f)
+		}
+	}
+	c.storage.cache.setFiles(fileSet, files, gen)
+	return files, nil
+}
+
+// fileCount returns the number of files in a file set.
+func (c *Client) fileCount(fileSet string) (int, error) {
+	if files, _, ok := c.storage.cache.getFiles(fileSet); ok {
+		return len(files), nil
+	}
+	var fs FileSet
+	if err := c.storage.ReadDataFile(c.fileHash(fileSet), &fs); err != nil {
+		return 0, err
+	}
+	return len(fs.Files), nil
+}
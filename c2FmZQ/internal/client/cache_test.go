@@ -0,0 +1,174 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"c2FmZQ/internal/stingle"
+)
+
+func TestGlobCache(t *testing.T) {
+	c, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	names := func() []string {
+		li, err := c.GlobFiles([]string{"*"}, GlobOptions{})
+		if err != nil {
+			t.Fatalf("GlobFiles: %v", err)
+		}
+		var out []string
+		for _, item := range li {
+			out = append(out, item.Filename)
+		}
+		return out
+	}
+	cached := func() bool {
+		_, _, ok := c.storage.cache.getDirs()
+		return ok
+	}
+
+	if err := c.AddAlbums([]string{"alpha"}); err != nil {
+		t.Fatalf("AddAlbums: %v", err)
+	}
+	if cached() {
+		t.Fatal("Cache should be empty")
+	}
+	if got, want := names(), []string{"alpha", "gallery"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected names. Got %v, want %v", got, want)
+	}
+	if !cached() {
+		t.Fatal("Cache should be populated")
+	}
+	// Listing the directories doesn't need to decrypt the files.
+	if _, _, ok := c.storage.cache.getFiles(galleryFile); ok {
+		t.Error("Gallery file set should not be cached yet")
+	}
+	if _, err := c.GlobFiles([]string{"gallery/*"}, GlobOptions{Quiet: true}); err != nil {
+		t.Fatalf("GlobFiles: %v", err)
+	}
+	if _, _, ok := c.storage.cache.getFiles(galleryFile); !ok {
+		t.Error("Gallery file set should be cached")
+	}
+
+	// Mutations invalidate the cache.
+	if err := c.AddAlbums([]string{"beta"}); err != nil {
+		t.Fatalf("AddAlbums: %v", err)
+	}
+	if cached() {
+		t.Fatal("Cache should be empty after AddAlbums")
+	}
+	if got, want := names(), []string{"alpha", "beta", "gallery"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected names. Got %v, want %v", got, want)
+	}
+	if err := c.Move([]string{"beta"}, "gamma", false); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	if got, want := names(), []string{"alpha", "gallery", "gamma"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected names. Got %v, want %v", got, want)
+	}
+
+	// Concurrent reads and mutations.
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			if err := c.AddAlbums([]string{fmt.Sprintf("album%d", i)}); err != nil {
+				t.Errorf("AddAlbums: %v", err)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			if _, err := c.GlobFiles([]string{"*"}, GlobOptions{}); err != nil {
+				t.Errorf("GlobFiles: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got, want := names(), []string{"album0", "album1", "album2", "album3", "album4", "alpha", "gallery", "gamma"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected names. Got %v, want %v", got, want)
+	}
+}
+
+// BenchmarkGlobFiles measures GlobFiles with a synthetic 100k-file gallery,
+// with and without a warm cache.
+func BenchmarkGlobFiles(b *testing.B) {
+	c, err := newClient(b.TempDir())
+	if err != nil {
+		b.Fatalf("newClient: %v", err)
+	}
+	const numFiles = 100000
+	fs := FileSet{Files: make(map[string]*stingle.File)}
+	pk := c.PublicKey()
+	for i := 0; i < numFiles; i++ {
+		hdrs := stingle.NewHeaders(fmt.Sprintf("file%06d.jpg", i))
+		encHdrs, err := stingle.EncryptBase64Headers(hdrs[:], pk)
+		if err != nil {
+			b.Fatalf("EncryptBase64Headers: %v", err)
+		}
+		f := &stingle.File{
+			File:         makeSPFilename(),
+			Version:      "1",
+			DateCreated:  json.Number("1"),
+			DateModified: json.Number("1"),
+			Headers:      encHdrs,
+		}
+		fs.Files[f.File] = f
+	}
+	if err := c.storage.SaveDataFile(c.fileHash(galleryFile), &fs); err != nil {
+		b.Fatalf("SaveDataFile: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		pattern string
+		want    int
+		cold    bool
+	}{
+		{"List/Cold", "*", 1, true},
+		{"List/Warm", "*", 1, false},
+		{"Literal/Cold", "gallery/file050000.jpg", 1, true},
+		{"Literal/Warm", "gallery/file050000.jpg", 1, false},
+		{"Wildcard/Cold", "gallery/file05*.jpg", 10000, true},
+		{"Wildcard/Warm", "gallery/file05*.jpg", 10000, false},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if tc.cold {
+					c.storage.cache.invalidate()
+				}
+				li, err := c.GlobFiles([]string{tc.pattern}, GlobOptions{})
+				if err != nil {
+					b.Fatalf("GlobFiles: %v", err)
+				}
+				if got := len(li); got != tc.want {
+					b.Fatalf("Unexpected number of items. Want %d, got %d", tc.want, got)
+				}
+				if tc.pattern == "*" && li[0].DirSize != numFiles {
+					b.Fatalf("Unexpected DirSize. Want %d, got %d", numFiles, li[0].DirSize)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"time"
+
+	"c2FmZQ/internal/log"
+)
+
+// AccessTimes contains the last time the local copy of each file was used,
+// keyed by stingle.File.File. The times are in milliseconds.
+type AccessTimes struct {
+	Files map[string]int64 `json:"files"`
+}
+
+// SetCacheLimit sets the maximum total size, in bytes, of the local copies of
+// the files that are backed up. When it is exceeded, Sync frees the least
+// recently used files. Thumbnails are not counted and are never freed. Zero
+// means no limit.
+func (c *Client) SetCacheLimit(limit int64) error {
+	if limit < 0 {
+		return errors.New("the cache limit cannot be negative")
+	}
+	c.CacheLimit = limit
+	return c.Save()
+}
+
+// OpenFile opens the local copy of item's content, and records the access for
+// the cache limit.
+func (c *Client) OpenFile(item ListItem) (*os.File, error) {
+	f, err := os.Open(item.FilePath)
+	if err == nil {
+		c.recordAccess(item.FSFile.File)
+	}
+	return f, err
+}
+
+// recordAccess records that the local copy of a file was used. The access
+// times are only needed, and only recorded, when there is a cache limit.
+func (c *Client) recordAccess(file string) {
+	if c.CacheLimit == 0 {
+		return
+	}
+	// The access times don't affect glob. Bypass the cache invalidation.
+	fn := c.fileHash(accessTimesFile)
+	c.storage.Storage.CreateEmptyFile(fn, &AccessTimes{})
+	var at AccessTimes
+	commit, err := c.storage.Storage.OpenForUpdate(fn, &at)
+	if err != nil {
+		log.Errorf("recordAccess: %v", err)
+		return
+	}
+	if at.Files == nil {
+		at.Files = make(map[string]int64)
+	}
+	at.Files[file] = time.Now().UnixMilli()
+	if err := commit(true, nil); err != nil {
+		log.Errorf("recordAccess: %v", err)
+	}
+}
+
+// enforceCacheLimit frees the least recently used files that are backed up
+// until the total size of the local files is under the cache limit. Files
+// without an access time are ordered by their modification time. Files in
+// locked albums and pinned files are never freed.
+func (c *Client) enforceCacheLimit() error {
+	if c.CacheLimit <= 0 {
+		return nil
+	}
+	list, err := c.GlobFiles([]string{"*"}, GlobOptions{MatchDot: true, Recursive: true, Quiet: true})
+	if err != nil {
+		return err
+	}
+	pl, err := c.Pins()
+	if err != nil {
+		return err
+	}
+	var at AccessTimes
+	if err := c.storage.ReadDataFile(c.fileHash(accessTimesFile), &at); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	type candidate struct {
+		item  ListItem
+		size  int64
+		atime int64
+	}
+	var candidates []candidate
+	var total int64
+	seen := make(map[string]bool)
+	for _, item := range list {
+		if item.IsDir || seen[item.FilePath] {
+			continue
+		}
+		seen[item.FilePath] = true
+		fi, err := os.Stat(item.FilePath)
+		if err != nil {
+			continue
+		}
+		total += fi.Size()
+		if item.LocalOnly || isLocked(item.Album) || pl.IsPinned(item) {
+			continue
+		}
+		atime, ok := at.Files[item.FSFile.File]
+		if !ok {
+			atime = fi.ModTime().UnixMilli()
+		}
+		candidates = append(candidates, candidate{item, fi.Size(), atime})
+	}
+	if total <= c.CacheLimit {
+		return nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].atime < candidates[j].atime
+	})
+	count := 0
+	for _, cand := range candidates {
+		if total <= c.CacheLimit {
+			break
+		}
+		freed, err := c.freeItem(cand.item, false)
+		if err != nil {
+			return err
+		}
+		if freed {
+			total -= cand.size
+			count++
+		}
+	}
+	if count > 0 {
+		c.Infof("Freed %d file(s) to stay under the cache limit.\n", count)
+	}
+	if total > c.CacheLimit {
+		c.Info("The local files that aren't backed up exceed the cache limit.")
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"c2FmZQ/internal/client"
+)
+
+func TestCacheLimit(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 5); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "*")}, "gallery", true); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+	if err := c.SetCacheLimit(-1); err == nil {
+		t.Error("c.SetCacheLimit(-1) should have failed")
+	}
+
+	list, err := c.GlobFiles([]string{"gallery/*"}, client.GlobOptions{})
+	if err != nil || len(list) != 5 {
+		t.Fatalf("c.GlobFiles: %d, %v", len(list), err)
+	}
+	sizes := make([]int64, len(list))
+	for i, item := range list {
+		fi, err := os.Stat(item.FilePath)
+		if err != nil {
+			t.Fatalf("os.Stat: %v", err)
+		}
+		sizes[i] = fi.Size()
+	}
+	if err := c.SetCacheLimit(sizes[0] + sizes[1]); err != nil {
+		t.Fatalf("c.SetCacheLimit: %v", err)
+	}
+	// Use the first two files. They should be the ones that are kept.
+	for _, item := range list[:2] {
+		f, err := c.OpenFile(item)
+		if err != nil {
+			t.Fatalf("c.OpenFile: %v", err)
+		}
+		f.Close()
+	}
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+
+	for i, item := range list {
+		_, err := os.Stat(item.FilePath)
+		if want, got := i >= 2, os.IsNotExist(err); want != got {
+			t.Errorf("%s: freed = %v, want %v", item.Filename, got, want)
+		}
+		if _, err := os.Stat(item.ThumbPath); err != nil {
+			t.Errorf("%s: thumbnail: %v", item.Filename, err)
+		}
+	}
+
+	// Files that are pulled again count as used.
+	if n, err := c.Pull([]string{"gallery/*"}, client.GlobOptions{}); err != nil {
+		t.Fatalf("c.Pull: %v", err)
+	} else if want, got := 3, n; want != got {
+		t.Errorf("Unexpected Pull result. Want %d, got %d", want, got)
+	}
+	if err := c.SetCacheLimit(sizes[2] + sizes[3] + sizes[4]); err != nil {
+		t.Fatalf("c.SetCacheLimit: %v", err)
+	}
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+	for i, item := range list {
+		_, err := os.Stat(item.FilePath)
+		if want, got := i < 2, os.IsNotExist(err); want != got {
+			t.Errorf("%s: freed = %v, want %v", item.Filename, got, want)
+		}
+	}
+
+	if err := c.SetCacheLimit(0); err != nil {
+		t.Fatalf("c.SetCacheLimit: %v", err)
+	}
+}
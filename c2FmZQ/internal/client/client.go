@@ -20,6 +20,8 @@ package client
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -29,42 +31,69 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
+	"runtime/debug"
 	"strings"
-	"time"
+	"sync"
+	"sync/atomic"
 
 	"github.com/c2FmZQ/storage"
 	"github.com/c2FmZQ/storage/autocertcache"
 	"github.com/c2FmZQ/storage/crypto"
 
+	"c2FmZQ/internal/fileperm"
 	"c2FmZQ/internal/log"
 	"c2FmZQ/internal/stingle"
 	"c2FmZQ/internal/stingle/token"
 )
 
 const (
-	configFile   = "config"
-	galleryFile  = "gallery"
-	trashFile    = "trash"
-	albumList    = "albums"
-	albumPrefix  = "album/"
-	contactsFile = "contacts"
-	cacheFile    = "autocert-cache.dat"
-
-	userAgent = "Dalvik/2.1.0 (Linux; U; Android 9; moto x4 Build/PPWS29.69-39-6-4)"
+	configFile      = "config"
+	galleryFile     = "gallery"
+	trashFile       = "trash"
+	albumList       = "albums"
+	albumPrefix     = "album/"
+	contactsFile    = "contacts"
+	cacheFile       = "autocert-cache.dat"
+	historyFile     = "history"
+	accessTimesFile = "access-times"
+	pinsFile        = "pins"
+	conflictsFile   = "conflicts"
 )
 
 var (
-	ErrNotLoggedIn = errors.New("not logged in")
+	ErrNotLoggedIn      = errors.New("not logged in")
+	ErrFileNotFound     = errors.New("file not found")
+	ErrAlbumNotFound    = errors.New("album not found")
+	ErrContactNotFound  = errors.New("contact not found")
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrServerKeyChanged = errors.New("server public key changed")
+	ErrOffline          = errors.New("offline mode")
+	// ErrDecrypt is returned when a file or its header can't be decrypted,
+	// e.g. because the local copy is corrupt.
+	ErrDecrypt = stingle.ErrDecrypt
 )
 
+// ServerError is returned when the server responds to a request with a status
+// other than ok. It carries the server's full response.
+type ServerError struct {
+	Response *stingle.Response
+}
+
+func (e *ServerError) Error() string {
+	return "server error: " + e.Response.Error()
+}
+
 // Create creates a new client configuration, if one doesn't exist already.
 func Create(m crypto.MasterKey, s *storage.Storage) (*Client, error) {
 	var c Client
-	c.hc = &http.Client{}
+	c.timeouts = DefaultTimeouts()
+	c.hc = newHTTPClient(c.timeouts, nil)
 	c.masterKey = m
-	c.storage = s
+	c.storage = newCachedStorage(s)
 	c.writer = os.Stdout
 	c.prompt = prompt
+	c.userAgent = defaultUserAgent()
 	c.LocalSecretKey = c.encryptSK(stingle.MakeSecretKey())
 	c.WebServerConfig = NewWebServerConfig()
 
@@ -77,36 +106,104 @@ func Create(m crypto.MasterKey, s *storage.Storage) (*Client, error) {
 	return &c, nil
 }
 
+// LoadOption is an option for Load.
+type LoadOption func(*Client) error
+
 // Load loads the existing client configuration.
-func Load(m crypto.MasterKey, s *storage.Storage) (*Client, error) {
+func Load(m crypto.MasterKey, s *storage.Storage, opts ...LoadOption) (*Client, error) {
 	var c Client
 	c.masterKey = m
-	c.storage = s
+	c.storage = newCachedStorage(s)
 	if err := s.ReadDataFile(c.cfgFile(), &c); err != nil {
 		return nil, err
 	}
 	if c.WebServerConfig == nil {
 		c.WebServerConfig = NewWebServerConfig()
 	}
-	c.hc = &http.Client{}
+	c.timeouts = DefaultTimeouts()
+	c.hc = newHTTPClient(c.timeouts, nil)
 	c.writer = os.Stdout
 	c.prompt = prompt
+	c.userAgent = defaultUserAgent()
+	for _, opt := range opts {
+		if err := opt(&c); err != nil {
+			return nil, err
+		}
+	}
 	c.createEmptyFiles()
 	return &c, nil
 }
 
 // Client contains the metadata for a user account.
+//
+// A Client can be shared by multiple goroutines. The file operations, e.g.
+// ListFiles, IterateFiles, ImportFiles, Copy, Move, Delete, and the sync
+// operations, e.g. GetUpdates, Sync, Pin, can be called concurrently: the
+// file sets are protected by the storage layer's locks, the in-memory caches
+// have their own mutexes, and the messages are written to the writer one at
+// a time.
+//
+// The Set* methods that change the Client's configuration must be called
+// before the Client is shared. The methods that change the account or the
+// local configuration, e.g. Login, Logout, ChangePassword, SetServerURL,
+// SetCacheLimit, ReshardBlobs, WipeAccount, must not be called concurrently
+// with any other method.
 type Client struct {
 	Account         *AccountInfo     `json:"accountInfo"`
 	WebServerConfig *WebServerConfig `json:"webServerConfig"`
 	LocalSecretKey  []byte           `json:"localSecretKey"`
-
-	hc *http.Client
-
-	masterKey crypto.MasterKey
-	storage   *storage.Storage
-	writer    io.Writer
-	prompt    func(msg string) (string, error)
+	// The number of directory levels used to store the blobs. Zero means
+	// one level. It is changed with ReshardBlobs.
+	BlobShardDepth int `json:"blobShardDepth,omitempty"`
+	// The maximum total size of the local copies of the files that are
+	// backed up. Zero means no limit. It is changed with SetCacheLimit.
+	CacheLimit int64 `json:"cacheLimit,omitempty"`
+	// The public keys that the servers presented the first time each
+	// account logged in, by server URL and email address. A server that
+	// presents a different key is rejected unless SetAcceptNewServerKey is
+	// used.
+	ServerKeys map[string]stingle.PublicKey `json:"serverKeys,omitempty"`
+
+	hc        *http.Client
+	timeouts  Timeouts
+	tlsConfig *tls.Config
+	trace     bool
+	userAgent string
+
+	masterKey  crypto.MasterKey
+	storage    cachedStorage
+	writer     io.Writer
+	writerMu   sync.Mutex
+	prompt     func(msg string) (string, error)
+	quiet      bool
+	durability Durability
+	// The permission of the blobs and blob directories.
+	blobPerm fileperm.Perm
+	// The directory where blobs are written before being moved to their
+	// final location. Empty means the blob's own directory.
+	tempDir     string
+	tempDirNote sync.Once
+	// The difference between the server's clock and the local clock,
+	// in nanoseconds, and whether to adjust timestamps with it.
+	clockSkew     atomic.Int64
+	clockSkewNote sync.Once
+	adjustClock   bool
+	// Whether to accept, and pin, a server public key that is different
+	// from the one that was pinned before.
+	acceptNewServerKey bool
+	// Whether GetUpdates applies the changes to the file sets concurrently.
+	parallelSets bool
+	// Whether GetUpdates keeps the local version of conflicting files.
+	keepLocalOnConflict bool
+	// Whether all requests to the server are refused with ErrOffline.
+	offline bool
+	// Whether the server doesn't support /v2/sync/uploadBatch. It is set
+	// the first time the server rejects a batch upload.
+	noBatchUpload atomic.Bool
+	// When the login state comes from WithLogin, the account that is
+	// saved in the data directory instead of Account.
+	savedAccount  *AccountInfo
+	loginOverride bool
 }
 
 // AccountInfo encapsulated the information for a logged in account.
@@ -150,6 +247,9 @@ type WebServerConfig struct {
 
 // Save saves the current client configuration.
 func (c *Client) Save() error {
+	if c.loginOverride {
+		return c.storage.SaveDataFile(c.cfgFile(), c.withSavedAccount())
+	}
 	return c.storage.SaveDataFile(c.cfgFile(), c)
 }
 
@@ -206,6 +306,19 @@ func (c *Client) Status() error {
 		}
 	}
 	c.Printf("Public key: % X\n", c.PublicKey().ToBytes())
+	if local, err := c.LocalUsage(); err == nil {
+		c.Printf("Local storage: %s\n", HumanSize(local))
+	}
+	if c.Account != nil {
+		u, err := c.ServerUsage()
+		if err != nil {
+			c.Printf("Server storage: unavailable (%v)\n", err)
+			return nil
+		}
+		c.Printf("Server storage: %s in %d files, %d albums (quota %s, %s remaining)\n",
+			HumanSize(u.SpaceUsed), u.FileCount, u.AlbumCount, HumanSize(u.SpaceQuota), HumanSize(u.SpaceRemaining))
+		c.Printf("Clock skew: %s\n", c.ClockSkew())
+	}
 	return nil
 }
 
@@ -227,30 +340,98 @@ func (c *Client) SetPrompt(f func(msg string) (string, error)) {
 }
 
 func (c *Client) SetHTTPClient(hc *http.Client) {
-	c.hc = hc
+	c.hc = c.traceHTTPClient(hc)
+}
+
+// SetUserAgent sets the User-Agent header of the requests to the server.
+func (c *Client) SetUserAgent(ua string) {
+	c.userAgent = ua
+}
+
+// defaultUserAgent returns the default User-Agent header, e.g.
+// c2FmZQ-client/v0.4.10 (linux).
+func defaultUserAgent() string {
+	version := "devel"
+	if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+		version = bi.Main.Version
+	}
+	return fmt.Sprintf("c2FmZQ-client/%s (%s)", version, runtime.GOOS)
 }
 
 func (c *Client) Printf(format string, args ...interface{}) {
+	c.writerMu.Lock()
+	defer c.writerMu.Unlock()
 	fmt.Fprintf(c.writer, format, args...)
 }
 
 func (c *Client) Print(args ...interface{}) {
+	c.writerMu.Lock()
+	defer c.writerMu.Unlock()
 	fmt.Fprintln(c.writer, args...)
 }
 
-func nowString() string {
-	return fmt.Sprintf("%d", time.Now().UnixNano()/1000000)
+// SetQuiet sets whether informational messages, e.g. progress and success
+// messages, are suppressed.
+func (c *Client) SetQuiet(quiet bool) {
+	c.quiet = quiet
+}
+
+// SetOffline sets whether the client works without a network connection. In
+// offline mode, all requests to the server fail with ErrOffline, and the
+// files that aren't available locally can't be read.
+func (c *Client) SetOffline(offline bool) {
+	c.offline = offline
+}
+
+// Infof prints an informational message, unless quiet mode is enabled.
+func (c *Client) Infof(format string, args ...interface{}) {
+	if !c.quiet {
+		c.Printf(format, args...)
+	}
+}
+
+// Info prints an informational message, unless quiet mode is enabled.
+func (c *Client) Info(args ...interface{}) {
+	if !c.quiet {
+		c.Print(args...)
+	}
 }
 
-func nowJSON() json.Number {
-	return json.Number(nowString())
+func (c *Client) nowString() string {
+	return fmt.Sprintf("%d", c.now().UnixNano()/1000000)
+}
+
+func (c *Client) nowJSON() json.Number {
+	return json.Number(c.nowString())
 }
 
 func (c *Client) fileHash(fn string) string {
+	n := c.nameHash(fn)
+	return filepath.Join(n[:2], n)
+}
+
+// nameHash returns the hash of fn, i.e. the name of the file where fn is
+// stored.
+func (c *Client) nameHash(fn string) string {
 	sk := c.SecretKey()
 	defer sk.Wipe()
-	n := c.storage.HashString(hex.EncodeToString(sk.ToBytes()) + "/" + fn)
-	return filepath.Join(n[:2], n)
+	return c.storage.HashString(hex.EncodeToString(sk.ToBytes()) + "/" + fn)
+}
+
+// signRequest adds a request signature to req, so that the server can reject
+// replayed requests. Requests without a session token aren't signed.
+func (c *Client) signRequest(req *http.Request, tok string) error {
+	if tok == "" || c.Account == nil || c.Account.ServerPublicKey == (stingle.PublicKey{}) {
+		return nil
+	}
+	sk := c.SecretKey()
+	defer sk.Wipe()
+	sig, err := stingle.SignRequest(req.Method, req.URL.Path, tok, c.now().UnixMilli(), c.Account.ServerPublicKey, sk)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(stingle.RequestSignatureHeader, sig)
+	return nil
 }
 
 func (c *Client) encodeParams(params map[string]string) string {
@@ -261,6 +442,15 @@ func (c *Client) encodeParams(params map[string]string) string {
 }
 
 func (c *Client) sendRequest(uri string, form url.Values, server string) (*stingle.Response, error) {
+	return c.sendRequestContext(context.Background(), uri, form, server)
+}
+
+// sendRequestContext sends an API request. The request is canceled when ctx
+// is done.
+func (c *Client) sendRequestContext(ctx context.Context, uri string, form url.Values, server string) (*stingle.Response, error) {
+	if c.offline {
+		return nil, ErrOffline
+	}
 	if server == "" && c.Account != nil {
 		server = c.Account.ServerBaseURL
 	}
@@ -271,17 +461,23 @@ func (c *Client) sendRequest(uri string, form url.Values, server string) (*sting
 
 	log.Debugf("SEND POST %s", url)
 
-	req, err := http.NewRequest("POST", url, strings.NewReader(form.Encode()))
+	ctx, cancel := c.requestContext(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(form.Encode()))
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("User-Agent", c.userAgent)
+	if err := c.signRequest(req, form.Get("token")); err != nil {
+		return nil, err
+	}
 	resp, err := c.hc.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	c.checkClockSkew(resp)
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("request returned status code %d", resp.StatusCode)
 	}
@@ -314,7 +510,10 @@ func (c *Client) sendRequest(uri string, form url.Values, server string) (*sting
 	return &sr, nil
 }
 
-func (c *Client) download(file, set, thumb string) (io.ReadCloser, error) {
+func (c *Client) download(ctx context.Context, file, set, thumb string) (io.ReadCloser, error) {
+	if c.offline {
+		return nil, ErrOffline
+	}
 	if c.Account == nil {
 		return nil, ErrNotLoggedIn
 	}
@@ -331,21 +530,38 @@ func (c *Client) download(file, set, thumb string) (io.ReadCloser, error) {
 
 	log.Debugf("SEND POST %v", url)
 
-	req, err := http.NewRequest("POST", url, strings.NewReader(form.Encode()))
+	// There is no overall deadline for downloads. They are only canceled
+	// if they stop making progress, or if ctx is canceled.
+	ctx, cancel := context.WithCancel(ctx)
+	stall := c.newStallDetector(cancel)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(form.Encode()))
 	if err != nil {
+		stall.stop()
+		cancel()
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("User-Agent", c.userAgent)
+	if err := c.signRequest(req, c.Account.Token); err != nil {
+		stall.stop()
+		cancel()
+		return nil, err
+	}
 	resp, err := c.hc.Do(req)
 	if err != nil {
+		stall.stop()
+		cancel()
 		return nil, err
 	}
+	c.checkClockSkew(resp)
 	if resp.StatusCode != http.StatusOK {
 		resp.Body.Close()
+		stall.stop()
+		cancel()
 		return nil, fmt.Errorf("request returned status code %d", resp.StatusCode)
 	}
-	return resp.Body, nil
+	stall.progress()
+	return &transferBody{stallReader{resp.Body, stall}, resp.Body, cancel}, nil
 }
 
 // DownloadGet returns a seekable download stream for the remote file.
@@ -368,19 +584,20 @@ func (c *Client) DownloadGet(file, set string, thumb bool) (*SeekDownloader, err
 		return nil, err
 	}
 	if sr.Status != "ok" {
-		return nil, sr
+		return nil, &ServerError{sr}
 	}
 	url, ok := sr.Part("url").(string)
 	if !ok {
 		return nil, fmt.Errorf("server did not return a url: %v", sr.Part("url"))
 	}
-	return &SeekDownloader{hc: c.hc, url: url}, nil
+	return &SeekDownloader{hc: c.hc, ua: c.userAgent, url: url}, nil
 }
 
 // SeekDownloader uses HTTP GET with a Range header to make the download
 // stream seekable.
 type SeekDownloader struct {
 	hc     *http.Client
+	ua     string
 	url    string
 	offset int64
 	body   io.ReadCloser
@@ -407,7 +624,7 @@ func (d *SeekDownloader) Seek(offset int64, whence int) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
-	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("User-Agent", d.ua)
 	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", d.offset))
 	resp, err := d.hc.Do(req)
 	if err != nil {
@@ -460,7 +677,7 @@ func (c *Client) createEmptyFiles() (err error) {
 
 // AutocertCache returns an Autocert Cache that uses the encrypted storage.
 func (c *Client) AutocertCache() *autocertcache.Cache {
-	return autocertcache.New(c.fileHash(cacheFile), c.storage)
+	return autocertcache.New(c.fileHash(cacheFile), c.storage.Storage)
 }
 
 func prompt(msg string) (reply string, err error) {
@@ -0,0 +1,57 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestUserAgent(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req.Header.Get("User-Agent")
+		fmt.Fprint(w, `{"status":"ok","parts":{}}`)
+	}))
+	defer srv.Close()
+
+	c, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	c.Account = &AccountInfo{ServerBaseURL: srv.URL}
+
+	if _, err := c.sendRequest("/v2/sync/getServerPK", url.Values{}, ""); err != nil {
+		t.Fatalf("sendRequest: %v", err)
+	}
+	if !strings.HasPrefix(got, "c2FmZQ-client/") {
+		t.Errorf("Unexpected default User-Agent %q", got)
+	}
+
+	c.SetUserAgent("my-app/1.0")
+	if _, err := c.sendRequest("/v2/sync/getServerPK", url.Values{}, ""); err != nil {
+		t.Fatalf("sendRequest: %v", err)
+	}
+	if want := "my-app/1.0"; got != want {
+		t.Errorf("User-Agent = %q, want %q", got, want)
+	}
+}
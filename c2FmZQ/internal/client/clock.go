@@ -0,0 +1,77 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"net/http"
+	"time"
+)
+
+// maxClockSkew is the difference between the local clock and the server's
+// clock above which the user is warned. The server rejects request signatures
+// with timestamps that are off by more than a few minutes.
+const maxClockSkew = time.Minute
+
+// SetAdjustClock sets whether the timestamps of new files, albums, and request
+// signatures are adjusted to match the server's clock.
+func (c *Client) SetAdjustClock(adjust bool) {
+	c.adjustClock = adjust
+}
+
+// ClockSkew returns how far the server's clock is ahead of the local clock,
+// as observed in the last response from the server.
+func (c *Client) ClockSkew() time.Duration {
+	return time.Duration(c.clockSkew.Load())
+}
+
+// now returns the current time, adjusted to match the server's clock if
+// enabled.
+func (c *Client) now() time.Time {
+	t := time.Now()
+	if c.adjustClock {
+		t = t.Add(c.ClockSkew())
+	}
+	return t
+}
+
+// checkClockSkew compares the Date header of a server response with the local
+// clock, and warns the user once when they are too far apart. The Date header
+// has a resolution of one second, which is plenty to detect a clock that is
+// badly off.
+func (c *Client) checkClockSkew(resp *http.Response) {
+	t, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return
+	}
+	skew := t.Sub(time.Now()).Round(time.Second)
+	c.clockSkew.Store(int64(skew))
+	if skew > -maxClockSkew && skew < maxClockSkew {
+		return
+	}
+	c.clockSkewNote.Do(func() {
+		dir := "behind"
+		if skew < 0 {
+			dir, skew = "ahead of", -skew
+		}
+		msg := "Use --adjust-clock to adjust the timestamps."
+		if c.adjustClock {
+			msg = "The timestamps are adjusted."
+		}
+		c.Printf("WARNING: The local clock is %s %s the server's clock. %s\n", skew, dir, msg)
+	})
+}
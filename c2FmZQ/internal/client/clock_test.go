@@ -0,0 +1,70 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClockSkew(t *testing.T) {
+	const skew = 10 * time.Minute
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Date", time.Now().Add(skew).UTC().Format(http.TimeFormat))
+		w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer srv.Close()
+
+	c, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	c.hc = srv.Client()
+	var out bytes.Buffer
+	c.SetWriter(&out)
+
+	if _, err := c.sendRequest("/v2/test", url.Values{}, srv.URL); err != nil {
+		t.Fatalf("sendRequest: %v", err)
+	}
+	if got := c.ClockSkew(); got < skew-2*time.Second || got > skew+2*time.Second {
+		t.Errorf("ClockSkew() = %s, want ~%s", got, skew)
+	}
+	if !strings.Contains(out.String(), "WARNING: The local clock is") {
+		t.Errorf("Unexpected output: %q", out.String())
+	}
+	out.Reset()
+	if _, err := c.sendRequest("/v2/test", url.Values{}, srv.URL); err != nil {
+		t.Fatalf("sendRequest: %v", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("Unexpected output: %q", out.String())
+	}
+
+	if d := time.Since(c.now()); d < -time.Second || d > time.Second {
+		t.Errorf("now() is adjusted by %s without SetAdjustClock", -d)
+	}
+	c.SetAdjustClock(true)
+	if d := c.now().Sub(time.Now()); d < skew-2*time.Second || d > skew+2*time.Second {
+		t.Errorf("now() is adjusted by %s, want ~%s", d, skew)
+	}
+}
@@ -0,0 +1,136 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"c2FmZQ/internal/client"
+)
+
+// TestConcurrentUse uses the same client from multiple goroutines. It is
+// most useful with the race detector, i.e. go test -race.
+func TestConcurrentUse(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	// Embedders typically collect the output in a buffer.
+	var out bytes.Buffer
+	c.SetWriter(&out)
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	if err := c.Login(url, "alice@", "pass"); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if err := c.AddAlbums([]string{"album"}); err != nil {
+		t.Fatalf("AddAlbums: %v", err)
+	}
+
+	const numImporters = 4
+	const numFiles = 5
+	var importDone sync.WaitGroup
+	stop := make(chan struct{})
+	errCh := make(chan error, 100)
+	var wg sync.WaitGroup
+	for i := 0; i < numImporters; i++ {
+		dir := t.TempDir()
+		if err := makeImages(dir, i*numFiles, numFiles); err != nil {
+			t.Fatalf("makeImages: %v", err)
+		}
+		dest := "gallery"
+		if i%2 == 1 {
+			dest = "album"
+		}
+		wg.Add(1)
+		importDone.Add(1)
+		go func() {
+			defer wg.Done()
+			defer importDone.Done()
+			if _, err := c.ImportFiles([]string{filepath.Join(dir, "*")}, dest, false); err != nil {
+				errCh <- fmt.Errorf("ImportFiles: %w", err)
+			}
+		}()
+	}
+	// Readers and mutators that run until the imports are done.
+	loop := func(name string, f func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := f(); err != nil {
+					errCh <- fmt.Errorf("%s: %w", name, err)
+					return
+				}
+			}
+		}()
+	}
+	loop("ListFiles", func() error {
+		return c.ListFiles([]string{"*"}, client.GlobOptions{Recursive: true, Long: true, Quiet: true})
+	})
+	loop("IterateFiles", func() error {
+		return c.IterateFiles([]string{"*/*"}, client.GlobOptions{Quiet: true}, func(client.ListItem) error { return nil })
+	})
+	loop("Sync", func() error { return c.Sync(false) })
+	loop("GetUpdates", func() error { return c.GetUpdates(true) })
+	loop("Pin", func() error {
+		if _, err := c.Pin([]string{"album"}, client.GlobOptions{}, true); err != nil {
+			return err
+		}
+		_, err := c.Pin([]string{"album"}, client.GlobOptions{}, false)
+		return err
+	})
+	loop("Status", c.Status)
+
+	importDone.Wait()
+	close(stop)
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Error(err)
+	}
+
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	got, err := globAll(c)
+	if err != nil {
+		t.Fatalf("globAll: %v", err)
+	}
+	want := []string{".trash", "album", "gallery"}
+	for i := 0; i < numImporters*numFiles; i++ {
+		dir := "gallery"
+		if (i/numFiles)%2 == 1 {
+			dir = "album"
+		}
+		want = append(want, fmt.Sprintf("%s/image%03d.jpg", dir, i))
+	}
+	sort.Strings(want)
+	if fmt.Sprint(want) != fmt.Sprint(got) {
+		t.Errorf("Unexpected files.\nWant %v\n Got %v", want, got)
+	}
+}
@@ -0,0 +1,176 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+// The maximum number of conflicts that are remembered.
+const maxConflicts = 1000
+
+// Conflict is a file that was changed on the server while it also had local
+// changes that weren't synced yet.
+type Conflict struct {
+	// The file set where the conflict happened, e.g. gallery or album/<id>.
+	FileSet string `json:"fileSet"`
+	// When the conflict was detected, in milliseconds.
+	Date int64 `json:"date"`
+	// The local version of the file, or nil if it was removed locally.
+	Local *stingle.File `json:"local"`
+	// The server's version of the file.
+	Remote *stingle.File `json:"remote"`
+	// Whether the local version was kept. Otherwise, it was replaced with
+	// the server's version.
+	KeptLocal bool `json:"keptLocal"`
+}
+
+// ConflictList contains the conflicts detected by GetUpdates.
+type ConflictList struct {
+	Conflicts []Conflict `json:"conflicts"`
+}
+
+// SetKeepLocalOnConflict sets whether GetUpdates keeps the local version of
+// the files that were changed both locally and on the server. The local
+// version is then sent to the server with the next sync. By default, the
+// server's version replaces the local one.
+func (c *Client) SetKeepLocalOnConflict(keep bool) {
+	c.keepLocalOnConflict = keep
+}
+
+// Conflicts returns the conflicts that were detected, oldest first.
+func (c *Client) Conflicts() ([]Conflict, error) {
+	var cl ConflictList
+	if err := c.storage.Storage.ReadDataFile(c.fileHash(conflictsFile), &cl); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return cl.Conflicts, nil
+}
+
+// ClearConflicts forgets all the conflicts that were detected.
+func (c *Client) ClearConflicts() error {
+	return c.storage.Storage.SaveDataFile(c.fileHash(conflictsFile), &ConflictList{})
+}
+
+// recordConflicts remembers the conflicts that were detected in fileSet.
+func (c *Client) recordConflicts(fileSet string, conflicts []Conflict) (retErr error) {
+	if len(conflicts) == 0 {
+		return nil
+	}
+	now := c.now().UnixMilli()
+	for i := range conflicts {
+		conflicts[i].FileSet = fileSet
+		conflicts[i].Date = now
+		kept := "server"
+		if conflicts[i].KeptLocal {
+			kept = "local"
+		}
+		log.Infof("Conflict in %s: file %s was changed locally and on the server, kept %s version", fileSet, conflicts[i].Remote.File, kept)
+	}
+	// The conflicts don't affect glob. Bypass the cache invalidation.
+	fn := c.fileHash(conflictsFile)
+	c.storage.Storage.CreateEmptyFile(fn, &ConflictList{})
+	var cl ConflictList
+	commit, err := c.storage.Storage.OpenForUpdate(fn, &cl)
+	if err != nil {
+		return err
+	}
+	defer commit(true, &retErr)
+	cl.Conflicts = append(cl.Conflicts, conflicts...)
+	if len(cl.Conflicts) > maxConflicts {
+		cl.Conflicts = cl.Conflicts[len(cl.Conflicts)-maxConflicts:]
+	}
+	return nil
+}
+
+// ListConflicts shows the conflicts that were detected.
+func (c *Client) ListConflicts() error {
+	conflicts, err := c.Conflicts()
+	if err != nil {
+		return err
+	}
+	if len(conflicts) == 0 {
+		c.Info("No conflicts.")
+		return nil
+	}
+	var al AlbumList
+	if err := c.storage.ReadDataFile(c.fileHash(albumList), &al); err != nil {
+		return err
+	}
+	for _, cf := range conflicts {
+		kept := "kept server version"
+		if cf.KeptLocal {
+			kept = "kept local version"
+		}
+		if cf.Local == nil {
+			kept += ", removed locally"
+		}
+		c.Printf("%s %s: %s\n", time.UnixMilli(cf.Date).Format("2006-01-02 15:04:05"), c.conflictName(cf, al), kept)
+	}
+	return nil
+}
+
+// conflictName returns the name of the file in conflict, e.g. gallery/foo.jpg.
+func (c *Client) conflictName(cf Conflict, al AlbumList) string {
+	var dir string
+	var album *stingle.Album
+	switch {
+	case cf.FileSet == galleryFile:
+		dir = "gallery"
+	case cf.FileSet == trashFile:
+		dir = ".trash"
+	case strings.HasPrefix(cf.FileSet, albumPrefix):
+		albumID := strings.TrimPrefix(cf.FileSet, albumPrefix)
+		if album = al.Albums[albumID]; album == nil {
+			album = al.RemoteAlbums[albumID]
+		}
+		if album == nil {
+			return cf.FileSet + "/" + cf.Remote.File
+		}
+		sk := c.SecretKey()
+		name, err := album.Name(sk)
+		sk.Wipe()
+		if err != nil {
+			return cf.FileSet + "/" + cf.Remote.File
+		}
+		dir = sanitize(name)
+	default:
+		return cf.FileSet + "/" + cf.Remote.File
+	}
+	sk, err := c.SKForAlbum(album)
+	if err != nil {
+		return dir + "/" + cf.Remote.File
+	}
+	defer sk.Wipe()
+	hdrs, err := stingle.DecryptBase64Headers(cf.Remote.Headers, sk)
+	if err != nil {
+		return dir + "/" + cf.Remote.File
+	}
+	defer hdrs[0].Wipe()
+	defer hdrs[1].Wipe()
+	return dir + "/" + sanitize(string(hdrs[0].Filename))
+}
@@ -0,0 +1,122 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// DumpFile shows the decrypted content of a data file as JSON. The name is
+// either a path relative to the data directory, or the logical name of one of
+// the client's data files, i.e. config, gallery, trash, albums, contacts,
+// history, or album/<albumID>. It is meant for debugging.
+func (c *Client) DumpFile(name string) error {
+	fn, obj, err := c.dumpFileName(name)
+	if err != nil {
+		return err
+	}
+	if obj != nil {
+		if err := c.storage.ReadDataFile(fn, obj); err != nil {
+			return err
+		}
+	} else {
+		// Not one of the known files. Guess the type.
+		var (
+			al AlbumList
+			fs FileSet
+			cl ContactList
+			sh ShellHistory
+		)
+		switch {
+		case c.storage.ReadDataFile(fn, &al) == nil && al.Albums != nil:
+			obj = al
+		case c.storage.ReadDataFile(fn, &fs) == nil && fs.Files != nil:
+			obj = fs
+		case c.storage.ReadDataFile(fn, &cl) == nil && cl.Contacts != nil:
+			obj = cl
+		case c.storage.ReadDataFile(fn, &sh) == nil && sh.Lines != nil:
+			obj = sh
+		default:
+			return fmt.Errorf("%s: not a known data file", name)
+		}
+	}
+	b, err := json.MarshalIndent(obj, "", "  ")
+	if err != nil {
+		return err
+	}
+	c.Print(string(b))
+	return nil
+}
+
+// dumpFileName returns the path of the file to dump, relative to the data
+// directory, and an object of the right type for it, if it is known. Paths
+// that escape the data directory are rejected.
+func (c *Client) dumpFileName(name string) (string, interface{}, error) {
+	known := map[string]func() interface{}{
+		configFile:      func() interface{} { return new(Client) },
+		galleryFile:     func() interface{} { return new(FileSet) },
+		trashFile:       func() interface{} { return new(FileSet) },
+		albumList:       func() interface{} { return new(AlbumList) },
+		contactsFile:    func() interface{} { return new(ContactList) },
+		historyFile:     func() interface{} { return new(ShellHistory) },
+		accessTimesFile: func() interface{} { return new(AccessTimes) },
+		pinsFile:        func() interface{} { return new(PinList) },
+		conflictsFile:   func() interface{} { return new(ConflictList) },
+	}
+	var al AlbumList
+	if err := c.storage.ReadDataFile(c.fileHash(albumList), &al); err == nil {
+		for albumID := range al.Albums {
+			known[albumPrefix+albumID] = func() interface{} { return new(FileSet) }
+		}
+	}
+	hashed := func(n string) string {
+		if n == configFile {
+			return c.cfgFile()
+		}
+		return c.fileHash(n)
+	}
+	if f, ok := known[name]; ok {
+		return hashed(name), f(), nil
+	}
+
+	if filepath.IsAbs(name) {
+		rel, err := filepath.Rel(c.storage.Dir(), name)
+		if err != nil {
+			return "", nil, err
+		}
+		name = rel
+	}
+	if !filepath.IsLocal(name) {
+		return "", nil, fmt.Errorf("%s: outside of the data directory", name)
+	}
+	if _, err := os.Stat(filepath.Join(c.storage.Dir(), name)); errors.Is(err, os.ErrNotExist) {
+		return "", nil, ErrFileNotFound
+	} else if err != nil {
+		return "", nil, err
+	}
+	for n, f := range known {
+		if hashed(n) == filepath.Clean(name) {
+			return name, f(), nil
+		}
+	}
+	return name, nil, nil
+}
@@ -0,0 +1,69 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDumpFile(t *testing.T) {
+	dir := t.TempDir()
+	c, err := newClient(dir)
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	if err := c.AddAlbums([]string{"foo"}); err != nil {
+		t.Fatalf("AddAlbums: %v", err)
+	}
+	var buf bytes.Buffer
+	c.SetWriter(&buf)
+
+	for _, tc := range []struct {
+		name string
+		want string
+	}{
+		{"albums", `"remoteAlbums"`},
+		{"gallery", `"remoteFiles"`},
+		{"contacts", `"contacts"`},
+		{"config", `"localSecretKey"`},
+		{c.fileHash(trashFile), `"remoteFiles"`},
+		{filepath.Join(dir, c.fileHash(albumList)), `"remoteAlbums"`},
+	} {
+		buf.Reset()
+		if err := c.DumpFile(tc.name); err != nil {
+			t.Errorf("DumpFile(%q): %v", tc.name, err)
+			continue
+		}
+		if !strings.Contains(buf.String(), tc.want) {
+			t.Errorf("DumpFile(%q) = %q, want %s", tc.name, buf.String(), tc.want)
+		}
+	}
+
+	for _, name := range []string{"../foo", "/etc/passwd", filepath.Join(dir, "..", "foo")} {
+		if err := c.DumpFile(name); err == nil {
+			t.Errorf("DumpFile(%q) succeeded unexpectedly", name)
+		}
+	}
+	if err := c.DumpFile("nonexistent"); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("DumpFile(nonexistent) returned unexpected error: want %v, got %v", ErrFileNotFound, err)
+	}
+}
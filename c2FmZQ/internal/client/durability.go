@@ -0,0 +1,114 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"c2FmZQ/internal/fileperm"
+)
+
+// Durability controls how the files written by the client, e.g. blobs and
+// exported files, are flushed to disk.
+type Durability int
+
+const (
+	// DurabilitySync opens the files with O_SYNC, i.e. every write is
+	// flushed to disk before it returns. This is the default.
+	DurabilitySync Durability = iota
+	// DurabilityFsync calls fsync once when the files are closed.
+	DurabilityFsync
+	// DurabilityNone leaves it to the operating system to flush the data.
+	// Files written just before a crash or power loss can be lost or
+	// corrupted.
+	DurabilityNone
+)
+
+// ParseDurability parses the value of the --durability flag.
+func ParseDurability(s string) (Durability, error) {
+	switch s {
+	case "sync":
+		return DurabilitySync, nil
+	case "fsync":
+		return DurabilityFsync, nil
+	case "none":
+		return DurabilityNone, nil
+	default:
+		return 0, fmt.Errorf("invalid durability mode: %q", s)
+	}
+}
+
+// SetDurability sets how the files written by the client are flushed to disk.
+func (c *Client) SetDurability(d Durability) {
+	c.durability = d
+}
+
+// SetBlobPerm sets the permission of the new blobs and blob directories, e.g.
+// to let a backup user in the same group read them. The default is owner-only
+// access. The existing blobs and the metadata files aren't changed.
+func (c *Client) SetBlobPerm(p fileperm.Perm) error {
+	if err := p.Check(); err != nil {
+		return err
+	}
+	c.blobPerm = p
+	return nil
+}
+
+// openForWrite opens a file for writing according to the client's durability
+// mode. flag is passed to os.OpenFile, without O_SYNC.
+func (c *Client) openForWrite(name string, flag int) (io.WriteCloser, error) {
+	return c.openForWriteWithPerm(name, flag, fileperm.Default)
+}
+
+// openBlobForWrite is like openForWrite for blobs.
+func (c *Client) openBlobForWrite(name string, flag int) (io.WriteCloser, error) {
+	return c.openForWriteWithPerm(name, flag, c.blobPerm)
+}
+
+func (c *Client) openForWriteWithPerm(name string, flag int, perm fileperm.Perm) (io.WriteCloser, error) {
+	if c.durability == DurabilitySync {
+		flag |= os.O_SYNC
+	}
+	f, err := os.OpenFile(name, flag, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := perm.ApplyFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if c.durability == DurabilityFsync {
+		return fsyncOnClose{f}, nil
+	}
+	return f, nil
+}
+
+// fsyncOnClose is a file that is flushed to disk when it is closed.
+type fsyncOnClose struct {
+	*os.File
+}
+
+func (f fsyncOnClose) Close() error {
+	if err := f.File.Sync(); err != nil {
+		f.File.Close()
+		return err
+	}
+	return f.File.Close()
+}
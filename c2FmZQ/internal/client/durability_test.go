@@ -0,0 +1,109 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"c2FmZQ/internal/client"
+	"c2FmZQ/internal/fileperm"
+)
+
+func TestDurability(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+
+	for _, mode := range []string{"sync", "fsync", "none"} {
+		d, err := client.ParseDurability(mode)
+		if err != nil {
+			t.Fatalf("ParseDurability(%q): %v", mode, err)
+		}
+		c.SetDurability(d)
+
+		testdir := t.TempDir()
+		if err := makeImages(testdir, 0, 2); err != nil {
+			t.Fatalf("makeImages: %v", err)
+		}
+		if n, err := c.ImportFiles([]string{filepath.Join(testdir, "*")}, mode, true); err != nil {
+			t.Fatalf("c.ImportFiles: %v", err)
+		} else if want, got := 2, n; want != got {
+			t.Errorf("Unexpected ImportFiles result. Want %d, got %d", want, got)
+		}
+		if n, err := c.ExportFiles([]string{mode + "/*"}, t.TempDir(), client.ExportOptions{}); err != nil {
+			t.Errorf("c.ExportFiles: %v", err)
+		} else if want, got := 2, n; want != got {
+			t.Errorf("Unexpected ExportFiles result. Want %d, got %d", want, got)
+		}
+	}
+	if _, err := client.ParseDurability("foo"); err == nil {
+		t.Error("ParseDurability(foo) should have failed")
+	}
+}
+
+func TestBlobPerm(t *testing.T) {
+	_, url, done := startServer(t)
+	defer done()
+	c, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	if err := c.SetBlobPerm(fileperm.Perm{Mode: 0o644, GID: -1}); err == nil {
+		t.Error("SetBlobPerm(0644) succeeded unexpectedly")
+	}
+	if err := c.SetBlobPerm(fileperm.Perm{Mode: 0o640, GID: -1}); err != nil {
+		t.Fatalf("SetBlobPerm(0640): %v", err)
+	}
+
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 2); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "*")}, "gallery", true); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+	items, err := c.GlobFiles([]string{"gallery/*"}, client.GlobOptions{})
+	if err != nil || len(items) != 2 {
+		t.Fatalf("c.GlobFiles: %v, %v", items, err)
+	}
+	for _, item := range items {
+		for _, fn := range []string{item.FilePath, item.ThumbPath} {
+			fi, err := os.Stat(fn)
+			if err != nil {
+				t.Fatalf("Stat: %v", err)
+			}
+			if want, got := fs.FileMode(0o640), fi.Mode(); want != got {
+				t.Errorf("Mode(%s) = %s, want %s", fn, got, want)
+			}
+			if fi, err = os.Stat(filepath.Dir(fn)); err != nil {
+				t.Fatalf("Stat: %v", err)
+			}
+			if want, got := fs.ModeDir|0o750, fi.Mode(); want != got {
+				t.Errorf("Mode(%s) = %s, want %s", filepath.Dir(fn), got, want)
+			}
+		}
+	}
+}
@@ -19,15 +19,25 @@ package client_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 
 	"github.com/go-test/deep"
 	"github.com/tyler-smith/go-bip39"
 
 	"c2FmZQ/internal/client"
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/server"
+	"c2FmZQ/internal/stingle"
 )
 
 func TestLoginLogout(t *testing.T) {
@@ -46,6 +56,11 @@ func TestLoginLogout(t *testing.T) {
 	if err := c.Logout(); err != nil {
 		t.Fatalf("c.Logout: %v", err)
 	}
+	t.Log("CLIENT Login wrong password")
+	var serr *client.ServerError
+	if err := c.Login(url, "alice@", "wrong-pass"); !errors.As(err, &serr) {
+		t.Fatalf("Login with wrong password returned unexpected error: %v", err)
+	}
 	t.Log("CLIENT Login")
 	if err := c.Login(url, "alice@", "pass"); err != nil {
 		t.Fatalf("Login: %v", err)
@@ -56,6 +71,77 @@ func TestLoginLogout(t *testing.T) {
 	}
 }
 
+func TestSetServerURL(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	// Another server with a different account for the same email address.
+	c2, url2, done2 := startServer(t)
+	defer done2()
+	if err := c2.CreateAccount(url2, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+
+	if err := c.SetServerURL("ftp://example.com"); err == nil {
+		t.Error("c.SetServerURL(ftp://) succeeded unexpectedly")
+	}
+	if err := c.SetServerURL(url2); err == nil {
+		t.Error("c.SetServerURL(url2) succeeded unexpectedly")
+	}
+	if got := c.Account.ServerBaseURL; got != url {
+		t.Errorf("ServerBaseURL = %q, want %q", got, url)
+	}
+	if err := c.SetServerURL(url + "/"); err != nil {
+		t.Fatalf("c.SetServerURL: %v", err)
+	}
+	if got := c.Account.ServerBaseURL; got != url {
+		t.Errorf("ServerBaseURL = %q, want %q", got, url)
+	}
+	if err := c.GetUpdates(true); err != nil {
+		t.Errorf("c.GetUpdates: %v", err)
+	}
+}
+
+func TestServerKeyPinning(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	if err := c.Login(url, "alice@", "pass"); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+
+	// Replace the account on the server, which gives it a new server key.
+	c2, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	if err := c2.Login(url, "alice@", "pass"); err != nil {
+		t.Fatalf("c2.Login: %v", err)
+	}
+	if err := c2.DeleteAccount("pass"); err != nil {
+		t.Fatalf("c2.DeleteAccount: %v", err)
+	}
+	if err := c2.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("c2.CreateAccount: %v", err)
+	}
+
+	if err := c.Login(url, "alice@", "pass"); !errors.Is(err, client.ErrServerKeyChanged) {
+		t.Fatalf("Login: err = %v, want %v", err, client.ErrServerKeyChanged)
+	}
+	c.SetAcceptNewServerKey(true)
+	if err := c.Login(url, "alice@", "pass"); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	c.SetAcceptNewServerKey(false)
+	if err := c.Login(url, "alice@", "pass"); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+}
+
 func TestRecovery(t *testing.T) {
 	c, url, done := startServer(t)
 	defer done()
@@ -138,7 +224,7 @@ func TestImportExportSync(t *testing.T) {
 		t.Fatalf("os.Mkdir: %v", err)
 	}
 	t.Log("CLIENT Export gallery/*")
-	if n, err := c.ExportFiles([]string{"gallery/*"}, exportDir, true); err != nil {
+	if n, err := c.ExportFiles([]string{"gallery/*"}, exportDir, client.ExportOptions{Recursive: true}); err != nil {
 		t.Errorf("c.ExportFiles: %v", err)
 	} else if want, got := 10, n; want != got {
 		t.Errorf("Unexpected ExportFiles result. Want %d, got %d", want, got)
@@ -158,13 +244,29 @@ func TestImportExportSync(t *testing.T) {
 		t.Errorf("c.GetUpdates: %v", err)
 	}
 
+	t.Log("CLIENT ServerUsage")
+	if u, err := c.ServerUsage(); err != nil {
+		t.Errorf("c.ServerUsage: %v", err)
+	} else if u.FileCount != 10 || u.AlbumCount != 0 || u.SpaceUsed == 0 || u.SpaceRemaining != u.SpaceQuota-u.SpaceUsed {
+		t.Errorf("Unexpected ServerUsage result: %+v", u)
+	}
+
 	t.Log("CLIENT Free gallery/*")
-	if n, err := c.Free([]string{"gallery/*"}, client.GlobOptions{}); err != nil {
+	if n, err := c.Free([]string{"gallery/*"}, client.GlobOptions{}, false); err != nil {
 		t.Errorf("c.Free: %v", err)
 	} else if want, got := 10, n; want != got {
 		t.Errorf("Unexpected Free result. Want %d, got %d", want, got)
 	}
 
+	t.Log("CLIENT PullThumbnails gallery/*")
+	for _, want := range []int{10, 0} {
+		if n, err := c.PullThumbnails([]string{"gallery/*"}, client.GlobOptions{}); err != nil {
+			t.Errorf("c.PullThumbnails: %v", err)
+		} else if got := n; want != got {
+			t.Errorf("Unexpected PullThumbnails result. Want %d, got %d", want, got)
+		}
+	}
+
 	t.Log("CLIENT Pull gallery/*0.jpg")
 	if n, err := c.Pull([]string{"gallery/*0.jpg"}, client.GlobOptions{}); err != nil {
 		t.Errorf("c.Pull: %v", err)
@@ -179,6 +281,145 @@ func TestImportExportSync(t *testing.T) {
 	}
 }
 
+func TestImportDeleteAfterUpload(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 3); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	opts := client.ImportOptions{DeleteAfterUpload: true}
+	if _, err := c.ImportFilesWithOptions([]string{filepath.Join(testdir, "*")}, "gallery", opts); !errors.Is(err, client.ErrNotLoggedIn) {
+		t.Errorf("c.ImportFilesWithOptions() = %v, want ErrNotLoggedIn", err)
+	}
+
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	if n, err := c.ImportFilesWithOptions([]string{filepath.Join(testdir, "*")}, "gallery", opts); err != nil {
+		t.Fatalf("c.ImportFilesWithOptions: %v", err)
+	} else if want, got := 3, n; want != got {
+		t.Errorf("Unexpected ImportFilesWithOptions result. Want %d, got %d", want, got)
+	}
+	if entries, err := os.ReadDir(testdir); err != nil {
+		t.Fatalf("os.ReadDir: %v", err)
+	} else if len(entries) != 0 {
+		t.Errorf("Unexpected files left in source directory: %v", entries)
+	}
+	li, err := c.GlobFiles([]string{"gallery/*"}, client.GlobOptions{})
+	if err != nil {
+		t.Fatalf("c.GlobFiles: %v", err)
+	}
+	if want, got := 3, len(li); want != got {
+		t.Errorf("Unexpected number of files in gallery. Want %d, got %d", want, got)
+	}
+	for _, item := range li {
+		if item.LocalOnly {
+			t.Errorf("%s wasn't uploaded", item.Filename)
+		}
+	}
+}
+
+func TestCanceledImportAndSync(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 3); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if n, err := c.ImportFilesContext(ctx, []string{filepath.Join(testdir, "*")}, "gallery", false); !errors.Is(err, context.Canceled) {
+		t.Errorf("c.ImportFilesContext() = %v, want context.Canceled", err)
+	} else if n != 0 {
+		t.Errorf("c.ImportFilesContext() imported %d file(s), want 0", n)
+	}
+	if n, err := c.ImportFiles([]string{filepath.Join(testdir, "*")}, "gallery", false); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	} else if want, got := 3, n; want != got {
+		t.Errorf("Unexpected ImportFiles result. Want %d, got %d", want, got)
+	}
+
+	// A canceled sync leaves the files to upload for the next one.
+	if err := c.SyncContext(ctx, false); !errors.Is(err, context.Canceled) {
+		t.Errorf("c.SyncContext() = %v, want context.Canceled", err)
+	}
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+	li, err := c.GlobFiles([]string{"gallery/*"}, client.GlobOptions{})
+	if err != nil {
+		t.Fatalf("c.GlobFiles: %v", err)
+	}
+	if want, got := 3, len(li); want != got {
+		t.Errorf("Unexpected number of files in gallery. Want %d, got %d", want, got)
+	}
+	for _, item := range li {
+		if item.LocalOnly {
+			t.Errorf("%s wasn't uploaded", item.Filename)
+		}
+	}
+
+	if _, err := c.Free([]string{"gallery/*"}, client.GlobOptions{}, false); err != nil {
+		t.Fatalf("c.Free: %v", err)
+	}
+	if _, err := c.PullContext(ctx, []string{"gallery/*"}, client.GlobOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("c.PullContext() = %v, want context.Canceled", err)
+	}
+	if n, err := c.Pull([]string{"gallery/*"}, client.GlobOptions{}); err != nil {
+		t.Fatalf("c.Pull: %v", err)
+	} else if want, got := 3, n; want != got {
+		t.Errorf("Unexpected Pull result. Want %d, got %d", want, got)
+	}
+}
+
+func TestFreePartialFailure(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 3); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "*")}, "gallery", false); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+	list, err := c.GlobFiles([]string{"gallery/*"}, client.GlobOptions{})
+	if err != nil || len(list) != 3 {
+		t.Fatalf("c.GlobFiles: %d, %v", len(list), err)
+	}
+	// Replace one blob with a non-empty directory so that it can't be removed.
+	bad := list[1].FilePath
+	if err := os.Remove(bad); err != nil {
+		t.Fatalf("os.Remove: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(bad, "x"), 0700); err != nil {
+		t.Fatalf("os.MkdirAll: %v", err)
+	}
+
+	n, err := c.Free([]string{"gallery/*"}, client.GlobOptions{}, false)
+	if err == nil || !strings.Contains(err.Error(), list[1].Filename) {
+		t.Errorf("c.Free() err = %v, want error mentioning %s", err, list[1].Filename)
+	}
+	if n != 2 {
+		t.Errorf("c.Free() = %d, want 2", n)
+	}
+	for _, i := range []int{0, 2} {
+		if _, err := os.Stat(list[i].FilePath); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s wasn't freed: %v", list[i].Filename, err)
+		}
+	}
+}
+
 func TestCopyMoveDeleteFiles(t *testing.T) {
 	c, url, done := startServer(t)
 	defer done()
@@ -236,7 +477,7 @@ func TestCopyMoveDeleteFiles(t *testing.T) {
 	}
 
 	t.Log("CLIENT Delete alpha/image000.jpg gallery/image004.jpg")
-	if err := c.Delete([]string{"alpha/image000.jpg", "gallery/image004.jpg"}, false); err != nil {
+	if err := c.Delete([]string{"alpha/image000.jpg", "gallery/image004.jpg"}, false, false); err != nil {
 		t.Fatalf("c.Delete: %v", err)
 	}
 
@@ -262,7 +503,7 @@ func TestCopyMoveDeleteFiles(t *testing.T) {
 	}
 
 	t.Log("CLIENT Delete .trash/*")
-	if err := c.Delete([]string{".trash/*"}, false); err != nil {
+	if err := c.Delete([]string{".trash/*"}, false, false); err != nil {
 		t.Fatalf("c.Delete: %v", err)
 	}
 
@@ -287,12 +528,12 @@ func TestCopyMoveDeleteFiles(t *testing.T) {
 
 	// Delete alpha should fail because it's not empty.
 	t.Log("CLIENT Delete alpha (should fail)")
-	if err := c.Delete([]string{"alpha"}, false); err == nil {
+	if err := c.Delete([]string{"alpha"}, false, false); err == nil {
 		t.Fatal("c.Delete succeeded unexpectedly.")
 	}
 	t.Log("CLIENT Delete charlie")
 	// Delete charlie should succeed because it is empty.
-	if err := c.Delete([]string{"charlie"}, false); err != nil {
+	if err := c.Delete([]string{"charlie"}, false, false); err != nil {
 		t.Fatalf("c.Delete: %v", err)
 	}
 
@@ -361,6 +602,284 @@ func TestCopyMoveDeleteFiles(t *testing.T) {
 	}
 }
 
+func TestRenameFile(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	t.Log("CLIENT CreateAccount")
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 2); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	t.Log("CLIENT Import")
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "*")}, "gallery", true); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+	t.Log("CLIENT Sync")
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+
+	for _, tc := range []struct {
+		pattern, newName string
+	}{
+		{"gallery/image000.jpg", ""},
+		{"gallery/image000.jpg", "a/b.jpg"},
+		{"gallery/image000.jpg", "image001.jpg"},
+		{"gallery/image000.jpg", strings.Repeat("x", 100) + ".jpg"},
+		{"gallery/*", "foo.jpg"},
+		{"gallery/nothing.jpg", "foo.jpg"},
+		{"gallery", "foo"},
+	} {
+		if err := c.RenameFile(tc.pattern, tc.newName, false); err == nil {
+			t.Errorf("RenameFile(%q, %q) succeeded unexpectedly", tc.pattern, tc.newName)
+		}
+	}
+
+	t.Log("CLIENT RenameFile gallery/image000.jpg -> foo.jpg")
+	if err := c.RenameFile("gallery/image000.jpg", "foo.jpg", false); err != nil {
+		t.Fatalf("c.RenameFile: %v", err)
+	}
+	t.Log("CLIENT Sync")
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+
+	want := []string{
+		".trash",
+		"gallery",
+		"gallery/foo.jpg",
+		"gallery/image001.jpg",
+	}
+	got, err := globAll(c)
+	if err != nil {
+		t.Fatalf("globAll: %v", err)
+	}
+	if diff := deep.Equal(want, got); diff != nil {
+		t.Fatalf("Unexpected file list. Want %#v, got %#v, diff: %v", want, got, diff)
+	}
+}
+
+func TestRefreshFile(t *testing.T) {
+	c1, url, done := startServer(t)
+	defer done()
+	t.Log("CLIENT 1 CreateAccount")
+	if err := c1.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 2); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	t.Log("CLIENT 1 Import")
+	if _, err := c1.ImportFiles([]string{filepath.Join(testdir, "*")}, "gallery", true); err != nil {
+		t.Fatalf("c1.ImportFiles: %v", err)
+	}
+	t.Log("CLIENT 1 Sync")
+	if err := c1.Sync(false); err != nil {
+		t.Fatalf("c1.Sync: %v", err)
+	}
+
+	c2, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	t.Log("CLIENT 2 Login")
+	if err := c2.Login(url, "alice@", "pass"); err != nil {
+		t.Fatalf("c2.Login: %v", err)
+	}
+	t.Log("CLIENT 2 GetUpdates")
+	if err := c2.GetUpdates(false); err != nil {
+		t.Fatalf("c2.GetUpdates: %v", err)
+	}
+
+	t.Log("CLIENT 1 RenameFile gallery/image000.jpg -> foo.jpg")
+	if err := c1.RenameFile("gallery/image000.jpg", "foo.jpg", false); err != nil {
+		t.Fatalf("c1.RenameFile: %v", err)
+	}
+	t.Log("CLIENT 1 Delete gallery/image001.jpg")
+	if err := c1.Delete([]string{"gallery/image001.jpg"}, false, false); err != nil {
+		t.Fatalf("c1.Delete: %v", err)
+	}
+	t.Log("CLIENT 1 Sync")
+	if err := c1.Sync(false); err != nil {
+		t.Fatalf("c1.Sync: %v", err)
+	}
+
+	li, err := c2.GlobFiles([]string{"gallery", "gallery/image000.jpg", "gallery/image001.jpg"}, client.GlobOptions{})
+	if err != nil || len(li) != 3 {
+		t.Fatalf("c2.GlobFiles: %v, %v", li, err)
+	}
+	t.Log("CLIENT 2 RefreshFile gallery")
+	if err := c2.RefreshFile(li[0]); err == nil {
+		t.Error("c2.RefreshFile(gallery) succeeded unexpectedly")
+	}
+	t.Log("CLIENT 2 RefreshFile gallery/image000.jpg")
+	if err := c2.RefreshFile(li[1]); err != nil {
+		t.Fatalf("c2.RefreshFile: %v", err)
+	}
+	t.Log("CLIENT 2 RefreshFile gallery/image001.jpg")
+	if err := c2.RefreshFile(li[2]); !errors.Is(err, client.ErrFileNotFound) {
+		t.Errorf("c2.RefreshFile(gallery/image001.jpg) returned %v, want ErrFileNotFound", err)
+	}
+
+	want := []string{
+		".trash",
+		"gallery",
+		"gallery/foo.jpg",
+		"gallery/image001.jpg",
+	}
+	got, err := globAll(c2)
+	if err != nil {
+		t.Fatalf("globAll: %v", err)
+	}
+	if diff := deep.Equal(want, got); diff != nil {
+		t.Fatalf("Unexpected file list. Want %#v, got %#v, diff: %v", want, got, diff)
+	}
+
+	// The refresh doesn't skip the other updates.
+	t.Log("CLIENT 2 GetUpdates")
+	if err := c2.GetUpdates(false); err != nil {
+		t.Fatalf("c2.GetUpdates: %v", err)
+	}
+	want = []string{
+		".trash",
+		".trash/image001.jpg",
+		"gallery",
+		"gallery/foo.jpg",
+	}
+	if got, err = globAll(c2); err != nil {
+		t.Fatalf("globAll: %v", err)
+	}
+	if diff := deep.Equal(want, got); diff != nil {
+		t.Fatalf("Unexpected file list. Want %#v, got %#v, diff: %v", want, got, diff)
+	}
+	if conflicts, err := c2.Conflicts(); err != nil || len(conflicts) != 0 {
+		t.Errorf("c2.Conflicts() = %v, %v", conflicts, err)
+	}
+}
+
+func TestAlbumCover(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	t.Log("CLIENT CreateAccount")
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 2); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	t.Log("CLIENT Import")
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "*")}, "alpha", true); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+	t.Log("CLIENT Sync")
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+	item := func(name string) client.ListItem {
+		li, err := c.GlobFiles([]string{name}, client.GlobOptions{})
+		if err != nil || len(li) != 1 {
+			t.Fatalf("GlobFiles(%q) = %v, %v", name, li, err)
+		}
+		return li[0]
+	}
+	albumID := item("alpha").Album.AlbumID
+	cover := item("alpha/image001.jpg").FSFile.File
+
+	if err := c.SetAlbumCover(albumID, "nothing"); err == nil {
+		t.Error("SetAlbumCover succeeded unexpectedly with a file that's not in the album")
+	}
+	t.Log("CLIENT SetAlbumCover alpha/image001.jpg")
+	if err := c.SetAlbumCover(albumID, cover); err != nil {
+		t.Fatalf("SetAlbumCover: %v", err)
+	}
+	t.Log("CLIENT Sync")
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+	if got, want := item("alpha").Album.Cover, cover; got != want {
+		t.Errorf("Unexpected cover. Got %q, want %q", got, want)
+	}
+	if got, err := c.AlbumCover(item("alpha")); err != nil || got != "alpha/image001.jpg" {
+		t.Errorf("AlbumCover() = %q, %v", got, err)
+	}
+
+	t.Log("CLIENT Move alpha/image001.jpg -> gallery")
+	if err := c.Move([]string{"alpha/image001.jpg"}, "gallery", false); err != nil {
+		t.Fatalf("c.Move: %v", err)
+	}
+	t.Log("CLIENT Sync")
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+	if got := item("alpha").Album.Cover; got != "" {
+		t.Errorf("Unexpected cover. Got %q, want empty", got)
+	}
+}
+
+func TestLockedAlbum(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	t.Log("CLIENT CreateAccount")
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 2); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	t.Log("CLIENT Import")
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "*")}, "alpha", true); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+	li, err := c.GlobFiles([]string{"alpha"}, client.GlobOptions{})
+	if err != nil || len(li) != 1 {
+		t.Fatalf("GlobFiles(alpha) = %v, %v", li, err)
+	}
+	albumID := li[0].Album.AlbumID
+
+	t.Log("CLIENT SetAlbumLocked alpha true")
+	if err := c.SetAlbumLocked(albumID, true); err != nil {
+		t.Fatalf("SetAlbumLocked: %v", err)
+	}
+	t.Log("CLIENT Sync")
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+	if li, err = c.GlobFiles([]string{"alpha"}, client.GlobOptions{}); err != nil || len(li) != 1 {
+		t.Fatalf("GlobFiles(alpha) = %v, %v", li, err)
+	}
+	if got := li[0].Album.IsLocked; got != "1" {
+		t.Errorf("Unexpected IsLocked after sync. Got %q, want 1", got)
+	}
+
+	if n, err := c.Free([]string{"alpha/*"}, client.GlobOptions{}, false); err != nil || n != 0 {
+		t.Errorf("c.Free() = %d, %v, want 0, nil", n, err)
+	}
+	if err := c.Delete([]string{"alpha/image000.jpg"}, false, false); !errors.Is(err, client.ErrPermissionDenied) {
+		t.Errorf("c.Delete() = %v, want ErrPermissionDenied", err)
+	}
+	if err := c.Delete([]string{"alpha/image000.jpg"}, false, true); err != nil {
+		t.Errorf("c.Delete(force) = %v", err)
+	}
+	if n, err := c.Free([]string{"alpha/*"}, client.GlobOptions{}, true); err != nil || n != 1 {
+		t.Errorf("c.Free(force) = %d, %v, want 1, nil", n, err)
+	}
+
+	t.Log("CLIENT SetAlbumLocked alpha false")
+	if err := c.SetAlbumLocked(albumID, false); err != nil {
+		t.Fatalf("SetAlbumLocked: %v", err)
+	}
+	if err := c.Delete([]string{"alpha/image001.jpg"}, false, false); err != nil {
+		t.Errorf("c.Delete() = %v", err)
+	}
+}
+
 func TestNestedDirectories(t *testing.T) {
 	c, url, done := startServer(t)
 	defer done()
@@ -505,11 +1024,11 @@ func TestSyncTrash(t *testing.T) {
 		t.Fatalf("c.Sync: %v", err)
 	}
 	t.Log("CLIENT Delete */image000.jpg")
-	if err := c.Delete([]string{"*/image000.jpg"}, false); err != nil {
+	if err := c.Delete([]string{"*/image000.jpg"}, false, false); err != nil {
 		t.Fatalf("c.Delete: %v", err)
 	}
 	t.Log("CLIENT Delete .trash/image000.jpg")
-	if err := c.Delete([]string{".trash/image000.jpg"}, false); err != nil {
+	if err := c.Delete([]string{".trash/image000.jpg"}, false, false); err != nil {
 		t.Fatalf("c.Delete: %v", err)
 	}
 	t.Log("CLIENT Sync")
@@ -614,7 +1133,7 @@ func TestConcurrentMutations(t *testing.T) {
 		t.Fatalf("c2.AddAlbums: %v", err)
 	}
 	t.Log("CLIENT 2 Delete delta")
-	if err := c2.Delete([]string{"delta"}, false); err != nil {
+	if err := c2.Delete([]string{"delta"}, false, false); err != nil {
 		t.Fatalf("c2.Delete: %v", err)
 	}
 	t.Log("CLIENT 2 Import -> charlie")
@@ -656,7 +1175,7 @@ func TestConcurrentMutations(t *testing.T) {
 		t.Fatalf("c1.Move: %v", err)
 	}
 	t.Log("CLIENT 1 Delete alpha beta")
-	if err := c1.Delete([]string{"alpha", "beta"}, false); err != nil {
+	if err := c1.Delete([]string{"alpha", "beta"}, false, false); err != nil {
 		t.Fatalf("c1.Delete: %v", err)
 	}
 	t.Log("CLIENT 1 Sync")
@@ -824,8 +1343,14 @@ func TestSharing(t *testing.T) {
 		t.Fatalf("Unexpected file list. Diff: %v", diff)
 	}
 
+	li, err := c["alice"].GlobFiles([]string{"alpha"}, client.GlobOptions{})
+	if err != nil || len(li) != 1 {
+		t.Fatalf("alice.GlobFiles: %v, %v", li, err)
+	}
+	oldPK := li[0].Album.PublicKey
+
 	t.Log("alice RemoveMember carol")
-	if err := c["alice"].RemoveMembers("alpha", []string{"carol@"}); err != nil {
+	if err := c["alice"].RemoveMembers("alpha", []string{"carol@"}, true); err != nil {
 		t.Fatalf("alice.RemoveMembers: %v", err)
 	}
 
@@ -844,8 +1369,54 @@ func TestSharing(t *testing.T) {
 		t.Fatalf("Unexpected file list. Diff: %v", diff)
 	}
 
+	if li, err = c["alice"].GlobFiles([]string{"alpha"}, client.GlobOptions{}); err != nil || len(li) != 1 {
+		t.Fatalf("alice.GlobFiles: %v, %v", li, err)
+	}
+	if li[0].Album.PublicKey == oldPK {
+		t.Error("Album key was not rotated")
+	}
+
+	// After the key rotation, alice and dave must still be able to decrypt
+	// the album.
+	for _, n := range []string{"alice", "dave"} {
+		t.Logf("%s GetUpdates", n)
+		if err := c[n].GetUpdates(false); err != nil {
+			t.Fatalf("%s.GetUpdates: %v", n, err)
+		}
+		if n == "alice" {
+			want = []string{
+				".trash",
+				"alpha",
+				"alpha/image000.jpg",
+				"alpha/image001.jpg",
+				"alpha/image002.jpg",
+				"alpha/image003.jpg",
+				"alpha/image004.jpg",
+				"gallery",
+			}
+		} else {
+			want = []string{
+				".trash",
+				"gallery",
+				"shared LOCAL",
+				"shared/alpha",
+				"shared/alpha/image000.jpg",
+				"shared/alpha/image001.jpg",
+				"shared/alpha/image002.jpg",
+				"shared/alpha/image003.jpg",
+				"shared/alpha/image004.jpg",
+			}
+		}
+		if got, err = globAll(c[n]); err != nil {
+			t.Fatalf("globAll: %v", err)
+		}
+		if diff := deep.Equal(want, got); diff != nil {
+			t.Fatalf("Unexpected file list. Diff: %v", diff)
+		}
+	}
+
 	t.Log("alice Unshare")
-	if err := c["alice"].Unshare([]string{"alpha"}); err != nil {
+	if err := c["alice"].Unshare([]string{"alpha"}, false); err != nil {
 		t.Fatalf("alice.Unshare: %v", err)
 	}
 	t.Log("dave GetUpdates")
@@ -864,6 +1435,168 @@ func TestSharing(t *testing.T) {
 	}
 }
 
+func TestAlbumMembers(t *testing.T) {
+	_, url, done := startServer(t)
+	defer done()
+
+	c := make(map[string]*client.Client)
+	for _, n := range []string{"alice", "bob"} {
+		t.Logf("%s Login", n)
+		var err error
+		if c[n], err = newClient(t.TempDir()); err != nil {
+			t.Fatalf("newClient: %v", err)
+		}
+		if err := c[n].CreateAccount(url, n+"@", n+"-pass", true); err != nil {
+			t.Fatalf("CreateAccount(%s): %v", n, err)
+		}
+	}
+	t.Log("alice AddAlbum alpha")
+	if err := c["alice"].AddAlbums([]string{"alpha"}); err != nil {
+		t.Fatalf("alice.AddAlbums: %v", err)
+	}
+	t.Log("alice Sync")
+	if err := c["alice"].Sync(false); err != nil {
+		t.Fatalf("alice.Sync: %v", err)
+	}
+	if m, err := c["alice"].AlbumMembers("alpha"); err != nil || len(m) != 0 {
+		t.Errorf("alice.AlbumMembers() = %v, %v, want no members", m, err)
+	}
+	c["alice"].SetPrompt(func(string) (string, error) { return "YES", nil })
+	t.Log("alice Share")
+	if err := c["alice"].Share("alpha", []string{"bob@"}, nil); err != nil {
+		t.Fatalf("alice.Share: %v", err)
+	}
+	for _, n := range []string{"alice", "bob"} {
+		t.Logf("%s GetUpdates", n)
+		if err := c[n].GetUpdates(false); err != nil {
+			t.Fatalf("%s.GetUpdates: %v", n, err)
+		}
+	}
+
+	members, err := c["alice"].AlbumMembers("alpha")
+	if err != nil {
+		t.Fatalf("alice.AlbumMembers: %v", err)
+	}
+	if len(members) != 2 || members[0].Email != "alice@" || !members[0].IsOwner || members[1].Email != "bob@" || members[1].IsOwner {
+		t.Fatalf("Unexpected members: %+v", members)
+	}
+	if p := members[1].Permissions; p.AllowAdd() || p.AllowShare() || p.AllowCopy() {
+		t.Errorf("Unexpected permissions: %s", p.Human())
+	}
+
+	if err := c["bob"].SetMemberPermissions("shared/alpha", "bob@", true, false, false); !errors.Is(err, client.ErrPermissionDenied) {
+		t.Errorf("bob.SetMemberPermissions() = %v, want ErrPermissionDenied", err)
+	}
+	if err := c["alice"].SetMemberPermissions("alpha", "carol@", true, false, false); err == nil {
+		t.Error("alice.SetMemberPermissions() succeeded for a non-member")
+	}
+	t.Log("alice SetMemberPermissions alpha bob@ +Add +Copy")
+	if err := c["alice"].SetMemberPermissions("alpha", "bob@", true, false, true); err != nil {
+		t.Fatalf("alice.SetMemberPermissions: %v", err)
+	}
+	t.Log("alice Sync")
+	if err := c["alice"].Sync(false); err != nil {
+		t.Fatalf("alice.Sync: %v", err)
+	}
+	t.Log("bob GetUpdates")
+	if err := c["bob"].GetUpdates(false); err != nil {
+		t.Fatalf("bob.GetUpdates: %v", err)
+	}
+	if members, err = c["bob"].AlbumMembers("shared/alpha"); err != nil {
+		t.Fatalf("bob.AlbumMembers: %v", err)
+	}
+	if len(members) != 2 {
+		t.Fatalf("Unexpected members: %+v", members)
+	}
+	for _, m := range members {
+		if m.IsOwner {
+			t.Errorf("IsOwner should not be set for bob: %+v", m)
+		}
+		if p := m.Permissions; !p.AllowAdd() || p.AllowShare() || !p.AllowCopy() {
+			t.Errorf("Unexpected permissions: %s", p.Human())
+		}
+	}
+}
+
+func TestShareInvite(t *testing.T) {
+	_, url, done := startServer(t)
+	defer done()
+
+	c := make(map[string]*client.Client)
+	for _, n := range []string{"alice", "bob"} {
+		var err error
+		if c[n], err = newClient(t.TempDir()); err != nil {
+			t.Fatalf("newClient: %v", err)
+		}
+	}
+	t.Log("alice Login")
+	if err := c["alice"].CreateAccount(url, "alice@", "alice-pass", true); err != nil {
+		t.Fatalf("CreateAccount(alice): %v", err)
+	}
+	t.Log("alice AddAlbum alpha")
+	if err := c["alice"].AddAlbums([]string{"alpha"}); err != nil {
+		t.Fatalf("alice.AddAlbums: %v", err)
+	}
+	t.Log("alice Sync")
+	if err := c["alice"].Sync(false); err != nil {
+		t.Fatalf("alice.Sync: %v", err)
+	}
+	c["alice"].SetPrompt(func(string) (string, error) { return "YES", nil })
+	t.Log("alice Share with bob, who doesn't have an account")
+	if err := c["alice"].Share("alpha", []string{"bob@"}, []string{"+add"}); err != nil {
+		t.Fatalf("alice.Share: %v", err)
+	}
+	if err := c["alice"].GetUpdates(false); err != nil {
+		t.Fatalf("alice.GetUpdates: %v", err)
+	}
+	if m, err := c["alice"].AlbumMembers("alpha"); err != nil || len(m) != 0 {
+		t.Errorf("alice.AlbumMembers() = %v, %v, want no members", m, err)
+	}
+
+	t.Log("bob Login")
+	if err := c["bob"].CreateAccount(url, "bob@", "bob-pass", true); err != nil {
+		t.Fatalf("CreateAccount(bob): %v", err)
+	}
+	t.Log("alice GetUpdates")
+	if err := c["alice"].GetUpdates(false); err != nil {
+		t.Fatalf("alice.GetUpdates: %v", err)
+	}
+	if m, err := c["alice"].AlbumMembers("alpha"); err != nil || len(m) != 0 {
+		t.Errorf("alice.AlbumMembers() = %v, %v, want no members", m, err)
+	}
+	c["alice"].SetPrompt(func(string) (string, error) { return "NO", nil })
+	t.Log("alice CompletePendingShares, not confirmed")
+	if err := c["alice"].CompletePendingShares(); err == nil {
+		t.Fatal("alice.CompletePendingShares succeeded unexpectedly")
+	}
+	c["alice"].SetPrompt(func(string) (string, error) { return "YES", nil })
+	t.Log("alice CompletePendingShares")
+	if err := c["alice"].CompletePendingShares(); err != nil {
+		t.Fatalf("alice.CompletePendingShares: %v", err)
+	}
+	if err := c["alice"].GetUpdates(false); err != nil {
+		t.Fatalf("alice.GetUpdates: %v", err)
+	}
+	members, err := c["alice"].AlbumMembers("alpha")
+	if err != nil {
+		t.Fatalf("alice.AlbumMembers: %v", err)
+	}
+	if len(members) != 2 || members[0].Email != "alice@" || members[1].Email != "bob@" {
+		t.Fatalf("Unexpected members: %+v", members)
+	}
+	if p := members[1].Permissions; !p.AllowAdd() || p.AllowShare() || p.AllowCopy() {
+		t.Errorf("Unexpected permissions: %s", p.Human())
+	}
+
+	t.Log("bob GetUpdates")
+	if err := c["bob"].GetUpdates(false); err != nil {
+		t.Fatalf("bob.GetUpdates: %v", err)
+	}
+	if m, err := c["bob"].AlbumMembers("shared/alpha"); err != nil || len(m) != 2 {
+		t.Errorf("bob.AlbumMembers() = %v, %v, want 2 members", m, err)
+	}
+}
+
 func TestCopyPermission(t *testing.T) {
 	_, url, done := startServer(t)
 	defer done()
@@ -918,10 +1651,12 @@ func TestCopyPermission(t *testing.T) {
 		}
 	}
 	t.Log("bob Copy shared/beta/* -> gallery   Should fail")
-	if err := c["bob"].Copy([]string{"shared/beta/*"}, "gallery", false); err == nil {
-		t.Fatal("bob.Copy succeeded unexpectedly")
-	} else {
-		t.Logf("Copy error: %v", err)
+	if err := c["bob"].Copy([]string{"shared/beta/*"}, "gallery", false); !errors.Is(err, client.ErrPermissionDenied) {
+		t.Fatalf("bob.Copy returned unexpected error: %v", err)
+	}
+	t.Log("bob Copy shared/nonexistent/* -> gallery   Should fail")
+	if err := c["bob"].Copy([]string{"shared/nonexistent/*"}, "gallery", false); !errors.Is(err, client.ErrFileNotFound) {
+		t.Fatalf("bob.Copy returned unexpected error: %v", err)
 	}
 	t.Log("bob Copy shared/alpha/* -> gallery")
 	if err := c["bob"].Copy([]string{"shared/alpha/*"}, "gallery", false); err != nil {
@@ -932,3 +1667,106 @@ func TestCopyPermission(t *testing.T) {
 		t.Fatalf("bob.Sync: %v", err)
 	}
 }
+
+func TestSyncWithoutBatchUpload(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		resp        func(w http.ResponseWriter, req *http.Request)
+		fallback    bool
+		wantBatches int32
+	}{
+		{
+			// An older server without /v2/sync/uploadBatch.
+			name:        "NotFound",
+			resp:        http.NotFound,
+			fallback:    true,
+			wantBatches: 1,
+		},
+		{
+			// An older server with the /v2/ catch-all.
+			name: "NotImplemented",
+			resp: func(w http.ResponseWriter, req *http.Request) {
+				json.NewEncoder(w).Encode(stingle.ResponseNOK().AddError(stingle.NotImplementedError))
+			},
+			fallback:    true,
+			wantBatches: 1,
+		},
+		{
+			// Any other error must not be retried with individual
+			// uploads.
+			name: "OtherError",
+			resp: func(w http.ResponseWriter, req *http.Request) {
+				json.NewEncoder(w).Encode(stingle.ResponseNOK().AddError("Quota exceeded"))
+			},
+			fallback:    false,
+			wantBatches: 2,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			log.Record = t.Log
+			log.Level = 2
+			db := database.New(filepath.Join(t.TempDir(), "data"), nil)
+			s := server.New(db, "", "", "")
+			s.AllowCreateAccount = true
+			s.AutoApproveNewAccounts = true
+
+			var batchUploads, uploads atomic.Int32
+			h := s.Handler()
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				switch req.URL.Path {
+				case "/v2/sync/uploadBatch":
+					batchUploads.Add(1)
+					tc.resp(w, req)
+					return
+				case "/v2/sync/upload":
+					uploads.Add(1)
+				}
+				h.ServeHTTP(w, req)
+			}))
+			defer srv.Close()
+			hc = srv.Client()
+
+			c, err := newClient(t.TempDir())
+			if err != nil {
+				t.Fatalf("newClient: %v", err)
+			}
+			if err := c.CreateAccount(srv.URL, "alice@", "pass", true); err != nil {
+				t.Fatalf("CreateAccount: %v", err)
+			}
+			testdir := t.TempDir()
+			for i := 0; i < 2; i++ {
+				if err := makeImages(testdir, 3*i, 3); err != nil {
+					t.Fatalf("makeImages: %v", err)
+				}
+				if _, err := c.ImportFiles([]string{filepath.Join(testdir, "*")}, "gallery", false); err != nil {
+					t.Fatalf("c.ImportFiles: %v", err)
+				}
+				if err := c.Sync(false); (err == nil) != tc.fallback {
+					t.Fatalf("c.Sync: %v", err)
+				}
+			}
+			li, err := c.GlobFiles([]string{"gallery/*"}, client.GlobOptions{})
+			if err != nil {
+				t.Fatalf("c.GlobFiles: %v", err)
+			}
+			if want, got := 6, len(li); want != got {
+				t.Errorf("Unexpected number of files in gallery. Want %d, got %d", want, got)
+			}
+			for _, item := range li {
+				if item.LocalOnly == tc.fallback {
+					t.Errorf("%s: unexpected LocalOnly %v", item.Filename, item.LocalOnly)
+				}
+			}
+			if want, got := tc.wantBatches, batchUploads.Load(); want != got {
+				t.Errorf("Unexpected number of batch uploads. Want %d, got %d", want, got)
+			}
+			wantUploads := int32(0)
+			if tc.fallback {
+				wantUploads = 6
+			}
+			if want, got := wantUploads, uploads.Load(); want != got {
+				t.Errorf("Unexpected number of uploads. Want %d, got %d", want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"c2FmZQ/internal/stingle"
+	"c2FmZQ/internal/stingle/pwhash"
+)
+
+// passphraseMagic is the beginning of files that are encrypted with a
+// passphrase. It is followed by the salt, and by a regular stingle file
+// encrypted with the key derived from the passphrase and salt. Files encrypted
+// with the client's key are regular stingle files, which start with "SP".
+var passphraseMagic = []byte("C2PW")
+
+const passphraseSaltSize = 16
+
+// ErrPassphraseRequired is returned by DecryptLocalFile when the file is
+// encrypted with a passphrase and none was given.
+var ErrPassphraseRequired = errors.New("the file is encrypted with a passphrase")
+
+// EncryptLocalFile encrypts the file in to out, using the same format as the
+// files in the gallery. If passphrase is empty, the file is encrypted with the
+// client's current key. Otherwise, it is encrypted with a key derived from
+// passphrase.
+func (c *Client) EncryptLocalFile(in, out string, passphrase []byte) error {
+	inf, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer inf.Close()
+	fi, err := inf.Stat()
+	if err != nil {
+		return err
+	}
+	return c.writeAtomically(out, func(w io.Writer) error {
+		var pk stingle.PublicKey
+		if len(passphrase) > 0 {
+			salt := make([]byte, passphraseSaltSize)
+			if _, err := rand.Read(salt); err != nil {
+				return err
+			}
+			if _, err := w.Write(append(append([]byte{}, passphraseMagic...), salt...)); err != nil {
+				return err
+			}
+			sk := passphraseKey(passphrase, salt)
+			pk = sk.PublicKey()
+			sk.Wipe()
+		} else {
+			pk = c.PublicKey()
+		}
+		hdr := stingle.NewHeaders(filepath.Base(in))[0]
+		defer hdr.Wipe()
+		hdr.DataSize = fi.Size()
+		if err := stingle.EncryptHeader(w, hdr, pk); err != nil {
+			return err
+		}
+		sw := stingle.EncryptFile(w, hdr)
+		if _, err := io.Copy(sw, inf); err != nil {
+			sw.Close()
+			return err
+		}
+		return sw.Close()
+	})
+}
+
+// DecryptLocalFile decrypts a file that was encrypted with EncryptLocalFile.
+// The passphrase is only needed if the file was encrypted with one.
+func (c *Client) DecryptLocalFile(in, out string, passphrase []byte) error {
+	inf, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer inf.Close()
+	r := bufio.NewReader(inf)
+	var sk *stingle.SecretKey
+	if b, err := r.Peek(len(passphraseMagic)); err == nil && bytes.Equal(b, passphraseMagic) {
+		if len(passphrase) == 0 {
+			return ErrPassphraseRequired
+		}
+		salt := make([]byte, passphraseSaltSize)
+		if _, err := r.Discard(len(passphraseMagic)); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(r, salt); err != nil {
+			return err
+		}
+		sk = passphraseKey(passphrase, salt)
+	} else {
+		sk = c.SecretKey()
+	}
+	hdr, err := stingle.DecryptHeader(r, sk)
+	sk.Wipe()
+	if err != nil {
+		return fmt.Errorf("%s: %w", in, err)
+	}
+	defer hdr.Wipe()
+	return c.writeAtomically(out, func(w io.Writer) error {
+		sr := stingle.DecryptFile(r, hdr)
+		defer sr.Close()
+		n, err := io.Copy(w, sr)
+		if err != nil {
+			return err
+		}
+		if n != hdr.DataSize {
+			return fmt.Errorf("%s: unexpected size %d, want %d", in, n, hdr.DataSize)
+		}
+		return nil
+	})
+}
+
+// writeAtomically creates the file name with the content written by fn. The
+// file is only created if fn succeeds.
+func (c *Client) writeAtomically(name string, fn func(w io.Writer) error) error {
+	tmp := fmt.Sprintf("%s-tmp-%d", name, time.Now().UnixNano())
+	f, err := c.openForWrite(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return err
+	}
+	// Hide f's Close method. Stream writers close their underlying writer.
+	if err := fn(struct{ io.Writer }{f}); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+func passphraseKey(passphrase, salt []byte) *stingle.SecretKey {
+	return stingle.SecretKeyFromBytes(pwhash.KeyFromPassword(passphrase, salt, pwhash.Moderate, 32))
+}
@@ -0,0 +1,115 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"c2FmZQ/internal/client"
+)
+
+func TestEncryptDecryptLocalFile(t *testing.T) {
+	c, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	other, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	dir := t.TempDir()
+	content := make([]byte, 3<<20+12345)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatalf("rand.Read: %v", err)
+	}
+	in := filepath.Join(dir, "in")
+	if err := os.WriteFile(in, content, 0600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	check := func(fn string) {
+		t.Helper()
+		got, err := os.ReadFile(fn)
+		if err != nil {
+			t.Fatalf("os.ReadFile: %v", err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("%s: decrypted content doesn't match", fn)
+		}
+	}
+
+	t.Run("Key", func(t *testing.T) {
+		enc, dec := filepath.Join(dir, "key.enc"), filepath.Join(dir, "key.dec")
+		if err := c.EncryptLocalFile(in, enc, nil); err != nil {
+			t.Fatalf("EncryptLocalFile: %v", err)
+		}
+		if err := other.DecryptLocalFile(enc, dec, nil); err == nil {
+			t.Error("DecryptLocalFile with the wrong key should have failed")
+		}
+		if _, err := os.Stat(dec); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Output file exists after failure: %v", err)
+		}
+		if err := c.DecryptLocalFile(enc, dec, nil); err != nil {
+			t.Fatalf("DecryptLocalFile: %v", err)
+		}
+		check(dec)
+	})
+
+	t.Run("Passphrase", func(t *testing.T) {
+		enc, dec := filepath.Join(dir, "pp.enc"), filepath.Join(dir, "pp.dec")
+		if err := c.EncryptLocalFile(in, enc, []byte("foo")); err != nil {
+			t.Fatalf("EncryptLocalFile: %v", err)
+		}
+		if err := c.DecryptLocalFile(enc, dec, nil); !errors.Is(err, client.ErrPassphraseRequired) {
+			t.Errorf("DecryptLocalFile without passphrase: %v, want ErrPassphraseRequired", err)
+		}
+		if err := c.DecryptLocalFile(enc, dec, []byte("bar")); err == nil {
+			t.Error("DecryptLocalFile with the wrong passphrase should have failed")
+		}
+		// Only the passphrase is needed.
+		if err := other.DecryptLocalFile(enc, dec, []byte("foo")); err != nil {
+			t.Fatalf("DecryptLocalFile: %v", err)
+		}
+		check(dec)
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		enc, dec := filepath.Join(dir, "t.enc"), filepath.Join(dir, "t.dec")
+		if err := c.EncryptLocalFile(in, enc, nil); err != nil {
+			t.Fatalf("EncryptLocalFile: %v", err)
+		}
+		b, err := os.ReadFile(enc)
+		if err != nil {
+			t.Fatalf("os.ReadFile: %v", err)
+		}
+		b[len(b)-100] ^= 1
+		if err := os.WriteFile(enc, b, 0600); err != nil {
+			t.Fatalf("os.WriteFile: %v", err)
+		}
+		if err := c.DecryptLocalFile(enc, dec, nil); err == nil {
+			t.Error("DecryptLocalFile should have failed")
+		}
+		if _, err := os.Stat(dec); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Output file exists after failure: %v", err)
+		}
+	})
+}
@@ -0,0 +1,154 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// The EXIF fields that are copied to images that are re-encoded. GPS
+// coordinates are intentionally not copied.
+var (
+	exifIFD0Fields = []exif.FieldName{exif.Make, exif.Model, exif.Orientation}
+	exifSubFields  = []exif.FieldName{exif.DateTimeOriginal}
+)
+
+// exifTag is a TIFF tag that is ready to be encoded.
+type exifTag struct {
+	id    uint16
+	typ   uint16
+	count uint32
+	data  []byte
+}
+
+const (
+	tiffShort  = 3
+	tiffLong   = 4
+	tiffASCII  = 2
+	exifIFDTag = 0x8769
+)
+
+var exifTagIDs = map[exif.FieldName]uint16{
+	exif.Make:             0x010f,
+	exif.Model:            0x0110,
+	exif.Orientation:      0x0112,
+	exif.DateTimeOriginal: 0x9003,
+}
+
+// keyExifTags returns the tags of fields that exist in x.
+func keyExifTags(x *exif.Exif, fields []exif.FieldName) []exifTag {
+	var tags []exifTag
+	for _, f := range fields {
+		t, err := x.Get(f)
+		if err != nil {
+			continue
+		}
+		tag := exifTag{id: exifTagIDs[f]}
+		if f == exif.Orientation {
+			v, err := t.Int(0)
+			if err != nil {
+				continue
+			}
+			tag.typ, tag.count = tiffShort, 1
+			tag.data = binary.LittleEndian.AppendUint16(nil, uint16(v))
+		} else {
+			s, err := t.StringVal()
+			if err != nil {
+				continue
+			}
+			tag.typ, tag.count = tiffASCII, uint32(len(s)+1)
+			tag.data = append([]byte(s), 0)
+		}
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// encodeIFD encodes an IFD that starts at offset start in the TIFF data,
+// followed by the values that don't fit in the IFD entries.
+func encodeIFD(start uint32, tags []exifTag) []byte {
+	sort.Slice(tags, func(i, j int) bool { return tags[i].id < tags[j].id })
+	size := uint32(2 + 12*len(tags) + 4)
+	var ifd, data []byte
+	ifd = binary.LittleEndian.AppendUint16(ifd, uint16(len(tags)))
+	for _, t := range tags {
+		ifd = binary.LittleEndian.AppendUint16(ifd, t.id)
+		ifd = binary.LittleEndian.AppendUint16(ifd, t.typ)
+		ifd = binary.LittleEndian.AppendUint32(ifd, t.count)
+		if len(t.data) <= 4 {
+			v := make([]byte, 4)
+			copy(v, t.data)
+			ifd = append(ifd, v...)
+			continue
+		}
+		ifd = binary.LittleEndian.AppendUint32(ifd, start+size+uint32(len(data)))
+		data = append(data, t.data...)
+		if len(data)%2 != 0 {
+			data = append(data, 0)
+		}
+	}
+	ifd = binary.LittleEndian.AppendUint32(ifd, 0)
+	return append(ifd, data...)
+}
+
+// exifSegment returns an APP1 segment with the key EXIF fields of x, or nil
+// if x doesn't have any of them.
+func exifSegment(x *exif.Exif) []byte {
+	ifd0 := keyExifTags(x, exifIFD0Fields)
+	sub := keyExifTags(x, exifSubFields)
+	if len(ifd0) == 0 && len(sub) == 0 {
+		return nil
+	}
+	if len(sub) > 0 {
+		ifd0 = append(ifd0, exifTag{id: exifIFDTag, typ: tiffLong, count: 1, data: make([]byte, 4)})
+	}
+	// The TIFF header is 8 bytes. IFD0 starts right after it.
+	tiff := []byte{'I', 'I', 42, 0, 8, 0, 0, 0}
+	enc := encodeIFD(8, ifd0)
+	if len(sub) > 0 {
+		subStart := uint32(8 + len(enc))
+		ifd0[len(ifd0)-1].data = binary.LittleEndian.AppendUint32(nil, subStart)
+		enc = encodeIFD(8, ifd0)
+		enc = append(enc, encodeIFD(subStart, sub)...)
+	}
+	tiff = append(tiff, enc...)
+
+	seg := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(2+6+len(tiff)))
+	seg = append(seg, "Exif\x00\x00"...)
+	return append(seg, tiff...)
+}
+
+// insertExif inserts the key EXIF fields of x in the JPEG image img.
+func insertExif(img []byte, x *exif.Exif) ([]byte, error) {
+	if len(img) < 2 || img[0] != 0xff || img[1] != 0xd8 {
+		return nil, errors.New("not a jpeg image")
+	}
+	seg := exifSegment(x)
+	if seg == nil {
+		return img, nil
+	}
+	out := make([]byte, 0, len(img)+len(seg))
+	out = append(out, img[:2]...)
+	out = append(out, seg...)
+	return append(out, img[2:]...), nil
+}
@@ -18,22 +18,67 @@
 package client
 
 import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"c2FmZQ/internal/stingle"
 )
 
-// ExportFiles decrypts and exports files to dir. Returns the number of files exported.
-func (c *Client) ExportFiles(patterns []string, dir string, recursive bool) (int, error) {
+// ExportConflictPolicy controls what ExportFiles does when a destination file
+// already exists.
+type ExportConflictPolicy int
+
+const (
+	// ExportRename exports the file with a numeric suffix, e.g. foo-1.jpg.
+	ExportRename ExportConflictPolicy = iota
+	// ExportSkip doesn't export the file.
+	ExportSkip
+	// ExportOverwrite replaces the existing file.
+	ExportOverwrite
+)
+
+// errExportSkipped is returned by exportFile when the file is skipped.
+var errExportSkipped = errors.New("skipped")
+
+// ParseExportConflictPolicy parses the value of the --on-conflict flag.
+func ParseExportConflictPolicy(s string) (ExportConflictPolicy, error) {
+	switch s {
+	case "rename":
+		return ExportRename, nil
+	case "skip":
+		return ExportSkip, nil
+	case "overwrite":
+		return ExportOverwrite, nil
+	default:
+		return 0, fmt.Errorf("invalid conflict policy: %q", s)
+	}
+}
+
+// ExportOptions contains the options of ExportFiles.
+type ExportOptions struct {
+	Recursive  bool                 // Export directories recursively.
+	OnConflict ExportConflictPolicy // What to do when a file already exists.
+	Manifest   string               // If set, write a checksum manifest to this file.
+	ExactMatch bool                 // The patterns are exact names, i.e. no wildcards.
+}
+
+// ExportFiles decrypts and exports files to dir. Returns the number of files
+// exported. The files that can't be decrypted, e.g. because their local copy
+// is corrupt, are skipped and listed at the end. Their errors wrap ErrDecrypt.
+func (c *Client) ExportFiles(patterns []string, dir string, opts ExportOptions) (int, error) {
 	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
 		return 0, fmt.Errorf("%s is not a directory", dir)
 	}
-	li, err := c.GlobFiles(patterns, GlobOptions{})
+	li, err := c.GlobFiles(patterns, GlobOptions{ExactMatch: opts.ExactMatch})
 	if err != nil {
 		return 0, err
 	}
@@ -49,7 +94,7 @@ func (c *Client) ExportFiles(patterns []string, dir string, recursive bool) (int
 			toExport = append(toExport, srcdst{item, dir})
 			continue
 		}
-		if !recursive {
+		if !opts.Recursive {
 			continue
 		}
 		si, err := c.glob(filepath.Join(item.Filename, "*"), GlobOptions{ExactMatchExceptLast: true, Recursive: true})
@@ -69,8 +114,14 @@ func (c *Client) ExportFiles(patterns []string, dir string, recursive bool) (int
 			toExport = append(toExport, srcdst{item2, filepath.Join(dir, rel)})
 		}
 	}
+	type result struct {
+		name string
+		path string
+		hash string
+		err  error
+	}
 	qCh := make(chan srcdst)
-	eCh := make(chan error)
+	eCh := make(chan result)
 	for i := 0; i < 5; i++ {
 		go func() {
 			for i := range qCh {
@@ -78,12 +129,11 @@ func (c *Client) ExportFiles(patterns []string, dir string, recursive bool) (int
 				hdr, err := i.src.Header(sk)
 				sk.Wipe()
 				if err != nil {
-					eCh <- err
+					eCh <- result{name: i.src.Filename, err: err}
 					continue
 				}
-				_, fn := filepath.Split(string(hdr.Filename))
-				c.Printf("Exporting %s -> %s\n", i.src.Filename, filepath.Join(i.dst, sanitize(fn)))
-				eCh <- c.exportFile(i.src, i.dst, hdr)
+				path, hash, err := c.exportFile(i.src, i.dst, hdr, opts.OnConflict)
+				eCh <- result{i.src.Filename, path, hash, err}
 				hdr.Wipe()
 			}
 		}()
@@ -94,15 +144,39 @@ func (c *Client) ExportFiles(patterns []string, dir string, recursive bool) (int
 		}
 		close(qCh)
 	}()
-	var errors []error
+	var errs []error
+	var skipped int
+	var corrupt []string
+	manifest := make(map[string]string)
 	for range toExport {
-		if err := <-eCh; err != nil {
-			errors = append(errors, err)
+		r := <-eCh
+		if errors.Is(r.err, errExportSkipped) {
+			skipped++
+		} else if r.err != nil {
+			if errors.Is(r.err, ErrDecrypt) {
+				c.Infof("Skipping %s: %v\n", r.name, r.err)
+				corrupt = append(corrupt, r.name)
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", r.name, r.err))
+		} else {
+			manifest[r.path] = r.hash
+		}
+	}
+	count := len(toExport) - len(errs) - skipped
+	if opts.Manifest != "" {
+		if err := writeManifest(opts.Manifest, dir, manifest); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if corrupt != nil {
+		sort.Strings(corrupt)
+		c.Infof("%d file(s) could not be decrypted:\n", len(corrupt))
+		for _, name := range corrupt {
+			c.Infof("  %s\n", name)
 		}
 	}
-	count := len(li) - len(errors)
-	if errors != nil {
-		return count, fmt.Errorf("%w %v", errors[0], errors[1:])
+	if errs != nil {
+		return count, fmt.Errorf("%w %v", errs[0], errs[1:])
 	}
 	return count, nil
 }
@@ -122,11 +196,10 @@ func (c *Client) Cat(patterns []string) error {
 }
 
 func (c *Client) catFile(item ListItem) error {
-	var f io.ReadCloser
-	var err error
-	if f, err = os.Open(item.FilePath); errors.Is(err, os.ErrNotExist) {
-		f, err = c.download(item.FSFile.File, item.Set, "0")
+	if err := c.ensureDownloaded(item); err != nil {
+		return err
 	}
+	f, err := c.OpenFile(item)
 	if err != nil {
 		return err
 	}
@@ -145,39 +218,168 @@ func (c *Client) catFile(item ListItem) error {
 	return err
 }
 
-func (c *Client) exportFile(item ListItem, dir string, hdr *stingle.Header) (err error) {
-	if err := os.MkdirAll(dir, 0700); err != nil {
-		return err
-	}
-	var in io.ReadCloser
-	if in, err = os.Open(item.FilePath); errors.Is(err, os.ErrNotExist) {
-		in, err = c.download(item.FSFile.File, item.Set, "0")
+// reserveExportPath returns the path where a file should be exported,
+// according to the conflict policy. With ExportRename and ExportSkip, the path
+// is reserved by creating an empty file. This way, concurrent exports can't
+// choose the same path.
+func reserveExportPath(fn string, onConflict ExportConflictPolicy) (string, error) {
+	if onConflict == ExportOverwrite {
+		return fn, nil
 	}
-	if err != nil {
-		return err
+	ext := filepath.Ext(fn)
+	base := strings.TrimSuffix(fn, ext)
+	for i := 0; i < 10000; i++ {
+		p := fn
+		if i > 0 {
+			p = fmt.Sprintf("%s-%d%s", base, i, ext)
+		}
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			return p, f.Close()
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return "", err
+		}
+		if onConflict == ExportSkip {
+			return "", errExportSkipped
+		}
 	}
-	defer in.Close()
-	if err := stingle.SkipHeader(in); err != nil {
-		return err
+	return "", fmt.Errorf("%s: too many conflicts", fn)
+}
+
+// exportFile decrypts and exports one file to dir. It returns the path of the
+// exported file, and the SHA256 hash of its content.
+func (c *Client) exportFile(item ListItem, dir string, hdr *stingle.Header, onConflict ExportConflictPolicy) (path, hash string, err error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", err
 	}
 	_, fn := filepath.Split(sanitize(string(hdr.Filename)))
 	if fn == "" {
 		_, fn = filepath.Split(sanitize(string(item.FSFile.File)))
 		fn = "decrypted-" + fn
 	}
-	fn = filepath.Join(dir, fn)
+	fn, err = reserveExportPath(filepath.Join(dir, fn), onConflict)
+	if errors.Is(err, errExportSkipped) {
+		c.Infof("Skipping %s, already exported\n", item.Filename)
+		return "", "", err
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if onConflict != ExportOverwrite {
+		// Release the reserved path if the export fails.
+		defer func() {
+			if err != nil {
+				os.Remove(fn)
+			}
+		}()
+	}
+	c.Infof("Exporting %s -> %s\n", item.Filename, fn)
+
+	if err = c.ensureDownloaded(item); err != nil {
+		return "", "", err
+	}
+	in, err := c.OpenFile(item)
+	if err != nil {
+		return "", "", err
+	}
+	defer in.Close()
+	if err := stingle.SkipHeader(in); err != nil {
+		return "", "", err
+	}
 	tmp := fmt.Sprintf("%s-tmp-%d", fn, time.Now().UnixNano())
-	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_SYNC, 0600)
+	out, err := c.openForWrite(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
 	if err != nil {
-		return err
+		return "", "", err
 	}
+	h := sha256.New()
 	r := stingle.DecryptFile(in, hdr)
-	if _, err := io.Copy(out, r); err != nil {
+	if _, err := io.Copy(io.MultiWriter(out, h), r); err != nil {
 		out.Close()
-		return err
+		os.Remove(tmp)
+		return "", "", err
 	}
 	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return "", "", err
+	}
+	if err := os.Rename(tmp, fn); err != nil {
+		return "", "", err
+	}
+	return fn, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeManifest writes a checksum manifest for the files exported to dir. The
+// paths are relative to dir. The format is the same as sha256sum's, i.e.
+// `cd dir && sha256sum -c manifest` also works.
+func writeManifest(manifest, dir string, hashes map[string]string) error {
+	var lines []string
+	for p, h := range hashes {
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, fmt.Sprintf("%s  %s\n", h, filepath.ToSlash(rel)))
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i][66:] < lines[j][66:] })
+	tmp := fmt.Sprintf("%s-tmp-%d", manifest, time.Now().UnixNano())
+	if err := os.WriteFile(tmp, []byte(strings.Join(lines, "")), 0600); err != nil {
 		return err
 	}
-	return os.Rename(tmp, fn)
+	return os.Rename(tmp, manifest)
+}
+
+// VerifyExport verifies that the files in dir match the checksum manifest
+// written by ExportFiles. It reports the mismatched and missing files, and
+// returns the number of files that were verified successfully.
+func (c *Client) VerifyExport(dir, manifest string) (int, error) {
+	f, err := os.Open(manifest)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var ok, mismatched, missing int
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		want, rel, found := strings.Cut(scanner.Text(), "  ")
+		if !found || len(want) != 64 {
+			return ok, fmt.Errorf("%s:%d: invalid line", manifest, n)
+		}
+		fn := filepath.Join(dir, filepath.FromSlash(rel))
+		got, err := hashFile(fn)
+		if errors.Is(err, os.ErrNotExist) {
+			c.Printf("MISSING  %s\n", rel)
+			missing++
+			continue
+		}
+		if err != nil {
+			return ok, err
+		}
+		if got != want {
+			c.Printf("MISMATCH %s\n", rel)
+			mismatched++
+			continue
+		}
+		ok++
+	}
+	if err := scanner.Err(); err != nil {
+		return ok, err
+	}
+	if mismatched > 0 || missing > 0 {
+		return ok, fmt.Errorf("%d mismatched, %d missing", mismatched, missing)
+	}
+	return ok, nil
+}
+
+func hashFile(fn string) (string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
@@ -0,0 +1,364 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+
+	"c2FmZQ/internal/client"
+)
+
+func TestExportConflicts(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 2); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "*")}, "album", true); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+
+	exportDir := t.TempDir()
+	for _, tc := range []struct {
+		onConflict client.ExportConflictPolicy
+		exported   int
+		files      []string
+	}{
+		{client.ExportRename, 2, []string{"image000.jpg", "image001.jpg"}},
+		{client.ExportRename, 2, []string{"image000-1.jpg", "image000.jpg", "image001-1.jpg", "image001.jpg"}},
+		{client.ExportSkip, 0, []string{"image000-1.jpg", "image000.jpg", "image001-1.jpg", "image001.jpg"}},
+		{client.ExportOverwrite, 2, []string{"image000-1.jpg", "image000.jpg", "image001-1.jpg", "image001.jpg"}},
+	} {
+		if n, err := c.ExportFiles([]string{"album/*"}, exportDir, client.ExportOptions{OnConflict: tc.onConflict}); err != nil {
+			t.Errorf("c.ExportFiles(%d): %v", tc.onConflict, err)
+		} else if want, got := tc.exported, n; want != got {
+			t.Errorf("Unexpected ExportFiles(%d) result. Want %d, got %d", tc.onConflict, want, got)
+		}
+		entries, err := os.ReadDir(exportDir)
+		if err != nil {
+			t.Fatalf("os.ReadDir: %v", err)
+		}
+		var files []string
+		for _, e := range entries {
+			files = append(files, e.Name())
+		}
+		sort.Strings(files)
+		if diff := deep.Equal(tc.files, files); diff != nil {
+			t.Errorf("Unexpected files after ExportFiles(%d): %v", tc.onConflict, diff)
+		}
+	}
+
+	for _, s := range []string{"rename", "skip", "overwrite"} {
+		if _, err := client.ParseExportConflictPolicy(s); err != nil {
+			t.Errorf("ParseExportConflictPolicy(%q): %v", s, err)
+		}
+	}
+	if _, err := client.ParseExportConflictPolicy("foo"); err == nil {
+		t.Error("ParseExportConflictPolicy(foo) succeeded unexpectedly")
+	}
+}
+
+func TestExportManifest(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 3); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "*")}, "album", true); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+
+	exportDir := t.TempDir()
+	manifest := filepath.Join(t.TempDir(), "manifest.txt")
+	if n, err := c.ExportFiles([]string{"album"}, exportDir, client.ExportOptions{Recursive: true, Manifest: manifest}); err != nil {
+		t.Fatalf("c.ExportFiles: %v", err)
+	} else if want, got := 3, n; want != got {
+		t.Errorf("Unexpected ExportFiles result. Want %d, got %d", want, got)
+	}
+	b, err := os.ReadFile(manifest)
+	if err != nil {
+		t.Fatalf("os.ReadFile: %v", err)
+	}
+	if want, got := 3, strings.Count(string(b), "  album/image00"); want != got {
+		t.Errorf("Unexpected manifest: %s", b)
+	}
+
+	if n, err := c.VerifyExport(exportDir, manifest); err != nil {
+		t.Errorf("c.VerifyExport: %v", err)
+	} else if want, got := 3, n; want != got {
+		t.Errorf("Unexpected VerifyExport result. Want %d, got %d", want, got)
+	}
+
+	if err := os.WriteFile(filepath.Join(exportDir, "album", "image000.jpg"), []byte("foo"), 0600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	if err := os.Remove(filepath.Join(exportDir, "album", "image001.jpg")); err != nil {
+		t.Fatalf("os.Remove: %v", err)
+	}
+	if n, err := c.VerifyExport(exportDir, manifest); err == nil {
+		t.Error("c.VerifyExport succeeded unexpectedly")
+	} else if want, got := 1, n; want != got {
+		t.Errorf("Unexpected VerifyExport result. Want %d, got %d", want, got)
+	}
+}
+
+func TestExportMetadata(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 2); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "*")}, "album", true); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+	if err := makeImages(testdir, 2, 1); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "image002.jpg")}, "album", true); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+
+	out := filepath.Join(t.TempDir(), "metadata.json")
+	if n, err := c.ExportMetadata([]string{"album"}, out, client.GlobOptions{Recursive: true}); err != nil {
+		t.Fatalf("c.ExportMetadata: %v", err)
+	} else if want, got := 3, n; want != got {
+		t.Errorf("Unexpected ExportMetadata result. Want %d, got %d", want, got)
+	}
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("os.ReadFile: %v", err)
+	}
+	var doc struct {
+		Files []client.FileMetadata `json:"files"`
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if len(doc.Files) != 3 {
+		t.Fatalf("Unexpected metadata: %s", b)
+	}
+	for i, f := range doc.Files {
+		fi, err := os.Stat(filepath.Join(testdir, f.OriginalName))
+		if err != nil {
+			t.Fatalf("os.Stat: %v", err)
+		}
+		if want, got := filepath.Join("album", f.OriginalName), f.Name; want != got {
+			t.Errorf("Name = %q, want %q", got, want)
+		}
+		if f.Album != "album" || f.Type != "photo" || f.Size != fi.Size() || f.DateCreated == "" {
+			t.Errorf("Unexpected metadata: %+v", f)
+		}
+		if want, got := i == 2, f.LocalOnly; want != got {
+			t.Errorf("%s: LocalOnly = %v, want %v", f.Name, got, want)
+		}
+	}
+}
+
+func TestExportDownloadsOnDemand(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 2); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "*")}, "album", true); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+	if _, err := c.Free([]string{"album/*"}, client.GlobOptions{}, false); err != nil {
+		t.Fatalf("c.Free: %v", err)
+	}
+
+	c.SetOffline(true)
+	if err := c.Sync(false); !errors.Is(err, client.ErrOffline) {
+		t.Errorf("c.Sync() = %v, want ErrOffline", err)
+	}
+	if _, err := c.ExportFiles([]string{"album/*"}, t.TempDir(), client.ExportOptions{}); !errors.Is(err, client.ErrOffline) {
+		t.Errorf("c.ExportFiles() = %v, want ErrOffline", err)
+	}
+
+	c.SetOffline(false)
+	if n, err := c.ExportFiles([]string{"album/*"}, t.TempDir(), client.ExportOptions{}); err != nil {
+		t.Fatalf("c.ExportFiles: %v", err)
+	} else if want, got := 2, n; want != got {
+		t.Errorf("Unexpected ExportFiles result. Want %d, got %d", want, got)
+	}
+	// The files were downloaded to the local storage.
+	if n, err := c.Pull([]string{"album/*"}, client.GlobOptions{}); err != nil {
+		t.Errorf("c.Pull: %v", err)
+	} else if want, got := 0, n; want != got {
+		t.Errorf("Unexpected Pull result. Want %d, got %d", want, got)
+	}
+}
+
+func TestExportCorruptFile(t *testing.T) {
+	c, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 3); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "*")}, "gallery", false); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+	li, err := c.GlobFiles([]string{"gallery/image001.jpg"}, client.GlobOptions{})
+	if err != nil || len(li) != 1 {
+		t.Fatalf("c.GlobFiles: %v, %v", li, err)
+	}
+	b, err := os.ReadFile(li[0].FilePath)
+	if err != nil {
+		t.Fatalf("os.ReadFile: %v", err)
+	}
+	b[len(b)-10] ^= 0xff
+	if err := os.WriteFile(li[0].FilePath, b, 0600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+
+	var buf bytes.Buffer
+	c.SetWriter(&buf)
+	exportDir := t.TempDir()
+	n, err := c.ExportFiles([]string{"gallery/*"}, exportDir, client.ExportOptions{})
+	if !errors.Is(err, client.ErrDecrypt) {
+		t.Errorf("c.ExportFiles returned %v, want ErrDecrypt", err)
+	}
+	if want, got := 2, n; want != got {
+		t.Errorf("Unexpected ExportFiles result. Want %d, got %d", want, got)
+	}
+	entries, err := os.ReadDir(exportDir)
+	if err != nil {
+		t.Fatalf("os.ReadDir: %v", err)
+	}
+	var files []string
+	for _, e := range entries {
+		files = append(files, e.Name())
+	}
+	if diff := deep.Equal([]string{"image000.jpg", "image002.jpg"}, files); diff != nil {
+		t.Errorf("Unexpected exported files: %v", diff)
+	}
+	if want := "1 file(s) could not be decrypted:\n  gallery/image001.jpg\n"; !strings.HasSuffix(buf.String(), want) {
+		t.Errorf("Missing summary. Want suffix %q, got %q", want, buf.String())
+	}
+}
+
+func TestStreamIndex(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 2); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "*")}, "album", true); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+	if err := c.Copy([]string{"album/image000.jpg"}, "gallery", false); err != nil {
+		t.Fatalf("c.Copy: %v", err)
+	}
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+	if _, err := c.Free([]string{"album/image001.jpg"}, client.GlobOptions{}, false); err != nil {
+		t.Fatalf("c.Free: %v", err)
+	}
+	if err := makeImages(testdir, 2, 1); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "image002.jpg")}, "album", true); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+
+	var buf bytes.Buffer
+	n, err := c.StreamIndex(&buf)
+	if err != nil {
+		t.Fatalf("c.StreamIndex: %v", err)
+	}
+	if want, got := 4, n; want != got {
+		t.Errorf("Unexpected StreamIndex result. Want %d, got %d", want, got)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != n {
+		t.Fatalf("Unexpected output: %q", buf.String())
+	}
+	type rec struct {
+		Name                  string
+		LocalOnly, Downloaded bool
+	}
+	var got []rec
+	ids := make(map[string]string)
+	for _, line := range lines {
+		var r client.IndexRecord
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("json.Unmarshal(%q): %v", line, err)
+		}
+		if r.Album != filepath.Dir(r.Name) || r.OriginalName != filepath.Base(r.Name) || r.FileID == "" {
+			t.Errorf("Unexpected record: %+v", r)
+		}
+		ids[r.Name] = r.FileID
+		got = append(got, rec{r.Name, r.LocalOnly, r.Downloaded})
+	}
+	want := []rec{
+		{"album/image000.jpg", false, true},
+		{"album/image001.jpg", false, false},
+		{"album/image002.jpg", true, true},
+		{"gallery/image000.jpg", false, true},
+	}
+	if diff := deep.Equal(want, got); diff != nil {
+		t.Errorf("Unexpected records: %v", diff)
+	}
+	if ids["album/image000.jpg"] != ids["gallery/image000.jpg"] {
+		t.Errorf("Copies have different file IDs: %v", ids)
+	}
+}
@@ -83,7 +83,7 @@ func (c *Client) StreamImport(name string, dst ListItem) (*FuseImportWriter, err
 	if err != nil {
 		return nil, err
 	}
-	ts := strconv.FormatInt(time.Now().UnixNano()/1000000, 10)
+	ts := c.nowString()
 	sFile := stingle.File{
 		File:         makeSPFilename(),
 		Version:      "1",
@@ -106,7 +106,7 @@ func (c *Client) StreamImport(name string, dst ListItem) (*FuseImportWriter, err
 
 	fn := c.blobPath(sFile.File, false)
 	dir, _ := filepath.Split(fn)
-	if err := os.MkdirAll(dir, 0700); err != nil {
+	if err := c.blobPerm.MkdirAll(dir); err != nil {
 		return nil, err
 	}
 	thumbnail, err := c.GenericThumbnail(thumbName)
@@ -117,7 +117,7 @@ func (c *Client) StreamImport(name string, dst ListItem) (*FuseImportWriter, err
 		return nil, err
 	}
 
-	out, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_SYNC, 0600)
+	out, err := c.openBlobForWrite(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
 	if err != nil {
 		return nil, err
 	}
@@ -161,8 +161,8 @@ func (iw *FuseImportWriter) Close() error {
 func (iw *FuseImportWriter) sk() (sk *stingle.SecretKey, err error) {
 	sk = iw.c.SecretKey()
 	if iw.albumID != "" {
-		var al AlbumList
-		if err := iw.c.storage.ReadDataFile(iw.c.fileHash(albumList), &al); err != nil {
+		al, err := iw.c.albumList()
+		if err != nil {
 			sk.Wipe()
 			return nil, err
 		}
@@ -281,7 +281,7 @@ func (iw *FuseImportWriter) processNewFile() (retErr error) {
 
 	// Rewrite the file header. The header should be the same size because
 	// we use the original filename.
-	out, err := os.OpenFile(iw.c.blobPath(file.File, false), os.O_WRONLY|os.O_SYNC, 0600)
+	out, err := iw.c.openBlobForWrite(iw.c.blobPath(file.File, false), os.O_WRONLY)
 	if err != nil {
 		return err
 	}
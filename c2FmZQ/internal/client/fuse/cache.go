@@ -0,0 +1,101 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !windows
+// +build !windows
+
+package fuse
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+// blockSize is the size of the blocks of decrypted data in the cache. It is
+// the same as the chunk size of the encrypted files.
+const blockSize = 1 << 20
+
+// blockCache is a bounded in-memory cache of decrypted file data. Media players
+// read the same parts of a file over and over, and files that aren't available
+// locally are downloaded again every time they are opened.
+type blockCache struct {
+	mu  sync.Mutex
+	lru *simplelru.LRU
+}
+
+type blockKey struct {
+	file  string
+	index int64
+}
+
+// newBlockCache returns a blockCache that holds at most size bytes, or nil if
+// size is too small to hold one block.
+func newBlockCache(size int64) *blockCache {
+	if size < blockSize {
+		return nil
+	}
+	lru, _ := simplelru.NewLRU(int(size/blockSize), nil)
+	return &blockCache{lru: lru}
+}
+
+// readAt reads the decrypted content of file at offset off into b, using r to
+// read the blocks that aren't in the cache. The blob name of a file never
+// changes, and neither does its content.
+func (c *blockCache) readAt(file string, r io.ReadSeeker, b []byte, off int64) (int, error) {
+	n := 0
+	for n < len(b) {
+		block, err := c.block(file, r, (off+int64(n))/blockSize)
+		if err != nil {
+			return n, err
+		}
+		start := int((off + int64(n)) % blockSize)
+		if start >= len(block) {
+			return n, io.EOF
+		}
+		n += copy(b[n:], block[start:])
+		if len(block) < blockSize {
+			break
+		}
+	}
+	return n, nil
+}
+
+func (c *blockCache) block(file string, r io.ReadSeeker, index int64) ([]byte, error) {
+	key := blockKey{file, index}
+	c.mu.Lock()
+	v, ok := c.lru.Get(key)
+	c.mu.Unlock()
+	if ok {
+		return v.([]byte), nil
+	}
+	if _, err := r.Seek(index*blockSize, io.SeekStart); err != nil {
+		return nil, err
+	}
+	block := make([]byte, blockSize)
+	n, err := io.ReadFull(r, block)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	block = block[:n]
+	c.mu.Lock()
+	c.lru.Add(key, block)
+	c.mu.Unlock()
+	return block, nil
+}
@@ -0,0 +1,80 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !windows
+// +build !windows
+
+package fuse
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+type countingReader struct {
+	*bytes.Reader
+	reads int
+}
+
+// Seek is called once for every block that is read.
+func (r *countingReader) Seek(offset int64, whence int) (int64, error) {
+	r.reads++
+	return r.Reader.Seek(offset, whence)
+}
+
+func TestBlockCache(t *testing.T) {
+	if newBlockCache(blockSize-1) != nil {
+		t.Error("newBlockCache(blockSize-1) should be nil")
+	}
+	content := make([]byte, 3*blockSize+1000)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatalf("rand.Read: %v", err)
+	}
+	r := &countingReader{Reader: bytes.NewReader(content)}
+	c := newBlockCache(2 * blockSize)
+
+	for _, tc := range []struct {
+		off, size int64
+		want      []byte
+		reads     int
+	}{
+		{0, 100, content[:100], 1},
+		{50, 100, content[50:150], 0},
+		// Crosses a block boundary.
+		{blockSize - 10, 20, content[blockSize-10 : blockSize+10], 1},
+		// The last block is partial.
+		{3*blockSize + 900, 500, content[3*blockSize+900:], 1},
+		{int64(len(content)), 10, nil, 0},
+		// The first block was evicted.
+		{0, 100, content[:100], 1},
+	} {
+		r.reads = 0
+		buf := make([]byte, tc.size)
+		n, err := c.readAt("file", r, buf, tc.off)
+		if err != nil && err != io.EOF {
+			t.Fatalf("readAt(%d, %d): %v", tc.off, tc.size, err)
+		}
+		if !bytes.Equal(buf[:n], tc.want) {
+			t.Errorf("readAt(%d, %d) returned unexpected data, n=%d", tc.off, tc.size, n)
+		}
+		if r.reads != tc.reads {
+			t.Errorf("readAt(%d, %d) read %d blocks, want %d", tc.off, tc.size, r.reads, tc.reads)
+		}
+	}
+}
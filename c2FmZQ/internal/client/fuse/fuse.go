@@ -52,8 +52,9 @@ func init() {
 	mounts = make(map[string]*filesys)
 }
 
-// Mount mounts the client filesystem.
-func Mount(c *client.Client, mnt string, readOnly bool) error {
+// Mount mounts the client filesystem. Up to cacheSize bytes of decrypted file
+// data are cached in memory.
+func Mount(c *client.Client, mnt string, readOnly bool, cacheSize int64) error {
 	opts := []fuse.MountOption{
 		fuse.FSName("c2FmZQ"),
 	}
@@ -96,7 +97,9 @@ func Mount(c *client.Client, mnt string, readOnly bool) error {
 		}
 	}
 	srv := fs.New(conn, conf)
-	return srv.Serve(initFS(c, srv, mnt))
+	f := initFS(c, srv, mnt)
+	f.cache = newBlockCache(cacheSize)
+	return srv.Serve(f)
 }
 
 type writer struct{}
@@ -157,6 +160,10 @@ type filesys struct {
 
 	// Keeps track of ongoing mutations.
 	mutations sync.WaitGroup
+
+	// cache contains decrypted file data. It is nil when caching is
+	// disabled.
+	cache *blockCache
 }
 
 // Root is called to obtain the Node for the file system root.
@@ -520,7 +527,7 @@ func (n *dirNode) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 		return syscall.ENOENT
 	}
 	path := n.childPath(req.Name)
-	if err := n.f.c.Delete([]string{path}, true); err != nil {
+	if err := n.f.c.Delete([]string{path}, true, false); err != nil {
 		log.Debugf("Delete(%q) failed: %v", path, err)
 		var syserr syscall.Errno
 		if errors.As(err, &syserr) {
@@ -764,7 +771,7 @@ func (n *fileNode) openRead() (io.ReadSeekCloser, error) {
 	log.Debugf("openRead called on %s", n)
 	var f io.ReadSeekCloser
 	var err error
-	if f, err = os.Open(n.item.FilePath); errors.Is(err, os.ErrNotExist) {
+	if f, err = n.f.c.OpenFile(n.item); errors.Is(err, os.ErrNotExist) {
 		f, err = n.f.c.DownloadGet(n.item.FSFile.File, n.item.Set, false)
 	}
 	if err != nil {
@@ -889,13 +896,18 @@ func (h *handle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.Rea
 	if h.r == nil {
 		return syscall.EINVAL
 	}
-	_, err := h.r.Seek(req.Offset, io.SeekStart)
-	if err != nil {
-		log.Debugf("Seek(%d) failed: %v", req.Offset, err)
-		return err
-	}
 	buf := make([]byte, req.Size)
-	n, err := h.r.Read(buf)
+	var n int
+	var err error
+	if cache, file := h.n.f.cache, h.n.item.FSFile.File; cache != nil && file != "" {
+		n, err = cache.readAt(file, h.r, buf, req.Offset)
+	} else {
+		if _, err := h.r.Seek(req.Offset, io.SeekStart); err != nil {
+			log.Debugf("Seek(%d) failed: %v", req.Offset, err)
+			return err
+		}
+		n, err = h.r.Read(buf)
+	}
 	log.Debugf("Read returned %d bytes and err=%v", n, err)
 	if n > 0 {
 		resp.Data = buf[:n]
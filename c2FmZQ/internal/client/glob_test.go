@@ -0,0 +1,74 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGlobTrashAndHidden(t *testing.T) {
+	c, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	if err := c.AddAlbums([]string{"visible", "secret"}); err != nil {
+		t.Fatalf("AddAlbums: %v", err)
+	}
+	var al AlbumList
+	commit, err := c.storage.OpenForUpdate(c.fileHash(albumList), &al)
+	if err != nil {
+		t.Fatalf("OpenForUpdate: %v", err)
+	}
+	sk := c.SecretKey()
+	for _, a := range al.Albums {
+		if name, _ := a.Name(sk); name == "secret" {
+			a.IsHidden = "1"
+		}
+	}
+	sk.Wipe()
+	if err := commit(true, nil); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	for _, tc := range []struct {
+		pattern string
+		opt     GlobOptions
+		want    []string
+	}{
+		{"*", GlobOptions{}, []string{"gallery", "visible"}},
+		{"*", GlobOptions{IncludeTrash: true}, []string{".trash", "gallery", "visible"}},
+		{"*", GlobOptions{IncludeHidden: true}, []string{"gallery", "secret", "visible"}},
+		{"*", GlobOptions{MatchDot: true}, []string{".trash", "gallery", "secret", "visible"}},
+		{"g*", GlobOptions{IncludeTrash: true}, []string{"gallery"}},
+		{"secret", GlobOptions{}, []string{"secret"}},
+		{".trash", GlobOptions{}, []string{".trash"}},
+	} {
+		li, err := c.GlobFiles([]string{tc.pattern}, tc.opt)
+		if err != nil {
+			t.Fatalf("GlobFiles(%q): %v", tc.pattern, err)
+		}
+		var got []string
+		for _, item := range li {
+			got = append(got, item.Filename)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("GlobFiles(%q, %+v) = %v, want %v", tc.pattern, tc.opt, got, tc.want)
+		}
+	}
+}
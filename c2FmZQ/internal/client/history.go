@@ -0,0 +1,53 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"errors"
+	"os"
+)
+
+// The maximum number of lines kept in the shell history.
+const maxShellHistory = 1000
+
+// ShellHistory contains the commands entered in shell mode.
+type ShellHistory struct {
+	Lines []string `json:"lines"`
+}
+
+// ShellHistory returns the saved shell history, oldest first. Like all the
+// other client data, it is encrypted.
+func (c *Client) ShellHistory() ([]string, error) {
+	var h ShellHistory
+	if err := c.storage.ReadDataFile(c.fileHash(historyFile), &h); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return h.Lines, nil
+}
+
+// SaveShellHistory saves the shell history. Only the most recent lines are
+// kept.
+func (c *Client) SaveShellHistory(lines []string) error {
+	if len(lines) > maxShellHistory {
+		lines = lines[len(lines)-maxShellHistory:]
+	}
+	return c.storage.SaveDataFile(c.fileHash(historyFile), &ShellHistory{Lines: lines})
+}
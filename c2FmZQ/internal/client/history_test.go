@@ -0,0 +1,66 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestShellHistory(t *testing.T) {
+	c, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	h, err := c.ShellHistory()
+	if err != nil {
+		t.Fatalf("ShellHistory: %v", err)
+	}
+	if len(h) != 0 {
+		t.Errorf("Unexpected history: %q", h)
+	}
+
+	want := []string{"ls", "cd foo", "pull -r bar"}
+	if err := c.SaveShellHistory(want); err != nil {
+		t.Fatalf("SaveShellHistory: %v", err)
+	}
+	if h, err = c.ShellHistory(); err != nil {
+		t.Fatalf("ShellHistory: %v", err)
+	}
+	if !reflect.DeepEqual(h, want) {
+		t.Errorf("Unexpected history. Want %q, got %q", want, h)
+	}
+
+	var long []string
+	for i := 0; i < 1500; i++ {
+		long = append(long, fmt.Sprintf("cmd %d", i))
+	}
+	if err := c.SaveShellHistory(long); err != nil {
+		t.Fatalf("SaveShellHistory: %v", err)
+	}
+	if h, err = c.ShellHistory(); err != nil {
+		t.Fatalf("ShellHistory: %v", err)
+	}
+	if got, want := len(h), 1000; got != want {
+		t.Fatalf("Unexpected history length. Want %d, got %d", want, got)
+	}
+	if got, want := h[0], "cmd 500"; got != want {
+		t.Errorf("Unexpected first line. Want %q, got %q", want, got)
+	}
+}
@@ -18,10 +18,13 @@
 package client
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"golang.org/x/image/font"
 	"golang.org/x/image/font/inconsolata"
@@ -35,13 +38,16 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/disintegration/imaging"
 	"github.com/rwcarlsen/goexif/exif"
+	_ "golang.org/x/image/webp" // Register the WebP decoder.
 
 	"c2FmZQ/internal/log"
 	"c2FmZQ/internal/stingle"
@@ -52,9 +58,66 @@ type toImport struct {
 	dst string
 }
 
+// ImportOptions contains the options of ImportFilesWithOptions.
+type ImportOptions struct {
+	Recursive bool // Import directories recursively.
+	// Use the file's modification time as creation date when the file
+	// has no EXIF or video metadata.
+	DateFromMtime bool
+	// Explicit creation dates, keyed by source file path or base name.
+	// They take precedence over the file's metadata.
+	Dates map[string]time.Time
+	// If set, JPEG images larger than MaxDimension pixels in width or
+	// height are downscaled and re-encoded before they are encrypted.
+	MaxDimension int
+	// Follow symbolic links. By default, they are skipped.
+	FollowSymlinks bool
+	// Delete each source file after it was encrypted and added to the
+	// local file set. The files that fail to import are not deleted.
+	DeleteSource bool
+	// Delete each source file only after it was uploaded to the server.
+	// The files are synced at the end of the import. It implies
+	// DeleteSource.
+	DeleteAfterUpload bool
+}
+
+// importedFile is a file that was added to a file set by importFiles.
+type importedFile struct {
+	src     string
+	fileSet string
+	file    string
+}
+
 // ImportFiles encrypts and imports files. Returns the number of files imported.
 func (c *Client) ImportFiles(patterns []string, dest string, recursive bool) (int, error) {
-	files, err := c.findFilesToImport(patterns, dest, recursive)
+	return c.ImportFilesWithOptions(patterns, dest, ImportOptions{Recursive: recursive})
+}
+
+// ImportFilesContext is like ImportFiles, but it stops when ctx is canceled.
+func (c *Client) ImportFilesContext(ctx context.Context, patterns []string, dest string, recursive bool) (int, error) {
+	return c.ImportFilesWithOptionsContext(ctx, patterns, dest, ImportOptions{Recursive: recursive})
+}
+
+// ImportFilesWithOptions encrypts and imports files. Returns the number of
+// files imported.
+func (c *Client) ImportFilesWithOptions(patterns []string, dest string, opts ImportOptions) (int, error) {
+	return c.ImportFilesWithOptionsContext(context.Background(), patterns, dest, opts)
+}
+
+// ImportFilesWithOptionsContext is like ImportFilesWithOptions, but it stops
+// when ctx is canceled. The files that were already encrypted are added to
+// their file sets, and the others are reported as errors.
+func (c *Client) ImportFilesWithOptionsContext(ctx context.Context, patterns []string, dest string, opts ImportOptions) (int, error) {
+	if opts.DeleteAfterUpload {
+		opts.DeleteSource = true
+		if c.Account == nil {
+			return 0, fmt.Errorf("deleting the source files after upload: %w", ErrNotLoggedIn)
+		}
+	}
+	if opts.DeleteSource && c.durability == DurabilityNone {
+		return 0, errors.New("the source files can't be deleted when the durability mode is none")
+	}
+	files, err := c.findFilesToImport(patterns, dest, opts)
 	if err != nil {
 		return 0, err
 	}
@@ -91,11 +154,16 @@ func (c *Client) ImportFiles(patterns []string, dest string, recursive bool) (in
 			return 0, fmt.Errorf("cannot import to trash: %s", dir)
 		}
 		if li[0].Album != nil && li[0].Album.IsOwner != "1" && !stingle.Permissions(li[0].Album.Permissions).AllowAdd() {
-			return 0, fmt.Errorf("adding is not allowed: %s", dir)
+			return 0, fmt.Errorf("%w: adding is not allowed: %s", ErrPermissionDenied, dir)
 		}
 	}
-	count := 0
+	var imported []importedFile
+	var errs []error
 	for _, dir := range sorted {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
 		li := dirs[dir]
 		if len(li) == 0 || (len(li) == 1 && li[0].Set == "") {
 			name := dir
@@ -115,19 +183,211 @@ func (c *Client) ImportFiles(patterns []string, dest string, recursive bool) (in
 				return 0, err
 			}
 		}
+		var dirFiles []toImport
 		for _, f := range files {
-			if dd, _ := filepath.Split(f.dst); dir != strings.TrimSuffix(dd, "/") {
-				continue
+			if dd, _ := filepath.Split(f.dst); dir == strings.TrimSuffix(dd, "/") {
+				dirFiles = append(dirFiles, f)
 			}
-			c.Printf("Importing %s -> %s (not synced)\n", f.src, f.dst)
-			if err := c.importFile(f.src, li[0], pk); err != nil {
-				return count, err
+		}
+		done, err := c.importFiles(ctx, dirFiles, li[0], pk, opts)
+		imported = append(imported, done...)
+		errs = append(errs, err...)
+	}
+	count := len(imported)
+	if opts.DeleteAfterUpload && count > 0 {
+		if err := c.SyncContext(ctx, false); err != nil {
+			errs = append(errs, err)
+		} else {
+			errs = append(errs, c.deleteUploadedSources(imported)...)
+		}
+	}
+	if errs != nil {
+		return count, fmt.Errorf("%w %v", errs[0], errs[1:])
+	}
+	return count, nil
+}
+
+// importFiles encrypts files in parallel and then adds them to dst's file set
+// in a single commit. The files that fail to import are reported in the
+// returned errors and don't prevent the others from being added. With
+// DeleteSource, and without DeleteAfterUpload, the source files are deleted
+// after the commit.
+func (c *Client) importFiles(ctx context.Context, files []toImport, dst ListItem, pk stingle.PublicKey, opts ImportOptions) ([]importedFile, []error) {
+	type result struct {
+		src  string
+		file *stingle.File
+		err  error
+	}
+	// The files are processed in two stages. The metadata, EXIF, and
+	// thumbnails are CPU-bound, and use all the CPUs. The encryption and
+	// the writing of the blobs use a separate pool of workers.
+	qCh := make(chan toImport)
+	pCh := make(chan *preparedImport)
+	rCh := make(chan result)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range qCh {
+				if err := ctx.Err(); err != nil {
+					rCh <- result{f.src, nil, fmt.Errorf("%s: %w", f.src, err)}
+					continue
+				}
+				c.Infof("Importing %s -> %s (not synced)\n", f.src, f.dst)
+				p, err := c.prepareImport(f.src, opts)
+				if err != nil {
+					rCh <- result{f.src, nil, fmt.Errorf("%s: %w", f.src, err)}
+					continue
+				}
+				pCh <- p
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(pCh)
+	}()
+	for i := 0; i < 5; i++ {
+		go func() {
+			for p := range pCh {
+				sFile, err := c.encryptImport(p, dst, pk)
+				if err != nil {
+					err = fmt.Errorf("%s: %w", p.file, err)
+				}
+				rCh <- result{p.file, sFile, err}
+			}
+		}()
+	}
+	go func() {
+		for _, f := range files {
+			qCh <- f
+		}
+		close(qCh)
+	}()
+	var errs []error
+	var newFiles []result
+	for range files {
+		r := <-rCh
+		if r.err != nil {
+			errs = append(errs, r.err)
+			continue
+		}
+		newFiles = append(newFiles, r)
+	}
+	if len(newFiles) == 0 {
+		return nil, errs
+	}
+	commit, fs, err := c.fileSetForUpdate(dst.FileSet)
+	if err != nil {
+		return nil, append(errs, err)
+	}
+	for _, r := range newFiles {
+		fs.Files[r.file.File] = r.file
+	}
+	if err := commit(true, nil); err != nil {
+		return nil, append(errs, err)
+	}
+	imported := make([]importedFile, 0, len(newFiles))
+	for _, r := range newFiles {
+		imported = append(imported, importedFile{src: r.src, fileSet: dst.FileSet, file: r.file.File})
+	}
+	if opts.DeleteSource && !opts.DeleteAfterUpload {
+		// The files are committed to the file set. The sources can be
+		// deleted safely.
+		for _, f := range imported {
+			if err := c.deleteSource(f.src); err != nil {
+				errs = append(errs, err)
 			}
-			count++
 		}
 	}
+	return imported, errs
+}
 
-	return count, nil
+// deleteUploadedSources deletes the source files of the imported files that
+// were uploaded to the server.
+func (c *Client) deleteUploadedSources(imported []importedFile) []error {
+	var errs []error
+	fileSets := make(map[string]*FileSet)
+	for _, f := range imported {
+		fs, ok := fileSets[f.fileSet]
+		if !ok {
+			fs = &FileSet{}
+			if err := c.storage.ReadDataFile(c.fileHash(f.fileSet), fs); err != nil {
+				errs = append(errs, err)
+				fs = nil
+			}
+			fileSets[f.fileSet] = fs
+		}
+		if fs == nil || fs.RemoteFiles[f.file] == nil {
+			c.Infof("Not deleting %s (not uploaded)\n", f.src)
+			continue
+		}
+		if err := c.deleteSource(f.src); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// deleteSource deletes a source file that was imported.
+func (c *Client) deleteSource(src string) error {
+	if err := os.Remove(src); err != nil {
+		return err
+	}
+	c.Infof("Deleted %s\n", src)
+	return nil
+}
+
+// ParseImportDate parses a creation date for ImportOptions.Dates. The date can
+// be in RFC 3339 format, "2006-01-02 15:04:05" or "2006-01-02" in local time,
+// or a number of seconds since the epoch.
+func ParseImportDate(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid date: %q", s)
+}
+
+// ReadDateManifest reads a manifest of creation dates for ImportOptions.Dates.
+// Each line has the form <file>=<date>. Empty lines and lines that start with
+// # are ignored.
+func ReadDateManifest(file string) (map[string]time.Time, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dates := make(map[string]time.Time)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("%s:%d: expected <file>=<date>", file, n)
+		}
+		t, err := ParseImportDate(line[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", file, n, err)
+		}
+		dates[strings.TrimSpace(line[:i])] = t
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return dates, nil
 }
 
 func importedFileName(s string) string {
@@ -139,7 +399,7 @@ func importedFileName(s string) string {
 	return filepath.Join(parts...)
 }
 
-func (c *Client) findFilesToImport(patterns []string, dest string, recursive bool) ([]toImport, error) {
+func (c *Client) findFilesToImport(patterns []string, dest string, opts ImportOptions) ([]toImport, error) {
 	dest = strings.TrimSuffix(dest, "/")
 	li, err := c.glob(dest, GlobOptions{})
 	if err != nil {
@@ -152,7 +412,7 @@ func (c *Client) findFilesToImport(patterns []string, dest string, recursive boo
 		dest = li[0].Filename
 	}
 
-	existingItems, err := c.glob(filepath.Join(dest, "*"), GlobOptions{MatchDot: true, Recursive: recursive})
+	existingItems, err := c.glob(filepath.Join(dest, "*"), GlobOptions{MatchDot: true, Recursive: opts.Recursive})
 	if err != nil {
 		return nil, err
 	}
@@ -162,51 +422,45 @@ func (c *Client) findFilesToImport(patterns []string, dest string, recursive boo
 	}
 
 	var files []toImport
+	add := func(src, rel string) {
+		df := filepath.Join(dest, importedFileName(rel))
+		if exist[df] {
+			c.Infof("Skipping %s (already exists)\n", df)
+			return
+		}
+		files = append(files, toImport{src: src, dst: df})
+	}
+	visited := make(map[string]bool)
 	for _, p := range patterns {
 		m, err := filepath.Glob(p)
 		if err != nil {
 			return nil, err
 		}
 		for _, f := range m {
-			fi, err := os.Stat(f)
+			fi, err := c.importFileInfo(f, opts.FollowSymlinks)
 			if err != nil {
 				log.Errorf("%s: %v", f, err)
 				continue
 			}
+			if fi == nil {
+				continue
+			}
 			if !fi.IsDir() {
 				_, file := filepath.Split(f)
-				df := filepath.Join(dest, importedFileName(file))
-				if exist[df] {
-					c.Printf("Skipping %s (already exists)\n", df)
-					continue
-				}
-				files = append(files, toImport{src: f, dst: df})
+				add(f, file)
 				continue
 			}
-			if !recursive {
+			if !opts.Recursive {
 				continue
 			}
 			baseDir, _ := filepath.Split(f)
-			filepath.WalkDir(f, func(p string, d fs.DirEntry, err error) error {
-				if err != nil {
-					log.Errorf("%s: %v", p, err)
-					return nil
-				}
-				if d.IsDir() {
-					return nil
-				}
+			c.walkImportDir(f, opts.FollowSymlinks, visited, func(p string) {
 				rel, err := filepath.Rel(baseDir, p)
 				if err != nil {
 					log.Errorf("%s: %v", p, err)
-					return nil
+					return
 				}
-				df := filepath.Join(dest, importedFileName(rel))
-				if exist[df] {
-					c.Printf("Skipping %s (already exists)\n", df)
-					return nil
-				}
-				files = append(files, toImport{src: p, dst: df})
-				return nil
+				add(p, rel)
 			})
 		}
 	}
@@ -214,6 +468,66 @@ func (c *Client) findFilesToImport(patterns []string, dest string, recursive boo
 	return files, nil
 }
 
+// importFileInfo returns the FileInfo of a file or directory to import. It
+// returns nil when the file must be skipped, i.e. special files, and symbolic
+// links unless followSymlinks is true.
+func (c *Client) importFileInfo(path string, followSymlinks bool) (fs.FileInfo, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		if !followSymlinks {
+			c.Infof("Skipping %s (symbolic link)\n", path)
+			return nil, nil
+		}
+		if fi, err = os.Stat(path); err != nil {
+			return nil, err
+		}
+	}
+	if !fi.IsDir() && !fi.Mode().IsRegular() {
+		c.Infof("Skipping %s (not a regular file)\n", path)
+		return nil, nil
+	}
+	return fi, nil
+}
+
+// walkImportDir calls fn for each file to import in dir, recursively. The
+// directories that were already visited, e.g. through symbolic links, are
+// skipped.
+func (c *Client) walkImportDir(dir string, followSymlinks bool, visited map[string]bool, fn func(path string)) {
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		log.Errorf("%s: %v", dir, err)
+		return
+	}
+	if visited[real] {
+		return
+	}
+	visited[real] = true
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Errorf("%s: %v", dir, err)
+		return
+	}
+	for _, e := range entries {
+		p := filepath.Join(dir, e.Name())
+		fi, err := c.importFileInfo(p, followSymlinks)
+		if err != nil {
+			log.Errorf("%s: %v", p, err)
+			continue
+		}
+		if fi == nil {
+			continue
+		}
+		if fi.IsDir() {
+			c.walkImportDir(p, followSymlinks, visited, fn)
+			continue
+		}
+		fn(p)
+	}
+}
+
 func fileTypeForExt(ext string) uint8 {
 	switch ext {
 	case ".jpg", ".jpeg", ".png", ".gif", ".tiff", ".bmp", ".webp", ".svg":
@@ -227,24 +541,64 @@ func fileTypeForExt(ext string) uint8 {
 	}
 }
 
-func (c *Client) importFile(file string, dst ListItem, pk stingle.PublicKey) error {
+// importFile encrypts file and returns the stingle.File to add to dst's file
+// set.
+func (c *Client) importFile(file string, dst ListItem, pk stingle.PublicKey, opts ImportOptions) (*stingle.File, error) {
+	p, err := c.prepareImport(file, opts)
+	if err != nil {
+		return nil, err
+	}
+	return c.encryptImport(p, dst, pk)
+}
+
+// preparedImport is a file to import, with its metadata and thumbnail.
+type preparedImport struct {
+	file         string
+	in           *os.File
+	src          io.ReadSeeker
+	hdrs         [2]*stingle.Header
+	creationTime time.Time
+	thumbnail    []byte
+}
+
+// close releases the resources of p.
+func (p *preparedImport) close() {
+	p.in.Close()
+	p.hdrs[0].Wipe()
+	p.hdrs[1].Wipe()
+}
+
+// prepareImport reads the metadata of file, and makes its thumbnail. The
+// returned preparedImport must be passed to encryptImport.
+func (c *Client) prepareImport(file string, opts ImportOptions) (_ *preparedImport, retErr error) {
 	fi, err := os.Stat(file)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	// Opening a FIFO would block, and devices and sockets can't be read
+	// like files.
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("not a regular file (%s)", fi.Mode().Type())
 	}
 
 	in, err := os.Open(file)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer in.Close()
-
 	_, fn := filepath.Split(file)
-	creationTime := time.Now()
+	p := &preparedImport{
+		file: file,
+		in:   in,
+		hdrs: stingle.NewHeaders(fn),
+	}
+	defer func() {
+		if retErr != nil {
+			p.close()
+		}
+	}()
+	hdrs := p.hdrs
+	var creationTime time.Time
 
-	hdrs := stingle.NewHeaders(fn)
-	defer hdrs[0].Wipe()
-	defer hdrs[1].Wipe()
 	hdrs[0].DataSize = fi.Size()
 	hdrs[0].FileType = fileTypeForExt(strings.ToLower(filepath.Ext(file)))
 	if hdrs[0].FileType == stingle.FileTypeVideo {
@@ -256,7 +610,7 @@ func (c *Client) importFile(file string, dst ListItem, pk stingle.PublicKey) err
 		}
 	}
 	if _, err := in.Seek(0, io.SeekStart); err != nil {
-		return err
+		return nil, err
 	}
 
 	if x, err := exif.Decode(in); err == nil {
@@ -265,59 +619,107 @@ func (c *Client) importFile(file string, dst ListItem, pk stingle.PublicKey) err
 		}
 	}
 	if _, err := in.Seek(0, io.SeekStart); err != nil {
-		return err
+		return nil, err
 	}
-
-	var thumbnail []byte
-	switch hdrs[0].FileType {
-	case stingle.FileTypeVideo:
-		thumbnail, err = c.videoThumbnail(in)
-	case stingle.FileTypePhoto:
-		thumbnail, err = c.photoThumbnail(in)
-	default:
-		thumbnail, err = c.GenericThumbnail(file)
+	if t, ok := opts.Dates[file]; ok {
+		creationTime = t
+	} else if t, ok := opts.Dates[fn]; ok {
+		creationTime = t
 	}
-	if err != nil {
-		// Fallback to a genetic thumbnail.
-		thumbnail, err = c.GenericThumbnail(file)
+	if creationTime.IsZero() && opts.DateFromMtime {
+		creationTime = fi.ModTime()
 	}
-	if err != nil {
-		return err
+	if creationTime.IsZero() {
+		creationTime = time.Now()
 	}
-	hdrs[1].DataSize = int64(len(thumbnail))
+	p.creationTime = creationTime
+
+	// The creation time was already read from the original file. Only
+	// the key EXIF fields are kept when the image is downscaled.
+	p.src = in
+	if opts.MaxDimension > 0 && hdrs[0].FileType == stingle.FileTypePhoto {
+		b, err := downscaleImage(in, opts.MaxDimension)
+		if err != nil {
+			return nil, err
+		}
+		if b != nil {
+			p.src = bytes.NewReader(b)
+			hdrs[0].DataSize = int64(len(b))
+		} else if _, err := in.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.thumbnail, err = c.makeThumbnail(p.src, file, hdrs[0].FileType); err != nil {
+		return nil, err
+	}
+	hdrs[1].DataSize = int64(len(p.thumbnail))
 	hdrs[1].FileType = hdrs[0].FileType
 	hdrs[1].VideoDuration = hdrs[0].VideoDuration
+	return p, nil
+}
 
-	encHdrs, err := stingle.EncryptBase64Headers(hdrs[:], pk)
+// encryptImport encrypts a file that was prepared by prepareImport, and
+// returns the stingle.File to add to dst's file set. It releases p.
+func (c *Client) encryptImport(p *preparedImport, dst ListItem, pk stingle.PublicKey) (*stingle.File, error) {
+	defer p.close()
+	encHdrs, err := stingle.EncryptBase64Headers(p.hdrs[:], pk)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	sFile := stingle.File{
 		File:         makeSPFilename(),
 		Version:      "1",
-		DateCreated:  json.Number(strconv.FormatInt(creationTime.UnixNano()/1000000, 10)),
-		DateModified: json.Number(strconv.FormatInt(time.Now().UnixNano()/1000000, 10)),
+		DateCreated:  json.Number(strconv.FormatInt(p.creationTime.UnixNano()/1000000, 10)),
+		DateModified: c.nowJSON(),
 		Headers:      encHdrs,
 	}
 	if dst.Album != nil {
 		sFile.AlbumID = dst.Album.AlbumID
 	}
 
-	if _, err := in.Seek(0, io.SeekStart); err != nil {
-		return err
+	if _, err := p.src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
 	}
-	if err := c.encryptFile(in, sFile.File, hdrs[0], pk, false); err != nil {
-		return err
+	if err := c.encryptFile(p.src, sFile.File, p.hdrs[0], pk, false); err != nil {
+		return nil, err
 	}
-	if err := c.encryptFile(bytes.NewBuffer(thumbnail), sFile.File, hdrs[1], pk, true); err != nil {
-		return err
+	if err := c.encryptFile(bytes.NewBuffer(p.thumbnail), sFile.File, p.hdrs[1], pk, true); err != nil {
+		return nil, err
 	}
-	commit, fs, err := c.fileSetForUpdate(dst.FileSet)
+	return &sFile, nil
+}
+
+// downscaleImage returns the JPEG image from in, re-encoded to fit in
+// maxDim x maxDim pixels. The key EXIF fields are copied to the new image, and
+// the orientation is left to the viewer, as with the original image. It
+// returns nil if the image isn't a JPEG image, or if it is already small
+// enough.
+func downscaleImage(in io.ReadSeeker, maxDim int) ([]byte, error) {
+	cfg, format, err := image.DecodeConfig(in)
+	if err != nil || format != "jpeg" || (cfg.Width <= maxDim && cfg.Height <= maxDim) {
+		return nil, nil
+	}
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	x, _ := exif.Decode(in)
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, err := imaging.Decode(in)
 	if err != nil {
-		return err
+		return nil, nil
 	}
-	fs.Files[sFile.File] = &sFile
-	return commit(true, nil)
+	img = imaging.Fit(img, maxDim, maxDim, imaging.Lanczos)
+	var buf bytes.Buffer
+	if err := imaging.Encode(&buf, img, imaging.JPEG, imaging.JPEGQuality(90)); err != nil {
+		return nil, err
+	}
+	if x == nil {
+		return buf.Bytes(), nil
+	}
+	return insertExif(buf.Bytes(), x)
 }
 
 func makeSPFilename() string {
@@ -337,6 +739,24 @@ func (c *Client) importExif(file string) (x *exif.Exif, err error) {
 	return exif.Decode(f)
 }
 
+// makeThumbnail returns the thumbnail of file, whose content is read from in.
+func (c *Client) makeThumbnail(in io.Reader, file string, fileType uint8) (thumbnail []byte, err error) {
+	switch fileType {
+	case stingle.FileTypeVideo:
+		thumbnail, err = c.videoThumbnail(in)
+	case stingle.FileTypePhoto:
+		thumbnail, err = c.photoThumbnail(in)
+	default:
+		thumbnail, err = c.GenericThumbnail(file)
+	}
+	if err != nil {
+		// Fallback to a genetic thumbnail.
+		log.Infof("Using generic thumbnail for %s: %v", file, err)
+		thumbnail, err = c.GenericThumbnail(file)
+	}
+	return
+}
+
 func (c *Client) GenericThumbnail(filename string) ([]byte, error) {
 	_, filename = filepath.Split(filename)
 	var ext string
@@ -373,6 +793,9 @@ func (c *Client) GenericThumbnail(filename string) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// photoThumbnail returns a thumbnail for any image format registered with the
+// image package, i.e. JPEG, PNG, GIF, BMP, TIFF, and WebP. Only the first frame
+// of animated GIFs is used.
 func (c *Client) photoThumbnail(file io.Reader) ([]byte, error) {
 	img, err := imaging.Decode(file, imaging.AutoOrientation(true))
 	if err != nil {
@@ -443,25 +866,27 @@ func videoMetadata(file io.Reader) (duration int32, creationTime time.Time, err
 func (c *Client) encryptFile(in io.Reader, file string, hdr *stingle.Header, pk stingle.PublicKey, thumb bool) error {
 	fn := c.blobPath(file, thumb)
 	dir, _ := filepath.Split(fn)
-	if err := os.MkdirAll(dir, 0700); err != nil {
+	if err := c.blobPerm.MkdirAll(dir); err != nil {
 		return err
 	}
-	tmp := fmt.Sprintf("%s-tmp-%d", fn, time.Now().UnixNano())
-	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_SYNC, 0600)
+	out, tmp, err := c.createBlobTemp(fn)
 	if err != nil {
 		return err
 	}
 	if err := stingle.EncryptHeader(out, hdr, pk); err != nil {
 		out.Close()
+		os.Remove(tmp)
 		return err
 	}
 	w := stingle.EncryptFile(out, hdr)
 	if _, err := io.Copy(w, in); err != nil {
 		w.Close()
+		os.Remove(tmp)
 		return err
 	}
 	if err := w.Close(); err != nil {
+		os.Remove(tmp)
 		return err
 	}
-	return os.Rename(tmp, fn)
+	return c.commitBlobTemp(tmp, fn)
 }
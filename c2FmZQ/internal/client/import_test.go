@@ -18,13 +18,28 @@
 package client
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/c2FmZQ/storage"
 	"github.com/c2FmZQ/storage/crypto"
+	"github.com/rwcarlsen/goexif/exif"
+
+	"c2FmZQ/internal/stingle"
 )
 
 func TestFindFilesToImport(t *testing.T) {
@@ -60,7 +75,7 @@ func TestFindFilesToImport(t *testing.T) {
 		{src: testDir + "/file2", dst: "dest/file2"},
 	}
 
-	got, err := c.findFilesToImport([]string{filepath.Join(testDir, "*")}, dest, true)
+	got, err := c.findFilesToImport([]string{filepath.Join(testDir, "*")}, dest, ImportOptions{Recursive: true})
 	if err != nil {
 		t.Fatalf("c.findFilesToImport('*'): %v", err)
 	}
@@ -69,6 +84,383 @@ func TestFindFilesToImport(t *testing.T) {
 	}
 }
 
+func TestImportFilesBatch(t *testing.T) {
+	c, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	sk := stingle.MakeSecretKeyForTest()
+	defer sk.Wipe()
+
+	testDir := t.TempDir()
+	var files []toImport
+	for _, f := range []string{"file1", "file2", "file3"} {
+		fn := filepath.Join(testDir, f)
+		if err := os.WriteFile(fn, []byte(f), 0600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		files = append(files, toImport{src: fn, dst: f})
+	}
+	files = append(files, toImport{src: filepath.Join(testDir, "missing"), dst: "missing"})
+
+	imported, errs := c.importFiles(context.Background(), files, ListItem{FileSet: galleryFile}, sk.PublicKey(), ImportOptions{})
+	if want, got := 3, len(imported); want != got {
+		t.Errorf("Unexpected importFiles result. Want %d, got %d", want, got)
+	}
+	if want, got := 1, len(errs); want != got {
+		t.Errorf("Unexpected number of errors. Want %d, got %d: %v", want, got, errs)
+	} else if want, got := filepath.Join(testDir, "missing")+":", errs[0].Error(); !strings.HasPrefix(got, want) {
+		t.Errorf("Error not attributed to the right file. Want %q, got %q", want, got)
+	}
+	for _, f := range imported {
+		if filepath.Base(f.src) == "missing" {
+			t.Errorf("Unexpected imported file: %+v", f)
+		}
+	}
+	var fs FileSet
+	if err := c.storage.ReadDataFile(c.fileHash(galleryFile), &fs); err != nil {
+		t.Fatalf("ReadDataFile: %v", err)
+	}
+	if want, got := 3, len(fs.Files); want != got {
+		t.Errorf("Unexpected number of files in gallery. Want %d, got %d", want, got)
+	}
+}
+
+func TestImportDeleteSource(t *testing.T) {
+	c, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	c.SetQuiet(true)
+	sk := stingle.MakeSecretKeyForTest()
+	defer sk.Wipe()
+
+	testDir := t.TempDir()
+	var files []toImport
+	for _, f := range []string{"file1", "file2"} {
+		fn := filepath.Join(testDir, f)
+		if err := os.WriteFile(fn, []byte(f), 0600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		files = append(files, toImport{src: fn, dst: f})
+	}
+	// A directory can't be imported, and must not be deleted.
+	if err := os.Mkdir(filepath.Join(testDir, "dir"), 0700); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	files = append(files, toImport{src: filepath.Join(testDir, "dir"), dst: "dir"})
+
+	imported, errs := c.importFiles(context.Background(), files, ListItem{FileSet: galleryFile}, sk.PublicKey(), ImportOptions{DeleteSource: true})
+	if want, got := 2, len(imported); want != got {
+		t.Errorf("Unexpected importFiles result. Want %d, got %d", want, got)
+	}
+	if want, got := 1, len(errs); want != got {
+		t.Errorf("Unexpected number of errors. Want %d, got %d: %v", want, got, errs)
+	}
+	entries, err := os.ReadDir(testDir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "dir" {
+		t.Errorf("Unexpected files left in source directory: %v", entries)
+	}
+
+	c.SetDurability(DurabilityNone)
+	if _, err := c.ImportFilesWithOptions([]string{filepath.Join(testDir, "*")}, "gallery", ImportOptions{DeleteSource: true}); err == nil {
+		t.Error("ImportFilesWithOptions with DurabilityNone succeeded unexpectedly")
+	}
+}
+
+func TestImportDates(t *testing.T) {
+	c, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	testDir := t.TempDir()
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	for _, f := range []string{"file1", "file2", "file3"} {
+		fn := filepath.Join(testDir, f)
+		if err := os.WriteFile(fn, []byte(f), 0600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		if err := os.Chtimes(fn, mtime, mtime); err != nil {
+			t.Fatalf("Chtimes: %v", err)
+		}
+	}
+	manifest := filepath.Join(t.TempDir(), "dates")
+	content := "# Dates\n\nfile2=2010-11-12T13:14:15Z\n" + filepath.Join(testDir, "file3") + "=1234567890\n"
+	if err := os.WriteFile(manifest, []byte(content), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	dates, err := ReadDateManifest(manifest)
+	if err != nil {
+		t.Fatalf("ReadDateManifest: %v", err)
+	}
+
+	opts := ImportOptions{DateFromMtime: true, Dates: dates}
+	if _, err := c.ImportFilesWithOptions([]string{filepath.Join(testDir, "*")}, "gallery", opts); err != nil {
+		t.Fatalf("ImportFilesWithOptions: %v", err)
+	}
+	li, err := c.GlobFiles([]string{"gallery/*"}, GlobOptions{})
+	if err != nil {
+		t.Fatalf("GlobFiles: %v", err)
+	}
+	got := make(map[string]int64)
+	for _, item := range li {
+		got[item.Filename], _ = item.FSFile.DateCreated.Int64()
+	}
+	want := map[string]int64{
+		"gallery/file1": mtime.UnixMilli(),
+		"gallery/file2": time.Date(2010, 11, 12, 13, 14, 15, 0, time.UTC).UnixMilli(),
+		"gallery/file3": 1234567890000,
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("Unexpected dates. Want %v, got %v", want, got)
+	}
+
+	if err := os.WriteFile(manifest, []byte("file1=yesterday\n"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err := ReadDateManifest(manifest); err == nil {
+		t.Error("ReadDateManifest succeeded with an invalid date")
+	}
+}
+
+func TestImportMaxDimension(t *testing.T) {
+	c, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	testDir := t.TempDir()
+	for _, f := range []struct {
+		name string
+		w, h int
+	}{{"large.jpg", 200, 100}, {"small.jpg", 30, 20}} {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, f.w, f.h)), nil); err != nil {
+			t.Fatalf("jpeg.Encode: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(testDir, f.name), buf.Bytes(), 0600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	if _, err := c.ImportFilesWithOptions([]string{filepath.Join(testDir, "*")}, "gallery", ImportOptions{MaxDimension: 50}); err != nil {
+		t.Fatalf("ImportFilesWithOptions: %v", err)
+	}
+	li, err := c.GlobFiles([]string{"gallery/*"}, GlobOptions{})
+	if err != nil {
+		t.Fatalf("GlobFiles: %v", err)
+	}
+	got := make(map[string]string)
+	for _, item := range li {
+		sk := c.SecretKey()
+		hdr, err := item.Header(sk)
+		sk.Wipe()
+		if err != nil {
+			t.Fatalf("Header: %v", err)
+		}
+		f, err := os.Open(item.FilePath)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		if err := stingle.SkipHeader(f); err != nil {
+			t.Fatalf("SkipHeader: %v", err)
+		}
+		cfg, err := jpeg.DecodeConfig(stingle.DecryptFile(f, hdr))
+		f.Close()
+		if err != nil {
+			t.Fatalf("DecodeConfig(%s): %v", item.Filename, err)
+		}
+		got[item.Filename] = fmt.Sprintf("%dx%d", cfg.Width, cfg.Height)
+	}
+	want := map[string]string{
+		"gallery/large.jpg": "50x25",
+		"gallery/small.jpg": "30x20",
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("Unexpected image sizes. Want %v, got %v", want, got)
+	}
+}
+
+func TestImportMaxDimensionKeepsExif(t *testing.T) {
+	c, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 200, 100)), nil); err != nil {
+		t.Fatalf("jpeg.Encode: %v", err)
+	}
+	ascii := func(id uint16, s string) exifTag {
+		return exifTag{id: id, typ: tiffASCII, count: uint32(len(s) + 1), data: append([]byte(s), 0)}
+	}
+	ifd0 := []exifTag{
+		ascii(0x010f, "Acme"),
+		ascii(0x0110, "Camera 3000"),
+		ascii(0x0131, "Photo Editor"),
+		{id: 0x0112, typ: tiffShort, count: 1, data: []byte{6, 0, 0, 0}},
+		{id: exifIFDTag, typ: tiffLong, count: 1, data: make([]byte, 4)},
+	}
+	sub := []exifTag{ascii(0x9003, "2005:06:07 08:09:10")}
+	subStart := uint32(8 + len(encodeIFD(8, ifd0)))
+	binary.LittleEndian.PutUint32(ifd0[4].data, subStart)
+	tiff := append([]byte{'I', 'I', 42, 0, 8, 0, 0, 0}, encodeIFD(8, ifd0)...)
+	tiff = append(tiff, encodeIFD(subStart, sub)...)
+	seg := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(2+6+len(tiff)))
+	seg = append(append(seg, "Exif\x00\x00"...), tiff...)
+	img := append(append(append([]byte{}, buf.Bytes()[:2]...), seg...), buf.Bytes()[2:]...)
+
+	testDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(testDir, "image.jpg"), img, 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err := c.ImportFilesWithOptions([]string{filepath.Join(testDir, "*")}, "gallery", ImportOptions{MaxDimension: 50}); err != nil {
+		t.Fatalf("ImportFilesWithOptions: %v", err)
+	}
+	li, err := c.GlobFiles([]string{"gallery/image.jpg"}, GlobOptions{})
+	if err != nil || len(li) != 1 {
+		t.Fatalf("GlobFiles: %v %v", li, err)
+	}
+	sk := c.SecretKey()
+	hdr, err := li[0].Header(sk)
+	sk.Wipe()
+	if err != nil {
+		t.Fatalf("Header: %v", err)
+	}
+	x, err := c.getExif(li[0], hdr)
+	if err != nil {
+		t.Fatalf("getExif: %v", err)
+	}
+	got := make(map[string]string)
+	for _, f := range []exif.FieldName{exif.Make, exif.Model, exif.Orientation, exif.DateTimeOriginal, exif.Software} {
+		if tag, err := x.Get(f); err == nil {
+			got[string(f)] = tag.String()
+		}
+	}
+	want := map[string]string{
+		"Make":             `"Acme"`,
+		"Model":            `"Camera 3000"`,
+		"Orientation":      "6",
+		"DateTimeOriginal": `"2005:06:07 08:09:10"`,
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("Unexpected EXIF fields. Want %v, got %v", want, got)
+	}
+	if want, got := time.Date(2005, 6, 7, 8, 9, 10, 0, time.Local).UnixMilli(), li[0].FSFile.DateCreated.String(); fmt.Sprint(want) != got {
+		t.Errorf("Unexpected creation date. Want %d, got %s", want, got)
+	}
+}
+
+func TestImportReadsAlbumListOnce(t *testing.T) {
+	c, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	c.SetQuiet(true)
+	if err := c.AddAlbums([]string{"album"}); err != nil {
+		t.Fatalf("AddAlbums: %v", err)
+	}
+	testDir := t.TempDir()
+	for i := 0; i < 20; i++ {
+		if err := os.WriteFile(filepath.Join(testDir, fmt.Sprintf("file%02d", i)), []byte{byte(i)}, 0600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	reads := func() int {
+		c.storage.albums.mu.Lock()
+		defer c.storage.albums.mu.Unlock()
+		return c.storage.albums.reads
+	}
+
+	before := reads()
+	for _, p := range []string{"file0*", "file1*"} {
+		if n, err := c.ImportFiles([]string{filepath.Join(testDir, p)}, "album", false); err != nil || n != 10 {
+			t.Fatalf("ImportFiles(%s): %d, %v", p, n, err)
+		}
+	}
+	if want, got := 1, reads()-before; want != got {
+		t.Errorf("Album list read %d times, want %d", got, want)
+	}
+
+	// Modifying the album list invalidates the cache.
+	if err := c.AddAlbums([]string{"album2"}); err != nil {
+		t.Fatalf("AddAlbums: %v", err)
+	}
+	li, err := c.GlobFiles([]string{"*"}, GlobOptions{})
+	if err != nil {
+		t.Fatalf("GlobFiles: %v", err)
+	}
+	if want, got := 3, len(li); want != got {
+		t.Errorf("GlobFiles returned %d items, want %d", got, want)
+	}
+	if want, got := 2, reads()-before; want != got {
+		t.Errorf("Album list read %d times, want %d", got, want)
+	}
+}
+
+func TestMakeThumbnail(t *testing.T) {
+	c, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+
+	// An animated GIF with a red frame followed by a blue frame.
+	red := color.RGBA{255, 0, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+	anim := &gif.GIF{}
+	for _, col := range []color.Color{red, blue} {
+		frame := image.NewPaletted(image.Rect(0, 0, 16, 16), color.Palette{red, blue})
+		for x := 0; x < 16; x++ {
+			for y := 0; y < 16; y++ {
+				frame.Set(x, y, col)
+			}
+		}
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var gifBuf bytes.Buffer
+	if err := gif.EncodeAll(&gifBuf, anim); err != nil {
+		t.Fatalf("gif.EncodeAll: %v", err)
+	}
+	// A 1x1 lossless WebP image.
+	webp, err := base64.StdEncoding.DecodeString("UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA==")
+	if err != nil {
+		t.Fatalf("base64: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		content []byte
+	}{
+		{"anim.gif", gifBuf.Bytes()},
+		{"image.webp", webp},
+		{"broken.jpg", []byte("not an image")},
+	} {
+		thumb, err := c.makeThumbnail(bytes.NewReader(tc.content), tc.name, stingle.FileTypePhoto)
+		if err != nil {
+			t.Fatalf("%s: makeThumbnail: %v", tc.name, err)
+		}
+		img, err := png.Decode(bytes.NewReader(thumb))
+		if err != nil {
+			t.Fatalf("%s: png.Decode: %v", tc.name, err)
+		}
+		generic, err := c.GenericThumbnail(tc.name)
+		if err != nil {
+			t.Fatalf("%s: GenericThumbnail: %v", tc.name, err)
+		}
+		if isGeneric := bytes.Equal(thumb, generic); isGeneric != (tc.name == "broken.jpg") {
+			t.Errorf("%s: generic thumbnail = %v", tc.name, isGeneric)
+		}
+		if tc.name == "anim.gif" {
+			b := img.Bounds()
+			if r, g, bl, _ := img.At(b.Dx()/2, b.Dy()/2).RGBA(); r>>8 < 200 || g>>8 > 50 || bl>>8 > 50 {
+				t.Errorf("%s: thumbnail isn't from the first frame: %v", tc.name, img.At(b.Dx()/2, b.Dy()/2))
+			}
+		}
+	}
+}
+
 func newClient(dir string) (*Client, error) {
 	masterKey, err := crypto.CreateAESMasterKeyForTest()
 	if err != nil {
@@ -0,0 +1,99 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !windows
+
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestFindFilesToImportSymlinks(t *testing.T) {
+	c, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	c.SetQuiet(true)
+
+	testDir := t.TempDir()
+	outDir := t.TempDir()
+	for _, f := range []string{
+		filepath.Join(testDir, "file1"),
+		filepath.Join(testDir, "dirA", "file2"),
+		filepath.Join(outDir, "file3"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(f), 0700); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		if err := os.WriteFile(f, []byte("content"), 0600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	if err := syscall.Mkfifo(filepath.Join(testDir, "fifo"), 0600); err != nil {
+		t.Fatalf("Mkfifo: %v", err)
+	}
+	for link, target := range map[string]string{
+		"link1":     "file1",
+		"linkdir":   "dirA",
+		"linkout":   outDir,
+		"dirA/self": ".",
+	} {
+		if err := os.Symlink(target, filepath.Join(testDir, link)); err != nil {
+			t.Fatalf("Symlink: %v", err)
+		}
+	}
+
+	for _, tc := range []struct {
+		opts ImportOptions
+		want []toImport
+	}{
+		{
+			opts: ImportOptions{Recursive: true},
+			want: []toImport{
+				{src: testDir + "/dirA/file2", dst: "dest/dirA/file2"},
+				{src: testDir + "/file1", dst: "dest/file1"},
+			},
+		},
+		{
+			opts: ImportOptions{Recursive: true, FollowSymlinks: true},
+			want: []toImport{
+				{src: testDir + "/dirA/file2", dst: "dest/dirA/file2"},
+				{src: testDir + "/file1", dst: "dest/file1"},
+				{src: testDir + "/link1", dst: "dest/link1"},
+				{src: testDir + "/linkout/file3", dst: "dest/linkout/file3"},
+			},
+		},
+	} {
+		got, err := c.findFilesToImport([]string{filepath.Join(testDir, "*")}, "dest", tc.opts)
+		if err != nil {
+			t.Fatalf("c.findFilesToImport(%+v): %v", tc.opts, err)
+		}
+		if !reflect.DeepEqual(tc.want, got) {
+			t.Errorf("findFilesToImport(%+v) = %v, want %v", tc.opts, got, tc.want)
+		}
+	}
+
+	if _, err := c.importFile(filepath.Join(testDir, "fifo"), ListItem{FileSet: galleryFile}, c.PublicKey(), ImportOptions{}); err == nil || !strings.Contains(err.Error(), "not a regular file") {
+		t.Errorf("importFile(fifo) = %v, want not a regular file", err)
+	}
+}
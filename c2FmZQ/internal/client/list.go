@@ -24,6 +24,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -59,21 +60,167 @@ type GlobOptions struct {
 	Recursive            bool // Traverse tree recursively.
 	ExactMatch           bool // pattern is an exact name to match, i.e. no wildcards.
 	ExactMatchExceptLast bool // pattern is an exact match except for the last element.
+	// Match is how the elements of the pattern are matched against names.
+	// ExactMatch and ExactMatchExceptLast take precedence.
+	Match MatchMode
+	// The trash and the hidden albums are only matched by their exact
+	// names, unless they are included here, or with MatchDot.
+	IncludeTrash  bool
+	IncludeHidden bool
 
 	// List options
-	Long      bool // Show long output.
-	Directory bool // Show directories themselves.
+	Long      bool      // Show long output.
+	Directory bool      // Show directories themselves.
+	Sort      SortOrder // The order of the items shown by ListFiles.
 
 	trimPrefix string
 }
 
 var MatchAll = GlobOptions{MatchDot: true}
 
+// MatchMode is how the elements of a pattern, i.e. the parts between slashes,
+// are matched against file and directory names.
+type MatchMode int
+
+const (
+	// MatchGlob matches names with shell glob patterns, e.g. *.jpg. The
+	// whole name must match.
+	MatchGlob MatchMode = iota
+	// MatchSubstring matches names that contain the pattern element.
+	MatchSubstring
+	// MatchRegexp matches names that contain a match of the pattern
+	// element as a regular expression. Use ^ and $ to anchor it.
+	MatchRegexp
+)
+
+// ParseMatchMode returns the MatchMode with this name, i.e. glob, substring,
+// or regexp.
+func ParseMatchMode(s string) (MatchMode, error) {
+	switch s {
+	case "", "glob":
+		return MatchGlob, nil
+	case "substring":
+		return MatchSubstring, nil
+	case "regexp", "regex":
+		return MatchRegexp, nil
+	default:
+		return MatchGlob, fmt.Errorf("invalid match mode %q, must be one of glob, substring, regexp", s)
+	}
+}
+
+// String returns the name of the MatchMode.
+func (m MatchMode) String() string {
+	switch m {
+	case MatchGlob:
+		return "glob"
+	case MatchSubstring:
+		return "substring"
+	case MatchRegexp:
+		return "regexp"
+	default:
+		return fmt.Sprintf("MatchMode(%d)", int(m))
+	}
+}
+
+// SortOrder is the order of the items shown by ListFiles.
+type SortOrder int
+
+const (
+	// SortByName sorts the items by name.
+	SortByName SortOrder = iota
+	// SortByCreated shows the most recently created items first. The
+	// dates of the directories are those of their albums.
+	SortByCreated
+	// SortByModified shows the most recently modified items first.
+	SortByModified
+	// SortByCount shows the directories with the most files first. Files
+	// stay in name order.
+	SortByCount
+)
+
+// ParseSortOrder returns the SortOrder with this name, i.e. name, created,
+// modified, or count.
+func ParseSortOrder(s string) (SortOrder, error) {
+	switch s {
+	case "", "name":
+		return SortByName, nil
+	case "created":
+		return SortByCreated, nil
+	case "modified":
+		return SortByModified, nil
+	case "count":
+		return SortByCount, nil
+	default:
+		return SortByName, fmt.Errorf("invalid sort order %q, must be one of name, created, modified, count", s)
+	}
+}
+
+// String returns the name of the SortOrder.
+func (s SortOrder) String() string {
+	switch s {
+	case SortByName:
+		return "name"
+	case SortByCreated:
+		return "created"
+	case SortByModified:
+		return "modified"
+	case SortByCount:
+		return "count"
+	default:
+		return fmt.Sprintf("SortOrder(%d)", int(s))
+	}
+}
+
+// SortItems sorts items, which must already be in name order, e.g. as
+// returned by GlobFiles. Items with the same sort key stay in name order.
+func SortItems(items []ListItem, order SortOrder) {
+	var key func(ListItem) int64
+	switch order {
+	case SortByCreated:
+		key = func(i ListItem) int64 {
+			if i.IsDir {
+				if i.Album == nil {
+					return 0
+				}
+				v, _ := i.Album.DateCreated.Int64()
+				return v
+			}
+			v, _ := i.FSFile.DateCreated.Int64()
+			return v
+		}
+	case SortByModified:
+		key = func(i ListItem) int64 {
+			if i.IsDir {
+				if i.Album == nil {
+					return 0
+				}
+				v, _ := i.Album.DateModified.Int64()
+				return v
+			}
+			v, _ := i.FSFile.DateModified.Int64()
+			return v
+		}
+	case SortByCount:
+		key = func(i ListItem) int64 {
+			if !i.IsDir {
+				return 0
+			}
+			return int64(i.DirSize)
+		}
+	default:
+		return
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return key(items[i]) > key(items[j])
+	})
+}
+
 type node struct {
-	name  string
-	local bool
-	dir   *dir
-	file  *file
+	name   string
+	local  bool
+	dir    *dir
+	file   *file
+	loaded bool // Whether the files in dir were inserted in children.
 
 	children map[string]*node
 }
@@ -94,26 +241,105 @@ type file struct {
 
 type glob struct {
 	elems []string
+	res   []*regexp.Regexp // The compiled elems, with MatchRegexp.
 	opt   GlobOptions
 }
 
-func (g *glob) matchFirstElem(n string) bool {
+// newGlob returns a glob for pattern. Invalid patterns are reported here,
+// before any file is looked at.
+func newGlob(pattern string, opt GlobOptions) (*glob, error) {
+	if filepath.Separator == '\\' {
+		pattern = strings.ReplaceAll(pattern, "\\", "/")
+	}
+	pattern = strings.TrimSuffix(pattern, "/")
+	g := &glob{opt: opt}
+	g.elems = strings.Split(pattern, "/")
+	switch opt.Match {
+	case MatchGlob:
+		// Sanity check the pattern.
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%s: %w", pattern, err)
+		}
+	case MatchSubstring:
+	case MatchRegexp:
+		g.res = make([]*regexp.Regexp, len(g.elems))
+		for i, e := range g.elems {
+			if g.exact(i) {
+				continue
+			}
+			re, err := regexp.Compile(e)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", pattern, err)
+			}
+			g.res[i] = re
+		}
+	default:
+		return nil, fmt.Errorf("%s: invalid match mode %v", pattern, opt.Match)
+	}
+	return g, nil
+}
+
+// exact returns true if element i of the glob is an exact name.
+func (g *glob) exact(i int) bool {
+	return g.opt.ExactMatch || (g.opt.ExactMatchExceptLast && i < len(g.elems)-1)
+}
+
+// next returns the glob for the children of the names that match the first
+// element.
+func (g *glob) next() *glob {
+	gg := &glob{opt: g.opt}
+	if len(g.elems) > 0 {
+		gg.elems = g.elems[1:]
+	}
+	if len(g.res) > 0 {
+		gg.res = g.res[1:]
+	}
+	return gg
+}
+
+func (g *glob) matchFirstElem(nn *node) bool {
+	n := nn.name
 	if len(g.elems) == 0 {
 		return g.opt.Recursive
 	}
 	if g.elems[0] == n {
 		return true
 	}
-	if !g.opt.MatchDot && !strings.HasPrefix(g.elems[0], ".") && strings.HasPrefix(n, ".") {
+	isTrash := nn.dir != nil && nn.dir.set == stingle.TrashSet
+	if !g.opt.MatchDot && !(isTrash && g.opt.IncludeTrash) && !strings.HasPrefix(g.elems[0], ".") && strings.HasPrefix(n, ".") {
+		return false
+	}
+	if !g.opt.MatchDot && !g.opt.IncludeHidden && nn.dir != nil && nn.dir.album != nil && nn.dir.album.IsHidden == "1" {
 		return false
 	}
-	if g.opt.ExactMatch || (g.opt.ExactMatchExceptLast && len(g.elems) > 1) {
+	if g.exact(0) {
 		return g.elems[0] == n
 	}
+	switch g.opt.Match {
+	case MatchSubstring:
+		return strings.Contains(n, g.elems[0])
+	case MatchRegexp:
+		return g.res[0].MatchString(n)
+	}
 	matched, _ := path.Match(g.elems[0], n)
 	return matched
 }
 
+// isLiteral returns true if the first element of the glob can only match a
+// name equal to itself.
+func (g *glob) isLiteral() bool {
+	if len(g.elems) == 0 {
+		return false
+	}
+	if g.exact(0) {
+		return true
+	}
+	if g.opt.Match != MatchGlob {
+		return false
+	}
+	return !strings.ContainsAny(g.elems[0], `*?[\`)
+}
+
 func newNode(name string) *node {
 	return &node{
 		name:     name,
@@ -206,6 +432,11 @@ func sanitize(s string) string {
 	}, s)
 }
 
+// IsCover returns true if the item is the cover of its album.
+func (i ListItem) IsCover() bool {
+	return !i.IsDir && i.Album != nil && i.Album.Cover != "" && i.Album.Cover == i.FSFile.File
+}
+
 // Header returns the decrypted Header.
 func (i ListItem) Header(sk *stingle.SecretKey) (*stingle.Header, error) {
 	if a := i.Album; a != nil {
@@ -286,15 +517,11 @@ func (c *Client) AlbumCover(i ListItem) (string, error) {
 // GlobFiles returns files that match the glob patterns.
 func (c *Client) GlobFiles(patterns []string, opt GlobOptions) ([]ListItem, error) {
 	var li []ListItem
-	for _, p := range patterns {
-		items, err := c.glob(p, opt)
-		if err != nil {
-			return nil, err
-		}
-		if len(items) == 0 && !opt.Quiet {
-			fmt.Fprintf(c.writer, "no match for: %s\n", p)
-		}
-		li = append(li, items...)
+	if err := c.IterateFiles(patterns, opt, func(item ListItem) error {
+		li = append(li, item)
+		return nil
+	}); err != nil {
+		return nil, err
 	}
 	sort.Slice(li, func(i, j int) bool {
 		if li[i].Filename == li[j].Filename {
@@ -308,104 +535,175 @@ func (c *Client) GlobFiles(patterns []string, opt GlobOptions) ([]ListItem, erro
 	return li, nil
 }
 
+// IterateFiles calls fn for each file that matches the glob patterns, as they
+// are found. The patterns are processed in order, and the matches of each
+// pattern are in name order. The files of a directory are only loaded, and
+// their headers decrypted, when the directory is reached. If fn returns an
+// error, the iteration stops and that error is returned.
+func (c *Client) IterateFiles(patterns []string, opt GlobOptions, fn func(ListItem) error) error {
+	globs := make([]*glob, len(patterns))
+	for i, p := range patterns {
+		g, err := newGlob(p, opt)
+		if err != nil {
+			return err
+		}
+		globs[i] = g
+	}
+	root, err := c.globTree()
+	if err != nil {
+		return err
+	}
+	for i, p := range patterns {
+		var count int
+		if err := c.globStep("", globs[i], root, func(item ListItem) error {
+			count++
+			return fn(item)
+		}); err != nil {
+			return err
+		}
+		if count == 0 && !opt.Quiet {
+			c.Infof("no match for: %s\n", p)
+		}
+	}
+	return nil
+}
+
+// ResolveNames returns the files and directories with exactly these names, as
+// shown by ListFiles with full paths, e.g. album/file.jpg. Names are never
+// interpreted as glob patterns. All the unknown names are reported in the
+// error.
+func (c *Client) ResolveNames(names []string) ([]ListItem, error) {
+	root, err := c.globTree()
+	if err != nil {
+		return nil, err
+	}
+	var li []ListItem
+	var unknown []string
+	for _, name := range names {
+		items, err := c.globInTree(root, strings.TrimSuffix(name, "/"), GlobOptions{ExactMatch: true, MatchDot: true})
+		if err != nil {
+			return nil, err
+		}
+		if len(items) == 0 {
+			unknown = append(unknown, name)
+		}
+		li = append(li, items...)
+	}
+	if unknown != nil {
+		return nil, fmt.Errorf("%w: %s", ErrFileNotFound, strings.Join(unknown, ", "))
+	}
+	return li, nil
+}
+
 // glob returns files that match the glob pattern.
 func (c *Client) glob(pattern string, opt GlobOptions) ([]ListItem, error) {
-	if filepath.Separator == '\\' {
-		pattern = strings.ReplaceAll(pattern, "\\", "/")
+	root, err := c.globTree()
+	if err != nil {
+		return nil, err
 	}
-	pattern = strings.TrimSuffix(pattern, "/")
-	// Sanity check the pattern.
-	if _, err := path.Match(pattern, ""); err != nil {
-		return nil, fmt.Errorf("%s: %w", pattern, err)
+	return c.globInTree(root, pattern, opt)
+}
+
+// globInTree returns the files in the tree that match the glob pattern. The
+// files of the directories that the pattern traverses are added to the tree
+// as needed, so the same tree can be used for multiple patterns.
+func (c *Client) globInTree(root *node, pattern string, opt GlobOptions) ([]ListItem, error) {
+	var out []ListItem
+	if err := c.iterateInTree(root, pattern, opt, func(item ListItem) error {
+		out = append(out, item)
+		return nil
+	}); err != nil {
+		return nil, err
 	}
-	g := &glob{opt: opt}
-	g.elems = strings.Split(pattern, "/")
+	return out, nil
+}
+
+// iterateInTree calls fn for each file in the tree that matches the glob
+// pattern.
+func (c *Client) iterateInTree(root *node, pattern string, opt GlobOptions, fn func(ListItem) error) error {
+	g, err := newGlob(pattern, opt)
+	if err != nil {
+		return err
+	}
+	return c.globStep("", g, root, fn)
+}
 
+// globTree returns a tree with the gallery, the trash, and the albums. The
+// files are not included.
+func (c *Client) globTree() (*node, error) {
 	root := newNode("")
 	root.insertDir("gallery", galleryFile, stingle.GallerySet, nil, false)
 	root.insertDir(".trash", trashFile, stingle.TrashSet, nil, false)
-	var al AlbumList
-	if err := c.storage.ReadDataFile(c.fileHash(albumList), &al); err != nil {
+	dirs, err := c.globDirs()
+	if err != nil {
 		return nil, fmt.Errorf("albumList: %w", err)
 	}
-	var albumIDs []string
-	for albumID := range al.Albums {
-		albumIDs = append(albumIDs, albumID)
-	}
-	sort.Strings(albumIDs)
-	for _, albumID := range albumIDs {
-		album := al.Albums[albumID]
-		local := al.RemoteAlbums[albumID] == nil
-		ask, err := c.SKForAlbum(album)
-		if err != nil {
-			log.Errorf("Unable to decrypt the secret key for %s: %v", albumID, err)
-			continue
-		}
-		md, err := stingle.DecryptAlbumMetadata(album.Metadata, ask)
-		ask.Wipe()
-		if err != nil {
-			log.Errorf("Unable to decrypt the metadata for %s: %v", albumID, err)
-			md = &stingle.AlbumMetadata{Name: "###ERR###"}
-		}
-		name := sanitize(md.Name)
-		if album.IsShared == "1" && album.IsOwner != "1" {
+	for _, d := range dirs {
+		name := sanitize(d.name)
+		if d.album.IsShared == "1" && d.album.IsOwner != "1" {
 			name = filepath.Join("shared", name)
 		}
-		root.insertDir(name, albumPrefix+album.AlbumID, stingle.AlbumSet, album, local)
+		root.insertDir(name, albumPrefix+d.album.AlbumID, stingle.AlbumSet, d.album, d.local)
 	}
+	return root, nil
+}
 
-	var out []ListItem
-	if err := c.globStep("", g, root, &out); err != nil {
-		return nil, err
+// loadFiles inserts the files of n's directory in the tree, if they aren't
+// already there.
+func (c *Client) loadFiles(n *node) error {
+	if n.dir == nil || n.loaded {
+		return nil
 	}
-	return out, nil
+	files, err := c.globFiles(n.dir.fileSet, n.dir.album)
+	if err != nil {
+		log.Errorf("ReadDataFile: %v", err)
+		return err
+	}
+	for _, f := range files {
+		n.insertFile(sanitize(f.name), f.size, f.f, n.dir.fileSet, n.dir.set, n.dir.album, f.local)
+	}
+	n.loaded = true
+	return nil
+}
+
+// dirSize returns the number of items in n's directory. When the files aren't
+// in the tree yet, they are counted without decrypting their headers.
+func (c *Client) dirSize(n *node) (int, error) {
+	if n.loaded {
+		return len(n.children), nil
+	}
+	count, err := c.fileCount(n.dir.fileSet)
+	if err != nil {
+		log.Errorf("ReadDataFile: %v", err)
+		return 0, err
+	}
+	return len(n.children) + count, nil
 }
 
-func (c *Client) globStep(parent string, g *glob, n *node, li *[]ListItem) error {
-	if n.dir != nil {
-		var fs FileSet
-		if err := c.storage.ReadDataFile(c.fileHash(n.dir.fileSet), &fs); err != nil {
-			log.Errorf("ReadDataFile: %v", err)
+func (c *Client) globStep(parent string, g *glob, n *node, emit func(ListItem) error) error {
+	if len(g.elems) > 0 || g.opt.Recursive {
+		if err := c.loadFiles(n); err != nil {
 			return err
 		}
-		var files []string
-		for file := range fs.Files {
-			files = append(files, file)
-		}
-		sort.Strings(files)
-		for _, file := range files {
-			f := fs.Files[file]
-			local := fs.RemoteFiles[f.File] == nil
-			sk, err := c.SKForAlbum(n.dir.album)
-			if err != nil {
-				log.Errorf("SKForAlbum: %v", err)
-				continue
-			}
-			hdrs, err := stingle.DecryptBase64Headers(f.Headers, sk)
-			sk.Wipe()
-			if err != nil {
-				log.Errorf("DecryptBase64Headers: %v", err)
-				continue
-			}
-			fn := sanitize(string(hdrs[0].Filename))
-			n.insertFile(fn, hdrs[0].DataSize, f, n.dir.fileSet, n.dir.set, n.dir.album, local)
-			hdrs[0].Wipe()
-			hdrs[1].Wipe()
-		}
 	}
 	if len(g.elems) == 0 {
+		var item ListItem
 		if n.dir != nil {
-			*li = append(*li, ListItem{
+			size, err := c.dirSize(n)
+			if err != nil {
+				return err
+			}
+			item = ListItem{
 				Filename:  filepath.Join(parent, n.name),
 				FileSet:   n.dir.fileSet,
 				IsDir:     true,
-				DirSize:   len(n.children),
+				DirSize:   size,
 				Set:       n.dir.set,
 				Album:     n.dir.album,
 				LocalOnly: n.local,
-			})
+			}
 		} else if n.file != nil {
-			*li = append(*li, ListItem{
+			item = ListItem{
 				Filename:  filepath.Join(parent, n.name),
 				Size:      n.file.size,
 				FilePath:  c.blobPath(n.file.f.File, false),
@@ -415,26 +713,37 @@ func (c *Client) globStep(parent string, g *glob, n *node, li *[]ListItem) error
 				Set:       n.file.set,
 				Album:     n.file.album,
 				LocalOnly: n.local,
-			})
+			}
 		} else {
-			*li = append(*li, ListItem{
+			item = ListItem{
 				Filename:  filepath.Join(parent, n.name),
 				IsDir:     true,
 				LocalOnly: true,
-			})
+			}
+		}
+		if err := emit(item); err != nil {
+			return err
 		}
 		if !g.opt.Recursive {
 			return nil
 		}
 	}
 
-	gg := &glob{opt: g.opt}
-	if len(g.elems) > 0 {
-		gg.elems = g.elems[1:]
+	gg := g.next()
+	if g.isLiteral() {
+		if child, ok := n.children[g.elems[0]]; ok {
+			return c.globStep(filepath.Join(parent, n.name), gg, child, emit)
+		}
+		return nil
 	}
-	for _, child := range n.children {
-		if g.matchFirstElem(child.name) {
-			if err := c.globStep(filepath.Join(parent, n.name), gg, child, li); err != nil {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if child := n.children[name]; g.matchFirstElem(child) {
+			if err := c.globStep(filepath.Join(parent, n.name), gg, child, emit); err != nil {
 				return err
 			}
 		}
@@ -446,37 +755,32 @@ func addSlash(filename string) string {
 	return fmt.Sprintf("%s%c", filename, filepath.Separator)
 }
 
+// ListFiles shows the files that match the glob patterns. The files are shown
+// as they are found, except in long format where the column widths depend on
+// all the matches.
 func (c *Client) ListFiles(patterns []string, opt GlobOptions) error {
 	for i, p := range patterns {
 		if p == "" {
-			p = "*"
+			if opt.Match == MatchGlob {
+				p = "*"
+			}
 			opt.Directory = true
 			patterns[i] = p
 		}
 	}
-	li, err := c.GlobFiles(patterns, opt)
-	if err != nil {
-		return err
-	}
-	maxFilenameWidth, maxSizeWidth := 0, 0
-	for _, item := range li {
-		fn := strings.TrimPrefix(addSlash(item.Filename), opt.trimPrefix)
-		if len(fn) > maxFilenameWidth {
-			maxFilenameWidth = len(fn)
-		}
-		w := len(fmt.Sprintf("%d", item.Size))
-		if w > maxSizeWidth {
-			maxSizeWidth = w
-		}
-	}
 	var cl ContactList
 	if err := c.storage.ReadDataFile(c.fileHash(contactsFile), &cl); err != nil {
 		return err
 	}
+	pl, err := c.Pins()
+	if err != nil {
+		return err
+	}
 
 	var expand []string
 	fileCount := 0
-	for _, item := range li {
+	maxFilenameWidth, maxSizeWidth := 0, 0
+	show := func(item ListItem) error {
 		if item.IsDir {
 			if !opt.Directory && !opt.Recursive {
 				expand = append(expand, item.Filename)
@@ -513,9 +817,12 @@ func (c *Client) ListFiles(patterns []string, opt GlobOptions) error {
 				if item.LocalOnly {
 					s += ", Local"
 				}
+				if pl.IsPinned(item) {
+					s += ", Pinned"
+				}
 				c.Print(s)
 			}
-			continue
+			return nil
 		}
 		fileCount++
 		sk := c.SecretKey()
@@ -528,7 +835,7 @@ func (c *Client) ListFiles(patterns []string, opt GlobOptions) error {
 		if !opt.Long {
 			c.Print(strings.TrimPrefix(item.Filename, opt.trimPrefix))
 			hdr.Wipe()
-			continue
+			return nil
 		}
 		duration := ""
 		if hdr.FileType == stingle.FileTypeVideo {
@@ -550,18 +857,57 @@ func (c *Client) ListFiles(patterns []string, opt GlobOptions) error {
 		if item.LocalOnly {
 			local = " Local"
 		}
+		if pl.IsPinned(item) {
+			local += " Pinned"
+		}
+		if item.IsCover() {
+			local += " Cover"
+		}
 		ms, _ := item.FSFile.DateCreated.Int64()
 		c.Printf("%*s %*d %s %s%s%s%s\n", -maxFilenameWidth,
 			strings.TrimPrefix(item.Filename, opt.trimPrefix), maxSizeWidth, item.Size,
 			time.Unix(ms/1000, 0).Format("2006-01-02 15:04:05"), stingle.FileType(hdr.FileType),
 			exifData, duration, local)
 		hdr.Wipe()
+		return nil
+	}
+	if !opt.Long && opt.Sort == SortByName {
+		if err := c.IterateFiles(patterns, opt, show); err != nil {
+			return err
+		}
+	} else {
+		var li []ListItem
+		if err := c.IterateFiles(patterns, opt, func(item ListItem) error {
+			li = append(li, item)
+			return nil
+		}); err != nil {
+			return err
+		}
+		SortItems(li, opt.Sort)
+		for _, item := range li {
+			fn := strings.TrimPrefix(addSlash(item.Filename), opt.trimPrefix)
+			if len(fn) > maxFilenameWidth {
+				maxFilenameWidth = len(fn)
+			}
+			w := len(fmt.Sprintf("%d", item.Size))
+			if w > maxSizeWidth {
+				maxSizeWidth = w
+			}
+		}
+		for _, item := range li {
+			if err := show(item); err != nil {
+				return err
+			}
+		}
 	}
 	if fileCount > 0 && len(expand) > 0 {
 		c.Print()
 	}
 	opt.Quiet = true
 	opt.Directory = true
+	// The directory names are exact, whatever the match mode.
+	opt.Match = MatchGlob
+	opt.ExactMatchExceptLast = true
 	for i, d := range expand {
 		if i > 0 {
 			c.Print()
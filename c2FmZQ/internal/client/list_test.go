@@ -19,10 +19,14 @@ package client_test
 
 import (
 	"bytes"
+	"errors"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"c2FmZQ/internal/client"
 )
@@ -132,3 +136,228 @@ func TestList(t *testing.T) {
 		}
 	}
 }
+
+func TestResolveNames(t *testing.T) {
+	c, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 3); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if err := os.Rename(filepath.Join(testdir, "image002.jpg"), filepath.Join(testdir, "[x]*.jpg")); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if err := c.AddAlbums([]string{"album"}); err != nil {
+		t.Fatalf("AddAlbums: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "*")}, "album", false); err != nil {
+		t.Fatalf("ImportFiles: %v", err)
+	}
+
+	li, err := c.ResolveNames([]string{"album/", "album/[x]*.jpg", "album/image000.jpg"})
+	if err != nil {
+		t.Fatalf("ResolveNames: %v", err)
+	}
+	var got []string
+	for _, item := range li {
+		got = append(got, item.Filename)
+	}
+	if want := []string{"album", "album/[x]*.jpg", "album/image000.jpg"}; !reflect.DeepEqual(want, got) {
+		t.Errorf("Unexpected ResolveNames result. Want %v, got %v", want, got)
+	}
+
+	_, err = c.ResolveNames([]string{"album/image000.jpg", "album/image00?.jpg", "nope"})
+	if !errors.Is(err, client.ErrFileNotFound) {
+		t.Fatalf("ResolveNames: %v, want ErrFileNotFound", err)
+	}
+	if !strings.Contains(err.Error(), "album/image00?.jpg, nope") {
+		t.Errorf("Unknown names not reported: %v", err)
+	}
+}
+
+func TestIterateFiles(t *testing.T) {
+	c, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 3); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if err := c.AddAlbums([]string{"album"}); err != nil {
+		t.Fatalf("AddAlbums: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "*")}, "album", false); err != nil {
+		t.Fatalf("ImportFiles: %v", err)
+	}
+
+	var got []string
+	if err := c.IterateFiles([]string{"album/*", "album"}, client.GlobOptions{}, func(item client.ListItem) error {
+		got = append(got, item.Filename)
+		return nil
+	}); err != nil {
+		t.Fatalf("IterateFiles: %v", err)
+	}
+	if want := []string{"album/image000.jpg", "album/image001.jpg", "album/image002.jpg", "album"}; !reflect.DeepEqual(want, got) {
+		t.Errorf("Unexpected IterateFiles result. Want %v, got %v", want, got)
+	}
+
+	errStop := errors.New("stop")
+	got = nil
+	err = c.IterateFiles([]string{"album/*"}, client.GlobOptions{}, func(item client.ListItem) error {
+		got = append(got, item.Filename)
+		if len(got) == 2 {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop {
+		t.Errorf("IterateFiles returned %v, want %v", err, errStop)
+	}
+	if want := []string{"album/image000.jpg", "album/image001.jpg"}; !reflect.DeepEqual(want, got) {
+		t.Errorf("Unexpected IterateFiles result. Want %v, got %v", want, got)
+	}
+}
+
+func TestMatchModes(t *testing.T) {
+	c, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 3); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if err := os.Rename(filepath.Join(testdir, "image002.jpg"), filepath.Join(testdir, "[x]*.jpg")); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if err := c.AddAlbums([]string{"album"}); err != nil {
+		t.Fatalf("AddAlbums: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "*")}, "album", false); err != nil {
+		t.Fatalf("ImportFiles: %v", err)
+	}
+
+	testcases := []struct {
+		pattern string
+		mode    client.MatchMode
+		want    []string
+	}{
+		{"album/image00?.jpg", client.MatchGlob, []string{"album/image000.jpg", "album/image001.jpg"}},
+		{"album/001", client.MatchGlob, nil},
+		{"album/001", client.MatchSubstring, []string{"album/image001.jpg"}},
+		{"alb/*", client.MatchSubstring, []string{"album/[x]*.jpg"}},
+		{"album/jpg", client.MatchSubstring, []string{"album/[x]*.jpg", "album/image000.jpg", "album/image001.jpg"}},
+		{"album/^image00[02]", client.MatchRegexp, []string{"album/image000.jpg"}},
+		{"^al/\\*", client.MatchRegexp, []string{"album/[x]*.jpg"}},
+	}
+	for _, tc := range testcases {
+		li, err := c.GlobFiles([]string{tc.pattern}, client.GlobOptions{Match: tc.mode, Quiet: true})
+		if err != nil {
+			t.Errorf("GlobFiles(%q, %v): %v", tc.pattern, tc.mode, err)
+			continue
+		}
+		var got []string
+		for _, item := range li {
+			got = append(got, item.Filename)
+		}
+		if !reflect.DeepEqual(tc.want, got) {
+			t.Errorf("GlobFiles(%q, %v) = %v, want %v", tc.pattern, tc.mode, got, tc.want)
+		}
+	}
+
+	if _, err := c.GlobFiles([]string{"album/image(", "album"}, client.GlobOptions{Match: client.MatchRegexp}); err == nil {
+		t.Error("GlobFiles with invalid regexp didn't fail")
+	}
+
+	var buf bytes.Buffer
+	c.SetWriter(&buf)
+	if err := c.ListFiles([]string{"bum"}, client.GlobOptions{Match: client.MatchSubstring}); err != nil {
+		t.Fatalf("ListFiles: %v", err)
+	}
+	if want, got := "album:\n[x]*.jpg\nimage000.jpg\nimage001.jpg\n", buf.String(); want != got {
+		t.Errorf("Unexpected ListFiles output. Want %q, got %q", want, got)
+	}
+	buf.Reset()
+	if err := c.ListFiles([]string{""}, client.GlobOptions{Match: client.MatchSubstring}); err != nil {
+		t.Fatalf("ListFiles: %v", err)
+	}
+	if want, got := "album/\ngallery/\n", buf.String(); want != got {
+		t.Errorf("Unexpected ListFiles output. Want %q, got %q", want, got)
+	}
+}
+
+func TestListSort(t *testing.T) {
+	c, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 6); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	for _, a := range []struct {
+		name  string
+		files []string
+	}{
+		{"a", []string{"image000.jpg"}},
+		{"b", []string{"image001.jpg", "image002.jpg", "image003.jpg"}},
+		{"c", []string{"image004.jpg", "image005.jpg"}},
+	} {
+		if err := c.AddAlbums([]string{a.name}); err != nil {
+			t.Fatalf("AddAlbums: %v", err)
+		}
+		for _, f := range a.files {
+			if _, err := c.ImportFiles([]string{filepath.Join(testdir, f)}, a.name, false); err != nil {
+				t.Fatalf("ImportFiles: %v", err)
+			}
+		}
+		// The albums must have different creation times.
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	var buf bytes.Buffer
+	c.SetWriter(&buf)
+	for _, tc := range []struct {
+		order client.SortOrder
+		want  string
+	}{
+		{client.SortByName, "a/ b/ c/"},
+		{client.SortByCreated, "c/ b/ a/"},
+		{client.SortByCount, "b/ c/ a/"},
+	} {
+		buf.Reset()
+		if err := c.ListFiles([]string{"?"}, client.GlobOptions{Directory: true, Sort: tc.order}); err != nil {
+			t.Fatalf("ListFiles: %v", err)
+		}
+		if got := strings.Join(strings.Fields(buf.String()), " "); got != tc.want {
+			t.Errorf("ListFiles(sort=%v) = %q, want %q", tc.order, got, tc.want)
+		}
+	}
+	if _, err := client.ParseSortOrder("size"); err == nil {
+		t.Error("ParseSortOrder(size) didn't fail")
+	}
+
+	li, err := c.GlobFiles([]string{"b/image002.jpg"}, client.GlobOptions{})
+	if err != nil || len(li) != 1 {
+		t.Fatalf("GlobFiles: %v, %v", li, err)
+	}
+	if err := c.SetAlbumCover(li[0].Album.AlbumID, li[0].FSFile.File); err != nil {
+		t.Fatalf("SetAlbumCover: %v", err)
+	}
+	buf.Reset()
+	if err := c.ListFiles([]string{"b/*"}, client.GlobOptions{Long: true}); err != nil {
+		t.Fatalf("ListFiles: %v", err)
+	}
+	var covers []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasSuffix(line, " Cover") {
+			covers = append(covers, strings.Fields(line)[0])
+		}
+	}
+	if want := []string{"b/image002.jpg"}; !reflect.DeepEqual(covers, want) {
+		t.Errorf("Unexpected covers. Want %v, got %v\n%s", want, covers, buf.String())
+	}
+}
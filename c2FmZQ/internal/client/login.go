@@ -44,6 +44,13 @@ const (
 
 // CreateAccount creates a new account on the remote server.
 func (c *Client) CreateAccount(server, email, password string, doBackup bool) error {
+	return c.CreateAccountWithInviteCode(server, email, password, "", doBackup)
+}
+
+// CreateAccountWithInviteCode creates a new account on the remote server with
+// an invite code. The code is required by servers that restrict account
+// creation, and ignored by the others.
+func (c *Client) CreateAccountWithInviteCode(server, email, password, inviteCode string, doBackup bool) error {
 	salt := make([]byte, 16)
 	if _, err := rand.Read(salt); err != nil {
 		return err
@@ -64,13 +71,16 @@ func (c *Client) CreateAccount(server, email, password string, doBackup bool) er
 	if doBackup {
 		form.Set("isBackup", "1")
 	}
+	if inviteCode != "" {
+		form.Set("inviteCode", inviteCode)
+	}
 
 	sr, err := c.sendRequest("/v2/register/createAccount", form, server)
 	if err != nil {
 		return err
 	}
 	if sr.Status != "ok" {
-		return sr
+		return &ServerError{sr}
 	}
 
 	c.Account = &AccountInfo{
@@ -86,7 +96,7 @@ func (c *Client) CreateAccount(server, email, password string, doBackup bool) er
 	if err := c.Save(); err != nil {
 		return err
 	}
-	c.Print("Account created successfully.")
+	c.Info("Account created successfully.")
 	if !doBackup {
 		c.Print(backupWarning)
 	}
@@ -96,7 +106,7 @@ func (c *Client) CreateAccount(server, email, password string, doBackup bool) er
 	if err := c.Save(); err != nil {
 		return err
 	}
-	c.Print("Logged in successfully.")
+	c.Info("Logged in successfully.")
 	return nil
 }
 
@@ -129,7 +139,7 @@ func (c *Client) Login(server, email, password string) error {
 		return err
 	}
 	if sr.Status != "ok" {
-		return sr
+		return &ServerError{sr}
 	}
 	eSalt, ok := sr.Part("salt").(string)
 	if !ok {
@@ -179,10 +189,103 @@ func (c *Client) Login(server, email, password string) error {
 	if err := c.Save(); err != nil {
 		return err
 	}
-	c.Print("Logged in successfully.")
+	c.Info("Logged in successfully.")
+	return nil
+}
+
+// SetServerURL changes the URL of the server used by the current account. The
+// new server must be reachable, it must know the account's public key, and its
+// own public key must be the one that was pinned for the account.
+func (c *Client) SetServerURL(serverURL string) error {
+	if c.Account == nil {
+		return ErrNotLoggedIn
+	}
+	if c.loginOverride {
+		return errors.New("the server URL comes from the token file")
+	}
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid server URL: %q", serverURL)
+	}
+	serverURL = strings.TrimSuffix(u.String(), "/")
+
+	form := url.Values{}
+	form.Set("email", c.Account.Email)
+	sr, err := c.sendRequest("/v2/login/checkKey", form, serverURL)
+	if err != nil {
+		return fmt.Errorf("%s: %w", serverURL, err)
+	}
+	if sr.Status != "ok" {
+		return &ServerError{sr}
+	}
+	challenge, ok := sr.Part("challenge").(string)
+	if !ok {
+		return errors.New("invalid challenge")
+	}
+	sk := c.SecretKey()
+	defer sk.Wipe()
+	if dec, err := sk.SealBoxOpenBase64(challenge); err != nil || !bytes.HasPrefix(dec, []byte("validkey_")) {
+		return fmt.Errorf("%s doesn't have the account %s", serverURL, c.Account.Email)
+	}
+	spk, ok := sr.Part("serverPK").(string)
+	if !ok {
+		return fmt.Errorf("serverPK has unexpected type: %T", sr.Part("serverPK"))
+	}
+	b, err := base64.StdEncoding.DecodeString(spk)
+	if err != nil {
+		return err
+	}
+	pk := stingle.PublicKeyFromBytes(b)
+	if err := c.pinServerKey(serverURL, c.Account.Email, pk); err != nil {
+		return err
+	}
+
+	c.Account.ServerBaseURL = serverURL
+	c.Account.ServerPublicKey = pk
+	if err := c.Save(); err != nil {
+		return err
+	}
+	c.Infof("Server set to %s.\n", serverURL)
 	return nil
 }
 
+// SetAcceptNewServerKey sets whether a server public key that is different
+// from the pinned one is accepted, and pinned instead.
+func (c *Client) SetAcceptNewServerKey(accept bool) {
+	c.acceptNewServerKey = accept
+}
+
+// pinServerKey verifies that pk is the public key that was pinned for the
+// server and email address, or pins it if there is none. When there is no
+// pinned key, the current account's server key is used for the same email
+// address, e.g. when the server URL changes.
+func (c *Client) pinServerKey(server, email string, pk stingle.PublicKey) error {
+	id := serverKeyID(server, email)
+	pinned, ok := c.ServerKeys[id]
+	if !ok && c.Account != nil && c.Account.Email == email && c.Account.ServerPublicKey != (stingle.PublicKey{}) {
+		pinned, ok = c.Account.ServerPublicKey, true
+	}
+	if ok && pinned != pk {
+		c.Printf("WARNING: The public key of %s for %s is not the one that was used before. This may not be the right server, or someone may be intercepting the connection.\n", server, email)
+		if !c.acceptNewServerKey {
+			return ErrServerKeyChanged
+		}
+		c.Printf("Accepting the new public key of %s.\n", server)
+	}
+	if c.ServerKeys == nil {
+		c.ServerKeys = make(map[string]stingle.PublicKey)
+	}
+	c.ServerKeys[id] = pk
+	return nil
+}
+
+func serverKeyID(server, email string) string {
+	return strings.TrimSuffix(server, "/") + " " + email
+}
+
 func (c *Client) sendLogin(email, hashedPassword string) (*stingle.Response, error) {
 	form := url.Values{}
 	form.Set("email", email)
@@ -192,7 +295,7 @@ func (c *Client) sendLogin(email, hashedPassword string) (*stingle.Response, err
 		return nil, err
 	}
 	if sr.Status != "ok" {
-		return nil, sr
+		return nil, &ServerError{sr}
 	}
 	userID, ok := sr.Part("userId").(string)
 	if !ok {
@@ -214,6 +317,9 @@ func (c *Client) sendLogin(email, hashedPassword string) (*stingle.Response, err
 	if !ok || token == "" {
 		return nil, fmt.Errorf("login: invalid token: %#v", sr.Part("token"))
 	}
+	if err := c.pinServerKey(c.Account.ServerBaseURL, email, stingle.PublicKeyFromBytes(pk)); err != nil {
+		return nil, err
+	}
 
 	c.Account.Email = email
 	c.Account.HashedPassword = hashedPassword
@@ -236,13 +342,13 @@ func (c *Client) Logout() error {
 		return err
 	}
 	if sr.Status != "ok" {
-		return sr
+		return &ServerError{sr}
 	}
 	c.Account = nil
 	if err := c.Save(); err != nil {
 		return err
 	}
-	c.Print("Logged out successfully.")
+	c.Info("Logged out successfully.")
 	return nil
 }
 
@@ -286,7 +392,7 @@ func (c *Client) ChangePassword(password, newPassword string, doBackup bool) err
 		return err
 	}
 	if sr.Status != "ok" {
-		return sr
+		return &ServerError{sr}
 	}
 	tok, ok := sr.Part("token").(string)
 	if !ok || tok == "" {
@@ -302,7 +408,7 @@ func (c *Client) ChangePassword(password, newPassword string, doBackup bool) err
 	if err := c.Save(); err != nil {
 		return err
 	}
-	c.Print("Password changed successfully.")
+	c.Info("Password changed successfully.")
 	if !doBackup {
 		c.Print(backupWarning)
 	}
@@ -344,7 +450,7 @@ func (c *Client) RecoverAccount(server, email, newPassword, backupPhrase string,
 		return err
 	}
 	if sr.Status != "ok" {
-		return sr
+		return &ServerError{sr}
 	}
 	if sr.Part("result") != "OK" {
 		return errors.New("result not OK")
@@ -361,7 +467,7 @@ func (c *Client) RecoverAccount(server, email, newPassword, backupPhrase string,
 	if err := c.Save(); err != nil {
 		return err
 	}
-	c.Print("Account recovered successfully.")
+	c.Info("Account recovered successfully.")
 
 	if _, err := c.sendLogin(email, pw); err != nil {
 		return err
@@ -369,7 +475,7 @@ func (c *Client) RecoverAccount(server, email, newPassword, backupPhrase string,
 	if err := c.Save(); err != nil {
 		return err
 	}
-	c.Print("Logged in successfully.")
+	c.Info("Logged in successfully.")
 	if !doBackup {
 		c.Print(backupWarning)
 	}
@@ -393,8 +499,9 @@ func (c *Client) DeleteAccount(password string) error {
 		return err
 	}
 	if sr.Status != "ok" {
-		return sr
+		return &ServerError{sr}
 	}
+	delete(c.ServerKeys, serverKeyID(c.Account.ServerBaseURL, c.Account.Email))
 	if err := c.WipeAccount(password); err != nil {
 		return err
 	}
@@ -402,7 +509,7 @@ func (c *Client) DeleteAccount(password string) error {
 	if err := c.Save(); err != nil {
 		return err
 	}
-	c.Print("Account deleted successfully.")
+	c.Info("Account deleted successfully.")
 	return nil
 }
 
@@ -431,15 +538,15 @@ func (c *Client) UploadKeys(password string, doBackup bool) error {
 		return err
 	}
 	if sr.Status != "ok" {
-		return sr
+		return &ServerError{sr}
 	}
 	if err := c.Save(); err != nil {
 		return err
 	}
 	if doBackup {
-		c.Print("Secret key backup enabled.")
+		c.Info("Secret key backup enabled.")
 	} else {
-		c.Print("Secret key backup disabled.")
+		c.Info("Secret key backup disabled.")
 		c.Print(backupWarning)
 	}
 	return nil
@@ -453,7 +560,7 @@ func (c *Client) checkKey(server, email string, sk *stingle.SecretKey) error {
 		return err
 	}
 	if sr.Status != "ok" {
-		return sr
+		return &ServerError{sr}
 	}
 	challenge, ok := sr.Part("challenge").(string)
 	if !ok {
@@ -0,0 +1,138 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"c2FmZQ/internal/stingle"
+)
+
+// FileMetadata is the decrypted metadata of a file, as written by
+// ExportMetadata.
+type FileMetadata struct {
+	Name          string `json:"name"`
+	Album         string `json:"album"`
+	OriginalName  string `json:"originalName"`
+	Type          string `json:"type"`
+	Size          int64  `json:"size"`
+	DateCreated   string `json:"dateCreated"`
+	DateModified  string `json:"dateModified"`
+	VideoDuration int32  `json:"videoDuration,omitempty"`
+	LocalOnly     bool   `json:"localOnly"`
+}
+
+// ExportMetadata writes a JSON document with the metadata of the files that
+// match patterns to out. Only the file headers are decrypted, not the file
+// content. Returns the number of files exported.
+func (c *Client) ExportMetadata(patterns []string, out string, opt GlobOptions) (int, error) {
+	li, err := c.GlobFiles(patterns, opt)
+	if err != nil {
+		return 0, err
+	}
+	files := []FileMetadata{}
+	for _, item := range li {
+		if item.IsDir {
+			continue
+		}
+		md, err := c.fileMetadata(item)
+		if err != nil {
+			return 0, err
+		}
+		files = append(files, md)
+	}
+	err = c.writeAtomically(out, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Files []FileMetadata `json:"files"`
+		}{files})
+	})
+	if err != nil {
+		return 0, err
+	}
+	c.Infof("Exported the metadata of %d file(s) to %s\n", len(files), out)
+	return len(files), nil
+}
+
+// IndexRecord is the information written by StreamIndex for each file.
+type IndexRecord struct {
+	FileMetadata
+	// FileID identifies the file's content. A file that is in more than
+	// one album has one record per album, all with the same FileID.
+	FileID string `json:"fileId"`
+	// Downloaded indicates that the file's content is stored locally.
+	Downloaded bool `json:"downloaded"`
+}
+
+// StreamIndex writes the metadata of all the files, including the trash, to
+// w as newline-delimited JSON, one IndexRecord per line. The records are
+// written as the files are found, so that memory use doesn't depend on the
+// size of the output. Returns the number of records written.
+func (c *Client) StreamIndex(w io.Writer) (int, error) {
+	enc := json.NewEncoder(w)
+	var count int
+	err := c.IterateFiles([]string{"*"}, GlobOptions{Recursive: true, MatchDot: true, Quiet: true}, func(item ListItem) error {
+		if item.IsDir {
+			return nil
+		}
+		md, err := c.fileMetadata(item)
+		if err != nil {
+			return err
+		}
+		_, statErr := os.Stat(item.FilePath)
+		if err := enc.Encode(IndexRecord{
+			FileMetadata: md,
+			FileID:       item.FSFile.File,
+			Downloaded:   statErr == nil,
+		}); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// fileMetadata returns the decrypted metadata of item.
+func (c *Client) fileMetadata(item ListItem) (FileMetadata, error) {
+	sk := c.SecretKey()
+	hdr, err := item.Header(sk)
+	sk.Wipe()
+	if err != nil {
+		return FileMetadata{}, err
+	}
+	defer hdr.Wipe()
+	created, _ := item.FSFile.DateCreated.Int64()
+	modified, _ := item.FSFile.DateModified.Int64()
+	return FileMetadata{
+		Name:          item.Filename,
+		Album:         filepath.Dir(item.Filename),
+		OriginalName:  sanitize(string(hdr.Filename)),
+		Type:          stingle.FileType(hdr.FileType),
+		Size:          hdr.DataSize,
+		DateCreated:   time.UnixMilli(created).UTC().Format(time.RFC3339),
+		DateModified:  time.UnixMilli(modified).UTC().Format(time.RFC3339),
+		VideoDuration: hdr.VideoDuration,
+		LocalOnly:     item.LocalOnly,
+	}, nil
+}
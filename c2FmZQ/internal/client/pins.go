@@ -0,0 +1,121 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// PinList contains the files and albums that are pinned. Pinned files are
+// never freed or evicted from the local cache, and they can't be deleted
+// unless forced.
+type PinList struct {
+	// The pinned files, keyed by stingle.File.File.
+	Files map[string]bool `json:"files"`
+	// The pinned albums, keyed by album ID. All the files in a pinned album
+	// are pinned.
+	Albums map[string]bool `json:"albums"`
+}
+
+// IsPinned returns true if item, or the album that contains it, is pinned.
+func (p *PinList) IsPinned(item ListItem) bool {
+	if item.Album != nil && p.Albums[item.Album.AlbumID] {
+		return true
+	}
+	return !item.IsDir && p.Files[item.FSFile.File]
+}
+
+// Pins returns the list of pinned files and albums.
+func (c *Client) Pins() (*PinList, error) {
+	var pl PinList
+	if err := c.storage.ReadDataFile(c.fileHash(pinsFile), &pl); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return &pl, nil
+}
+
+// Pin pins or unpins the files and directories (albums) matching patterns.
+// Returns the number of items that changed.
+func (c *Client) Pin(patterns []string, opt GlobOptions, pinned bool) (n int, retErr error) {
+	li, err := c.GlobFiles(patterns, opt)
+	if err != nil {
+		return 0, err
+	}
+	// The pins don't affect glob. Bypass the cache invalidation.
+	fn := c.fileHash(pinsFile)
+	c.storage.Storage.CreateEmptyFile(fn, &PinList{})
+	var pl PinList
+	commit, err := c.storage.Storage.OpenForUpdate(fn, &pl)
+	if err != nil {
+		return 0, err
+	}
+	defer commit(false, &retErr)
+	if pl.Files == nil {
+		pl.Files = make(map[string]bool)
+	}
+	if pl.Albums == nil {
+		pl.Albums = make(map[string]bool)
+	}
+	for _, item := range li {
+		m, key := pl.Files, item.FSFile.File
+		if item.IsDir {
+			if item.Album == nil {
+				c.Infof("Skipped %s (not an album)\n", item.Filename)
+				continue
+			}
+			m, key = pl.Albums, item.Album.AlbumID
+		}
+		if m[key] == pinned {
+			continue
+		}
+		if pinned {
+			m[key] = true
+		} else {
+			delete(m, key)
+		}
+		n++
+	}
+	if err := commit(true, nil); err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	verb := "Pinned"
+	if !pinned {
+		verb = "Unpinned"
+	}
+	c.Infof("%s %d item(s).\n", verb, n)
+	return n, nil
+}
+
+// checkNotPinned returns an error if any of the items is pinned.
+func (c *Client) checkNotPinned(li []ListItem) error {
+	pl, err := c.Pins()
+	if err != nil {
+		return err
+	}
+	for _, item := range li {
+		if pl.IsPinned(item) {
+			return fmt.Errorf("%w: %s is pinned", ErrPermissionDenied, item.Filename)
+		}
+	}
+	return nil
+}
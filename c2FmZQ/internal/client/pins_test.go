@@ -0,0 +1,120 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"c2FmZQ/internal/client"
+)
+
+func TestPins(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 3); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "*")}, "album", true); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+	list, err := c.GlobFiles([]string{"album/*"}, client.GlobOptions{})
+	if err != nil || len(list) != 3 {
+		t.Fatalf("c.GlobFiles: %d, %v", len(list), err)
+	}
+	isLocal := func(item client.ListItem) bool {
+		_, err := os.Stat(item.FilePath)
+		return err == nil
+	}
+
+	if n, err := c.Pin([]string{"album/image000.jpg"}, client.GlobOptions{}, true); err != nil || n != 1 {
+		t.Fatalf("c.Pin: %d, %v", n, err)
+	}
+	if n, err := c.Pin([]string{"album/image000.jpg"}, client.GlobOptions{}, true); err != nil || n != 0 {
+		t.Fatalf("c.Pin again: %d, %v", n, err)
+	}
+	if n, err := c.Free([]string{"album"}, client.GlobOptions{Recursive: true}, false); err != nil {
+		t.Fatalf("c.Free: %v", err)
+	} else if want, got := 2, n; want != got {
+		t.Errorf("Unexpected Free result. Want %d, got %d", want, got)
+	}
+	for i, item := range list {
+		if want, got := i == 0, isLocal(item); want != got {
+			t.Errorf("%s: local = %v, want %v", item.Filename, got, want)
+		}
+	}
+	if err := c.Delete([]string{"album/image000.jpg"}, false, false); !errors.Is(err, client.ErrPermissionDenied) {
+		t.Errorf("c.Delete(pinned) = %v, want ErrPermissionDenied", err)
+	}
+
+	// Pinning the album pins all its files, including against the cache
+	// limit.
+	if n, err := c.Pin([]string{"album"}, client.GlobOptions{}, true); err != nil || n != 1 {
+		t.Fatalf("c.Pin(album): %d, %v", n, err)
+	}
+	if _, err := c.Pull([]string{"album"}, client.GlobOptions{Recursive: true}); err != nil {
+		t.Fatalf("c.Pull: %v", err)
+	}
+	if err := c.SetCacheLimit(1); err != nil {
+		t.Fatalf("c.SetCacheLimit: %v", err)
+	}
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+	pl, err := c.Pins()
+	if err != nil {
+		t.Fatalf("c.Pins: %v", err)
+	}
+	for _, item := range list {
+		if !isLocal(item) {
+			t.Errorf("%s was freed", item.Filename)
+		}
+		if !pl.IsPinned(item) {
+			t.Errorf("%s isn't pinned", item.Filename)
+		}
+	}
+	if err := c.Delete([]string{"album"}, false, false); !errors.Is(err, client.ErrPermissionDenied) {
+		t.Errorf("c.Delete(pinned album) = %v, want ErrPermissionDenied", err)
+	}
+
+	// Unpinned files can be freed again.
+	if n, err := c.Pin([]string{"album", "album/*"}, client.GlobOptions{}, false); err != nil || n != 2 {
+		t.Fatalf("c.Pin(false): %d, %v", n, err)
+	}
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+	for _, item := range list {
+		if isLocal(item) {
+			t.Errorf("%s wasn't freed", item.Filename)
+		}
+	}
+	if err := c.Delete([]string{"album/image000.jpg"}, false, false); err != nil {
+		t.Errorf("c.Delete: %v", err)
+	}
+}
@@ -0,0 +1,179 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"encoding/json"
+
+	"c2FmZQ/internal/stingle"
+)
+
+// RawUpdatesOptions contains the options of RawUpdates.
+type RawUpdatesOptions struct {
+	// The pagination cursor returned by a previous request.
+	Cursor string
+	// Request all the updates, instead of the updates since the ones that
+	// were applied locally.
+	FromStart bool
+}
+
+// rawAlbum is an album, as sent by the server, with its decrypted name.
+type rawAlbum struct {
+	stingle.Album
+	DecryptedName string `json:"decryptedName,omitempty"`
+}
+
+// rawFile is a file, as sent by the server, with its decrypted name.
+type rawFile struct {
+	stingle.File
+	DecryptedName string `json:"decryptedName,omitempty"`
+}
+
+// RawUpdates requests one page of updates from the server, and shows the
+// response as JSON, without applying it to the local file sets. The names of
+// the albums and files are decrypted when the keys are available. It is meant
+// for debugging sync issues, e.g. to compare what the server sends with what
+// the client applies. Only the session token is redacted from the output.
+func (c *Client) RawUpdates(opts RawUpdatesOptions) error {
+	if c.Account == nil {
+		return ErrNotLoggedIn
+	}
+	c.storage.cache.invalidate()
+	form, err := c.updatesForm()
+	if err != nil {
+		return err
+	}
+	if opts.FromStart {
+		for _, k := range []string{"filesST", "trashST", "albumsST", "albumFilesST", "cntST", "delST"} {
+			form.Set(k, "0")
+		}
+	}
+	if opts.Cursor != "" {
+		form.Set("cursor", opts.Cursor)
+	}
+	sr, err := c.sendRequest("/v2/sync/getUpdates", form, "")
+	if err != nil {
+		return err
+	}
+
+	var (
+		albums     []stingle.Album
+		gallery    []stingle.File
+		trash      []stingle.File
+		albumFiles []stingle.File
+		contacts   []stingle.Contact
+		deletes    []stingle.DeleteEvent
+	)
+	for _, p := range []struct {
+		name  string
+		value interface{}
+	}{
+		{"albums", &albums},
+		{"files", &gallery},
+		{"trash", &trash},
+		{"albumFiles", &albumFiles},
+		{"contacts", &contacts},
+		{"deletes", &deletes},
+	} {
+		if err := copyJSON(sr.Part(p.name), p.value); err != nil {
+			return err
+		}
+	}
+
+	// The album keys are needed to decrypt the names of the album files.
+	// The albums in the response take precedence over the local ones.
+	var al AlbumList
+	if err := c.storage.ReadDataFile(c.fileHash(albumList), &al); err != nil {
+		return err
+	}
+	keys := make(map[string]stingle.Album)
+	for id, a := range al.Albums {
+		keys[id] = *a
+	}
+	for _, a := range albums {
+		keys[a.AlbumID] = a
+	}
+	sk := c.SecretKey()
+	defer sk.Wipe()
+
+	req := make(map[string]string)
+	for k := range form {
+		req[k] = form.Get(k)
+	}
+	req["token"] = "REDACTED"
+	out := struct {
+		Request    map[string]string     `json:"request"`
+		Status     string                `json:"status"`
+		NextCursor interface{}           `json:"nextCursor,omitempty"`
+		Albums     []rawAlbum            `json:"albums"`
+		Files      []rawFile             `json:"files"`
+		Trash      []rawFile             `json:"trash"`
+		AlbumFiles []rawFile             `json:"albumFiles"`
+		Contacts   []stingle.Contact     `json:"contacts"`
+		Deletes    []stingle.DeleteEvent `json:"deletes"`
+		Infos      []string              `json:"infos,omitempty"`
+		Errors     []string              `json:"errors,omitempty"`
+	}{
+		Request:    req,
+		Status:     sr.Status,
+		NextCursor: sr.Part("nextCursor"),
+		Albums:     []rawAlbum{},
+		Files:      c.rawFiles(gallery, sk, nil),
+		Trash:      c.rawFiles(trash, sk, nil),
+		AlbumFiles: c.rawFiles(albumFiles, sk, keys),
+		Contacts:   contacts,
+		Deletes:    deletes,
+		Infos:      sr.Infos,
+		Errors:     sr.Errors,
+	}
+	for _, a := range albums {
+		name, _ := a.Name(sk)
+		out.Albums = append(out.Albums, rawAlbum{a, name})
+	}
+	if out.Contacts == nil {
+		out.Contacts = []stingle.Contact{}
+	}
+	if out.Deletes == nil {
+		out.Deletes = []stingle.DeleteEvent{}
+	}
+	b, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	c.Print(string(b))
+	return nil
+}
+
+// rawFiles returns the files with their decrypted names. The headers of the
+// album files are decrypted with the keys of their albums.
+func (c *Client) rawFiles(files []stingle.File, sk *stingle.SecretKey, albums map[string]stingle.Album) []rawFile {
+	out := []rawFile{}
+	for _, f := range files {
+		var name string
+		if albums == nil {
+			name, _ = f.Name(sk)
+		} else if a, ok := albums[f.AlbumID]; ok {
+			if ask, err := a.SK(sk); err == nil {
+				name, _ = f.Name(ask)
+				ask.Wipe()
+			}
+		}
+		out = append(out, rawFile{f, name})
+	}
+	return out
+}
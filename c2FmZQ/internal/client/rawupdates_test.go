@@ -0,0 +1,97 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"c2FmZQ/internal/client"
+)
+
+func TestRawUpdates(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 1); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if err := c.AddAlbums([]string{"foo"}); err != nil {
+		t.Fatalf("c.AddAlbums: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "image000.jpg")}, "foo", false); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+	var buf bytes.Buffer
+	c.SetWriter(&buf)
+
+	type raw struct {
+		Request map[string]string `json:"request"`
+		Status  string            `json:"status"`
+		Albums  []struct {
+			DecryptedName string `json:"decryptedName"`
+		} `json:"albums"`
+		AlbumFiles []struct {
+			DecryptedName string `json:"decryptedName"`
+		} `json:"albumFiles"`
+	}
+
+	// Everything is already synced.
+	if err := c.RawUpdates(client.RawUpdatesOptions{}); err != nil {
+		t.Fatalf("c.RawUpdates: %v", err)
+	}
+	var r raw
+	if err := json.Unmarshal(buf.Bytes(), &r); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if r.Status != "ok" || len(r.Albums) != 0 || len(r.AlbumFiles) != 0 {
+		t.Errorf("Unexpected updates: %s", buf.String())
+	}
+	if got, want := r.Request["token"], "REDACTED"; got != want {
+		t.Errorf("Unexpected token. Got %q, want %q", got, want)
+	}
+	if strings.Contains(buf.String(), c.Account.Token) {
+		t.Errorf("The output contains the token: %s", buf.String())
+	}
+
+	buf.Reset()
+	if err := c.RawUpdates(client.RawUpdatesOptions{FromStart: true}); err != nil {
+		t.Fatalf("c.RawUpdates: %v", err)
+	}
+	r = raw{}
+	if err := json.Unmarshal(buf.Bytes(), &r); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if len(r.Albums) != 1 || r.Albums[0].DecryptedName != "foo" {
+		t.Errorf("Unexpected albums: %s", buf.String())
+	}
+	// The file names are shown exactly as they are in the headers, with
+	// their padding.
+	if len(r.AlbumFiles) != 1 || strings.TrimSpace(r.AlbumFiles[0].DecryptedName) != "image000.jpg" {
+		t.Errorf("Unexpected album files: %s", buf.String())
+	}
+}
@@ -0,0 +1,102 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// MaxBlobShardDepth is the maximum number of directory levels used to store
+// blobs.
+const MaxBlobShardDepth = 4
+
+// ReshardBlobs moves the local blobs to a layout with depth levels of
+// directories, e.g. aa/bb/aabbcc... with depth 2. It returns the number of
+// files moved. If it is interrupted, it can safely be run again.
+func (c *Client) ReshardBlobs(depth int) (int, error) {
+	if depth < 1 || depth > MaxBlobShardDepth {
+		return 0, fmt.Errorf("invalid depth %d: must be between 1 and %d", depth, MaxBlobShardDepth)
+	}
+	sets := []string{galleryFile, trashFile}
+	var al AlbumList
+	if err := c.storage.ReadDataFile(c.fileHash(albumList), &al); err != nil {
+		return 0, err
+	}
+	for _, album := range al.Albums {
+		sets = append(sets, albumPrefix+album.AlbumID)
+	}
+
+	count := 0
+	for _, set := range sets {
+		var fs FileSet
+		if err := c.storage.ReadDataFile(c.fileHash(set), &fs); err != nil {
+			return count, err
+		}
+		for _, f := range fs.Files {
+			for _, thumb := range []bool{false, true} {
+				moved, err := c.moveBlob(f.File, thumb, depth)
+				if err != nil {
+					return count, err
+				}
+				if moved {
+					count++
+				}
+			}
+		}
+	}
+	c.BlobShardDepth = depth
+	if err := c.Save(); err != nil {
+		return count, err
+	}
+	c.Infof("Moved %d file(s).\n", count)
+	return count, nil
+}
+
+// moveBlob moves a blob to its location with depth levels of directories. The
+// blob is looked for at all depths, in case a previous attempt was
+// interrupted.
+func (c *Client) moveBlob(name string, thumb bool, depth int) (bool, error) {
+	to := c.blobPathWithDepth(name, thumb, depth)
+	for d := 1; d <= MaxBlobShardDepth; d++ {
+		if d == depth {
+			continue
+		}
+		from := c.blobPathWithDepth(name, thumb, d)
+		if _, err := os.Stat(from); err != nil {
+			continue
+		}
+		if err := c.blobPerm.MkdirAll(filepath.Dir(to)); err != nil {
+			return false, err
+		}
+		if err := os.Rename(from, to); err != nil {
+			return false, err
+		}
+		// Remove the directories that are now empty, except the first
+		// level which is shared with other files.
+		for dir := filepath.Dir(from); d > 1; d-- {
+			if os.Remove(dir) != nil {
+				break
+			}
+			dir = filepath.Dir(dir)
+		}
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,67 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"c2FmZQ/internal/client"
+)
+
+func TestReshardBlobs(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 5); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "*")}, "album", true); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+
+	for _, tc := range []struct {
+		depth int
+		moved int
+	}{
+		{2, 10},
+		{2, 0},
+		{4, 10},
+		{1, 10},
+	} {
+		n, err := c.ReshardBlobs(tc.depth)
+		if err != nil {
+			t.Fatalf("c.ReshardBlobs(%d): %v", tc.depth, err)
+		}
+		if want, got := tc.moved, n; want != got {
+			t.Errorf("Unexpected ReshardBlobs(%d) result. Want %d, got %d", tc.depth, want, got)
+		}
+		if n, err := c.ExportFiles([]string{"album/*"}, t.TempDir(), client.ExportOptions{}); err != nil {
+			t.Errorf("c.ExportFiles: %v", err)
+		} else if want, got := 5, n; want != got {
+			t.Errorf("Unexpected ExportFiles result. Want %d, got %d", want, got)
+		}
+	}
+	if _, err := c.ReshardBlobs(5); err == nil {
+		t.Error("c.ReshardBlobs(5) should have failed")
+	}
+}
@@ -0,0 +1,224 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"c2FmZQ/internal/stingle"
+)
+
+// resyncBackupDir is the directory, relative to the data directory, where
+// FullResync saves the metadata that it discards.
+const resyncBackupDir = "resync-backup"
+
+// FullResync discards the local metadata, i.e. the gallery, trash, albums, and
+// contacts, and downloads it again from the server. Local changes that aren't
+// synced are lost. The downloaded files are kept, except those that don't
+// match the new metadata.
+//
+// The discarded metadata is saved first. The returned directory can be passed
+// to UndoResync to restore it.
+func (c *Client) FullResync() (backupDir string, retErr error) {
+	if c.Account == nil {
+		return "", ErrNotLoggedIn
+	}
+	c.storage.cache.invalidate()
+	al, err := c.albumList()
+	if err != nil {
+		return "", err
+	}
+	var (
+		newAlbumList AlbumList
+		newContacts  ContactList
+	)
+	names := []string{c.fileHash(albumList), c.fileHash(contactsFile), c.fileHash(galleryFile), c.fileHash(trashFile)}
+	objects := []interface{}{&newAlbumList, &newContacts, &FileSet{}, &FileSet{}}
+	var albumSets []string
+	seen := make(map[string]bool)
+	for _, albums := range []map[string]*stingle.Album{al.Albums, al.RemoteAlbums} {
+		for albumID := range albums {
+			fn := c.fileHash(albumPrefix + albumID)
+			if _, err := os.Stat(filepath.Join(c.storage.Dir(), fn)); err != nil || seen[fn] {
+				continue
+			}
+			seen[fn] = true
+			albumSets = append(albumSets, fn)
+			names = append(names, fn)
+			objects = append(objects, &FileSet{})
+		}
+	}
+	commit, err := c.storage.OpenManyForUpdate(names, objects)
+	if err != nil {
+		return "", err
+	}
+	defer commit(false, nil)
+
+	backupDir = filepath.Join(c.storage.Dir(), resyncBackupDir, time.Now().UTC().Format("20060102-150405.000"))
+	for _, name := range names {
+		if err := c.copyStateFile(filepath.Join(c.storage.Dir(), name), filepath.Join(backupDir, name)); err != nil {
+			return "", err
+		}
+	}
+	c.Infof("Saved the current metadata in %s\n", backupDir)
+
+	newAlbumList = AlbumList{}
+	newContacts = ContactList{}
+	for _, obj := range objects[2:] {
+		*obj.(*FileSet) = FileSet{}
+	}
+	if err := commit(true, nil); err != nil {
+		return "", err
+	}
+	// The albums' file sets are created again when the albums are
+	// received from the server.
+	for _, fn := range albumSets {
+		if err := os.Remove(filepath.Join(c.storage.Dir(), fn)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return backupDir, err
+		}
+	}
+	c.storage.cache.invalidate()
+
+	if err := c.GetUpdates(true); err != nil {
+		return backupDir, err
+	}
+	n, err := c.removeMismatchedBlobs()
+	if err != nil {
+		return backupDir, err
+	}
+	c.Infof("Metadata resynced successfully. %d local file(s) removed.\n", n)
+	return backupDir, nil
+}
+
+// UndoResync restores the metadata that was saved by FullResync in backupDir.
+func (c *Client) UndoResync(backupDir string) error {
+	var names []string
+	err := filepath.WalkDir(backupDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(backupDir, path)
+		if err != nil {
+			return err
+		}
+		names = append(names, rel)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return errors.New("nothing to restore")
+	}
+	if err := c.storage.LockMany(names); err != nil {
+		return err
+	}
+	defer c.storage.UnlockMany(names)
+	defer c.storage.cache.invalidate()
+	for _, name := range names {
+		dst := filepath.Join(c.storage.Dir(), name)
+		if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+			return err
+		}
+		if err := c.copyStateFile(filepath.Join(backupDir, name), dst); err != nil {
+			return err
+		}
+	}
+	c.Infof("Restored the metadata from %s\n", backupDir)
+	return nil
+}
+
+func (c *Client) copyStateFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	return c.writeAtomically(dst, func(w io.Writer) error {
+		_, err := io.Copy(w, in)
+		return err
+	})
+}
+
+// removeMismatchedBlobs removes the local copies of files and thumbnails that
+// can't be decrypted with their current headers, e.g. because the file was
+// replaced on the server. They are downloaded again when needed.
+func (c *Client) removeMismatchedBlobs() (int, error) {
+	li, err := c.GlobFiles([]string{"*"}, GlobOptions{Recursive: true, MatchDot: true, Quiet: true})
+	if err != nil {
+		return 0, err
+	}
+	sk := c.SecretKey()
+	defer sk.Wipe()
+	seen := make(map[string]bool)
+	count := 0
+	for _, item := range li {
+		if item.IsDir || seen[item.FSFile.File] {
+			continue
+		}
+		seen[item.FSFile.File] = true
+		for _, thumb := range []bool{false, true} {
+			fn := c.blobPath(item.FSFile.File, thumb)
+			if _, err := os.Stat(fn); err != nil {
+				continue
+			}
+			getHeader := item.Header
+			if thumb {
+				getHeader = item.ThumbHeader
+			}
+			hdr, err := getHeader(sk)
+			if err != nil {
+				return count, err
+			}
+			ok := blobMatches(fn, hdr)
+			hdr.Wipe()
+			if ok {
+				continue
+			}
+			c.Infof("Removing the local copy of %s (doesn't match)\n", item.Filename)
+			if err := os.Remove(fn); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, nil
+}
+
+// blobMatches returns true if the first chunk of the blob can be decrypted
+// with hdr.
+func blobMatches(fn string, hdr *stingle.Header) bool {
+	f, err := os.Open(fn)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if err := stingle.SkipHeader(f); err != nil {
+		return false
+	}
+	_, err = io.CopyN(io.Discard, stingle.DecryptFile(f, hdr), 1)
+	return err == nil || err == io.EOF
+}
@@ -0,0 +1,103 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"c2FmZQ/internal/client"
+)
+
+func TestFullResync(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 3); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "*")}, "gallery", false); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+	if err := c.AddAlbums([]string{"alpha"}); err != nil {
+		t.Fatalf("c.AddAlbums: %v", err)
+	}
+	if err := c.Copy([]string{"gallery/image000.jpg"}, "alpha", false); err != nil {
+		t.Fatalf("c.Copy: %v", err)
+	}
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+
+	// A local change that isn't synced.
+	testdir2 := t.TempDir()
+	if err := makeImages(testdir2, 3, 1); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir2, "*")}, "gallery", false); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+	list, err := c.GlobFiles([]string{"gallery/*"}, client.GlobOptions{})
+	if err != nil || len(list) != 4 {
+		t.Fatalf("c.GlobFiles: %d, %v", len(list), err)
+	}
+	// A local copy that doesn't match its file.
+	b, err := os.ReadFile(list[1].FilePath)
+	if err != nil {
+		t.Fatalf("os.ReadFile: %v", err)
+	}
+	if err := os.WriteFile(list[0].FilePath, b, 0600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+
+	backupDir, err := c.FullResync()
+	if err != nil {
+		t.Fatalf("c.FullResync: %v", err)
+	}
+	for _, tc := range []struct {
+		pattern string
+		want    int
+	}{
+		{"gallery/*", 3},
+		{"alpha/*", 1},
+	} {
+		if li, err := c.GlobFiles([]string{tc.pattern}, client.GlobOptions{}); err != nil || len(li) != tc.want {
+			t.Errorf("c.GlobFiles(%q) after resync: %d, %v, want %d", tc.pattern, len(li), err, tc.want)
+		}
+	}
+	if _, err := os.Stat(list[0].FilePath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("%s wasn't removed: %v", list[0].Filename, err)
+	}
+	for _, item := range list[1:3] {
+		if _, err := os.Stat(item.FilePath); err != nil {
+			t.Errorf("%s wasn't kept: %v", item.Filename, err)
+		}
+	}
+
+	if err := c.UndoResync(backupDir); err != nil {
+		t.Fatalf("c.UndoResync: %v", err)
+	}
+	if li, err := c.GlobFiles([]string{"gallery/*"}, client.GlobOptions{}); err != nil || len(li) != 4 {
+		t.Errorf("c.GlobFiles after undo: %d, %v, want 4", len(li), err)
+	}
+}
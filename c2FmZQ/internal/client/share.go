@@ -18,6 +18,8 @@
 package client
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -44,7 +46,7 @@ func (c *Client) Share(pattern string, shareWith []string, permissions []string)
 			continue
 		}
 		if item.Album == nil {
-			return fmt.Errorf("not an album: %s", item.Filename)
+			return fmt.Errorf("%w: %s", ErrAlbumNotFound, item.Filename)
 		}
 		if item.Album.IsOwner != "1" && !stingle.Permissions(item.Album.Permissions).AllowShare() {
 			return fmt.Errorf("resharing is not permitted: %s", item.Filename)
@@ -55,6 +57,7 @@ func (c *Client) Share(pattern string, shareWith []string, permissions []string)
 		return err
 	}
 	var members []*stingle.Contact
+	var invitees []string
 	maxSize := 5
 	for _, email := range shareWith {
 		if email == c.Account.Email {
@@ -75,12 +78,17 @@ func (c *Client) Share(pattern string, shareWith []string, permissions []string)
 			continue
 		}
 		c, err := c.sendGetContact(email)
+		if errors.Is(err, ErrContactNotFound) {
+			// The recipient doesn't have an account yet.
+			invitees = append(invitees, email)
+			continue
+		}
 		if err != nil {
 			return err
 		}
 		members = append(members, c)
 	}
-	if len(members) == 0 {
+	if len(members) == 0 && len(invitees) == 0 {
 		return fmt.Errorf("no match: %s", shareWith)
 	}
 	c.Print("Sharing with:\n")
@@ -94,6 +102,14 @@ func (c *Client) Share(pattern string, shareWith []string, permissions []string)
 	for _, l := range list {
 		c.Print(l)
 	}
+	if len(invitees) > 0 {
+		c.Print("\nInviting (no account yet):\n")
+		sort.Strings(invitees)
+		for _, email := range invitees {
+			c.Print(email)
+		}
+		c.Print("\nThe album can be shared with them with complete-shares after they create an account.")
+	}
 	c.Print("\nWARNING: Verify the public keys of your contacts, then confirm.\n")
 	if reply, err := c.prompt("Type YES to confirm: "); err != nil || reply != "YES" {
 		return errors.New("not confirmed")
@@ -102,7 +118,9 @@ func (c *Client) Share(pattern string, shareWith []string, permissions []string)
 		if !item.IsDir {
 			continue
 		}
-		album := item.Album
+		// item.Album may be shared with the caches.
+		a := *item.Album
+		album := &a
 		sharingKeys := make(map[string]string)
 		sk, err := c.SKForAlbum(album)
 		if err != nil {
@@ -125,16 +143,142 @@ func (c *Client) Share(pattern string, shareWith []string, permissions []string)
 			return err
 		}
 
-		if err := c.sendShare(album, sharingKeys); err != nil {
+		if len(members) > 0 {
+			if err := c.sendShare(album, sharingKeys); err != nil {
+				return err
+			}
+			var emails []string
+			for _, m := range members {
+				emails = append(emails, m.Email)
+			}
+			c.Infof("Now sharing %s with %s. (synced)\n", item.Filename, strings.Join(emails, ", "))
+		}
+		for _, email := range invitees {
+			if err := c.sendInvite(album.AlbumID, email, album.Permissions); err != nil {
+				return err
+			}
+			c.Infof("Invited %s to %s. (invited)\n", email, item.Filename)
+		}
+	}
+	return nil
+}
+
+// CompletePendingShares completes the shares with the recipients who were
+// invited before they had an account, and who have now registered. The
+// server can't do it on its own because it doesn't have the albums' secret
+// keys. The recipients' public keys come from the server, so the user has to
+// verify and confirm them.
+func (c *Client) CompletePendingShares() error {
+	if c.Account == nil {
+		return ErrNotLoggedIn
+	}
+	form := url.Values{}
+	form.Set("token", c.Account.Token)
+	sr, err := c.sendRequest("/v2x/sync/pendingShares", form, "")
+	if err != nil {
+		return err
+	}
+	if sr.Status != "ok" {
+		return &ServerError{sr}
+	}
+	var shares []struct {
+		AlbumID     string `json:"albumId"`
+		Email       string `json:"email"`
+		Permissions string `json:"permissions"`
+		RecipientID int64  `json:"recipientId"`
+	}
+	if err := copyJSON(sr.Part("shares"), &shares); err != nil {
+		return err
+	}
+	var al AlbumList
+	if err := c.storage.ReadDataFile(c.fileHash(albumList), &al); err != nil {
+		return err
+	}
+	var cl ContactList
+	if err := c.storage.ReadDataFile(c.fileHash(contactsFile), &cl); err != nil {
+		return err
+	}
+	type pendingShare struct {
+		album       *stingle.Album
+		name        string
+		contact     *stingle.Contact
+		pk          stingle.PublicKey
+		permissions string
+	}
+	var pending []pendingShare
+	maxName, maxEmail := 5, 5
+	for _, ps := range shares {
+		if ps.RecipientID == 0 {
+			continue
+		}
+		a, ok := al.RemoteAlbums[ps.AlbumID]
+		if !ok {
+			continue
+		}
+		contact, ok := cl.Contacts[ps.RecipientID]
+		if !ok {
+			continue
+		}
+		pk, err := contact.PK()
+		if err != nil {
 			return err
 		}
-		c.Printf("Now sharing %s with %s. (synced)\n", item.Filename, strings.Join(shareWith, ", "))
+		name, err := c.translateSetAlbumIDToName(stingle.AlbumSet, a.AlbumID, al)
+		if err != nil {
+			name = a.AlbumID
+		}
+		if len(name) > maxName {
+			maxName = len(name)
+		}
+		if len(contact.Email) > maxEmail {
+			maxEmail = len(contact.Email)
+		}
+		pending = append(pending, pendingShare{a, name, contact, pk, ps.Permissions})
+	}
+	if len(pending) == 0 {
+		c.Print("No pending shares can be completed.")
+		return nil
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		if pending[i].name != pending[j].name {
+			return pending[i].name < pending[j].name
+		}
+		return pending[i].contact.Email < pending[j].contact.Email
+	})
+	c.Print("Completing shares:\n")
+	c.Printf("%*s %*s %s\n", -maxName, "Album", -maxEmail, "Email", "Public Key")
+	for _, p := range pending {
+		c.Printf("%*s %*s % X\n", -maxName, p.name, -maxEmail, p.contact.Email, p.pk.ToBytes())
+	}
+	c.Print("\nWARNING: Verify the public keys of your contacts, then confirm.\n")
+	if reply, err := c.prompt("Type YES to confirm: "); err != nil || reply != "YES" {
+		return errors.New("not confirmed")
+	}
+	for _, p := range pending {
+		album := *p.album
+		sk, err := c.SKForAlbum(&album)
+		if err != nil {
+			return err
+		}
+		id := p.contact.UserID.String()
+		sharingKeys := map[string]string{id: p.pk.SealBoxBase64(sk.ToBytes())}
+		sk.Wipe()
+		album.Members = fmt.Sprintf("%d,%s", c.Account.UserID, id)
+		if album.IsShared != "1" {
+			album.Permissions = p.permissions
+		}
+		if err := c.sendShare(&album, sharingKeys); err != nil {
+			return err
+		}
+		c.Infof("Now sharing %s with %s. (synced)\n", p.name, p.contact.Email)
 	}
 	return nil
 }
 
-// Unshare stops sharing albums.
-func (c *Client) Unshare(patterns []string) error {
+// Unshare stops sharing albums. When rotateKey is true, the albums' keypairs
+// are also replaced so that the former members can't decrypt anything that is
+// added later.
+func (c *Client) Unshare(patterns []string, rotateKey bool) error {
 	if c.Account == nil {
 		return ErrNotLoggedIn
 	}
@@ -147,10 +291,10 @@ func (c *Client) Unshare(patterns []string) error {
 			continue
 		}
 		if item.Album == nil {
-			return fmt.Errorf("not an album: %s", item.Filename)
+			return fmt.Errorf("%w: %s", ErrAlbumNotFound, item.Filename)
 		}
 		if item.Album.IsOwner != "1" {
-			return fmt.Errorf("not owner: %s", item.Filename)
+			return fmt.Errorf("%w: not owner: %s", ErrPermissionDenied, item.Filename)
 		}
 	}
 	for _, item := range li {
@@ -160,7 +304,10 @@ func (c *Client) Unshare(patterns []string) error {
 		if err := c.sendUnshareAlbum(item.Album.AlbumID); err != nil {
 			return err
 		}
-		c.Printf("Stopped sharing %s. (synced)\n", item.Filename)
+		c.Infof("Stopped sharing %s. (synced)\n", item.Filename)
+	}
+	if rotateKey {
+		return c.rotateAlbumKeys(li)
 	}
 	return nil
 }
@@ -179,7 +326,7 @@ func (c *Client) Leave(patterns []string) error {
 			continue
 		}
 		if item.Album == nil {
-			return fmt.Errorf("not an album: %s", item.Filename)
+			return fmt.Errorf("%w: %s", ErrAlbumNotFound, item.Filename)
 		}
 		if item.Album.IsOwner == "1" {
 			return fmt.Errorf("is owner: %s", item.Filename)
@@ -189,16 +336,18 @@ func (c *Client) Leave(patterns []string) error {
 		if !item.IsDir {
 			continue
 		}
-		if err := c.sendLeaveAlbum(item.Album.AlbumID); err != nil {
+		if err := c.sendLeaveAlbum(context.Background(), item.Album.AlbumID); err != nil {
 			return err
 		}
-		c.Printf("Left %s. (synced)\n", item.Filename)
+		c.Infof("Left %s. (synced)\n", item.Filename)
 	}
 	return nil
 }
 
-// RemoveMember removes members of an album.
-func (c *Client) RemoveMembers(pattern string, toRemove []string) error {
+// RemoveMembers removes members of an album. When rotateKey is true, the
+// album's keypair is also replaced so that the removed members can't decrypt
+// anything that is added later.
+func (c *Client) RemoveMembers(pattern string, toRemove []string, rotateKey bool) error {
 	if c.Account == nil {
 		return ErrNotLoggedIn
 	}
@@ -211,10 +360,10 @@ func (c *Client) RemoveMembers(pattern string, toRemove []string) error {
 			continue
 		}
 		if item.Album == nil {
-			return fmt.Errorf("not an album: %s", item.Filename)
+			return fmt.Errorf("%w: %s", ErrAlbumNotFound, item.Filename)
 		}
 		if item.Album.IsOwner != "1" {
-			return fmt.Errorf("not owner: %s", item.Filename)
+			return fmt.Errorf("%w: not owner: %s", ErrPermissionDenied, item.Filename)
 		}
 	}
 	var cl ContactList
@@ -256,12 +405,232 @@ func (c *Client) RemoveMembers(pattern string, toRemove []string) error {
 			if err := c.sendRemoveAlbumMember(album, id); err != nil {
 				return err
 			}
-			c.Printf("Removed %s from %s. (synced)\n", cl.Contacts[id].Email, item.Filename)
+			c.Infof("Removed %s from %s. (synced)\n", cl.Contacts[id].Email, item.Filename)
 		}
 	}
+	if rotateKey {
+		return c.rotateAlbumKeys(li)
+	}
 	return nil
 }
 
+// rotateAlbumKeys replaces the keypairs of the albums in li. The new album
+// secret key is encrypted for the owner and for each remaining member, and
+// the album metadata and the headers of all the files are re-encrypted with
+// the new public key. The file content is not re-encrypted.
+func (c *Client) rotateAlbumKeys(li []ListItem) error {
+	c.Print("\nWARNING: Rotating the album key re-encrypts the headers of every file in the album. This can take a while for large albums.\n")
+	if err := c.GetUpdates(true); err != nil {
+		return err
+	}
+	for _, item := range li {
+		if !item.IsDir {
+			continue
+		}
+		if err := c.rotateAlbumKey(item.Album.AlbumID); err != nil {
+			return fmt.Errorf("%s: %w", item.Filename, err)
+		}
+		c.Infof("Rotated key of %s. (synced)\n", item.Filename)
+	}
+	return c.GetUpdates(true)
+}
+
+func (c *Client) rotateAlbumKey(albumID string) error {
+	var al AlbumList
+	if err := c.storage.ReadDataFile(c.fileHash(albumList), &al); err != nil {
+		return err
+	}
+	album := al.RemoteAlbums[albumID]
+	if album == nil {
+		return ErrAlbumNotFound
+	}
+	if !album.Equals(al.Albums[albumID]) {
+		return errors.New("album has local changes, sync first")
+	}
+	var fs FileSet
+	if err := c.storage.ReadDataFile(c.fileHash(albumPrefix+albumID), &fs); err != nil {
+		return err
+	}
+	if len(fs.Files) != len(fs.RemoteFiles) {
+		return errors.New("album has local changes, sync first")
+	}
+	for fn, f := range fs.RemoteFiles {
+		if lf := fs.Files[fn]; lf == nil || lf.Headers != f.Headers {
+			return errors.New("album has local changes, sync first")
+		}
+	}
+	var cl ContactList
+	if err := c.storage.ReadDataFile(c.fileHash(contactsFile), &cl); err != nil {
+		return err
+	}
+
+	oldSK, err := c.SKForAlbum(album)
+	if err != nil {
+		return err
+	}
+	defer oldSK.Wipe()
+	ask := stingle.MakeSecretKey()
+	defer ask.Wipe()
+	pk := ask.PublicKey()
+
+	md, err := stingle.DecryptAlbumMetadata(album.Metadata, oldSK)
+	if err != nil {
+		return err
+	}
+	newAlbum := *album
+	newAlbum.EncPrivateKey = c.PublicKey().SealBoxBase64(ask.ToBytes())
+	newAlbum.Metadata = stingle.EncryptAlbumMetadata(*md, pk)
+	newAlbum.PublicKey = base64.StdEncoding.EncodeToString(pk.ToBytes())
+
+	sharingKeys := make(map[string]string)
+	for _, m := range strings.Split(album.Members, ",") {
+		id, err := strconv.ParseInt(m, 10, 64)
+		if err != nil || id == c.Account.UserID {
+			continue
+		}
+		contact := cl.Contacts[id]
+		if contact == nil {
+			return fmt.Errorf("unknown member: %d", id)
+		}
+		mpk, err := contact.PK()
+		if err != nil {
+			return err
+		}
+		sharingKeys[m] = mpk.SealBoxBase64(ask.ToBytes())
+	}
+
+	headers := make(map[string]string)
+	for fn, f := range fs.RemoteFiles {
+		hdrs, err := stingle.DecryptBase64Headers(f.Headers, oldSK)
+		if err != nil {
+			return err
+		}
+		h, err := stingle.EncryptBase64Headers(hdrs, pk)
+		hdrs[0].Wipe()
+		hdrs[1].Wipe()
+		if err != nil {
+			return err
+		}
+		headers[fn] = h
+	}
+	return c.sendRotateAlbumKey(&newAlbum, sharingKeys, headers)
+}
+
+// AlbumMember is a member of a shared album.
+type AlbumMember struct {
+	UserID int64  `json:"userId"`
+	Email  string `json:"email"`
+	// IsOwner is only set when the current user is the owner.
+	IsOwner bool `json:"isOwner,omitempty"`
+	// Permissions are the album's permissions. They apply to all the
+	// members except the owner.
+	Permissions stingle.Permissions `json:"permissions,omitempty"`
+}
+
+// AlbumMembers returns the members of the album matching pattern, sorted by
+// email.
+func (c *Client) AlbumMembers(pattern string) ([]AlbumMember, error) {
+	item, err := c.oneAlbum(pattern)
+	if err != nil {
+		return nil, err
+	}
+	var cl ContactList
+	if err := c.storage.ReadDataFile(c.fileHash(contactsFile), &cl); err != nil {
+		return nil, err
+	}
+	members := []AlbumMember{}
+	if item.Album.IsShared != "1" {
+		return members, nil
+	}
+	for _, m := range strings.Split(item.Album.Members, ",") {
+		id, err := strconv.ParseInt(m, 10, 64)
+		if err != nil {
+			continue
+		}
+		member := AlbumMember{UserID: id, Permissions: stingle.Permissions(item.Album.Permissions)}
+		if c.Account != nil && id == c.Account.UserID {
+			member.Email = c.Account.Email
+			if item.Album.IsOwner == "1" {
+				member.IsOwner = true
+				member.Permissions = ""
+			}
+		} else if contact, ok := cl.Contacts[id]; ok {
+			member.Email = contact.Email
+		} else {
+			member.Email = fmt.Sprintf("user %d", id)
+		}
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Email < members[j].Email })
+	return members, nil
+}
+
+// SetMemberPermissions sets the permissions of a member of the album matching
+// pattern. The Stingle API only has one set of permissions per album. So, the
+// new permissions apply to all the members.
+func (c *Client) SetMemberPermissions(pattern, email string, allowAdd, allowShare, allowCopy bool) (retErr error) {
+	item, err := c.oneAlbum(pattern)
+	if err != nil {
+		return err
+	}
+	if item.Album.IsOwner != "1" {
+		return fmt.Errorf("%w: not owner: %s", ErrPermissionDenied, item.Filename)
+	}
+	members, err := c.AlbumMembers(pattern)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, m := range members {
+		if m.Email == email && !m.IsOwner {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("not a member of %s: %s", item.Filename, email)
+	}
+	p := []byte("1000")
+	for i, v := range []bool{allowAdd, allowShare, allowCopy} {
+		if v {
+			p[i+1] = '1'
+		}
+	}
+	var al AlbumList
+	commit, err := c.storage.OpenForUpdate(c.fileHash(albumList), &al)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	album, ok := al.Albums[item.Album.AlbumID]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrAlbumNotFound, item.Filename)
+	}
+	album.Permissions = string(p)
+	album.DateModified = c.nowJSON()
+	c.Infof("Set permissions on %s to %s (%s). (not synced)\n", item.Filename, stingle.Permissions(p).Human(), p)
+	if len(members) > 2 {
+		c.Infof("Note: the permissions apply to all the members of %s.\n", item.Filename)
+	}
+	return commit(true, nil)
+}
+
+// oneAlbum returns the album matching pattern, which must match exactly one
+// album.
+func (c *Client) oneAlbum(pattern string) (ListItem, error) {
+	li, err := c.GlobFiles([]string{pattern}, GlobOptions{Quiet: true})
+	if err != nil {
+		return ListItem{}, err
+	}
+	if len(li) == 0 || !li[0].IsDir || li[0].Album == nil {
+		return ListItem{}, fmt.Errorf("%w: %s", ErrAlbumNotFound, pattern)
+	}
+	if len(li) > 1 {
+		return ListItem{}, fmt.Errorf("more than one match for: %s", pattern)
+	}
+	return li[0], nil
+}
+
 // ChangePermissions changes the permissions on albums.
 func (c *Client) ChangePermissions(patterns, perms []string) (retErr error) {
 	if c.Account == nil {
@@ -276,10 +645,10 @@ func (c *Client) ChangePermissions(patterns, perms []string) (retErr error) {
 			continue
 		}
 		if item.Album == nil {
-			return fmt.Errorf("not an album: %s", item.Filename)
+			return fmt.Errorf("%w: %s", ErrAlbumNotFound, item.Filename)
 		}
 		if item.Album.IsOwner != "1" {
-			return fmt.Errorf("not owner: %s", item.Filename)
+			return fmt.Errorf("%w: not owner: %s", ErrPermissionDenied, item.Filename)
 		}
 	}
 	var al AlbumList
@@ -300,8 +669,8 @@ func (c *Client) ChangePermissions(patterns, perms []string) (retErr error) {
 			return err
 		}
 		al.Albums[item.Album.AlbumID].Permissions = p
-		al.Albums[item.Album.AlbumID].DateModified = nowJSON()
-		c.Printf("Set permissions on %s to %s (%s). (not synced)\n", item.Filename, stingle.Permissions(p).Human(), p)
+		al.Albums[item.Album.AlbumID].DateModified = c.nowJSON()
+		c.Infof("Set permissions on %s to %s (%s). (not synced)\n", item.Filename, stingle.Permissions(p).Human(), p)
 	}
 	return commit(true, nil)
 }
@@ -382,7 +751,10 @@ func (c *Client) sendGetContact(email string) (*stingle.Contact, error) {
 		return nil, err
 	}
 	if sr.Status != "ok" {
-		return nil, sr
+		if sr.Part("notFound") == "1" {
+			return nil, fmt.Errorf("%w: %s", ErrContactNotFound, email)
+		}
+		return nil, &ServerError{sr}
 	}
 	var contact stingle.Contact
 	if err := copyJSON(sr.Part("contact"), &contact); err != nil {
@@ -391,6 +763,29 @@ func (c *Client) sendGetContact(email string) (*stingle.Contact, error) {
 	return &contact, nil
 }
 
+func (c *Client) sendInvite(albumID, email, permissions string) error {
+	if c.Account == nil {
+		return ErrNotLoggedIn
+	}
+	params := make(map[string]string)
+	params["albumId"] = albumID
+	params["email"] = email
+	params["permissions"] = permissions
+
+	form := url.Values{}
+	form.Set("token", c.Account.Token)
+	form.Set("params", c.encodeParams(params))
+
+	sr, err := c.sendRequest("/v2x/sync/invite", form, "")
+	if err != nil {
+		return err
+	}
+	if sr.Status != "ok" {
+		return &ServerError{sr}
+	}
+	return nil
+}
+
 func (c *Client) sendShare(album *stingle.Album, sharingKeys map[string]string) error {
 	if c.Account == nil {
 		return ErrNotLoggedIn
@@ -416,7 +811,7 @@ func (c *Client) sendShare(album *stingle.Album, sharingKeys map[string]string)
 		return err
 	}
 	if sr.Status != "ok" {
-		return sr
+		return &ServerError{sr}
 	}
 	return nil
 }
@@ -437,12 +832,12 @@ func (c *Client) sendUnshareAlbum(albumID string) error {
 		return err
 	}
 	if sr.Status != "ok" {
-		return sr
+		return &ServerError{sr}
 	}
 	return nil
 }
 
-func (c *Client) sendLeaveAlbum(albumID string) error {
+func (c *Client) sendLeaveAlbum(ctx context.Context, albumID string) error {
 	if c.Account == nil {
 		return ErrNotLoggedIn
 	}
@@ -453,12 +848,12 @@ func (c *Client) sendLeaveAlbum(albumID string) error {
 	form.Set("token", c.Account.Token)
 	form.Set("params", c.encodeParams(params))
 
-	sr, err := c.sendRequest("/v2/sync/leaveAlbum", form, "")
+	sr, err := c.sendRequestContext(ctx, "/v2/sync/leaveAlbum", form, "")
 	if err != nil {
 		return err
 	}
 	if sr.Status != "ok" {
-		return sr
+		return &ServerError{sr}
 	}
 	return nil
 }
@@ -484,7 +879,42 @@ func (c *Client) sendRemoveAlbumMember(album *stingle.Album, id int64) error {
 		return err
 	}
 	if sr.Status != "ok" {
-		return sr
+		return &ServerError{sr}
+	}
+	return nil
+}
+
+func (c *Client) sendRotateAlbumKey(album *stingle.Album, sharingKeys, headers map[string]string) error {
+	if c.Account == nil {
+		return ErrNotLoggedIn
+	}
+	aj, err := json.Marshal(album)
+	if err != nil {
+		return err
+	}
+	kj, err := json.Marshal(sharingKeys)
+	if err != nil {
+		return err
+	}
+	hj, err := json.Marshal(headers)
+	if err != nil {
+		return err
+	}
+	params := make(map[string]string)
+	params["album"] = string(aj)
+	params["sharingKeys"] = string(kj)
+	params["headers"] = string(hj)
+
+	form := url.Values{}
+	form.Set("token", c.Account.Token)
+	form.Set("params", c.encodeParams(params))
+
+	sr, err := c.sendRequest("/v2x/sync/rotateAlbumKey", form, "")
+	if err != nil {
+		return err
+	}
+	if sr.Status != "ok" {
+		return &ServerError{sr}
 	}
 	return nil
 }
@@ -18,6 +18,7 @@
 package client
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -28,18 +29,31 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
-	"time"
 
 	"c2FmZQ/internal/log"
 	"c2FmZQ/internal/stingle"
 )
 
+const (
+	// Files smaller than maxBatchFileSize are uploaded in batches of up to
+	// maxBatchFiles files, or maxBatchBytes bytes.
+	maxBatchFileSize = 1 << 20
+	maxBatchFiles    = 20
+	maxBatchBytes    = 10 << 20
+)
+
+// errEndpointNotFound is returned when the server doesn't have the endpoint
+// of a request, e.g. an older server.
+var errEndpointNotFound = errors.New("endpoint not found")
+
 type albumDiffs struct {
 	AlbumsToAdd        []*stingle.Album
 	AlbumsToRemove     []*stingle.Album
 	AlbumsToRename     []*stingle.Album
 	AlbumPermsToChange []*stingle.Album
+	AlbumCoversToSet   []*stingle.Album
 
 	FilesToAdd    []FileLoc
 	FilesToMove   []MoveItem
@@ -68,128 +82,157 @@ type MoveItem struct {
 // Sync synchronizes all metadata changes that have been made locally with the
 // remote server.
 func (c *Client) Sync(dryrun bool) error {
-	if err := c.GetUpdates(true); err != nil {
+	return c.SyncContext(context.Background(), dryrun)
+}
+
+// SyncContext is like Sync, but it stops when ctx is canceled. The changes
+// that were already applied are kept, and the rest are synced by the next
+// call.
+func (c *Client) SyncContext(ctx context.Context, dryrun bool) error {
+	if err := c.GetUpdatesContext(ctx, true); err != nil {
 		return err
 	}
 	d, err := c.diff()
 	if err != nil {
 		return err
 	}
-	if d.AlbumsToAdd == nil && d.AlbumsToRemove == nil && d.AlbumsToRename == nil && d.AlbumPermsToChange == nil &&
+	if d.AlbumsToAdd == nil && d.AlbumsToRemove == nil && d.AlbumsToRename == nil && d.AlbumPermsToChange == nil && d.AlbumCoversToSet == nil &&
 		d.FilesToAdd == nil && d.FilesToMove == nil && d.FilesToDelete == nil {
-		c.Print("No changes to sync.")
-		return nil
+		c.Info("No changes to sync.")
+		return c.enforceCacheLimit()
 	}
-	if err := c.applyDiffs(d, dryrun); err != nil {
+	if err := c.applyDiffs(ctx, d, dryrun); err != nil {
 		return err
 	}
 	if dryrun {
-		c.Print("Dry-run mode, not synced.")
+		c.Info("Dry-run mode, not synced.")
 		return nil
 	}
-	return c.GetUpdates(true)
+	if err := c.GetUpdatesContext(ctx, true); err != nil {
+		return err
+	}
+	return c.enforceCacheLimit()
 }
 
-func (c *Client) applyDiffs(d *albumDiffs, dryrun bool) error {
+func (c *Client) applyDiffs(ctx context.Context, d *albumDiffs, dryrun bool) error {
 	var al AlbumList
 	if err := c.storage.ReadDataFile(c.fileHash(albumList), &al); err != nil {
 		return err
 	}
 	if len(d.AlbumsToAdd) > 0 {
-		if err := c.applyAlbumsToAdd(d.AlbumsToAdd, dryrun); err != nil {
+		if err := c.applyAlbumsToAdd(ctx, d.AlbumsToAdd, dryrun); err != nil {
 			return err
 		}
 	}
 	if len(d.AlbumsToRename) > 0 {
-		if err := c.applyAlbumsToRename(d.AlbumsToRename, dryrun); err != nil {
+		if err := c.applyAlbumsToRename(ctx, d.AlbumsToRename, dryrun); err != nil {
 			return err
 		}
 	}
 	if len(d.AlbumPermsToChange) > 0 {
-		if err := c.applyAlbumPermsToChange(d.AlbumPermsToChange, dryrun); err != nil {
+		if err := c.applyAlbumPermsToChange(ctx, d.AlbumPermsToChange, dryrun); err != nil {
 			return err
 		}
 	}
 	if len(d.FilesToAdd) > 0 {
-		if err := c.applyFilesToAdd(d.FilesToAdd, al, dryrun); err != nil {
+		if err := c.applyFilesToAdd(ctx, d.FilesToAdd, al, dryrun); err != nil {
 			return err
 		}
 	}
 	if len(d.FilesToMove) > 0 {
-		if err := c.applyFilesToMove(d.FilesToMove, al, dryrun); err != nil {
+		if err := c.applyFilesToMove(ctx, d.FilesToMove, al, dryrun); err != nil {
 			return err
 		}
 	}
 	if len(d.FilesToDelete) > 0 {
-		if err := c.applyFilesToDelete(d.FilesToDelete, al, dryrun); err != nil {
+		if err := c.applyFilesToDelete(ctx, d.FilesToDelete, al, dryrun); err != nil {
+			return err
+		}
+	}
+	if len(d.AlbumCoversToSet) > 0 {
+		if err := c.applyAlbumCoversToSet(ctx, d.AlbumCoversToSet, dryrun); err != nil {
 			return err
 		}
 	}
 	if len(d.AlbumsToRemove) > 0 {
-		if err := c.applyAlbumsToRemove(d.AlbumsToRemove, dryrun); err != nil {
+		if err := c.applyAlbumsToRemove(ctx, d.AlbumsToRemove, dryrun); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (c *Client) applyAlbumsToAdd(albums []*stingle.Album, dryrun bool) error {
+func (c *Client) applyAlbumsToAdd(ctx context.Context, albums []*stingle.Album, dryrun bool) error {
 	c.showAlbumsToSync("Albums to create:", albums)
 	if dryrun {
 		return nil
 	}
 	for _, album := range albums {
-		if err := c.sendAddAlbum(album); err != nil {
+		if err := c.sendAddAlbum(ctx, album); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (c *Client) applyAlbumsToRename(albums []*stingle.Album, dryrun bool) error {
+func (c *Client) applyAlbumsToRename(ctx context.Context, albums []*stingle.Album, dryrun bool) error {
 	c.showAlbumsToSync("Albums to rename:", albums)
 	if dryrun {
 		return nil
 	}
 	for _, album := range albums {
-		if err := c.sendRenameAlbum(album); err != nil {
+		if err := c.sendRenameAlbum(ctx, album); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (c *Client) applyAlbumPermsToChange(albums []*stingle.Album, dryrun bool) error {
+func (c *Client) applyAlbumPermsToChange(ctx context.Context, albums []*stingle.Album, dryrun bool) error {
 	c.showAlbumsToSync("Album permissions to change:", albums)
 	if dryrun {
 		return nil
 	}
 	for _, album := range albums {
-		if err := c.sendEditPerms(album); err != nil {
+		if err := c.sendEditPerms(ctx, album); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (c *Client) applyFilesToAdd(files []FileLoc, al AlbumList, dryrun bool) error {
+func (c *Client) applyAlbumCoversToSet(ctx context.Context, albums []*stingle.Album, dryrun bool) error {
+	c.showAlbumsToSync("Album covers to set:", albums)
+	if dryrun {
+		return nil
+	}
+	for _, album := range albums {
+		if err := c.sendChangeAlbumCover(ctx, album); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) applyFilesToAdd(ctx context.Context, files []FileLoc, al AlbumList, dryrun bool) error {
 	c.showFilesToSync("Files to upload:", files, al)
 	if dryrun {
 		return nil
 	}
-	qCh := make(chan FileLoc)
+	batches := c.uploadBatches(files)
+	qCh := make(chan []FileLoc)
 	eCh := make(chan error)
 	for i := 0; i < 5; i++ {
-		go c.uploadWorker(qCh, eCh)
+		go c.uploadWorker(ctx, qCh, eCh)
 	}
 	go func() {
-		for _, f := range files {
-			qCh <- f
+		for _, b := range batches {
+			qCh <- b
 		}
 		close(qCh)
 	}()
 	var errors []error
-	for range files {
+	for range batches {
 		if err := <-eCh; err != nil {
 			errors = append(errors, err)
 		}
@@ -200,8 +243,33 @@ func (c *Client) applyFilesToAdd(files []FileLoc, al AlbumList, dryrun bool) err
 	return nil
 }
 
-func (c *Client) applyFilesToMove(moves []MoveItem, al AlbumList, dryrun bool) error {
-	c.Print("Files to move:")
+// uploadBatches groups small files into batches that can be uploaded with a
+// single request. Large files, e.g. videos, are uploaded individually.
+func (c *Client) uploadBatches(files []FileLoc) [][]FileLoc {
+	var batches [][]FileLoc
+	var batch []FileLoc
+	var batchSize int64
+	for _, f := range files {
+		fi, err := os.Stat(c.blobPath(f.File.File, false))
+		if err != nil || fi.Size() > maxBatchFileSize {
+			batches = append(batches, []FileLoc{f})
+			continue
+		}
+		if len(batch) >= maxBatchFiles || batchSize+fi.Size() > maxBatchBytes {
+			batches = append(batches, batch)
+			batch, batchSize = nil, 0
+		}
+		batch = append(batch, f)
+		batchSize += fi.Size()
+	}
+	if batch != nil {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+func (c *Client) applyFilesToMove(ctx context.Context, moves []MoveItem, al AlbumList, dryrun bool) error {
+	c.Info("Files to move:")
 	for _, i := range moves {
 		src, err := c.translateSetAlbumIDToName(i.key.SetFrom, i.key.AlbumIDFrom, al)
 		if err != nil {
@@ -236,47 +304,47 @@ func (c *Client) applyFilesToMove(moves []MoveItem, al AlbumList, dryrun bool) e
 			if err != nil {
 				n = f.File
 			}
-			c.Printf("* %s %s -> %s\n", op, filepath.Join(src, "["+f.File+"]"), filepath.Join(dst, sanitize(n)))
+			c.Infof("* %s %s -> %s\n", op, filepath.Join(src, "["+f.File+"]"), filepath.Join(dst, sanitize(n)))
 		}
 	}
 	if dryrun {
 		return nil
 	}
 	for _, i := range moves {
-		if err := c.sendMoveFiles(i.key, i.files); err != nil {
+		if err := c.sendMoveFiles(ctx, i.key, i.files); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (c *Client) applyFilesToDelete(files []string, al AlbumList, dryrun bool) error {
-	c.Print("Files to delete:")
+func (c *Client) applyFilesToDelete(ctx context.Context, files []string, al AlbumList, dryrun bool) error {
+	c.Info("Files to delete:")
 	for _, f := range files {
-		c.Printf("* trash/%s\n", f)
+		c.Infof("* trash/%s\n", f)
 	}
 	if dryrun {
 		return nil
 	}
-	if err := c.sendDelete(files); err != nil {
+	if err := c.sendDelete(ctx, files); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (c *Client) applyAlbumsToRemove(albums []*stingle.Album, dryrun bool) error {
+func (c *Client) applyAlbumsToRemove(ctx context.Context, albums []*stingle.Album, dryrun bool) error {
 	c.showAlbumsToSync("Albums to delete:", albums)
 	if dryrun {
 		return nil
 	}
 	for _, album := range albums {
 		if album.IsOwner == "1" {
-			if err := c.sendDeleteAlbum(album.AlbumID); err != nil {
+			if err := c.sendDeleteAlbum(ctx, album.AlbumID); err != nil {
 				return err
 			}
 			continue
 		}
-		if err := c.sendLeaveAlbum(album.AlbumID); err != nil {
+		if err := c.sendLeaveAlbum(ctx, album.AlbumID); err != nil {
 			return err
 		}
 	}
@@ -284,7 +352,7 @@ func (c *Client) applyAlbumsToRemove(albums []*stingle.Album, dryrun bool) error
 }
 
 func (c *Client) showAlbumsToSync(label string, albums []*stingle.Album) error {
-	c.Print(label)
+	c.Info(label)
 	for _, a := range albums {
 		sk := c.SecretKey()
 		name, err := a.Name(sk)
@@ -292,13 +360,13 @@ func (c *Client) showAlbumsToSync(label string, albums []*stingle.Album) error {
 		if err != nil {
 			return err
 		}
-		c.Printf("* %s\n", sanitize(name))
+		c.Infof("* %s\n", sanitize(name))
 	}
 	return nil
 }
 
 func (c *Client) showFilesToSync(label string, files []FileLoc, al AlbumList) error {
-	c.Print(label)
+	c.Info(label)
 	for _, f := range files {
 		sk := c.SecretKey()
 		if album, ok := al.Albums[f.AlbumID]; ok {
@@ -325,7 +393,7 @@ func (c *Client) showFilesToSync(label string, files []FileLoc, al AlbumList) er
 		if err != nil {
 			return err
 		}
-		c.Printf("* %s/%s\n", sanitize(d), sanitize(n))
+		c.Infof("* %s/%s\n", sanitize(d), sanitize(n))
 	}
 	return nil
 }
@@ -345,7 +413,7 @@ func (c *Client) translateSetAlbumIDToName(set, albumID string, al AlbumList) (s
 		if album, ok := al.RemoteAlbums[albumID]; ok {
 			return album.Name(sk)
 		}
-		return "", fmt.Errorf("album not found: %s", albumID)
+		return "", fmt.Errorf("%w: %s", ErrAlbumNotFound, albumID)
 	default:
 		return "", fmt.Errorf("invalid set: %s", set)
 	}
@@ -363,14 +431,23 @@ func (c *Client) diff() (*albumDiffs, error) {
 		ra, ok := al.RemoteAlbums[albumID]
 		if !ok {
 			diffs.AlbumsToAdd = append(diffs.AlbumsToAdd, album)
+			if album.IsLocked == "1" {
+				diffs.AlbumPermsToChange = append(diffs.AlbumPermsToChange, album)
+			}
+			if album.Cover != "" {
+				diffs.AlbumCoversToSet = append(diffs.AlbumCoversToSet, album)
+			}
 			continue
 		}
 		if album.Metadata != ra.Metadata {
 			diffs.AlbumsToRename = append(diffs.AlbumsToRename, album)
 		}
-		if album.IsHidden != ra.IsHidden || album.Permissions != ra.Permissions {
+		if album.IsHidden != ra.IsHidden || album.Permissions != ra.Permissions || album.IsLocked != ra.IsLocked {
 			diffs.AlbumPermsToChange = append(diffs.AlbumPermsToChange, album)
 		}
+		if album.Cover != ra.Cover {
+			diffs.AlbumCoversToSet = append(diffs.AlbumCoversToSet, album)
+		}
 	}
 	for albumID, album := range al.RemoteAlbums {
 		if _, ok := al.Albums[albumID]; !ok {
@@ -620,6 +697,24 @@ func (c *Client) diff() (*albumDiffs, error) {
 // Pull downloads all the files matching pattern that are not already present
 // in the local storage. Returns the number of files downloaded.
 func (c *Client) Pull(patterns []string, opt GlobOptions) (int, error) {
+	return c.pull(context.Background(), patterns, opt, false)
+}
+
+// PullContext is like Pull, but it stops when ctx is canceled. The files that
+// were not downloaded yet are reported as errors.
+func (c *Client) PullContext(ctx context.Context, patterns []string, opt GlobOptions) (int, error) {
+	return c.pull(ctx, patterns, opt, false)
+}
+
+// PullThumbnails downloads the thumbnails of all the files matching pattern
+// that are not already present in the local storage. It is much faster than
+// Pull, and makes the files browsable before their content is downloaded.
+// Returns the number of thumbnails downloaded.
+func (c *Client) PullThumbnails(patterns []string, opt GlobOptions) (int, error) {
+	return c.pull(context.Background(), patterns, opt, true)
+}
+
+func (c *Client) pull(ctx context.Context, patterns []string, opt GlobOptions, thumb bool) (int, error) {
 	list, err := c.GlobFiles(patterns, opt)
 	if err != nil {
 		return 0, err
@@ -629,7 +724,7 @@ func (c *Client) Pull(patterns []string, opt GlobOptions) (int, error) {
 		if item.IsDir || item.LocalOnly {
 			continue
 		}
-		fn := c.blobPath(item.FSFile.File, false)
+		fn := c.blobPath(item.FSFile.File, thumb)
 		if _, err := os.Stat(fn); errors.Is(err, os.ErrNotExist) {
 			files[item.FSFile.File] = item
 		}
@@ -638,7 +733,7 @@ func (c *Client) Pull(patterns []string, opt GlobOptions) (int, error) {
 	qCh := make(chan ListItem)
 	eCh := make(chan error)
 	for i := 0; i < 5; i++ {
-		go c.downloadWorker(qCh, eCh)
+		go c.downloadWorker(ctx, qCh, eCh, thumb)
 	}
 	go func() {
 		for _, li := range files {
@@ -654,7 +749,11 @@ func (c *Client) Pull(patterns []string, opt GlobOptions) (int, error) {
 		}
 	}
 	if len(files) == 0 {
-		fmt.Fprintln(c.writer, "No files to download.")
+		if thumb {
+			c.Info("No thumbnails to download.")
+		} else {
+			c.Info("No files to download.")
+		}
 	}
 	count := len(files) - len(errors)
 	if errors != nil {
@@ -664,179 +763,382 @@ func (c *Client) Pull(patterns []string, opt GlobOptions) (int, error) {
 }
 
 // Free deletes all the files matching pattern that are already present in the
-// remote storage. Returns the number of files freed.
-func (c *Client) Free(patterns []string, opt GlobOptions) (int, error) {
+// remote storage. Files in locked albums and pinned files are skipped unless
+// force is true.
+// Returns the number of files freed.
+func (c *Client) Free(patterns []string, opt GlobOptions, force bool) (int, error) {
 	list, err := c.GlobFiles(patterns, opt)
 	if err != nil {
 		return 0, err
 	}
+	pl, err := c.Pins()
+	if err != nil {
+		return 0, err
+	}
 	count := 0
+	var errs []error
 	for _, item := range list {
 		if item.IsDir || item.LocalOnly {
 			continue
 		}
-		deleted := false
-		err := os.Remove(c.blobPath(item.FSFile.File, false))
-		if err == nil {
-			deleted = true
-		}
-		if err != nil && !errors.Is(err, os.ErrNotExist) {
-			return count, err
+		if !force && isLocked(item.Album) {
+			c.Infof("Skipped %s (locked album)\n", item.Filename)
+			continue
 		}
-		if err = os.Remove(c.blobPath(item.FSFile.File, true)); err == nil {
-			deleted = true
+		if !force && pl.IsPinned(item) {
+			c.Infof("Skipped %s (pinned)\n", item.Filename)
+			continue
 		}
-		if err != nil && !errors.Is(err, os.ErrNotExist) {
-			return count, err
+		deleted, err := c.freeItem(item, true)
+		if err != nil {
+			c.Infof("Failed to free %s: %v\n", item.Filename, err)
+			errs = append(errs, fmt.Errorf("%s: %w", item.Filename, err))
+			continue
 		}
 		if deleted {
-			c.Printf("Freed %s\n", item.Filename)
+			c.Infof("Freed %s\n", item.Filename)
 			count++
 		}
 	}
+	if len(errs) > 0 {
+		c.Infof("Freed %d file(s), %d failed.\n", count, len(errs))
+		return count, fmt.Errorf("failed to free %d file(s): %w", len(errs), errors.Join(errs...))
+	}
 	if count == 0 {
-		fmt.Fprintln(c.writer, "There are no files to free.")
+		c.Info("There are no files to free.")
 	}
 	return count, nil
 }
 
+// freeItem deletes the local copy of item's content, and optionally its
+// thumbnail. Returns true if anything was deleted.
+func (c *Client) freeItem(item ListItem, thumb bool) (bool, error) {
+	deleted := false
+	err := os.Remove(c.blobPath(item.FSFile.File, false))
+	if err == nil {
+		deleted = true
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return deleted, err
+	}
+	if !thumb {
+		return deleted, nil
+	}
+	if err = os.Remove(c.blobPath(item.FSFile.File, true)); err == nil {
+		deleted = true
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return deleted, err
+	}
+	return deleted, nil
+}
+
 func (c *Client) blobPath(name string, thumb bool) string {
+	return c.blobPathWithDepth(name, thumb, c.BlobShardDepth)
+}
+
+// blobPathWithDepth returns the path of a blob when blobs are sharded in depth
+// levels of directories, e.g. aa/bb/aabbcc... with depth 2.
+func (c *Client) blobPathWithDepth(name string, thumb bool, depth int) string {
 	if thumb {
 		name = name + "-thumb"
 	}
-	return filepath.Join(c.storage.Dir(), c.fileHash(name))
+	n := c.nameHash(name)
+	if depth < 1 {
+		depth = 1
+	}
+	parts := []string{c.storage.Dir()}
+	for i := 0; i < depth && 2*i+2 < len(n); i++ {
+		parts = append(parts, n[2*i:2*i+2])
+	}
+	return filepath.Join(append(parts, n)...)
 }
 
-func (c *Client) downloadWorker(ch <-chan ListItem, out chan<- error) {
+func (c *Client) downloadWorker(ctx context.Context, ch <-chan ListItem, out chan<- error, thumb bool) {
 	for i := range ch {
-		c.Printf("Downloading %s\n", i.Filename)
-		out <- c.downloadFile(i)
+		if err := ctx.Err(); err != nil {
+			out <- fmt.Errorf("%s: %w", i.Filename, err)
+			continue
+		}
+		if thumb {
+			c.Infof("Downloading thumbnail of %s\n", i.Filename)
+		} else {
+			c.Infof("Downloading %s\n", i.Filename)
+		}
+		out <- c.downloadFile(ctx, i, thumb)
 	}
 }
 
-func (c *Client) uploadWorker(ch <-chan FileLoc, out chan<- error) {
+func (c *Client) uploadWorker(ctx context.Context, ch <-chan []FileLoc, out chan<- error) {
 	for l := range ch {
-		out <- c.uploadFile(l)
+		if err := ctx.Err(); err != nil {
+			out <- err
+			continue
+		}
+		if len(l) == 1 {
+			out <- c.uploadFile(ctx, l[0])
+			continue
+		}
+		out <- c.uploadBatch(ctx, l)
 	}
 }
 
-func (c *Client) downloadFile(li ListItem) error {
-	r, err := c.download(li.FSFile.File, li.Set, "0")
+// ensureDownloaded downloads the content of li to the local storage, if it
+// isn't already there. In offline mode, a missing file is an error.
+func (c *Client) ensureDownloaded(li ListItem) error {
+	if _, err := os.Stat(li.FilePath); !errors.Is(err, os.ErrNotExist) || li.LocalOnly {
+		return err
+	}
+	if c.offline {
+		return fmt.Errorf("%s isn't available locally: %w", li.Filename, ErrOffline)
+	}
+	return c.downloadFile(context.Background(), li, false)
+}
+
+// downloadFile downloads the content, or the thumbnail, of li to the local
+// storage.
+func (c *Client) downloadFile(ctx context.Context, li ListItem, thumb bool) error {
+	t := "0"
+	if thumb {
+		t = "1"
+	}
+	r, err := c.download(ctx, li.FSFile.File, li.Set, t)
 	if err != nil {
 		return err
 	}
 	defer r.Close()
-	fn := c.blobPath(li.FSFile.File, false)
+	fn := c.blobPath(li.FSFile.File, thumb)
 	dir, _ := filepath.Split(fn)
-	if err := os.MkdirAll(dir, 0700); err != nil {
+	if err := c.blobPerm.MkdirAll(dir); err != nil {
 		return err
 	}
-	tmp := fmt.Sprintf("%s-tmp-%d", fn, time.Now().UnixNano())
-	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_SYNC, 0600)
+	f, tmp, err := c.createBlobTemp(fn)
 	if err != nil {
 		return err
 	}
 	if _, err := io.Copy(f, r); err != nil {
 		f.Close()
+		os.Remove(tmp)
 		return err
 	}
 	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := c.commitBlobTemp(tmp, fn); err != nil {
+		return err
+	}
+	if !thumb {
+		c.recordAccess(li.FSFile.File)
+	}
+	return nil
+}
+
+func (c *Client) uploadFile(ctx context.Context, item FileLoc) error {
+	if c.Account == nil {
+		return ErrNotLoggedIn
+	}
+	sr, err := c.sendMultipart(ctx, "/v2/sync/upload", func(w *multipart.Writer) error {
+		return c.writeUploadParts(w, item, "")
+	})
+	if err != nil {
 		return err
 	}
-	return os.Rename(tmp, fn)
+	if sr.Status != "ok" {
+		return &ServerError{sr}
+	}
+	return nil
 }
 
-func (c *Client) uploadFile(item FileLoc) error {
+// uploadBatch uploads multiple files with a single request. The server adds
+// each file independently. An error is returned if any of them failed. When
+// the server doesn't support batch uploads, the files are uploaded one at a
+// time, and batch uploads aren't attempted again.
+func (c *Client) uploadBatch(ctx context.Context, items []FileLoc) error {
 	if c.Account == nil {
 		return ErrNotLoggedIn
 	}
+	if c.noBatchUpload.Load() {
+		return c.uploadFiles(ctx, items)
+	}
+	sr, err := c.sendMultipart(ctx, "/v2/sync/uploadBatch", func(w *multipart.Writer) error {
+		for i, item := range items {
+			if err := c.writeUploadParts(w, item, strconv.Itoa(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil && sr.Status != "ok" {
+		err = &ServerError{sr}
+	}
+	if err == errEndpointNotFound || isNotImplemented(sr) {
+		log.Infof("Falling back to individual uploads: %v", err)
+		c.noBatchUpload.Store(true)
+		return c.uploadFiles(ctx, items)
+	}
+	if err != nil {
+		return err
+	}
+	results, ok := sr.Part("results").([]interface{})
+	if !ok || len(results) != len(items) {
+		return fmt.Errorf("server returned unexpected results: %v", sr.Part("results"))
+	}
+	var errors []error
+	for i, r := range results {
+		if r != "ok" {
+			errors = append(errors, fmt.Errorf("%s: %v", items[i].File.File, r))
+		}
+	}
+	if errors != nil {
+		return fmt.Errorf("%w %v", errors[0], errors[1:])
+	}
+	return nil
+}
+
+// isNotImplemented returns whether sr is the response of a server that doesn't
+// implement the request.
+func isNotImplemented(sr *stingle.Response) bool {
+	if sr == nil || sr.Status == "ok" {
+		return false
+	}
+	for _, e := range sr.Errors {
+		if e == stingle.NotImplementedError {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadFiles uploads files one at a time. An error is returned if any of
+// them failed.
+func (c *Client) uploadFiles(ctx context.Context, items []FileLoc) error {
+	var errors []error
+	for _, item := range items {
+		if err := c.uploadFile(ctx, item); err != nil {
+			errors = append(errors, fmt.Errorf("%s: %w", item.File.File, err))
+		}
+	}
+	if errors != nil {
+		return fmt.Errorf("%w %v", errors[0], errors[1:])
+	}
+	return nil
+}
+
+// writeUploadParts writes the file, thumbnail, and metadata of item to w. The
+// form names are suffixed with suffix.
+func (c *Client) writeUploadParts(w *multipart.Writer, item FileLoc, suffix string) error {
+	for _, f := range []string{"file", "thumb"} {
+		pw, err := w.CreateFormFile(f+suffix, item.File.File)
+		if err != nil {
+			return fmt.Errorf("multipart.CreateFormFile(%s): %w", item.File.File, err)
+		}
+		in, err := os.Open(c.blobPath(item.File.File, f == "thumb"))
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(pw, in); err != nil {
+			in.Close()
+			return fmt.Errorf("Read(%s): %w", item.File.File, err)
+		}
+		if err := in.Close(); err != nil {
+			return fmt.Errorf("Close(%s): %w", item.File.File, err)
+		}
+	}
+	for _, f := range []struct{ name, value string }{
+		{"headers", item.File.Headers},
+		{"set", item.Set},
+		{"albumId", item.AlbumID},
+		{"dateCreated", item.File.DateCreated.String()},
+		{"dateModified", item.File.DateModified.String()},
+		{"version", item.File.Version},
+	} {
+		pw, err := w.CreateFormField(f.name + suffix)
+		if err != nil {
+			return fmt.Errorf("Metadata(%s): %w", item.File.File, err)
+		}
+		if _, err := pw.Write([]byte(f.value)); err != nil {
+			return fmt.Errorf("Metadata(%s): %w", item.File.File, err)
+		}
+	}
+	return nil
+}
+
+// sendMultipart sends a multipart/form-data request to the server. The parts
+// are written by writeParts, and the session token is added at the end.
+func (c *Client) sendMultipart(ctx context.Context, uri string, writeParts func(*multipart.Writer) error) (*stingle.Response, error) {
+	if c.offline {
+		return nil, ErrOffline
+	}
 	pr, pw := io.Pipe()
 	w := multipart.NewWriter(pw)
 
 	go func() {
-		defer pw.Close()
-		for _, f := range []string{"file", "thumb"} {
-			pw, err := w.CreateFormFile(f, item.File.File)
-			if err != nil {
-				log.Errorf("multipart.CreateFormFile(%s): %v", item.File.File, err)
-				return
-			}
-			in, err := os.Open(c.blobPath(item.File.File, f == "thumb"))
-			if err != nil {
-				log.Errorf("Open(%s): %v", item.File.File, err)
-				return
-			}
-			if _, err := io.Copy(pw, in); err != nil {
-				log.Errorf("Read(%s): %v", item.File.File, err)
-				return
-			}
-			if err := in.Close(); err != nil {
-				log.Errorf("Close(%s): %v", item.File.File, err)
-				return
+		err := writeParts(w)
+		if err == nil {
+			var tw io.Writer
+			if tw, err = w.CreateFormField("token"); err == nil {
+				_, err = tw.Write([]byte(c.Account.Token))
 			}
 		}
-		for _, f := range []struct{ name, value string }{
-			{"headers", item.File.Headers},
-			{"set", item.Set},
-			{"albumId", item.AlbumID},
-			{"dateCreated", item.File.DateCreated.String()},
-			{"dateModified", item.File.DateModified.String()},
-			{"version", item.File.Version},
-			{"token", c.Account.Token},
-		} {
-			pw, err := w.CreateFormField(f.name)
-			if err != nil {
-				log.Errorf("Metadata(%s): %v", item.File.File, err)
-				return
-			}
-			if _, err := pw.Write([]byte(f.value)); err != nil {
-				log.Errorf("Metadata(%s): %v", item.File.File, err)
-				return
-			}
+		if err == nil {
+			err = w.Close()
 		}
-		if err := w.Close(); err != nil {
-			log.Errorf("multipart.Writer(%s): %v", item.File.File, err)
-			return
+		if err != nil {
+			log.Errorf("%s: %v", uri, err)
 		}
+		pw.CloseWithError(err)
 	}()
 
-	url := strings.TrimSuffix(c.Account.ServerBaseURL, "/") + "/v2/sync/upload"
+	url := strings.TrimSuffix(c.Account.ServerBaseURL, "/") + uri
 
-	req, err := http.NewRequest("POST", url, pr)
+	// There is no overall deadline for uploads. They are only canceled if
+	// they stop making progress, or if ctx is canceled.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stall := c.newStallDetector(cancel)
+	defer stall.stop()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, &stallReader{pr, stall})
 	if err != nil {
-		return err
+		pr.CloseWithError(err)
+		return nil, err
 	}
 	req.Header.Set("Content-Type", w.FormDataContentType())
-	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("User-Agent", c.userAgent)
+	if err := c.signRequest(req, c.Account.Token); err != nil {
+		pr.CloseWithError(err)
+		return nil, err
+	}
 	resp, err := c.hc.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
+	c.checkClockSkew(resp)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errEndpointNotFound
+	}
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("request returned status code %d", resp.StatusCode)
+		return nil, fmt.Errorf("request returned status code %d", resp.StatusCode)
 	}
 	dec := json.NewDecoder(resp.Body)
 	dec.UseNumber()
 	var sr stingle.Response
 	if err := dec.Decode(&sr); err != nil {
-		return err
+		return nil, err
 	}
 	log.Debugf("Response: %v", sr)
-	if sr.Status != "ok" {
-		return sr
-	}
-	return nil
+	return &sr, nil
 }
 
-func (c *Client) sendAddAlbum(album *stingle.Album) error {
+func (c *Client) sendAddAlbum(ctx context.Context, album *stingle.Album) error {
 	if c.Account == nil {
 		return ErrNotLoggedIn
 	}
 	params := make(map[string]string)
 	params["albumId"] = album.AlbumID
 	params["dateCreated"] = album.DateCreated.String()
-	params["dateModified"] = nowString()
+	params["dateModified"] = c.nowString()
 	params["encPrivateKey"] = album.EncPrivateKey
 	params["metadata"] = album.Metadata
 	params["publicKey"] = album.PublicKey
@@ -844,17 +1146,17 @@ func (c *Client) sendAddAlbum(album *stingle.Album) error {
 	form.Set("token", c.Account.Token)
 	form.Set("params", c.encodeParams(params))
 
-	sr, err := c.sendRequest("/v2/sync/addAlbum", form, "")
+	sr, err := c.sendRequestContext(ctx, "/v2/sync/addAlbum", form, "")
 	if err != nil {
 		return err
 	}
 	if sr.Status != "ok" {
-		return sr
+		return &ServerError{sr}
 	}
 	return nil
 }
 
-func (c *Client) sendDeleteAlbum(albumID string) error {
+func (c *Client) sendDeleteAlbum(ctx context.Context, albumID string) error {
 	if c.Account == nil {
 		return ErrNotLoggedIn
 	}
@@ -864,17 +1166,17 @@ func (c *Client) sendDeleteAlbum(albumID string) error {
 	form.Set("token", c.Account.Token)
 	form.Set("params", c.encodeParams(params))
 
-	sr, err := c.sendRequest("/v2/sync/deleteAlbum", form, "")
+	sr, err := c.sendRequestContext(ctx, "/v2/sync/deleteAlbum", form, "")
 	if err != nil {
 		return err
 	}
 	if sr.Status != "ok" {
-		return sr
+		return &ServerError{sr}
 	}
 	return nil
 }
 
-func (c *Client) sendRenameAlbum(album *stingle.Album) error {
+func (c *Client) sendRenameAlbum(ctx context.Context, album *stingle.Album) error {
 	if c.Account == nil {
 		return ErrNotLoggedIn
 	}
@@ -886,17 +1188,39 @@ func (c *Client) sendRenameAlbum(album *stingle.Album) error {
 	form.Set("token", c.Account.Token)
 	form.Set("params", c.encodeParams(params))
 
-	sr, err := c.sendRequest("/v2/sync/renameAlbum", form, "")
+	sr, err := c.sendRequestContext(ctx, "/v2/sync/renameAlbum", form, "")
+	if err != nil {
+		return err
+	}
+	if sr.Status != "ok" {
+		return &ServerError{sr}
+	}
+	return nil
+}
+
+func (c *Client) sendChangeAlbumCover(ctx context.Context, album *stingle.Album) error {
+	if c.Account == nil {
+		return ErrNotLoggedIn
+	}
+	params := make(map[string]string)
+	params["albumId"] = album.AlbumID
+	params["cover"] = album.Cover
+
+	form := url.Values{}
+	form.Set("token", c.Account.Token)
+	form.Set("params", c.encodeParams(params))
+
+	sr, err := c.sendRequestContext(ctx, "/v2/sync/changeAlbumCover", form, "")
 	if err != nil {
 		return err
 	}
 	if sr.Status != "ok" {
-		return sr
+		return &ServerError{sr}
 	}
 	return nil
 }
 
-func (c *Client) sendEditPerms(album *stingle.Album) error {
+func (c *Client) sendEditPerms(ctx context.Context, album *stingle.Album) error {
 	if c.Account == nil {
 		return ErrNotLoggedIn
 	}
@@ -911,17 +1235,17 @@ func (c *Client) sendEditPerms(album *stingle.Album) error {
 	form.Set("token", c.Account.Token)
 	form.Set("params", c.encodeParams(params))
 
-	sr, err := c.sendRequest("/v2/sync/editPerms", form, "")
+	sr, err := c.sendRequestContext(ctx, "/v2/sync/editPerms", form, "")
 	if err != nil {
 		return err
 	}
 	if sr.Status != "ok" {
-		return sr
+		return &ServerError{sr}
 	}
 	return nil
 }
 
-func (c *Client) sendMoveFiles(key MoveKey, files []*stingle.File) error {
+func (c *Client) sendMoveFiles(ctx context.Context, key MoveKey, files []*stingle.File) error {
 	if c.Account == nil {
 		return ErrNotLoggedIn
 	}
@@ -954,17 +1278,17 @@ func (c *Client) sendMoveFiles(key MoveKey, files []*stingle.File) error {
 	form.Set("token", c.Account.Token)
 	form.Set("params", c.encodeParams(params))
 
-	sr, err := c.sendRequest("/v2/sync/moveFile", form, "")
+	sr, err := c.sendRequestContext(ctx, "/v2/sync/moveFile", form, "")
 	if err != nil {
 		return err
 	}
 	if sr.Status != "ok" {
-		return sr
+		return &ServerError{sr}
 	}
 	return nil
 }
 
-func (c *Client) sendDelete(files []string) error {
+func (c *Client) sendDelete(ctx context.Context, files []string) error {
 	if c.Account == nil {
 		return ErrNotLoggedIn
 	}
@@ -978,12 +1302,12 @@ func (c *Client) sendDelete(files []string) error {
 	form.Set("token", c.Account.Token)
 	form.Set("params", c.encodeParams(params))
 
-	sr, err := c.sendRequest("/v2/sync/delete", form, "")
+	sr, err := c.sendRequestContext(ctx, "/v2/sync/delete", form, "")
 	if err != nil {
 		return err
 	}
 	if sr.Status != "ok" {
-		return sr
+		return &ServerError{sr}
 	}
 	return nil
 }
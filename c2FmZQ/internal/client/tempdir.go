@@ -0,0 +1,108 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"c2FmZQ/internal/log"
+)
+
+// renameFile is os.Rename. Tests replace it to simulate renames across
+// filesystems.
+var renameFile = os.Rename
+
+// SetTempDir sets the directory where blobs are written before they are moved
+// to their final location. The default, "", is the blob's own directory. If
+// dir is on a different filesystem than the blobs, each blob is copied to its
+// own directory before being renamed, which is slower.
+func (c *Client) SetTempDir(dir string) error {
+	if dir != "" {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+	}
+	c.tempDir = dir
+	return nil
+}
+
+// createBlobTemp creates a temporary file where the content of blob fn can be
+// written before calling commitBlobTemp.
+func (c *Client) createBlobTemp(fn string) (io.WriteCloser, string, error) {
+	dir, name := filepath.Split(fn)
+	if c.tempDir != "" {
+		dir = c.tempDir
+	}
+	tmp := filepath.Join(dir, fmt.Sprintf("%s-tmp-%d", name, time.Now().UnixNano()))
+	f, err := c.openBlobForWrite(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	return f, tmp, err
+}
+
+// commitBlobTemp atomically replaces blob fn with the temporary file tmp. When
+// they are on different filesystems, tmp is first copied to fn's directory.
+// tmp is removed if there is an error.
+func (c *Client) commitBlobTemp(tmp, fn string) error {
+	err := renameFile(tmp, fn)
+	if errors.Is(err, syscall.EXDEV) {
+		c.tempDirNote.Do(func() {
+			log.Infof("The temp directory %s is on a different filesystem than %s. Blobs are copied instead of renamed.", c.tempDir, c.storage.Dir())
+		})
+		err = c.copyBlobTemp(tmp, fn)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func (c *Client) copyBlobTemp(tmp, fn string) error {
+	in, err := os.Open(tmp)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp2 := fmt.Sprintf("%s-tmp-%d", fn, time.Now().UnixNano())
+	out, err := c.openBlobForWrite(tmp2, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp2)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp2)
+		return err
+	}
+	if err := os.Rename(tmp2, fn); err != nil {
+		os.Remove(tmp2)
+		return err
+	}
+	return os.Remove(tmp)
+}
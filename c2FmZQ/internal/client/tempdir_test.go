@@ -0,0 +1,79 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestTempDir(t *testing.T) {
+	c, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	c.SetQuiet(true)
+	if err := c.SetTempDir(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("SetTempDir(missing) should have failed")
+	}
+	tempDir := t.TempDir()
+	if err := c.SetTempDir(tempDir); err != nil {
+		t.Fatalf("SetTempDir: %v", err)
+	}
+	defer func() { renameFile = os.Rename }()
+
+	srcDir := t.TempDir()
+	for _, tc := range []struct {
+		name    string
+		rename  func(string, string) error
+		wantErr bool
+	}{
+		{"same-fs", os.Rename, false},
+		{"cross-fs", func(string, string) error {
+			return &os.LinkError{Op: "rename", Err: syscall.EXDEV}
+		}, false},
+		{"error", func(string, string) error {
+			return &os.LinkError{Op: "rename", Err: syscall.EACCES}
+		}, true},
+	} {
+		renameFile = tc.rename
+		src := filepath.Join(srcDir, tc.name)
+		if err := os.WriteFile(src, []byte(tc.name), 0600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		_, err := c.ImportFiles([]string{src}, "gallery", false)
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("%s: ImportFiles: %v", tc.name, err)
+		}
+		if entries, err := os.ReadDir(tempDir); err != nil || len(entries) != 0 {
+			t.Errorf("%s: temp dir not empty: %v %v", tc.name, entries, err)
+		}
+		if tc.wantErr {
+			continue
+		}
+		exportDir := t.TempDir()
+		if _, err := c.ExportFiles([]string{"gallery/" + tc.name}, exportDir, ExportOptions{}); err != nil {
+			t.Fatalf("%s: ExportFiles: %v", tc.name, err)
+		}
+		if b, err := os.ReadFile(filepath.Join(exportDir, tc.name)); err != nil || string(b) != tc.name {
+			t.Errorf("%s: exported content = %q, %v", tc.name, b, err)
+		}
+	}
+}
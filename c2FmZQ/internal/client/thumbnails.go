@@ -0,0 +1,218 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+
+	"c2FmZQ/internal/stingle"
+)
+
+// RegenerateThumbnails creates new thumbnails for the files that match the
+// patterns, using the original files that are already downloaded. Files whose
+// content is not available locally are skipped. The new thumbnails are
+// uploaded to the server for files that were already synced.
+func (c *Client) RegenerateThumbnails(patterns []string, opt GlobOptions) (int, error) {
+	list, err := c.GlobFiles(patterns, opt)
+	if err != nil {
+		return 0, err
+	}
+	// The same file can be in more than one place, e.g. in the gallery and
+	// in an album. They all share the same blobs.
+	var groups [][]ListItem
+	index := make(map[string]int)
+	for _, item := range list {
+		if item.IsDir {
+			continue
+		}
+		if i, ok := index[item.FSFile.File]; ok {
+			groups[i] = append(groups[i], item)
+			continue
+		}
+		if _, err := os.Stat(c.blobPath(item.FSFile.File, false)); err != nil {
+			c.Infof("Skipped %s (not downloaded)\n", item.Filename)
+			continue
+		}
+		index[item.FSFile.File] = len(groups)
+		groups = append(groups, []ListItem{item})
+	}
+	if len(groups) == 0 {
+		c.Info("There are no thumbnails to regenerate.")
+		return 0, nil
+	}
+
+	qCh := make(chan []ListItem)
+	rCh := make(chan error)
+	for i := 0; i < 5; i++ {
+		go func() {
+			for g := range qCh {
+				c.Infof("Regenerating thumbnail for %s\n", g[0].Filename)
+				err := c.regenerateThumbnail(g)
+				if err != nil {
+					c.Infof("Failed to regenerate thumbnail for %s: %v\n", g[0].Filename, err)
+					err = fmt.Errorf("%s: %w", g[0].Filename, err)
+				}
+				rCh <- err
+			}
+		}()
+	}
+	go func() {
+		for _, g := range groups {
+			qCh <- g
+		}
+		close(qCh)
+	}()
+	count := 0
+	var errs []error
+	for range groups {
+		if err := <-rCh; err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		count++
+	}
+	if count > 0 && c.Account != nil {
+		if err := c.GetUpdates(true); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return count, fmt.Errorf("failed to regenerate %d thumbnail(s): %w", len(errs), errors.Join(errs...))
+	}
+	return count, nil
+}
+
+// regenerateThumbnail creates a new thumbnail for the file in items, updates
+// the headers of all the items, and uploads the file again where needed.
+func (c *Client) regenerateThumbnail(items []ListItem) (retErr error) {
+	first := items[0]
+	sk := c.SecretKey()
+	defer sk.Wipe()
+
+	hdr, err := first.Header(sk)
+	if err != nil {
+		return err
+	}
+	defer hdr.Wipe()
+	in, err := os.Open(c.blobPath(first.FSFile.File, false))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := stingle.SkipHeader(in); err != nil {
+		return err
+	}
+	thumb, err := c.makeThumbnail(stingle.DecryptFile(in, hdr), sanitize(string(hdr.Filename)), hdr.FileType)
+	if err != nil {
+		return err
+	}
+
+	thumbHdr, err := first.ThumbHeader(sk)
+	if err != nil {
+		return err
+	}
+	defer thumbHdr.Wipe()
+	thumbHdr.SymmetricKey = make([]byte, len(thumbHdr.SymmetricKey))
+	if _, err := rand.Read(thumbHdr.SymmetricKey); err != nil {
+		return err
+	}
+	thumbHdr.DataSize = int64(len(thumb))
+
+	// Re-encrypt the headers for each location with the new thumbnail key.
+	var blobPK stingle.PublicKey
+	newFiles := make([]stingle.File, len(items))
+	locs := make([]FileLoc, len(items))
+	for i, item := range items {
+		isk, pk := sk, c.PublicKey()
+		if item.Album != nil {
+			if isk, err = c.SKForAlbum(item.Album); err != nil {
+				return err
+			}
+			pk = isk.PublicKey()
+		}
+		if i == 0 {
+			blobPK = pk
+		}
+		hdrs, err := stingle.DecryptBase64Headers(item.FSFile.Headers, isk)
+		if item.Album != nil {
+			isk.Wipe()
+		}
+		if err != nil {
+			return err
+		}
+		hdrs[1].Wipe()
+		hdrs[1] = thumbHdr
+		h, err := stingle.EncryptBase64Headers(hdrs, pk)
+		hdrs[0].Wipe()
+		if err != nil {
+			return err
+		}
+		newFiles[i] = item.FSFile
+		newFiles[i].Headers = h
+		newFiles[i].DateModified = c.nowJSON()
+		locs[i] = FileLoc{File: &newFiles[i], Set: item.Set}
+		if item.Album != nil {
+			locs[i].AlbumID = item.Album.AlbumID
+		}
+	}
+
+	thumbPath := c.blobPath(first.FSFile.File, true)
+	backup := thumbPath + ".bak"
+	if err := os.Rename(thumbPath, backup); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	defer func() {
+		if retErr != nil {
+			os.Rename(backup, thumbPath)
+			return
+		}
+		os.Remove(backup)
+	}()
+	if err := c.encryptFile(bytes.NewReader(thumb), first.FSFile.File, thumbHdr, blobPK, true); err != nil {
+		return err
+	}
+
+	for i, item := range items {
+		if item.LocalOnly {
+			continue
+		}
+		if err := c.uploadFile(context.Background(), locs[i]); err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, len(items))
+	for i, item := range items {
+		names[i] = item.FileSet
+	}
+	commit, fileSets, err := c.fileSetsForUpdate(names)
+	if err != nil {
+		return err
+	}
+	for i, fs := range fileSets {
+		if _, ok := fs.Files[newFiles[i].File]; ok {
+			fs.Files[newFiles[i].File] = &newFiles[i]
+		}
+	}
+	return commit(true, nil)
+}
@@ -0,0 +1,120 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"c2FmZQ/internal/client"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestRegenerateThumbnails(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 3); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "*")}, "gallery", false); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+	if err := c.AddAlbums([]string{"alpha"}); err != nil {
+		t.Fatalf("c.AddAlbums: %v", err)
+	}
+	if err := c.Copy([]string{"gallery/image000.jpg"}, "alpha", false); err != nil {
+		t.Fatalf("c.Copy: %v", err)
+	}
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+	if _, err := c.Free([]string{"gallery/image002.jpg"}, client.GlobOptions{}, false); err != nil {
+		t.Fatalf("c.Free: %v", err)
+	}
+	before, err := c.GlobFiles([]string{"gallery/*", "alpha/*"}, client.GlobOptions{})
+	if err != nil || len(before) != 4 {
+		t.Fatalf("c.GlobFiles: %d, %v", len(before), err)
+	}
+
+	n, err := c.RegenerateThumbnails([]string{"gallery/*", "alpha/*"}, client.GlobOptions{})
+	if err != nil {
+		t.Fatalf("c.RegenerateThumbnails: %v", err)
+	}
+	if want := 2; n != want {
+		t.Errorf("c.RegenerateThumbnails() = %d, want %d", n, want)
+	}
+
+	after, err := c.GlobFiles([]string{"gallery/*", "alpha/*"}, client.GlobOptions{})
+	if err != nil || len(after) != 4 {
+		t.Fatalf("c.GlobFiles: %d, %v", len(after), err)
+	}
+	for i := range after {
+		changed := after[i].FSFile.Headers != before[i].FSFile.Headers
+		if want := after[i].Filename != "gallery/image002.jpg"; changed != want {
+			t.Errorf("%s: headers changed = %v, want %v", after[i].Filename, changed, want)
+		}
+	}
+	if err := c.Sync(true); err != nil {
+		t.Errorf("c.Sync(dryrun): %v", err)
+	}
+
+	// The new thumbnails should be readable from another client.
+	c2, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	if err := c2.Login(url, "alice@", "pass"); err != nil {
+		t.Fatalf("c2.Login: %v", err)
+	}
+	if err := c2.GetUpdates(true); err != nil {
+		t.Fatalf("c2.GetUpdates: %v", err)
+	}
+	backupDir := t.TempDir()
+	if _, err := c2.FullBackup(backupDir, ""); err != nil {
+		t.Fatalf("c2.FullBackup: %v", err)
+	}
+	list, err := c2.GlobFiles([]string{"gallery/*", "alpha/*"}, client.GlobOptions{})
+	if err != nil || len(list) != 4 {
+		t.Fatalf("c2.GlobFiles: %d, %v", len(list), err)
+	}
+	sk := c2.SecretKey()
+	defer sk.Wipe()
+	for _, item := range list {
+		hdr, err := item.ThumbHeader(sk)
+		if err != nil {
+			t.Fatalf("%s: ThumbHeader: %v", item.Filename, err)
+		}
+		f, err := os.Open(filepath.Join(backupDir, "thumbs", item.FSFile.File))
+		if err != nil {
+			t.Fatalf("%s: %v", item.Filename, err)
+		}
+		if err := stingle.SkipHeader(f); err != nil {
+			t.Fatalf("%s: SkipHeader: %v", item.Filename, err)
+		}
+		if _, err := png.Decode(stingle.DecryptFile(f, hdr)); err != nil {
+			t.Errorf("%s: png.Decode: %v", item.Filename, err)
+		}
+		f.Close()
+	}
+}
@@ -0,0 +1,146 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Timeouts are the network timeouts used by the client. A zero value means no
+// timeout.
+type Timeouts struct {
+	// Dial is the maximum time to establish a connection.
+	Dial time.Duration
+	// TLSHandshake is the maximum time to complete a TLS handshake.
+	TLSHandshake time.Duration
+	// Request is the maximum duration of an API request. It doesn't apply
+	// to uploads and downloads, which can take much longer.
+	Request time.Duration
+	// Stall is the maximum time an upload or download can go without
+	// making any progress.
+	Stall time.Duration
+}
+
+// DefaultTimeouts returns the timeouts used by default.
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		Dial:         30 * time.Second,
+		TLSHandshake: 10 * time.Second,
+		Request:      2 * time.Minute,
+		Stall:        time.Minute,
+	}
+}
+
+// SetTimeouts sets the network timeouts. The dial and TLS handshake timeouts
+// don't apply to a client set with SetHTTPClient.
+func (c *Client) SetTimeouts(t Timeouts) {
+	c.timeouts = t
+	c.hc = c.traceHTTPClient(newHTTPClient(c.timeouts, c.tlsConfig))
+}
+
+// SetTLSConfig sets the TLS configuration used to connect to the server, e.g.
+// to trust a custom root CA.
+func (c *Client) SetTLSConfig(cfg *tls.Config) {
+	c.tlsConfig = cfg
+	c.hc = c.traceHTTPClient(newHTTPClient(c.timeouts, c.tlsConfig))
+}
+
+func newHTTPClient(t Timeouts, tlsConfig *tls.Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   t.Dial,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = t.TLSHandshake
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}
+}
+
+// requestContext returns a context for an API request, derived from ctx.
+func (c *Client) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.timeouts.Request <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.timeouts.Request)
+}
+
+// stallDetector calls cancel when progress isn't called for a while.
+type stallDetector struct {
+	mu    sync.Mutex
+	timer *time.Timer
+	d     time.Duration
+}
+
+func (c *Client) newStallDetector(cancel func()) *stallDetector {
+	s := &stallDetector{d: c.timeouts.Stall}
+	if s.d > 0 {
+		s.timer = time.AfterFunc(s.d, cancel)
+	}
+	return s
+}
+
+func (s *stallDetector) progress() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timer != nil {
+		s.timer.Reset(s.d)
+	}
+}
+
+func (s *stallDetector) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+}
+
+// stallReader reports progress to a stallDetector when data is read.
+type stallReader struct {
+	io.Reader
+	s *stallDetector
+}
+
+func (r *stallReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		r.s.progress()
+	}
+	return n, err
+}
+
+// transferBody is the body of a download response. Closing it stops the stall
+// detector and releases the request's context.
+type transferBody struct {
+	stallReader
+	body   io.Closer
+	cancel context.CancelFunc
+}
+
+func (b *transferBody) Close() error {
+	b.s.stop()
+	b.cancel()
+	return b.body.Close()
+}
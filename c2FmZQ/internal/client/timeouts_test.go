@@ -0,0 +1,114 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v2/hang":
+			<-release
+		case "/v2/sync/download":
+			// Send data slowly, but steadily, then stall.
+			for i := 0; i < 5; i++ {
+				w.Write([]byte("data"))
+				w.(http.Flusher).Flush()
+				time.Sleep(100 * time.Millisecond)
+			}
+			<-release
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	c, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	c.Account = &AccountInfo{ServerBaseURL: srv.URL}
+	c.SetTimeouts(Timeouts{
+		Request: 200 * time.Millisecond,
+		Stall:   300 * time.Millisecond,
+	})
+
+	start := time.Now()
+	if _, err := c.sendRequest("/v2/hang", url.Values{}, ""); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("sendRequest returned unexpected error: %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("sendRequest took too long: %s", d)
+	}
+
+	// The download takes longer than the request timeout, but is only
+	// interrupted when it stalls.
+	r, err := c.download(context.Background(), "file", "0", "0")
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err == nil {
+		t.Error("ReadAll should have failed")
+	}
+	if got, want := string(b), "datadatadatadatadata"; got != want {
+		t.Errorf("Unexpected data. Got %q, want %q", got, want)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	c, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	c.Account = &AccountInfo{ServerBaseURL: srv.URL}
+	c.SetTimeouts(Timeouts{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.sendRequestContext(ctx, "/v2/hang", url.Values{}, ""); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("sendRequestContext returned unexpected error: %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("sendRequestContext took too long: %s", d)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.download(ctx, "file", "0", "0"); !errors.Is(err, context.Canceled) {
+		t.Errorf("download returned unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+
+	"c2FmZQ/internal/stingle"
+)
+
+// TokenFile is the content of the file written by ExportLogin and used by
+// WithLogin. It contains the server token of the account, which must be kept
+// secret.
+type TokenFile struct {
+	ServerBaseURL   string            `json:"serverBaseURL"`
+	Email           string            `json:"email"`
+	UserID          int64             `json:"userID"`
+	ServerPublicKey stingle.PublicKey `json:"serverPublicKey"`
+	Token           string            `json:"token"`
+}
+
+// ExportLogin writes the login state of the current account to tokenFile,
+// and its secret key, encrypted with password, to keyBundleFile. They can be
+// used with WithLogin to access the account without logging in.
+func (c *Client) ExportLogin(tokenFile, keyBundleFile string, password []byte) error {
+	if c.Account == nil {
+		return ErrNotLoggedIn
+	}
+	if len(password) == 0 {
+		return errors.New("password is empty")
+	}
+	tf := TokenFile{
+		ServerBaseURL:   c.Account.ServerBaseURL,
+		Email:           c.Account.Email,
+		UserID:          c.Account.UserID,
+		ServerPublicKey: c.Account.ServerPublicKey,
+		Token:           c.Account.Token,
+	}
+	sk := c.SecretKey()
+	bundle := stingle.MakeSecretKeyBundle(password, sk)
+	sk.Wipe()
+	if err := c.writeAtomically(keyBundleFile, func(w io.Writer) error {
+		_, err := io.WriteString(w, bundle)
+		return err
+	}); err != nil {
+		return err
+	}
+	return c.writeAtomically(tokenFile, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(tf)
+	})
+}
+
+// WithLogin returns a LoadOption that uses the login state in tokenFile, and
+// the secret key in keyBundleFile, decrypted with password, instead of the
+// login state saved in the data directory. The login state from these files
+// is never saved in the data directory.
+func WithLogin(tokenFile, keyBundleFile string, password []byte) LoadOption {
+	return func(c *Client) error {
+		b, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return err
+		}
+		var tf TokenFile
+		if err := json.Unmarshal(b, &tf); err != nil {
+			return err
+		}
+		if tf.ServerBaseURL == "" || tf.Token == "" {
+			return errors.New("invalid token file")
+		}
+		bundle, err := os.ReadFile(keyBundleFile)
+		if err != nil {
+			return err
+		}
+		sk, err := stingle.DecodeSecretKeyBundle(password, strings.TrimSpace(string(bundle)))
+		if err != nil {
+			return err
+		}
+		c.savedAccount = c.Account
+		c.loginOverride = true
+		c.Account = &AccountInfo{
+			Email:           tf.Email,
+			SecretKey:       c.encryptSK(sk),
+			IsBackedUp:      true,
+			ServerBaseURL:   tf.ServerBaseURL,
+			UserID:          tf.UserID,
+			ServerPublicKey: tf.ServerPublicKey,
+			Token:           tf.Token,
+		}
+		return nil
+	}
+}
+
+// withSavedAccount returns a copy of the persistent fields of c, with the
+// account that is saved in the data directory.
+func (c *Client) withSavedAccount() *Client {
+	v := reflect.ValueOf(c).Elem()
+	cp := reflect.New(v.Type())
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).IsExported() {
+			cp.Elem().Field(i).Set(v.Field(i))
+		}
+	}
+	out := cp.Interface().(*Client)
+	out.Account = c.savedAccount
+	return out
+}
@@ -0,0 +1,89 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/crypto"
+
+	"c2FmZQ/internal/client"
+)
+
+func TestWithLogin(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 1); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(testdir, "*")}, "gallery", false); err != nil {
+		t.Fatalf("c.ImportFiles: %v", err)
+	}
+	if err := c.Sync(false); err != nil {
+		t.Fatalf("c.Sync: %v", err)
+	}
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	keyBundle := filepath.Join(t.TempDir(), "keybundle")
+	if err := c.ExportLogin(tokenFile, keyBundle, []byte("secret")); err != nil {
+		t.Fatalf("c.ExportLogin: %v", err)
+	}
+
+	masterKey, err := crypto.CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("crypto.CreateAESMasterKeyForTest: %v", err)
+	}
+	s := storage.New(t.TempDir(), masterKey)
+	if _, err := client.Create(masterKey, s); err != nil {
+		t.Fatalf("client.Create: %v", err)
+	}
+	if _, err := client.Load(masterKey, s, client.WithLogin(tokenFile, keyBundle, []byte("wrong"))); err == nil {
+		t.Error("client.Load with wrong password succeeded unexpectedly")
+	}
+	c2, err := client.Load(masterKey, s, client.WithLogin(tokenFile, keyBundle, []byte("secret")))
+	if err != nil {
+		t.Fatalf("client.Load: %v", err)
+	}
+	c2.SetHTTPClient(hc)
+	if err := c2.GetUpdates(true); err != nil {
+		t.Fatalf("c2.GetUpdates: %v", err)
+	}
+	if li, err := c2.GlobFiles([]string{"gallery/*"}, client.GlobOptions{}); err != nil || len(li) != 1 {
+		t.Fatalf("c2.GlobFiles: %d, %v", len(li), err)
+	}
+	if err := c2.SetCacheLimit(1 << 20); err != nil {
+		t.Fatalf("c2.SetCacheLimit: %v", err)
+	}
+
+	// The login state isn't saved, but the other settings are.
+	c3, err := client.Load(masterKey, s)
+	if err != nil {
+		t.Fatalf("client.Load: %v", err)
+	}
+	if c3.Account != nil {
+		t.Errorf("Account was saved: %+v", c3.Account)
+	}
+	if want, got := int64(1<<20), c3.CacheLimit; want != got {
+		t.Errorf("CacheLimit = %d, want %d", got, want)
+	}
+}
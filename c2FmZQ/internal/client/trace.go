@@ -0,0 +1,207 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"c2FmZQ/internal/log"
+)
+
+// redactedFields are the form fields, query parameters, and headers whose
+// values are never logged.
+var redactedFields = map[string]bool{
+	"token":         true,
+	"password":      true,
+	"newpassword":   true,
+	"keybundle":     true,
+	"salt":          true,
+	"newsalt":       true,
+	"params":        true,
+	"authorization": true,
+	"cookie":        true,
+	"set-cookie":    true,
+}
+
+var traceID int64
+
+// SetTrace enables or disables the network trace mode. When enabled, the
+// metadata of every HTTP request and response is logged, with the sensitive
+// values redacted.
+func (c *Client) SetTrace(on bool) {
+	c.trace = on
+	c.hc = c.traceHTTPClient(c.hc)
+}
+
+// traceHTTPClient returns hc with a transport that logs the requests and
+// responses, if trace mode is enabled.
+func (c *Client) traceHTTPClient(hc *http.Client) *http.Client {
+	if !c.trace || hc == nil {
+		return hc
+	}
+	if _, ok := hc.Transport.(*traceTransport); ok {
+		return hc
+	}
+	base := hc.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	out := *hc
+	out.Transport = &traceTransport{base: base}
+	return &out
+}
+
+// traceTransport is a http.RoundTripper that logs the requests and responses.
+type traceTransport struct {
+	base http.RoundTripper
+}
+
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	logger := log.With("trace", atomic.AddInt64(&traceID, 1))
+	start := time.Now()
+
+	fields := []interface{}{
+		"method", req.Method,
+		"url", redactURL(req.URL),
+		"headers", redactHeaders(req.Header),
+	}
+	if req.Body != nil && req.Header.Get("Content-Type") == "application/x-www-form-urlencoded" {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		fields = append(fields, "size", len(body))
+		if form, err := url.ParseQuery(string(body)); err == nil {
+			fields = append(fields, "form", redactValues(form))
+		}
+	} else {
+		fields = append(fields, "size", req.ContentLength)
+	}
+	logger.With(fields...).Info("TRACE request")
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		logger.With("elapsed", time.Since(start), "error", err).Info("TRACE response")
+		return nil, err
+	}
+	resp.Body = &traceBody{
+		ReadCloser: resp.Body,
+		done: func(n int64) {
+			logger.With(
+				"status", resp.StatusCode,
+				"headers", redactHeaders(resp.Header),
+				"size", n,
+				"elapsed", time.Since(start),
+			).Info("TRACE response")
+		},
+	}
+	return resp, nil
+}
+
+// traceBody counts the bytes read from a response body, and reports the total
+// when the body is closed.
+type traceBody struct {
+	io.ReadCloser
+	n    int64
+	done func(n int64)
+}
+
+func (b *traceBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *traceBody) Close() error {
+	if b.done != nil {
+		b.done(b.n)
+		b.done = nil
+	}
+	return b.ReadCloser.Close()
+}
+
+func redacted(s string) string {
+	return fmt.Sprintf("<redacted %d bytes>", len(s))
+}
+
+// redactURL returns u as a string, without the sensitive query parameters or
+// download tokens.
+func redactURL(u *url.URL) string {
+	c := *u
+	if i := strings.Index(c.Path, "/v2/download/"); i >= 0 {
+		c.Path = c.Path[:i] + "/v2/download/REDACTED"
+		c.RawPath = ""
+	}
+	if c.RawQuery != "" {
+		if q, err := url.ParseQuery(c.RawQuery); err == nil {
+			c.RawQuery = redactValues(q)
+		}
+	}
+	return c.String()
+}
+
+// redactValues returns the values, sorted by key, with the values of the
+// sensitive fields redacted.
+func redactValues(v url.Values) string {
+	var keys []string
+	for k := range v {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var out []string
+	for _, k := range keys {
+		for _, val := range v[k] {
+			if redactedFields[strings.ToLower(k)] {
+				val = redacted(val)
+			}
+			out = append(out, k+"="+val)
+		}
+	}
+	return strings.Join(out, "&")
+}
+
+// redactHeaders returns the headers, sorted by name, with the values of the
+// sensitive headers redacted.
+func redactHeaders(h http.Header) string {
+	var keys []string
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var out []string
+	for _, k := range keys {
+		for _, val := range h[k] {
+			if redactedFields[strings.ToLower(k)] {
+				val = redacted(val)
+			}
+			out = append(out, k+": "+val)
+		}
+	}
+	return "{" + strings.Join(out, ", ") + "}"
+}
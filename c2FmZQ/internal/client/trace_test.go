@@ -0,0 +1,97 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"c2FmZQ/internal/log"
+)
+
+func TestTrace(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Set-Cookie", "session=secret-cookie")
+		fmt.Fprint(w, `{"status":"ok","parts":{"token":"secret-response-token"}}`)
+	}))
+	defer srv.Close()
+
+	var mu sync.Mutex
+	var lines []string
+	log.Record = func(args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, fmt.Sprint(args...))
+	}
+	defer func() { log.Record = nil }()
+	defer func(l int) { log.Level = l }(log.Level)
+	log.Level = log.InfoLevel
+
+	c, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	c.Account = &AccountInfo{ServerBaseURL: srv.URL}
+	c.SetTrace(true)
+
+	form := url.Values{}
+	form.Set("token", "secret-token")
+	form.Set("password", "secret-password")
+	form.Set("keyBundle", "secret-bundle")
+	form.Set("email", "alice@example.com")
+	if _, err := c.sendRequest("/v2/login/login", form, ""); err != nil {
+		t.Fatalf("sendRequest: %v", err)
+	}
+
+	mu.Lock()
+	out := strings.Join(lines, "\n")
+	mu.Unlock()
+	for _, want := range []string{"TRACE request", "TRACE response", "/v2/login/login", "email=alice@example.com", "status=200"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Trace doesn't contain %q:\n%s", want, out)
+		}
+	}
+	for _, secret := range []string{"secret-token", "secret-password", "secret-bundle", "secret-cookie", "secret-response-token"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("Trace contains %q:\n%s", secret, out)
+		}
+	}
+}
+
+func TestRedactURL(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"https://example.com/v2/sync/getUpdates", "https://example.com/v2/sync/getUpdates"},
+		{"https://example.com/v2/download/abcdef", "https://example.com/v2/download/REDACTED"},
+		{"https://example.com/foo?token=abc&x=1", "https://example.com/foo?token=<redacted 3 bytes>&x=1"},
+	} {
+		u, err := url.Parse(tc.in)
+		if err != nil {
+			t.Fatalf("url.Parse(%q): %v", tc.in, err)
+		}
+		if got := redactURL(u); got != tc.want {
+			t.Errorf("redactURL(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
@@ -18,6 +18,7 @@
 package client
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -25,11 +26,16 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"sync"
 
 	"c2FmZQ/internal/log"
 	"c2FmZQ/internal/stingle"
 )
 
+// updatesPageSize is the maximum number of records that the server returns
+// for each getUpdates request.
+const updatesPageSize = 5000
+
 // AlbumList represents a list of albums.
 type AlbumList struct {
 	UpdateTimestamps
@@ -66,22 +72,32 @@ func (c *Client) fileSetForUpdate(name string) (func(bool, *error) error, *FileS
 	return commit, fs[0], nil
 }
 
-// fileSetsForUpdate retrieves any number of file sets for update.
+// fileSetsForUpdate retrieves any number of file sets for atomic update, i.e.
+// the changes to all of them are committed together, or not at all. If a name
+// appears more than once, the same FileSet is returned for each occurrence.
 func (c *Client) fileSetsForUpdate(names []string) (func(bool, *error) error, []*FileSet, error) {
 	var filenames []string
-	for i := range names {
-		filenames = append(filenames, c.fileHash(names[i]))
+	index := make(map[string]int)
+	pos := make([]int, len(names))
+	for i, name := range names {
+		j, exists := index[name]
+		if !exists {
+			j = len(filenames)
+			index[name] = j
+			filenames = append(filenames, c.fileHash(name))
+		}
+		pos[i] = j
 	}
 
-	fileSets := make([]*FileSet, len(filenames))
-	for i := range fileSets {
-		fileSets[i] = &FileSet{}
+	unique := make([]*FileSet, len(filenames))
+	for i := range unique {
+		unique[i] = &FileSet{}
 	}
-	commit, err := c.storage.OpenManyForUpdate(filenames, fileSets)
+	commit, err := c.storage.OpenManyForUpdate(filenames, unique)
 	if err != nil {
 		return nil, nil, err
 	}
-	for _, fs := range fileSets {
+	for _, fs := range unique {
 		if fs.Files == nil {
 			fs.Files = make(map[string]*stingle.File)
 		}
@@ -89,6 +105,10 @@ func (c *Client) fileSetsForUpdate(names []string) (func(bool, *error) error, []
 			fs.RemoteFiles = make(map[string]*stingle.File)
 		}
 	}
+	fileSets := make([]*FileSet, len(names))
+	for i := range names {
+		fileSets[i] = unique[pos[i]]
+	}
 	return commit, fileSets, nil
 }
 
@@ -173,7 +193,7 @@ func (c *Client) processContactUpdates(updates []stingle.Contact) (retErr error)
 	return nil
 }
 
-func (c *Client) processFileUpdates(name string, updates []stingle.File) (n int, retErr error) {
+func (c *Client) processFileUpdates(name string, updates []stingle.File) (int, error) {
 	if len(updates) == 0 {
 		return 0, nil
 	}
@@ -181,20 +201,113 @@ func (c *Client) processFileUpdates(name string, updates []stingle.File) (n int,
 	if err != nil {
 		return 0, err
 	}
-	defer commit(true, &retErr)
+	n, conflicts := applyFileUpdates(fs, updates, c.keepLocalOnConflict)
+	if err := commit(true, nil); err != nil {
+		return 0, err
+	}
+	return n, c.recordConflicts(name, conflicts)
+}
+
+// applyFileUpdates applies updates to fs, and returns the number of files that
+// are new, and the files that have local changes that weren't synced yet.
+// These local changes are replaced with the server's version, unless keepLocal
+// is true.
+func applyFileUpdates(fs *FileSet, updates []stingle.File, keepLocal bool) (n int, conflicts []Conflict) {
 	for _, up := range updates {
-		if _, ok := fs.RemoteFiles[up.File]; !ok {
+		remote, ok := fs.RemoteFiles[up.File]
+		if !ok {
 			n++
 		}
 		nf := up
+		// The file was removed or changed locally since the last sync.
+		local, hasLocal := fs.Files[up.File]
+		conflict := ok && (!hasLocal || (local.Headers != remote.Headers && local.Headers != up.Headers))
+		if conflict {
+			conflicts = append(conflicts, Conflict{Local: local, Remote: &nf, KeptLocal: keepLocal})
+		}
 		fs.RemoteFiles[up.File] = &nf
-		fs.Files[up.File] = &nf
+		if !conflict || !keepLocal {
+			fs.Files[up.File] = &nf
+		}
 		d, _ := up.DateModified.Int64()
 		if d > fs.LastUpdateTime {
 			fs.LastUpdateTime = d
 		}
 	}
-	return n, nil
+	return n, conflicts
+}
+
+// RefreshFile fetches the server's current record of a single file, and
+// updates the local file set with it. It is much cheaper than a full
+// GetUpdates when only one file is suspected to be stale. Conflicts with
+// local changes are handled the same way as with GetUpdates.
+func (c *Client) RefreshFile(li ListItem) (retErr error) {
+	if li.IsDir {
+		return fmt.Errorf("%s is a directory", li.Filename)
+	}
+	if li.LocalOnly {
+		return fmt.Errorf("%w: %s is not on the server", ErrFileNotFound, li.Filename)
+	}
+	var albumID string
+	if li.Album != nil {
+		albumID = li.Album.AlbumID
+	}
+	f, err := c.sendGetFile(li.Set, albumID, li.FSFile.File)
+	if err != nil {
+		return err
+	}
+	if f == nil {
+		return fmt.Errorf("%w: %s is not on the server", ErrFileNotFound, li.Filename)
+	}
+	commit, fs, err := c.fileSetForUpdate(li.FileSet)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	if r := fs.RemoteFiles[f.File]; r != nil && *r == *f {
+		return nil
+	}
+	lastUpdate := fs.LastUpdateTime
+	_, conflicts := applyFileUpdates(fs, []stingle.File{*f}, c.keepLocalOnConflict)
+	// The other files in the set may have older updates that weren't
+	// fetched yet.
+	fs.LastUpdateTime = lastUpdate
+	if err := commit(true, nil); err != nil {
+		return err
+	}
+	return c.recordConflicts(li.FileSet, conflicts)
+}
+
+// sendGetFile returns the server's record of a file, or nil if the file
+// isn't in the file set.
+func (c *Client) sendGetFile(set, albumID, file string) (*stingle.File, error) {
+	if c.Account == nil {
+		return nil, ErrNotLoggedIn
+	}
+	params := make(map[string]string)
+	params["set"] = set
+	params["albumId"] = albumID
+	params["file"] = file
+
+	form := url.Values{}
+	form.Set("token", c.Account.Token)
+	form.Set("params", c.encodeParams(params))
+
+	sr, err := c.sendRequest("/v2/sync/getFile", form, "")
+	if err != nil {
+		return nil, err
+	}
+	if sr.Status != "ok" {
+		return nil, &ServerError{sr}
+	}
+	if sr.Part("file") == nil {
+		return nil, nil
+	}
+	var f stingle.File
+	if err := copyJSON(sr.Part("file"), &f); err != nil {
+		return nil, err
+	}
+	return &f, nil
 }
 
 func (c *Client) processAlbumFileUpdates(updates []stingle.File) (retErr error) {
@@ -224,27 +337,38 @@ func (c *Client) processAlbumFileUpdates(updates []stingle.File) (retErr error)
 		if n == 0 {
 			continue
 		}
-		// If the album was deleted locally, bring it back since there
-		// are new files.
-		if _, ok := al.Albums[a]; !ok {
-			al.Albums[a] = al.RemoteAlbums[a]
-			if album := al.Albums[a]; album != nil {
-				sk := c.SecretKey()
-				name, _ := album.Name(sk)
-				sk.Wipe()
-				log.Debugf("Album recovered %q (%s)", name, a)
-			}
-		}
+		c.recoverAlbum(&al, a)
 	}
 	return nil
 }
 
+// recoverAlbum brings back an album that was deleted locally, since it has new
+// files.
+func (c *Client) recoverAlbum(al *AlbumList, albumID string) {
+	if _, ok := al.Albums[albumID]; ok {
+		return
+	}
+	al.Albums[albumID] = al.RemoteAlbums[albumID]
+	if album := al.Albums[albumID]; album != nil {
+		sk := c.SecretKey()
+		name, _ := album.Name(sk)
+		sk.Wipe()
+		log.Debugf("Album recovered %q (%s)", name, albumID)
+	}
+}
+
 func (c *Client) processDeleteFiles(name string, deletes []stingle.DeleteEvent) (retErr error) {
 	commit, fs, err := c.fileSetForUpdate(name)
 	if err != nil {
 		return err
 	}
 	defer commit(true, &retErr)
+	applyDeleteFiles(fs, deletes)
+	return nil
+}
+
+// applyDeleteFiles applies the delete events to fs.
+func applyDeleteFiles(fs *FileSet, deletes []stingle.DeleteEvent) {
 	for _, del := range deletes {
 		d, _ := del.Date.Int64()
 		if f, ok := fs.Files[del.File]; ok {
@@ -263,7 +387,6 @@ func (c *Client) processDeleteFiles(name string, deletes []stingle.DeleteEvent)
 			fs.LastDeleteTime = d
 		}
 	}
-	return nil
 }
 
 func (c *Client) albumHasLocalFileChanges(albumID string) (bool, error) {
@@ -434,98 +557,313 @@ func max(values ...int64) (m int64) {
 	return
 }
 
-func (c *Client) GetUpdates(quiet bool) error {
-	if c.Account == nil {
-		return ErrNotLoggedIn
+// processUpdates applies one page of updates, and returns the most recent
+// timestamp that it contains.
+func (c *Client) processUpdates(sr *stingle.Response) (maxTS int64, err error) {
+	ts := func(n json.Number) {
+		if v, _ := n.Int64(); v > maxTS {
+			maxTS = v
+		}
 	}
-	galleryTS, err := c.getTimestamps(galleryFile)
-	if err != nil {
-		return err
+
+	var (
+		albums     []stingle.Album
+		gallery    []stingle.File
+		trash      []stingle.File
+		albumFiles []stingle.File
+		contacts   []stingle.Contact
+		deletes    []stingle.DeleteEvent
+	)
+	for _, p := range []struct {
+		name  string
+		value interface{}
+	}{
+		{"albums", &albums},
+		{"files", &gallery},
+		{"trash", &trash},
+		{"albumFiles", &albumFiles},
+		{"contacts", &contacts},
+		{"deletes", &deletes},
+	} {
+		if err := copyJSON(sr.Part(p.name), p.value); err != nil {
+			return 0, err
+		}
 	}
-	trashTS, err := c.getTimestamps(trashFile)
-	if err != nil {
-		return err
+	for _, a := range albums {
+		ts(a.DateModified)
 	}
-	albumsTS, err := c.getTimestamps(albumList)
-	if err != nil {
-		return err
+	for _, files := range [][]stingle.File{gallery, trash, albumFiles} {
+		for _, f := range files {
+			ts(f.DateModified)
+		}
 	}
-	contactsTS, err := c.getTimestamps(contactsFile)
-	if err != nil {
-		return err
+	for _, ct := range contacts {
+		ts(ct.DateModified)
 	}
-	albumFilesTS, err := c.getAlbumTimestamps()
-	if err != nil {
-		return err
+	for _, d := range deletes {
+		ts(d.Date)
 	}
-	deleteTS := max(galleryTS.LastDeleteTime, trashTS.LastDeleteTime, albumsTS.LastDeleteTime, contactsTS.LastDeleteTime, albumFilesTS.LastDeleteTime)
 
-	form := url.Values{}
-	form.Set("token", c.Account.Token)
-	form.Set("filesST", strconv.FormatInt(galleryTS.LastUpdateTime, 10))
-	form.Set("trashST", strconv.FormatInt(trashTS.LastUpdateTime, 10))
-	form.Set("albumsST", strconv.FormatInt(albumsTS.LastUpdateTime, 10))
-	form.Set("albumFilesST", strconv.FormatInt(albumFilesTS.LastUpdateTime, 10))
-	form.Set("cntST", strconv.FormatInt(contactsTS.LastUpdateTime, 10))
-	form.Set("delST", strconv.FormatInt(deleteTS, 10))
-	sr, err := c.sendRequest("/v2/sync/getUpdates", form, "")
-	if err != nil {
-		return err
+	if c.parallelSets {
+		return maxTS, c.processUpdatesParallel(albums, gallery, trash, albumFiles, contacts, deletes)
 	}
-	if sr.Status != "ok" {
-		return sr
+	if err := c.processAlbumUpdates(albums); err != nil {
+		return 0, err
 	}
-
-	var albums []stingle.Album
-	if err := copyJSON(sr.Part("albums"), &albums); err != nil {
-		return err
+	if _, err := c.processFileUpdates(galleryFile, gallery); err != nil {
+		return 0, err
+	}
+	if _, err := c.processFileUpdates(trashFile, trash); err != nil {
+		return 0, err
+	}
+	if err := c.processAlbumFileUpdates(albumFiles); err != nil {
+		return 0, err
+	}
+	if err := c.processContactUpdates(contacts); err != nil {
+		return 0, err
 	}
+	if err := c.processDeleteUpdates(deletes); err != nil {
+		return 0, err
+	}
+	return maxTS, nil
+}
+
+// processUpdatesParallel applies the same updates as processUpdates, except
+// that the file updates and file deletions of all the file sets, i.e. gallery,
+// trash, and albums, are applied concurrently and committed together.
+func (c *Client) processUpdatesParallel(albums []stingle.Album, gallery, trash, albumFiles []stingle.File, contacts []stingle.Contact, deletes []stingle.DeleteEvent) (retErr error) {
+	// The album updates create the albums' file sets.
 	if err := c.processAlbumUpdates(albums); err != nil {
 		return err
 	}
 
-	var gallery []stingle.File
-	if err := copyJSON(sr.Part("files"), &gallery); err != nil {
-		return err
+	files := make(map[string][]stingle.File)
+	if len(gallery) > 0 {
+		files[galleryFile] = gallery
 	}
-	if _, err := c.processFileUpdates(galleryFile, gallery); err != nil {
-		return err
+	if len(trash) > 0 {
+		files[trashFile] = trash
+	}
+	for _, f := range albumFiles {
+		files[albumPrefix+f.AlbumID] = append(files[albumPrefix+f.AlbumID], f)
+	}
+	fileDeletes := make(map[string][]stingle.DeleteEvent)
+	var otherDeletes []stingle.DeleteEvent
+	for _, d := range deletes {
+		t, _ := d.Type.Int64()
+		switch t {
+		case stingle.DeleteEventGallery:
+			fileDeletes[galleryFile] = append(fileDeletes[galleryFile], d)
+		case stingle.DeleteEventTrash, stingle.DeleteEventTrashDelete:
+			fileDeletes[trashFile] = append(fileDeletes[trashFile], d)
+		case stingle.DeleteEventAlbumFile:
+			fileDeletes[albumPrefix+d.AlbumID] = append(fileDeletes[albumPrefix+d.AlbumID], d)
+		default:
+			otherDeletes = append(otherDeletes, d)
+		}
 	}
 
-	var trash []stingle.File
-	if err := copyJSON(sr.Part("trash"), &trash); err != nil {
+	newFiles, err := c.processFileSetUpdates(files, fileDeletes)
+	if err != nil {
 		return err
 	}
-	if _, err := c.processFileUpdates(trashFile, trash); err != nil {
-		return err
+	var recovered []string
+	for _, f := range albumFiles {
+		if newFiles[albumPrefix+f.AlbumID] > 0 {
+			recovered = append(recovered, f.AlbumID)
+		}
+	}
+	if len(recovered) > 0 {
+		var al AlbumList
+		commit, err := c.storage.OpenForUpdate(c.fileHash(albumList), &al)
+		if err != nil {
+			return err
+		}
+		for _, a := range recovered {
+			c.recoverAlbum(&al, a)
+		}
+		if err := commit(true, nil); err != nil {
+			return err
+		}
 	}
 
-	var albumFiles []stingle.File
-	if err := copyJSON(sr.Part("albumFiles"), &albumFiles); err != nil {
+	if err := c.processContactUpdates(contacts); err != nil {
 		return err
 	}
-	if err := c.processAlbumFileUpdates(albumFiles); err != nil {
-		return err
+	return c.processDeleteUpdates(otherDeletes)
+}
+
+// processFileSetUpdates applies the file updates, followed by the delete
+// events, of each file set concurrently. All the file sets are committed
+// together, or not at all. It returns the number of new files in each file set.
+func (c *Client) processFileSetUpdates(files map[string][]stingle.File, deletes map[string][]stingle.DeleteEvent) (map[string]int, error) {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	for name := range deletes {
+		if _, ok := files[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	commit, fileSets, err := c.fileSetsForUpdate(names)
+	if err != nil {
+		return nil, err
 	}
 
-	var contacts []stingle.Contact
-	if err := copyJSON(sr.Part("contacts"), &contacts); err != nil {
-		return err
+	counts := make([]int, len(names))
+	conflicts := make([][]Conflict, len(names))
+	var wg sync.WaitGroup
+	for i := range names {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			counts[i], conflicts[i] = applyFileUpdates(fileSets[i], files[names[i]], c.keepLocalOnConflict)
+			applyDeleteFiles(fileSets[i], deletes[names[i]])
+		}(i)
+	}
+	wg.Wait()
+	if err := commit(true, nil); err != nil {
+		return nil, err
+	}
+
+	newFiles := make(map[string]int)
+	for i, name := range names {
+		newFiles[name] = counts[i]
+		if err := c.recordConflicts(name, conflicts[i]); err != nil {
+			return nil, err
+		}
 	}
-	if err := c.processContactUpdates(contacts); err != nil {
+	return newFiles, nil
+}
+
+// rewindTimestamps makes sure that none of the local update timestamps are
+// more recent than ts.
+func (c *Client) rewindTimestamps(ts int64) (retErr error) {
+	rewind := func(t *UpdateTimestamps) {
+		if t.LastUpdateTime > ts {
+			t.LastUpdateTime = ts
+		}
+		if t.LastDeleteTime > ts {
+			t.LastDeleteTime = ts
+		}
+	}
+	var al AlbumList
+	var cl ContactList
+	commit, err := c.storage.OpenManyForUpdate([]string{c.fileHash(albumList), c.fileHash(contactsFile)}, []interface{}{&al, &cl})
+	if err != nil {
 		return err
 	}
+	defer commit(true, &retErr)
+	rewind(&al.UpdateTimestamps)
+	rewind(&cl.UpdateTimestamps)
 
-	var deletes []stingle.DeleteEvent
-	if err := copyJSON(sr.Part("deletes"), &deletes); err != nil {
-		return err
+	names := []string{galleryFile, trashFile}
+	for albumID := range al.Albums {
+		names = append(names, albumPrefix+albumID)
 	}
-	if err := c.processDeleteUpdates(deletes); err != nil {
+	commitFS, fs, err := c.fileSetsForUpdate(names)
+	if err != nil {
 		return err
 	}
+	for _, f := range fs {
+		rewind(&f.UpdateTimestamps)
+	}
+	return commitFS(true, nil)
+}
+
+// SetParallelSets sets whether GetUpdates applies the changes to the gallery,
+// trash, and album file sets concurrently, and commits them together.
+func (c *Client) SetParallelSets(parallel bool) {
+	c.parallelSets = parallel
+}
+
+// updatesForm returns the parameters of a getUpdates request, with the
+// timestamps of the last updates that were applied locally.
+func (c *Client) updatesForm() (url.Values, error) {
+	galleryTS, err := c.getTimestamps(galleryFile)
+	if err != nil {
+		return nil, err
+	}
+	trashTS, err := c.getTimestamps(trashFile)
+	if err != nil {
+		return nil, err
+	}
+	albumsTS, err := c.getTimestamps(albumList)
+	if err != nil {
+		return nil, err
+	}
+	contactsTS, err := c.getTimestamps(contactsFile)
+	if err != nil {
+		return nil, err
+	}
+	albumFilesTS, err := c.getAlbumTimestamps()
+	if err != nil {
+		return nil, err
+	}
+	deleteTS := max(galleryTS.LastDeleteTime, trashTS.LastDeleteTime, albumsTS.LastDeleteTime, contactsTS.LastDeleteTime, albumFilesTS.LastDeleteTime)
+
+	form := url.Values{}
+	form.Set("token", c.Account.Token)
+	form.Set("filesST", strconv.FormatInt(galleryTS.LastUpdateTime, 10))
+	form.Set("trashST", strconv.FormatInt(trashTS.LastUpdateTime, 10))
+	form.Set("albumsST", strconv.FormatInt(albumsTS.LastUpdateTime, 10))
+	form.Set("albumFilesST", strconv.FormatInt(albumFilesTS.LastUpdateTime, 10))
+	form.Set("cntST", strconv.FormatInt(contactsTS.LastUpdateTime, 10))
+	form.Set("delST", strconv.FormatInt(deleteTS, 10))
+	form.Set("pageSize", strconv.Itoa(updatesPageSize))
+	return form, nil
+}
 
+// GetUpdates downloads the metadata changes from the server, and applies them
+// to the local file sets.
+func (c *Client) GetUpdates(quiet bool) error {
+	return c.GetUpdatesContext(context.Background(), quiet)
+}
+
+// GetUpdatesContext is like GetUpdates, but it stops when ctx is canceled. The
+// pages of updates that were already received are kept.
+func (c *Client) GetUpdatesContext(ctx context.Context, quiet bool) error {
+	if c.Account == nil {
+		return ErrNotLoggedIn
+	}
+	// The local files may also have been updated by another process, e.g.
+	// a daemon.
+	c.storage.cache.invalidate()
+	form, err := c.updatesForm()
+	if err != nil {
+		return err
+	}
+	for {
+		sr, err := c.sendRequestContext(ctx, "/v2/sync/getUpdates", form, "")
+		if err != nil {
+			return err
+		}
+		if sr.Status != "ok" {
+			return &ServerError{sr}
+		}
+		maxTS, err := c.processUpdates(sr)
+		if err != nil {
+			return err
+		}
+		// Servers that don't support pagination don't return a cursor.
+		cursor, _ := sr.Part("nextCursor").(string)
+		if cursor == "" {
+			break
+		}
+		// The next page may contain more records with the same timestamp
+		// as the last record of this page. If we're interrupted, the
+		// next call needs to fetch them again.
+		if err := c.rewindTimestamps(maxTS - 1); err != nil {
+			return err
+		}
+		form.Set("cursor", cursor)
+	}
 	if !quiet {
-		fmt.Fprintln(c.writer, "Metadata synced successfully.")
+		c.Info("Metadata synced successfully.")
 	}
 	return nil
 }
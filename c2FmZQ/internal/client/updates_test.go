@@ -0,0 +1,310 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"c2FmZQ/internal/stingle"
+)
+
+func countFiles(t *testing.T, c *Client) (gallery, trash int) {
+	t.Helper()
+	commit, fs, err := c.fileSetsForUpdate([]string{galleryFile, trashFile})
+	if err != nil {
+		t.Fatalf("fileSetsForUpdate: %v", err)
+	}
+	defer commit(false, nil)
+	for f := range fs[0].Files {
+		if fs[1].Files[f] != nil {
+			t.Errorf("%s is in both sets", f)
+		}
+	}
+	return len(fs[0].Files), len(fs[1].Files)
+}
+
+func TestFileSetsForUpdate(t *testing.T) {
+	c, err := newClient(t.TempDir())
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	const numFiles = 20
+
+	commit, fs, err := c.fileSetForUpdate(galleryFile)
+	if err != nil {
+		t.Fatalf("fileSetForUpdate: %v", err)
+	}
+	for i := 0; i < numFiles; i++ {
+		name := fmt.Sprintf("file%d", i)
+		fs.Files[name] = &stingle.File{File: name}
+	}
+	if err := commit(true, nil); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	// Changes are discarded together.
+	commit, fileSets, err := c.fileSetsForUpdate([]string{galleryFile, trashFile})
+	if err != nil {
+		t.Fatalf("fileSetsForUpdate: %v", err)
+	}
+	fileSets[1].Files["file0"] = fileSets[0].Files["file0"]
+	delete(fileSets[0].Files, "file0")
+	retErr := errors.New("abort")
+	commit(false, &retErr)
+	if g, tr := countFiles(t, c); g != numFiles || tr != 0 {
+		t.Errorf("Unexpected number of files after abort. Got %d, %d", g, tr)
+	}
+
+	// The same set can be opened twice.
+	commit, fileSets, err = c.fileSetsForUpdate([]string{galleryFile, galleryFile})
+	if err != nil {
+		t.Fatalf("fileSetsForUpdate: %v", err)
+	}
+	if fileSets[0] != fileSets[1] {
+		t.Error("Expected the same FileSet")
+	}
+	commit(false, nil)
+
+	// Concurrent moves between the two sets, in both directions. No file
+	// should be lost or duplicated.
+	var wg sync.WaitGroup
+	for w := 0; w < 10; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			names := []string{galleryFile, trashFile}
+			if w%2 == 1 {
+				names = []string{trashFile, galleryFile}
+			}
+			for i := 0; i < 10; i++ {
+				commit, fileSets, err := c.fileSetsForUpdate(names)
+				if err != nil {
+					t.Errorf("fileSetsForUpdate: %v", err)
+					return
+				}
+				for name, f := range fileSets[0].Files {
+					delete(fileSets[0].Files, name)
+					fileSets[1].Files[name] = f
+					break
+				}
+				if err := commit(true, nil); err != nil {
+					t.Errorf("commit: %v", err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if g, tr := countFiles(t, c); g+tr != numFiles {
+		t.Errorf("Unexpected number of files. Got %d + %d, want %d", g, tr, numFiles)
+	}
+}
+
+// updatesResponse returns a page of updates with files in the gallery, trash,
+// and albums, and some delete events.
+func updatesResponse(numFiles int, albumIDs []string) *stingle.Response {
+	ts := func(n int) json.Number { return json.Number(fmt.Sprint(n)) }
+	var albums, gallery, trash, albumFiles, deletes []interface{}
+	for i, id := range albumIDs {
+		albums = append(albums, stingle.Album{AlbumID: id, DateModified: ts(i + 1), IsOwner: "1"})
+	}
+	for i := 0; i < numFiles; i++ {
+		gallery = append(gallery, stingle.File{File: fmt.Sprintf("g%d", i), DateModified: ts(i + 1)})
+		trash = append(trash, stingle.File{File: fmt.Sprintf("t%d", i), DateModified: ts(i + 1)})
+		id := albumIDs[i%len(albumIDs)]
+		albumFiles = append(albumFiles, stingle.File{File: fmt.Sprintf("a%d", i), AlbumID: id, DateModified: ts(i + 1)})
+		if i%10 == 0 {
+			deletes = append(deletes,
+				stingle.DeleteEvent{File: fmt.Sprintf("g%d", i), Type: ts(stingle.DeleteEventGallery), Date: ts(numFiles + i)},
+				stingle.DeleteEvent{File: fmt.Sprintf("t%d", i), Type: ts(stingle.DeleteEventTrashDelete), Date: ts(numFiles + i)},
+				stingle.DeleteEvent{File: fmt.Sprintf("a%d", i), AlbumID: id, Type: ts(stingle.DeleteEventAlbumFile), Date: ts(numFiles + i)},
+			)
+		}
+	}
+	return stingle.ResponseOK().
+		AddPartList("albums", albums...).
+		AddPartList("files", gallery...).
+		AddPartList("trash", trash...).
+		AddPartList("albumFiles", albumFiles...).
+		AddPartList("contacts").
+		AddPartList("deletes", deletes...)
+}
+
+func TestProcessUpdatesParallel(t *testing.T) {
+	const numFiles = 3000
+	albumIDs := []string{"album1", "album2", "album3"}
+	sr := updatesResponse(numFiles, albumIDs)
+
+	var clients []*Client
+	for _, parallel := range []bool{false, true} {
+		c, err := newClient(t.TempDir())
+		if err != nil {
+			t.Fatalf("newClient: %v", err)
+		}
+		c.SetParallelSets(parallel)
+		if _, err := c.processUpdates(sr); err != nil {
+			t.Fatalf("processUpdates(parallel=%v): %v", parallel, err)
+		}
+		clients = append(clients, c)
+	}
+
+	// Both clients must end up with the same file sets.
+	names := []string{galleryFile, trashFile}
+	for _, id := range albumIDs {
+		names = append(names, albumPrefix+id)
+	}
+	var sets [2][]*FileSet
+	for i, c := range clients {
+		commit, fs, err := c.fileSetsForUpdate(names)
+		if err != nil {
+			t.Fatalf("fileSetsForUpdate: %v", err)
+		}
+		commit(false, nil)
+		sets[i] = fs
+	}
+	total := 0
+	for i, name := range names {
+		if !reflect.DeepEqual(sets[0][i], sets[1][i]) {
+			t.Errorf("%s: file sets differ", name)
+		}
+		total += len(sets[1][i].Files)
+	}
+	if want := 3 * (numFiles - numFiles/10); total != want {
+		t.Errorf("Unexpected number of files. Got %d, want %d", total, want)
+	}
+
+	// If one of the file sets can't be updated, none of them are.
+	c := clients[1]
+	if err := os.WriteFile(filepath.Join(c.storage.Dir(), c.fileHash(albumPrefix+albumIDs[2])), []byte("garbage"), 0600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	c.storage.cache.invalidate()
+	if _, err := c.processUpdates(updatesResponse(2*numFiles, albumIDs)); err == nil {
+		t.Fatal("processUpdates succeeded unexpectedly")
+	}
+	if g, tr := countFiles(t, c); g != len(sets[1][0].Files) || tr != len(sets[1][1].Files) {
+		t.Errorf("Unexpected number of files after failure. Got %d, %d", g, tr)
+	}
+}
+
+func TestConflicts(t *testing.T) {
+	for _, tc := range []struct {
+		parallel, keepLocal bool
+	}{{false, false}, {false, true}, {true, false}, {true, true}} {
+		c, err := newClient(t.TempDir())
+		if err != nil {
+			t.Fatalf("newClient: %v", err)
+		}
+		c.SetParallelSets(tc.parallel)
+		c.SetKeepLocalOnConflict(tc.keepLocal)
+
+		commit, fs, err := c.fileSetForUpdate(galleryFile)
+		if err != nil {
+			t.Fatalf("fileSetForUpdate: %v", err)
+		}
+		for _, f := range []struct{ name, local, remote string }{
+			{"synced", "h1", "h1"},
+			{"changed", "h2-local", "h2"},
+			{"removed", "", "h3"},
+			{"echo", "h4-local", "h4"},
+		} {
+			if f.local != "" {
+				fs.Files[f.name] = &stingle.File{File: f.name, Headers: f.local}
+			}
+			fs.RemoteFiles[f.name] = &stingle.File{File: f.name, Headers: f.remote}
+		}
+		if err := commit(true, nil); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+
+		sr := stingle.ResponseOK().AddPartList("files",
+			stingle.File{File: "synced", Headers: "h1-server", DateModified: "1"},
+			stingle.File{File: "changed", Headers: "h2-server", DateModified: "1"},
+			stingle.File{File: "removed", Headers: "h3-server", DateModified: "1"},
+			stingle.File{File: "echo", Headers: "h4-local", DateModified: "1"},
+		)
+		if _, err := c.processUpdates(sr); err != nil {
+			t.Fatalf("processUpdates: %v", err)
+		}
+
+		conflicts, err := c.Conflicts()
+		if err != nil {
+			t.Fatalf("Conflicts: %v", err)
+		}
+		var got []string
+		for _, cf := range conflicts {
+			got = append(got, fmt.Sprintf("%s %s %v", cf.FileSet, cf.Remote.File, cf.KeptLocal))
+		}
+		sort.Strings(got)
+		want := []string{
+			fmt.Sprintf("gallery changed %v", tc.keepLocal),
+			fmt.Sprintf("gallery removed %v", tc.keepLocal),
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("%+v: Unexpected conflicts. Want %v, got %v", tc, want, got)
+		}
+
+		commit, fs, err = c.fileSetForUpdate(galleryFile)
+		if err != nil {
+			t.Fatalf("fileSetForUpdate: %v", err)
+		}
+		commit(false, nil)
+		files := make(map[string]string)
+		for n, f := range fs.Files {
+			files[n] = f.Headers
+		}
+		wantFiles := map[string]string{
+			"synced":  "h1-server",
+			"changed": "h2-server",
+			"removed": "h3-server",
+			"echo":    "h4-local",
+		}
+		if tc.keepLocal {
+			wantFiles["changed"] = "h2-local"
+			delete(wantFiles, "removed")
+		}
+		if !reflect.DeepEqual(wantFiles, files) {
+			t.Errorf("%+v: Unexpected files. Want %v, got %v", tc, wantFiles, files)
+		}
+
+		var buf bytes.Buffer
+		c.SetWriter(&buf)
+		if err := c.ListConflicts(); err != nil {
+			t.Fatalf("ListConflicts: %v", err)
+		}
+		if !strings.Contains(buf.String(), "gallery/removed: kept") || !strings.Contains(buf.String(), "removed locally") {
+			t.Errorf("%+v: Unexpected ListConflicts output: %q", tc, buf.String())
+		}
+		if err := c.ClearConflicts(); err != nil {
+			t.Fatalf("ClearConflicts: %v", err)
+		}
+		if conflicts, err := c.Conflicts(); err != nil || len(conflicts) != 0 {
+			t.Errorf("Conflicts after clear: %v, %v", conflicts, err)
+		}
+	}
+}
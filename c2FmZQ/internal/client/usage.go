@@ -0,0 +1,103 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path/filepath"
+	"strconv"
+)
+
+// Usage is the storage used by the account on the server.
+type Usage struct {
+	SpaceUsed      int64 `json:"spaceUsed"`
+	SpaceQuota     int64 `json:"spaceQuota"`
+	SpaceRemaining int64 `json:"spaceRemaining"`
+	FileCount      int64 `json:"fileCount"`
+	AlbumCount     int64 `json:"albumCount"`
+}
+
+// ServerUsage returns the storage used by the account on the server.
+func (c *Client) ServerUsage() (*Usage, error) {
+	if c.Account == nil {
+		return nil, ErrNotLoggedIn
+	}
+	form := url.Values{}
+	form.Set("token", c.Account.Token)
+	sr, err := c.sendRequest("/v2/account/usage", form, "")
+	if err != nil {
+		return nil, err
+	}
+	if sr.Status != "ok" {
+		return nil, &ServerError{sr}
+	}
+	var u Usage
+	for _, p := range []struct {
+		name string
+		v    *int64
+	}{
+		{"spaceUsed", &u.SpaceUsed},
+		{"spaceQuota", &u.SpaceQuota},
+		{"spaceRemaining", &u.SpaceRemaining},
+		{"fileCount", &u.FileCount},
+		{"albumCount", &u.AlbumCount},
+	} {
+		v, err := strconv.ParseInt(fmt.Sprint(sr.Part(p.name)), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", p.name, err)
+		}
+		*p.v = v
+	}
+	return &u, nil
+}
+
+// LocalUsage returns the number of bytes used by the client's local data.
+func (c *Client) LocalUsage() (int64, error) {
+	var total int64
+	err := filepath.WalkDir(c.storage.Dir(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			total += fi.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+// HumanSize returns n formatted with a binary unit, e.g. 1.5 MiB.
+func HumanSize(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	v := float64(n)
+	for _, unit := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		v /= 1024
+		if v < 1024 || unit == "TiB" {
+			return fmt.Sprintf("%.1f %s", v, unit)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,136 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"c2FmZQ/internal/log"
+)
+
+const (
+	// A file is imported after it hasn't changed for this long.
+	watchDebounce = time.Second
+	// The number of times we try to import a file before giving up.
+	watchMaxAttempts = 5
+)
+
+type watchedFile struct {
+	lastChange time.Time
+	size       int64
+	attempts   int
+}
+
+// Watch imports new files as they appear in dir, until ctx is canceled. Files
+// that already exist in dir are imported first, unless they were already
+// imported.
+func (c *Client) Watch(ctx context.Context, dir, dest string) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if err := w.Add(dir); err != nil {
+		return err
+	}
+	if _, err := c.ImportFilesContext(ctx, []string{filepath.Join(globEscape(dir), "*")}, dest, false); err != nil {
+		return err
+	}
+	c.Infof("Watching %s\n", dir)
+
+	pending := make(map[string]*watchedFile)
+	ticker := time.NewTicker(watchDebounce / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			log.Errorf("watch %s: %v", dir, err)
+		case ev, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename) {
+				delete(pending, ev.Name)
+				continue
+			}
+			if !ev.Has(fsnotify.Create) && !ev.Has(fsnotify.Write) {
+				continue
+			}
+			if f, exists := pending[ev.Name]; exists {
+				f.lastChange = time.Now()
+				continue
+			}
+			pending[ev.Name] = &watchedFile{lastChange: time.Now(), size: -1}
+		case <-ticker.C:
+			c.importWatchedFiles(pending, dest)
+		}
+	}
+}
+
+// importWatchedFiles imports the pending files that haven't changed recently.
+// Files that are still being written are left in pending.
+func (c *Client) importWatchedFiles(pending map[string]*watchedFile, dest string) {
+	var ready []string
+	for name, f := range pending {
+		if time.Since(f.lastChange) < watchDebounce {
+			continue
+		}
+		fi, err := os.Stat(name)
+		if err != nil || fi.IsDir() {
+			delete(pending, name)
+			continue
+		}
+		if fi.Size() != f.size {
+			// The file is probably still being written.
+			f.size = fi.Size()
+			f.lastChange = time.Now()
+			continue
+		}
+		ready = append(ready, name)
+	}
+	for _, name := range ready {
+		f := pending[name]
+		f.attempts++
+		if _, err := c.ImportFiles([]string{globEscape(name)}, dest, false); err != nil {
+			if f.attempts < watchMaxAttempts {
+				log.Infof("Import %s failed, will retry: %v", name, err)
+				f.lastChange = time.Now()
+				continue
+			}
+			c.Printf("Import %s failed: %v\n", name, err)
+		}
+		delete(pending, name)
+	}
+}
+
+// globEscape escapes the characters that have a special meaning in
+// filepath.Glob patterns.
+func globEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`).Replace(s)
+}
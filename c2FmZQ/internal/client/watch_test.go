@@ -0,0 +1,83 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	c, url, done := startServer(t)
+	defer done()
+	if err := c.CreateAccount(url, "alice@", "pass", true); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+
+	testdir := t.TempDir()
+	if err := makeImages(testdir, 0, 2); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan error)
+	go func() {
+		ch <- c.Watch(ctx, testdir, "gallery")
+	}()
+
+	waitFor := func(want []string) {
+		t.Helper()
+		var got []string
+		for deadline := time.Now().Add(30 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+			var err error
+			if got, err = globAll(c); err != nil {
+				t.Fatalf("globAll: %v", err)
+			}
+			if reflect.DeepEqual(got, want) {
+				return
+			}
+		}
+		t.Fatalf("Unexpected files. Want %q, got %q", want, got)
+	}
+
+	waitFor([]string{
+		".trash",
+		"gallery",
+		"gallery/image000.jpg LOCAL",
+		"gallery/image001.jpg LOCAL",
+	})
+	if err := makeImages(testdir, 2, 3); err != nil {
+		t.Fatalf("makeImages: %v", err)
+	}
+	waitFor([]string{
+		".trash",
+		"gallery",
+		"gallery/image000.jpg LOCAL",
+		"gallery/image001.jpg LOCAL",
+		"gallery/image002.jpg LOCAL",
+		"gallery/image003.jpg LOCAL",
+		"gallery/image004.jpg LOCAL",
+	})
+
+	cancel()
+	if err := <-ch; err != nil {
+		t.Errorf("Watch: %v", err)
+	}
+}
@@ -374,7 +374,7 @@ func (s *Server) handleUpload(w http.ResponseWriter, req *http.Request) {
 				http.Error(w, "illegal filename", http.StatusInternalServerError)
 				return
 			}
-			s.c.Delete([]string{filepath.Join(item.Filename, name)}, true)
+			s.c.Delete([]string{filepath.Join(item.Filename, name)}, true, false)
 			f, err := s.c.StreamImport(name, item)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -450,7 +450,7 @@ func (s *Server) handleRaw(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 	} else {
-		if f, err = os.Open(item.FilePath); errors.Is(err, os.ErrNotExist) {
+		if f, err = s.c.OpenFile(item); errors.Is(err, os.ErrNotExist) {
 			if item.FSFile.File != "" {
 				f, err = s.c.DownloadGet(item.FSFile.File, item.Set, false)
 			}
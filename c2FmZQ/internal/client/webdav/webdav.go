@@ -0,0 +1,330 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+// Package webdav implements a read-only WebDAV view of the decrypted files.
+package webdav
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	xwebdav "golang.org/x/net/webdav"
+
+	"c2FmZQ/internal/client"
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+// How long the items returned by Readdir are used to answer Stat, which is
+// called for each of them during PROPFIND.
+const itemCacheTTL = 10 * time.Second
+
+// NewHandler returns an http.Handler that serves the client's files with
+// WebDAV. The files are decrypted on the fly, and downloaded if they aren't
+// available locally. Only the methods that don't modify anything are allowed.
+func NewHandler(c *client.Client) http.Handler {
+	h := &xwebdav.Handler{
+		FileSystem: &fileSystem{c: c, items: make(map[string]cachedItem)},
+		LockSystem: xwebdav.NewMemLS(),
+		Logger: func(req *http.Request, err error) {
+			if err != nil {
+				log.Debugf("WebDAV %s %s: %v", req.Method, req.URL.Path, err)
+			}
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		log.Debugf("WebDAV %s %s", req.Method, req.URL.Path)
+		switch req.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+			h.ServeHTTP(w, req)
+		default:
+			http.Error(w, "read-only", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+type cachedItem struct {
+	item client.ListItem
+	ts   time.Time
+}
+
+// fileSystem implements xwebdav.FileSystem.
+type fileSystem struct {
+	c *client.Client
+
+	mu    sync.Mutex
+	items map[string]cachedItem
+}
+
+func (*fileSystem) Mkdir(context.Context, string, os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (*fileSystem) RemoveAll(context.Context, string) error {
+	return os.ErrPermission
+}
+
+func (*fileSystem) Rename(context.Context, string, string) error {
+	return os.ErrPermission
+}
+
+func (f *fileSystem) OpenFile(_ context.Context, name string, flag int, _ os.FileMode) (xwebdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, os.ErrPermission
+	}
+	item, err := f.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return &file{fs: f, item: item}, nil
+}
+
+func (f *fileSystem) Stat(_ context.Context, name string) (os.FileInfo, error) {
+	item, err := f.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return fileInfo{item}, nil
+}
+
+// lookup returns the file or directory with this name.
+func (f *fileSystem) lookup(name string) (client.ListItem, error) {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name == "" {
+		return client.ListItem{IsDir: true}, nil
+	}
+	f.mu.Lock()
+	ci, ok := f.items[name]
+	f.mu.Unlock()
+	if ok && time.Since(ci.ts) < itemCacheTTL {
+		return ci.item, nil
+	}
+	li, err := f.c.GlobFiles([]string{name}, client.GlobOptions{ExactMatch: true, MatchDot: true, Quiet: true})
+	if err != nil {
+		return client.ListItem{}, err
+	}
+	if len(li) == 0 {
+		return client.ListItem{}, os.ErrNotExist
+	}
+	return li[0], nil
+}
+
+// readdir returns the content of the directory dir.
+func (f *fileSystem) readdir(dir string) ([]client.ListItem, error) {
+	pattern := "*"
+	if dir != "" {
+		pattern = dir + "/*"
+	}
+	li, err := f.c.GlobFiles([]string{pattern}, client.GlobOptions{ExactMatchExceptLast: true, Quiet: true})
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for k, v := range f.items {
+		if now.Sub(v.ts) >= itemCacheTTL {
+			delete(f.items, k)
+		}
+	}
+	for _, item := range li {
+		f.items[item.Filename] = cachedItem{item, now}
+	}
+	return li, nil
+}
+
+// file implements xwebdav.File. The content of regular files is only opened
+// when it is read, so that PROPFIND and HEAD requests don't need to download
+// or decrypt anything.
+type file struct {
+	fs   *fileSystem
+	item client.ListItem
+	off  int64
+	r    io.ReadSeekCloser
+	pos  int64
+	// Whether Readdir already returned the content of the directory.
+	eof bool
+}
+
+func (f *file) Close() error {
+	if f.r != nil {
+		return f.r.Close()
+	}
+	return nil
+}
+
+func (f *file) Read(b []byte) (int, error) {
+	if f.item.IsDir {
+		return 0, &fs.PathError{Op: "read", Path: f.item.Filename, Err: errors.New("is a directory")}
+	}
+	if f.off >= f.item.Size {
+		return 0, io.EOF
+	}
+	if f.r == nil {
+		r, err := f.open()
+		if err != nil {
+			return 0, err
+		}
+		f.r = r
+	}
+	if f.pos != f.off {
+		if _, err := f.r.Seek(f.off, io.SeekStart); err != nil {
+			return 0, err
+		}
+		f.pos = f.off
+	}
+	n, err := f.r.Read(b)
+	f.off += int64(n)
+	f.pos = f.off
+	return n, err
+}
+
+// open returns the decrypted content of the file.
+func (f *file) open() (io.ReadSeekCloser, error) {
+	c := f.fs.c
+	r, err := c.OpenFile(f.item)
+	var in io.ReadSeekCloser = r
+	if errors.Is(err, os.ErrNotExist) {
+		in, err = c.DownloadGet(f.item.FSFile.File, f.item.Set, false)
+	}
+	if err != nil {
+		log.Errorf("Open(%s) failed: %v", f.item.Filename, err)
+		return nil, err
+	}
+	if err := stingle.SkipHeader(in); err != nil {
+		in.Close()
+		return nil, err
+	}
+	sk := c.SecretKey()
+	hdr, err := f.item.Header(sk)
+	sk.Wipe()
+	if err != nil {
+		in.Close()
+		return nil, err
+	}
+	return stingle.DecryptFile(in, hdr), nil
+}
+
+// Seek only changes the offset of the next read. The size of the file is
+// known, so seeking doesn't require opening it.
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	var off int64
+	switch whence {
+	case io.SeekStart:
+		off = offset
+	case io.SeekCurrent:
+		off = f.off + offset
+	case io.SeekEnd:
+		off = f.item.Size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if off < 0 {
+		return 0, fs.ErrInvalid
+	}
+	f.off = off
+	return off, nil
+}
+
+func (f *file) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.item.IsDir {
+		return nil, &fs.PathError{Op: "readdir", Path: f.item.Filename, Err: errors.New("not a directory")}
+	}
+	if f.eof && count > 0 {
+		return nil, io.EOF
+	}
+	li, err := f.fs.readdir(f.item.Filename)
+	if err != nil {
+		return nil, err
+	}
+	f.eof = true
+	out := make([]os.FileInfo, 0, len(li))
+	for _, item := range li {
+		out = append(out, fileInfo{item})
+	}
+	return out, nil
+}
+
+func (f *file) Stat() (os.FileInfo, error) {
+	return fileInfo{f.item}, nil
+}
+
+func (*file) Write([]byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+// fileInfo implements os.FileInfo, xwebdav.ContentTyper, and xwebdav.ETager.
+type fileInfo struct {
+	item client.ListItem
+}
+
+func (fi fileInfo) Name() string {
+	return path.Base("/" + fi.item.Filename)
+}
+
+func (fi fileInfo) Size() int64 {
+	return fi.item.Size
+}
+
+func (fi fileInfo) Mode() os.FileMode {
+	if fi.item.IsDir {
+		return fs.ModeDir | 0o500
+	}
+	return 0o400
+}
+
+func (fi fileInfo) ModTime() time.Time {
+	if fi.item.IsDir {
+		return time.Time{}
+	}
+	ms, _ := fi.item.FSFile.DateModified.Int64()
+	return time.UnixMilli(ms)
+}
+
+func (fi fileInfo) IsDir() bool {
+	return fi.item.IsDir
+}
+
+func (fi fileInfo) Sys() interface{} {
+	return nil
+}
+
+// ContentType returns the content type based on the file extension. The
+// default implementation would decrypt the beginning of every file.
+func (fi fileInfo) ContentType(context.Context) (string, error) {
+	if t := mime.TypeByExtension(path.Ext(fi.item.Filename)); t != "" {
+		return t, nil
+	}
+	return "application/octet-stream", nil
+}
+
+func (fi fileInfo) ETag(context.Context) (string, error) {
+	if fi.item.IsDir {
+		return "", xwebdav.ErrNotImplemented
+	}
+	return fmt.Sprintf(`"%s-%s"`, fi.item.FSFile.File, fi.item.FSFile.DateModified), nil
+}
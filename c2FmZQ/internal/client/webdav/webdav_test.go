@@ -0,0 +1,121 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package webdav_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/crypto"
+
+	"c2FmZQ/internal/client"
+	"c2FmZQ/internal/client/webdav"
+)
+
+func TestWebDAV(t *testing.T) {
+	masterKey, err := crypto.CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("CreateAESMasterKeyForTest: %v", err)
+	}
+	c, err := client.Create(masterKey, storage.New(t.TempDir(), masterKey))
+	if err != nil {
+		t.Fatalf("client.Create: %v", err)
+	}
+	c.SetQuiet(true)
+
+	content := make([]byte, 3<<20+1234)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatalf("rand.Read: %v", err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file.bin"), content, 0600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	if err := c.AddAlbums([]string{"album"}); err != nil {
+		t.Fatalf("AddAlbums: %v", err)
+	}
+	if _, err := c.ImportFiles([]string{filepath.Join(dir, "file.bin")}, "album", false); err != nil {
+		t.Fatalf("ImportFiles: %v", err)
+	}
+
+	srv := httptest.NewServer(webdav.NewHandler(c))
+	defer srv.Close()
+
+	do := func(method, path string, hdr map[string]string) (int, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest: %v", err)
+		}
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		return resp.StatusCode, body
+	}
+
+	code, body := do("PROPFIND", "/", map[string]string{"Depth": "1"})
+	if code != http.StatusMultiStatus || !strings.Contains(string(body), "<D:href>/album/</D:href>") {
+		t.Errorf("PROPFIND / = %d %s", code, body)
+	}
+	code, body = do("PROPFIND", "/album/", map[string]string{"Depth": "1"})
+	if code != http.StatusMultiStatus || !strings.Contains(string(body), "<D:href>/album/file.bin</D:href>") || !strings.Contains(string(body), "<D:getcontentlength>3146962</D:getcontentlength>") {
+		t.Errorf("PROPFIND /album/ = %d %s", code, body)
+	}
+
+	if code, body := do("GET", "/album/file.bin", nil); code != http.StatusOK || !bytes.Equal(body, content) {
+		t.Errorf("GET /album/file.bin = %d, len %d", code, len(body))
+	}
+	// The range crosses a chunk boundary.
+	code, body = do("GET", "/album/file.bin", map[string]string{"Range": "bytes=1048000-1049999"})
+	if code != http.StatusPartialContent || !bytes.Equal(body, content[1048000:1050000]) {
+		t.Errorf("GET /album/file.bin with range = %d, len %d", code, len(body))
+	}
+	code, body = do("GET", "/album/file.bin", map[string]string{"Range": "bytes=-10"})
+	if code != http.StatusPartialContent || !bytes.Equal(body, content[len(content)-10:]) {
+		t.Errorf("GET /album/file.bin with suffix range = %d, len %d", code, len(body))
+	}
+	if code, _ := do("GET", "/album/nope.bin", nil); code != http.StatusNotFound {
+		t.Errorf("GET /album/nope.bin = %d, want 404", code)
+	}
+
+	for _, method := range []string{"PUT", "DELETE", "MKCOL", "MOVE", "COPY", "PROPPATCH", "LOCK"} {
+		if code, _ := do(method, "/album/file.bin", nil); code != http.StatusMethodNotAllowed {
+			t.Errorf("%s = %d, want 405", method, code)
+		}
+	}
+	if li, err := c.GlobFiles([]string{"album/*"}, client.GlobOptions{}); err != nil || len(li) != 1 {
+		t.Errorf("GlobFiles: %d, %v", len(li), err)
+	}
+}
@@ -32,6 +32,7 @@ func (c *Client) WipeAccount(password string) error {
 			return err
 		}
 	}
+	defer c.storage.cache.invalidate()
 	var errList []error
 
 	if errs := c.wipeFileSet(galleryFile); errs != nil {
@@ -71,7 +72,7 @@ func (c *Client) WipeAccount(password string) error {
 		}
 		return fmt.Errorf("wipe errors: %w (%v)", errList[0], errList[1:])
 	}
-	c.Print("All data was deleted.")
+	c.Info("All data was deleted.")
 	return nil
 }
 
@@ -26,6 +26,8 @@ import (
 	"encoding/json"
 	"errors"
 	"sort"
+
+	"c2FmZQ/internal/log"
 )
 
 var (
@@ -121,6 +123,7 @@ func (d *Database) AdminData(changes *AdminData) (data *AdminData, retErr error)
 	}
 
 	// Apply the changes.
+	var approved []*User
 	if changes.DefaultQuota != nil {
 		quotas.DefaultLimit = *changes.DefaultQuota
 	}
@@ -135,6 +138,9 @@ func (d *Database) AdminData(changes *AdminData) (data *AdminData, retErr error)
 			}
 		}
 		if user.Approved != nil {
+			if *user.Approved && users[user.UserID].NeedApproval {
+				approved = append(approved, users[user.UserID])
+			}
 			users[user.UserID].NeedApproval = !*user.Approved
 		}
 		if user.Admin != nil {
@@ -163,8 +169,17 @@ func (d *Database) AdminData(changes *AdminData) (data *AdminData, retErr error)
 		}
 	}
 
-	if err := commit(true, nil); err != nil {
+	err = commit(true, nil)
+	for _, user := range changes.Users {
+		d.invalidateUser(user.UserID)
+	}
+	if err != nil {
 		return nil, err
 	}
+	for _, u := range approved {
+		if err := d.acceptPendingShares(*u); err != nil {
+			log.Errorf("acceptPendingShares(%d): %v", u.UserID, err)
+		}
+	}
 	return d.AdminData(nil)
 }
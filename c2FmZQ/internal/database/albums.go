@@ -20,6 +20,7 @@ package database
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/fs"
@@ -78,6 +79,12 @@ type AlbumSpec struct {
 	Permissions stingle.Permissions `json:"permissions"`
 	// The file to use as album cover.
 	Cover string `json:"cover"`
+	// The number of files in the album. It is updated every time files are
+	// added to or removed from the album.
+	FileCount int64 `json:"fileCount"`
+	// The total size of the files in the album, including the thumbnails.
+	// It is updated with FileCount.
+	TotalSize int64 `json:"totalSize"`
 	// The set of members: key is member ID, value is always true.
 	Members map[int64]bool `json:"members"`
 	// The private key of the album, encrypted for each member.
@@ -268,21 +275,22 @@ func convertAlbumSpecToStingleAlbum(album *AlbumSpec) stingle.Album {
 		IsHidden:      boolToNumber(album.IsHidden),
 		IsOwner:       "1",
 		Permissions:   string(album.Permissions),
-		IsLocked:      "0",
+		IsLocked:      boolToNumber(album.IsLocked),
 		Cover:         album.Cover,
 		Members:       strings.Join(members, ","),
 	}
 }
 
-// AlbumUpdates returns all the changes to the user's album list since ts.
-func (d *Database) AlbumUpdates(user User, ts int64) ([]stingle.Album, error) {
+// AlbumUpdates returns the changes to the user's album list since ts, limited
+// to the selected page.
+func (d *Database) AlbumUpdates(user User, ts int64, page UpdatesPage) ([]stingle.Album, error) {
 	defer recordLatency("AlbumUpdates")()
 
 	albumRefs, err := d.AlbumRefs(user)
 	if err != nil {
 		return nil, err
 	}
-	out := []stingle.Album{}
+	pc := pageCollector[stingle.Album]{page: page}
 	for _, v := range albumRefs {
 		fs, err := d.FileSet(user, stingle.AlbumSet, v.AlbumID)
 		if err != nil {
@@ -293,25 +301,105 @@ func (d *Database) AlbumUpdates(user User, ts int64) ([]stingle.Album, error) {
 			log.Errorf("d.FileSet(%q, %q, %q) has Album == nil", user.Email, stingle.AlbumSet, v.AlbumID)
 			continue
 		}
-		if fs.Album.DateModified > ts {
-			sa := convertAlbumSpecToStingleAlbum(fs.Album)
-			if fs.Album.OwnerID != user.UserID {
-				sa.EncPrivateKey = fs.Album.SharingKeys[user.UserID]
-				sa.IsOwner = "0"
-			}
-			out = append(out, sa)
+		if fs.Album.DateModified <= ts {
+			continue
+		}
+		pos := UpdatePos{TS: fs.Album.DateModified, Kind: UpdateKindAlbum, Key: v.AlbumID}
+		if !pc.want(pos) {
+			continue
+		}
+		sa := convertAlbumSpecToStingleAlbum(fs.Album)
+		if fs.Album.OwnerID != user.UserID {
+			sa.EncPrivateKey = fs.Album.SharingKeys[user.UserID]
+			sa.IsOwner = "0"
 		}
+		pc.add(pos, sa)
 	}
-	sort.Slice(out, func(i, j int) bool {
-		if out[i].DateModified == out[j].DateModified {
-			return out[i].AlbumID < out[j].AlbumID
+	return pc.records(), nil
+}
+
+// AlbumSummary is a lightweight view of an album, without its files.
+type AlbumSummary struct {
+	AlbumID       string      `json:"albumId"`
+	DateCreated   json.Number `json:"dateCreated"`
+	DateModified  json.Number `json:"dateModified"`
+	EncPrivateKey string      `json:"encPrivateKey"`
+	Metadata      string      `json:"metadata"`
+	PublicKey     string      `json:"publicKey"`
+	IsOwner       json.Number `json:"isOwner"`
+	IsShared      json.Number `json:"isShared"`
+	IsHidden      json.Number `json:"isHidden"`
+	IsLocked      json.Number `json:"isLocked"`
+	Cover         string      `json:"cover"`
+	FileCount     json.Number `json:"fileCount"`
+	TotalSize     json.Number `json:"totalSize"`
+}
+
+// AlbumSummaries returns a summary of all the albums that the user owns or is
+// a member of, sorted by album ID.
+func (d *Database) AlbumSummaries(user User) ([]AlbumSummary, error) {
+	defer recordLatency("AlbumSummaries")()
+
+	albumRefs, err := d.AlbumRefs(user)
+	if err != nil {
+		return nil, err
+	}
+	out := []AlbumSummary{}
+	for _, v := range albumRefs {
+		album, err := d.Album(user, v.AlbumID)
+		if err != nil {
+			log.Errorf("d.Album(%q, %q) failed: %v", user.Email, v.AlbumID, err)
+			continue
+		}
+		if album == nil {
+			log.Errorf("d.Album(%q, %q) returned nil", user.Email, v.AlbumID)
+			continue
 		}
-		return out[i].DateModified < out[j].DateModified
+		if album.OwnerID != user.UserID && !album.Members[user.UserID] {
+			continue
+		}
+		as := AlbumSummary{
+			AlbumID:       album.AlbumID,
+			DateCreated:   number(album.DateCreated),
+			DateModified:  number(album.DateModified),
+			EncPrivateKey: album.EncPrivateKey,
+			Metadata:      album.Metadata,
+			PublicKey:     album.PublicKey,
+			IsOwner:       "1",
+			IsShared:      boolToNumber(album.IsShared),
+			IsHidden:      boolToNumber(album.IsHidden),
+			IsLocked:      boolToNumber(album.IsLocked),
+			Cover:         album.Cover,
+			FileCount:     number(album.FileCount),
+			TotalSize:     number(album.TotalSize),
+		}
+		if album.OwnerID != user.UserID {
+			as.EncPrivateKey = album.SharingKeys[user.UserID]
+			as.IsOwner = "0"
+		}
+		out = append(out, as)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].AlbumID < out[j].AlbumID
 	})
-
 	return out, nil
 }
 
+// updateAlbumCounters updates the album's file counter and total size, if fs
+// is an album. It must be called every time files are added to or removed
+// from fs.
+func (fs *FileSet) updateAlbumCounters() {
+	if fs.Album == nil {
+		return
+	}
+	var size int64
+	for _, f := range fs.Files {
+		size += f.StoreFileSize + f.StoreThumbSize
+	}
+	fs.Album.FileCount = int64(len(fs.Files))
+	fs.Album.TotalSize = size
+}
+
 // ShareAlbum turns on sharing on an album and adds members.
 func (d *Database) ShareAlbum(user User, sharing *stingle.Album, sharingKeys map[string]string) (retErr error) {
 	defer recordLatency("ShareAlbums")()
@@ -502,3 +590,56 @@ func (d *Database) RemoveAlbumMember(user User, albumID string, memberID int64)
 	fs.Album.DateModified = nowInMS()
 	return d.removeAlbumRef(memberID, albumID)
 }
+
+// RotateAlbumKey replaces the album's keypair. The new public key, the new
+// private key encrypted for the owner, and the re-encrypted metadata are in
+// album. sharingKeys must contain the new private key encrypted for every
+// member other than the owner, and headers must contain the re-encrypted
+// headers of every file in the album. ErrOutdated is returned if the members
+// or the files don't match, e.g. because the album changed concurrently.
+func (d *Database) RotateAlbumKey(owner User, album *stingle.Album, sharingKeys, headers map[string]string) (retErr error) {
+	defer recordLatency("RotateAlbumKey")()
+
+	commit, fs, err := d.fileSetForUpdate(owner, stingle.AlbumSet, album.AlbumID)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	if fs.Album.OwnerID != owner.UserID {
+		return fmt.Errorf("user %d is not the owner of the album", owner.UserID)
+	}
+	if len(headers) != len(fs.Files) {
+		return ErrOutdated
+	}
+	for fn := range fs.Files {
+		if headers[fn] == "" {
+			return ErrOutdated
+		}
+	}
+	newSharingKeys := make(map[int64]string)
+	for m := range fs.Album.Members {
+		if m == owner.UserID {
+			continue
+		}
+		k := sharingKeys[strconv.FormatInt(m, 10)]
+		if k == "" {
+			return ErrOutdated
+		}
+		newSharingKeys[m] = k
+	}
+	if len(newSharingKeys) != len(sharingKeys) {
+		return ErrOutdated
+	}
+
+	now := nowInMS()
+	for fn, f := range fs.Files {
+		f.Headers = headers[fn]
+		f.DateModified = now
+	}
+	fs.Album.PublicKey = album.PublicKey
+	fs.Album.EncPrivateKey = album.EncPrivateKey
+	fs.Album.Metadata = album.Metadata
+	fs.Album.SharingKeys = newSharingKeys
+	fs.Album.DateModified = now
+	return commit(true, nil)
+}
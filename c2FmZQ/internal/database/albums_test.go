@@ -136,6 +136,8 @@ func TestAlbums(t *testing.T) {
 		IsShared:      true,
 		Permissions:   "1111",
 		Cover:         "",
+		FileCount:     4,
+		TotalSize:     4400,
 		Members:       map[int64]bool{user.UserID: true, bobUser.UserID: true},
 		SharingKeys:   map[int64]string{bobUser.UserID: "bob's sharing key"},
 	}
@@ -143,7 +145,7 @@ func TestAlbums(t *testing.T) {
 		t.Errorf("Album data has unexpected value: %v", diff)
 	}
 
-	aliceUpdates, err := db.AlbumUpdates(user, 0)
+	aliceUpdates, err := db.AlbumUpdates(user, 0, database.UpdatesPage{})
 	if err != nil {
 		t.Fatalf("db.AlbumUpdates(%q, 0) failed: %v", user.Email, err)
 	}
@@ -169,7 +171,7 @@ func TestAlbums(t *testing.T) {
 		t.Errorf("Alice's updates have unexpected value: %v", diff)
 	}
 
-	bobUpdates, err := db.AlbumUpdates(bobUser, 0)
+	bobUpdates, err := db.AlbumUpdates(bobUser, 0, database.UpdatesPage{})
 	if err != nil {
 		t.Fatalf("db.AlbumUpdates(%q, 0) failed: %v", bobUser.Email, err)
 	}
@@ -198,7 +200,7 @@ func TestAlbums(t *testing.T) {
 	if err := db.DeleteUser(user); err != nil {
 		t.Fatalf("DeleteUser(alice) failed: %v", err)
 	}
-	deleteUpdates, err := db.DeleteUpdates(bobUser, 0)
+	deleteUpdates, err := db.DeleteUpdates(bobUser, 0, database.UpdatesPage{})
 	if err != nil {
 		t.Fatalf("db.DeleteUpdates(%q, 0) failed: %v", bobUser.Email, err)
 	}
@@ -215,3 +217,114 @@ func TestAlbums(t *testing.T) {
 
 	}
 }
+
+// checkAlbumCounters verifies that the album's counters match its files.
+func checkAlbumCounters(t *testing.T, db *database.Database, user database.User, albumID string, wantCount int) {
+	t.Helper()
+	fs, err := db.FileSet(user, stingle.AlbumSet, albumID)
+	if err != nil {
+		t.Fatalf("db.FileSet(%q, %q, %q) failed: %v", user.Email, stingle.AlbumSet, albumID, err)
+	}
+	var size int64
+	for _, f := range fs.Files {
+		size += f.StoreFileSize + f.StoreThumbSize
+	}
+	if want, got := wantCount, len(fs.Files); want != got {
+		t.Errorf("Unexpected number of files in %s: Want %d, got %d", albumID, want, got)
+	}
+	if want, got := int64(len(fs.Files)), fs.Album.FileCount; want != got {
+		t.Errorf("Unexpected FileCount for %s: Want %d, got %d", albumID, want, got)
+	}
+	if want, got := size, fs.Album.TotalSize; want != got {
+		t.Errorf("Unexpected TotalSize for %s: Want %d, got %d", albumID, want, got)
+	}
+}
+
+func TestAlbumCounters(t *testing.T) {
+	dir := t.TempDir()
+	db := database.New(dir, nil)
+	email := "alice@"
+	key := stingle.MakeSecretKeyForTest()
+	database.CurrentTimeForTesting = 10000
+
+	if err := addUser(db, email, key.PublicKey()); err != nil {
+		t.Fatalf("addUser(%q, pk) failed: %v", email, err)
+	}
+	user, err := db.User(email)
+	if err != nil {
+		t.Fatalf("db.User(%q) failed: %v", email, err)
+	}
+	for _, albumID := range []string{"album1", "album2"} {
+		if err := addAlbum(db, user, albumID); err != nil {
+			t.Fatalf("addAlbum(%q, %q) failed: %v", user.Email, albumID, err)
+		}
+		checkAlbumCounters(t, db, user, albumID, 0)
+	}
+
+	for i := 0; i < 5; i++ {
+		f := fmt.Sprintf("file%d", i)
+		if err := addFile(db, user, f, stingle.GallerySet, ""); err != nil {
+			t.Errorf("addFile(%q, %q, %q) failed: %v", f, stingle.GallerySet, "", err)
+		}
+	}
+	if err := addFile(db, user, "file5", stingle.AlbumSet, "album1"); err != nil {
+		t.Errorf("addFile(%q, %q, %q) failed: %v", "file5", stingle.AlbumSet, "album1", err)
+	}
+	checkAlbumCounters(t, db, user, "album1", 1)
+
+	for _, tc := range []struct {
+		mvp    database.MoveFileParams
+		album1 int
+		album2 int
+	}{
+		// Copy 3 files from Gallery to album1.
+		{database.MoveFileParams{
+			SetFrom:   stingle.GallerySet,
+			SetTo:     stingle.AlbumSet,
+			AlbumIDTo: "album1",
+			Filenames: []string{"file0", "file1", "file2"},
+		}, 4, 0},
+		// Copying a file that is already there doesn't change anything.
+		{database.MoveFileParams{
+			SetFrom:   stingle.GallerySet,
+			SetTo:     stingle.AlbumSet,
+			AlbumIDTo: "album1",
+			Filenames: []string{"file0"},
+		}, 4, 0},
+		// Move 2 files from album1 to album2.
+		{database.MoveFileParams{
+			SetFrom:     stingle.AlbumSet,
+			AlbumIDFrom: "album1",
+			SetTo:       stingle.AlbumSet,
+			AlbumIDTo:   "album2",
+			IsMoving:    true,
+			Filenames:   []string{"file1", "file5"},
+		}, 2, 2},
+		// Move 1 file from album2 to Trash.
+		{database.MoveFileParams{
+			SetFrom:     stingle.AlbumSet,
+			AlbumIDFrom: "album2",
+			SetTo:       stingle.TrashSet,
+			IsMoving:    true,
+			Filenames:   []string{"file5"},
+		}, 2, 1},
+	} {
+		if err := db.MoveFile(user, tc.mvp); err != nil {
+			t.Fatalf("db.MoveFile(%q, %v) failed: %v", user.Email, tc.mvp, err)
+		}
+		checkAlbumCounters(t, db, user, "album1", tc.album1)
+		checkAlbumCounters(t, db, user, "album2", tc.album2)
+	}
+
+	summaries, err := db.AlbumSummaries(user)
+	if err != nil {
+		t.Fatalf("db.AlbumSummaries(%q) failed: %v", user.Email, err)
+	}
+	var got []string
+	for _, as := range summaries {
+		got = append(got, fmt.Sprintf("%s:%s:%s", as.AlbumID, as.FileCount, as.TotalSize))
+	}
+	if diff := deep.Equal([]string{"album1:2:2200", "album2:1:1100"}, got); diff != nil {
+		t.Errorf("Unexpected album summaries: %v", diff)
+	}
+}
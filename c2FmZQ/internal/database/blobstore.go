@@ -0,0 +1,417 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/c2FmZQ/storage"
+
+	"c2FmZQ/internal/fileperm"
+)
+
+// BlobStore stores the content of files and thumbnails, i.e. the blobs. The
+// blobs are identified by the names recorded in the file sets, e.g. 1A/<name>.
+// They are already encrypted when they are stored, and they are decrypted by
+// the database after they are retrieved.
+//
+// The metadata, including the blob reference counts, always stays on the local
+// filesystem.
+type BlobStore interface {
+	// Put stores the content of r as blob name, replacing any existing
+	// blob with the same name.
+	Put(name string, r io.Reader) error
+	// Get opens blob name for reading.
+	Get(name string) (io.ReadSeekCloser, error)
+	// Delete deletes blob name.
+	Delete(name string) error
+	// Exists returns whether blob name exists.
+	Exists(name string) (bool, error)
+}
+
+// blobMover is implemented by the blob stores that can take ownership of a
+// local file without copying it.
+type blobMover interface {
+	Move(localPath, name string) error
+}
+
+// blobLister is implemented by the blob stores that can list their blobs.
+type blobLister interface {
+	// List calls fn for each blob in the store.
+	List(fn func(name string, fi fs.FileInfo) error) error
+}
+
+// blobLocator is implemented by the blob stores that can describe where they
+// keep the blobs.
+type blobLocator interface {
+	Location() string
+}
+
+// FileBlobStore is a BlobStore that keeps the blobs in a directory on the
+// local filesystem. It is the default blob store, using the database
+// directory.
+type FileBlobStore struct {
+	dir  string
+	perm fileperm.Perm
+}
+
+// NewFileBlobStore returns a FileBlobStore that keeps the blobs in dir.
+func NewFileBlobStore(dir string) *FileBlobStore {
+	return &FileBlobStore{dir: dir, perm: fileperm.Default}
+}
+
+// SetPerm sets the permission of the new blobs and blob directories. The
+// existing ones aren't changed.
+func (s *FileBlobStore) SetPerm(p fileperm.Perm) error {
+	if err := p.Check(); err != nil {
+		return err
+	}
+	s.perm = p
+	return nil
+}
+
+// path returns the full path of blob name. Names that would escape the
+// directory are rejected.
+func (s *FileBlobStore) path(name string) (string, error) {
+	if !filepath.IsLocal(name) {
+		return "", fs.ErrInvalid
+	}
+	return filepath.Join(s.dir, name), nil
+}
+
+// Put stores the content of r as blob name.
+func (s *FileBlobStore) Put(name string, r io.Reader) (retErr error) {
+	fn, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := s.perm.MkdirAll(filepath.Dir(fn)); err != nil {
+		return err
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	tmp := fn + ".tmp-" + base64.RawURLEncoding.EncodeToString(b)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if retErr != nil {
+			os.Remove(tmp)
+		}
+	}()
+	if err := s.perm.ApplyFile(f); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+// Move moves the local file localPath to blob name. The content is copied
+// when the file can't be renamed, e.g. when it is on a different filesystem.
+func (s *FileBlobStore) Move(localPath, name string) error {
+	fn, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := s.perm.MkdirAll(filepath.Dir(fn)); err != nil {
+		return err
+	}
+	if err := os.Rename(localPath, fn); err == nil {
+		return s.perm.Apply(fn, false)
+	}
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := s.Put(name, f); err != nil {
+		return err
+	}
+	return os.Remove(localPath)
+}
+
+// Get opens blob name for reading.
+func (s *FileBlobStore) Get(name string) (io.ReadSeekCloser, error) {
+	fn, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(fn)
+}
+
+// Delete deletes blob name.
+func (s *FileBlobStore) Delete(name string) error {
+	fn, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(fn)
+}
+
+// List calls fn for each file in the blob directories, e.g. 1A/<name>. Files
+// outside of these directories are ignored.
+func (s *FileBlobStore) List(fn func(name string, fi fs.FileInfo) error) error {
+	return filepath.WalkDir(s.dir, func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == s.dir {
+			return nil
+		}
+		if de.IsDir() {
+			if !isShardDir(de.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Dir(path) == s.dir {
+			return nil
+		}
+		fi, err := de.Info()
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		return fn(name, fi)
+	})
+}
+
+// isShardDir returns whether name is the name of a blob directory, i.e. two
+// uppercase hex digits.
+func isShardDir(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+	for _, c := range name {
+		if (c < '0' || c > '9') && (c < 'A' || c > 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// Exists returns whether blob name exists.
+func (s *FileBlobStore) Exists(name string) (bool, error) {
+	fn, err := s.path(name)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(fn)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Location returns the absolute path of the blob directory.
+func (s *FileBlobStore) Location() string {
+	if dir, err := filepath.Abs(s.dir); err == nil {
+		return dir
+	}
+	return s.dir
+}
+
+const blobStoreFile = "blobstore.dat"
+
+// blobStoreInfo describes the blob store used by the server.
+type blobStoreInfo struct {
+	Location string `json:"location"`
+}
+
+// blobStoreLocation returns the location of the current blob store, or an
+// empty string if the blob store can't describe it.
+func (d *Database) blobStoreLocation() string {
+	if l, ok := d.blobs.(blobLocator); ok {
+		return l.Location()
+	}
+	return ""
+}
+
+// RecordBlobStore records the location of the current blob store. The server
+// calls it at startup so that the maintenance commands can verify that they
+// use the same blob store.
+func (d *Database) RecordBlobStore() error {
+	return d.storage.SaveDataFile(d.filePath(blobStoreFile), blobStoreInfo{Location: d.blobStoreLocation()})
+}
+
+// checkBlobStore returns an error if the current blob store isn't the one
+// recorded by the server.
+func (d *Database) checkBlobStore() error {
+	var info blobStoreInfo
+	if err := d.storage.ReadDataFile(d.filePath(blobStoreFile), &info); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if loc := d.blobStoreLocation(); loc == "" || loc != info.Location {
+		return fmt.Errorf("the blob store %q isn't the one used by the server %q, check --blob-dir", loc, info.Location)
+	}
+	return nil
+}
+
+// SetBlobStore changes where the database stores the blobs. It must be called
+// before the database is used. Existing blobs are not moved.
+func (d *Database) SetBlobStore(bs BlobStore) {
+	d.blobs = bs
+}
+
+// SetBlobPerm sets the permission of the new blobs, when the blob store
+// supports it. The metadata files always remain accessible only by the owner.
+func (d *Database) SetBlobPerm(p fileperm.Perm) error {
+	ps, ok := d.blobs.(interface{ SetPerm(fileperm.Perm) error })
+	if !ok {
+		if p.IsDefault() {
+			return nil
+		}
+		return errors.New("the blob store doesn't support permissions")
+	}
+	return ps.SetPerm(p)
+}
+
+// putBlob moves the encrypted local file localPath to the blob store.
+func (d *Database) putBlob(localPath, name string) error {
+	if m, ok := d.blobs.(blobMover); ok {
+		return m.Move(localPath, name)
+	}
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := d.blobs.Put(name, f); err != nil {
+		return err
+	}
+	return os.Remove(localPath)
+}
+
+// The header of the blob files written by storage.OpenBlobWrite.
+const (
+	blobMagic       = "KRIN"
+	blobOptRawBytes = 0x04
+	blobOptEncrypt  = 0x10
+	blobOptCompress = 0x20
+	blobOptPadded   = 0x40
+)
+
+// openBlob opens a blob from the blob store and decrypts it.
+func (d *Database) openBlob(name string) (io.ReadSeekCloser, error) {
+	if s, ok := d.blobs.(*FileBlobStore); ok && s.dir == d.dir {
+		return d.storage.OpenBlobRead(name)
+	}
+	r, err := d.blobs.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	b, err := d.decryptBlob(name, r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// decryptBlob decrypts the content of blob name as it is read from r. It is
+// the same as storage.OpenBlobRead, but it doesn't require the blob to be on
+// the local filesystem.
+func (d *Database) decryptBlob(name string, r io.ReadSeekCloser) (io.ReadSeekCloser, error) {
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if string(hdr[:4]) != blobMagic {
+		return nil, errors.New("wrong file type")
+	}
+	flags := hdr[4]
+	if flags&blobOptRawBytes == 0 || flags&blobOptCompress != 0 {
+		return nil, errors.New("unexpected blob format")
+	}
+	if flags&blobOptEncrypt != 0 {
+		if d.masterKey == nil {
+			return nil, errors.New("file is encrypted, but a master key was not provided")
+		}
+		k, err := d.masterKey.ReadEncryptedKey(r)
+		if err != nil {
+			return nil, err
+		}
+		defer k.Wipe()
+		// The encryption context is the sha1 hash of the blob name.
+		ctx := sha1.Sum([]byte(name))
+		if r, err = k.StartReader(ctx[:], r); err != nil {
+			return nil, err
+		}
+		h := make([]byte, 5)
+		if _, err := io.ReadFull(r, h); err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(hdr, h) {
+			return nil, errors.New("wrong encrypted header")
+		}
+		if flags&blobOptPadded != 0 {
+			if err := storage.SkipPadding(r); err != nil {
+				return nil, err
+			}
+		}
+	}
+	off, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	return &offsetReader{ReadSeekCloser: r, start: off}, nil
+}
+
+// offsetReader is a ReadSeekCloser whose offsets are relative to start.
+type offsetReader struct {
+	io.ReadSeekCloser
+	start int64
+}
+
+func (r *offsetReader) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekStart {
+		offset += r.start
+	}
+	n, err := r.ReadSeekCloser.Seek(offset, whence)
+	if err != nil {
+		return 0, err
+	}
+	if n -= r.start; n < 0 {
+		return 0, fs.ErrInvalid
+	}
+	return n, nil
+}
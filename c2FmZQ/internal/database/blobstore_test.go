@@ -0,0 +1,345 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/fileperm"
+	"c2FmZQ/internal/stingle"
+)
+
+// memBlobStore is a BlobStore that keeps the blobs in memory.
+type memBlobStore struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func (s *memBlobStore) Put(name string, r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.blobs == nil {
+		s.blobs = make(map[string][]byte)
+	}
+	s.blobs[name] = b
+	return nil
+}
+
+func (s *memBlobStore) Get(name string) (io.ReadSeekCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.blobs[name]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return nopCloser{bytes.NewReader(b)}, nil
+}
+
+func (s *memBlobStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.blobs[name]; !ok {
+		return fs.ErrNotExist
+	}
+	delete(s.blobs, name)
+	return nil
+}
+
+func (s *memBlobStore) Exists(name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.blobs[name]
+	return ok, nil
+}
+
+func (s *memBlobStore) names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for n := range s.blobs {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+func testBlobStore(t *testing.T, bs database.BlobStore) {
+	if exists, err := bs.Exists("AA/blob"); err != nil || exists {
+		t.Errorf("Exists(AA/blob) = %v, %v, want false, nil", exists, err)
+	}
+	if _, err := bs.Get("AA/blob"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Get(AA/blob) returned unexpected error: want %v, got %v", fs.ErrNotExist, err)
+	}
+	for _, content := range []string{"Hello world", "Goodbye world"} {
+		if err := bs.Put("AA/blob", bytes.NewReader([]byte(content))); err != nil {
+			t.Fatalf("Put(AA/blob) failed: %v", err)
+		}
+		if exists, err := bs.Exists("AA/blob"); err != nil || !exists {
+			t.Errorf("Exists(AA/blob) = %v, %v, want true, nil", exists, err)
+		}
+		r, err := bs.Get("AA/blob")
+		if err != nil {
+			t.Fatalf("Get(AA/blob) failed: %v", err)
+		}
+		if _, err := r.Seek(5, io.SeekStart); err != nil {
+			t.Fatalf("Seek failed: %v", err)
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("ReadAll failed: %v", err)
+		}
+		r.Close()
+		if want, got := content[5:], string(b); want != got {
+			t.Errorf("Unexpected content: want %q, got %q", want, got)
+		}
+	}
+	if err := bs.Delete("AA/blob"); err != nil {
+		t.Fatalf("Delete(AA/blob) failed: %v", err)
+	}
+	if exists, err := bs.Exists("AA/blob"); err != nil || exists {
+		t.Errorf("Exists(AA/blob) = %v, %v, want false, nil", exists, err)
+	}
+	if err := bs.Delete("AA/blob"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Delete(AA/blob) returned unexpected error: want %v, got %v", fs.ErrNotExist, err)
+	}
+}
+
+func TestFileBlobStore(t *testing.T) {
+	bs := database.NewFileBlobStore(t.TempDir())
+	testBlobStore(t, bs)
+
+	if err := bs.Put("../escape", bytes.NewReader([]byte("foo"))); err == nil {
+		t.Error("Put(../escape) succeeded unexpectedly")
+	}
+}
+
+func TestFileBlobStorePerm(t *testing.T) {
+	dir := t.TempDir()
+	bs := database.NewFileBlobStore(dir)
+	if err := bs.SetPerm(fileperm.Perm{Mode: 0o644, GID: -1}); err == nil {
+		t.Error("SetPerm(0644) succeeded unexpectedly")
+	}
+	if err := bs.SetPerm(fileperm.Perm{Mode: 0o640, GID: -1}); err != nil {
+		t.Fatalf("SetPerm(0640): %v", err)
+	}
+	if err := bs.Put("1A/put", bytes.NewReader([]byte("foo"))); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	local := filepath.Join(t.TempDir(), "local")
+	if err := os.WriteFile(local, []byte("bar"), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := bs.Move(local, "2B/move"); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	for _, tc := range []struct {
+		name string
+		want fs.FileMode
+	}{
+		{"1A", fs.ModeDir | 0o750},
+		{"1A/put", 0o640},
+		{"2B", fs.ModeDir | 0o750},
+		{"2B/move", 0o640},
+	} {
+		fi, err := os.Stat(filepath.Join(dir, tc.name))
+		if err != nil {
+			t.Fatalf("Stat(%s): %v", tc.name, err)
+		}
+		if got := fi.Mode(); got != tc.want {
+			t.Errorf("Mode(%s) = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+
+	db := database.New(t.TempDir(), nil)
+	db.SetBlobStore(&memBlobStore{})
+	if err := db.SetBlobPerm(fileperm.Default); err != nil {
+		t.Errorf("SetBlobPerm(default): %v", err)
+	}
+	if err := db.SetBlobPerm(fileperm.Perm{Mode: 0o640, GID: -1}); err == nil {
+		t.Error("SetBlobPerm(0640) succeeded unexpectedly with memBlobStore")
+	}
+}
+
+func TestMemBlobStore(t *testing.T) {
+	testBlobStore(t, &memBlobStore{})
+}
+
+func TestExternalBlobStore(t *testing.T) {
+	dir := t.TempDir()
+	db := database.New(dir, []byte("passphrase"))
+	defer db.Wipe()
+	bs := &memBlobStore{}
+	db.SetBlobStore(bs)
+	email := "alice@"
+	key := stingle.MakeSecretKeyForTest()
+	database.CurrentTimeForTesting = 10000
+
+	if err := addUser(db, email, key.PublicKey()); err != nil {
+		t.Fatalf("addUser(%q, pk) failed: %v", email, err)
+	}
+	user, err := db.User(email)
+	if err != nil {
+		t.Fatalf("db.User(%q) failed: %v", email, err)
+	}
+	if err := addFile(db, user, "file1", stingle.GallerySet, ""); err != nil {
+		t.Fatalf("addFile failed: %v", err)
+	}
+	names := bs.names()
+	if len(names) != 2 {
+		t.Fatalf("Unexpected blobs: %v", names)
+	}
+	for _, n := range names {
+		b := bs.blobs[n]
+		if bytes.Contains(b, []byte("content")) {
+			t.Errorf("Blob %s is not encrypted: %q", n, b)
+		}
+	}
+
+	for _, tc := range []struct {
+		thumb bool
+		want  string
+	}{
+		{false, "file content"},
+		{true, "thumb content"},
+	} {
+		f, err := db.DownloadFile(user, stingle.GallerySet, "file1", tc.thumb)
+		if err != nil {
+			t.Fatalf("db.DownloadFile(%v) failed: %v", tc.thumb, err)
+		}
+		b, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatalf("io.ReadAll(f) failed: %v", err)
+		}
+		if want, got := tc.want, string(b); want != got {
+			t.Errorf("Unexpected content: want %q, got %q", want, got)
+		}
+		if _, err := f.Seek(6, io.SeekStart); err != nil {
+			t.Fatalf("f.Seek failed: %v", err)
+		}
+		if b, err = io.ReadAll(f); err != nil {
+			t.Fatalf("io.ReadAll(f) failed: %v", err)
+		}
+		if want, got := tc.want[6:], string(b); want != got {
+			t.Errorf("Unexpected content after Seek: want %q, got %q", want, got)
+		}
+		if err := f.Close(); err != nil {
+			t.Errorf("f.Close() failed: %v", err)
+		}
+	}
+
+	if err := db.MoveFile(user, database.MoveFileParams{
+		SetFrom:   stingle.GallerySet,
+		SetTo:     stingle.TrashSet,
+		IsMoving:  true,
+		Filenames: []string{"file1"},
+	}); err != nil {
+		t.Fatalf("db.MoveFile failed: %v", err)
+	}
+	if err := db.EmptyTrash(user, 20000); err != nil {
+		t.Fatalf("db.EmptyTrash failed: %v", err)
+	}
+	if names := bs.names(); len(names) != 0 {
+		t.Errorf("Unexpected blobs after EmptyTrash: %v", names)
+	}
+}
+
+func TestFindOrphanFilesBlobStore(t *testing.T) {
+	dir := t.TempDir()
+	db := database.New(dir, []byte("passphrase"))
+	defer db.Wipe()
+	email := "alice@"
+	key := stingle.MakeSecretKeyForTest()
+	database.CurrentTimeForTesting = 10000
+
+	if err := addUser(db, email, key.PublicKey()); err != nil {
+		t.Fatalf("addUser(%q, pk) failed: %v", email, err)
+	}
+	user, err := db.User(email)
+	if err != nil {
+		t.Fatalf("db.User(%q) failed: %v", email, err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := addFile(db, user, fmt.Sprintf("file%d", i), stingle.GallerySet, ""); err != nil {
+			t.Fatalf("addFile failed: %v", err)
+		}
+	}
+	if err := db.RecordBlobStore(); err != nil {
+		t.Fatalf("db.RecordBlobStore failed: %v", err)
+	}
+	removeBlob := func(name string) {
+		fs, err := db.FileSet(user, stingle.GallerySet, "")
+		if err != nil {
+			t.Fatalf("db.FileSet failed: %v", err)
+		}
+		if err := os.Remove(filepath.Join(dir, fs.Files[name].StoreFile)); err != nil {
+			t.Fatalf("os.Remove failed: %v", err)
+		}
+	}
+
+	// The blob store isn't the one used by the server.
+	db2 := database.New(dir, []byte("passphrase"))
+	defer db2.Wipe()
+	db2.SetBlobStore(database.NewFileBlobStore(t.TempDir()))
+	if err := db2.FindOrphanFiles(true); err == nil {
+		t.Error("FindOrphanFiles succeeded with the wrong blob store")
+	}
+	if want, got := 20, numFilesInSet(t, db, user, stingle.GallerySet, ""); want != got {
+		t.Errorf("Unexpected number of files: want %d, got %d", want, got)
+	}
+
+	// A few missing blobs.
+	removeBlob("file0")
+	if err := db.FindOrphanFiles(true); err != nil {
+		t.Fatalf("FindOrphanFiles failed: %v", err)
+	}
+	if want, got := 19, numFilesInSet(t, db, user, stingle.GallerySet, ""); want != got {
+		t.Errorf("Unexpected number of files: want %d, got %d", want, got)
+	}
+
+	// Too many missing blobs.
+	removeBlob("file1")
+	removeBlob("file2")
+	if err := db.FindOrphanFiles(true); err == nil {
+		t.Error("FindOrphanFiles succeeded with too many missing blobs")
+	}
+	if want, got := 19, numFilesInSet(t, db, user, stingle.GallerySet, ""); want != got {
+		t.Errorf("Unexpected number of files: want %d, got %d", want, got)
+	}
+}
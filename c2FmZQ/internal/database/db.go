@@ -58,10 +58,18 @@ var (
 		},
 		[]string{"func"},
 	)
+	userCacheLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "database_user_cache_lookups",
+			Help: "The number of user record cache lookups, by result",
+		},
+		[]string{"result"},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(funcLatency)
+	prometheus.MustRegister(userCacheLookups)
 
 }
 
@@ -72,7 +80,10 @@ func recordLatency(name string) func() time.Duration {
 
 // New returns an initialized database that uses dir for storage.
 func New(dir string, passphrase []byte) *Database {
-	db := &Database{dir: dir}
+	db := &Database{dir: dir, blobs: NewFileBlobStore(dir)}
+	// storage.New rolls back the pending ops. Count them for the recovery
+	// report.
+	db.pendingOpsRolledBack = countPendingOps(dir)
 	mkFile := filepath.Join(dir, "master.key")
 	if len(passphrase) > 0 {
 		if _, err := os.Stat(filepath.Join(dir, "metadata", "users.dat")); err == nil {
@@ -116,10 +127,13 @@ func New(dir string, passphrase []byte) *Database {
 	db.fileSetCache, _ = simplelru.NewLRU(db.fileSetCacheSize, nil)
 	db.albumRefCacheSize = 20
 	db.albumRefCache, _ = simplelru.NewLRU(db.albumRefCacheSize, nil)
+	db.usageCache, _ = simplelru.NewLRU(100, nil)
+	db.userCache, _ = simplelru.NewLRU(1000, nil)
 
 	if err := db.readPushServiceConfigurationFile(); err != nil {
 		log.Fatalf("pushServices: %v", err)
 	}
+	db.migrate()
 	if db.pushServices.Enable {
 		db.notifyChan = make(chan notifyItem, 100)
 		db.startNotifyWorkers()
@@ -130,9 +144,16 @@ func New(dir string, passphrase []byte) *Database {
 // Database implements all the storage requirements of the c2FmZQ server using
 // encrypted storage on a local filesystem.
 type Database struct {
+	// The number of directory levels used to shard the blobs. The default
+	// is 1.
+	BlobShardDepth int
+
 	dir       string
 	masterKey crypto.MasterKey
 	storage   *storage.Storage
+	blobs     BlobStore
+
+	pendingOpsRolledBack int
 
 	fileSetCache      *simplelru.LRU
 	fileSetCacheSize  int
@@ -142,6 +163,12 @@ type Database struct {
 	albumRefCacheSize  int
 	albumRefCacheMutex sync.Mutex
 
+	usageCache      *simplelru.LRU
+	usageCacheMutex sync.Mutex
+
+	userCache      *simplelru.LRU
+	userCacheMutex sync.Mutex
+
 	notifyChan   chan notifyItem
 	pushServices webpush.PushServiceConfiguration
 }
@@ -377,7 +404,9 @@ func (d *Database) DumpUsers(details bool) {
 }
 
 func (d *Database) FindOrphanFiles(del bool) error {
-	d.fixFileSets(del)
+	if err := d.fixFileSets(del); err != nil {
+		return err
+	}
 	exist := make(map[string]struct{})
 	err := filepath.WalkDir(d.Dir(), func(path string, de fs.DirEntry, err error) error {
 		if err != nil {
@@ -439,7 +468,7 @@ func (d *Database) FileIterator() <-chan DFile {
 	go func() {
 		defer close(ch)
 		ch <- fp(quotaFile)
-		for _, f := range []string{cacheFile, pushServiceConfigFile} {
+		for _, f := range []string{cacheFile, pushServiceConfigFile, passwordResetTokenFile, pendingShareFile, inviteCodeFile, migrationsFile, blobStoreFile} {
 			if _, err := os.Stat(filepath.Join(d.Dir(), d.filePath(f))); err == nil {
 				ch <- fp(f)
 			}
@@ -510,21 +539,33 @@ func (d *Database) FileIterator() <-chan DFile {
 	return ch
 }
 
-func (d *Database) fixFileSets(del bool) {
+// maxMissingBlobs is the largest share of files with missing blobs for which
+// fixFileSets removes the broken references. More missing blobs usually mean
+// that the blob store isn't configured correctly.
+const maxMissingBlobs = 0.1
+
+func (d *Database) fixFileSets(del bool) error {
 	var ul []userList
 	if err := d.storage.ReadDataFile(d.filePath(userListFile), &ul); err != nil {
 		log.Errorf("ReadDataFile: %v", err)
-		return
+		return nil
 	}
 
+	type fileSetRef struct {
+		file string
+		set  string
+	}
+	var fileSets []fileSetRef
 	for _, u := range ul {
 		user, err := d.UserByID(u.UserID)
 		if err != nil {
 			log.Errorf("User(%q): %v", u.Email, err)
 			continue
 		}
-		d.fixFileSetReferences(d.fileSetPath(user, stingle.TrashSet), stingle.TrashSet, del)
-		d.fixFileSetReferences(d.fileSetPath(user, stingle.GallerySet), stingle.GallerySet, del)
+		fileSets = append(fileSets,
+			fileSetRef{d.fileSetPath(user, stingle.TrashSet), stingle.TrashSet},
+			fileSetRef{d.fileSetPath(user, stingle.GallerySet), stingle.GallerySet},
+		)
 
 		albums, err := d.AlbumRefs(user)
 		if err != nil {
@@ -532,9 +573,50 @@ func (d *Database) fixFileSets(del bool) {
 			continue
 		}
 		for _, v := range albums {
-			d.fixFileSetReferences(v.File, stingle.AlbumSet, del)
+			fileSets = append(fileSets, fileSetRef{v.File, stingle.AlbumSet})
 		}
 	}
+	if del {
+		if err := d.checkBlobStore(); err != nil {
+			return err
+		}
+		var total, missing int
+		for _, f := range fileSets {
+			var fs FileSet
+			if err := d.storage.ReadDataFile(f.file, &fs); err != nil {
+				log.Errorf("FileSet: %s %v", f.file, err)
+				continue
+			}
+			for _, file := range fs.Files {
+				total++
+				if d.isBrokenFile(file) {
+					missing++
+				}
+			}
+		}
+		if float64(missing) > maxMissingBlobs*float64(total) {
+			return fmt.Errorf("%d of %d files have missing blobs, not removing them: check that the blob store is configured correctly", missing, total)
+		}
+	}
+	for _, f := range fileSets {
+		d.fixFileSetReferences(f.file, f.set, del)
+	}
+	return nil
+}
+
+// isBrokenFile returns whether some of the blobs of file are missing.
+func (d *Database) isBrokenFile(file *FileSpec) bool {
+	for _, b := range []string{file.StoreFile, file.StoreThumb} {
+		if exists, err := d.blobs.Exists(b); err == nil && !exists {
+			return true
+		}
+	}
+	for _, b := range []string{d.blobRef(file.StoreFile), d.blobRef(file.StoreThumb)} {
+		if _, err := os.Stat(filepath.Join(d.Dir(), b)); err == os.ErrNotExist {
+			return true
+		}
+	}
+	return false
 }
 
 func (d *Database) fixFileSetReferences(fsFile, set string, update bool) {
@@ -548,14 +630,7 @@ func (d *Database) fixFileSetReferences(fsFile, set string, update bool) {
 
 	changed := false
 	for key, file := range fs.Files {
-		broken := false
-		for _, b := range []string{file.StoreFile, file.StoreThumb, d.blobRef(file.StoreFile), d.blobRef(file.StoreThumb)} {
-			if _, err := os.Stat(filepath.Join(d.Dir(), b)); err == os.ErrNotExist {
-				broken = true
-				break
-			}
-		}
-		if !broken {
+		if !d.isBrokenFile(file) {
 			continue
 		}
 		if !update {
@@ -583,6 +658,7 @@ func (d *Database) fixFileSetReferences(fsFile, set string, update bool) {
 	if !changed {
 		return
 	}
+	fs.updateAlbumCounters()
 	if err := commit(true, nil); err != nil {
 		log.Errorf("fixFileSetReferences commit: %v", err)
 	}
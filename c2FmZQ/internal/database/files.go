@@ -33,6 +33,9 @@ import (
 
 const (
 	fileSetPattern = "fileset-%s"
+
+	// MaxBlobShardDepth is the maximum value of BlobShardDepth.
+	MaxBlobShardDepth = 4
 )
 
 var (
@@ -95,8 +98,8 @@ func (d *Database) incRefCount(blob string, delta int) int {
 	}
 	log.Debugf("RefCount(%q)%+d -> %d", blob, delta, blobSpec.RefCount)
 	if blobSpec.RefCount == 0 {
-		if err := os.Remove(filepath.Join(d.dir, blob)); err != nil {
-			log.Errorf("os.Remove(%q) failed: %v", blob, err)
+		if err := d.blobs.Delete(blob); err != nil {
+			log.Errorf("d.blobs.Delete(%q) failed: %v", blob, err)
 		}
 		if err := os.Remove(filepath.Join(d.dir, ref)); err != nil {
 			log.Errorf("os.Remove(%q) failed: %v", ref, err)
@@ -137,6 +140,7 @@ func (d *Database) addFileToFileSet(user User, file FileSpec, name, set, albumID
 		fileSet.Deletes = []DeleteEvent{}
 	}
 	fileSet.Files[name] = &file
+	fileSet.updateAlbumCounters()
 	d.storage.CreateEmptyFile(d.blobRef(file.StoreFile), BlobSpec{})
 	d.storage.CreateEmptyFile(d.blobRef(file.StoreThumb), BlobSpec{})
 	d.incRefCount(file.StoreFile, 1)
@@ -158,8 +162,8 @@ func (d *Database) TempFile(dir string) (io.WriteCloser, string, error) {
 		}
 		temp := filepath.Join(dir, base64.RawURLEncoding.EncodeToString(name))
 		fullTemp := filepath.Join(d.Dir(), temp)
-		final, _ := finalFilename(temp)
-		if _, err := os.Stat(filepath.Join(d.Dir(), final)); err == nil {
+		final, _ := d.finalFilename(temp)
+		if exists, err := d.blobs.Exists(final); err != nil || exists {
 			log.Debugf("TempFile collision: %s", final)
 			continue
 		}
@@ -178,13 +182,28 @@ func (d *Database) TempFile(dir string) (io.WriteCloser, string, error) {
 	}
 }
 
-func finalFilename(temp string) (string, error) {
+// finalFilename returns the path where a blob is stored, relative to the
+// database's root directory. The blobs are sharded in BlobShardDepth levels of
+// directories, e.g. with 2 levels: 1A/2B/<name>. Changing BlobShardDepth only
+// affects new blobs. The paths of existing blobs are recorded in the file sets.
+func (d *Database) finalFilename(temp string) (string, error) {
 	_, n := filepath.Split(temp)
 	b, err := base64.RawURLEncoding.DecodeString(n)
 	if err != nil {
 		return "", err
 	}
-	return filepath.Join(fmt.Sprintf("%02X", b[0]), n), nil
+	depth := d.BlobShardDepth
+	if depth < 1 {
+		depth = 1
+	}
+	if depth > MaxBlobShardDepth || depth > len(b) {
+		return "", fmt.Errorf("invalid blob shard depth: %d", depth)
+	}
+	var parts []string
+	for i := 0; i < depth; i++ {
+		parts = append(parts, fmt.Sprintf("%02X", b[i]))
+	}
+	return filepath.Join(append(parts, n)...), nil
 }
 
 func (d *Database) fileSetOwner(user User, set, albumID string) (User, error) {
@@ -227,35 +246,34 @@ func (d *Database) AddFile(user User, file FileSpec, name, set, albumID string)
 		return ErrQuotaExceeded
 	}
 
-	fn, err := finalFilename(file.StoreFile)
+	fn, err := d.finalFilename(file.StoreFile)
 	if err != nil {
 		log.Errorf("makeFilePath() failed: %v", err)
 		return err
 	}
-	tn, err := finalFilename(file.StoreThumb)
+	tn, err := d.finalFilename(file.StoreThumb)
 	if err != nil {
 		log.Errorf("makeFilePath() failed: %v", err)
 		return err
 	}
 
-	if err := createParentIfNotExist(filepath.Join(filepath.Join(d.Dir(), fn))); err != nil {
-		return err
-	}
-	if err := os.Rename(file.StoreFile, filepath.Join(d.Dir(), fn)); err != nil {
+	if err := d.putBlob(file.StoreFile, fn); err != nil {
 		return err
 	}
 	file.StoreFile = fn
-	if err := createParentIfNotExist(filepath.Join(filepath.Join(d.Dir(), tn))); err != nil {
-		return err
-	}
-	if err := os.Rename(file.StoreThumb, filepath.Join(d.Dir(), tn)); err != nil {
+	if err := d.putBlob(file.StoreThumb, tn); err != nil {
 		return err
 	}
 	file.StoreThumb = tn
 	file.DateModified = nowInMS()
 
 	if err := d.addFileToFileSet(user, file, name, set, albumID); err != nil {
-		for _, f := range []string{fn, tn, d.blobRef(fn), d.blobRef(tn)} {
+		for _, f := range []string{fn, tn} {
+			if err := d.blobs.Delete(f); err != nil {
+				log.Errorf("d.blobs.Delete(%q) failed: %v", f, err)
+			}
+		}
+		for _, f := range []string{d.blobRef(fn), d.blobRef(tn)} {
 			if err := os.Remove(filepath.Join(d.Dir(), f)); err != nil {
 				log.Errorf("os.Remove(%q) failed: %v", f, err)
 			}
@@ -481,6 +499,8 @@ func (d *Database) MoveFile(user User, p MoveFileParams) (retErr error) {
 			d.incRefCount(toFile.StoreThumb, refCountAdj)
 		}
 	}
+	fsFrom.updateAlbumCounters()
+	fsTo.updateAlbumCounters()
 	pruneDeleteEvents(&fsFrom.Deletes, &fsFrom.DeleteHorizon)
 	pruneDeleteEvents(&fsTo.Deletes, &fsTo.DeleteHorizon)
 
@@ -558,12 +578,34 @@ func (d *Database) findFileInSet(user User, set, albumID, filename string) (*Fil
 	return nil, os.ErrNotExist
 }
 
+// FileRecord returns the current stingle.File record of a file in a file set.
+// It returns os.ErrNotExist if the file isn't in the file set.
+func (d *Database) FileRecord(user User, set, albumID, filename string) (*stingle.File, error) {
+	defer recordLatency("FileRecord")()
+
+	if set != stingle.AlbumSet {
+		albumID = ""
+	}
+	f, err := d.findFileInSet(user, set, albumID, filename)
+	if err != nil {
+		return nil, err
+	}
+	return &stingle.File{
+		File:         filename,
+		Version:      f.Version,
+		DateCreated:  number(f.DateCreated),
+		DateModified: number(f.DateModified),
+		Headers:      f.Headers,
+		AlbumID:      albumID,
+	}, nil
+}
+
 // downloadFileSpec opens a file for reading.
 func (d *Database) downloadFileSpec(fileSpec *FileSpec, thumb bool) (io.ReadSeekCloser, error) {
 	if thumb {
-		return d.storage.OpenBlobRead(fileSpec.StoreThumb)
+		return d.openBlob(fileSpec.StoreThumb)
 	}
-	return d.storage.OpenBlobRead(fileSpec.StoreFile)
+	return d.openBlob(fileSpec.StoreFile)
 }
 
 // DownloadFile locates a file and opens it for reading.
@@ -23,6 +23,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -177,3 +178,54 @@ func TestFiles(t *testing.T) {
 		t.Errorf("Unexpected number of files in Trash: Want %d, got %d", want, got)
 	}
 }
+
+func TestBlobShardDepth(t *testing.T) {
+	dir := t.TempDir()
+	db := database.New(dir, nil)
+	email := "alice@"
+	key := stingle.MakeSecretKeyForTest()
+
+	if err := addUser(db, email, key.PublicKey()); err != nil {
+		t.Fatalf("addUser(%q, pk) failed: %v", email, err)
+	}
+	user, err := db.User(email)
+	if err != nil {
+		t.Fatalf("db.User(%q) failed: %v", email, err)
+	}
+
+	testCases := []struct {
+		file  string
+		depth int
+	}{
+		{"file1", 1},
+		{"file2", 2},
+		{"file3", 4},
+	}
+	for _, tc := range testCases {
+		db.BlobShardDepth = tc.depth
+		if err := addFile(db, user, tc.file, stingle.GallerySet, ""); err != nil {
+			t.Fatalf("addFile(%q) failed: %v", tc.file, err)
+		}
+	}
+	fs, err := db.FileSet(user, stingle.GallerySet, "")
+	if err != nil {
+		t.Fatalf("db.FileSet failed: %v", err)
+	}
+	for _, tc := range testCases {
+		if want, got := tc.depth+1, len(strings.Split(fs.Files[tc.file].StoreFile, string(filepath.Separator))); want != got {
+			t.Errorf("Unexpected number of path elements for %s: Want %d, got %d", tc.file, want, got)
+		}
+		f, err := db.DownloadFile(user, stingle.GallerySet, tc.file, false)
+		if err != nil {
+			t.Fatalf("db.DownloadFile(%q) failed: %v", tc.file, err)
+		}
+		slurp, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("io.ReadAll(f) failed: %v", err)
+		}
+		if want, got := "file content", string(slurp); want != got {
+			t.Errorf("Unexpected file content: want %q, got %q", want, got)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+// OrphanBlob is a blob that isn't referenced by any file set.
+type OrphanBlob struct {
+	Name    string    // The name of the blob, or the path of the upload.
+	Size    int64     // The size of the blob.
+	ModTime time.Time // The last time the blob was modified.
+	upload  bool
+}
+
+// GCResult is the result of CollectGarbage.
+type GCResult struct {
+	// The orphaned blobs, sorted by name.
+	Orphans []OrphanBlob
+	// The total size of the orphaned blobs.
+	Bytes int64
+	// The number of unreferenced blobs that were skipped because they
+	// are more recent than minAge.
+	Skipped int
+}
+
+// CollectGarbage finds the blobs that aren't referenced by any file set, and
+// the temporary files of uploads that never completed. With del, they are
+// deleted.
+//
+// Uploads in progress create blobs before the file sets that reference them.
+// To avoid deleting them, the blobs and temporary files modified less than
+// minAge ago are skipped. The server should be stopped, or minAge should be
+// longer than any upload.
+func (d *Database) CollectGarbage(del bool, minAge time.Duration) (*GCResult, error) {
+	lister, ok := d.blobs.(blobLister)
+	if !ok {
+		return nil, errors.New("the blob store doesn't support listing")
+	}
+	// Any error here must abort. Otherwise, referenced blobs could be
+	// deleted.
+	referenced, err := d.referencedBlobs()
+	if err != nil {
+		return nil, err
+	}
+	fbs, isFileBlobStore := d.blobs.(*FileBlobStore)
+	sharedDir := isFileBlobStore && fbs.dir == d.dir
+
+	cutoff := time.Now().Add(-minAge)
+	res := &GCResult{}
+	add := func(name string, fi fs.FileInfo, upload bool) {
+		if fi.ModTime().After(cutoff) {
+			res.Skipped++
+			return
+		}
+		res.Orphans = append(res.Orphans, OrphanBlob{Name: name, Size: fi.Size(), ModTime: fi.ModTime(), upload: upload})
+		res.Bytes += fi.Size()
+	}
+	if err := lister.List(func(name string, fi fs.FileInfo) error {
+		if referenced[name] {
+			return nil
+		}
+		// When the blobs are in the database directory, the metadata
+		// files have the same kind of names. Only files that can be
+		// opened as blobs are considered.
+		if sharedDir && !strings.Contains(name, ".tmp-") && !d.isBlob(name) {
+			return nil
+		}
+		add(name, fi, false)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	uploads := filepath.Join(d.Dir(), "uploads")
+	if err := filepath.WalkDir(uploads, func(path string, de fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && path == uploads {
+			return nil
+		}
+		if err != nil || de.IsDir() {
+			return err
+		}
+		fi, err := de.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(d.Dir(), path)
+		if err != nil {
+			return err
+		}
+		add(rel, fi, true)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.Slice(res.Orphans, func(i, j int) bool {
+		return res.Orphans[i].Name < res.Orphans[j].Name
+	})
+
+	if !del {
+		return res, nil
+	}
+	for _, o := range res.Orphans {
+		if o.upload {
+			if err := os.Remove(filepath.Join(d.Dir(), o.Name)); err != nil {
+				return res, err
+			}
+			continue
+		}
+		if err := d.blobs.Delete(o.Name); err != nil {
+			return res, err
+		}
+		// A leftover reference count would be wrong if the blob name
+		// were ever reused.
+		if err := os.Remove(filepath.Join(d.Dir(), d.blobRef(o.Name))); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Errorf("os.Remove(%q): %v", d.blobRef(o.Name), err)
+		}
+	}
+	return res, nil
+}
+
+// referencedBlobs returns the names of the blobs referenced by the file sets
+// of all the users.
+func (d *Database) referencedBlobs() (map[string]bool, error) {
+	var ul []userList
+	if err := d.storage.ReadDataFile(d.filePath(userListFile), &ul); err != nil {
+		return nil, err
+	}
+	blobs := make(map[string]bool)
+	for _, u := range ul {
+		user, err := d.UserByID(u.UserID)
+		if err != nil {
+			return nil, fmt.Errorf("user %d: %w", u.UserID, err)
+		}
+		albums, err := d.AlbumRefs(user)
+		if err != nil {
+			return nil, fmt.Errorf("user %d: %w", u.UserID, err)
+		}
+		files := []string{
+			d.fileSetPath(user, stingle.TrashSet),
+			d.fileSetPath(user, stingle.GallerySet),
+		}
+		for _, a := range albums {
+			files = append(files, a.File)
+		}
+		for _, f := range files {
+			var fs FileSet
+			if err := d.storage.ReadDataFile(f, &fs); err != nil {
+				return nil, fmt.Errorf("user %d: %s: %w", u.UserID, f, err)
+			}
+			for _, file := range fs.Files {
+				blobs[file.StoreFile] = true
+				blobs[file.StoreThumb] = true
+			}
+		}
+	}
+	return blobs, nil
+}
+
+// isBlob returns whether the file name in the database directory is a blob.
+func (d *Database) isBlob(name string) bool {
+	r, err := d.storage.OpenBlobRead(name)
+	if err != nil {
+		return false
+	}
+	r.Close()
+	return true
+}
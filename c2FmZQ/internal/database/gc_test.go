@@ -0,0 +1,139 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		passphrase []byte
+		blobDir    bool
+	}{
+		{"NoPassphrase", nil, false},
+		{"Passphrase", []byte("foo"), false},
+		{"BlobDir", []byte("foo"), true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			blobDir := dir
+			db := database.New(dir, tc.passphrase)
+			if tc.blobDir {
+				blobDir = t.TempDir()
+				db.SetBlobStore(database.NewFileBlobStore(blobDir))
+			}
+			if err := addUser(db, "alice@", stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+				t.Fatalf("addUser failed: %v", err)
+			}
+			user, err := db.User("alice@")
+			if err != nil {
+				t.Fatalf("User failed: %v", err)
+			}
+			if err := addFile(db, user, "file1", stingle.GallerySet, ""); err != nil {
+				t.Fatalf("addFile failed: %v", err)
+			}
+			fs, err := db.FileSet(user, stingle.GallerySet, "")
+			if err != nil {
+				t.Fatalf("FileSet failed: %v", err)
+			}
+			var blob string
+			for _, f := range fs.Files {
+				blob = f.StoreFile
+			}
+
+			// A blob that was never added to a file set, and the
+			// leftover of an upload.
+			var temp []string
+			for i := 0; i < 2; i++ {
+				w, fn, err := db.TempFile("uploads")
+				if err != nil {
+					t.Fatalf("TempFile: %v", err)
+				}
+				w.Write([]byte("content"))
+				w.Close()
+				temp = append(temp, fn)
+			}
+			name := filepath.Base(temp[0])
+			b, _ := base64.RawURLEncoding.DecodeString(name)
+			orphan := filepath.Join(fmt.Sprintf("%02X", b[0]), name)
+			if err := os.MkdirAll(filepath.Join(blobDir, filepath.Dir(orphan)), 0700); err != nil {
+				t.Fatalf("MkdirAll: %v", err)
+			}
+			if err := os.Rename(temp[0], filepath.Join(blobDir, orphan)); err != nil {
+				t.Fatalf("Rename: %v", err)
+			}
+			upload := temp[1]
+			rel, _ := filepath.Rel(dir, upload)
+
+			res, err := db.CollectGarbage(false, time.Hour)
+			if err != nil {
+				t.Fatalf("CollectGarbage failed: %v", err)
+			}
+			if want, got := 0, len(res.Orphans); want != got {
+				t.Errorf("Unexpected number of orphans with min-age. Want %d, got %d", want, got)
+			}
+			if want, got := 2, res.Skipped; want != got {
+				t.Errorf("Unexpected number of skipped blobs. Want %d, got %d", want, got)
+			}
+
+			res, err = db.CollectGarbage(true, 0)
+			if err != nil {
+				t.Fatalf("CollectGarbage failed: %v", err)
+			}
+			var names []string
+			var size int64
+			for _, o := range res.Orphans {
+				names = append(names, o.Name)
+				size += o.Size
+			}
+			if want, got := []string{orphan, rel}, names; len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+				t.Errorf("Unexpected orphans. Want %v, got %v", want, got)
+			}
+			if want, got := size, res.Bytes; want != got || got == 0 {
+				t.Errorf("Unexpected orphan size. Want %d, got %d", want, got)
+			}
+			for _, f := range []string{filepath.Join(blobDir, orphan), upload} {
+				if _, err := os.Stat(f); !os.IsNotExist(err) {
+					t.Errorf("%s should have been deleted: %v", f, err)
+				}
+			}
+			// The referenced blob and the metadata are still there.
+			if _, err := os.Stat(filepath.Join(blobDir, blob)); err != nil {
+				t.Errorf("Referenced blob: %v", err)
+			}
+			if _, err := db.FileSet(user, stingle.GallerySet, ""); err != nil {
+				t.Errorf("FileSet failed: %v", err)
+			}
+			if res, err = db.CollectGarbage(false, 0); err != nil {
+				t.Fatalf("CollectGarbage failed: %v", err)
+			} else if len(res.Orphans) != 0 {
+				t.Errorf("Unexpected orphans after delete: %v", res.Orphans)
+			}
+		})
+	}
+}
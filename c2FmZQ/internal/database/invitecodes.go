@@ -0,0 +1,156 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"io/fs"
+)
+
+const (
+	// The logical filename where the account invite codes are stored.
+	inviteCodeFile = "invite-codes.dat"
+)
+
+var (
+	// ErrInvalidInviteCode is returned when an invite code doesn't exist or
+	// was already used.
+	ErrInvalidInviteCode = errors.New("invalid invite code")
+)
+
+// InviteCodes contains the account invite codes, keyed by code.
+type InviteCodes struct {
+	Codes map[string]*InviteCode `json:"codes"`
+}
+
+// InviteCode is a single-use code that allows someone to create an account.
+type InviteCode struct {
+	// The time when the code was created.
+	DateCreated int64 `json:"dateCreated"`
+	// The time when the code was used, or 0 if it is still unused.
+	DateUsed int64 `json:"dateUsed,omitempty"`
+	// The email address of the account that was created with the code.
+	UsedBy string `json:"usedBy,omitempty"`
+}
+
+func (d *Database) openInviteCodes(codes *InviteCodes) (func(bool, *error) error, error) {
+	if err := d.storage.CreateEmptyFile(d.filePath(inviteCodeFile), InviteCodes{}); err != nil && !errors.Is(err, fs.ErrExist) {
+		return nil, err
+	}
+	commit, err := d.storage.OpenForUpdate(d.filePath(inviteCodeFile), codes)
+	if err != nil {
+		return nil, err
+	}
+	if codes.Codes == nil {
+		codes.Codes = make(map[string]*InviteCode)
+	}
+	return commit, nil
+}
+
+// AddInviteCodes adds invite codes chosen by the admin. Codes that already
+// exist are left unchanged.
+func (d *Database) AddInviteCodes(codes []string) (retErr error) {
+	defer recordLatency("AddInviteCodes")()
+
+	var ic InviteCodes
+	commit, err := d.openInviteCodes(&ic)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	for _, c := range codes {
+		if c == "" {
+			return ErrInvalidInviteCode
+		}
+		if _, ok := ic.Codes[c]; !ok {
+			ic.Codes[c] = &InviteCode{DateCreated: nowInMS()}
+		}
+	}
+	return commit(true, nil)
+}
+
+// NewInviteCodes creates n random invite codes.
+func (d *Database) NewInviteCodes(n int) ([]string, error) {
+	var codes []string
+	for i := 0; i < n; i++ {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		codes = append(codes, base32.StdEncoding.EncodeToString(b))
+	}
+	if err := d.AddInviteCodes(codes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// InviteCodes returns all the invite codes, used or not.
+func (d *Database) InviteCodes() (map[string]*InviteCode, error) {
+	defer recordLatency("InviteCodes")()
+
+	var ic InviteCodes
+	if err := d.storage.ReadDataFile(d.filePath(inviteCodeFile), &ic); errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return ic.Codes, nil
+}
+
+// UseInviteCode marks an invite code as used by email. Each code can only be
+// used once.
+func (d *Database) UseInviteCode(code, email string) (retErr error) {
+	defer recordLatency("UseInviteCode")()
+
+	var ic InviteCodes
+	commit, err := d.openInviteCodes(&ic)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	c, ok := ic.Codes[code]
+	if !ok || c.DateUsed != 0 {
+		return ErrInvalidInviteCode
+	}
+	c.DateUsed = nowInMS()
+	c.UsedBy = email
+	return commit(true, nil)
+}
+
+// ReleaseInviteCode makes an invite code that was used by email available
+// again, e.g. when the account couldn't be created.
+func (d *Database) ReleaseInviteCode(code, email string) (retErr error) {
+	defer recordLatency("ReleaseInviteCode")()
+
+	var ic InviteCodes
+	commit, err := d.openInviteCodes(&ic)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	c, ok := ic.Codes[code]
+	if !ok || c.DateUsed == 0 || c.UsedBy != email {
+		return ErrInvalidInviteCode
+	}
+	c.DateUsed = 0
+	c.UsedBy = ""
+	return commit(true, nil)
+}
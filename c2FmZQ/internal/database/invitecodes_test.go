@@ -0,0 +1,77 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"testing"
+
+	"c2FmZQ/internal/database"
+)
+
+func TestInviteCodes(t *testing.T) {
+	db := database.New(t.TempDir(), nil)
+
+	if err := db.UseInviteCode("foo", "alice"); err != database.ErrInvalidInviteCode {
+		t.Errorf("UseInviteCode(foo) returned unexpected error: want %v, got %v", database.ErrInvalidInviteCode, err)
+	}
+	if err := db.AddInviteCodes([]string{"foo"}); err != nil {
+		t.Fatalf("AddInviteCodes failed: %v", err)
+	}
+	codes, err := db.NewInviteCodes(2)
+	if err != nil {
+		t.Fatalf("NewInviteCodes failed: %v", err)
+	}
+	if len(codes) != 2 || codes[0] == codes[1] {
+		t.Fatalf("NewInviteCodes returned unexpected codes: %v", codes)
+	}
+
+	if err := db.UseInviteCode("foo", "alice"); err != nil {
+		t.Errorf("UseInviteCode(foo) failed: %v", err)
+	}
+	// Codes can only be used once.
+	if err := db.UseInviteCode("foo", "bob"); err != database.ErrInvalidInviteCode {
+		t.Errorf("UseInviteCode(foo) returned unexpected error: want %v, got %v", database.ErrInvalidInviteCode, err)
+	}
+	if err := db.UseInviteCode(codes[0], "bob"); err != nil {
+		t.Errorf("UseInviteCode(%s) failed: %v", codes[0], err)
+	}
+	// Released codes can be used again, but only the user who used them
+	// can release them.
+	if err := db.UseInviteCode(codes[1], "carol"); err != nil {
+		t.Errorf("UseInviteCode(%s) failed: %v", codes[1], err)
+	}
+	if err := db.ReleaseInviteCode(codes[1], "bob"); err != database.ErrInvalidInviteCode {
+		t.Errorf("ReleaseInviteCode(%s) returned unexpected error: want %v, got %v", codes[1], database.ErrInvalidInviteCode, err)
+	}
+	if err := db.ReleaseInviteCode(codes[1], "carol"); err != nil {
+		t.Errorf("ReleaseInviteCode(%s) failed: %v", codes[1], err)
+	}
+
+	all, err := db.InviteCodes()
+	if err != nil {
+		t.Fatalf("InviteCodes failed: %v", err)
+	}
+	if len(all) != 3 {
+		t.Fatalf("InviteCodes returned unexpected codes: %v", all)
+	}
+	for code, want := range map[string]string{"foo": "alice", codes[0]: "bob", codes[1]: ""} {
+		if got := all[code].UsedBy; want != got {
+			t.Errorf("InviteCodes()[%s].UsedBy = %q, want %q", code, got, want)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+)
+
+const (
+	// The logical filename where the pending shares are stored.
+	pendingShareFile = "pending-shares.dat"
+)
+
+// PendingShare is an invitation to share an album with someone who doesn't
+// have an account yet.
+//
+// The server can't add the recipient to the album on its own because the
+// album's secret key must be encrypted with the recipient's public key, which
+// only exists after they register. When they do, the recipient is added to
+// the sharer's contacts, and the sharer's client completes the share the next
+// time it syncs.
+type PendingShare struct {
+	AlbumID     string `json:"albumId"`
+	SharerID    int64  `json:"sharerId"`
+	Email       string `json:"email"`
+	Permissions string `json:"permissions"`
+	DateCreated int64  `json:"dateCreated"`
+	// The user ID of the recipient, after they registered.
+	RecipientID int64 `json:"recipientId,omitempty"`
+}
+
+// PendingShares contains all the pending shares.
+type PendingShares struct {
+	Shares []PendingShare `json:"shares"`
+}
+
+func (d *Database) openPendingShares(shares *PendingShares) (func(bool, *error) error, error) {
+	if err := d.storage.CreateEmptyFile(d.filePath(pendingShareFile), PendingShares{}); err != nil && !errors.Is(err, fs.ErrExist) {
+		return nil, err
+	}
+	return d.storage.OpenForUpdate(d.filePath(pendingShareFile), shares)
+}
+
+// AddPendingShare records an invitation from sharer to share an album with
+// email. It returns os.ErrExist if email already has an account.
+func (d *Database) AddPendingShare(sharer User, albumID, email, permissions string) (retErr error) {
+	defer recordLatency("AddPendingShare")()
+
+	if _, err := d.User(email); err == nil {
+		return os.ErrExist
+	}
+	var shares PendingShares
+	commit, err := d.openPendingShares(&shares)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	ps := PendingShare{
+		AlbumID:     albumID,
+		SharerID:    sharer.UserID,
+		Email:       email,
+		Permissions: permissions,
+		DateCreated: nowInMS(),
+	}
+	for i, s := range shares.Shares {
+		if s.AlbumID == albumID && s.SharerID == sharer.UserID && s.Email == email {
+			shares.Shares[i] = ps
+			return commit(true, nil)
+		}
+	}
+	shares.Shares = append(shares.Shares, ps)
+	return commit(true, nil)
+}
+
+// PendingSharesFrom returns the pending shares created by sharer.
+func (d *Database) PendingSharesFrom(sharer User) ([]PendingShare, error) {
+	defer recordLatency("PendingSharesFrom")()
+
+	var shares PendingShares
+	if err := d.storage.ReadDataFile(d.filePath(pendingShareFile), &shares); errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var out []PendingShare
+	for _, s := range shares.Shares {
+		if s.SharerID == sharer.UserID {
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+// removePendingShares removes the pending shares that match f.
+func (d *Database) removePendingShares(f func(PendingShare) bool) (retErr error) {
+	var shares PendingShares
+	commit, err := d.openPendingShares(&shares)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	var keep []PendingShare
+	for _, s := range shares.Shares {
+		if !f(s) {
+			keep = append(keep, s)
+		}
+	}
+	if len(keep) == len(shares.Shares) {
+		return nil
+	}
+	shares.Shares = keep
+	return commit(true, nil)
+}
+
+// CancelPendingShare removes sharer's invitation to share an album with
+// email.
+func (d *Database) CancelPendingShare(sharer User, albumID, email string) error {
+	defer recordLatency("CancelPendingShare")()
+
+	return d.removePendingShares(func(s PendingShare) bool {
+		return s.SharerID == sharer.UserID && s.AlbumID == albumID && s.Email == email
+	})
+}
+
+// CompletePendingShares removes the pending shares of an album that were
+// completed, i.e. the recipients were added as members.
+func (d *Database) CompletePendingShares(albumID string, members []int64) error {
+	defer recordLatency("CompletePendingShares")()
+
+	m := make(map[int64]bool)
+	for _, id := range members {
+		m[id] = true
+	}
+	return d.removePendingShares(func(s PendingShare) bool {
+		return s.AlbumID == albumID && s.RecipientID != 0 && m[s.RecipientID]
+	})
+}
+
+// acceptPendingShares is called when a new user is ready to use their account.
+// The pending shares for their email address are updated with their user ID,
+// and they are added to the sharers' contacts, so that the sharers' clients
+// can complete the shares.
+func (d *Database) acceptPendingShares(u User) (retErr error) {
+	var shares PendingShares
+	commit, err := d.openPendingShares(&shares)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	var sharers []int64
+	for i, s := range shares.Shares {
+		if s.Email != u.Email || s.RecipientID != 0 {
+			continue
+		}
+		shares.Shares[i].RecipientID = u.UserID
+		sharers = append(sharers, s.SharerID)
+	}
+	if len(sharers) == 0 {
+		return nil
+	}
+	if err := commit(true, nil); err != nil {
+		return err
+	}
+	for _, id := range sharers {
+		sharer, err := d.UserByID(id)
+		if err != nil {
+			return err
+		}
+		if _, err := d.addContactToUser(sharer, u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
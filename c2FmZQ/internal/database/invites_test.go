@@ -0,0 +1,94 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestPendingShares(t *testing.T) {
+	db := database.New(t.TempDir(), nil)
+	database.CurrentTimeForTesting = 10000
+	defer func() { database.CurrentTimeForTesting = 0 }()
+
+	if err := addUser(db, "alice@", stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+		t.Fatalf("addUser failed: %v", err)
+	}
+	alice, err := db.User("alice@")
+	if err != nil {
+		t.Fatalf("db.User(alice@) failed: %v", err)
+	}
+	if err := db.AddPendingShare(alice, "album1", "alice@", "1000"); !errors.Is(err, os.ErrExist) {
+		t.Errorf("AddPendingShare(alice@) returned unexpected error: want %v, got %v", os.ErrExist, err)
+	}
+	for _, id := range []string{"album1", "album2", "album2"} {
+		if err := db.AddPendingShare(alice, id, "bob@", "1000"); err != nil {
+			t.Fatalf("AddPendingShare(%s, bob@) failed: %v", id, err)
+		}
+	}
+	if err := db.AddPendingShare(alice, "album1", "carol@", "1000"); err != nil {
+		t.Fatalf("AddPendingShare(album1, carol@) failed: %v", err)
+	}
+	if err := db.CancelPendingShare(alice, "album1", "carol@"); err != nil {
+		t.Fatalf("CancelPendingShare(album1, carol@) failed: %v", err)
+	}
+	shares, err := db.PendingSharesFrom(alice)
+	if err != nil {
+		t.Fatalf("PendingSharesFrom failed: %v", err)
+	}
+	if len(shares) != 2 || shares[0].RecipientID != 0 || shares[1].RecipientID != 0 {
+		t.Fatalf("Unexpected pending shares: %+v", shares)
+	}
+
+	// When bob registers, he is added to alice's contacts.
+	if err := addUser(db, "bob@", stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+		t.Fatalf("addUser failed: %v", err)
+	}
+	bob, err := db.User("bob@")
+	if err != nil {
+		t.Fatalf("db.User(bob@) failed: %v", err)
+	}
+	if shares, err = db.PendingSharesFrom(alice); err != nil {
+		t.Fatalf("PendingSharesFrom failed: %v", err)
+	}
+	if len(shares) != 2 || shares[0].RecipientID != bob.UserID || shares[1].RecipientID != bob.UserID {
+		t.Fatalf("Unexpected pending shares: %+v", shares)
+	}
+	cu, err := db.ContactUpdates(alice, 0, database.UpdatesPage{})
+	if err != nil {
+		t.Fatalf("ContactUpdates failed: %v", err)
+	}
+	if len(cu) != 1 || cu[0].Email != "bob@" {
+		t.Errorf("Unexpected contacts: %+v", cu)
+	}
+
+	if err := db.CompletePendingShares("album1", []int64{bob.UserID}); err != nil {
+		t.Fatalf("CompletePendingShares failed: %v", err)
+	}
+	if shares, err = db.PendingSharesFrom(alice); err != nil {
+		t.Fatalf("PendingSharesFrom failed: %v", err)
+	}
+	if len(shares) != 1 || shares[0].AlbumID != "album2" {
+		t.Errorf("Unexpected pending shares: %+v", shares)
+	}
+}
@@ -0,0 +1,98 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"c2FmZQ/internal/log"
+)
+
+const (
+	migrationsFile = "migrations.dat"
+)
+
+// migrations records the one-time data migrations that were completed.
+type migrations struct {
+	// The album file counters and total sizes were computed from the
+	// album file sets.
+	AlbumCounters bool `json:"albumCounters"`
+}
+
+// migrate runs the data migrations that weren't completed yet.
+func (d *Database) migrate() {
+	// Fail silently if it already exists.
+	d.storage.CreateEmptyFile(d.filePath(migrationsFile), migrations{})
+
+	var m migrations
+	commit, err := d.storage.OpenForUpdate(d.filePath(migrationsFile), &m)
+	if err != nil {
+		log.Errorf("migrate: %v", err)
+		return
+	}
+	changed := false
+	if !m.AlbumCounters {
+		if err := d.backfillAlbumCounters(); err != nil {
+			log.Errorf("backfillAlbumCounters: %v", err)
+		} else {
+			m.AlbumCounters = true
+			changed = true
+		}
+	}
+	if err := commit(changed, nil); err != nil {
+		log.Errorf("migrate: %v", err)
+	}
+}
+
+// backfillAlbumCounters computes the file counter and total size of all the
+// albums. Albums created before the counters were introduced don't have them.
+func (d *Database) backfillAlbumCounters() error {
+	var ul []userList
+	if err := d.storage.ReadDataFile(d.filePath(userListFile), &ul); err != nil {
+		return err
+	}
+	count := 0
+	for _, u := range ul {
+		user, err := d.UserByID(u.UserID)
+		if err != nil {
+			return err
+		}
+		albums, err := d.AlbumRefs(user)
+		if err != nil {
+			return err
+		}
+		for _, v := range albums {
+			var fs FileSet
+			commit, err := d.storage.OpenForUpdate(v.File, &fs)
+			if err != nil {
+				return err
+			}
+			if fs.Album == nil || fs.Album.OwnerID != user.UserID {
+				commit(false, nil)
+				continue
+			}
+			fs.updateAlbumCounters()
+			if err := commit(true, nil); err != nil {
+				return err
+			}
+			count++
+		}
+	}
+	if count > 0 {
+		log.Infof("Computed the counters of %d album(s)", count)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"testing"
+
+	"c2FmZQ/internal/stingle"
+)
+
+func TestBackfillAlbumCounters(t *testing.T) {
+	dir := t.TempDir()
+	db := New(dir, []byte("passphrase"))
+	CurrentTimeForTesting = 10000
+
+	if _, err := db.AddUser(User{
+		Email:     "alice@",
+		PublicKey: stingle.MakeSecretKeyForTest().PublicKey(),
+	}); err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	user, err := db.User("alice@")
+	if err != nil {
+		t.Fatalf("User: %v", err)
+	}
+	if err := db.AddAlbum(user, AlbumSpec{OwnerID: user.UserID, AlbumID: "album"}); err != nil {
+		t.Fatalf("AddAlbum: %v", err)
+	}
+	for _, name := range []string{"file1", "file2", "file3"} {
+		fs := FileSpec{StoreFileSize: 1000, StoreThumbSize: 100}
+		for _, p := range []*string{&fs.StoreFile, &fs.StoreThumb} {
+			w, fn, err := db.TempFile(dir)
+			if err != nil {
+				t.Fatalf("TempFile: %v", err)
+			}
+			w.Close()
+			*p = fn
+		}
+		if err := db.AddFile(user, fs, name, stingle.AlbumSet, "album"); err != nil {
+			t.Fatalf("AddFile: %v", err)
+		}
+	}
+
+	// Simulate an album and a database from before the counters existed.
+	commit, fs, err := db.fileSetForUpdate(user, stingle.AlbumSet, "album")
+	if err != nil {
+		t.Fatalf("fileSetForUpdate: %v", err)
+	}
+	fs.Album.FileCount = 0
+	fs.Album.TotalSize = 0
+	if err := commit(true, nil); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if err := db.storage.SaveDataFile(db.filePath(migrationsFile), migrations{}); err != nil {
+		t.Fatalf("SaveDataFile: %v", err)
+	}
+
+	db = New(dir, []byte("passphrase"))
+	album, err := db.Album(user, "album")
+	if err != nil {
+		t.Fatalf("Album: %v", err)
+	}
+	if album.FileCount != 3 || album.TotalSize != 3300 {
+		t.Errorf("Unexpected counters after migration: FileCount=%d TotalSize=%d", album.FileCount, album.TotalSize)
+	}
+	var m migrations
+	if err := db.storage.ReadDataFile(db.filePath(migrationsFile), &m); err != nil {
+		t.Fatalf("ReadDataFile: %v", err)
+	}
+	if !m.AlbumCounters {
+		t.Error("AlbumCounters migration wasn't recorded")
+	}
+}
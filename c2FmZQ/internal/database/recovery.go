@@ -0,0 +1,178 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RecoveryReport describes what Recover found and fixed.
+type RecoveryReport struct {
+	// The number of interrupted multi-file updates that were rolled back
+	// when the database was opened.
+	PendingOpsRolledBack int
+	// The leftover temporary files that were removed, relative to the
+	// database directory.
+	TempFilesRemoved []string
+	// The leftover backup files that were removed, relative to the
+	// database directory.
+	BackupFilesRemoved []string
+	// The leftover partial uploads that were removed, relative to the
+	// database directory.
+	UploadsRemoved []string
+	// The problems that couldn't be fixed.
+	Errors []error
+}
+
+// String returns a one-line summary of the report.
+func (r RecoveryReport) String() string {
+	if r.Clean() {
+		return "clean"
+	}
+	out := fmt.Sprintf("%d pending op(s) rolled back, %d temp file(s), %d backup file(s), %d partial upload(s) removed",
+		r.PendingOpsRolledBack, len(r.TempFilesRemoved), len(r.BackupFilesRemoved), len(r.UploadsRemoved))
+	if len(r.Errors) > 0 {
+		out += fmt.Sprintf(", %d error(s): %v", len(r.Errors), r.Errors)
+	}
+	return out
+}
+
+// Clean returns true if there was nothing to recover.
+func (r RecoveryReport) Clean() bool {
+	return r.PendingOpsRolledBack == 0 && len(r.TempFilesRemoved) == 0 &&
+		len(r.BackupFilesRemoved) == 0 && len(r.UploadsRemoved) == 0 && len(r.Errors) == 0
+}
+
+// countPendingOps returns the number of interrupted multi-file updates in dir.
+// They are rolled back by storage.New.
+func countPendingOps(dir string) int {
+	m, _ := filepath.Glob(filepath.Join(dir, "pending", "*"))
+	n := 0
+	for _, f := range m {
+		if !strings.Contains(filepath.Base(f), ".tmp-") {
+			n++
+		}
+	}
+	return n
+}
+
+// Recover verifies the database directory structure and cleans up after an
+// interrupted run, i.e. it removes the temporary files left behind by
+// interrupted writes, the backup files of multi-file updates that are no
+// longer pending, and the partial uploads.
+//
+// It must be called before the database is used, when nothing else is
+// writing to it.
+func (d *Database) Recover() (*RecoveryReport, error) {
+	defer recordLatency("Recover")()
+
+	report := &RecoveryReport{PendingOpsRolledBack: d.pendingOpsRolledBack}
+	d.pendingOpsRolledBack = 0
+
+	if fi, err := os.Stat(d.Dir()); err != nil {
+		return nil, err
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", d.Dir())
+	}
+	if n := countPendingOps(d.Dir()); n > 0 {
+		return nil, fmt.Errorf("%d pending op(s) were not rolled back", n)
+	}
+	if d.masterKey != nil {
+		if _, err := os.Stat(filepath.Join(d.Dir(), "master.key")); err != nil {
+			report.Errors = append(report.Errors, err)
+		}
+	}
+	var ul []userList
+	if err := d.storage.ReadDataFile(d.filePath(userListFile), &ul); err != nil {
+		report.Errors = append(report.Errors, fmt.Errorf("user list: %w", err))
+	}
+	var q Quotas
+	if err := d.storage.ReadDataFile(d.filePath(quotaFile), &q); err != nil {
+		report.Errors = append(report.Errors, fmt.Errorf("quotas: %w", err))
+	}
+
+	remove := func(path string, list *[]string) {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			report.Errors = append(report.Errors, err)
+			return
+		}
+		rel, _ := filepath.Rel(d.Dir(), path)
+		*list = append(*list, rel)
+	}
+	check := func(path string, de fs.DirEntry) {
+		switch {
+		case strings.Contains(de.Name(), ".tmp-"):
+			remove(path, &report.TempFilesRemoved)
+		case strings.Contains(de.Name(), ".bck-"):
+			remove(path, &report.BackupFilesRemoved)
+		}
+	}
+	walk := func(dir string, f func(string, fs.DirEntry)) error {
+		err := filepath.WalkDir(dir, func(path string, de fs.DirEntry, err error) error {
+			if err != nil || de.IsDir() {
+				return err
+			}
+			f(path, de)
+			return nil
+		})
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	// Only the directories that can contain interrupted work are checked,
+	// not the blobs. The temporary blob files are removed by
+	// CollectGarbage.
+	if err := walk(filepath.Join(d.Dir(), "uploads"), func(path string, _ fs.DirEntry) {
+		remove(path, &report.UploadsRemoved)
+	}); err != nil {
+		return nil, err
+	}
+	if err := walk(filepath.Join(d.Dir(), "metadata"), check); err != nil {
+		return nil, err
+	}
+	// The encrypted metadata files are directly in the top-level hash
+	// directories. The subdirectories only contain blobs.
+	dirs := []string{d.Dir(), filepath.Join(d.Dir(), "pending")}
+	if d.masterKey != nil {
+		for i := 0; i < 256; i++ {
+			dirs = append(dirs, filepath.Join(d.Dir(), fmt.Sprintf("%02X", i)))
+		}
+	}
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, de := range entries {
+			if !de.IsDir() {
+				check(filepath.Join(dir, de.Name()), de)
+			}
+		}
+	}
+	return report, nil
+}
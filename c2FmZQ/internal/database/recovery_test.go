@@ -0,0 +1,130 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestRecover(t *testing.T) {
+	dir := t.TempDir()
+	db := database.New(dir, []byte("passphrase"))
+	email := "alice@"
+	if err := addUser(db, email, stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+		t.Fatalf("addUser(%q, pk) failed: %v", email, err)
+	}
+
+	report, err := db.Recover()
+	if err != nil {
+		t.Fatalf("db.Recover() failed: %v", err)
+	}
+	if !report.Clean() {
+		t.Errorf("Unexpected report: %s", report)
+	}
+
+	// Simulate a crash in the middle of a few writes.
+	s := storage.New(dir, nil)
+	if err := s.SaveDataFile("data", "original"); err != nil {
+		t.Fatalf("SaveDataFile failed: %v", err)
+	}
+	ts := time.Now().Add(-time.Minute)
+	if err := os.Link(filepath.Join(dir, "data"), filepath.Join(dir, fmt.Sprintf("data.bck-%d", ts.UnixNano()))); err != nil {
+		t.Fatalf("os.Link failed: %v", err)
+	}
+	pending := struct {
+		TS    time.Time `json:"ts"`
+		Files []string  `json:"files"`
+	}{ts, []string{"data"}}
+	if err := s.SaveDataFile(filepath.Join("pending", fmt.Sprintf("%d", ts.UnixNano())), pending); err != nil {
+		t.Fatalf("SaveDataFile failed: %v", err)
+	}
+	if err := s.SaveDataFile("data", "modified"); err != nil {
+		t.Fatalf("SaveDataFile failed: %v", err)
+	}
+	junk := []string{
+		"data.tmp-12345",
+		filepath.Join("AB", "blob.tmp-abc"),
+		"other.bck-12345",
+		filepath.Join("uploads", "partial"),
+	}
+	// Temporary blob files are left for CollectGarbage.
+	blobTmp := filepath.Join("AB", "CD", "blob.tmp-abc")
+	for _, f := range append(junk, blobTmp) {
+		fn := filepath.Join(dir, f)
+		if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+			t.Fatalf("os.MkdirAll failed: %v", err)
+		}
+		if err := os.WriteFile(fn, []byte("junk"), 0600); err != nil {
+			t.Fatalf("os.WriteFile failed: %v", err)
+		}
+	}
+
+	db = database.New(dir, []byte("passphrase"))
+	if report, err = db.Recover(); err != nil {
+		t.Fatalf("db.Recover() failed: %v", err)
+	}
+	if want, got := 1, report.PendingOpsRolledBack; want != got {
+		t.Errorf("PendingOpsRolledBack: want %d, got %d", want, got)
+	}
+	if want, got := 2, len(report.TempFilesRemoved); want != got {
+		t.Errorf("TempFilesRemoved: want %d, got %v", want, report.TempFilesRemoved)
+	}
+	if want, got := 1, len(report.BackupFilesRemoved); want != got {
+		t.Errorf("BackupFilesRemoved: want %d, got %v", want, report.BackupFilesRemoved)
+	}
+	if want, got := 1, len(report.UploadsRemoved); want != got {
+		t.Errorf("UploadsRemoved: want %d, got %v", want, report.UploadsRemoved)
+	}
+	if len(report.Errors) != 0 {
+		t.Errorf("Errors: %v", report.Errors)
+	}
+	for _, f := range junk {
+		if _, err := os.Stat(filepath.Join(dir, f)); !os.IsNotExist(err) {
+			t.Errorf("%s wasn't removed", f)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, blobTmp)); err != nil {
+		t.Errorf("%s was removed: %v", blobTmp, err)
+	}
+	var data string
+	if err := s.ReadDataFile("data", &data); err != nil {
+		t.Fatalf("ReadDataFile failed: %v", err)
+	}
+	if want, got := "original", data; want != got {
+		t.Errorf("Unexpected data: want %q, got %q", want, got)
+	}
+	if _, err := db.User(email); err != nil {
+		t.Errorf("db.User(%q) failed: %v", email, err)
+	}
+
+	if report, err = db.Recover(); err != nil {
+		t.Fatalf("db.Recover() failed: %v", err)
+	}
+	if !report.Clean() {
+		t.Errorf("Unexpected report: %s", report)
+	}
+}
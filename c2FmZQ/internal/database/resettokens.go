@@ -0,0 +1,140 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io/fs"
+	"time"
+)
+
+const (
+	// The logical filename where the password reset tokens are stored.
+	passwordResetTokenFile = "password-reset-tokens.dat"
+)
+
+var (
+	// ErrInvalidResetToken is returned when a password reset token doesn't
+	// exist, was already used, or has expired.
+	ErrInvalidResetToken = errors.New("invalid password reset token")
+)
+
+// PasswordResetTokens contains the outstanding password reset tokens, keyed
+// by the hash of the token. The tokens themselves are never stored.
+type PasswordResetTokens struct {
+	Tokens map[string]PasswordResetToken `json:"tokens"`
+}
+
+// PasswordResetToken is an outstanding password reset token.
+type PasswordResetToken struct {
+	UserID  int64 `json:"userId"`
+	Expires int64 `json:"expires"`
+}
+
+func hashResetToken(tok string) string {
+	h := sha256.Sum256([]byte(tok))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+// openPasswordResetTokens opens the password reset tokens for update, and
+// removes the ones that have expired.
+func (d *Database) openPasswordResetTokens(tokens *PasswordResetTokens) (func(bool, *error) error, error) {
+	if err := d.storage.CreateEmptyFile(d.filePath(passwordResetTokenFile), PasswordResetTokens{}); err != nil && !errors.Is(err, fs.ErrExist) {
+		return nil, err
+	}
+	commit, err := d.storage.OpenForUpdate(d.filePath(passwordResetTokenFile), tokens)
+	if err != nil {
+		return nil, err
+	}
+	if tokens.Tokens == nil {
+		tokens.Tokens = make(map[string]PasswordResetToken)
+	}
+	now := nowInMS()
+	for k, t := range tokens.Tokens {
+		if t.Expires <= now {
+			delete(tokens.Tokens, k)
+		}
+	}
+	return commit, nil
+}
+
+// NewPasswordResetToken returns a new password reset token for the user. The
+// token is valid for ttl, and it replaces any other outstanding token for the
+// same user.
+func (d *Database) NewPasswordResetToken(userID int64, ttl time.Duration) (tok string, retErr error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	tok = base64.RawURLEncoding.EncodeToString(b)
+
+	var tokens PasswordResetTokens
+	commit, err := d.openPasswordResetTokens(&tokens)
+	if err != nil {
+		return "", err
+	}
+	defer commit(false, &retErr)
+	for k, t := range tokens.Tokens {
+		if t.UserID == userID {
+			delete(tokens.Tokens, k)
+		}
+	}
+	tokens.Tokens[hashResetToken(tok)] = PasswordResetToken{
+		UserID:  userID,
+		Expires: nowInMS() + ttl.Milliseconds(),
+	}
+	return tok, commit(true, nil)
+}
+
+// PasswordResetTokenUser validates a password reset token without consuming
+// it, and returns the ID of the user to whom it was issued.
+func (d *Database) PasswordResetTokenUser(tok string) (int64, error) {
+	var tokens PasswordResetTokens
+	if err := d.storage.ReadDataFile(d.filePath(passwordResetTokenFile), &tokens); errors.Is(err, fs.ErrNotExist) {
+		return 0, ErrInvalidResetToken
+	} else if err != nil {
+		return 0, err
+	}
+	t, ok := tokens.Tokens[hashResetToken(tok)]
+	if !ok || t.Expires <= nowInMS() {
+		return 0, ErrInvalidResetToken
+	}
+	return t.UserID, nil
+}
+
+// ConsumePasswordResetToken validates a password reset token and returns the
+// ID of the user to whom it was issued. A token can only be used once.
+func (d *Database) ConsumePasswordResetToken(tok string) (userID int64, retErr error) {
+	var tokens PasswordResetTokens
+	commit, err := d.openPasswordResetTokens(&tokens)
+	if err != nil {
+		return 0, err
+	}
+	// Commit even when the token is invalid to remove the expired tokens.
+	defer commit(true, &retErr)
+	h := hashResetToken(tok)
+	t, ok := tokens.Tokens[h]
+	if !ok {
+		return 0, ErrInvalidResetToken
+	}
+	delete(tokens.Tokens, h)
+	return t.UserID, nil
+}
@@ -0,0 +1,72 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+import (
+	"testing"
+	"time"
+
+	"c2FmZQ/internal/database"
+)
+
+func TestPasswordResetTokens(t *testing.T) {
+	db := database.New(t.TempDir(), nil)
+	database.CurrentTimeForTesting = 10000
+	defer func() { database.CurrentTimeForTesting = 0 }()
+
+	if _, err := db.PasswordResetTokenUser("foo"); err != database.ErrInvalidResetToken {
+		t.Errorf("PasswordResetTokenUser(foo) returned unexpected error: want %v, got %v", database.ErrInvalidResetToken, err)
+	}
+
+	tok1, err := db.NewPasswordResetToken(1, time.Minute)
+	if err != nil {
+		t.Fatalf("NewPasswordResetToken failed: %v", err)
+	}
+	tok2, err := db.NewPasswordResetToken(2, time.Minute)
+	if err != nil {
+		t.Fatalf("NewPasswordResetToken failed: %v", err)
+	}
+	if id, err := db.PasswordResetTokenUser(tok1); err != nil || id != 1 {
+		t.Errorf("PasswordResetTokenUser(tok1) = %d, %v, want 1, nil", id, err)
+	}
+
+	// A new token replaces the old one for the same user.
+	tok3, err := db.NewPasswordResetToken(1, time.Minute)
+	if err != nil {
+		t.Fatalf("NewPasswordResetToken failed: %v", err)
+	}
+	if _, err := db.ConsumePasswordResetToken(tok1); err != database.ErrInvalidResetToken {
+		t.Errorf("ConsumePasswordResetToken(tok1) returned unexpected error: want %v, got %v", database.ErrInvalidResetToken, err)
+	}
+	if id, err := db.ConsumePasswordResetToken(tok3); err != nil || id != 1 {
+		t.Errorf("ConsumePasswordResetToken(tok3) = %d, %v, want 1, nil", id, err)
+	}
+	// Tokens can only be used once.
+	if _, err := db.ConsumePasswordResetToken(tok3); err != database.ErrInvalidResetToken {
+		t.Errorf("ConsumePasswordResetToken(tok3) returned unexpected error: want %v, got %v", database.ErrInvalidResetToken, err)
+	}
+
+	// Tokens expire.
+	database.CurrentTimeForTesting += time.Minute.Milliseconds()
+	if _, err := db.PasswordResetTokenUser(tok2); err != database.ErrInvalidResetToken {
+		t.Errorf("PasswordResetTokenUser(tok2) returned unexpected error: want %v, got %v", database.ErrInvalidResetToken, err)
+	}
+	if _, err := db.ConsumePasswordResetToken(tok2); err != database.ErrInvalidResetToken {
+		t.Errorf("ConsumePasswordResetToken(tok2) returned unexpected error: want %v, got %v", database.ErrInvalidResetToken, err)
+	}
+}
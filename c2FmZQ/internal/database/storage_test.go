@@ -0,0 +1,262 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database_test
+
+// The benchmarks in this file measure the storage layer in the hot paths of
+// the database. Run them with:
+//
+//	go test -run='^$' -bench=. -benchmem ./internal/database
+//
+// and compare the results before and after a change, e.g. with benchstat.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/crypto"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/stingle"
+)
+
+// The number of files in the file sets used by the benchmarks.
+var benchFileSetSizes = []int{10, 1000, 10000}
+
+// benchStorage runs fn with an unencrypted and an encrypted storage.
+func benchStorage(b *testing.B, fn func(b *testing.B, s *storage.Storage)) {
+	b.Run("plain", func(b *testing.B) {
+		fn(b, storage.New(b.TempDir(), nil))
+	})
+	b.Run("aes", func(b *testing.B) {
+		mk, err := crypto.CreateAESMasterKeyForTest()
+		if err != nil {
+			b.Fatalf("CreateAESMasterKeyForTest: %v", err)
+		}
+		defer mk.Wipe()
+		fn(b, storage.New(b.TempDir(), mk))
+	})
+}
+
+// makeFileSet returns a file set with n files.
+func makeFileSet(n int) *database.FileSet {
+	fs := &database.FileSet{Files: make(map[string]*database.FileSpec, n)}
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("file%06d", i)
+		fs.Files[name] = &database.FileSpec{
+			Headers:        name + "-headers",
+			DateCreated:    int64(i),
+			DateModified:   int64(i),
+			Version:        "1",
+			StoreFile:      "1A/" + name,
+			StoreFileSize:  1 << 20,
+			StoreThumb:     "1A/" + name + "-thumb",
+			StoreThumbSize: 1 << 10,
+		}
+	}
+	return fs
+}
+
+// reportFileSize reports the size of the data file fn.
+func reportFileSize(b *testing.B, s *storage.Storage, fn string) {
+	fi, err := os.Stat(filepath.Join(s.Dir(), fn))
+	if err != nil {
+		b.Fatalf("Stat: %v", err)
+	}
+	b.ReportMetric(float64(fi.Size()), "file-bytes")
+}
+
+func BenchmarkSaveDataFile(b *testing.B) {
+	benchStorage(b, func(b *testing.B, s *storage.Storage) {
+		for _, n := range benchFileSetSizes {
+			b.Run(fmt.Sprintf("files=%d", n), func(b *testing.B) {
+				fs := makeFileSet(n)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := s.SaveDataFile("fileset", fs); err != nil {
+						b.Fatalf("SaveDataFile: %v", err)
+					}
+				}
+				b.StopTimer()
+				reportFileSize(b, s, "fileset")
+			})
+		}
+	})
+}
+
+func BenchmarkReadDataFile(b *testing.B) {
+	benchStorage(b, func(b *testing.B, s *storage.Storage) {
+		for _, n := range benchFileSetSizes {
+			b.Run(fmt.Sprintf("files=%d", n), func(b *testing.B) {
+				if err := s.SaveDataFile("fileset", makeFileSet(n)); err != nil {
+					b.Fatalf("SaveDataFile: %v", err)
+				}
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					var fs database.FileSet
+					if err := s.ReadDataFile("fileset", &fs); err != nil {
+						b.Fatalf("ReadDataFile: %v", err)
+					}
+				}
+			})
+		}
+	})
+}
+
+// BenchmarkOpenManyForUpdate updates two file sets atomically, like a move
+// between albums. With "shared", all the goroutines update the same file sets.
+// With "distinct", each goroutine has its own.
+func BenchmarkOpenManyForUpdate(b *testing.B) {
+	benchStorage(b, func(b *testing.B, s *storage.Storage) {
+		for _, shared := range []bool{true, false} {
+			name := "distinct"
+			if shared {
+				name = "shared"
+			}
+			b.Run(name, func(b *testing.B) {
+				var next atomic.Int64
+				b.ReportAllocs()
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					files := []string{"from", "to"}
+					if !shared {
+						id := next.Add(1)
+						files = []string{fmt.Sprintf("from%d", id), fmt.Sprintf("to%d", id)}
+					}
+					for _, f := range files {
+						s.CreateEmptyFile(f, makeFileSet(100))
+					}
+					for pb.Next() {
+						var from, to database.FileSet
+						commit, err := s.OpenManyForUpdate(files, []interface{}{&from, &to})
+						if err != nil {
+							b.Errorf("OpenManyForUpdate: %v", err)
+							return
+						}
+						from.DeleteHorizon++
+						to.DeleteHorizon++
+						if err := commit(true, nil); err != nil {
+							b.Errorf("commit: %v", err)
+							return
+						}
+					}
+				})
+			})
+		}
+	})
+}
+
+func BenchmarkLock(b *testing.B) {
+	s := storage.New(b.TempDir(), nil)
+	for _, shared := range []bool{true, false} {
+		name := "distinct"
+		if shared {
+			name = "shared"
+		}
+		b.Run(name, func(b *testing.B) {
+			var next atomic.Int64
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				f := "lock"
+				if !shared {
+					f = fmt.Sprintf("lock%d", next.Add(1))
+				}
+				for pb.Next() {
+					if err := s.Lock(f); err != nil {
+						b.Errorf("Lock: %v", err)
+						return
+					}
+					if err := s.Unlock(f); err != nil {
+						b.Errorf("Unlock: %v", err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkLockMany(b *testing.B) {
+	s := storage.New(b.TempDir(), nil)
+	for _, n := range []int{2, 10} {
+		b.Run(fmt.Sprintf("files=%d", n), func(b *testing.B) {
+			var files []string
+			for i := 0; i < n; i++ {
+				files = append(files, fmt.Sprintf("lock%d", i))
+			}
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := s.LockMany(files); err != nil {
+						b.Errorf("LockMany: %v", err)
+						return
+					}
+					if err := s.UnlockMany(files); err != nil {
+						b.Errorf("UnlockMany: %v", err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkBulkImport adds files to albums, like a bulk import, and reports
+// the memory allocated for each file. Each iteration adds filesPerOp files to
+// a new album, so that the results don't depend on b.N.
+func BenchmarkBulkImport(b *testing.B) {
+	const filesPerOp = 50
+	db := database.New(b.TempDir(), nil)
+	email := "alice@"
+	if err := addUser(db, email, stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+		b.Fatalf("addUser: %v", err)
+	}
+	user, err := db.User(email)
+	if err != nil {
+		b.Fatalf("db.User: %v", err)
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		albumID := fmt.Sprintf("album%d", i)
+		if err := addAlbum(db, user, albumID); err != nil {
+			b.Fatalf("addAlbum: %v", err)
+		}
+		for j := 0; j < filesPerOp; j++ {
+			if err := addFile(db, user, fmt.Sprintf("file%d-%d", i, j), stingle.AlbumSet, albumID); err != nil {
+				b.Fatalf("addFile: %v", err)
+			}
+		}
+	}
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+	files := float64(b.N * filesPerOp)
+	b.ReportMetric(float64(after.TotalAlloc-before.TotalAlloc)/files, "B/file")
+	b.ReportMetric(float64(after.Mallocs-before.Mallocs)/files, "allocs/file")
+	b.ReportMetric(float64(after.NumGC-before.NumGC)/files, "gc/file")
+}
@@ -60,8 +60,128 @@ func pruneDeleteEvents(events *[]DeleteEvent, horizonTS *int64) {
 	}
 }
 
+// The kinds of update records. When records have the same timestamp, they are
+// ordered by kind, then by key.
+const (
+	UpdateKindAlbum = iota
+	UpdateKindFile
+	UpdateKindTrash
+	UpdateKindAlbumFile
+	UpdateKindContact
+	UpdateKindDelete
+)
+
+// UpdatePos is the position of an update record in the list of all the update
+// records of a user, ordered by timestamp, kind, and key. The order is stable
+// under concurrent modifications because changed records always get a newer
+// timestamp.
+type UpdatePos struct {
+	TS   int64
+	Kind int
+	Key  string
+}
+
+// Less returns true if p is before o.
+func (p UpdatePos) Less(o UpdatePos) bool {
+	if p.TS != o.TS {
+		return p.TS < o.TS
+	}
+	if p.Kind != o.Kind {
+		return p.Kind < o.Kind
+	}
+	return p.Key < o.Key
+}
+
+// UpdatesPage selects a page of update records, i.e. at most Limit records
+// after position After. The zero value selects all the records.
+type UpdatesPage struct {
+	After *UpdatePos
+	Limit int
+}
+
+// pageRecord is an update record and its position.
+type pageRecord[T any] struct {
+	pos UpdatePos
+	rec T
+}
+
+// pageCollector collects the update records of a page. It never holds more
+// than twice the page's limit.
+type pageCollector[T any] struct {
+	page UpdatesPage
+	recs []pageRecord[T]
+	// The position of the last record of a full page, once known. The
+	// records after it can't be in the page.
+	last *UpdatePos
+}
+
+// want returns true if a record at position pos belongs to the page, as far as
+// it can tell without seeing all the records.
+func (c *pageCollector[T]) want(pos UpdatePos) bool {
+	if c.page.After != nil && !c.page.After.Less(pos) {
+		return false
+	}
+	if c.last != nil && !pos.Less(*c.last) {
+		return false
+	}
+	return true
+}
+
+func (c *pageCollector[T]) add(pos UpdatePos, rec T) {
+	if !c.want(pos) {
+		return
+	}
+	c.recs = append(c.recs, pageRecord[T]{pos, rec})
+	if c.page.Limit > 0 && len(c.recs) >= 2*c.page.Limit {
+		c.trim()
+	}
+}
+
+// trim sorts the records and drops the ones that are past the page's limit.
+func (c *pageCollector[T]) trim() {
+	sort.Slice(c.recs, func(i, j int) bool { return c.recs[i].pos.Less(c.recs[j].pos) })
+	if c.page.Limit > 0 && len(c.recs) >= c.page.Limit {
+		c.recs = c.recs[:c.page.Limit]
+		last := c.recs[c.page.Limit-1].pos
+		c.last = &last
+	}
+}
+
+// records returns the records of the page, in order.
+func (c *pageCollector[T]) records() []T {
+	c.trim()
+	out := make([]T, 0, len(c.recs))
+	for _, r := range c.recs {
+		out = append(out, r.rec)
+	}
+	return out
+}
+
+// fileUpdateKind returns the kind of the update records of a file set.
+func fileUpdateKind(set string) int {
+	switch set {
+	case stingle.TrashSet:
+		return UpdateKindTrash
+	case stingle.AlbumSet:
+		return UpdateKindAlbumFile
+	default:
+		return UpdateKindFile
+	}
+}
+
+// FileUpdateKey returns the key of a file's update record.
+func FileUpdateKey(albumID, file string) string {
+	return albumID + "/" + file
+}
+
+// DeleteUpdateKey returns the key of a delete event's update record.
+func DeleteUpdateKey(typ int64, albumID, file string) string {
+	return fmt.Sprintf("%d/%s/%s", typ, albumID, file)
+}
+
 // fileUpdatesForSet finds which files were added to the file set since ts.
-func (d *Database) fileUpdatesForSet(user User, set, albumID string, ts int64, ch chan<- stingle.File, wg *sync.WaitGroup) {
+// The files before the start of page are skipped.
+func (d *Database) fileUpdatesForSet(user User, set, albumID string, ts int64, page UpdatesPage, ch chan<- pageRecord[stingle.File], wg *sync.WaitGroup) {
 	defer wg.Done()
 	fs, err := d.FileSet(user, set, albumID)
 	if err != nil {
@@ -69,31 +189,37 @@ func (d *Database) fileUpdatesForSet(user User, set, albumID string, ts int64, c
 		return
 	}
 
+	kind := fileUpdateKind(set)
 	for k, v := range fs.Files {
-		if v.DateModified > ts {
-			ch <- stingle.File{
-				File:         k,
-				Version:      v.Version,
-				DateCreated:  number(v.DateCreated),
-				DateModified: number(v.DateModified),
-				Headers:      v.Headers,
-				AlbumID:      albumID,
-			}
+		if v.DateModified <= ts {
+			continue
+		}
+		pos := UpdatePos{TS: v.DateModified, Kind: kind, Key: FileUpdateKey(albumID, k)}
+		if page.After != nil && !page.After.Less(pos) {
+			continue
 		}
+		ch <- pageRecord[stingle.File]{pos, stingle.File{
+			File:         k,
+			Version:      v.Version,
+			DateCreated:  number(v.DateCreated),
+			DateModified: number(v.DateModified),
+			Headers:      v.Headers,
+			AlbumID:      albumID,
+		}}
 	}
 }
 
-// FileUpdates returns all the files that were added to a file set since time
-// ts.
-func (d *Database) FileUpdates(user User, set string, ts int64) ([]stingle.File, error) {
+// FileUpdates returns the files that were added to a file set since time ts,
+// limited to the selected page.
+func (d *Database) FileUpdates(user User, set string, ts int64, page UpdatesPage) ([]stingle.File, error) {
 	defer recordLatency("FileUpdates")()
 
-	ch := make(chan stingle.File)
+	ch := make(chan pageRecord[stingle.File])
 	var wg sync.WaitGroup
 
 	if set != stingle.AlbumSet {
 		wg.Add(1)
-		go d.fileUpdatesForSet(user, set, "", ts, ch, &wg)
+		go d.fileUpdatesForSet(user, set, "", ts, page, ch, &wg)
 	} else {
 		albumRefs, err := d.AlbumRefs(user)
 		if err != nil {
@@ -103,30 +229,24 @@ func (d *Database) FileUpdates(user User, set string, ts int64) ([]stingle.File,
 
 		for _, album := range albumRefs {
 			wg.Add(1)
-			go d.fileUpdatesForSet(user, stingle.AlbumSet, album.AlbumID, ts, ch, &wg)
+			go d.fileUpdatesForSet(user, stingle.AlbumSet, album.AlbumID, ts, page, ch, &wg)
 		}
 	}
-	go func(ch chan<- stingle.File, wg *sync.WaitGroup) {
+	go func(ch chan<- pageRecord[stingle.File], wg *sync.WaitGroup) {
 		wg.Wait()
 		close(ch)
 	}(ch, &wg)
 
-	out := []stingle.File{}
-	for sf := range ch {
-		out = append(out, sf)
+	pc := pageCollector[stingle.File]{page: page}
+	for r := range ch {
+		pc.add(r.pos, r.rec)
 	}
-	sort.Slice(out, func(i, j int) bool {
-		if out[i].DateModified == out[j].DateModified {
-			return out[i].File < out[j].File
-		}
-		return out[i].DateModified < out[j].DateModified
-	})
-	return out, nil
+	return pc.records(), nil
 }
 
 // deleteUpdatesForSet finds which files were deleted from the file set since
-// ts.
-func (d *Database) deleteUpdatesForSet(user User, set, albumID string, ts int64, ch chan<- stingle.DeleteEvent, eCh chan<- error) {
+// ts. The delete events before the start of page are skipped.
+func (d *Database) deleteUpdatesForSet(user User, set, albumID string, ts int64, page UpdatesPage, ch chan<- pageRecord[stingle.DeleteEvent], eCh chan<- error) {
 	fs, err := d.FileSet(user, set, albumID)
 	if err != nil {
 		log.Errorf("d.FileSet(%q, %q, %q failed: %v", user.Email, set, albumID, err)
@@ -138,24 +258,37 @@ func (d *Database) deleteUpdatesForSet(user User, set, albumID string, ts int64,
 		return
 	}
 	for _, d := range fs.Deletes {
-		if d.Date > ts {
-			ch <- stingle.DeleteEvent{
-				File:    d.File,
-				AlbumID: d.AlbumID,
-				Type:    number(int64(d.Type)),
-				Date:    number(d.Date),
-			}
+		if d.Date <= ts {
+			continue
 		}
+		pos := deleteUpdatePos(d)
+		if page.After != nil && !page.After.Less(pos) {
+			continue
+		}
+		ch <- pageRecord[stingle.DeleteEvent]{pos, convertDeleteEvent(d)}
 	}
 	eCh <- nil
 }
 
-// DeleteUpdates returns all the files that were deleted from a file set since
-// time ts.
-func (d *Database) DeleteUpdates(user User, ts int64) ([]stingle.DeleteEvent, error) {
+func deleteUpdatePos(d DeleteEvent) UpdatePos {
+	return UpdatePos{TS: d.Date, Kind: UpdateKindDelete, Key: DeleteUpdateKey(int64(d.Type), d.AlbumID, d.File)}
+}
+
+func convertDeleteEvent(d DeleteEvent) stingle.DeleteEvent {
+	return stingle.DeleteEvent{
+		File:    d.File,
+		AlbumID: d.AlbumID,
+		Type:    number(int64(d.Type)),
+		Date:    number(d.Date),
+	}
+}
+
+// DeleteUpdates returns the files that were deleted from a file set since
+// time ts, limited to the selected page.
+func (d *Database) DeleteUpdates(user User, ts int64, page UpdatesPage) ([]stingle.DeleteEvent, error) {
 	defer recordLatency("DeleteUpdates")()
 
-	out := []stingle.DeleteEvent{}
+	pc := pageCollector[stingle.DeleteEvent]{page: page}
 
 	var manifest AlbumManifest
 	if err := d.storage.ReadDataFile(d.filePath(user.home(albumManifest)), &manifest); err != nil {
@@ -166,12 +299,7 @@ func (d *Database) DeleteUpdates(user User, ts int64) ([]stingle.DeleteEvent, er
 	}
 	for _, d := range manifest.Deletes {
 		if d.Date > ts {
-			out = append(out, stingle.DeleteEvent{
-				File:    d.File,
-				AlbumID: d.AlbumID,
-				Type:    number(int64(d.Type)),
-				Date:    number(d.Date),
-			})
+			pc.add(deleteUpdatePos(d), convertDeleteEvent(d))
 		}
 	}
 	var contactList ContactList
@@ -183,27 +311,22 @@ func (d *Database) DeleteUpdates(user User, ts int64) ([]stingle.DeleteEvent, er
 	}
 	for _, d := range contactList.Deletes {
 		if d.Date > ts {
-			out = append(out, stingle.DeleteEvent{
-				File:    d.File,
-				AlbumID: d.AlbumID,
-				Type:    number(int64(d.Type)),
-				Date:    number(d.Date),
-			})
+			pc.add(deleteUpdatePos(d), convertDeleteEvent(d))
 		}
 	}
 
-	ch := make(chan stingle.DeleteEvent)
+	ch := make(chan pageRecord[stingle.DeleteEvent])
 	eCh := make(chan error)
 	count := 0
 	for _, set := range []string{stingle.GallerySet, stingle.TrashSet, stingle.AlbumSet} {
 		if set == stingle.AlbumSet {
 			for _, a := range manifest.Albums {
 				count++
-				go d.deleteUpdatesForSet(user, set, a.AlbumID, ts, ch, eCh)
+				go d.deleteUpdatesForSet(user, set, a.AlbumID, ts, page, ch, eCh)
 			}
 		} else {
 			count++
-			go d.deleteUpdatesForSet(user, set, "", ts, ch, eCh)
+			go d.deleteUpdatesForSet(user, set, "", ts, page, ch, eCh)
 		}
 	}
 	var errorList []error
@@ -216,8 +339,8 @@ func (d *Database) DeleteUpdates(user User, ts int64) ([]stingle.DeleteEvent, er
 		close(ch)
 	}()
 
-	for de := range ch {
-		out = append(out, de)
+	for r := range ch {
+		pc.add(r.pos, r.rec)
 	}
 	for _, err := range errorList {
 		if err == ErrUpdateTimestampTooOld {
@@ -227,66 +350,5 @@ func (d *Database) DeleteUpdates(user User, ts int64) ([]stingle.DeleteEvent, er
 	if errorList != nil {
 		return nil, fmt.Errorf("%w %v", errorList[0], errorList[1:])
 	}
-	sort.Slice(out, func(i, j int) bool { return out[i].Date < out[j].Date })
-	return out, nil
-}
-
-type fileSize struct {
-	name string
-	size int64
-}
-
-func (d *Database) getFileSizes(user User, set, albumID string, ch chan<- fileSize, wg *sync.WaitGroup) {
-	defer wg.Done()
-	fs, err := d.FileSet(user, set, albumID)
-	if err != nil {
-		log.Errorf("d.FileSet(%q, %q, %q failed: %v", user.Email, set, albumID, err)
-		return
-	}
-	if fs.Album != nil && fs.Album.OwnerID != user.UserID {
-		// Only charge file size to owner of the album.
-		return
-	}
-	for k, f := range fs.Files {
-		ch <- fileSize{k, f.StoreFileSize + f.StoreThumbSize}
-	}
-}
-
-// SpaceUsed calculates the sum of all the file sizes in a user's file sets,
-// counting each file only once, even if it is in multiple sets.
-func (d *Database) SpaceUsed(user User) (int64, error) {
-	defer recordLatency("SpaceUsed")()
-
-	var manifest AlbumManifest
-	if err := d.storage.ReadDataFile(d.filePath(user.home(albumManifest)), &manifest); err != nil {
-		return 0, err
-	}
-
-	ch := make(chan fileSize)
-	var wg sync.WaitGroup
-	for _, set := range []string{stingle.GallerySet, stingle.TrashSet, stingle.AlbumSet} {
-		if set == stingle.AlbumSet {
-			for _, a := range manifest.Albums {
-				wg.Add(1)
-				go d.getFileSizes(user, set, a.AlbumID, ch, &wg)
-			}
-		} else {
-			wg.Add(1)
-			go d.getFileSizes(user, set, "", ch, &wg)
-		}
-	}
-	go func(ch chan<- fileSize, wg *sync.WaitGroup) {
-		wg.Wait()
-		close(ch)
-	}(ch, &wg)
-
-	files := make(map[string]int64)
-	for fs := range ch {
-		files[fs.name] = fs.size
-	}
-	var total int64
-	for _, v := range files {
-		total += v
-	}
-	return total, nil
+	return pc.records(), nil
 }
@@ -18,6 +18,8 @@
 package database
 
 import (
+	"fmt"
+	"reflect"
 	"testing"
 )
 
@@ -70,3 +72,35 @@ func TestPruneDeleteEvents(t *testing.T) {
 		t.Errorf("Unexpected changed to the delete horizon. Want %d, got %d", want, got)
 	}
 }
+
+func TestPageCollector(t *testing.T) {
+	orders := [][]int{{9, 0, 5, 1, 2, 3, 4, 6, 7, 8}, {}}
+	for i := 10; i < 20; i++ {
+		orders[0] = append(orders[0], i)
+	}
+	for i := 0; i < 20; i++ {
+		orders[1] = append(orders[1], (i*7)%20)
+	}
+	for _, tc := range []struct {
+		page UpdatesPage
+		want []int
+	}{
+		{UpdatesPage{}, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19}},
+		{UpdatesPage{Limit: 3}, []int{0, 1, 2}},
+		{UpdatesPage{After: &UpdatePos{TS: 5, Kind: UpdateKindFile, Key: "/file5"}, Limit: 3}, []int{6, 7, 8}},
+		{UpdatesPage{After: &UpdatePos{TS: 5, Kind: UpdateKindAlbum}, Limit: 3}, []int{5, 6, 7}},
+		{UpdatesPage{After: &UpdatePos{TS: 17, Kind: UpdateKindFile, Key: "/file17"}, Limit: 3}, []int{18, 19}},
+		{UpdatesPage{Limit: 2}, []int{0, 1}},
+	} {
+		for _, order := range orders {
+			pc := pageCollector[int]{page: tc.page}
+			for _, i := range order {
+				pos := UpdatePos{TS: int64(i), Kind: UpdateKindFile, Key: FileUpdateKey("", fmt.Sprintf("file%d", i))}
+				pc.add(pos, i)
+			}
+			if got := pc.records(); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("records(%+v) with order %v = %v, want %v", tc.page, order, got, tc.want)
+			}
+		}
+	}
+}
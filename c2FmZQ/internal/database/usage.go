@@ -0,0 +1,164 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+// Usage is the storage used by a user.
+type Usage struct {
+	// The sum of all the file sizes, including thumbnails.
+	SpaceUsed int64
+	// The number of files, counting each file only once, even if it is in
+	// multiple sets.
+	FileCount int
+	// The number of albums owned by the user.
+	AlbumCount int
+}
+
+type usageCacheValue struct {
+	sig   string
+	usage Usage
+}
+
+// setSizes contains the file sizes of one file set.
+type setSizes struct {
+	files map[string]int64
+	album bool
+}
+
+func (d *Database) getFileSizes(user User, set, albumID string, ch chan<- setSizes, wg *sync.WaitGroup) {
+	defer wg.Done()
+	fs, err := d.FileSet(user, set, albumID)
+	if err != nil {
+		log.Errorf("d.FileSet(%q, %q, %q failed: %v", user.Email, set, albumID, err)
+		return
+	}
+	if fs.Album != nil && fs.Album.OwnerID != user.UserID {
+		// Only charge file size to owner of the album.
+		return
+	}
+	files := make(map[string]int64, len(fs.Files))
+	for k, f := range fs.Files {
+		files[k] = f.StoreFileSize + f.StoreThumbSize
+	}
+	ch <- setSizes{files: files, album: set == stingle.AlbumSet}
+}
+
+// usageSignature returns a string that changes when any of the files that
+// affect user's usage changes.
+func (d *Database) usageSignature(files []string) string {
+	var sig strings.Builder
+	for _, f := range files {
+		ts, sz := d.stat(f)
+		fmt.Fprintf(&sig, "%s:%d:%d;", f, ts, sz)
+	}
+	return sig.String()
+}
+
+// SpaceUsed calculates the sum of all the file sizes in a user's file sets,
+// counting each file only once, even if it is in multiple sets.
+func (d *Database) SpaceUsed(user User) (int64, error) {
+	usage, err := d.Usage(user)
+	if err != nil {
+		return 0, err
+	}
+	return usage.SpaceUsed, nil
+}
+
+// Usage calculates the storage used by user. The result is cached until one of
+// the user's file sets changes.
+func (d *Database) Usage(user User) (Usage, error) {
+	defer recordLatency("Usage")()
+
+	manifestFile := d.filePath(user.home(albumManifest))
+	var manifest AlbumManifest
+	if err := d.storage.ReadDataFile(manifestFile, &manifest); err != nil {
+		return Usage{}, err
+	}
+	files := []string{
+		manifestFile,
+		d.fileSetPath(user, stingle.GallerySet),
+		d.fileSetPath(user, stingle.TrashSet),
+	}
+	var albumFiles []string
+	for _, a := range manifest.Albums {
+		albumFiles = append(albumFiles, a.File)
+	}
+	sort.Strings(albumFiles)
+	files = append(files, albumFiles...)
+
+	sig := d.usageSignature(files)
+	d.usageCacheMutex.Lock()
+	v, ok := d.usageCache.Get(user.UserID)
+	d.usageCacheMutex.Unlock()
+	if ok {
+		if cv := v.(usageCacheValue); cv.sig == sig {
+			log.Debugf("Usage cache hit %d", user.UserID)
+			return cv.usage, nil
+		}
+	}
+	log.Debugf("Usage cache miss %d", user.UserID)
+
+	ch := make(chan setSizes)
+	var wg sync.WaitGroup
+	for _, set := range []string{stingle.GallerySet, stingle.TrashSet, stingle.AlbumSet} {
+		if set == stingle.AlbumSet {
+			for _, a := range manifest.Albums {
+				wg.Add(1)
+				go d.getFileSizes(user, set, a.AlbumID, ch, &wg)
+			}
+		} else {
+			wg.Add(1)
+			go d.getFileSizes(user, set, "", ch, &wg)
+		}
+	}
+	go func(ch chan<- setSizes, wg *sync.WaitGroup) {
+		wg.Wait()
+		close(ch)
+	}(ch, &wg)
+
+	var usage Usage
+	sizes := make(map[string]int64)
+	for s := range ch {
+		if s.album {
+			usage.AlbumCount++
+		}
+		for k, v := range s.files {
+			sizes[k] = v
+		}
+	}
+	for _, v := range sizes {
+		usage.SpaceUsed += v
+	}
+	usage.FileCount = len(sizes)
+
+	if sig == d.usageSignature(files) {
+		d.usageCacheMutex.Lock()
+		d.usageCache.Add(user.UserID, usageCacheValue{sig, usage})
+		d.usageCacheMutex.Unlock()
+	}
+	return usage, nil
+}
@@ -21,6 +21,7 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/fs"
@@ -29,7 +30,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"sort"
+	"strconv"
 	"time"
 
 	"c2FmZQ/internal/log"
@@ -41,6 +42,9 @@ const (
 	userListFile    = "users.dat"
 	userFile        = "user.dat"
 	contactListFile = "contact-list.dat"
+
+	// How long a user record can stay in the cache.
+	userCacheTTL = time.Minute
 )
 
 // This is used internally for the list of all users in the system.
@@ -83,6 +87,10 @@ type User struct {
 	// The server's secret key used for encrypting tokens for this user,
 	// encrypted with master key.
 	TokenKey string `json:"serverTokenKey"`
+	// The TokenKeys that were replaced by RotateTokenKey. They are still
+	// used to validate the tokens that were issued before the rotation
+	// until these tokens expire.
+	OldTokenKeys []OldTokenKey `json:"oldServerTokenKeys,omitempty"`
 	// A set of valid tokens. Each Login adds a token. Each logout remove one.
 	ValidTokens map[string]bool `json:"validTokens"`
 	// Whether multi-factor authentication is required for login and other
@@ -98,6 +106,14 @@ type User struct {
 	WebAuthnConfig *WebAuthnConfig `json:"webAuthNConfig,omitempty"`
 }
 
+// OldTokenKey is a TokenKey that was rotated out.
+type OldTokenKey struct {
+	// The TokenKey, encrypted with master key.
+	Key string `json:"key"`
+	// The time in milliseconds after which this key isn't used anymore.
+	Expiration int64 `json:"exp"`
+}
+
 // A decoy account's information.
 type Decoy struct {
 	// The UserID of the decoy account.
@@ -265,7 +281,15 @@ func (d *Database) AddUser(u User) (userID int64, retErr error) {
 		return 0, err
 	}
 	d.notifyAdmins(notification{Type: notifyNewUserRegistration, Target: u.Email})
-	return u.UserID, commit(true, nil)
+	if err := commit(true, nil); err != nil {
+		return 0, err
+	}
+	if !u.NeedApproval {
+		if err := d.acceptPendingShares(u); err != nil {
+			log.Errorf("acceptPendingShares(%d): %v", u.UserID, err)
+		}
+	}
+	return u.UserID, nil
 }
 
 // UpdateUser adds or updates a user object.
@@ -278,6 +302,7 @@ func (d *Database) UpdateUser(u User) error {
 	if err != nil {
 		return err
 	}
+	defer d.invalidateUser(u.UserID)
 	f = u
 	return commit(true, nil)
 }
@@ -292,6 +317,7 @@ func (d *Database) MutateUser(userID int64, f func(*User) error) error {
 	if err != nil {
 		return err
 	}
+	defer d.invalidateUser(userID)
 	if u.ValidTokens == nil {
 		u.ValidTokens = make(map[string]bool)
 	}
@@ -315,7 +341,15 @@ func (d *Database) ApproveUser(id int64) error {
 		return err
 	}
 	u.NeedApproval = false
-	return commit(true, nil)
+	err = commit(true, nil)
+	d.invalidateUser(id)
+	if err != nil {
+		return err
+	}
+	if err := d.acceptPendingShares(u); err != nil {
+		log.Errorf("acceptPendingShares(%d): %v", u.UserID, err)
+	}
+	return nil
 }
 
 // RenameUser changes a user's email address.
@@ -350,6 +384,7 @@ func (d *Database) RenameUser(id int64, newEmail string) (retErr error) {
 		log.Errorf("d.storage.OpenManyForUpdate: %v", err)
 		return err
 	}
+	defer d.invalidateUser(id)
 	defer commit(false, &retErr)
 	for _, u := range ul {
 		if u.Email == newEmail {
@@ -376,17 +411,76 @@ func (d *Database) RenameUser(id int64, newEmail string) (retErr error) {
 func (d *Database) UserByID(id int64) (User, error) {
 	defer recordLatency("UserByID")()
 
+	fileName := d.filePath(homeByUserID(id, userFile))
+	ts, sz := d.stat(fileName)
+	if u, ok := d.cachedUser(id, ts, sz); ok {
+		return u, nil
+	}
 	var u User
-	err := d.storage.ReadDataFile(d.filePath("home", fmt.Sprintf("%d", id), userFile), &u)
+	err := d.storage.ReadDataFile(fileName, &u)
 	if u.ValidTokens == nil {
 		u.ValidTokens = make(map[string]bool)
 	}
 	if u.WebAuthnConfig == nil {
 		u.WebAuthnConfig = &WebAuthnConfig{}
 	}
+	if err == nil {
+		if ts2, sz2 := d.stat(fileName); ts == ts2 && sz == sz2 {
+			d.cacheUser(u, ts, sz)
+		}
+	}
 	return u, err
 }
 
+// userCacheValue is a user record in the cache. The record is kept in its
+// serialized form so that every caller gets its own copy.
+type userCacheValue struct {
+	ts      int64
+	sz      int64
+	expires time.Time
+	data    []byte
+}
+
+// cachedUser returns the cached user record for userID, if it is still
+// valid. ts and sz are the current modification time and size of the user
+// file. They change every time the file is written.
+func (d *Database) cachedUser(userID, ts, sz int64) (User, bool) {
+	d.userCacheMutex.Lock()
+	v, ok := d.userCache.Get(userID)
+	d.userCacheMutex.Unlock()
+	if ok {
+		if cv := v.(userCacheValue); cv.ts == ts && cv.sz == sz && time.Now().Before(cv.expires) {
+			var u User
+			if err := json.Unmarshal(cv.data, &u); err == nil {
+				userCacheLookups.WithLabelValues("hit").Inc()
+				return u, true
+			}
+		}
+	}
+	userCacheLookups.WithLabelValues("miss").Inc()
+	return User{}, false
+}
+
+// cacheUser adds a user record to the cache.
+func (d *Database) cacheUser(u User, ts, sz int64) {
+	data, err := json.Marshal(u)
+	if err != nil {
+		log.Errorf("json.Marshal: %v", err)
+		return
+	}
+	d.userCacheMutex.Lock()
+	defer d.userCacheMutex.Unlock()
+	d.userCache.Add(u.UserID, userCacheValue{ts, sz, time.Now().Add(userCacheTTL), data})
+}
+
+// invalidateUser removes a user record from the cache. It is called after
+// every write to the user file.
+func (d *Database) invalidateUser(userID int64) {
+	d.userCacheMutex.Lock()
+	defer d.userCacheMutex.Unlock()
+	d.userCache.Remove(userID)
+}
+
 // User returns the User object with the given email address.
 func (d *Database) User(email string) (User, error) {
 	defer recordLatency("User")()
@@ -424,6 +518,74 @@ func (d *Database) DecryptTokenKey(key string) (*token.Key, error) {
 	return token.KeyFromBytes(k), nil
 }
 
+// DecryptTokenKeys returns the user's current TokenKey followed by the old
+// TokenKeys that haven't expired yet. All the keys must be wiped by the
+// caller.
+func (d *Database) DecryptTokenKeys(u User) ([]*token.Key, error) {
+	tk, err := d.DecryptTokenKey(u.TokenKey)
+	if err != nil {
+		return nil, err
+	}
+	keys := []*token.Key{tk}
+	now := nowInMS()
+	for _, k := range u.OldTokenKeys {
+		if k.Expiration <= now {
+			continue
+		}
+		tk, err := d.DecryptTokenKey(k.Key)
+		if err != nil {
+			for _, k := range keys {
+				k.Wipe()
+			}
+			return nil, err
+		}
+		keys = append(keys, tk)
+	}
+	return keys, nil
+}
+
+// RotateTokenKey replaces the user's TokenKey with a new one. The tokens
+// issued with the old key remain valid for maxTokenAge, which should be at
+// least the lifetime of the longest-lived token. The old keys that have
+// expired are removed.
+func (d *Database) RotateTokenKey(userID int64, maxTokenAge time.Duration) error {
+	defer recordLatency("RotateTokenKey")()
+
+	etk, err := d.NewEncryptedTokenKey()
+	if err != nil {
+		return err
+	}
+	return d.MutateUser(userID, func(u *User) error {
+		now := nowInMS()
+		var keep []OldTokenKey
+		for _, k := range u.OldTokenKeys {
+			if k.Expiration > now {
+				keep = append(keep, k)
+			}
+		}
+		u.OldTokenKeys = append(keep, OldTokenKey{Key: u.TokenKey, Expiration: now + maxTokenAge.Milliseconds()})
+		u.TokenKey = etk
+		return nil
+	})
+}
+
+// RotateTokenKeys calls RotateTokenKey for all the users. Returns the number
+// of users whose key was rotated.
+func (d *Database) RotateTokenKeys(maxTokenAge time.Duration) (int, error) {
+	ids, err := d.UserIDs()
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	for _, id := range ids {
+		if err := d.RotateTokenKey(id, maxTokenAge); err != nil {
+			return count, fmt.Errorf("user %d: %w", id, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
 // EncryptSecretKey encrypts a SecretKey.
 func (d *Database) EncryptSecretKey(sk *stingle.SecretKey) (string, error) {
 	return d.Encrypt(sk.ToBytes())
@@ -517,6 +679,7 @@ func (d *Database) DeleteUser(u User) error {
 			return err
 		}
 	}
+	d.invalidateUser(u.UserID)
 	return nil
 }
 
@@ -708,8 +871,8 @@ func (d *Database) addCrossContacts(list []Contact) {
 }
 
 // ContactUpdates returns changes to a user's contact list that are more recent
-// than ts.
-func (d *Database) ContactUpdates(user User, ts int64) ([]stingle.Contact, error) {
+// than ts, limited to the selected page.
+func (d *Database) ContactUpdates(user User, ts int64, page UpdatesPage) ([]stingle.Contact, error) {
 	defer recordLatency("ContactUpdates")()
 
 	var contactList ContactList
@@ -719,26 +882,23 @@ func (d *Database) ContactUpdates(user User, ts int64) ([]stingle.Contact, error
 	if contactList.Contacts == nil {
 		contactList.Contacts = make(map[int64]*Contact)
 	}
-	out := []stingle.Contact{}
+	pc := pageCollector[stingle.Contact]{page: page}
 	for _, v := range contactList.Contacts {
-		if v.DateModified > ts {
-			sc := stingle.Contact{
-				UserID:       number(v.UserID),
-				Email:        v.Email,
-				PublicKey:    v.PublicKey,
-				DateModified: number(v.DateModified),
-			}
-
-			out = append(out, sc)
+		if v.DateModified <= ts {
+			continue
 		}
-	}
-	sort.Slice(out, func(i, j int) bool {
-		if out[i].DateModified == out[j].DateModified {
-			return out[i].Email < out[j].Email
+		pos := UpdatePos{TS: v.DateModified, Kind: UpdateKindContact, Key: strconv.FormatInt(v.UserID, 10)}
+		if !pc.want(pos) {
+			continue
 		}
-		return out[i].DateModified < out[j].DateModified
-	})
-	return out, nil
+		pc.add(pos, stingle.Contact{
+			UserID:       number(v.UserID),
+			Email:        v.Email,
+			PublicKey:    v.PublicKey,
+			DateModified: number(v.DateModified),
+		})
+	}
+	return pc.records(), nil
 }
 
 func (c *WebAuthnConfig) AddChallenge(challenge string) {
@@ -20,10 +20,13 @@ package database_test
 import (
 	"fmt"
 	"github.com/go-test/deep"
+	"sync"
 	"testing"
+	"time"
 
 	"c2FmZQ/internal/database"
 	"c2FmZQ/internal/stingle"
+	"c2FmZQ/internal/stingle/token"
 )
 
 func addUser(db *database.Database, email string, pk stingle.PublicKey) error {
@@ -94,7 +97,7 @@ func TestUsers(t *testing.T) {
 		}
 	}
 
-	cu, err := db.ContactUpdates(alice, 0)
+	cu, err := db.ContactUpdates(alice, 0, database.UpdatesPage{})
 	if err != nil {
 		t.Errorf("ContactUpdates(%q) failed: %v", alice.Email, err)
 	}
@@ -105,7 +108,7 @@ func TestUsers(t *testing.T) {
 	if err := db.DeleteUser(users["bob@"]); err != nil {
 		t.Fatalf("DeleteUser(%q) failed: %v", users["bob@"].Email, err)
 	}
-	du, err := db.DeleteUpdates(alice, 0)
+	du, err := db.DeleteUpdates(alice, 0, database.UpdatesPage{})
 	if err != nil {
 		t.Fatalf("DeleteUpdates(%q) failed: %v", alice.Email, err)
 	}
@@ -117,6 +120,68 @@ func TestUsers(t *testing.T) {
 	}
 }
 
+func TestUserCache(t *testing.T) {
+	db := database.New(t.TempDir(), nil)
+	if err := addUser(db, "alice@", stingle.MakeSecretKeyForTest().PublicKey()); err != nil {
+		t.Fatalf("addUser failed: %v", err)
+	}
+	u, err := db.User("alice@")
+	if err != nil {
+		t.Fatalf("User failed: %v", err)
+	}
+
+	// Each caller gets its own copy.
+	u.ValidTokens["foo"] = true
+	u2, err := db.UserByID(u.UserID)
+	if err != nil {
+		t.Fatalf("UserByID failed: %v", err)
+	}
+	if u2.ValidTokens["foo"] {
+		t.Error("Modifying a returned user changed the cached user")
+	}
+
+	// Concurrent mutations are never lost or hidden by the cache.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tok := fmt.Sprintf("token%d", i)
+			if err := db.MutateUser(u.UserID, func(u *database.User) error {
+				u.ValidTokens[tok] = true
+				return nil
+			}); err != nil {
+				t.Errorf("MutateUser failed: %v", err)
+			}
+			u, err := db.UserByID(u.UserID)
+			if err != nil {
+				t.Errorf("UserByID failed: %v", err)
+				return
+			}
+			if !u.ValidTokens[tok] {
+				t.Errorf("UserByID returned stale data: %s is missing", tok)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if u, err = db.UserByID(u.UserID); err != nil {
+		t.Fatalf("UserByID failed: %v", err)
+	}
+	if want, got := 10, len(u.ValidTokens); want != got {
+		t.Errorf("Unexpected number of tokens. Want %d, got %d", want, got)
+	}
+
+	if err := db.RenameUser(u.UserID, "bob@"); err != nil {
+		t.Fatalf("RenameUser failed: %v", err)
+	}
+	if u, err = db.UserByID(u.UserID); err != nil {
+		t.Fatalf("UserByID failed: %v", err)
+	}
+	if want, got := "bob@", u.Email; want != got {
+		t.Errorf("Unexpected email after rename. Want %q, got %q", want, got)
+	}
+}
+
 func TestRenameUser(t *testing.T) {
 	dir := t.TempDir()
 	db := database.New(dir, nil)
@@ -155,7 +220,7 @@ func TestRenameUser(t *testing.T) {
 		t.Errorf("Unexpected userID after rename. Want %d, got %d", want, got)
 	}
 
-	cu, err := db.ContactUpdates(users["bob@"], 0)
+	cu, err := db.ContactUpdates(users["bob@"], 0, database.UpdatesPage{})
 	if err != nil {
 		t.Errorf("ContactUpdates(%q) failed: %v", "bob@", err)
 	}
@@ -170,3 +235,69 @@ func TestRenameUser(t *testing.T) {
 	}
 
 }
+
+func TestRotateTokenKey(t *testing.T) {
+	dir := t.TempDir()
+	db := database.New(dir, nil)
+	database.CurrentTimeForTesting = 10000
+
+	sk := stingle.MakeSecretKeyForTest()
+	if err := addUser(db, "alice@", sk.PublicKey()); err != nil {
+		t.Fatalf("addUser failed: %v", err)
+	}
+	u, err := db.User("alice@")
+	if err != nil {
+		t.Fatalf("User failed: %v", err)
+	}
+	tk, err := db.DecryptTokenKey(u.TokenKey)
+	if err != nil {
+		t.Fatalf("DecryptTokenKey failed: %v", err)
+	}
+	tok := token.Mint(tk, token.Token{Scope: "session", Subject: u.UserID}, time.Hour)
+	tk.Wipe()
+
+	if n, err := db.RotateTokenKeys(time.Hour); err != nil {
+		t.Fatalf("RotateTokenKeys failed: %v", err)
+	} else if want, got := 1, n; want != got {
+		t.Errorf("Unexpected RotateTokenKeys result. Want %d, got %d", want, got)
+	}
+	if u, err = db.User("alice@"); err != nil {
+		t.Fatalf("User failed: %v", err)
+	}
+	keys, err := db.DecryptTokenKeys(u)
+	if err != nil {
+		t.Fatalf("DecryptTokenKeys failed: %v", err)
+	}
+	if want, got := 2, len(keys); want != got {
+		t.Fatalf("Unexpected number of keys. Want %d, got %d", want, got)
+	}
+	if _, err := token.Decrypt(keys[0], tok); err == nil {
+		t.Error("Old token decrypted with the new key")
+	}
+	if _, err := token.Decrypt(keys[1], tok); err != nil {
+		t.Errorf("Old token not valid with the old key: %v", err)
+	}
+	for _, k := range keys {
+		k.Wipe()
+	}
+
+	database.CurrentTimeForTesting = 10000 + time.Hour.Milliseconds()
+	if keys, err = db.DecryptTokenKeys(u); err != nil {
+		t.Fatalf("DecryptTokenKeys failed: %v", err)
+	}
+	if want, got := 1, len(keys); want != got {
+		t.Errorf("Unexpected number of keys after expiration. Want %d, got %d", want, got)
+	}
+	for _, k := range keys {
+		k.Wipe()
+	}
+	if err := db.RotateTokenKey(u.UserID, time.Hour); err != nil {
+		t.Fatalf("RotateTokenKey failed: %v", err)
+	}
+	if u, err = db.User("alice@"); err != nil {
+		t.Fatalf("User failed: %v", err)
+	}
+	if want, got := 1, len(u.OldTokenKeys); want != got {
+		t.Errorf("Expired keys not removed. Want %d old keys, got %d", want, got)
+	}
+}
@@ -0,0 +1,153 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+// Package fileperm controls the permissions of the blob files and directories.
+package fileperm
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+)
+
+// Perm is the mode and group of the files that are created. The mode never
+// allows access by others, i.e. the files are never world-readable.
+type Perm struct {
+	// Mode is the permission of the files. The directories get the same
+	// permission, plus the search bit where the read bit is set.
+	Mode fs.FileMode
+	// GID is the group of the files and directories, or -1 to leave the
+	// default group.
+	GID int
+}
+
+// Default is owner-only access, i.e. 0600 for files and 0700 for
+// directories.
+var Default = Perm{Mode: 0o600, GID: -1}
+
+// Parse parses mode, an octal number like 0640, and group, a group name or
+// ID. The defaults are used when they are empty.
+func Parse(mode, group string) (Perm, error) {
+	p := Default
+	if mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			return p, fmt.Errorf("invalid file mode %q", mode)
+		}
+		p.Mode = fs.FileMode(m)
+	}
+	if group != "" {
+		gid, err := strconv.Atoi(group)
+		if err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return p, err
+			}
+			if gid, err = strconv.Atoi(g.Gid); err != nil {
+				return p, err
+			}
+		}
+		if gid < 0 {
+			return p, fmt.Errorf("invalid group %q", group)
+		}
+		p.GID = gid
+	}
+	return p, p.Check()
+}
+
+// Check returns an error if p isn't an acceptable permission.
+func (p Perm) Check() error {
+	if p.Mode&^fs.ModePerm != 0 {
+		return fmt.Errorf("invalid file mode %#o", p.Mode)
+	}
+	if p.Mode&0o007 != 0 {
+		return fmt.Errorf("file mode %#o allows access by others", p.Mode)
+	}
+	if p.Mode&0o600 != 0o600 {
+		return fmt.Errorf("file mode %#o doesn't let the owner read and write", p.Mode)
+	}
+	return nil
+}
+
+// IsDefault returns whether p is the default permission.
+func (p Perm) IsDefault() bool {
+	return p == Default || p == Perm{}
+}
+
+// DirMode returns the permission of the directories.
+func (p Perm) DirMode() fs.FileMode {
+	return p.Mode | 0o700 | (p.Mode&0o040)>>2
+}
+
+// Apply sets the permission of name, regardless of the umask. Nothing is
+// changed when p is the default.
+func (p Perm) Apply(name string, isDir bool) error {
+	if p.IsDefault() {
+		return nil
+	}
+	mode := p.Mode
+	if isDir {
+		mode = p.DirMode()
+	}
+	if err := os.Chmod(name, mode); err != nil {
+		return err
+	}
+	if p.GID >= 0 {
+		return os.Chown(name, -1, p.GID)
+	}
+	return nil
+}
+
+// ApplyFile is like Apply for an open file.
+func (p Perm) ApplyFile(f *os.File) error {
+	if p.IsDefault() {
+		return nil
+	}
+	if err := f.Chmod(p.Mode); err != nil {
+		return err
+	}
+	if p.GID >= 0 {
+		return f.Chown(-1, p.GID)
+	}
+	return nil
+}
+
+// MkdirAll is like os.MkdirAll. The permission is applied to the directories
+// that it creates.
+func (p Perm) MkdirAll(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if parent := filepath.Dir(dir); parent != dir {
+		if err := p.MkdirAll(parent); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(dir, p.DirMode()); err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return nil
+		}
+		return err
+	}
+	return p.Apply(dir, true)
+}
@@ -0,0 +1,98 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !windows
+
+package fileperm_test
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"c2FmZQ/internal/fileperm"
+)
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		mode    string
+		want    fs.FileMode
+		wantDir fs.FileMode
+		ok      bool
+	}{
+		{"", 0o600, 0o700, true},
+		{"0600", 0o600, 0o700, true},
+		{"0640", 0o640, 0o750, true},
+		{"660", 0o660, 0o770, true},
+		{"0644", 0, 0, false},
+		{"0606", 0, 0, false},
+		{"0400", 0, 0, false},
+		{"01640", 0, 0, false},
+		{"rw-r-----", 0, 0, false},
+	} {
+		p, err := fileperm.Parse(tc.mode, "")
+		if (err == nil) != tc.ok {
+			t.Errorf("Parse(%q) returned err=%v, want ok=%v", tc.mode, err, tc.ok)
+			continue
+		}
+		if !tc.ok {
+			continue
+		}
+		if p.Mode != tc.want || p.DirMode() != tc.wantDir || p.GID != -1 {
+			t.Errorf("Parse(%q) = %#o %#o %d, want %#o %#o -1", tc.mode, p.Mode, p.DirMode(), p.GID, tc.want, tc.wantDir)
+		}
+	}
+	if p, err := fileperm.Parse("", "1234"); err != nil || p.GID != 1234 {
+		t.Errorf("Parse(\"\", 1234) = %v, %v", p, err)
+	}
+	if _, err := fileperm.Parse("", "-1"); err == nil {
+		t.Error("Parse(\"\", -1) succeeded unexpectedly")
+	}
+}
+
+func TestMkdirAll(t *testing.T) {
+	old := syscall.Umask(0o077)
+	defer syscall.Umask(old)
+
+	dir := t.TempDir()
+	p := fileperm.Perm{Mode: 0o640, GID: -1}
+	if err := p.MkdirAll(filepath.Join(dir, "a", "b")); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	for _, d := range []string{"a", "a/b"} {
+		fi, err := os.Stat(filepath.Join(dir, d))
+		if err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+		if want, got := fs.ModeDir|0o750, fi.Mode(); want != got {
+			t.Errorf("Mode(%s) = %s, want %s", d, got, want)
+		}
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "a", "b", "c"), os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	if err := p.ApplyFile(f); err != nil {
+		t.Fatalf("ApplyFile: %v", err)
+	}
+	f.Close()
+	if fi, err := os.Stat(f.Name()); err != nil || fi.Mode() != 0o640 {
+		t.Errorf("Stat(%s) = %v, %v, want mode 0640", f.Name(), fi.Mode(), err)
+	}
+}
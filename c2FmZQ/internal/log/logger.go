@@ -19,11 +19,15 @@ package log
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	logpkg "log"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
 	"time"
 )
@@ -38,10 +42,43 @@ var (
 	Level int = 0
 	mu    sync.Mutex
 	// If Record is not nil, it will be used to send log messages instead
-	// of Stderr.
+	// of the output writer.
 	Record func(...interface{})
+	// The writer where log messages are sent. Defaults to Stderr.
+	output io.Writer = os.Stderr
 )
 
+// Format is the format of the log messages.
+type Format int
+
+const (
+	// Text is the default human-readable format.
+	Text Format = iota
+	// JSON emits each message as a JSON object with level, time, caller,
+	// and message.
+	JSON
+)
+
+var format = Text
+
+// SetFormat sets the format of the log messages.
+func SetFormat(f Format) {
+	mu.Lock()
+	defer mu.Unlock()
+	format = f
+}
+
+// SetOutput sets the writer where log messages are sent. A nil writer
+// restores the default, i.e. Stderr.
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	if w == nil {
+		w = os.Stderr
+	}
+	output = w
+}
+
 var internalLogger = &Logger{skip: 1}
 
 func Stack() string {
@@ -55,7 +92,68 @@ func DefaultLogger() *Logger {
 }
 
 type Logger struct {
-	skip int
+	skip   int
+	fields []interface{}
+}
+
+// With returns a Logger that adds the key/value pairs in fields to every
+// message.
+func With(fields ...interface{}) *Logger {
+	return internalLogger.With(fields...)
+}
+
+// With returns a Logger that adds the key/value pairs in fields to every
+// message, in addition to the fields of l.
+func (l *Logger) With(fields ...interface{}) *Logger {
+	f := make([]interface{}, 0, len(l.fields)+len(fields))
+	f = append(f, l.fields...)
+	f = append(f, fields...)
+	return &Logger{fields: f}
+}
+
+type ctxKey struct{}
+
+// NewContext returns a copy of ctx that carries l.
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, l)
+}
+
+// FromContext returns the Logger carried by ctx, or the default Logger.
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(ctxKey{}).(*Logger); ok {
+		return l
+	}
+	return DefaultLogger()
+}
+
+// fieldMap returns the logger's fields as a map.
+func (l *Logger) fieldMap() map[string]interface{} {
+	if len(l.fields) == 0 {
+		return nil
+	}
+	m := make(map[string]interface{})
+	for i := 0; i < len(l.fields); i += 2 {
+		k := fmt.Sprint(l.fields[i])
+		if i+1 < len(l.fields) {
+			m[k] = l.fields[i+1]
+		} else {
+			m[k] = nil
+		}
+	}
+	return m
+}
+
+// fieldString returns the logger's fields formatted as key=value.
+func (l *Logger) fieldString() string {
+	var out []string
+	for i := 0; i < len(l.fields); i += 2 {
+		if i+1 < len(l.fields) {
+			out = append(out, fmt.Sprintf("%v=%v", l.fields[i], l.fields[i+1]))
+		} else {
+			out = append(out, fmt.Sprintf("%v=", l.fields[i]))
+		}
+	}
+	return strings.Join(out, " ")
 }
 
 func (l *Logger) log(d int, level, s string) {
@@ -63,14 +161,47 @@ func (l *Logger) log(d int, level, s string) {
 	if _, file, line, ok := runtime.Caller(d + l.skip); ok {
 		fl = fmt.Sprintf("%s:%d", filepath.Join(filepath.Base(filepath.Dir(file)), filepath.Base(file)), line)
 	}
-	t := time.Now().UTC().Format("0102 150405.000")
+	t := time.Now().UTC()
 	if Record != nil {
-		Record(fmt.Sprintf("%s%s %s] %s", level, t, fl, s))
+		Record(l.formatText(level, t, fl, s))
 		return
 	}
 	mu.Lock()
-	fmt.Fprintf(os.Stderr, "%s%s %s] %s\n", level, t, fl, s)
-	mu.Unlock()
+	defer mu.Unlock()
+	if format == JSON {
+		fmt.Fprintln(output, l.formatJSON(level, t, fl, s))
+		return
+	}
+	fmt.Fprintln(output, l.formatText(level, t, fl, s))
+}
+
+func (l *Logger) formatText(level string, t time.Time, fl, s string) string {
+	if len(l.fields) > 0 {
+		s = "[" + l.fieldString() + "] " + s
+	}
+	return fmt.Sprintf("%s%s %s] %s", level, t.Format("0102 150405.000"), fl, s)
+}
+
+func (l *Logger) formatJSON(level string, t time.Time, fl, s string) string {
+	levelNames := map[string]string{
+		"PANIC!": "panic",
+		"F":      "fatal",
+		"E":      "error",
+		"I":      "info",
+		"D":      "debug",
+		"L":      "info",
+	}
+	b, err := json.Marshal(struct {
+		Level   string                 `json:"level"`
+		Time    string                 `json:"time"`
+		Caller  string                 `json:"caller"`
+		Message string                 `json:"message"`
+		Fields  map[string]interface{} `json:"fields,omitempty"`
+	}{levelNames[level], t.Format(time.RFC3339Nano), fl, s, l.fieldMap()})
+	if err != nil {
+		return l.formatText(level, t, fl, s)
+	}
+	return string(b)
 }
 
 func Panic(args ...interface{}) {
@@ -0,0 +1,86 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package log
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestJSONFormat(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	SetFormat(JSON)
+	defer SetOutput(nil)
+	defer SetFormat(Text)
+	Level = InfoLevel
+
+	Infof("Hello %s", "world")
+	Debug("not logged")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Unexpected output: %q", buf.String())
+	}
+	var got map[string]string
+	if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+		t.Fatalf("json.Unmarshal(%q): %v", lines[0], err)
+	}
+	if want := "info"; got["level"] != want {
+		t.Errorf("Unexpected level. Want %q, got %q", want, got["level"])
+	}
+	if want := "Hello world"; got["message"] != want {
+		t.Errorf("Unexpected message. Want %q, got %q", want, got["message"])
+	}
+	if want := "log/logger_test.go:"; !strings.HasPrefix(got["caller"], want) {
+		t.Errorf("Unexpected caller. Want %q, got %q", want, got["caller"])
+	}
+	if got["time"] == "" {
+		t.Error("Missing time")
+	}
+}
+
+func TestWithFields(t *testing.T) {
+	var got []string
+	Record = func(args ...interface{}) {
+		got = append(got, fmt.Sprint(args...))
+	}
+	defer func() { Record = nil }()
+	Level = InfoLevel
+
+	ctx := NewContext(context.Background(), With("reqId", "abc").With("userId", 123))
+	FromContext(ctx).Info("Hello")
+	FromContext(context.Background()).Info("World")
+
+	if len(got) != 2 {
+		t.Fatalf("Unexpected messages: %q", got)
+	}
+	if want := "] [reqId=abc userId=123] Hello"; !strings.HasSuffix(got[0], want) {
+		t.Errorf("Unexpected message. Want suffix %q, got %q", want, got[0])
+	}
+	if want := "log/logger_test.go:"; !strings.Contains(got[0], want) {
+		t.Errorf("Unexpected caller. Want %q, got %q", want, got[0])
+	}
+	if want := "] World"; !strings.HasSuffix(got[1], want) {
+		t.Errorf("Unexpected message. Want suffix %q, got %q", want, got[1])
+	}
+}
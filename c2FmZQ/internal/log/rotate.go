@@ -0,0 +1,118 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package log
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// The number of rotated files to keep, i.e. file.1, file.2, etc.
+const keepRotatedFiles = 5
+
+// RotatingFile is an io.Writer that writes to a file, and rotates it when its
+// size would exceed maxSize. The rotated files are renamed name.1, name.2, etc,
+// with name.1 being the most recent.
+type RotatingFile struct {
+	name    string
+	maxSize int64
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// NewRotatingFile opens (or creates) the file name for appending.
+func NewRotatingFile(name string, maxSize int64) (*RotatingFile, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("invalid max size: %d", maxSize)
+	}
+	r := &RotatingFile{name: name, maxSize: maxSize}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = fi.Size()
+	return nil
+}
+
+// rotate renames the current file to name.1, after renaming the older files,
+// and opens a new file. The file is reopened even if renaming fails.
+func (r *RotatingFile) rotate() error {
+	err := r.f.Close()
+	r.f = nil
+	for i := keepRotatedFiles - 1; i > 0 && err == nil; i-- {
+		if err = os.Rename(fmt.Sprintf("%s.%d", r.name, i), fmt.Sprintf("%s.%d", r.name, i+1)); errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = os.Rename(r.name, r.name+".1")
+	}
+	if openErr := r.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+// Write implements io.Writer.
+func (r *RotatingFile) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+	if r.size > 0 && r.size+int64(len(b)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "log rotation failed: %v\n", err)
+			if r.f == nil {
+				return 0, err
+			}
+		}
+	}
+	n, err := r.f.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+// Close closes the file.
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
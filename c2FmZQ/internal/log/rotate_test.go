@@ -0,0 +1,58 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package log
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "log")
+	r, err := NewRotatingFile(name, 100)
+	if err != nil {
+		t.Fatalf("NewRotatingFile: %v", err)
+	}
+	line := []byte(fmt.Sprintf("%039d\n", 0))
+	for i := 0; i < 20; i++ {
+		if _, err := r.Write(line); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	for _, fn := range []string{name, name + ".1", name + ".5"} {
+		fi, err := os.Stat(fn)
+		if err != nil {
+			t.Fatalf("Stat(%q): %v", fn, err)
+		}
+		if want, got := int64(80), fi.Size(); want != got {
+			t.Errorf("Unexpected size of %q. Want %d, got %d", fn, want, got)
+		}
+		if want, got := os.FileMode(0600), fi.Mode().Perm(); want != got {
+			t.Errorf("Unexpected mode of %q. Want %v, got %v", fn, want, got)
+		}
+	}
+	if _, err := os.Stat(name + ".6"); err == nil {
+		t.Errorf("%s.6 exists unexpectedly", name)
+	}
+}
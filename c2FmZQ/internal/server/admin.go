@@ -41,23 +41,24 @@ import (
 //   - stingle.Response(ok)
 //     Parts("users", encrypted list of user data)
 func (s *Server) handleAdminUsers(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
 	if !user.Admin {
 		return stingle.ResponseNOK()
 	}
 	data, err := s.db.AdminData(nil)
 	if err != nil {
-		log.Errorf("AdminData: %v", err)
+		logger.Errorf("AdminData: %v", err)
 		return stingle.ResponseNOK()
 	}
 	params, err := s.decodeParams(req.PostFormValue("params"), user)
 	if err != nil {
-		log.Errorf("decodeParams: %v", err)
+		logger.Errorf("decodeParams: %v", err)
 		return stingle.ResponseNOK()
 	}
 	if v, ok := params["changes"]; ok {
 		var changes database.AdminData
 		if err := json.Unmarshal([]byte(v), &changes); err != nil {
-			log.Errorf("json.Unmarshal: %v", err)
+			logger.Errorf("json.Unmarshal: %v", err)
 			return stingle.ResponseNOK()
 		}
 		data, err = s.db.AdminData(&changes)
@@ -65,13 +66,13 @@ func (s *Server) handleAdminUsers(user database.User, req *http.Request) *stingl
 			return stingle.ResponseNOK().AddError("Data outdated")
 		}
 		if err != nil {
-			log.Errorf("AdminData: %v", err)
+			logger.Errorf("AdminData: %v", err)
 			return stingle.ResponseNOK()
 		}
 	}
 	b, err := json.Marshal(data)
 	if err != nil {
-		log.Errorf("json.Marshal: %v", err)
+		logger.Errorf("json.Marshal: %v", err)
 		return stingle.ResponseNOK()
 	}
 	return stingle.ResponseOK().
@@ -18,14 +18,28 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/time/rate"
 
 	"c2FmZQ/internal/database"
 	"c2FmZQ/internal/log"
 	"c2FmZQ/internal/stingle"
 )
 
+const (
+	// Users can send inviteBurst invitations at once, and then one every
+	// inviteInterval.
+	inviteBurst    = 10
+	inviteInterval = 6 * time.Minute
+)
+
 // handleAddAlbum handles the /v2/sync/addAlbum endpoint. It is used to add a
 // new album.
 //
@@ -45,9 +59,10 @@ import (
 // Returns:
 //   - stingle.Response(ok)
 func (s *Server) handleAddAlbum(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
 	params, err := s.decodeParams(req.PostFormValue("params"), user)
 	if err != nil {
-		log.Errorf("decodeParams: %v", err)
+		logger.Errorf("decodeParams: %v", err)
 		return stingle.ResponseNOK()
 	}
 	album := database.AlbumSpec{
@@ -59,7 +74,7 @@ func (s *Server) handleAddAlbum(user database.User, req *http.Request) *stingle.
 		PublicKey:     params["publicKey"],
 	}
 	if err := s.db.AddAlbum(user, album); err != nil {
-		log.Errorf("AddAlbum: %v", err)
+		logger.Errorf("AddAlbum: %v", err)
 		return stingle.ResponseNOK()
 	}
 	return stingle.ResponseOK()
@@ -79,15 +94,16 @@ func (s *Server) handleAddAlbum(user database.User, req *http.Request) *stingle.
 // Returns:
 //   - stingle.Response(ok)
 func (s *Server) handleDeleteAlbum(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
 	params, err := s.decodeParams(req.PostFormValue("params"), user)
 	if err != nil {
-		log.Errorf("decodeParams: %v", err)
+		logger.Errorf("decodeParams: %v", err)
 		return stingle.ResponseNOK()
 	}
 	albumID := params["albumId"]
 	albumSpec, err := s.db.Album(user, albumID)
 	if err != nil {
-		log.Errorf("db.Album(%q, %q) failed: %v", user.Email, albumID, err)
+		logger.Errorf("db.Album(%q, %q) failed: %v", user.Email, albumID, err)
 		return stingle.ResponseNOK()
 	}
 	if albumSpec.OwnerID != user.UserID {
@@ -95,7 +111,7 @@ func (s *Server) handleDeleteAlbum(user database.User, req *http.Request) *sting
 	}
 
 	if err := s.db.DeleteAlbum(user, albumID); err != nil {
-		log.Errorf("DeleteAlbum: %v", err)
+		logger.Errorf("DeleteAlbum: %v", err)
 		return stingle.ResponseNOK()
 	}
 	return stingle.ResponseOK()
@@ -116,9 +132,10 @@ func (s *Server) handleDeleteAlbum(user database.User, req *http.Request) *sting
 // Returns:
 //   - stingle.Response(ok)
 func (s *Server) handleChangeAlbumCover(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
 	params, err := s.decodeParams(req.PostFormValue("params"), user)
 	if err != nil {
-		log.Errorf("decodeParams: %v", err)
+		logger.Errorf("decodeParams: %v", err)
 		return stingle.ResponseNOK()
 	}
 	albumID := params["albumId"]
@@ -126,7 +143,7 @@ func (s *Server) handleChangeAlbumCover(user database.User, req *http.Request) *
 
 	albumSpec, err := s.db.Album(user, albumID)
 	if err != nil {
-		log.Errorf("db.Album(%q, %q) failed: %v", user.Email, albumID, err)
+		logger.Errorf("db.Album(%q, %q) failed: %v", user.Email, albumID, err)
 		return stingle.ResponseNOK()
 	}
 	if albumSpec.OwnerID != user.UserID {
@@ -134,7 +151,7 @@ func (s *Server) handleChangeAlbumCover(user database.User, req *http.Request) *
 	}
 
 	if err := s.db.ChangeAlbumCover(user, albumID, cover); err != nil {
-		log.Errorf("ChangeAlbumCover: %v", err)
+		logger.Errorf("ChangeAlbumCover: %v", err)
 		return stingle.ResponseNOK()
 	}
 	return stingle.ResponseOK()
@@ -155,9 +172,10 @@ func (s *Server) handleChangeAlbumCover(user database.User, req *http.Request) *
 // Returns:
 //   - stingle.Response(ok)
 func (s *Server) handleRenameAlbum(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
 	params, err := s.decodeParams(req.PostFormValue("params"), user)
 	if err != nil {
-		log.Errorf("decodeParams: %v", err)
+		logger.Errorf("decodeParams: %v", err)
 		return stingle.ResponseNOK()
 	}
 	albumID := params["albumId"]
@@ -165,7 +183,7 @@ func (s *Server) handleRenameAlbum(user database.User, req *http.Request) *sting
 
 	albumSpec, err := s.db.Album(user, albumID)
 	if err != nil {
-		log.Errorf("db.Album(%q, %q) failed: %v", user.Email, albumID, err)
+		logger.Errorf("db.Album(%q, %q) failed: %v", user.Email, albumID, err)
 		return stingle.ResponseNOK()
 	}
 	if albumSpec.OwnerID != user.UserID {
@@ -173,7 +191,7 @@ func (s *Server) handleRenameAlbum(user database.User, req *http.Request) *sting
 	}
 
 	if err := s.db.ChangeMetadata(user, albumID, metadata); err != nil {
-		log.Errorf("ChangeMetadata: %v", err)
+		logger.Errorf("ChangeMetadata: %v", err)
 		return stingle.ResponseNOK()
 	}
 	return stingle.ResponseOK()
@@ -193,24 +211,53 @@ func (s *Server) handleRenameAlbum(user database.User, req *http.Request) *sting
 // Returns:
 //   - stingle.Response(ok).
 //     Part(contact, contact object)
+//   - stingle.Response(nok).
+//     Part(notFound, "1") when the contact doesn't have an account.
 func (s *Server) handleGetContact(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
 	if user.NeedApproval {
 		return stingle.ResponseNOK().
 			AddError("Account is not approved yet")
 	}
 	params, err := s.decodeParams(req.PostFormValue("params"), user)
 	if err != nil {
-		log.Errorf("decodeParams: %v", err)
+		logger.Errorf("decodeParams: %v", err)
 		return stingle.ResponseNOK()
 	}
 	contact, err := s.db.AddContact(user, params["email"])
+	if errors.Is(err, os.ErrNotExist) {
+		return stingle.ResponseNOK().AddPart("notFound", "1")
+	}
 	if err != nil {
-		log.Errorf("AddContact: %v", err)
+		logger.Errorf("AddContact: %v", err)
 		return stingle.ResponseNOK()
 	}
 	return stingle.ResponseOK().AddPart("contact", contact)
 }
 
+// sendShareInvites notifies the new members of an album that it was shared
+// with them. The notifications are sent in the background, and errors are
+// only logged.
+func (s *Server) sendShareInvites(logger *log.Logger, user database.User, members []int64) {
+	if len(members) == 0 {
+		return
+	}
+	n := s.notifier()
+	go func() {
+		ctx := log.NewContext(context.Background(), logger)
+		for _, id := range members {
+			m, err := s.db.UserByID(id)
+			if err != nil {
+				logger.Errorf("UserByID(%d): %v", id, err)
+				continue
+			}
+			if err := n.SendShareInvite(ctx, m.Email, user.Email); err != nil {
+				logger.Errorf("SendShareInvite(%q): %v", m.Email, err)
+			}
+		}
+	}()
+}
+
 func (s *Server) parseAlbumJSON(b []byte) (*stingle.Album, error) {
 	var album stingle.Album
 	if err := json.Unmarshal(b, &album); err != nil {
@@ -235,13 +282,14 @@ func (s *Server) parseAlbumJSON(b []byte) (*stingle.Album, error) {
 // Returns:
 //   - stingle.Response(ok).
 func (s *Server) handleShare(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
 	if user.NeedApproval {
 		return stingle.ResponseNOK().
 			AddError("Account is not approved yet")
 	}
 	params, err := s.decodeParams(req.PostFormValue("params"), user)
 	if err != nil {
-		log.Errorf("decodeParams: %v", err)
+		logger.Errorf("decodeParams: %v", err)
 		return stingle.ResponseNOK()
 	}
 
@@ -252,20 +300,30 @@ func (s *Server) handleShare(user database.User, req *http.Request) *stingle.Res
 
 	var sharingKeys map[string]string
 	if err := json.Unmarshal([]byte(params["sharingKeys"]), &sharingKeys); err != nil {
-		log.Errorf("json.Unmarshal sharingKeys failed: %v", err)
+		logger.Errorf("json.Unmarshal sharingKeys failed: %v", err)
 		return stingle.ResponseNOK()
 	}
 
 	albumSpec, err := s.db.Album(user, album.AlbumID)
 	if err != nil {
-		log.Errorf("db.Album(%q, %q) failed: %v", user.Email, album.AlbumID, err)
+		logger.Errorf("db.Album(%q, %q) failed: %v", user.Email, album.AlbumID, err)
 		return stingle.ResponseNOK()
 	}
 	if albumSpec.OwnerID == user.UserID || (albumSpec.Members[user.UserID] && albumSpec.Permissions.AllowShare()) {
+		var newMembers []int64
+		for k := range sharingKeys {
+			if id, err := strconv.ParseInt(k, 10, 64); err == nil && id != albumSpec.OwnerID && !albumSpec.Members[id] {
+				newMembers = append(newMembers, id)
+			}
+		}
 		if err := s.db.ShareAlbum(user, album, sharingKeys); err != nil {
-			log.Errorf("ShareAlbum: %v", err)
+			logger.Errorf("ShareAlbum: %v", err)
 			return stingle.ResponseNOK()
 		}
+		if err := s.db.CompletePendingShares(album.AlbumID, newMembers); err != nil {
+			logger.Errorf("CompletePendingShares: %v", err)
+		}
+		s.sendShareInvites(logger, user, newMembers)
 		return stingle.ResponseOK()
 	}
 	return stingle.ResponseNOK().AddError("You are not allow to share the album")
@@ -286,9 +344,10 @@ func (s *Server) handleShare(user database.User, req *http.Request) *stingle.Res
 // Returns:
 //   - stingle.Response(ok)
 func (s *Server) handleEditPerms(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
 	params, err := s.decodeParams(req.PostFormValue("params"), user)
 	if err != nil {
-		log.Errorf("decodeParams: %v", err)
+		logger.Errorf("decodeParams: %v", err)
 		return stingle.ResponseNOK()
 	}
 
@@ -299,7 +358,7 @@ func (s *Server) handleEditPerms(user database.User, req *http.Request) *stingle
 
 	albumSpec, err := s.db.Album(user, album.AlbumID)
 	if err != nil {
-		log.Errorf("db.Album(%q, %q) failed: %v", user.Email, album.AlbumID, err)
+		logger.Errorf("db.Album(%q, %q) failed: %v", user.Email, album.AlbumID, err)
 		return stingle.ResponseNOK()
 	}
 	if albumSpec.OwnerID != user.UserID {
@@ -307,7 +366,7 @@ func (s *Server) handleEditPerms(user database.User, req *http.Request) *stingle
 	}
 
 	if err := s.db.UpdatePerms(user, album.AlbumID, stingle.Permissions(album.Permissions), album.IsHidden == "1", album.IsLocked == "1"); err != nil {
-		log.Errorf("UpdatePerms(%q, %q): %v", album.AlbumID, album.Permissions, err)
+		logger.Errorf("UpdatePerms(%q, %q): %v", album.AlbumID, album.Permissions, err)
 		return stingle.ResponseNOK()
 	}
 	return stingle.ResponseOK()
@@ -328,9 +387,10 @@ func (s *Server) handleEditPerms(user database.User, req *http.Request) *stingle
 // Returns:
 //   - stingle.Response(ok)
 func (s *Server) handleRemoveAlbumMember(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
 	params, err := s.decodeParams(req.PostFormValue("params"), user)
 	if err != nil {
-		log.Errorf("decodeParams: %v", err)
+		logger.Errorf("decodeParams: %v", err)
 		return stingle.ResponseNOK()
 	}
 
@@ -342,7 +402,7 @@ func (s *Server) handleRemoveAlbumMember(user database.User, req *http.Request)
 
 	albumSpec, err := s.db.Album(user, album.AlbumID)
 	if err != nil {
-		log.Errorf("db.Album(%q, %q) failed: %v", user.Email, album.AlbumID, err)
+		logger.Errorf("db.Album(%q, %q) failed: %v", user.Email, album.AlbumID, err)
 		return stingle.ResponseNOK()
 	}
 	if albumSpec.OwnerID != user.UserID {
@@ -350,7 +410,7 @@ func (s *Server) handleRemoveAlbumMember(user database.User, req *http.Request)
 	}
 
 	if err := s.db.RemoveAlbumMember(user, album.AlbumID, memberID); err != nil {
-		log.Errorf("RemoveAlbumMember(%q, %q): %v", album.AlbumID, memberID, err)
+		logger.Errorf("RemoveAlbumMember(%q, %q): %v", album.AlbumID, memberID, err)
 		return stingle.ResponseNOK()
 	}
 	return stingle.ResponseOK()
@@ -370,9 +430,10 @@ func (s *Server) handleRemoveAlbumMember(user database.User, req *http.Request)
 // Returns:
 //   - stingle.Response(ok)
 func (s *Server) handleUnshareAlbum(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
 	params, err := s.decodeParams(req.PostFormValue("params"), user)
 	if err != nil {
-		log.Errorf("decodeParams: %v", err)
+		logger.Errorf("decodeParams: %v", err)
 		return stingle.ResponseNOK()
 	}
 
@@ -380,7 +441,7 @@ func (s *Server) handleUnshareAlbum(user database.User, req *http.Request) *stin
 
 	albumSpec, err := s.db.Album(user, albumID)
 	if err != nil {
-		log.Errorf("db.Album(%q, %q) failed: %v", user.Email, albumID, err)
+		logger.Errorf("db.Album(%q, %q) failed: %v", user.Email, albumID, err)
 		return stingle.ResponseNOK()
 	}
 	if albumSpec.OwnerID != user.UserID {
@@ -388,7 +449,73 @@ func (s *Server) handleUnshareAlbum(user database.User, req *http.Request) *stin
 	}
 
 	if err := s.db.UnshareAlbum(user, albumID); err != nil {
-		log.Errorf("UnshareAlbum(%q): %v", albumID, err)
+		logger.Errorf("UnshareAlbum(%q): %v", albumID, err)
+		return stingle.ResponseNOK()
+	}
+	return stingle.ResponseOK()
+}
+
+// handleRotateAlbumKey handles the /v2x/sync/rotateAlbumKey endpoint. It is
+// used by the owner to replace the album's keypair, e.g. after removing
+// members. The client generates the new keypair and re-encrypts everything
+// that depends on it.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Form arguments
+//   - params: The encrypted parameters
+//   - album: A JSON-encoded album object with the new publicKey,
+//     encPrivateKey, and metadata.
+//   - sharingKeys: A JSON-encoded map of member ID to the new album secret
+//     key encrypted for that member.
+//   - headers: A JSON-encoded map of file name to re-encrypted headers, for
+//     all the files in the album.
+//
+// Returns:
+//   - stingle.Response(ok)
+func (s *Server) handleRotateAlbumKey(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
+	params, err := s.decodeParams(req.PostFormValue("params"), user)
+	if err != nil {
+		logger.Errorf("decodeParams: %v", err)
+		return stingle.ResponseNOK()
+	}
+
+	album, err := s.parseAlbumJSON([]byte(params["album"]))
+	if err != nil {
+		return stingle.ResponseNOK()
+	}
+	var sharingKeys map[string]string
+	if err := json.Unmarshal([]byte(params["sharingKeys"]), &sharingKeys); err != nil {
+		logger.Errorf("json.Unmarshal sharingKeys failed: %v", err)
+		return stingle.ResponseNOK()
+	}
+	var headers map[string]string
+	if err := json.Unmarshal([]byte(params["headers"]), &headers); err != nil {
+		logger.Errorf("json.Unmarshal headers failed: %v", err)
+		return stingle.ResponseNOK()
+	}
+	if album.PublicKey == "" || album.EncPrivateKey == "" || album.Metadata == "" {
+		return stingle.ResponseNOK()
+	}
+
+	albumSpec, err := s.db.Album(user, album.AlbumID)
+	if err != nil {
+		logger.Errorf("db.Album(%q, %q) failed: %v", user.Email, album.AlbumID, err)
+		return stingle.ResponseNOK()
+	}
+	if albumSpec.OwnerID != user.UserID {
+		return stingle.ResponseNOK().AddError("You are not the owner of the album")
+	}
+
+	err = s.db.RotateAlbumKey(user, album, sharingKeys, headers)
+	if err == database.ErrOutdated {
+		return stingle.ResponseNOK().AddError("Album changed, please sync and try again")
+	}
+	if err != nil {
+		logger.Errorf("RotateAlbumKey(%q): %v", album.AlbumID, err)
 		return stingle.ResponseNOK()
 	}
 	return stingle.ResponseOK()
@@ -408,16 +535,17 @@ func (s *Server) handleUnshareAlbum(user database.User, req *http.Request) *stin
 // Returns:
 //   - stingle.Response(ok)
 func (s *Server) handleLeaveAlbum(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
 	params, err := s.decodeParams(req.PostFormValue("params"), user)
 	if err != nil {
-		log.Errorf("decodeParams: %v", err)
+		logger.Errorf("decodeParams: %v", err)
 		return stingle.ResponseNOK()
 	}
 	albumID := params["albumId"]
 
 	albumSpec, err := s.db.Album(user, albumID)
 	if err != nil {
-		log.Errorf("db.Album(%q, %q) failed: %v", user.Email, albumID, err)
+		logger.Errorf("db.Album(%q, %q) failed: %v", user.Email, albumID, err)
 		return stingle.ResponseNOK()
 	}
 	if albumSpec.OwnerID == user.UserID {
@@ -428,8 +556,125 @@ func (s *Server) handleLeaveAlbum(user database.User, req *http.Request) *stingl
 	}
 
 	if err := s.db.RemoveAlbumMember(user, albumID, user.UserID); err != nil {
-		log.Errorf("RemoveAlbumMember(%q, %q): %v", albumID, user.UserID, err)
+		logger.Errorf("RemoveAlbumMember(%q, %q): %v", albumID, user.UserID, err)
+		return stingle.ResponseNOK()
+	}
+	return stingle.ResponseOK()
+}
+
+// handleListAlbums handles the /v2/albums/list endpoint. It returns a summary
+// of all the albums that the user owns or is a member of, without any of the
+// file records.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Returns:
+//   - stingle.Response(ok)
+//     Part(albums, list of album summaries)
+func (s *Server) handleListAlbums(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
+	albums, err := s.db.AlbumSummaries(user)
+	if err != nil {
+		logger.Errorf("AlbumSummaries: %v", err)
+		return stingle.ResponseNOK()
+	}
+	return stingle.ResponseOK().AddPart("albums", albums)
+}
+
+// handleInvite handles the /v2x/sync/invite endpoint. It is used to share an
+// album with someone who doesn't have an account yet. The share is completed
+// by the sharer's client after the recipient registers. This is a c2FmZQ
+// extension.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Form arguments
+//   - params: The encrypted parameters
+//   - albumId: The ID of the album.
+//   - email: The email address of the recipient.
+//   - permissions: The album permissions to use when the share is completed.
+//
+// Returns:
+//   - stingle.Response(ok)
+func (s *Server) handleInvite(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
+	if user.NeedApproval {
+		return stingle.ResponseNOK().
+			AddError("Account is not approved yet")
+	}
+	params, err := s.decodeParams(req.PostFormValue("params"), user)
+	if err != nil {
+		logger.Errorf("decodeParams: %v", err)
+		return stingle.ResponseNOK()
+	}
+	albumID := params["albumId"]
+	email := params["email"]
+	if !validateEmail(email) {
+		return stingle.ResponseNOK().AddError("Invalid email address")
+	}
+	albumSpec, err := s.db.Album(user, albumID)
+	if err != nil {
+		logger.Errorf("db.Album(%q, %q) failed: %v", user.Email, albumID, err)
 		return stingle.ResponseNOK()
 	}
+	if albumSpec.OwnerID != user.UserID && !(albumSpec.Members[user.UserID] && albumSpec.Permissions.AllowShare()) {
+		return stingle.ResponseNOK().AddError("You are not allow to share the album")
+	}
+	if !s.inviteLimiter(user.UserID).Allow() {
+		return stingle.ResponseNOK().AddError("Too many invitations, try again later")
+	}
+	if err := s.db.AddPendingShare(user, albumID, email, params["permissions"]); errors.Is(err, os.ErrExist) {
+		return stingle.ResponseNOK().AddError("This user already has an account")
+	} else if err != nil {
+		logger.Errorf("AddPendingShare: %v", err)
+		return stingle.ResponseNOK()
+	}
+	n := s.notifier()
+	go func() {
+		if err := n.SendShareInvite(log.NewContext(context.Background(), logger), email, user.Email); err != nil {
+			logger.Errorf("SendShareInvite(%q): %v", email, err)
+		}
+	}()
 	return stingle.ResponseOK()
 }
+
+// inviteLimiter returns the rate limiter for the invitations sent by a user.
+// Each invitation sends an email to an address that the user chooses.
+func (s *Server) inviteLimiter(userID int64) *rate.Limiter {
+	s.inviteLimitersMutex.Lock()
+	defer s.inviteLimitersMutex.Unlock()
+	if v, ok := s.inviteLimiters.Get(userID); ok {
+		return v.(*rate.Limiter)
+	}
+	rl := rate.NewLimiter(rate.Every(inviteInterval), inviteBurst)
+	s.inviteLimiters.Add(userID, rl)
+	return rl
+}
+
+// handlePendingShares handles the /v2x/sync/pendingShares endpoint. It
+// returns the user's pending shares. The ones with a recipientId can be
+// completed with /v2/sync/share. This is a c2FmZQ extension.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Returns:
+//   - stingle.Response(ok)
+//     Part(shares, list of pending shares)
+func (s *Server) handlePendingShares(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
+	shares, err := s.db.PendingSharesFrom(user)
+	if err != nil {
+		logger.Errorf("PendingSharesFrom: %v", err)
+		return stingle.ResponseNOK()
+	}
+	if shares == nil {
+		shares = []database.PendingShare{}
+	}
+	return stingle.ResponseOK().AddPart("shares", shares)
+}
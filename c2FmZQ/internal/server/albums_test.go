@@ -26,6 +26,8 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/go-test/deep"
+
 	"c2FmZQ/internal/database"
 	"c2FmZQ/internal/stingle"
 )
@@ -405,6 +407,158 @@ func TestUnshareAlbumEdits(t *testing.T) {
 	}
 }
 
+func TestListAlbums(t *testing.T) {
+	sock, shutdown := startServer(t)
+	defer shutdown()
+
+	database.CurrentTimeForTesting = 1000
+
+	alice, bob, carol, err := createAccountsAndLogin(sock)
+	if err != nil {
+		t.Fatalf("createAccountsAndLogin failed: %v", err)
+	}
+	for _, a := range []string{"album1", "album2"} {
+		if err := alice.addAlbum(a, 1000); err != nil {
+			t.Fatalf("alice.addAlbum(%q) failed: %v", a, err)
+		}
+	}
+	for _, f := range []string{"file1", "file2", "file3"} {
+		if _, err := alice.uploadFile(f, stingle.AlbumSet, "album1", 1000); err != nil {
+			t.Fatalf("alice.uploadFile(%q) failed: %v", f, err)
+		}
+	}
+
+	database.CurrentTimeForTesting = 2000
+
+	if err := alice.moveFiles(database.MoveFileParams{
+		SetFrom:     stingle.AlbumSet,
+		SetTo:       stingle.AlbumSet,
+		AlbumIDFrom: "album1",
+		AlbumIDTo:   "album2",
+		IsMoving:    true,
+		Filenames:   []string{"file3"},
+	}); err != nil {
+		t.Fatalf("alice.moveFiles failed: %v", err)
+	}
+	if err := alice.shareAlbum(stingle.Album{
+		AlbumID:     "album1",
+		Permissions: "1111",
+		Members:     membersString(alice.userID, bob.userID),
+		SharingKeys: map[string]string{
+			fmt.Sprintf("%d", bob.userID): "Bob's Sharing Key",
+		},
+	}); err != nil {
+		t.Fatalf("alice.shareAlbum failed: %v", err)
+	}
+
+	got, err := alice.listAlbums()
+	if err != nil {
+		t.Fatalf("alice.listAlbums failed: %v", err)
+	}
+	want := []database.AlbumSummary{
+		{
+			AlbumID:       "album1",
+			DateCreated:   "1000",
+			DateModified:  "2000",
+			EncPrivateKey: "album1 encPrivateKey",
+			Metadata:      "album1 metadata",
+			PublicKey:     "album1 publicKey",
+			IsOwner:       "1",
+			IsShared:      "1",
+			IsHidden:      "0",
+			IsLocked:      "0",
+			FileCount:     "2",
+			TotalSize:     "138",
+		},
+		{
+			AlbumID:       "album2",
+			DateCreated:   "1000",
+			DateModified:  "1000",
+			EncPrivateKey: "album2 encPrivateKey",
+			Metadata:      "album2 metadata",
+			PublicKey:     "album2 publicKey",
+			IsOwner:       "1",
+			IsShared:      "0",
+			IsHidden:      "0",
+			IsLocked:      "0",
+			FileCount:     "1",
+			TotalSize:     "69",
+		},
+	}
+	if diff := deep.Equal(want, got); diff != nil {
+		t.Errorf("alice.listAlbums() = %#v, want %#v", got, want)
+	}
+
+	if got, err = bob.listAlbums(); err != nil {
+		t.Fatalf("bob.listAlbums failed: %v", err)
+	}
+	want = want[:1]
+	want[0].EncPrivateKey = "Bob's Sharing Key"
+	want[0].IsOwner = "0"
+	if diff := deep.Equal(want, got); diff != nil {
+		t.Errorf("bob.listAlbums() = %#v, want %#v", got, want)
+	}
+
+	if got, err = carol.listAlbums(); err != nil {
+		t.Fatalf("carol.listAlbums failed: %v", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("carol.listAlbums() = %#v, want empty", got)
+	}
+
+	carol.token = "invalid"
+	if _, err := carol.listAlbums(); err == nil {
+		t.Error("carol.listAlbums with invalid token succeeded unexpectedly")
+	}
+}
+
+func TestInviteToAlbum(t *testing.T) {
+	sock, shutdown := startServer(t)
+	defer shutdown()
+
+	c, err := createAccountAndLogin(sock, "alice")
+	if err != nil {
+		t.Fatalf("createAccountAndLogin failed: %v", err)
+	}
+	if err := c.addAlbum("album", 1000); err != nil {
+		t.Fatalf("c.addAlbum failed: %v", err)
+	}
+
+	for _, email := range []string{"", "bob\n@"} {
+		if err := c.invite("album", email); err == nil {
+			t.Errorf("c.invite(%q) succeeded unexpectedly", email)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if err := c.invite("album", fmt.Sprintf("bob%d@", i)); err != nil {
+			t.Fatalf("c.invite failed: %v", err)
+		}
+	}
+	if err := c.invite("album", "carol@"); err == nil {
+		t.Error("c.invite succeeded unexpectedly after too many invitations")
+	}
+}
+
+func (c *client) invite(albumID, email string) error {
+	params := make(map[string]string)
+	params["albumId"] = albumID
+	params["email"] = email
+	params["permissions"] = "1000"
+
+	form := url.Values{}
+	form.Set("token", c.token)
+	form.Set("params", c.encodeParams(params))
+
+	sr, err := c.sendRequest("/v2x/sync/invite", form)
+	if err != nil {
+		return err
+	}
+	if sr.Status != "ok" {
+		return sr
+	}
+	return nil
+}
+
 func (c *client) addAlbum(albumID string, ts int64) error {
 	params := make(map[string]string)
 	params["albumId"] = albumID
@@ -591,3 +745,25 @@ func (c *client) unshareAlbum(albumID string) error {
 	}
 	return nil
 }
+
+func (c *client) listAlbums() ([]database.AlbumSummary, error) {
+	form := url.Values{}
+	form.Set("token", c.token)
+
+	sr, err := c.sendRequest("/v2/albums/list", form)
+	if err != nil {
+		return nil, err
+	}
+	if sr.Status != "ok" {
+		return nil, sr
+	}
+	b, err := json.Marshal(sr.Part("albums"))
+	if err != nil {
+		return nil, err
+	}
+	var albums []database.AlbumSummary
+	if err := json.Unmarshal(b, &albums); err != nil {
+		return nil, err
+	}
+	return albums, nil
+}
@@ -19,9 +19,11 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"path"
 	"regexp"
 	"strings"
@@ -35,6 +37,8 @@ import (
 	"c2FmZQ/internal/stingle/token"
 )
 
+var errAddNotPermitted = errors.New("adding to this album is not permitted")
+
 // handleUpload handles the /v2/sync/upload endpoint. It is used to upload
 // new files. The incoming request is a multipart/form-data with two files:
 // one for the image or video, and one for the thumbnail.
@@ -44,7 +48,9 @@ import (
 //
 // Form arguments
 //   - token: The signed session token.
-//   - headers: File metadata (encrypted key, etc)
+//   - headers: File metadata (encrypted key, etc). The structure of the
+//     encrypted headers is checked, and the upload is rejected if they are
+//     malformed.
 //   - set: The file set where this file is being uploaded.
 //   - albumId: The ID of the album where the file is being uploaded.
 //   - dateCreated: A timestamp in milliseconds.
@@ -53,42 +59,56 @@ import (
 //
 // Returns:
 //   - stingle.Response("ok")
+//   - HTTP 400 if the headers are malformed.
 func (s *Server) handleUpload(w http.ResponseWriter, req *http.Request) {
+	logger := log.FromContext(req.Context())
 	up, err := s.receiveUpload("uploads", req)
 	s.setDeadline(req.Context(), time.Now().Add(30*time.Second))
 	if err != nil {
-		log.Errorf("handleUpload: receiveUpload failed: %v", err)
+		logger.Errorf("handleUpload: receiveUpload failed: %v", err)
 		http.Error(w, "Internal Error", http.StatusInternalServerError)
 		return
 	}
 	_, user, err := s.checkToken(up.token, "session")
 	if err != nil || !user.ValidTokens[token.Hash(up.token)] {
-		log.Errorf("handleUpload: checkToken failed: %v", err)
+		logger.Errorf("handleUpload: checkToken failed: %v", err)
+		up.removeFiles()
 		http.Error(w, "Internal Error", http.StatusInternalServerError)
 		return
 	}
-	log.Infof("%s %s %s (UserID:%d)", req.Proto, req.Method, req.URL, user.UserID)
+	logger = logger.With("userId", user.UserID)
+	if err := s.checkSignature(user, up.token, req); err != nil {
+		logger.Errorf("handleUpload: checkSignature failed: %v", err)
+		up.removeFiles()
+		http.Error(w, "Invalid request signature", http.StatusForbidden)
+		return
+	}
+	logger.Infof("%s %s %s (UserID:%d)", req.Proto, req.Method, req.URL, user.UserID)
 	if user.NeedApproval {
+		up.removeFiles()
 		http.Error(w, "Account is not approved yet", http.StatusForbidden)
 		return
 	}
 
+	if up.FileSpec.Headers, err = stingle.NormalizeBase64Headers(up.FileSpec.Headers); err != nil {
+		logger.Errorf("handleUpload: %v", err)
+		up.removeFiles()
+		http.Error(w, "Invalid file headers", http.StatusBadRequest)
+		return
+	}
+
 	if up.set == stingle.AlbumSet {
-		albumSpec, err := s.db.Album(user, up.albumID)
-		if err != nil {
-			log.Errorf("db.Album(%q, %q) failed: %v", user.Email, up.albumID, err)
-			http.Error(w, "Internal Error", http.StatusInternalServerError)
-			return
-		}
-		if albumSpec.OwnerID != user.UserID && !albumSpec.Permissions.AllowAdd() {
-			log.Error("handleUpload: permission denied on album")
+		if err := s.checkAddToAlbum(user, up.albumID); err != nil {
+			logger.Errorf("handleUpload: checkAddToAlbum(%q): %v", up.albumID, err)
+			up.removeFiles()
 			http.Error(w, "Adding to this album is not permitted", http.StatusForbidden)
 			return
 		}
 	}
 
 	if err := s.db.AddFile(user, up.FileSpec, up.name, up.set, up.albumID); err != nil {
-		log.Errorf("AddFile: %v", err)
+		logger.Errorf("AddFile: %v", err)
+		up.removeFiles()
 		if err == database.ErrQuotaExceeded {
 			http.Error(w, "Quota exceeded", http.StatusForbidden)
 			return
@@ -99,6 +119,120 @@ func (s *Server) handleUpload(w http.ResponseWriter, req *http.Request) {
 	stingle.ResponseOK().Send(w)
 }
 
+// handleUploadBatch handles the /v2/sync/uploadBatch endpoint. It is used to
+// upload multiple new files in a single request. The incoming request is a
+// multipart/form-data with the same fields as /v2/sync/upload, except that the
+// form names of each file's fields are suffixed with the index of the file,
+// e.g. file0, thumb0, headers0, file1, thumb1, headers1, etc. Each file is
+// added independently of the others.
+//
+// Arguments:
+//   - req: The http request.
+//
+// Form arguments
+//   - token: The signed session token.
+//   - file<int>: The image or video.
+//   - thumb<int>: The thumbnail.
+//   - headers<int>: File metadata (encrypted key, etc)
+//   - set<int>: The file set where this file is being uploaded.
+//   - albumId<int>: The ID of the album where the file is being uploaded.
+//   - dateCreated<int>: A timestamp in milliseconds.
+//   - dateModified<int>: A timestamp in milliseconds.
+//   - version<int>: The file format version (opaque to the server).
+//
+// Returns:
+//   - stingle.Response("ok")
+//     Part(results, list of "ok" or error message, in the same order as the
+//     files)
+func (s *Server) handleUploadBatch(w http.ResponseWriter, req *http.Request) {
+	logger := log.FromContext(req.Context())
+	common, uploads, err := s.receiveBatchUpload("uploads", req)
+	s.setDeadline(req.Context(), time.Now().Add(30*time.Second))
+	if err != nil {
+		logger.Errorf("handleUploadBatch: receiveBatchUpload failed: %v", err)
+		http.Error(w, "Internal Error", http.StatusInternalServerError)
+		return
+	}
+	_, user, err := s.checkToken(common.token, "session")
+	if err != nil || !user.ValidTokens[token.Hash(common.token)] {
+		logger.Errorf("handleUploadBatch: checkToken failed: %v", err)
+		for _, up := range uploads {
+			up.removeFiles()
+		}
+		http.Error(w, "Internal Error", http.StatusInternalServerError)
+		return
+	}
+	logger = logger.With("userId", user.UserID)
+	if err := s.checkSignature(user, common.token, req); err != nil {
+		logger.Errorf("handleUploadBatch: checkSignature failed: %v", err)
+		for _, up := range uploads {
+			up.removeFiles()
+		}
+		http.Error(w, "Invalid request signature", http.StatusForbidden)
+		return
+	}
+	logger.Infof("%s %s %s (UserID:%d) %d files", req.Proto, req.Method, req.URL, user.UserID, len(uploads))
+	if user.NeedApproval {
+		for _, up := range uploads {
+			up.removeFiles()
+		}
+		http.Error(w, "Account is not approved yet", http.StatusForbidden)
+		return
+	}
+
+	results := make([]interface{}, len(uploads))
+	for i, up := range uploads {
+		results[i] = "ok"
+		if err := s.addUploadedFile(user, up); err != nil {
+			logger.Errorf("handleUploadBatch: file %d: %v", i, err)
+			up.removeFiles()
+			results[i] = err.Error()
+		}
+	}
+	stingle.ResponseOK().AddPartList("results", results...).Send(w)
+}
+
+// addUploadedFile adds one file received with /v2/sync/uploadBatch.
+func (s *Server) addUploadedFile(user database.User, up *upload) error {
+	if up.FileSpec.StoreFile == "" || up.FileSpec.StoreThumb == "" {
+		return errors.New("missing file or thumbnail")
+	}
+	hdrs, err := stingle.NormalizeBase64Headers(up.FileSpec.Headers)
+	if err != nil {
+		return err
+	}
+	up.FileSpec.Headers = hdrs
+	if up.set == stingle.AlbumSet {
+		if err := s.checkAddToAlbum(user, up.albumID); err != nil {
+			return err
+		}
+	}
+	if err := s.db.AddFile(user, up.FileSpec, up.name, up.set, up.albumID); err != nil {
+		if err == database.ErrQuotaExceeded {
+			return errors.New("quota exceeded")
+		}
+		return err
+	}
+	return nil
+}
+
+// checkAddToAlbum returns an error if user isn't allowed to add files to the
+// album, i.e. if they are neither the owner nor a member with the AllowAdd
+// permission.
+func (s *Server) checkAddToAlbum(user database.User, albumID string) error {
+	albumSpec, err := s.db.Album(user, albumID)
+	if err != nil {
+		return err
+	}
+	if albumSpec.OwnerID == user.UserID {
+		return nil
+	}
+	if !albumSpec.Members[user.UserID] || !albumSpec.Permissions.AllowAdd() {
+		return errAddNotPermitted
+	}
+	return nil
+}
+
 // handleMoveFile handles the /v2/sync/moveFile endpoint. It is used to move
 // or copy files between filesets/albums.
 //
@@ -124,9 +258,10 @@ func (s *Server) handleUpload(w http.ResponseWriter, req *http.Request) {
 // Returns:
 //   - stingle.Response(ok)
 func (s *Server) handleMoveFile(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
 	params, err := s.decodeParams(req.PostFormValue("params"), user)
 	if err != nil {
-		log.Errorf("decodeParams: %v", err)
+		logger.Errorf("decodeParams: %v", err)
 		return stingle.ResponseNOK()
 	}
 
@@ -163,7 +298,7 @@ func (s *Server) handleMoveFile(user database.User, req *http.Request) *stingle.
 	if p.AlbumIDFrom != "" {
 		albumSpec, err := s.db.Album(user, p.AlbumIDFrom)
 		if err != nil {
-			log.Errorf("db.Album(%q, %q) failed: %v", user.Email, p.AlbumIDFrom, err)
+			logger.Errorf("db.Album(%q, %q) failed: %v", user.Email, p.AlbumIDFrom, err)
 			return stingle.ResponseNOK()
 		}
 		if albumSpec.OwnerID != user.UserID && !albumSpec.Permissions.AllowCopy() {
@@ -174,18 +309,14 @@ func (s *Server) handleMoveFile(user database.User, req *http.Request) *stingle.
 		}
 	}
 	if p.AlbumIDTo != "" {
-		albumSpec, err := s.db.Album(user, p.AlbumIDTo)
-		if err != nil {
-			log.Errorf("db.Album(%q, %q) failed: %v", user.Email, p.AlbumIDTo, err)
-			return stingle.ResponseNOK()
-		}
-		if albumSpec.OwnerID != user.UserID && !albumSpec.Permissions.AllowAdd() {
+		if err := s.checkAddToAlbum(user, p.AlbumIDTo); err != nil {
+			logger.Errorf("checkAddToAlbum(%q): %v", p.AlbumIDTo, err)
 			return stingle.ResponseNOK().AddError("Adding to this album is not permitted")
 		}
 	}
 
 	if err := s.db.MoveFile(user, p); err != nil {
-		log.Errorf("MoveFile(%+v): %v", p, err)
+		logger.Errorf("MoveFile(%+v): %v", p, err)
 		if err == database.ErrQuotaExceeded {
 			return stingle.ResponseNOK().AddError("Quota exceeded")
 		}
@@ -209,13 +340,14 @@ func (s *Server) handleMoveFile(user database.User, req *http.Request) *stingle.
 // Returns:
 //   - stingle.Response(ok)
 func (s *Server) handleEmptyTrash(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
 	params, err := s.decodeParams(req.PostFormValue("params"), user)
 	if err != nil {
-		log.Errorf("decodeParams: %v", err)
+		logger.Errorf("decodeParams: %v", err)
 		return stingle.ResponseNOK()
 	}
 	if err := s.db.EmptyTrash(user, parseInt(params["time"], 0)); err != nil {
-		log.Errorf("EmptyTrash: %v", err)
+		logger.Errorf("EmptyTrash: %v", err)
 		return stingle.ResponseNOK()
 	}
 	return stingle.ResponseOK()
@@ -236,9 +368,10 @@ func (s *Server) handleEmptyTrash(user database.User, req *http.Request) *stingl
 // Returns:
 //   - stingle.Response(ok)
 func (s *Server) handleDelete(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
 	params, err := s.decodeParams(req.PostFormValue("params"), user)
 	if err != nil {
-		log.Errorf("decodeParams: %v", err)
+		logger.Errorf("decodeParams: %v", err)
 		return stingle.ResponseNOK()
 	}
 	count := parseInt(params["count"], 0)
@@ -250,7 +383,7 @@ func (s *Server) handleDelete(user database.User, req *http.Request) *stingle.Re
 		files = append(files, params[fmt.Sprintf("filename%d", i)])
 	}
 	if err := s.db.DeleteFiles(user, files); err != nil {
-		log.Errorf("DeleteFiles: %v", err)
+		logger.Errorf("DeleteFiles: %v", err)
 		return stingle.ResponseNOK()
 	}
 	return stingle.ResponseOK()
@@ -271,34 +404,44 @@ func (s *Server) handleDelete(user database.User, req *http.Request) *stingle.Re
 // Returns:
 //   - The content of the file is streamed.
 func (s *Server) handleDownload(w http.ResponseWriter, req *http.Request) {
+	logger := log.FromContext(req.Context())
 	timer := prometheus.NewTimer(reqLatency.WithLabelValues(req.Method, req.URL.String()))
 	defer timer.ObserveDuration()
 	req.ParseForm()
 
-	_, user, err := s.checkToken(req.PostFormValue("token"), "session")
+	tok := req.PostFormValue("token")
+	_, user, err := s.checkToken(tok, "session")
 	if err != nil {
-		log.Errorf("%s %s (INVALID TOKEN: %v)", req.Method, req.URL, err)
+		logger.Errorf("%s %s (INVALID TOKEN: %v)", req.Method, req.URL, err)
 		stingle.ResponseOK().AddPart("logout", "1").Send(w)
 		reqStatus.WithLabelValues(req.Method, req.URL.String(), "nok").Inc()
 		return
 	}
-	log.Infof("%s %s (UserID:%d)", req.Method, req.URL, user.UserID)
+	logger = logger.With("userId", user.UserID)
+	if err := s.checkSignature(user, tok, req); err != nil {
+		logger.Errorf("%s %s (INVALID SIGNATURE: %v)", req.Method, req.URL, err)
+		w.WriteHeader(http.StatusForbidden)
+		reqStatus.WithLabelValues(req.Method, req.URL.String(), "nok").Inc()
+		return
+	}
+	logger.Infof("%s %s (UserID:%d)", req.Method, req.URL, user.UserID)
 	filename := req.PostFormValue("file")
 	set := req.PostFormValue("set")
 	thumb := req.PostFormValue("thumb") == "1"
 
 	f, err := s.db.DownloadFile(user, set, filename, thumb)
 	if err != nil {
-		log.Errorf("DownloadFile failed: %v", err)
+		logger.Errorf("DownloadFile failed: %v", err)
 		w.WriteHeader(http.StatusNotFound)
 		reqStatus.WithLabelValues(req.Method, req.URL.String(), "nok").Inc()
 		return
 	}
+	w.Header().Set("Content-Type", "application/octet-stream")
 	if _, err := s.copyWithCtx(req.Context(), w, f); err != nil {
-		log.Debugf("Copy failed: %v", err)
+		logger.Debugf("Copy failed: %v", err)
 	}
 	if err := f.Close(); err != nil {
-		log.Errorf("Close failed: %v", err)
+		logger.Errorf("Close failed: %v", err)
 	}
 	reqStatus.WithLabelValues(req.Method, req.URL.String(), "ok").Inc()
 }
@@ -340,34 +483,37 @@ func (s *Server) tryToHandleRange(w http.ResponseWriter, rangeHdr string, f io.R
 // Returns:
 //   - The content of the file is streamed.
 func (s *Server) handleTokenDownload(w http.ResponseWriter, req *http.Request) {
+	logger := log.FromContext(req.Context())
 	baseURI, tok := path.Split(req.URL.RequestURI())
 	timer := prometheus.NewTimer(reqLatency.WithLabelValues(req.Method, baseURI))
 	defer timer.ObserveDuration()
 
 	token, user, err := s.checkToken(tok, "download")
 	if err != nil {
-		log.Errorf("%s %s (INVALID TOKEN: %v)", req.Method, req.URL, err)
+		logger.Errorf("%s %s (INVALID TOKEN: %v)", req.Method, req.URL, err)
 		w.WriteHeader(http.StatusUnauthorized)
 		reqStatus.WithLabelValues(req.Method, baseURI, "nok").Inc()
 		return
 	}
-	log.Infof("%s %s %s[...] (UserID:%d)", req.Proto, req.Method, baseURI, user.UserID)
+	logger = logger.With("userId", user.UserID)
+	logger.Infof("%s %s %s[...] (UserID:%d)", req.Proto, req.Method, baseURI, user.UserID)
 
 	f, err := s.db.DownloadFile(user, token.Set, token.File, token.Thumb)
 	if err != nil {
-		log.Errorf("DownloadFile(%q, %q, %q, %v) failed: %v", user.Email, token.Set, token.File, token.Thumb, err)
+		logger.Errorf("DownloadFile(%q, %q, %q, %v) failed: %v", user.Email, token.Set, token.File, token.Thumb, err)
 		w.WriteHeader(http.StatusNotFound)
 		reqStatus.WithLabelValues(req.Method, baseURI, "nok").Inc()
 		return
 	}
+	w.Header().Set("Content-Type", "application/octet-stream")
 	if r := req.Header.Get("Range"); r != "" {
 		s.tryToHandleRange(w, r, f)
 	}
 	if _, err := s.copyWithCtx(req.Context(), w, f); err != nil {
-		log.Debugf("Copy failed: %v", err)
+		logger.Debugf("Copy failed: %v", err)
 	}
 	if err := f.Close(); err != nil {
-		log.Errorf("Close failed: %v", err)
+		logger.Errorf("Close failed: %v", err)
 	}
 	reqStatus.WithLabelValues(req.Method, baseURI, "ok").Inc()
 }
@@ -409,7 +555,7 @@ func (s *Server) copyWithCtx(ctx context.Context, dst io.Writer, src io.Reader)
 }
 
 // makeDownloadURL creates a signed URL to download a file.
-func (s *Server) makeDownloadURL(user database.User, host, file, set string, isThumb bool) (string, error) {
+func (s *Server) makeDownloadURL(user database.User, req *http.Request, file, set string, isThumb bool) (string, error) {
 	tk, err := s.db.DecryptTokenKey(user.TokenKey)
 	if err != nil {
 		return "", err
@@ -426,11 +572,7 @@ func (s *Server) makeDownloadURL(user database.User, host, file, set string, isT
 		},
 		12*time.Hour,
 	)
-	b := s.BaseURL
-	if b == "" {
-		b = fmt.Sprintf("https://%s%s/", host, s.pathPrefix)
-	}
-	return fmt.Sprintf("%sv2/download/%s", b, tok), nil
+	return fmt.Sprintf("%sv2/download/%s", s.baseURL(req), tok), nil
 }
 
 // handleGetDownloadUrls handles the /v2/sync/getDownloadUrls endpoint. It is
@@ -458,7 +600,7 @@ func (s *Server) handleGetDownloadUrls(user database.User, req *http.Request) *s
 			continue
 		}
 		set := req.PostFormValue(strings.Replace(k, "filename", "set", 1))
-		url, err := s.makeDownloadURL(user, req.Host, v[0], set, isThumb)
+		url, err := s.makeDownloadURL(user, req, v[0], set, isThumb)
 		if err != nil {
 			return stingle.ResponseNOK()
 		}
@@ -482,9 +624,49 @@ func (s *Server) handleGetDownloadUrls(user database.User, req *http.Request) *s
 //   - StringleResponse(ok).
 //     Parts("url", signed url)
 func (s *Server) handleGetURL(user database.User, req *http.Request) *stingle.Response {
-	url, err := s.makeDownloadURL(user, req.Host, req.PostFormValue("file"), req.PostFormValue("set"), req.PostFormValue("thumb") == "1")
+	url, err := s.makeDownloadURL(user, req, req.PostFormValue("file"), req.PostFormValue("set"), req.PostFormValue("thumb") == "1")
 	if err != nil {
 		return stingle.ResponseNOK()
 	}
 	return stingle.ResponseOK().AddPart("url", url)
 }
+
+// handleGetFile handles the /v2/sync/getFile endpoint. It is used to fetch
+// the current record of a single file, e.g. when the client suspects that its
+// local copy is stale.
+//
+// Arguments:
+//   - user: The authenticated user.
+//   - req: The http request.
+//
+// Form arguments
+//   - params: The encrypted parameters
+//   - set: The file set where the file is.
+//   - albumId: The ID of the album, when set is the album set.
+//   - file: The filename.
+//
+// Returns:
+//   - stingle.Response(ok)
+//     Part("file", the stingle.File record, or null if the file isn't in
+//     the file set)
+func (s *Server) handleGetFile(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
+	params, err := s.decodeParams(req.PostFormValue("params"), user)
+	if err != nil {
+		logger.Errorf("decodeParams: %v", err)
+		return stingle.ResponseNOK()
+	}
+	set, albumID, file := params["set"], params["albumId"], params["file"]
+	if set != stingle.GallerySet && set != stingle.TrashSet && set != stingle.AlbumSet {
+		return stingle.ResponseNOK().AddError("Invalid set")
+	}
+	f, err := s.db.FileRecord(user, set, albumID, file)
+	if errors.Is(err, os.ErrNotExist) {
+		return stingle.ResponseOK().AddPart("file", nil)
+	}
+	if err != nil {
+		logger.Errorf("FileRecord(%q, %q, %q): %v", set, albumID, file, err)
+		return stingle.ResponseNOK()
+	}
+	return stingle.ResponseOK().AddPart("file", f)
+}
@@ -18,11 +18,25 @@
 package server_test
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/server"
 	"c2FmZQ/internal/stingle"
 )
 
@@ -131,6 +145,287 @@ func TestUploadDownload(t *testing.T) {
 	}
 }
 
+func TestUploadBatch(t *testing.T) {
+	sock, shutdown := startServer(t)
+	defer shutdown()
+
+	c, err := createAccountAndLogin(sock, "alice")
+	if err != nil {
+		t.Fatalf("createAccountAndLogin failed: %v", err)
+	}
+	if err := c.addAlbum("album1", 1000); err != nil {
+		t.Fatalf("c.addAlbum failed: %v", err)
+	}
+
+	sr, err := c.uploadBatch([]batchFile{
+		{"filename1", stingle.GallerySet, "", ""},
+		{"filename2", stingle.AlbumSet, "album1", ""},
+		{"filename3", stingle.AlbumSet, "DoesNotExist", ""},
+	}, 1000)
+	if err != nil {
+		t.Fatalf("c.uploadBatch failed: %v", err)
+	}
+	if want, got := "ok", sr.Status; want != got {
+		t.Fatalf("c.uploadBatch returned unexpected status: Want %q, got %q", want, got)
+	}
+	results, ok := sr.Part("results").([]interface{})
+	if !ok || len(results) != 3 {
+		t.Fatalf("c.uploadBatch returned unexpected results: %#v", sr.Part("results"))
+	}
+	if results[0] != "ok" || results[1] != "ok" || results[2] == "ok" {
+		t.Errorf("c.uploadBatch returned unexpected results: %v", results)
+	}
+
+	for _, f := range []struct{ filename, set, thumb, body string }{
+		{"filename1", stingle.GallerySet, "0", `Content of "file" filename "filename1"`},
+		{"filename1", stingle.GallerySet, "1", `Content of "thumb" filename "filename1"`},
+		{"filename2", stingle.AlbumSet, "0", `Content of "file" filename "filename2"`},
+		{"filename2", stingle.AlbumSet, "1", `Content of "thumb" filename "filename2"`},
+	} {
+		body, err := c.downloadPost(f.filename, f.set, f.thumb)
+		if err != nil {
+			t.Fatalf("c.downloadPost(%q, %q, %q) failed: %v", f.filename, f.set, f.thumb, err)
+		}
+		if want, got := f.body, body; want != got {
+			t.Errorf("c.downloadPost returned unexpected body: Want %q, got %q", want, got)
+		}
+	}
+}
+
+func TestUploadBatchTruncated(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	sock, shutdown := startServerWithDB(t, database.New(dir, nil))
+	defer shutdown()
+
+	c, err := createAccountAndLogin(sock, "alice")
+	if err != nil {
+		t.Fatalf("createAccountAndLogin failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	pw, err := w.CreateFormField("token")
+	if err != nil {
+		t.Fatalf("CreateFormField: %v", err)
+	}
+	fmt.Fprint(pw, c.token)
+	// A file part without an index, a duplicate part, and a truncated
+	// part.
+	for _, name := range []string{"file", "file0", "thumb0", "file0", "file1"} {
+		pw, err := w.CreateFormFile(name, "filename")
+		if err != nil {
+			t.Fatalf("CreateFormFile: %v", err)
+		}
+		fmt.Fprintf(pw, "Content of %q", name)
+	}
+	body := buf.Bytes()[:buf.Len()-5]
+
+	dialer := dialer{sock: sock}
+	hc := http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
+	resp, err := hc.Post("http://unix/v2/sync/uploadBatch", w.FormDataContentType(), bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("hc.Post failed: %v", err)
+	}
+	resp.Body.Close()
+	if want, got := http.StatusInternalServerError, resp.StatusCode; want != got {
+		t.Errorf("Unexpected status code. Want %d, got %d", want, got)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, "uploads"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("os.ReadDir: %v", err)
+	}
+	for _, e := range entries {
+		t.Errorf("Unexpected file left in uploads: %s", e.Name())
+	}
+}
+
+func TestUploadMalformedHeaders(t *testing.T) {
+	sock, shutdown := startServer(t)
+	defer shutdown()
+
+	c, err := createAccountAndLogin(sock, "alice")
+	if err != nil {
+		t.Fatalf("createAccountAndLogin failed: %v", err)
+	}
+
+	good := testHeaders("filename headers ")
+	parts := strings.Split(good, "*")
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		t.Fatalf("DecodeString: %v", err)
+	}
+	malformed := []string{
+		"HEADERS",
+		parts[0],
+		good + "*" + parts[1],
+		"not base64!*" + parts[1],
+		base64.RawURLEncoding.EncodeToString(raw[:len(raw)-1]) + "*" + parts[1],
+		base64.RawURLEncoding.EncodeToString(append([]byte("XX"), raw[2:]...)) + "*" + parts[1],
+	}
+	for i, hdrs := range malformed {
+		if _, err := c.uploadFileWithHeaders(fmt.Sprintf("bad%d", i), stingle.GallerySet, "", hdrs, 1000); err == nil {
+			t.Errorf("c.uploadFile(%q) succeeded unexpectedly", hdrs)
+		}
+	}
+	var batch []batchFile
+	for i, hdrs := range malformed {
+		batch = append(batch, batchFile{fmt.Sprintf("badbatch%d", i), stingle.GallerySet, "", hdrs})
+	}
+	sr, err := c.uploadBatch(batch, 1000)
+	if err != nil {
+		t.Fatalf("c.uploadBatch failed: %v", err)
+	}
+	results, ok := sr.Part("results").([]interface{})
+	if !ok || len(results) != len(malformed) {
+		t.Fatalf("c.uploadBatch returned unexpected results: %#v", sr.Part("results"))
+	}
+	for i, r := range results {
+		if r == "ok" {
+			t.Errorf("c.uploadBatch file %d succeeded unexpectedly", i)
+		}
+	}
+
+	// Padded base64 is accepted, and stored in canonical form.
+	database.CurrentTimeForTesting = 2000
+	padded := base64.URLEncoding.EncodeToString(raw) + "*" + parts[1]
+	if _, err := c.uploadFileWithHeaders("filename", stingle.GallerySet, "", padded, 1000); err != nil {
+		t.Fatalf("c.uploadFile failed: %v", err)
+	}
+
+	got, err := c.getUpdates(0, 0, 0, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("c.getUpdates failed: %v", err)
+	}
+	want := stingle.ResponseOK().
+		AddPartList("files",
+			map[string]interface{}{"albumId": "", "dateCreated": "1000", "dateModified": "2000", "file": "filename", "headers": good, "version": "1"},
+		)
+	if diff := diffUpdates(want, got); diff != "" {
+		t.Errorf("Unexpected updates:\n%s", diff)
+	}
+}
+
+func TestUploadPermissions(t *testing.T) {
+	sock, shutdown := startServer(t)
+	defer shutdown()
+
+	alice, bob, carol, err := createAccountsAndLogin(sock)
+	if err != nil {
+		t.Fatalf("createAccountsAndLogin failed: %v", err)
+	}
+	if err := alice.addAlbum("album", 1000); err != nil {
+		t.Fatalf("alice.addAlbum failed: %v", err)
+	}
+	album := stingle.Album{
+		AlbumID:     "album",
+		Permissions: "1000",
+		Members:     fmt.Sprintf("%d,%d", alice.userID, bob.userID),
+		SharingKeys: map[string]string{
+			fmt.Sprintf("%d", bob.userID): "Bob's Sharing Key",
+		},
+	}
+	if err := alice.shareAlbum(album); err != nil {
+		t.Fatalf("alice.shareAlbum failed: %v", err)
+	}
+	if _, err := alice.uploadFile("alice-file", stingle.AlbumSet, "album", 1000); err != nil {
+		t.Errorf("alice.uploadFile failed: %v", err)
+	}
+
+	// Bob is a member without the AllowAdd permission, and carol isn't a
+	// member.
+	for _, c := range []*client{bob, carol} {
+		if _, err := c.uploadFile("file", stingle.AlbumSet, "album", 1000); err == nil {
+			t.Errorf("%s.uploadFile succeeded unexpectedly", c.email)
+		}
+		sr, err := c.uploadBatch([]batchFile{{"file", stingle.AlbumSet, "album", ""}}, 1000)
+		if err != nil {
+			t.Fatalf("%s.uploadBatch failed: %v", c.email, err)
+		}
+		if results, ok := sr.Part("results").([]interface{}); !ok || len(results) != 1 || results[0] == "ok" {
+			t.Errorf("%s.uploadBatch returned unexpected results: %#v", c.email, sr.Part("results"))
+		}
+		if _, err := c.uploadFile("gallery-file", stingle.GallerySet, "", 1000); err != nil {
+			t.Fatalf("%s.uploadFile failed: %v", c.email, err)
+		}
+		if err := c.moveFiles(database.MoveFileParams{
+			SetFrom:   stingle.GallerySet,
+			SetTo:     stingle.AlbumSet,
+			AlbumIDTo: "album",
+			Filenames: []string{"gallery-file"},
+			Headers:   []string{"new headers"},
+		}); err == nil {
+			t.Errorf("%s.moveFiles succeeded unexpectedly", c.email)
+		}
+	}
+
+	album.Permissions = "1100"
+	if err := alice.editPerms(album); err != nil {
+		t.Fatalf("alice.editPerms failed: %v", err)
+	}
+	if _, err := bob.uploadFile("bob-file", stingle.AlbumSet, "album", 1000); err != nil {
+		t.Errorf("bob.uploadFile failed: %v", err)
+	}
+	if _, err := carol.uploadFile("carol-file", stingle.AlbumSet, "album", 1000); err == nil {
+		t.Error("carol.uploadFile succeeded unexpectedly")
+	}
+}
+
+func TestUploadLargeFile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping large upload in short mode")
+	}
+	sock, shutdown := startServer(t)
+	defer shutdown()
+
+	c, err := createAccountAndLogin(sock, "alice")
+	if err != nil {
+		t.Fatalf("createAccountAndLogin failed: %v", err)
+	}
+
+	// Record the peak heap usage while the file is uploaded.
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	baseline := ms.HeapAlloc
+	peak := baseline
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			runtime.ReadMemStats(&ms)
+			if ms.HeapAlloc > peak {
+				peak = ms.HeapAlloc
+			}
+		}
+	}()
+
+	const fileSize = 64 << 20
+	err = c.uploadLargeFile("large-file", fileSize)
+	close(done)
+	<-stopped
+	if err != nil {
+		t.Fatalf("c.uploadLargeFile failed: %v", err)
+	}
+	if used := peak - baseline; used > fileSize/4 {
+		t.Errorf("Upload used too much memory: %d MiB", used>>20)
+	}
+
+	sr, err := c.accountUsage()
+	if err != nil {
+		t.Fatalf("c.accountUsage failed: %v", err)
+	}
+	if want, got := fmt.Sprint(fileSize+len("thumb")), sr.Part("spaceUsed"); want != got {
+		t.Errorf("Unexpected spaceUsed: Want %q, got %q", want, got)
+	}
+}
+
 func TestEmptyTrash(t *testing.T) {
 	sock, shutdown := startServer(t)
 	defer shutdown()
@@ -218,6 +513,64 @@ func TestDelete(t *testing.T) {
 	}
 }
 
+func TestAccountUsage(t *testing.T) {
+	sock, shutdown := startServer(t)
+	defer shutdown()
+
+	c, err := createAccountAndLogin(sock, "alice")
+	if err != nil {
+		t.Fatalf("createAccountAndLogin failed: %v", err)
+	}
+	if err := c.addAlbum("album1", 1000); err != nil {
+		t.Fatalf("c.addAlbum failed: %v", err)
+	}
+
+	checkUsage := func(spaceUsed, fileCount, albumCount int) {
+		t.Helper()
+		sr, err := c.accountUsage()
+		if err != nil {
+			t.Fatalf("c.accountUsage failed: %v", err)
+		}
+		for _, p := range []struct {
+			name string
+			want int
+		}{
+			{"spaceUsed", spaceUsed},
+			{"fileCount", fileCount},
+			{"albumCount", albumCount},
+		} {
+			if want, got := fmt.Sprint(p.want), sr.Part(p.name); want != got {
+				t.Errorf("Unexpected %s: Want %q, got %q", p.name, want, got)
+			}
+		}
+	}
+	fileSize := func(filename string) int {
+		return len(fmt.Sprintf("Content of %q filename %q", "file", filename)) + len(fmt.Sprintf("Content of %q filename %q", "thumb", filename))
+	}
+
+	checkUsage(0, 0, 1)
+
+	var size int
+	for i := 0; i < 10; i++ {
+		f := fmt.Sprintf("filename%d", i)
+		set, albumID := stingle.TrashSet, ""
+		if i%2 == 0 {
+			set, albumID = stingle.AlbumSet, "album1"
+		}
+		if _, err := c.uploadFile(f, set, albumID, 1000); err != nil {
+			t.Fatalf("c.uploadFile(%q) failed: %v", f, err)
+		}
+		size += fileSize(f)
+	}
+	checkUsage(size, 10, 1)
+
+	files := []string{"filename1", "filename3"}
+	if err := c.deleteFiles(files); err != nil {
+		t.Fatalf("c.deleteFile(%v) failed: %v", files, err)
+	}
+	checkUsage(size-fileSize("filename1")-fileSize("filename3"), 8, 1)
+}
+
 func TestMoveFile(t *testing.T) {
 	sock, shutdown := startServer(t)
 	defer shutdown()
@@ -296,16 +649,16 @@ func TestMoveFile(t *testing.T) {
 
 	want := stingle.ResponseOK().
 		AddPartList("trash",
-			map[string]interface{}{"albumId": "", "dateCreated": "1000", "dateModified": "3000", "file": "filename0", "headers": "filename0 headers ", "version": "1"},
-			map[string]interface{}{"albumId": "", "dateCreated": "1000", "dateModified": "3000", "file": "filename1", "headers": "filename1 headers ", "version": "1"},
+			map[string]interface{}{"albumId": "", "dateCreated": "1000", "dateModified": "3000", "file": "filename0", "headers": testHeaders("filename0 headers "), "version": "1"},
+			map[string]interface{}{"albumId": "", "dateCreated": "1000", "dateModified": "3000", "file": "filename1", "headers": testHeaders("filename1 headers "), "version": "1"},
 		).
 		AddPartList("files",
-			map[string]interface{}{"albumId": "", "dateCreated": "1000", "dateModified": "2000", "file": "filename4", "headers": "filename4 headers ", "version": "1"},
-			map[string]interface{}{"albumId": "", "dateCreated": "1000", "dateModified": "2000", "file": "filename5", "headers": "filename5 headers ", "version": "1"},
-			map[string]interface{}{"albumId": "", "dateCreated": "1000", "dateModified": "2000", "file": "filename6", "headers": "filename6 headers ", "version": "1"},
-			map[string]interface{}{"albumId": "", "dateCreated": "1000", "dateModified": "2000", "file": "filename7", "headers": "filename7 headers ", "version": "1"},
-			map[string]interface{}{"albumId": "", "dateCreated": "1000", "dateModified": "2000", "file": "filename8", "headers": "filename8 headers ", "version": "1"},
-			map[string]interface{}{"albumId": "", "dateCreated": "1000", "dateModified": "2000", "file": "filename9", "headers": "filename9 headers ", "version": "1"},
+			map[string]interface{}{"albumId": "", "dateCreated": "1000", "dateModified": "2000", "file": "filename4", "headers": testHeaders("filename4 headers "), "version": "1"},
+			map[string]interface{}{"albumId": "", "dateCreated": "1000", "dateModified": "2000", "file": "filename5", "headers": testHeaders("filename5 headers "), "version": "1"},
+			map[string]interface{}{"albumId": "", "dateCreated": "1000", "dateModified": "2000", "file": "filename6", "headers": testHeaders("filename6 headers "), "version": "1"},
+			map[string]interface{}{"albumId": "", "dateCreated": "1000", "dateModified": "2000", "file": "filename7", "headers": testHeaders("filename7 headers "), "version": "1"},
+			map[string]interface{}{"albumId": "", "dateCreated": "1000", "dateModified": "2000", "file": "filename8", "headers": testHeaders("filename8 headers "), "version": "1"},
+			map[string]interface{}{"albumId": "", "dateCreated": "1000", "dateModified": "2000", "file": "filename9", "headers": testHeaders("filename9 headers "), "version": "1"},
 		).
 		AddPartList("albums",
 			map[string]interface{}{"albumId": "album1", "cover": "", "dateCreated": "1000", "dateModified": "1000", "encPrivateKey": "album1 encPrivateKey", "isHidden": "0", "isLocked": "0", "isOwner": "1", "isShared": "0", "members": "", "metadata": "album1 metadata", "permissions": "", "publicKey": "album1 publicKey"},
@@ -328,6 +681,62 @@ func TestMoveFile(t *testing.T) {
 	}
 }
 
+// uploadLargeFile uploads a file with size bytes of content to the gallery.
+// The request body is generated as it is sent.
+func (c *client) uploadLargeFile(filename string, size int64) error {
+	dialer := dialer{sock: c.sock}
+	hc := http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
+
+	pr, pw := io.Pipe()
+	w := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(func() error {
+			for _, f := range []struct{ name, value string }{
+				{"headers", testHeaders(filename + " headers")},
+				{"set", stingle.GallerySet},
+				{"dateCreated", "1000"},
+				{"dateModified", "1000"},
+				{"version", "1"},
+				{"token", c.token},
+			} {
+				if err := w.WriteField(f.name, f.value); err != nil {
+					return err
+				}
+			}
+			fw, err := w.CreateFormFile("file", filename)
+			if err != nil {
+				return err
+			}
+			chunk := bytes.Repeat([]byte{'x'}, 1<<20)
+			for n := int64(0); n < size; n += int64(len(chunk)) {
+				if size-n < int64(len(chunk)) {
+					chunk = chunk[:size-n]
+				}
+				if _, err := fw.Write(chunk); err != nil {
+					return err
+				}
+			}
+			if fw, err = w.CreateFormFile("thumb", filename); err != nil {
+				return err
+			}
+			if _, err := fw.Write([]byte("thumb")); err != nil {
+				return err
+			}
+			return w.Close()
+		}())
+	}()
+
+	resp, err := hc.Post("http://unix/v2/sync/upload", w.FormDataContentType(), pr)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("request returned status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
 func (c *client) getURL(file, set string) (string, error) {
 	form := url.Values{}
 	form.Set("token", c.token)
@@ -442,3 +851,174 @@ func (c *client) moveFiles(p database.MoveFileParams) error {
 	}
 	return nil
 }
+
+func TestGetFile(t *testing.T) {
+	sock, shutdown := startServer(t)
+	defer shutdown()
+
+	alice, bob, _, err := createAccountsAndLogin(sock)
+	if err != nil {
+		t.Fatalf("createAccountsAndLogin failed: %v", err)
+	}
+	database.CurrentTimeForTesting = 2000
+	if err := alice.addAlbum("album1", 1000); err != nil {
+		t.Fatalf("alice.addAlbum failed: %v", err)
+	}
+	if _, err := alice.uploadFile("filename1", stingle.GallerySet, "", 1000); err != nil {
+		t.Fatalf("alice.uploadFile failed: %v", err)
+	}
+	if _, err := alice.uploadFile("filename2", stingle.AlbumSet, "album1", 1000); err != nil {
+		t.Fatalf("alice.uploadFile failed: %v", err)
+	}
+
+	for _, tc := range []struct {
+		set, albumID, file string
+		want               *stingle.File
+	}{
+		{stingle.GallerySet, "", "filename1", &stingle.File{File: "filename1", Version: "1", DateCreated: "1000", DateModified: "2000", Headers: testHeaders("filename1 headers ")}},
+		{stingle.AlbumSet, "album1", "filename2", &stingle.File{File: "filename2", Version: "1", DateCreated: "1000", DateModified: "2000", Headers: testHeaders("filename2 headers album1"), AlbumID: "album1"}},
+		{stingle.GallerySet, "", "filename2", nil},
+		{stingle.TrashSet, "", "filename1", nil},
+	} {
+		got, err := alice.getFile(tc.set, tc.albumID, tc.file)
+		if err != nil {
+			t.Fatalf("alice.getFile(%q, %q, %q) failed: %v", tc.set, tc.albumID, tc.file, err)
+		}
+		if !reflect.DeepEqual(tc.want, got) {
+			t.Errorf("alice.getFile(%q, %q, %q) = %#v, want %#v", tc.set, tc.albumID, tc.file, got, tc.want)
+		}
+	}
+
+	if _, err := alice.getFile("9", "", "filename1"); err == nil {
+		t.Error("alice.getFile with invalid set succeeded unexpectedly")
+	}
+	// Bob isn't a member of album1.
+	if f, err := bob.getFile(stingle.AlbumSet, "album1", "filename2"); err != nil || f != nil {
+		t.Errorf("bob.getFile = %#v, %v, want nil", f, err)
+	}
+}
+
+func (c *client) getFile(set, albumID, file string) (*stingle.File, error) {
+	params := make(map[string]string)
+	params["set"] = set
+	params["albumId"] = albumID
+	params["file"] = file
+	form := url.Values{}
+	form.Set("token", c.token)
+	form.Set("params", c.encodeParams(params))
+
+	sr, err := c.sendRequest("/v2/sync/getFile", form)
+	if err != nil {
+		return nil, err
+	}
+	if sr.Status != "ok" {
+		return nil, sr
+	}
+	if sr.Part("file") == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(sr.Part("file"))
+	if err != nil {
+		return nil, err
+	}
+	var f stingle.File
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func TestCompression(t *testing.T) {
+	sock, shutdown := startServer(t)
+	defer shutdown()
+
+	c, err := createAccountAndLogin(sock, "alice")
+	if err != nil {
+		t.Fatalf("createAccountAndLogin failed: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := c.addAlbum(fmt.Sprintf("album%d", i), 1000); err != nil {
+			t.Fatalf("c.addAlbum failed: %v", err)
+		}
+	}
+	if _, err := c.uploadFile("filename1", stingle.GallerySet, "", 1000); err != nil {
+		t.Fatalf("c.uploadFile failed: %v", err)
+	}
+
+	form := url.Values{}
+	form.Set("token", c.token)
+	for _, st := range []string{"fileST", "trashST", "albumsST", "albumFilesST", "cntST", "delST"} {
+		form.Set(st, "0")
+	}
+	hdr, size, err := c.sendRawRequest("/v2/sync/getUpdates", form, "gzip")
+	if err != nil {
+		t.Fatalf("c.sendRawRequest failed: %v", err)
+	}
+	if want, got := "gzip", hdr.Get("Content-Encoding"); want != got {
+		t.Errorf("getUpdates returned unexpected Content-Encoding: Want %q, got %q", want, got)
+	}
+	_, uncompressedSize, err := c.sendRawRequest("/v2/sync/getUpdates", form, "identity")
+	if err != nil {
+		t.Fatalf("c.sendRawRequest failed: %v", err)
+	}
+	t.Logf("getUpdates response size: %d bytes compressed, %d bytes uncompressed", size, uncompressedSize)
+	if size >= uncompressedSize {
+		t.Errorf("Compressed response isn't smaller: %d >= %d", size, uncompressedSize)
+	}
+
+	form = url.Values{}
+	form.Set("token", c.token)
+	form.Set("file", "filename1")
+	form.Set("set", stingle.GallerySet)
+	form.Set("thumb", "0")
+	if hdr, _, err = c.sendRawRequest("/v2/sync/download", form, "gzip"); err != nil {
+		t.Fatalf("c.sendRawRequest failed: %v", err)
+	}
+	if got := hdr.Get("Content-Encoding"); got != "" {
+		t.Errorf("download returned unexpected Content-Encoding: %q", got)
+	}
+	if want, got := "application/octet-stream", hdr.Get("Content-Type"); want != got {
+		t.Errorf("download returned unexpected Content-Type: Want %q, got %q", want, got)
+	}
+}
+
+func TestDownloadURLForwardedHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		hostHeader string
+		want       string
+	}{
+		{"untrusted", "", "https://unix/v2/download/"},
+		{"trusted", "X-Forwarded-Host", "http://photos.example.com/v2/download/"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sock, shutdown := startServer(t, func(s *server.Server) {
+				s.BaseURL = ""
+				s.ForwardedHostHeader = tc.hostHeader
+				if tc.hostHeader != "" {
+					s.ForwardedProtoHeader = "X-Forwarded-Proto"
+				}
+			})
+			defer shutdown()
+
+			c, err := createAccountAndLogin(sock, "alice")
+			if err != nil {
+				t.Fatalf("createAccountAndLogin failed: %v", err)
+			}
+			if _, err := c.uploadFile("filename1", stingle.GallerySet, "", 1000); err != nil {
+				t.Fatalf("c.uploadFile failed: %v", err)
+			}
+			c.headers = http.Header{
+				"X-Forwarded-Host":  []string{"spoofed.example.com, photos.example.com"},
+				"X-Forwarded-Proto": []string{"http"},
+			}
+			url, err := c.getURL("filename1", stingle.GallerySet)
+			if err != nil {
+				t.Fatalf("c.getURL failed: %v", err)
+			}
+			if !strings.HasPrefix(url, tc.want) {
+				t.Errorf("c.getURL returned %q, want prefix %q", url, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package limit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru"
+	"golang.org/x/time/rate"
+)
+
+// IPThrottle limits the rate of requests from each client IP address, and
+// temporarily bans the addresses that cause too many failures, e.g. failed
+// login attempts.
+type IPThrottle struct {
+	limit       rate.Limit
+	burst       int
+	maxFailures int
+	banDuration time.Duration
+
+	mu      sync.Mutex
+	clients *lru.Cache
+}
+
+type ipState struct {
+	limiter     *rate.Limiter
+	failures    int
+	lastFailure time.Time
+	bannedUntil time.Time
+}
+
+// NewIPThrottle returns a new IPThrottle that allows perMinute requests per
+// minute from each IP address, with bursts of up to perMinute requests. After
+// maxFailures failures, with less than banDuration between them, the address
+// is banned for banDuration.
+func NewIPThrottle(perMinute, maxFailures int, banDuration time.Duration) *IPThrottle {
+	// Only the most recently seen addresses are remembered, so that the
+	// memory usage is bounded.
+	clients, _ := lru.New(10000)
+	return &IPThrottle{
+		limit:       rate.Limit(float64(perMinute) / 60),
+		burst:       perMinute,
+		maxFailures: maxFailures,
+		banDuration: banDuration,
+		clients:     clients,
+	}
+}
+
+func (t *IPThrottle) state(ip string) *ipState {
+	if v, ok := t.clients.Get(ip); ok {
+		return v.(*ipState)
+	}
+	s := &ipState{limiter: rate.NewLimiter(t.limit, t.burst)}
+	t.clients.Add(ip, s)
+	return s
+}
+
+// Allow reports whether a request from ip should be allowed to proceed. When
+// it returns false, retryAfter is how long the client should wait before
+// trying again.
+func (t *IPThrottle) Allow(ip string) (ok bool, retryAfter time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.state(ip)
+	now := time.Now()
+	if now.Before(s.bannedUntil) {
+		return false, s.bannedUntil.Sub(now)
+	}
+	r := s.limiter.ReserveN(now, 1)
+	if d := r.DelayFrom(now); d > 0 {
+		r.CancelAt(now)
+		return false, d
+	}
+	return true, 0
+}
+
+// Failure records a failed request from ip.
+func (t *IPThrottle) Failure(ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.state(ip)
+	now := time.Now()
+	if now.Sub(s.lastFailure) > t.banDuration {
+		s.failures = 0
+	}
+	s.failures++
+	s.lastFailure = now
+	if s.failures >= t.maxFailures {
+		s.failures = 0
+		s.bannedUntil = now.Add(t.banDuration)
+	}
+}
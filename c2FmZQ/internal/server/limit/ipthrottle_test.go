@@ -0,0 +1,50 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package limit_test
+
+import (
+	"testing"
+	"time"
+
+	"c2FmZQ/internal/server/limit"
+)
+
+func TestIPThrottle(t *testing.T) {
+	th := limit.NewIPThrottle(3, 2, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := th.Allow("1.1.1.1"); !ok {
+			t.Fatalf("Allow(1.1.1.1) #%d = false", i)
+		}
+	}
+	if ok, retryAfter := th.Allow("1.1.1.1"); ok || retryAfter <= 0 {
+		t.Errorf("Allow(1.1.1.1) = %v, %v, want false, >0", ok, retryAfter)
+	}
+	if ok, _ := th.Allow("2.2.2.2"); !ok {
+		t.Error("Allow(2.2.2.2) = false")
+	}
+
+	th.Failure("2.2.2.2")
+	if ok, _ := th.Allow("2.2.2.2"); !ok {
+		t.Error("Allow(2.2.2.2) = false after 1 failure")
+	}
+	th.Failure("2.2.2.2")
+	if ok, retryAfter := th.Allow("2.2.2.2"); ok || retryAfter < 59*time.Second {
+		t.Errorf("Allow(2.2.2.2) = %v, %v after 2 failures, want false, ~1m", ok, retryAfter)
+	}
+}
@@ -16,7 +16,7 @@
 // c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
 
 // Package limit implements a mechamism to limit the number of concurrent
-// connections.
+// connections, and the rate of requests from each client IP address.
 package limit
 
 import (
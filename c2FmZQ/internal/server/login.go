@@ -53,10 +53,13 @@ const (
 //   - keyBundle: A binary representation of the public and (optionally) encrypted
 //     secret keys of the user.
 //   - isBackup:  Whether the user's secret key is included in the keyBundle.
+//   - inviteCode: A single-use invite code, required when RequireInviteCode
+//     is set. This is a c2FmZQ extension.
 //
 // Returns:
 //   - stingle.Response(ok)
 func (s *Server) handleCreateAccount(req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
 	defer time.Sleep(time.Duration(time.Now().UnixNano()%200) * time.Millisecond)
 	pk, _, err := stingle.DecodeKeyBundle(req.PostFormValue("keyBundle"))
 	if err != nil {
@@ -64,7 +67,7 @@ func (s *Server) handleCreateAccount(req *http.Request) *stingle.Response {
 	}
 	hashed, err := bcryptGen([]byte(req.PostFormValue("password")), 12)
 	if err != nil {
-		log.Errorf("bcryptGen: %v", err)
+		logger.Errorf("bcryptGen: %v", err)
 		return stingle.ResponseNOK()
 	}
 	email := req.PostFormValue("email")
@@ -77,6 +80,13 @@ func (s *Server) handleCreateAccount(req *http.Request) *stingle.Response {
 	if !s.AllowCreateAccount {
 		return stingle.ResponseNOK()
 	}
+	inviteCode := req.PostFormValue("inviteCode")
+	if s.RequireInviteCode {
+		if err := s.db.UseInviteCode(inviteCode, email); err != nil {
+			logger.Infof("UseInviteCode(%q): %v", email, err)
+			return stingle.ResponseNOK().AddError("Invalid invite code")
+		}
+	}
 	if _, err := s.db.AddUser(
 		database.User{
 			Email:          email,
@@ -87,7 +97,12 @@ func (s *Server) handleCreateAccount(req *http.Request) *stingle.Response {
 			PublicKey:      pk,
 			NeedApproval:   !s.AutoApproveNewAccounts,
 		}); err != nil {
-		log.Errorf("AddUser: %v", err)
+		logger.Errorf("AddUser: %v", err)
+		if s.RequireInviteCode {
+			if err := s.db.ReleaseInviteCode(inviteCode, email); err != nil {
+				logger.Errorf("ReleaseInviteCode(%q): %v", email, err)
+			}
+		}
 		return stingle.ResponseNOK()
 	}
 	return stingle.ResponseOK()
@@ -140,6 +155,7 @@ func (s *Server) handlePreLogin(req *http.Request) *stingle.Response {
 //     Part(isKeyBackedUp, Whether the user's secret key is in keyBundle)
 //     Part(homeFolder, A "Home folder" used on the app's device)
 func (s *Server) handleLogin(req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
 	email, _ := parseOTP(req.PostFormValue("email"))
 	pass := req.PostFormValue("password")
 	u, err := s.db.User(email)
@@ -159,7 +175,7 @@ func (s *Server) handleLogin(req *http.Request) *stingle.Response {
 	}
 	hashed, err := base64.StdEncoding.DecodeString(u.HashedPassword)
 	if err != nil {
-		log.Errorf("base64.StdEncoding.DecodeString: %v", err)
+		logger.Errorf("base64.StdEncoding.DecodeString: %v", err)
 		return stingle.ResponseNOK().AddError("Invalid credentials")
 	}
 	pwCh := make(chan bool)
@@ -169,7 +185,7 @@ func (s *Server) handleLogin(req *http.Request) *stingle.Response {
 	pwOK := <-pwCh
 	decoyUser := <-decoyCh
 
-	log.Debugf("UserID:%d pwOK:%v", u.UserID, pwOK)
+	logger.Debugf("UserID:%d pwOK:%v", u.UserID, pwOK)
 	if !pwOK || mfaFailed {
 		if decoyUser == nil {
 			return stingle.ResponseNOK().AddError("Invalid credentials")
@@ -186,7 +202,7 @@ func (s *Server) handleLogin(req *http.Request) *stingle.Response {
 		u.ValidTokens[token.Hash(tok)] = true
 		return nil
 	}); err != nil {
-		log.Errorf("MutateUser: %v", err)
+		logger.Errorf("MutateUser: %v", err)
 		return stingle.ResponseNOK()
 	}
 	resp := stingle.ResponseOK().
@@ -253,11 +269,12 @@ func (s *Server) decoyLogin(user database.User, hash string) *database.User {
 // Returns:
 //   - StringleResponse(ok)
 func (s *Server) handleLogout(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
 	if err := s.db.MutateUser(user.UserID, func(user *database.User) error {
 		delete(user.ValidTokens, token.Hash(req.PostFormValue("token")))
 		return nil
 	}); err != nil {
-		log.Errorf("MutateUser: %v", err)
+		logger.Errorf("MutateUser: %v", err)
 		return stingle.ResponseNOK()
 	}
 	return stingle.ResponseOK().AddPart("logout", "1")
@@ -279,13 +296,14 @@ func (s *Server) handleLogout(user database.User, req *http.Request) *stingle.Re
 //   - stingle.Response(ok)
 //     Part(token, A new signed session token)
 func (s *Server) handleChangePass(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
 	if user.LoginDisabled {
 		// Changing the password of a decoy account doesn't work.
 		return stingle.ResponseNOK()
 	}
 	params, err := s.decodeParams(req.PostFormValue("params"), user)
 	if err != nil {
-		log.Errorf("decodeParams: %v", err)
+		logger.Errorf("decodeParams: %v", err)
 		return stingle.ResponseNOK()
 	}
 
@@ -293,7 +311,7 @@ func (s *Server) handleChangePass(user database.User, req *http.Request) *stingl
 	if err := s.db.MutateUser(user.UserID, func(user *database.User) error {
 		hashed, err := bcryptGen([]byte(params["newPassword"]), 12)
 		if err != nil {
-			log.Errorf("bcryptGen: %v", err)
+			logger.Errorf("bcryptGen: %v", err)
 			return err
 		}
 		user.HashedPassword = base64.StdEncoding.EncodeToString(hashed)
@@ -301,13 +319,14 @@ func (s *Server) handleChangePass(user database.User, req *http.Request) *stingl
 		user.KeyBundle = params["keyBundle"]
 		etk, err := s.db.NewEncryptedTokenKey()
 		if err != nil {
-			log.Errorf("NewEncryptedTokenKey: %v", err)
+			logger.Errorf("NewEncryptedTokenKey: %v", err)
 			return err
 		}
 		user.TokenKey = etk
+		user.OldTokenKeys = nil
 		pk, hasSK, err := stingle.DecodeKeyBundle(user.KeyBundle)
 		if err != nil {
-			log.Errorf("DecodeKeyBundle: %v", err)
+			logger.Errorf("DecodeKeyBundle: %v", err)
 			return err
 		}
 		user.PublicKey = pk
@@ -318,7 +337,7 @@ func (s *Server) handleChangePass(user database.User, req *http.Request) *stingl
 		}
 		tk, err := s.db.DecryptTokenKey(user.TokenKey)
 		if err != nil {
-			log.Errorf("DecryptTokenKey: %v", err)
+			logger.Errorf("DecryptTokenKey: %v", err)
 			return err
 		}
 		defer tk.Wipe()
@@ -326,7 +345,7 @@ func (s *Server) handleChangePass(user database.User, req *http.Request) *stingl
 		user.ValidTokens = map[string]bool{token.Hash(tok): true}
 		return nil
 	}); err != nil {
-		log.Errorf("MutateUser: %v", err)
+		logger.Errorf("MutateUser: %v", err)
 		return stingle.ResponseNOK()
 	}
 	return stingle.ResponseOK().
@@ -421,6 +440,7 @@ func (s *Server) handleCheckKey(req *http.Request) *stingle.Response {
 //   - stingle.Response(ok)
 //     Part(result, OK)
 func (s *Server) handleRecoverAccount(req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
 	defer time.Sleep(time.Duration(time.Now().UnixNano()%200) * time.Millisecond)
 	email := req.PostFormValue("email")
 	user, err := s.db.User(email)
@@ -438,14 +458,14 @@ func (s *Server) handleRecoverAccount(req *http.Request) *stingle.Response {
 	}
 	params, err := s.decodeParams(req.PostFormValue("params"), user)
 	if err != nil {
-		log.Errorf("decodeParams: %v", err)
+		logger.Errorf("decodeParams: %v", err)
 		return stingle.ResponseNOK()
 	}
 
 	if err := s.db.MutateUser(user.UserID, func(user *database.User) error {
 		hashed, err := bcryptGen([]byte(params["newPassword"]), 12)
 		if err != nil {
-			log.Errorf("bcryptGen: %v", err)
+			logger.Errorf("bcryptGen: %v", err)
 			return err
 		}
 		user.HashedPassword = base64.StdEncoding.EncodeToString(hashed)
@@ -453,13 +473,14 @@ func (s *Server) handleRecoverAccount(req *http.Request) *stingle.Response {
 		user.KeyBundle = params["keyBundle"]
 		etk, err := s.db.NewEncryptedTokenKey()
 		if err != nil {
-			log.Errorf("s.db.NewEncryptedTokenKey: %v", err)
+			logger.Errorf("s.db.NewEncryptedTokenKey: %v", err)
 			return err
 		}
 		user.TokenKey = etk
+		user.OldTokenKeys = nil
 		pk, hasSK, err := stingle.DecodeKeyBundle(user.KeyBundle)
 		if err != nil {
-			log.Errorf("DecodeKeyBundle: %v", err)
+			logger.Errorf("DecodeKeyBundle: %v", err)
 			return err
 		}
 		user.PublicKey = pk
@@ -470,7 +491,7 @@ func (s *Server) handleRecoverAccount(req *http.Request) *stingle.Response {
 		}
 		return nil
 	}); err != nil {
-		log.Errorf("MutateUser: %v", err)
+		logger.Errorf("MutateUser: %v", err)
 		return stingle.ResponseNOK()
 	}
 	return stingle.ResponseOK().AddPart("result", "OK")
@@ -491,22 +512,23 @@ func (s *Server) handleRecoverAccount(req *http.Request) *stingle.Response {
 // Returns:
 //   - stingle.Response(ok)
 func (s *Server) handleDeleteUser(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
 	params, err := s.decodeParams(req.PostFormValue("params"), user)
 	if err != nil {
-		log.Errorf("decodeParams: %v", err)
+		logger.Errorf("decodeParams: %v", err)
 		return stingle.ResponseNOK()
 	}
 	pass := params["password"]
 	hashed, err := base64.StdEncoding.DecodeString(user.HashedPassword)
 	if err != nil {
-		log.Errorf("base64.StdEncoding.DecodeString: %v", err)
+		logger.Errorf("base64.StdEncoding.DecodeString: %v", err)
 		return stingle.ResponseNOK().AddError("Invalid credentials")
 	}
 	if err != nil || bcrypt.CompareHashAndPassword(hashed, []byte(pass)) != nil {
 		return stingle.ResponseNOK().AddError("Invalid credentials")
 	}
 	if err := s.db.DeleteUser(user); err != nil {
-		log.Errorf("DeleteUser: %v", err)
+		logger.Errorf("DeleteUser: %v", err)
 		return stingle.ResponseNOK()
 	}
 	return stingle.ResponseOK()
@@ -526,13 +548,14 @@ func (s *Server) handleDeleteUser(user database.User, req *http.Request) *stingl
 // Returns:
 //   - stingle.Response(ok)
 func (s *Server) handleChangeEmail(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
 	if user.LoginDisabled {
 		// Changing the email of a decoy account doesn't work.
 		return stingle.ResponseNOK()
 	}
 	params, err := s.decodeParams(req.PostFormValue("params"), user)
 	if err != nil {
-		log.Errorf("decodeParams: %v", err)
+		logger.Errorf("decodeParams: %v", err)
 		return stingle.ResponseNOK()
 	}
 	newEmail := params["newEmail"]
@@ -540,7 +563,7 @@ func (s *Server) handleChangeEmail(user database.User, req *http.Request) *sting
 		return stingle.ResponseNOK()
 	}
 	if err := s.db.RenameUser(user.UserID, newEmail); err != nil {
-		log.Errorf("RenameUser: %v", err)
+		logger.Errorf("RenameUser: %v", err)
 		return stingle.ResponseNOK()
 	}
 	return stingle.ResponseOK().
@@ -563,16 +586,17 @@ func (s *Server) handleChangeEmail(user database.User, req *http.Request) *sting
 // Returns:
 //   - stingle.Response(ok)
 func (s *Server) handleReuploadKeys(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
 	params, err := s.decodeParams(req.PostFormValue("params"), user)
 	if err != nil {
-		log.Errorf("decodeParams: %v", err)
+		logger.Errorf("decodeParams: %v", err)
 		return stingle.ResponseNOK()
 	}
 	if err := s.db.MutateUser(user.UserID, func(user *database.User) error {
 		user.KeyBundle = params["keyBundle"]
 		pk, hasSK, err := stingle.DecodeKeyBundle(user.KeyBundle)
 		if err != nil {
-			log.Errorf("DecodeKeyBundle: %v", err)
+			logger.Errorf("DecodeKeyBundle: %v", err)
 			return stingle.ResponseNOK()
 		}
 		user.PublicKey = pk
@@ -583,7 +607,7 @@ func (s *Server) handleReuploadKeys(user database.User, req *http.Request) *stin
 		}
 		return nil
 	}); err != nil {
-		log.Errorf("MutateUser: %v", err)
+		logger.Errorf("MutateUser: %v", err)
 		return stingle.ResponseNOK()
 	}
 	return stingle.ResponseOK()
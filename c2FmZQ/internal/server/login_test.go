@@ -20,12 +20,21 @@ package server_test
 import (
 	"bytes"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/server"
+	"c2FmZQ/internal/server/limit"
 	"c2FmZQ/internal/stingle"
 )
 
@@ -41,6 +50,158 @@ func createAccountAndLogin(sock, email string) (*client, error) {
 	return c, nil
 }
 
+func TestCreateAccountInviteCode(t *testing.T) {
+	db := database.New(filepath.Join(t.TempDir(), "data"), nil)
+	sock, shutdown := startServerWithDB(t, db, func(s *server.Server) {
+		s.RequireInviteCode = true
+	})
+	defer shutdown()
+
+	codes, err := db.NewInviteCodes(1)
+	if err != nil {
+		t.Fatalf("db.NewInviteCodes: %v", err)
+	}
+
+	c := newClient(sock)
+	if err := c.createAccount("alice"); err == nil {
+		t.Fatal("createAccount without invite code succeeded unexpectedly")
+	}
+	c.inviteCode = "invalid"
+	if err := c.createAccount("alice"); err == nil {
+		t.Fatal("createAccount with invalid invite code succeeded unexpectedly")
+	}
+	c.inviteCode = codes[0]
+	if err := c.createAccount("alice"); err != nil {
+		t.Fatalf("createAccount with invite code: %v", err)
+	}
+	if err := c.login(); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+
+	// Invite codes can only be used once.
+	c = newClient(sock)
+	c.inviteCode = codes[0]
+	if err := c.createAccount("bob"); err == nil {
+		t.Fatal("createAccount with used invite code succeeded unexpectedly")
+	}
+	ic, err := db.InviteCodes()
+	if err != nil {
+		t.Fatalf("db.InviteCodes: %v", err)
+	}
+	if want, got := "alice", ic[codes[0]].UsedBy; want != got {
+		t.Errorf("Unexpected UsedBy. Want %q, got %q", want, got)
+	}
+}
+
+func TestCreateAccountInviteCodeReleased(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	db := database.New(dir, nil)
+	sock, shutdown := startServerWithDB(t, db, func(s *server.Server) {
+		s.RequireInviteCode = true
+	})
+	defer shutdown()
+
+	codes, err := db.NewInviteCodes(1)
+	if err != nil {
+		t.Fatalf("db.NewInviteCodes: %v", err)
+	}
+
+	// Make AddUser fail by corrupting the user list.
+	userList := filepath.Join(dir, "metadata", "users.dat")
+	orig, err := os.ReadFile(userList)
+	if err != nil {
+		t.Fatalf("os.ReadFile: %v", err)
+	}
+	if err := os.WriteFile(userList, []byte("corrupt"), 0600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	c := newClient(sock)
+	c.inviteCode = codes[0]
+	if err := c.createAccount("alice"); err == nil {
+		t.Fatal("createAccount succeeded unexpectedly")
+	}
+	ic, err := db.InviteCodes()
+	if err != nil {
+		t.Fatalf("db.InviteCodes: %v", err)
+	}
+	if got := ic[codes[0]].UsedBy; got != "" {
+		t.Errorf("Invite code used by %q after failed createAccount", got)
+	}
+
+	if err := os.WriteFile(userList, orig, 0600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	if err := c.createAccount("alice"); err != nil {
+		t.Fatalf("createAccount with released invite code: %v", err)
+	}
+}
+
+func TestIPThrottle(t *testing.T) {
+	sock, shutdown := startServer(t, func(s *server.Server) {
+		s.IPThrottle = limit.NewIPThrottle(4, 2, time.Minute)
+		s.ClientIPHeader = "X-Forwarded-For"
+	})
+	defer shutdown()
+
+	alice := newClient(sock)
+	alice.headers = http.Header{"X-Forwarded-For": []string{"192.0.2.1"}}
+	if err := alice.createAccount("alice"); err != nil {
+		t.Fatalf("alice.createAccount: %v", err)
+	}
+	if err := alice.login(); err != nil {
+		t.Fatalf("alice.login: %v", err)
+	}
+
+	// Two failed logins get mallory banned.
+	mallory := newClient(sock)
+	mallory.headers = http.Header{"X-Forwarded-For": []string{"192.0.2.2"}}
+	mallory.email = "alice"
+	mallory.password = "WRONG"
+	for i := 0; i < 2; i++ {
+		var sr *stingle.Response
+		if err := mallory.login(); !errors.As(err, &sr) {
+			t.Fatalf("mallory.login: %v", err)
+		}
+	}
+	if err := mallory.preLogin(); err == nil || !strings.Contains(err.Error(), "429") {
+		t.Errorf("mallory.preLogin returned unexpected error: %v", err)
+	}
+
+	// Only the last address added by the proxy is used. Alice has 2
+	// requests left.
+	alice.headers = http.Header{"X-Forwarded-For": []string{"192.0.2.2, 192.0.2.1"}}
+	for i := 0; i < 2; i++ {
+		if err := alice.preLogin(); err != nil {
+			t.Fatalf("alice.preLogin: %v", err)
+		}
+	}
+	if err := alice.preLogin(); err == nil || !strings.Contains(err.Error(), "429") {
+		t.Errorf("alice.preLogin returned unexpected error: %v", err)
+	}
+}
+
+func TestIPThrottleOnlyCountsLoginFailures(t *testing.T) {
+	sock, shutdown := startServer(t, func(s *server.Server) {
+		s.IPThrottle = limit.NewIPThrottle(100, 2, time.Minute)
+	})
+	defer shutdown()
+
+	// The requests that aren't implemented by the server fail, but they
+	// don't get the client banned.
+	c := newClient(sock)
+	for i := 0; i < 2; i++ {
+		sr, err := c.sendRequest("/v2/sync/notImplemented", url.Values{})
+		if err != nil || sr.Status != "nok" {
+			t.Fatalf("sendRequest: %v %v", err, sr)
+		}
+	}
+	form := url.Values{}
+	form.Set("email", "foo")
+	if sr, err := c.sendRequest("/v2/login/preLogin", form); err != nil || sr.Status != "ok" {
+		t.Fatalf("preLogin failed: %v %v", err, sr)
+	}
+}
+
 func TestPreLoginFakeSalt(t *testing.T) {
 	sock, shutdown := startServer(t)
 	defer shutdown()
@@ -131,6 +292,9 @@ func (c *client) createAccount(email string) error {
 	form.Set("salt", c.salt)
 	form.Set("keyBundle", c.keyBundle)
 	form.Set("isBackup", c.isBackup)
+	if c.inviteCode != "" {
+		form.Set("inviteCode", c.inviteCode)
+	}
 
 	sr, err := c.sendRequest("/v2/register/createAccount", form)
 	if err != nil {
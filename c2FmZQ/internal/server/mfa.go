@@ -49,9 +49,10 @@ import (
 // Returns:
 //   - stingle.Response(ok)
 func (s *Server) handleEnableMFA(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
 	params, err := s.decodeParams(req.PostFormValue("params"), user)
 	if err != nil {
-		log.Errorf("decodeParams: %v", err)
+		logger.Errorf("decodeParams: %v", err)
 		return stingle.ResponseNOK()
 	}
 	requireMFA := params["requireMFA"] == "1"
@@ -72,7 +73,7 @@ func (s *Server) handleEnableMFA(user database.User, req *http.Request) *stingle
 		}
 		return nil
 	}); err != nil {
-		log.Errorf("MutateUser: %v", err)
+		logger.Errorf("MutateUser: %v", err)
 		return stingle.ResponseNOK()
 	}
 	resp := stingle.ResponseOK()
@@ -145,9 +146,10 @@ func (s *Server) tryRemoteMFA(ctx context.Context, user database.User) error {
 // Returns:
 //   - stingle.Response(ok)
 func (s *Server) handleApproveMFA(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
 	params, err := s.decodeParams(req.PostFormValue("params"), user)
 	if err != nil {
-		log.Errorf("decodeParams: %v", err)
+		logger.Errorf("decodeParams: %v", err)
 		return stingle.ResponseNOK()
 	}
 	session := params["session"]
@@ -163,6 +165,7 @@ func (s *Server) handleApproveMFA(user database.User, req *http.Request) *stingl
 }
 
 func (s *Server) requireMFA(user *database.User, req *http.Request, gracePeriod time.Duration) (*stingle.Response, bool) {
+	logger := log.FromContext(req.Context())
 	if _, passcode := parseOTP(req.PostFormValue("email")); passcode != "" {
 		if !validateOTP(user.OTPKey, passcode) {
 			return stingle.ResponseNOK(), false
@@ -182,7 +185,7 @@ func (s *Server) requireMFA(user *database.User, req *http.Request, gracePeriod
 		ctx := req.Context()
 		s.setDeadline(ctx, time.Now().Add(3*time.Minute))
 		if err := s.tryRemoteMFA(ctx, *user); err != nil {
-			log.Errorf("tryRemoteMFA: %v", err)
+			logger.Errorf("tryRemoteMFA: %v", err)
 			return stingle.ResponseNOK(), false
 		}
 		return nil, false
@@ -191,7 +194,7 @@ func (s *Server) requireMFA(user *database.User, req *http.Request, gracePeriod
 	if len(user.WebAuthnConfig.Keys) > 0 {
 		var err error
 		if opts, err = webauthn.NewAssertionOptions(); err != nil {
-			log.Errorf("webauthn.NewAssertionOptions: %v", err)
+			logger.Errorf("webauthn.NewAssertionOptions: %v", err)
 			return stingle.ResponseNOK(), false
 		}
 		if user.WebAuthnConfig.UsePasskey {
@@ -216,7 +219,7 @@ func (s *Server) requireMFA(user *database.User, req *http.Request, gracePeriod
 			*user = *u
 			return nil
 		}); err != nil {
-			log.Errorf("MutateUser: %v", err)
+			logger.Errorf("MutateUser: %v", err)
 			return stingle.ResponseNOK(), false
 		}
 	}
@@ -227,6 +230,7 @@ func (s *Server) requireMFA(user *database.User, req *http.Request, gracePeriod
 }
 
 func (s *Server) checkMFAResponse(user *database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
 	failResp := stingle.ResponseNOK().AddError("MFA failed")
 
 	var data struct {
@@ -240,12 +244,12 @@ func (s *Server) checkMFAResponse(user *database.User, req *http.Request) *sting
 		} `json:"webauthn"`
 	}
 	if err := json.Unmarshal([]byte(req.PostFormValue("mfa")), &data); err != nil {
-		log.Errorf("json.Unmarshal: %q %v", req.PostFormValue("mfa"), err)
+		logger.Errorf("json.Unmarshal: %q %v", req.PostFormValue("mfa"), err)
 		return failResp
 	}
 	if data.OTP != "" {
 		if !validateOTP(user.OTPKey, data.OTP) {
-			log.Info("checkMFAResponse: OTP check failed")
+			logger.Info("checkMFAResponse: OTP check failed")
 			return failResp
 		}
 		return nil
@@ -258,60 +262,60 @@ func (s *Server) checkMFAResponse(user *database.User, req *http.Request) *sting
 	// https://w3c.github.io/webauthn/#sctn-verifying-assertion
 	clientDataJSON, err := base64.RawURLEncoding.DecodeString(data.WebAuthn.ClientDataJSON)
 	if err != nil {
-		log.Errorf("data.WebAuthn.ClientDataJSON: %v", err)
+		logger.Errorf("data.WebAuthn.ClientDataJSON: %v", err)
 		return failResp
 	}
 	rawAuthData, err := base64.RawURLEncoding.DecodeString(data.WebAuthn.AuthenticatorData)
 	if err != nil {
-		log.Errorf("data.WebAuthn.AuthenticatorData: %v", err)
+		logger.Errorf("data.WebAuthn.AuthenticatorData: %v", err)
 		return failResp
 	}
 	sig, err := base64.RawURLEncoding.DecodeString(data.WebAuthn.Signature)
 	if err != nil {
-		log.Errorf("data.WebAuthn.Signature: %v", err)
+		logger.Errorf("data.WebAuthn.Signature: %v", err)
 		return failResp
 	}
 
 	cd, err := webauthn.ParseClientData(clientDataJSON)
 	if err != nil {
-		log.Errorf("webauthn.ParseClientData: %v", err)
+		logger.Errorf("webauthn.ParseClientData: %v", err)
 		return failResp
 	}
 	if cd.Type != "webauthn.get" {
-		log.Error("unexpected clientData.type")
+		logger.Error("unexpected clientData.type")
 		return failResp
 	}
 	var authData webauthn.AuthenticatorData
 	if err := webauthn.ParseAuthenticatorData(rawAuthData, &authData); err != nil {
-		log.Errorf("webauthn.ParseAuthenticatorData: %v", err)
+		logger.Errorf("webauthn.ParseAuthenticatorData: %v", err)
 		return failResp
 	}
 	if !authData.UserPresence {
-		log.Error("UserPresence is false")
+		logger.Error("UserPresence is false")
 		return failResp
 	}
 	if user.WebAuthnConfig.UsePasskey {
 		if !authData.UserVerification {
-			log.Error("UserVerification is false")
+			logger.Error("UserVerification is false")
 			return failResp
 		}
 		if data.WebAuthn.UserHandle != user.WebAuthnConfig.UserID {
-			log.Errorf("userHandle mismatch %q != %q", data.WebAuthn.UserHandle, user.WebAuthnConfig.UserID)
+			logger.Errorf("userHandle mismatch %q != %q", data.WebAuthn.UserHandle, user.WebAuthnConfig.UserID)
 			return failResp
 		}
 	}
 	creds, ok := user.WebAuthnConfig.Keys[data.WebAuthn.ID]
 	if !ok {
-		log.Errorf("Unknown key %q", data.WebAuthn.ID)
+		logger.Errorf("Unknown key %q", data.WebAuthn.ID)
 		return failResp
 	}
 	if authData.RPIDHash != creds.RPIDHash {
-		log.Error("rpIdHash mismatch")
+		logger.Error("rpIdHash mismatch")
 		return failResp
 	}
 	if (authData.SignCount > 0 || creds.SignCount > 0) && authData.SignCount <= creds.SignCount {
 		// Log it, but don't fail.
-		log.Infof("SignCount: %d <= %d", authData.SignCount, creds.SignCount)
+		logger.Infof("SignCount: %d <= %d", authData.SignCount, creds.SignCount)
 	}
 	if err := s.db.MutateUser(user.UserID, func(u *database.User) error {
 		if !u.WebAuthnConfig.CheckChallenge(cd.Challenge) {
@@ -339,7 +343,7 @@ func (s *Server) checkMFAResponse(user *database.User, req *http.Request) *sting
 		*user = *u
 		return nil
 	}); err != nil {
-		log.Errorf("MutateUser: %v", err)
+		logger.Errorf("MutateUser: %v", err)
 		return failResp
 	}
 	return nil
@@ -354,9 +358,10 @@ func (s *Server) checkMFAResponse(user *database.User, req *http.Request) *sting
 // Returns:
 //   - stingle.Response(ok)
 func (s *Server) handleMFACheck(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
 	params, err := s.decodeParams(req.PostFormValue("params"), user)
 	if err != nil {
-		log.Errorf("decodeParams: %v", err)
+		logger.Errorf("decodeParams: %v", err)
 		return stingle.ResponseNOK()
 	}
 	user.WebAuthnConfig.UsePasskey = params["passKey"] == "1"
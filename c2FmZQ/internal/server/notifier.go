@@ -0,0 +1,129 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"c2FmZQ/internal/log"
+)
+
+// Notifier sends notifications to the users outside of the app, e.g. by
+// email. All the notifications are optional. The server works without them.
+type Notifier interface {
+	// SendPasswordReset sends a password reset token to a user.
+	SendPasswordReset(ctx context.Context, to, token string, ttl time.Duration) error
+	// SendShareInvite tells a user that an album was shared with them.
+	SendShareInvite(ctx context.Context, to, from string) error
+}
+
+// notifier returns the server's Notifier, or one that does nothing if it
+// isn't set.
+func (s *Server) notifier() Notifier {
+	if s.Notifier == nil {
+		return nopNotifier{}
+	}
+	return s.Notifier
+}
+
+// nopNotifier is a Notifier that doesn't send anything.
+type nopNotifier struct{}
+
+func (nopNotifier) SendPasswordReset(context.Context, string, string, time.Duration) error {
+	return nil
+}
+
+func (nopNotifier) SendShareInvite(context.Context, string, string) error {
+	return nil
+}
+
+// EmailNotifier is a Notifier that sends the notifications by email.
+type EmailNotifier struct {
+	Sender EmailSender
+}
+
+// SendPasswordReset sends a password reset token by email.
+func (n EmailNotifier) SendPasswordReset(ctx context.Context, to, token string, ttl time.Duration) error {
+	body := fmt.Sprintf("A password reset was requested for your account.\n\n"+
+		"Reset token: %s\n\n"+
+		"The token expires in %s. Resetting the password requires your secret key, "+
+		"i.e. your backup phrase, or a device where you are still logged in.\n\n"+
+		"If you didn't request this, you can ignore this message.\n", token, ttl)
+	return n.Sender.SendEmail(ctx, to, "Password reset", body)
+}
+
+// SendShareInvite tells a user by email that an album was shared with them.
+// The album's name is encrypted. So, it can't be included.
+func (n EmailNotifier) SendShareInvite(ctx context.Context, to, from string) error {
+	body := fmt.Sprintf("%s shared an album with you.\n\n"+
+		"Open your app to see it. If you don't have an account yet, create one "+
+		"with this email address.\n", from)
+	return n.Sender.SendEmail(ctx, to, "New shared album", body)
+}
+
+// EmailSender sends emails to the users.
+type EmailSender interface {
+	SendEmail(ctx context.Context, to, subject, body string) error
+}
+
+// LogEmailSender is an EmailSender that writes the emails to the server log
+// instead of sending them. It is meant for self-hosted servers without an
+// email service, where the administrator relays the messages to the users.
+type LogEmailSender struct{}
+
+// SendEmail logs the email.
+func (LogEmailSender) SendEmail(ctx context.Context, to, subject, body string) error {
+	log.FromContext(ctx).With("to", to, "subject", subject).Infof("EMAIL\n%s", body)
+	return nil
+}
+
+// SMTPEmailSender is an EmailSender that sends the emails with SMTP. The
+// connection uses STARTTLS when the server supports it.
+type SMTPEmailSender struct {
+	// The address of the SMTP server, host:port.
+	Addr string
+	// The username and password, if the SMTP server requires
+	// authentication.
+	Username string
+	Password string
+	// The sender's email address.
+	From string
+}
+
+// SendEmail sends an email with SMTP.
+func (s SMTPEmailSender) SendEmail(ctx context.Context, to, subject, body string) error {
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return fmt.Errorf("invalid email header")
+	}
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s",
+		s.From, to, subject, time.Now().Format(time.RFC1123Z), strings.ReplaceAll(body, "\n", "\r\n"))
+	return smtp.SendMail(s.Addr, auth, s.From, []string{to}, []byte(msg))
+}
@@ -0,0 +1,131 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server_test
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"c2FmZQ/internal/server"
+	"c2FmZQ/internal/stingle"
+)
+
+// fakeEmailSender is an EmailSender that keeps the emails in memory.
+type fakeEmailSender struct {
+	mu     sync.Mutex
+	emails map[string][]string
+}
+
+func (s *fakeEmailSender) SendEmail(_ context.Context, to, _, body string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.emails == nil {
+		s.emails = make(map[string][]string)
+	}
+	s.emails[to] = append(s.emails[to], body)
+	return nil
+}
+
+func (s *fakeEmailSender) received(to string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.emails[to]...)
+}
+
+// resetToken returns the token from the last password reset email sent to
+// to.
+func (s *fakeEmailSender) resetToken(to string) string {
+	emails := s.received(to)
+	if len(emails) == 0 {
+		return ""
+	}
+	m := regexp.MustCompile(`Reset token: (\S+)`).FindStringSubmatch(emails[len(emails)-1])
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// waitForEmails waits until n emails were sent to to. The share invites are
+// sent in the background.
+func (s *fakeEmailSender) waitForEmails(t *testing.T, to string, n int) []string {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if emails := s.received(to); len(emails) >= n {
+			return emails
+		}
+	}
+	t.Fatalf("Timed out waiting for %d emails to %s", n, to)
+	return nil
+}
+
+func TestShareInvite(t *testing.T) {
+	sender := &fakeEmailSender{}
+	sock, shutdown := startServer(t, func(s *server.Server) {
+		s.Notifier = server.EmailNotifier{Sender: sender}
+	})
+	defer shutdown()
+
+	alice, bob, carol, err := createAccountsAndLogin(sock)
+	if err != nil {
+		t.Fatalf("createAccountsAndLogin failed: %v", err)
+	}
+	if err := alice.addAlbum("album", 1000); err != nil {
+		t.Fatalf("alice.addAlbum failed: %v", err)
+	}
+	if err := alice.shareAlbum(stingle.Album{
+		AlbumID:     "album",
+		Permissions: "1111",
+		Members:     membersString(alice.userID, bob.userID),
+		SharingKeys: map[string]string{
+			fmt.Sprintf("%d", bob.userID): "Bob's Sharing Key",
+		},
+	}); err != nil {
+		t.Fatalf("alice.shareAlbum failed: %v", err)
+	}
+	emails := sender.waitForEmails(t, "bob", 1)
+	if !strings.Contains(emails[0], "alice shared an album with you") {
+		t.Errorf("Unexpected email to bob: %q", emails[0])
+	}
+
+	// Only the new members are notified.
+	if err := bob.shareAlbum(stingle.Album{
+		AlbumID:     "album",
+		Permissions: "1111",
+		Members:     membersString(alice.userID, bob.userID, carol.userID),
+		SharingKeys: map[string]string{
+			fmt.Sprintf("%d", carol.userID): "Carol's Sharing Key",
+		},
+	}); err != nil {
+		t.Fatalf("bob.shareAlbum failed: %v", err)
+	}
+	emails = sender.waitForEmails(t, "carol", 1)
+	if !strings.Contains(emails[0], "bob shared an album with you") {
+		t.Errorf("Unexpected email to carol: %q", emails[0])
+	}
+	if n := len(sender.received("bob")); n != 1 {
+		t.Errorf("Unexpected number of emails to bob: want 1, got %d", n)
+	}
+	if n := len(sender.received("alice")); n != 0 {
+		t.Errorf("Unexpected number of emails to alice: want 0, got %d", n)
+	}
+}
@@ -46,22 +46,23 @@ import (
 //     Parts("key", OTP key)
 //     Parts("img", base64-encoded QR code image)
 func (s *Server) handleGenerateOTP(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
 	key, err := totp.Generate(totp.GenerateOpts{
 		Issuer:      req.Host,
 		AccountName: user.Email,
 	})
 	if err != nil {
-		log.Errorf("totp.Generate: %v", err)
+		logger.Errorf("totp.Generate: %v", err)
 		return stingle.ResponseNOK()
 	}
 	img, err := key.Image(200, 200)
 	if err != nil {
-		log.Errorf("key.Image: %v", err)
+		logger.Errorf("key.Image: %v", err)
 		return stingle.ResponseNOK()
 	}
 	var buf bytes.Buffer
 	if err := png.Encode(&buf, img); err != nil {
-		log.Errorf("png.Encode: %v", err)
+		logger.Errorf("png.Encode: %v", err)
 		return stingle.ResponseNOK()
 	}
 
@@ -85,9 +86,10 @@ func (s *Server) handleGenerateOTP(user database.User, req *http.Request) *sting
 // Returns:
 //   - stingle.Response(ok)
 func (s *Server) handleSetOTP(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
 	params, err := s.decodeParams(req.PostFormValue("params"), user)
 	if err != nil {
-		log.Errorf("decodeParams: %v", err)
+		logger.Errorf("decodeParams: %v", err)
 		return stingle.ResponseNOK()
 	}
 	key := params["key"]
@@ -104,7 +106,7 @@ func (s *Server) handleSetOTP(user database.User, req *http.Request) *stingle.Re
 		}
 		return nil
 	}); err != nil {
-		log.Errorf("MutateUser: %v", err)
+		logger.Errorf("MutateUser: %v", err)
 		return stingle.ResponseNOK()
 	}
 	resp := stingle.ResponseOK()
@@ -0,0 +1,173 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"time"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/log"
+	"c2FmZQ/internal/stingle"
+)
+
+const (
+	// Password reset tokens are good for 1 hour.
+	passwordResetTokenDuration = time.Hour
+)
+
+// handleRequestPasswordReset handles the /v2x/login/requestPasswordReset
+// endpoint. It sends a password reset token to the user with the server's
+// Notifier. This is a c2FmZQ extension.
+//
+// The response is the same whether the account exists or not.
+//
+// Arguments:
+//   - req: The http request.
+//
+// Form arguments:
+//   - email: The email address of the account.
+//
+// Returns:
+//   - stingle.Response(ok)
+func (s *Server) handleRequestPasswordReset(req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
+	defer time.Sleep(time.Duration(time.Now().UnixNano()%200) * time.Millisecond)
+	if !s.EnablePasswordReset {
+		return stingle.ResponseNOK().AddError("Password reset is not enabled on this server")
+	}
+	resp := stingle.ResponseOK().AddInfo("If the account exists, a password reset token was sent to its email address")
+	email := req.PostFormValue("email")
+	user, err := s.db.User(email)
+	if err != nil || user.LoginDisabled {
+		return resp
+	}
+	// Errors are only logged. Otherwise, the response would reveal that
+	// the account exists.
+	tok, err := s.db.NewPasswordResetToken(user.UserID, passwordResetTokenDuration)
+	if err != nil {
+		logger.Errorf("NewPasswordResetToken: %v", err)
+		return resp
+	}
+	if err := s.notifier().SendPasswordReset(req.Context(), user.Email, tok, passwordResetTokenDuration); err != nil {
+		logger.Errorf("SendPasswordReset: %v", err)
+	}
+	return resp
+}
+
+// handleResetPassword handles the /v2x/login/resetPassword endpoint. It
+// consumes a password reset token and replaces the user's password and key
+// bundle. This is a c2FmZQ extension.
+//
+// The account keys are protected by the password. So, the server can't reset
+// them on its own. The user must still hold their secret key, e.g. from the
+// backup phrase, to encrypt the params and to create the new key bundle. The
+// new key bundle must have the same public key as before, otherwise the
+// user's existing files would become unreadable.
+//
+// Arguments:
+//   - req: The http request.
+//
+// Form arguments:
+//   - resetToken: The token that was sent by email.
+//   - params - Encrypted parameters:
+//   - newPassword: The new hashed password.
+//   - newSalt: The salt used to hash the new password.
+//   - keyBundle: The new keyBundle.
+//
+// Returns:
+//   - stingle.Response(ok)
+//     Part(result, OK)
+func (s *Server) handleResetPassword(req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
+	defer time.Sleep(time.Duration(time.Now().UnixNano()%200) * time.Millisecond)
+	if !s.EnablePasswordReset {
+		return stingle.ResponseNOK().AddError("Password reset is not enabled on this server")
+	}
+	resetToken := req.PostFormValue("resetToken")
+	userID, err := s.db.PasswordResetTokenUser(resetToken)
+	if errors.Is(err, database.ErrInvalidResetToken) {
+		return stingle.ResponseNOK().AddError("Invalid or expired reset token")
+	}
+	if err != nil {
+		logger.Errorf("PasswordResetTokenUser: %v", err)
+		return stingle.ResponseNOK()
+	}
+	user, err := s.db.UserByID(userID)
+	if err != nil {
+		logger.Errorf("UserByID(%d): %v", userID, err)
+		return stingle.ResponseNOK()
+	}
+	if user.LoginDisabled {
+		return stingle.ResponseNOK()
+	}
+	if user.RequireMFA {
+		resp, _ := s.requireMFA(&user, req, time.Duration(0))
+		if resp != nil {
+			return resp
+		}
+	}
+	params, err := s.decodeParams(req.PostFormValue("params"), user)
+	if err != nil {
+		logger.Errorf("decodeParams: %v", err)
+		return stingle.ResponseNOK()
+	}
+	pk, hasSK, err := stingle.DecodeKeyBundle(params["keyBundle"])
+	if err != nil {
+		logger.Errorf("DecodeKeyBundle: %v", err)
+		return stingle.ResponseNOK()
+	}
+	if pk != user.PublicKey {
+		return stingle.ResponseNOK().AddError("The key bundle doesn't match the account's public key")
+	}
+	// The token is only consumed after the request is validated, so that it
+	// can be retried, e.g. after MFA.
+	if id, err := s.db.ConsumePasswordResetToken(resetToken); err != nil || id != user.UserID {
+		logger.Errorf("ConsumePasswordResetToken: %v", err)
+		return stingle.ResponseNOK().AddError("Invalid or expired reset token")
+	}
+
+	if err := s.db.MutateUser(user.UserID, func(user *database.User) error {
+		hashed, err := bcryptGen([]byte(params["newPassword"]), 12)
+		if err != nil {
+			return err
+		}
+		user.HashedPassword = base64.StdEncoding.EncodeToString(hashed)
+		user.Salt = params["newSalt"]
+		user.KeyBundle = params["keyBundle"]
+		etk, err := s.db.NewEncryptedTokenKey()
+		if err != nil {
+			return err
+		}
+		user.TokenKey = etk
+		user.OldTokenKeys = nil
+		user.ValidTokens = nil
+		if hasSK {
+			user.IsBackup = "1"
+		} else {
+			user.IsBackup = "0"
+		}
+		return nil
+	}); err != nil {
+		logger.Errorf("MutateUser: %v", err)
+		return stingle.ResponseNOK()
+	}
+	return stingle.ResponseOK().AddPart("result", "OK")
+}
@@ -0,0 +1,161 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"testing"
+
+	"c2FmZQ/internal/server"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestPasswordReset(t *testing.T) {
+	sender := &fakeEmailSender{}
+	sock, shutdown := startServer(t, func(s *server.Server) {
+		s.EnablePasswordReset = true
+		s.Notifier = server.EmailNotifier{Sender: sender}
+	})
+	defer shutdown()
+
+	c, err := createAccountAndLogin(sock, "alice@")
+	if err != nil {
+		t.Fatalf("createAccountAndLogin failed: %v", err)
+	}
+	if err := c.requestPasswordReset("bob@"); err != nil {
+		t.Fatalf("c.requestPasswordReset(bob@) failed: %v", err)
+	}
+	if tok := sender.resetToken("bob@"); tok != "" {
+		t.Errorf("Unexpected reset token for bob@: %q", tok)
+	}
+	if err := c.requestPasswordReset("alice@"); err != nil {
+		t.Fatalf("c.requestPasswordReset(alice@) failed: %v", err)
+	}
+	tok := sender.resetToken("alice@")
+	if tok == "" {
+		t.Fatal("No reset token for alice@")
+	}
+
+	if err := c.resetPassword("BadToken", c.secretKey); err == nil {
+		t.Error("c.resetPassword(BadToken) should have failed but succeeded")
+	}
+	// Without the secret key, the reset fails, but the token isn't
+	// consumed.
+	if err := c.resetPassword(tok, stingle.MakeSecretKeyForTest()); err == nil {
+		t.Error("c.resetPassword with wrong key should have failed but succeeded")
+	}
+	if err := c.resetPassword(tok, c.secretKey); err != nil {
+		t.Fatalf("c.resetPassword failed: %v", err)
+	}
+	if err := c.resetPassword(tok, c.secretKey); err == nil {
+		t.Error("c.resetPassword with used token should have failed but succeeded")
+	}
+
+	// The old session is no longer valid.
+	if _, err := c.accountUsage(); err == nil {
+		t.Error("c.accountUsage with old token should have failed but succeeded")
+	}
+	c.password = "PASSWORD"
+	if err := c.login(); err == nil {
+		t.Error("c.login with old password should have failed but succeeded")
+	}
+	c.password = "NEWPASSWORD"
+	if err := c.login(); err != nil {
+		t.Errorf("c.login with new password failed: %v", err)
+	}
+}
+
+func TestPasswordResetDisabled(t *testing.T) {
+	sock, shutdown := startServer(t)
+	defer shutdown()
+
+	c, err := createAccountAndLogin(sock, "alice@")
+	if err != nil {
+		t.Fatalf("createAccountAndLogin failed: %v", err)
+	}
+	if err := c.requestPasswordReset("alice@"); err == nil {
+		t.Error("c.requestPasswordReset should have failed but succeeded")
+	}
+}
+
+func TestPasswordResetNotifierError(t *testing.T) {
+	sock, shutdown := startServer(t, func(s *server.Server) {
+		s.EnablePasswordReset = true
+		s.Notifier = server.EmailNotifier{Sender: failingEmailSender{}}
+	})
+	defer shutdown()
+
+	c, err := createAccountAndLogin(sock, "alice@")
+	if err != nil {
+		t.Fatalf("createAccountAndLogin failed: %v", err)
+	}
+	// The response is the same whether the account exists or not.
+	for _, email := range []string{"alice@", "bob@"} {
+		if err := c.requestPasswordReset(email); err != nil {
+			t.Errorf("c.requestPasswordReset(%s) failed: %v", email, err)
+		}
+	}
+}
+
+type failingEmailSender struct{}
+
+func (failingEmailSender) SendEmail(context.Context, string, string, string) error {
+	return errors.New("no email for you")
+}
+
+func (c *client) requestPasswordReset(email string) error {
+	form := url.Values{}
+	form.Set("email", email)
+
+	sr, err := c.sendRequest("/v2x/login/requestPasswordReset", form)
+	if err != nil {
+		return err
+	}
+	if sr.Status != "ok" {
+		return sr
+	}
+	return nil
+}
+
+// resetPassword resets the password with resetToken. The params are encrypted
+// with sk, which must be the user's secret key.
+func (c *client) resetPassword(resetToken string, sk *stingle.SecretKey) error {
+	params := make(map[string]string)
+	params["newPassword"] = "NEWPASSWORD"
+	params["newSalt"] = c.salt
+	params["keyBundle"] = c.keyBundle
+
+	form := url.Values{}
+	form.Set("resetToken", resetToken)
+	form.Set("params", (&client{secretKey: sk, serverPublicKey: c.serverPublicKey}).encodeParams(params))
+
+	sr, err := c.sendRequest("/v2x/login/resetPassword", form)
+	if err != nil {
+		return err
+	}
+	if sr.Status != "ok" {
+		return sr
+	}
+	if want, got := "OK", sr.Part("result"); want != got {
+		return fmt.Errorf("resetPassword: unexpected result: want %v, got %v", want, got)
+	}
+	return nil
+}
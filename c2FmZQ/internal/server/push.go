@@ -37,13 +37,14 @@ import (
 // Returns:
 //   - stingle.Response(ok)
 func (s *Server) handlePush(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
 	var ep string
 	var auth string
 	var p256dh string
 	if v := req.PostFormValue("params"); v != "" {
 		params, err := s.decodeParams(v, user)
 		if err != nil {
-			log.Errorf("decodeParams: %v", err)
+			logger.Errorf("decodeParams: %v", err)
 			return stingle.ResponseNOK()
 		}
 		ep = params["endpoint"]
@@ -59,7 +60,7 @@ func (s *Server) handlePush(user database.User, req *http.Request) *stingle.Resp
 		if pc := u.PushConfig; pc == nil {
 			pc, err := database.NewPushConfig()
 			if err != nil {
-				log.Errorf("NewPushConfig: %v", err)
+				logger.Errorf("NewPushConfig: %v", err)
 				return err
 			}
 			u.PushConfig = pc
@@ -78,7 +79,7 @@ func (s *Server) handlePush(user database.User, req *http.Request) *stingle.Resp
 					P256dh: p256dh,
 				}
 				if err := s.db.TestPushEndpoint(*u, ep); err != nil {
-					log.Errorf("TestPushEndpoint: %v", err)
+					logger.Errorf("TestPushEndpoint: %v", err)
 					return err
 				}
 			}
@@ -86,7 +87,7 @@ func (s *Server) handlePush(user database.User, req *http.Request) *stingle.Resp
 		user = *u
 		return nil
 	}); err != nil {
-		log.Errorf("MutateUser: %v", err)
+		logger.Errorf("MutateUser: %v", err)
 		return stingle.ResponseNOK()
 	}
 	return stingle.ResponseOK().
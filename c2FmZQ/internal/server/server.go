@@ -21,8 +21,12 @@ package server
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"math"
 	"net"
 	"net/http"
 	"path/filepath"
@@ -85,6 +89,13 @@ var (
 		},
 		[]string{"code"},
 	)
+	reqUserAgent = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "server_requests_by_user_agent_total",
+			Help: "Number of requests, by client software",
+		},
+		[]string{"agent"},
+	)
 
 	startTime time.Time
 )
@@ -96,6 +107,7 @@ func init() {
 	prometheus.MustRegister(reqStatus)
 	prometheus.MustRegister(reqSize)
 	prometheus.MustRegister(respSize)
+	prometheus.MustRegister(reqUserAgent)
 }
 
 // An HTTP server that implements the Stingle server API.
@@ -106,17 +118,59 @@ type Server struct {
 	Redirect404            string
 	MaxConcurrentRequests  int
 	EnableWebApp           bool
-	mux                    *http.ServeMux
-	srv                    *http.Server
-	db                     *database.Database
-	addr                   string
-	basicAuth              *basicauth.BasicAuth
-	pathPrefix             string
-	preLoginCache          *lru.Cache
-	checkKeyCache          *lru.Cache
+	// When true, new accounts can only be created with a valid invite
+	// code. Each code can only be used once.
+	RequireInviteCode bool
+	// When true, all the authenticated requests must be signed. This is
+	// a c2FmZQ extension that the Stingle app doesn't support.
+	RequireSignedRequests bool
+	// When true, the users can reset their password with a token that is
+	// sent by the Notifier.
+	EnablePasswordReset bool
+	// Used to send notifications to the users, e.g. by email. Optional.
+	Notifier Notifier
+	// Limits the rate of unauthenticated requests from each client IP
+	// address, and temporarily bans the addresses that make too many
+	// failed requests. Optional.
+	IPThrottle *limit.IPThrottle
+	// The HTTP header, e.g. X-Forwarded-For, that contains the client's IP
+	// address when the server is behind a trusted reverse proxy. When empty,
+	// the remote address of the connection is used.
+	ClientIPHeader string
+	// The HTTP headers, e.g. X-Forwarded-Host and X-Forwarded-Proto, that
+	// contain the host name and the scheme that the clients used when the
+	// server is behind a trusted reverse proxy. They are used to create
+	// the download URLs when BaseURL is empty. When empty, the Host header
+	// and https are used.
+	ForwardedHostHeader  string
+	ForwardedProtoHeader string
+	// When true, the number of requests is exported for each client
+	// software, e.g. c2FmZQ-client/v0.4.10 or Dalvik/2.1.0, as identified
+	// by the User-Agent header. The clients choose the values, which could
+	// add many metrics.
+	UserAgentMetrics bool
+	// The origins, e.g. https://c2fmzq.org, of the browser-based clients
+	// that are allowed to call the API from a different origin. The value
+	// "*" allows all origins. When empty, cross-origin requests are
+	// refused.
+	AllowedOrigins []string
+
+	mux           *http.ServeMux
+	srv           *http.Server
+	db            *database.Database
+	addr          string
+	basicAuth     *basicauth.BasicAuth
+	pathPrefix    string
+	preLoginCache *lru.Cache
+	checkKeyCache *lru.Cache
+
+	inviteLimitersMutex sync.Mutex
+	inviteLimiters      *lru.Cache
 
 	remoteMFAMutex sync.Mutex
 	remoteMFA      map[string]remoteMFAReq
+
+	nonces nonceSet
 }
 
 type remoteMFAReq struct {
@@ -125,6 +179,8 @@ type remoteMFAReq struct {
 }
 
 // New returns an instance of Server that's fully initialized and ready to run.
+// The server listens on addr, which can be a comma-separated list of
+// addresses.
 func New(db *database.Database, addr, htdigest, pathPrefix string) *Server {
 	s := &Server{
 		MaxConcurrentRequests: 5,
@@ -143,6 +199,10 @@ func New(db *database.Database, addr, htdigest, pathPrefix string) *Server {
 		log.Fatalf("lru.New: %v", err)
 	}
 	s.checkKeyCache = cache
+	if cache, err = lru.New(1000); err != nil {
+		log.Fatalf("lru.New: %v", err)
+	}
+	s.inviteLimiters = cache
 	if htdigest != "" {
 		var err error
 		if s.basicAuth, err = basicauth.New(htdigest); err != nil {
@@ -180,20 +240,22 @@ func New(db *database.Database, addr, htdigest, pathPrefix string) *Server {
 	})
 
 	s.mux.HandleFunc(pathPrefix+"/v2/", s.noauth(s.handleNotImplemented))
-	s.mux.HandleFunc(pathPrefix+"/v2/register/createAccount", s.noauth(s.handleCreateAccount))
+	s.mux.HandleFunc(pathPrefix+"/v2/register/createAccount", s.noauth(s.countFailures(s.handleCreateAccount)))
 	s.mux.HandleFunc(pathPrefix+"/v2/login/preLogin", s.noauth(s.handlePreLogin))
-	s.mux.HandleFunc(pathPrefix+"/v2/login/login", s.noauth(s.handleLogin))
+	s.mux.HandleFunc(pathPrefix+"/v2/login/login", s.noauth(s.countFailures(s.handleLogin)))
 	s.mux.HandleFunc(pathPrefix+"/v2/login/logout", s.auth(s.handleLogout))
 	s.mux.HandleFunc(pathPrefix+"/v2/login/changePass", s.authMFA(time.Minute, s.handleChangePass))
-	s.mux.HandleFunc(pathPrefix+"/v2/login/checkKey", s.noauth(s.handleCheckKey))
-	s.mux.HandleFunc(pathPrefix+"/v2/login/recoverAccount", s.noauth(s.handleRecoverAccount))
+	s.mux.HandleFunc(pathPrefix+"/v2/login/checkKey", s.noauth(s.countFailures(s.handleCheckKey)))
+	s.mux.HandleFunc(pathPrefix+"/v2/login/recoverAccount", s.noauth(s.countFailures(s.handleRecoverAccount)))
 	s.mux.HandleFunc(pathPrefix+"/v2/login/deleteUser", s.authMFA(time.Duration(0), s.handleDeleteUser))
 	s.mux.HandleFunc(pathPrefix+"/v2/login/changeEmail", s.authMFA(time.Minute, s.handleChangeEmail))
+	s.mux.HandleFunc(pathPrefix+"/v2/account/usage", s.auth(s.handleAccountUsage))
 	s.mux.HandleFunc(pathPrefix+"/v2/keys/getServerPK", s.auth(s.handleGetServerPK))
 	s.mux.HandleFunc(pathPrefix+"/v2/keys/reuploadKeys", s.authMFA(time.Duration(0), s.handleReuploadKeys))
 
 	s.mux.HandleFunc(pathPrefix+"/v2/sync/getUpdates", s.auth(s.handleGetUpdates))
 	s.mux.HandleFunc(pathPrefix+"/v2/sync/upload", s.method("POST", s.handleUpload))
+	s.mux.HandleFunc(pathPrefix+"/v2/sync/uploadBatch", s.method("POST", s.handleUploadBatch))
 	s.mux.HandleFunc(pathPrefix+"/v2/sync/moveFile", s.auth(s.handleMoveFile))
 	s.mux.HandleFunc(pathPrefix+"/v2/sync/emptyTrash", s.auth(s.handleEmptyTrash))
 	s.mux.HandleFunc(pathPrefix+"/v2/sync/delete", s.auth(s.handleDelete))
@@ -201,6 +263,7 @@ func New(db *database.Database, addr, htdigest, pathPrefix string) *Server {
 	s.mux.HandleFunc(pathPrefix+"/v2/download/", s.method("GET", s.handleTokenDownload))
 	s.mux.HandleFunc(pathPrefix+"/v2/sync/getDownloadUrls", s.auth(s.handleGetDownloadUrls))
 	s.mux.HandleFunc(pathPrefix+"/v2/sync/getUrl", s.auth(s.handleGetURL))
+	s.mux.HandleFunc(pathPrefix+"/v2/sync/getFile", s.auth(s.handleGetFile))
 
 	s.mux.HandleFunc(pathPrefix+"/v2/sync/addAlbum", s.auth(s.handleAddAlbum))
 	s.mux.HandleFunc(pathPrefix+"/v2/sync/deleteAlbum", s.auth(s.handleDeleteAlbum))
@@ -212,6 +275,13 @@ func New(db *database.Database, addr, htdigest, pathPrefix string) *Server {
 	s.mux.HandleFunc(pathPrefix+"/v2/sync/removeAlbumMember", s.auth(s.handleRemoveAlbumMember))
 	s.mux.HandleFunc(pathPrefix+"/v2/sync/unshareAlbum", s.auth(s.handleUnshareAlbum))
 	s.mux.HandleFunc(pathPrefix+"/v2/sync/leaveAlbum", s.auth(s.handleLeaveAlbum))
+	s.mux.HandleFunc(pathPrefix+"/v2/albums/list", s.auth(s.handleListAlbums))
+
+	s.mux.HandleFunc(pathPrefix+"/v2x/sync/invite", s.auth(s.handleInvite))
+	s.mux.HandleFunc(pathPrefix+"/v2x/sync/pendingShares", s.auth(s.handlePendingShares))
+	s.mux.HandleFunc(pathPrefix+"/v2x/sync/rotateAlbumKey", s.auth(s.handleRotateAlbumKey))
+	s.mux.HandleFunc(pathPrefix+"/v2x/login/requestPasswordReset", s.noauth(s.handleRequestPasswordReset))
+	s.mux.HandleFunc(pathPrefix+"/v2x/login/resetPassword", s.noauth(s.handleResetPassword))
 
 	s.mux.HandleFunc(pathPrefix+"/v2x/config/generateOTP", s.auth(s.handleGenerateOTP))
 	s.mux.HandleFunc(pathPrefix+"/v2x/config/setOTP", s.authMFA(time.Minute, s.handleSetOTP))
@@ -229,15 +299,85 @@ func New(db *database.Database, addr, htdigest, pathPrefix string) *Server {
 	return s
 }
 
+// compressibleContentTypes are the content types of the responses that are
+// compressed with gzip. The file downloads are application/octet-stream. They
+// are already encrypted and wouldn't benefit from compression.
+var compressibleContentTypes = []string{
+	"application/javascript",
+	"application/json",
+	"application/manifest+json",
+	"image/svg+xml",
+	"text/css",
+	"text/html",
+	"text/javascript",
+	"text/plain",
+}
+
 func (s *Server) wrapHandler() http.Handler {
 	handler := http.Handler(s.mux)
-	handler = gziphandler.GzipHandler(handler)
+	handler = s.withUserAgent(handler)
+	handler = withRequestID(handler)
+	gz, err := gziphandler.GzipHandlerWithOpts(gziphandler.ContentTypes(compressibleContentTypes))
+	if err != nil {
+		log.Fatalf("gziphandler: %v", err)
+	}
+	handler = gz(handler)
 	handler = limit.New(s.MaxConcurrentRequests, handler)
 	handler = promhttp.InstrumentHandlerRequestSize(reqSize, handler)
 	handler = promhttp.InstrumentHandlerResponseSize(respSize, handler)
 	return handler
 }
 
+// withRequestID attaches a Logger with a unique request ID to the context of
+// every request, so that all the log messages of a request can be correlated.
+// The request ID is also returned in the X-Request-Id response header.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			log.Errorf("rand.Read: %v", err)
+		}
+		id := hex.EncodeToString(b)
+		w.Header().Set("X-Request-Id", id)
+		ctx := log.NewContext(req.Context(), log.With("reqId", id))
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// withUserAgent adds the client software that sent the request, as identified
+// by the User-Agent header, to the request's Logger, and counts the requests by
+// client software when UserAgentMetrics is true.
+func (s *Server) withUserAgent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		agent := userAgentProduct(req.Header.Get("User-Agent"))
+		if s.UserAgentMetrics {
+			reqUserAgent.WithLabelValues(agent).Inc()
+		}
+		ctx := log.NewContext(req.Context(), log.FromContext(req.Context()).With("agent", agent))
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// userAgentProduct returns the first product of a User-Agent header, e.g.
+// Dalvik/2.1.0 for "Dalvik/2.1.0 (Linux; U; Android 9)". Unexpected
+// characters are removed, and the result is truncated to 64 characters.
+func userAgentProduct(ua string) string {
+	product, _, _ := strings.Cut(strings.TrimSpace(ua), " ")
+	product = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("._/+-", r) {
+			return r
+		}
+		return -1
+	}, product)
+	if len(product) > 64 {
+		product = product[:64]
+	}
+	if product == "" {
+		return "unknown"
+	}
+	return product
+}
+
 func (s *Server) httpServer() *http.Server {
 	s.srv = &http.Server{
 		Addr:              s.addr,
@@ -256,16 +396,75 @@ func (s *Server) httpServer() *http.Server {
 	return s.srv
 }
 
-// Run runs the HTTP server on the configured address.
+// listen returns a listener for each of the server's addresses, which are
+// separated by commas, e.g. 127.0.0.1:8080,[::1]:8080. An address without a
+// host, e.g. :8080, listens on all the interfaces, IPv4 and IPv6. When there
+// is no address, defaultAddr is used.
+func (s *Server) listen(defaultAddr string) ([]net.Listener, error) {
+	var addrs []string
+	for _, addr := range strings.Split(s.addr, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		addrs = []string{defaultAddr}
+	}
+	var listeners []net.Listener
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+	for _, addr := range addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			closeAll()
+			return nil, fmt.Errorf("invalid address %q, IPv6 addresses must be in brackets, e.g. [::1]:8080: %w", addr, err)
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		log.Infof("Listening on %s", l.Addr())
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// serveAll calls serve with each listener concurrently, and returns the first
+// error, e.g. http.ErrServerClosed after Shutdown.
+func serveAll(listeners []net.Listener, serve func(net.Listener) error) error {
+	ch := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func() {
+			ch <- serve(l)
+		}()
+	}
+	return <-ch
+}
+
+// Run runs the HTTP server on the configured addresses.
 func (s *Server) Run() error {
 	srv := s.httpServer()
 	srv.Handler = h2c.NewHandler(srv.Handler, &http2.Server{})
-	return srv.ListenAndServe()
+	listeners, err := s.listen(":http")
+	if err != nil {
+		return err
+	}
+	return serveAll(listeners, srv.Serve)
 }
 
 // RunWithTLS runs the HTTP server with TLS.
 func (s *Server) RunWithTLS(certFile, keyFile string) error {
-	return s.httpServer().ListenAndServeTLS(certFile, keyFile)
+	srv := s.httpServer()
+	listeners, err := s.listen(":https")
+	if err != nil {
+		return err
+	}
+	return serveAll(listeners, func(l net.Listener) error {
+		return srv.ServeTLS(l, certFile, keyFile)
+	})
 }
 
 // RunWithAutocert runs the HTTP server with TLS credentials provided by
@@ -284,10 +483,16 @@ func (s *Server) RunWithAutocert(domain, addr string) error {
 		}()
 	}
 
-	s.srv = s.httpServer()
-	s.srv.TLSConfig = certManager.TLSConfig()
-	s.srv.TLSConfig.MinVersion = tls.VersionTLS12
-	return s.srv.ListenAndServeTLS("", "")
+	srv := s.httpServer()
+	srv.TLSConfig = certManager.TLSConfig()
+	srv.TLSConfig.MinVersion = tls.VersionTLS12
+	listeners, err := s.listen(":https")
+	if err != nil {
+		return err
+	}
+	return serveAll(listeners, func(l net.Listener) error {
+		return srv.ServeTLS(l, "", "")
+	})
 }
 
 // RunWithListener runs the server using a pre-existing Listener. Used for testing.
@@ -356,8 +561,11 @@ func (s *Server) setDeadline(ctx context.Context, t time.Time) {
 func (s *Server) method(method string, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		if req.Method == "OPTIONS" {
-			log.Infof("%s %s ...", req.Proto, req.Method)
-			w.Header().Set("Access-Control-Allow-Origin", req.Header.Get("Origin"))
+			log.FromContext(req.Context()).Infof("%s %s ...", req.Proto, req.Method)
+			if !s.setCORSHeaders(w, req) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
 			w.Header().Set("Access-Control-Allow-Methods", method+",OPTIONS")
 			w.Header().Set("Access-Control-Allow-Headers", req.Header.Get("Access-Control-Request-Headers"))
 			w.Header().Set("Access-Control-Max-Age", "86400")
@@ -370,13 +578,31 @@ func (s *Server) method(method string, next http.HandlerFunc) http.HandlerFunc {
 			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		if o := req.Header.Get("Origin"); o != "" {
-			w.Header().Set("Access-Control-Allow-Origin", o)
-		}
+		s.setCORSHeaders(w, req)
 		next(w, req)
 	}
 }
 
+// setCORSHeaders sets the headers that let a browser-based client call the
+// API from a different origin, if the request's origin is allowed. The
+// credentials are allowed too because the tokens are sent with the requests.
+// Returns false if the origin isn't allowed.
+func (s *Server) setCORSHeaders(w http.ResponseWriter, req *http.Request) bool {
+	w.Header().Add("Vary", "Origin")
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	for _, o := range s.AllowedOrigins {
+		if o == "*" || o == origin {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			return true
+		}
+	}
+	return false
+}
+
 // noauth wraps handlers that don't require authentication.
 func (s *Server) noauth(f func(*http.Request) *stingle.Response) http.HandlerFunc {
 	rl := rate.NewLimiter(rate.Limit(0.5), 1)
@@ -385,19 +611,87 @@ func (s *Server) noauth(f func(*http.Request) *stingle.Response) http.HandlerFun
 		defer timer.ObserveDuration()
 		s.setDeadline(req.Context(), time.Now().Add(30*time.Second))
 		defer s.setDeadline(req.Context(), time.Time{})
-		log.Infof("%s %s %s", req.Proto, req.Method, req.URL)
+		logger := log.FromContext(req.Context())
+		logger.Infof("%s %s %s", req.Proto, req.Method, req.URL)
+		ip := s.clientIP(req)
+		if s.IPThrottle != nil {
+			if ok, retryAfter := s.IPThrottle.Allow(ip); !ok {
+				logger.Infof("Throttled %s", ip)
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+				reqStatus.WithLabelValues(req.Method, req.URL.String(), "throttled").Inc()
+				return
+			}
+		}
 		req.ParseForm()
 		if err := rl.Wait(req.Context()); err != nil {
 			return
 		}
 		sr := f(req)
 		if err := sr.Send(w); err != nil {
-			log.Errorf("Send: %v", err)
+			logger.Errorf("Send: %v", err)
 		}
 		reqStatus.WithLabelValues(req.Method, req.URL.String(), sr.Status).Inc()
 	})
 }
 
+// countFailures wraps the unauthenticated handlers whose failures count
+// towards banning the client's IP address, e.g. failed logins.
+func (s *Server) countFailures(f func(*http.Request) *stingle.Response) func(*http.Request) *stingle.Response {
+	return func(req *http.Request) *stingle.Response {
+		sr := f(req)
+		if sr.Status != "ok" && s.IPThrottle != nil {
+			s.IPThrottle.Failure(s.clientIP(req))
+		}
+		return sr
+	}
+}
+
+// clientIP returns the IP address of the client that sent req. When the
+// server is behind a reverse proxy, the address is taken from the last value
+// of ClientIPHeader, i.e. the one that the proxy added.
+func (s *Server) clientIP(req *http.Request) string {
+	if ip := lastHeaderValue(req, s.ClientIPHeader); ip != "" {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// lastHeaderValue returns the last value of the header, i.e. the one that the
+// closest proxy added.
+func lastHeaderValue(req *http.Request, header string) string {
+	if header == "" {
+		return ""
+	}
+	values := req.Header.Values(header)
+	if len(values) == 0 {
+		return ""
+	}
+	parts := strings.Split(values[len(values)-1], ",")
+	return strings.TrimSpace(parts[len(parts)-1])
+}
+
+// baseURL returns the base URL of the links that the server creates, e.g.
+// the download URLs.
+func (s *Server) baseURL(req *http.Request) string {
+	if s.BaseURL != "" {
+		return s.BaseURL
+	}
+	host := req.Host
+	if h := lastHeaderValue(req, s.ForwardedHostHeader); h != "" && !strings.ContainsAny(h, "/?#@\\ ") {
+		host = h
+	}
+	scheme := "https"
+	if p := strings.ToLower(lastHeaderValue(req, s.ForwardedProtoHeader)); p == "http" || p == "https" {
+		scheme = p
+	}
+	return fmt.Sprintf("%s://%s%s/", scheme, host, s.pathPrefix)
+}
+
 // checkToken validates the signed token that was given to the client when it
 // logged in. The client presents this token with most API requests.
 // Returns the decoded token, and the authenticated user.
@@ -410,12 +704,23 @@ func (s *Server) checkToken(tok, scope string) (token.Token, database.User, erro
 	if err != nil {
 		return token.Token{}, database.User{}, err
 	}
-	tk, err := s.db.DecryptTokenKey(user.TokenKey)
+	keys, err := s.db.DecryptTokenKeys(user)
 	if err != nil {
 		return token.Token{}, database.User{}, err
 	}
-	defer tk.Wipe()
-	t, err := token.Decrypt(tk, tok)
+	defer func() {
+		for _, tk := range keys {
+			tk.Wipe()
+		}
+	}()
+	// The current key is first. The other keys were rotated out recently
+	// and are only used for the tokens issued before the rotation.
+	var t token.Token
+	for _, tk := range keys {
+		if t, err = token.Decrypt(tk, tok); err == nil {
+			break
+		}
+	}
 	if err != nil {
 		return token.Token{}, database.User{}, err
 	}
@@ -436,20 +741,32 @@ func (s *Server) auth(f func(database.User, *http.Request) *stingle.Response) ht
 
 		req.ParseForm()
 
+		logger := log.FromContext(req.Context())
 		tok := req.PostFormValue("token")
 		_, user, err := s.checkToken(tok, "session")
 		if err != nil || !user.ValidTokens[token.Hash(tok)] {
-			log.Errorf("%s %s (INVALID TOKEN: %v)", req.Method, req.URL, err)
+			logger.Errorf("%s %s (INVALID TOKEN: %v)", req.Method, req.URL, err)
 			sr := stingle.ResponseNOK().AddPart("logout", "1").AddError("You are not logged in")
 			if err := sr.Send(w); err != nil {
-				log.Errorf("Send: %v", err)
+				logger.Errorf("Send: %v", err)
+			}
+			return
+		}
+		logger = logger.With("userId", user.UserID)
+		req = req.WithContext(log.NewContext(req.Context(), logger))
+		if err := s.checkSignature(user, tok, req); err != nil {
+			logger.Errorf("%s %s (INVALID SIGNATURE: %v)", req.Method, req.URL, err)
+			sr := stingle.ResponseNOK().AddError("Invalid request signature")
+			if err := sr.Send(w); err != nil {
+				logger.Errorf("Send: %v", err)
 			}
+			reqStatus.WithLabelValues(req.Method, req.URL.String(), sr.Status).Inc()
 			return
 		}
-		log.Infof("%s %s %s (UserID:%d)", req.Proto, req.Method, req.URL, user.UserID)
+		logger.Infof("%s %s %s (UserID:%d)", req.Proto, req.Method, req.URL, user.UserID)
 		sr := f(user, req)
 		if err := sr.Send(w); err != nil {
-			log.Errorf("Send: %v", err)
+			logger.Errorf("Send: %v", err)
 		}
 		reqStatus.WithLabelValues(req.Method, req.URL.String(), sr.Status).Inc()
 	})
@@ -483,12 +800,13 @@ func (s *Server) authMFA(gracePeriod time.Duration, f func(database.User, *http.
 
 // handleNotFound handles requests for undefined endpoints.
 func (s *Server) handleNotFound(w http.ResponseWriter, req *http.Request) {
+	logger := log.FromContext(req.Context())
 	if log.Level >= log.DebugLevel {
-		log.Debugf("!!! (404) %s %s", req.Method, req.URL)
+		logger.Debugf("!!! (404) %s %s", req.Method, req.URL)
 		req.ParseForm()
 		if req.PostForm != nil {
 			for k, v := range req.PostForm {
-				log.Debugf("> %s: %v", k, v)
+				logger.Debugf("> %s: %v", k, v)
 			}
 		}
 	}
@@ -502,5 +820,5 @@ func (s *Server) handleNotFound(w http.ResponseWriter, req *http.Request) {
 // handleNotImplemented returns an error to the user saying this functionality
 // is not implemented.
 func (s *Server) handleNotImplemented(req *http.Request) *stingle.Response {
-	return stingle.ResponseNOK().AddError("This functionality is not yet implemented in the server")
+	return stingle.ResponseNOK().AddError(stingle.NotImplementedError)
 }
@@ -21,6 +21,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -34,6 +35,7 @@ import (
 	"time"
 
 	"github.com/pquerna/otp/totp"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"c2FmZQ/internal/database"
 	"c2FmZQ/internal/log"
@@ -43,17 +45,25 @@ import (
 )
 
 // startServer starts a server listening on a unix socket. Returns the unix socket
-// and a function to shutdown the server.
-func startServer(t *testing.T) (string, func()) {
-	testdir := t.TempDir()
-	sock := filepath.Join(testdir, "server.sock")
+// and a function to shutdown the server. The opts functions can change the
+// server's configuration before it starts.
+func startServer(t *testing.T, opts ...func(*server.Server)) (string, func()) {
+	return startServerWithDB(t, database.New(filepath.Join(t.TempDir(), "data"), nil), opts...)
+}
+
+// startServerWithDB is like startServer, but it uses db, which lets the test
+// access the database directly.
+func startServerWithDB(t *testing.T, db *database.Database, opts ...func(*server.Server)) (string, func()) {
+	sock := filepath.Join(t.TempDir(), "server.sock")
 	log.Record = t.Log
 	log.Level = 3
-	db := database.New(filepath.Join(testdir, "data"), nil)
 	s := server.New(db, "", "", "")
 	s.AllowCreateAccount = true
 	s.AutoApproveNewAccounts = true
 	s.BaseURL = "http://unix/"
+	for _, opt := range opts {
+		opt(s)
+	}
 	l, err := net.Listen("unix", sock)
 	if err != nil {
 		t.Fatalf("net.Listen failed: %v", err)
@@ -93,6 +103,8 @@ type client struct {
 	token           string
 	otpKey          string
 	authenticator   *webauthn.FakeAuthenticator
+	headers         http.Header
+	inviteCode      string
 }
 
 func (c *client) encodeParams(params map[string]string) string {
@@ -127,6 +139,9 @@ func (c *client) sendRequest(uri string, form url.Values) (*stingle.Response, er
 	}
 	req.Header.Add("X-c2FmZQ-capabilities", "mfa")
 	req.Header.Add("Content-type", "application/x-www-form-urlencoded")
+	for k, v := range c.headers {
+		req.Header[k] = v
+	}
 
 	resp, err := hc.Do(req)
 	if err != nil {
@@ -198,7 +213,25 @@ func (c *client) sendRequest(uri string, form url.Values) (*stingle.Response, er
 	return &sr, nil
 }
 
+// testHeaders returns well-formed, but not decryptable, base64-encoded
+// headers that contain text, in the format that the server expects.
+func testHeaders(text string) string {
+	var parts []string
+	for i := 0; i < 2; i++ {
+		enc := make([]byte, 102+len(text))
+		copy(enc, text)
+		b := append([]byte{'S', 'P', 1}, bytes.Repeat([]byte{byte(i)}, 32)...)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(enc)))
+		parts = append(parts, base64.RawURLEncoding.EncodeToString(append(b, enc...)))
+	}
+	return strings.Join(parts, "*")
+}
+
 func (c *client) uploadFile(filename, set, albumID string, t int64) (*stingle.Response, error) {
+	return c.uploadFileWithHeaders(filename, set, albumID, testHeaders(fmt.Sprintf("%s headers %s", filename, albumID)), t)
+}
+
+func (c *client) uploadFileWithHeaders(filename, set, albumID, headers string, t int64) (*stingle.Response, error) {
 	dialer := dialer{sock: c.sock}
 	hc := http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
 
@@ -213,7 +246,7 @@ func (c *client) uploadFile(filename, set, albumID string, t int64) (*stingle.Re
 	}
 	ts := fmt.Sprintf("%d", t)
 	for _, f := range []struct{ name, value string }{
-		{"headers", fmt.Sprintf("%s headers %s", filename, albumID)},
+		{"headers", headers},
 		{"set", set},
 		{"albumId", albumID},
 		{"dateCreated", ts},
@@ -253,6 +286,105 @@ func (c *client) uploadFile(filename, set, albumID string, t int64) (*stingle.Re
 	return &sr, nil
 }
 
+// sendRawRequest sends a request with the given Accept-Encoding header, and
+// returns the response headers and the size of the response body as received.
+func (c *client) sendRawRequest(uri string, form url.Values, acceptEncoding string) (http.Header, int, error) {
+	dialer := dialer{sock: c.sock}
+	hc := http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
+
+	req, err := http.NewRequest("POST", "http://unix"+uri, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Add("Content-type", "application/x-www-form-urlencoded")
+	req.Header.Add("Accept-Encoding", acceptEncoding)
+
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("request returned status code %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	return resp.Header, len(body), nil
+}
+
+type batchFile struct {
+	filename, set, albumID string
+	// headers defaults to testHeaders("<filename> headers <albumID>").
+	headers string
+}
+
+func (c *client) uploadBatch(files []batchFile, t int64) (*stingle.Response, error) {
+	dialer := dialer{sock: c.sock}
+	hc := http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	ts := fmt.Sprintf("%d", t)
+	for i, file := range files {
+		for _, f := range []string{"file", "thumb"} {
+			pw, err := w.CreateFormFile(fmt.Sprintf("%s%d", f, i), file.filename)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(pw, "Content of %q filename %q", f, file.filename)
+		}
+		headers := file.headers
+		if headers == "" {
+			headers = testHeaders(fmt.Sprintf("%s headers %s", file.filename, file.albumID))
+		}
+		for _, f := range []struct{ name, value string }{
+			{"headers", headers},
+			{"set", file.set},
+			{"albumId", file.albumID},
+			{"dateCreated", ts},
+			{"dateModified", ts},
+			{"version", "1"},
+		} {
+			pw, err := w.CreateFormField(fmt.Sprintf("%s%d", f.name, i))
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprint(pw, f.value)
+		}
+	}
+	pw, err := w.CreateFormField("token")
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprint(pw, c.token)
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	log.Debugf("SEND POST /v2/sync/uploadBatch (%d files)", len(files))
+
+	resp, err := hc.Post("http://unix/v2/sync/uploadBatch", w.FormDataContentType(), &buf)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("request returned status code %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var sr stingle.Response
+	if err := json.Unmarshal(body, &sr); err != nil {
+		return nil, err
+	}
+
+	return &sr, nil
+}
+
 func (c *client) downloadPost(file, set, isThumb string) (string, error) {
 	form := url.Values{}
 	form.Set("token", c.token)
@@ -299,3 +431,155 @@ func (c *client) downloadGet(url string) (string, error) {
 	}
 	return string(body), nil
 }
+
+func TestUserAgentMetrics(t *testing.T) {
+	sock, shutdown := startServer(t, func(s *server.Server) {
+		s.UserAgentMetrics = true
+	})
+	defer shutdown()
+
+	c := newClient(sock)
+	c.headers = http.Header{"User-Agent": []string{"test-agent/1.2 (Linux; x86_64)"}}
+	if _, err := c.sendRequest("/v2/login/preLogin", url.Values{"email": {"alice@"}}); err != nil {
+		t.Fatalf("sendRequest: %v", err)
+	}
+
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	var count float64
+	for _, mf := range mfs {
+		if mf.GetName() != "server_requests_by_user_agent_total" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "agent" && l.GetValue() == "test-agent/1.2" {
+					count += m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	if count != 1 {
+		t.Errorf("Unexpected number of requests from test-agent/1.2: %v", count)
+	}
+}
+
+// corsRequest sends a request to preLogin from origin. When method is OPTIONS,
+// it is a preflight request.
+func corsRequest(t *testing.T, sock, method, origin string) *http.Response {
+	dialer := dialer{sock: sock}
+	hc := http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
+	req, err := http.NewRequest(method, "http://unix/v2/login/preLogin", strings.NewReader("email=alice@"))
+	if err != nil {
+		t.Fatalf("http.NewRequest: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", origin)
+	if method == "OPTIONS" {
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		req.Header.Set("Access-Control-Request-Headers", "content-type")
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		t.Fatalf("hc.Do: %v", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestCORS(t *testing.T) {
+	sock, shutdown := startServer(t, func(s *server.Server) {
+		s.AllowedOrigins = []string{"https://app.example.com"}
+	})
+	defer shutdown()
+
+	for _, tc := range []struct {
+		method, origin string
+		status         int
+		allowOrigin    string
+		allowCreds     string
+	}{
+		{"OPTIONS", "https://app.example.com", http.StatusNoContent, "https://app.example.com", "true"},
+		{"OPTIONS", "https://evil.example.com", http.StatusForbidden, "", ""},
+		{"POST", "https://app.example.com", http.StatusOK, "https://app.example.com", "true"},
+		{"POST", "https://evil.example.com", http.StatusOK, "", ""},
+	} {
+		resp := corsRequest(t, sock, tc.method, tc.origin)
+		if got, want := resp.StatusCode, tc.status; got != want {
+			t.Errorf("%s %s: status %d, want %d", tc.method, tc.origin, got, want)
+		}
+		if got, want := resp.Header.Get("Access-Control-Allow-Origin"), tc.allowOrigin; got != want {
+			t.Errorf("%s %s: Access-Control-Allow-Origin %q, want %q", tc.method, tc.origin, got, want)
+		}
+		if got, want := resp.Header.Get("Access-Control-Allow-Credentials"), tc.allowCreds; got != want {
+			t.Errorf("%s %s: Access-Control-Allow-Credentials %q, want %q", tc.method, tc.origin, got, want)
+		}
+		if tc.method == "OPTIONS" && tc.status == http.StatusNoContent {
+			if got, want := resp.Header.Get("Access-Control-Allow-Methods"), "POST,OPTIONS"; got != want {
+				t.Errorf("Access-Control-Allow-Methods %q, want %q", got, want)
+			}
+		}
+	}
+}
+
+func TestCORSDisabledByDefault(t *testing.T) {
+	sock, shutdown := startServer(t)
+	defer shutdown()
+
+	for _, method := range []string{"OPTIONS", "POST"} {
+		resp := corsRequest(t, sock, method, "https://c2fmzq.org")
+		for k := range resp.Header {
+			if strings.HasPrefix(k, "Access-Control-Allow-") {
+				t.Errorf("%s: unexpected header %s: %q", method, k, resp.Header.Get(k))
+			}
+		}
+	}
+}
+
+func TestListenAddresses(t *testing.T) {
+	// freeAddr returns an address with a port that isn't in use.
+	freeAddr := func(network, addr string) string {
+		l, err := net.Listen(network, addr)
+		if err != nil {
+			t.Skipf("net.Listen(%q, %q): %v", network, addr, err)
+		}
+		defer l.Close()
+		return l.Addr().String()
+	}
+	addrs := []string{freeAddr("tcp4", "127.0.0.1:0"), freeAddr("tcp6", "[::1]:0")}
+
+	log.Record = t.Log
+	defer func() { log.Record = nil }()
+	s := server.New(database.New(filepath.Join(t.TempDir(), "data"), nil), strings.Join(addrs, ","), "", "")
+	ch := make(chan error)
+	go func() {
+		ch <- s.Run()
+	}()
+	for _, addr := range addrs {
+		var err error
+		for i := 0; i < 50; i++ {
+			var resp *http.Response
+			if resp, err = http.Get("http://" + addr + "/"); err == nil {
+				resp.Body.Close()
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err != nil {
+			t.Errorf("http.Get(%q): %v", addr, err)
+		}
+	}
+	if err := s.Shutdown(); err != nil {
+		t.Errorf("s.Shutdown: %v", err)
+	}
+	if err := <-ch; err != http.ErrServerClosed {
+		t.Errorf("s.Run returned %v, want http.ErrServerClosed", err)
+	}
+
+	s = server.New(database.New(filepath.Join(t.TempDir(), "data"), nil), "::1:8080", "", "")
+	if err := s.Run(); err == nil || !strings.Contains(err.Error(), "must be in brackets") {
+		t.Errorf("s.Run returned %v, want invalid address error", err)
+	}
+}
@@ -0,0 +1,105 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"c2FmZQ/internal/database"
+	"c2FmZQ/internal/stingle"
+)
+
+// maxSignatureSkew is the maximum difference between the timestamp of a
+// request signature and the server's clock.
+const maxSignatureSkew = 5 * time.Minute
+
+var errMissingSignature = errors.New("missing request signature")
+
+// nonceSet remembers the nonces of the recent request signatures, so that
+// requests can't be replayed. Nonces are forgotten after they become too old
+// to be accepted.
+type nonceSet struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastPrune time.Time
+}
+
+// add adds a nonce to the set. It returns false if the nonce was already
+// there.
+func (n *nonceSet) add(nonce string, ts time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := time.Now()
+	if n.seen == nil {
+		n.seen = make(map[string]time.Time)
+	}
+	if now.Sub(n.lastPrune) > maxSignatureSkew {
+		for k, t := range n.seen {
+			if now.Sub(t) > 2*maxSignatureSkew {
+				delete(n.seen, k)
+			}
+		}
+		n.lastPrune = now
+	}
+	if _, exists := n.seen[nonce]; exists {
+		return false
+	}
+	n.seen[nonce] = ts
+	return true
+}
+
+// checkSignature verifies the request signature. Requests without a signature
+// are rejected only when RequireSignedRequests is true. Signatures that are
+// invalid, stale, or replayed are always rejected.
+func (s *Server) checkSignature(user database.User, tok string, req *http.Request) error {
+	err := s.verifySignature(user, tok, req)
+	if err == errMissingSignature && !s.RequireSignedRequests {
+		return nil
+	}
+	return err
+}
+
+// verifySignature verifies the request signature. It returns
+// errMissingSignature when the request isn't signed.
+func (s *Server) verifySignature(user database.User, tok string, req *http.Request) error {
+	h := req.Header.Get(stingle.RequestSignatureHeader)
+	if h == "" {
+		return errMissingSignature
+	}
+	sk, err := s.db.DecryptSecretKey(user.ServerSecretKey)
+	if err != nil {
+		return err
+	}
+	defer sk.Wipe()
+	ts, nonce, err := stingle.VerifyRequestSignature(h, req.Method, req.URL.Path, tok, user.PublicKey, sk)
+	if err != nil {
+		return err
+	}
+	t := time.UnixMilli(ts)
+	if d := time.Since(t); d > maxSignatureSkew || d < -maxSignatureSkew {
+		return fmt.Errorf("stale request signature: %v", d)
+	}
+	if !s.nonces.add(fmt.Sprintf("%d/%s", user.UserID, nonce), t) {
+		return errors.New("request signature replayed")
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package server_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"c2FmZQ/internal/server"
+	"c2FmZQ/internal/stingle"
+)
+
+func TestSignedRequests(t *testing.T) {
+	sock, shutdown := startServer(t, func(s *server.Server) {
+		s.RequireSignedRequests = true
+	})
+	defer shutdown()
+
+	c, err := createAccountAndLogin(sock, "alice@")
+	if err != nil {
+		t.Fatalf("createAccountAndLogin failed: %v", err)
+	}
+
+	if _, err := c.accountUsage(); err == nil {
+		t.Fatal("accountUsage without signature succeeded unexpectedly")
+	}
+
+	sign := func(ts time.Time) {
+		sig, err := stingle.SignRequest("POST", "/v2/account/usage", c.token, ts.UnixMilli(), c.serverPublicKey, c.secretKey)
+		if err != nil {
+			t.Fatalf("SignRequest failed: %v", err)
+		}
+		c.headers = http.Header{stingle.RequestSignatureHeader: []string{sig}}
+	}
+
+	sign(time.Now())
+	if _, err := c.accountUsage(); err != nil {
+		t.Fatalf("accountUsage with signature failed: %v", err)
+	}
+	if _, err := c.accountUsage(); err == nil {
+		t.Fatal("replayed accountUsage succeeded unexpectedly")
+	}
+
+	sign(time.Now().Add(-time.Hour))
+	if _, err := c.accountUsage(); err == nil {
+		t.Fatal("accountUsage with stale signature succeeded unexpectedly")
+	}
+
+	sign(time.Now())
+	c.headers[stingle.RequestSignatureHeader] = []string{c.headers.Get(stingle.RequestSignatureHeader) + "x"}
+	if _, err := c.accountUsage(); err == nil {
+		t.Fatal("accountUsage with invalid signature succeeded unexpectedly")
+	}
+}
+
+func TestSignatureNotRequired(t *testing.T) {
+	sock, shutdown := startServer(t)
+	defer shutdown()
+
+	c, err := createAccountAndLogin(sock, "alice@")
+	if err != nil {
+		t.Fatalf("createAccountAndLogin failed: %v", err)
+	}
+
+	if _, err := c.accountUsage(); err != nil {
+		t.Fatalf("accountUsage without signature failed: %v", err)
+	}
+
+	sign := func(ts time.Time) string {
+		sig, err := stingle.SignRequest("POST", "/v2/account/usage", c.token, ts.UnixMilli(), c.serverPublicKey, c.secretKey)
+		if err != nil {
+			t.Fatalf("SignRequest failed: %v", err)
+		}
+		return sig
+	}
+
+	// The signatures that are present are always verified.
+	c.headers = http.Header{stingle.RequestSignatureHeader: []string{sign(time.Now())}}
+	if _, err := c.accountUsage(); err != nil {
+		t.Fatalf("accountUsage with signature failed: %v", err)
+	}
+	if _, err := c.accountUsage(); err == nil {
+		t.Fatal("replayed accountUsage succeeded unexpectedly")
+	}
+
+	c.headers.Set(stingle.RequestSignatureHeader, sign(time.Now().Add(-time.Hour)))
+	if _, err := c.accountUsage(); err == nil {
+		t.Fatal("accountUsage with stale signature succeeded unexpectedly")
+	}
+
+	c.headers.Set(stingle.RequestSignatureHeader, sign(time.Now())+"x")
+	if _, err := c.accountUsage(); err == nil {
+		t.Fatal("accountUsage with invalid signature succeeded unexpectedly")
+	}
+}
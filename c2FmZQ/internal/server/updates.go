@@ -18,8 +18,13 @@
 package server
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 
 	"c2FmZQ/internal/database"
 	"c2FmZQ/internal/log"
@@ -37,6 +42,10 @@ import (
 //     files.
 //   - cntST - The timestamp of the last seen changes to contacts.
 //   - delST - The timestamp of the last seen delete events.
+//   - pageSize - Optional. The maximum number of records to return. When
+//     there are more, nextCursor is set.
+//   - cursor - Optional. The nextCursor value from the previous page. The
+//     other arguments must be the same as for the first page.
 //
 // Returns:
 //   - files: unseen changes in Gallery
@@ -47,54 +56,73 @@ import (
 //   - deletes: unseen deletions (files, albums, contacts, etc)
 //   - spacedUsed: the number of megabytes of storage used.
 //   - spaceQuota: the user's quota in megabytes.
+//   - nextCursor: the cursor to use to get the next page, or empty when
+//     there are no more records.
 func (s *Server) handleGetUpdates(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
 	fileST := parseInt(req.PostFormValue("filesST"), 0)
 	trashST := parseInt(req.PostFormValue("trashST"), 0)
 	albumsST := parseInt(req.PostFormValue("albumsST"), 0)
 	albumFilesST := parseInt(req.PostFormValue("albumFilesST"), 0)
 	cntST := parseInt(req.PostFormValue("cntST"), 0)
 	delST := parseInt(req.PostFormValue("delST"), 0)
+	pageSize := int(parseInt(req.PostFormValue("pageSize"), 0))
+	cursor, err := parseUpdatesCursor(req.PostFormValue("cursor"))
+	if err != nil {
+		logger.Errorf("parseUpdatesCursor: %v", err)
+		return stingle.ResponseNOK()
+	}
+	// Each query returns at most one record more than the page size, which
+	// is enough to tell whether there is a next page.
+	page := database.UpdatesPage{After: cursor}
+	if pageSize > 0 {
+		page.Limit = pageSize + 1
+	}
 
-	files, err := s.db.FileUpdates(user, stingle.GallerySet, fileST)
+	files, err := s.db.FileUpdates(user, stingle.GallerySet, fileST, page)
 	if err != nil {
-		log.Errorf("FileUpdates() failed: %v", err)
+		logger.Errorf("FileUpdates() failed: %v", err)
 		return stingle.ResponseNOK()
 	}
-	trash, err := s.db.FileUpdates(user, stingle.TrashSet, trashST)
+	trash, err := s.db.FileUpdates(user, stingle.TrashSet, trashST, page)
 	if err != nil {
-		log.Errorf("FileUpdates() failed: %v", err)
+		logger.Errorf("FileUpdates() failed: %v", err)
 		return stingle.ResponseNOK()
 	}
-	albums, err := s.db.AlbumUpdates(user, albumsST)
+	albums, err := s.db.AlbumUpdates(user, albumsST, page)
 	if err != nil {
-		log.Errorf("AlbumUpdates() failed: %v", err)
+		logger.Errorf("AlbumUpdates() failed: %v", err)
 		return stingle.ResponseNOK()
 	}
-	albumFiles, err := s.db.FileUpdates(user, stingle.AlbumSet, albumFilesST)
+	albumFiles, err := s.db.FileUpdates(user, stingle.AlbumSet, albumFilesST, page)
 	if err != nil {
-		log.Errorf("FileUpdates() failed: %v", err)
+		logger.Errorf("FileUpdates() failed: %v", err)
 		return stingle.ResponseNOK()
 	}
-	contacts, err := s.db.ContactUpdates(user, cntST)
+	contacts, err := s.db.ContactUpdates(user, cntST, page)
 	if err != nil {
-		log.Errorf("ContactUpdates() failed: %v", err)
+		logger.Errorf("ContactUpdates() failed: %v", err)
 		return stingle.ResponseNOK()
 	}
 	outOfSync := false
-	deletes, err := s.db.DeleteUpdates(user, delST)
+	deletes, err := s.db.DeleteUpdates(user, delST, page)
 	if err == database.ErrUpdateTimestampTooOld {
 		outOfSync = true
 	} else if err != nil {
-		log.Errorf("DeleteUpdates() failed: %v", err)
+		logger.Errorf("DeleteUpdates() failed: %v", err)
 		return stingle.ResponseNOK()
 	}
+	var nextCursor string
+	if pageSize > 0 {
+		nextCursor = paginateUpdates(pageSize, &files, &trash, &albums, &albumFiles, &contacts, &deletes)
+	}
 	spaceUsed, err := s.db.SpaceUsed(user)
 	if err != nil {
-		log.Errorf("SpaceUSed() failed: %v", err)
+		logger.Errorf("SpaceUSed() failed: %v", err)
 	}
 	spaceQuota, err := s.db.Quota(user.UserID)
 	if err != nil {
-		log.Errorf("Quota() failed: %v", err)
+		logger.Errorf("Quota() failed: %v", err)
 	}
 
 	r := stingle.ResponseOK().
@@ -106,8 +134,135 @@ func (s *Server) handleGetUpdates(user database.User, req *http.Request) *stingl
 		AddPart("deletes", deletes).
 		AddPart("spaceUsed", fmt.Sprintf("%d", spaceUsed>>20)).
 		AddPart("spaceQuota", fmt.Sprintf("%d", spaceQuota>>20))
+	if pageSize > 0 {
+		r.AddPart("nextCursor", nextCursor)
+	}
 	if outOfSync {
 		r.AddError("Your app is too far out of sync. Upload your changes, then wipe your data, and login again.")
 	}
 	return r
 }
+
+// handleAccountUsage handles the /v2/account/usage endpoint. It reports how
+// much storage the user is using.
+// Form arguments:
+//   - token  - The signed session token.
+//
+// Returns:
+//   - spaceUsed: the number of bytes of storage used.
+//   - fileCount: the number of files.
+//   - albumCount: the number of albums owned by the user.
+//   - spaceQuota: the user's quota in bytes.
+//   - spaceRemaining: the number of bytes left before reaching the quota.
+func (s *Server) handleAccountUsage(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
+	usage, err := s.db.Usage(user)
+	if err != nil {
+		logger.Errorf("Usage() failed: %v", err)
+		return stingle.ResponseNOK()
+	}
+	quota, err := s.db.Quota(user.UserID)
+	if err != nil {
+		logger.Errorf("Quota() failed: %v", err)
+		return stingle.ResponseNOK()
+	}
+	remaining := quota - usage.SpaceUsed
+	if remaining < 0 {
+		remaining = 0
+	}
+	return stingle.ResponseOK().
+		AddPart("spaceUsed", fmt.Sprintf("%d", usage.SpaceUsed)).
+		AddPart("fileCount", fmt.Sprintf("%d", usage.FileCount)).
+		AddPart("albumCount", fmt.Sprintf("%d", usage.AlbumCount)).
+		AddPart("spaceQuota", fmt.Sprintf("%d", quota)).
+		AddPart("spaceRemaining", fmt.Sprintf("%d", remaining))
+}
+
+// formatUpdatesCursor returns the cursor of the page that starts after pos.
+func formatUpdatesCursor(pos database.UpdatePos) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d:%s", pos.TS, pos.Kind, pos.Key)))
+}
+
+func parseUpdatesCursor(s string) (*database.UpdatePos, error) {
+	if s == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	p := strings.SplitN(string(b), ":", 3)
+	if len(p) != 3 {
+		return nil, fmt.Errorf("invalid cursor: %q", b)
+	}
+	var pos database.UpdatePos
+	if pos.TS, err = strconv.ParseInt(p[0], 10, 64); err != nil {
+		return nil, err
+	}
+	if pos.Kind, err = strconv.Atoi(p[1]); err != nil {
+		return nil, err
+	}
+	pos.Key = p[2]
+	return &pos, nil
+}
+
+// paginateUpdates keeps the first pageSize update records, and returns the
+// cursor of the next page, or an empty string if there are no more records.
+// Each list is already limited to the records of the page, and sorted.
+func paginateUpdates(pageSize int, files, trash *[]stingle.File, albums *[]stingle.Album, albumFiles *[]stingle.File, contacts *[]stingle.Contact, deletes *[]stingle.DeleteEvent) string {
+	type record struct {
+		pos database.UpdatePos
+		idx int
+	}
+	var records []record
+	add := func(ts json.Number, kind int, key string, idx int) {
+		t, _ := ts.Int64()
+		records = append(records, record{database.UpdatePos{TS: t, Kind: kind, Key: key}, idx})
+	}
+	for i, a := range *albums {
+		add(a.DateModified, database.UpdateKindAlbum, a.AlbumID, i)
+	}
+	for kind, list := range map[int][]stingle.File{database.UpdateKindFile: *files, database.UpdateKindTrash: *trash, database.UpdateKindAlbumFile: *albumFiles} {
+		for i, f := range list {
+			add(f.DateModified, kind, database.FileUpdateKey(f.AlbumID, f.File), i)
+		}
+	}
+	for i, c := range *contacts {
+		add(c.DateModified, database.UpdateKindContact, c.UserID.String(), i)
+	}
+	for i, d := range *deletes {
+		typ, _ := d.Type.Int64()
+		add(d.Date, database.UpdateKindDelete, database.DeleteUpdateKey(typ, d.AlbumID, d.File), i)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].pos.Less(records[j].pos) })
+
+	var next string
+	if len(records) > pageSize {
+		records = records[:pageSize]
+		next = formatUpdatesCursor(records[pageSize-1].pos)
+	}
+	keep := make(map[int]map[int]bool)
+	for _, r := range records {
+		if keep[r.pos.Kind] == nil {
+			keep[r.pos.Kind] = make(map[int]bool)
+		}
+		keep[r.pos.Kind][r.idx] = true
+	}
+	*albums = filterUpdates(*albums, keep[database.UpdateKindAlbum])
+	*files = filterUpdates(*files, keep[database.UpdateKindFile])
+	*trash = filterUpdates(*trash, keep[database.UpdateKindTrash])
+	*albumFiles = filterUpdates(*albumFiles, keep[database.UpdateKindAlbumFile])
+	*contacts = filterUpdates(*contacts, keep[database.UpdateKindContact])
+	*deletes = filterUpdates(*deletes, keep[database.UpdateKindDelete])
+	return next
+}
+
+func filterUpdates[T any](list []T, keep map[int]bool) []T {
+	out := []T{}
+	for i, v := range list {
+		if keep[i] {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -21,10 +21,123 @@ import (
 	"fmt"
 	"net/url"
 	"strings"
+	"testing"
 
+	"c2FmZQ/internal/database"
 	"c2FmZQ/internal/stingle"
 )
 
+func TestGetUpdatesPagination(t *testing.T) {
+	sock, shutdown := startServer(t)
+	defer shutdown()
+	defer func() { database.CurrentTimeForTesting = 0 }()
+
+	database.CurrentTimeForTesting = 1000
+	c, err := createAccountAndLogin(sock, "alice")
+	if err != nil {
+		t.Fatalf("createAccountAndLogin failed: %v", err)
+	}
+	if err := c.addAlbum("album1", 1000); err != nil {
+		t.Fatalf("c.addAlbum failed: %v", err)
+	}
+	// Many records with the same timestamp.
+	for i := 0; i < 5; i++ {
+		set, albumID := stingle.GallerySet, ""
+		if i%2 == 1 {
+			set, albumID = stingle.AlbumSet, "album1"
+		}
+		if _, err := c.uploadFile(fmt.Sprintf("file%d", i), set, albumID, 1000); err != nil {
+			t.Fatalf("c.uploadFile failed: %v", err)
+		}
+	}
+	database.CurrentTimeForTesting = 2000
+	if err := c.moveFiles(database.MoveFileParams{
+		SetFrom:   stingle.GallerySet,
+		SetTo:     stingle.TrashSet,
+		Filenames: []string{"file0", "file2"},
+		IsMoving:  true,
+	}); err != nil {
+		t.Fatalf("c.moveFiles failed: %v", err)
+	}
+
+	want, err := c.getUpdates(0, 0, 0, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("c.getUpdates failed: %v", err)
+	}
+	if cursor := want.Part("nextCursor"); cursor != nil {
+		t.Errorf("Unexpected nextCursor without pageSize: %v", cursor)
+	}
+
+	lists := make(map[string][]interface{})
+	var cursor string
+	for pages := 0; ; pages++ {
+		if pages > 20 {
+			t.Fatal("Too many pages")
+		}
+		sr, err := c.getUpdatesPage(2, cursor)
+		if err != nil {
+			t.Fatalf("c.getUpdatesPage failed: %v", err)
+		}
+		addMissingFields(sr)
+		n := 0
+		for _, f := range []string{"files", "trash", "albums", "albumFiles", "contacts", "deletes"} {
+			l := sr.Part(f).([]interface{})
+			n += len(l)
+			lists[f] = append(lists[f], l...)
+		}
+		if n > 2 {
+			t.Errorf("Page has %d records, want at most 2", n)
+		}
+		cursor = sr.Part("nextCursor").(string)
+		if cursor == "" {
+			break
+		}
+		if pages == 0 {
+			// Records added between pages are returned on a later page.
+			database.CurrentTimeForTesting = 3000
+			if _, err := c.uploadFile("file5", stingle.GallerySet, "", 3000); err != nil {
+				t.Fatalf("c.uploadFile failed: %v", err)
+			}
+		}
+	}
+	got := stingle.ResponseOK()
+	for f, l := range lists {
+		got.AddPartList(f, l...)
+	}
+	if want, err = c.getUpdates(0, 0, 0, 0, 0, 0); err != nil {
+		t.Fatalf("c.getUpdates failed: %v", err)
+	}
+	if diff := diffUpdates(want, got); diff != "" {
+		t.Errorf("Unexpected updates:\n%v", diff)
+	}
+	for f, l := range lists {
+		seen := make(map[string]bool)
+		for _, v := range l {
+			k := fmt.Sprint(v)
+			if seen[k] {
+				t.Errorf("Duplicate record in %s: %v", f, v)
+			}
+			seen[k] = true
+		}
+	}
+}
+
+func (c *client) getUpdatesPage(pageSize int, cursor string) (*stingle.Response, error) {
+	form := url.Values{}
+	form.Set("token", c.token)
+	form.Set("pageSize", fmt.Sprintf("%d", pageSize))
+	form.Set("cursor", cursor)
+
+	sr, err := c.sendRequest("/v2/sync/getUpdates", form)
+	if err != nil {
+		return nil, err
+	}
+	if sr.Status != "ok" {
+		return nil, sr
+	}
+	return sr, nil
+}
+
 func (c *client) getUpdates(fileST, trashST, albumsST, albumFilesST, cntST, delST int64) (*stingle.Response, error) {
 	form := url.Values{}
 	form.Set("token", c.token)
@@ -94,3 +207,17 @@ func diffUpdates(u1, u2 *stingle.Response) string {
 	}
 	return strings.Join(out, "\n")
 }
+
+func (c *client) accountUsage() (*stingle.Response, error) {
+	form := url.Values{}
+	form.Set("token", c.token)
+
+	sr, err := c.sendRequest("/v2/account/usage", form)
+	if err != nil {
+		return nil, err
+	}
+	if sr.Status != "ok" {
+		return nil, sr
+	}
+	return sr, nil
+}
@@ -18,18 +18,24 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"c2FmZQ/internal/database"
 	"c2FmZQ/internal/log"
 )
 
+// The maximum number of files in a batch upload.
+const maxBatchUploadSize = 100
+
 // The return value of receiveUpload.
 type upload struct {
 	database.FileSpec
@@ -39,14 +45,21 @@ type upload struct {
 	albumID string
 }
 
-// receiveUpload processes a multipart/form-data.
-func (s *Server) receiveUpload(dir string, req *http.Request) (*upload, error) {
+// receiveUpload processes a multipart/form-data. The file parts are streamed
+// to temporary blob files as they are received. They are never held in
+// memory.
+func (s *Server) receiveUpload(dir string, req *http.Request) (_ *upload, retErr error) {
 	ctx := req.Context()
 	mr, err := req.MultipartReader()
 	if err != nil {
 		return nil, err
 	}
 	var upload upload
+	defer func() {
+		if retErr != nil {
+			upload.removeFiles()
+		}
+	}()
 
 	for {
 		s.setDeadline(ctx, time.Now().Add(10*time.Minute))
@@ -57,66 +70,167 @@ func (s *Server) receiveUpload(dir string, req *http.Request) (*upload, error) {
 		if err != nil {
 			return nil, err
 		}
-		if p.FileName() != "" {
-			f, name, err := s.db.TempFile(dir)
-			if err != nil {
-				return nil, err
-			}
-			size, err := s.copyWithCtx(ctx, f, p)
-			if err != nil {
-				if err := os.Remove(name); err != nil {
-					log.Errorf("os.Remove(%q): %v", name, err)
-				}
-				return nil, err
-			}
+		if err := s.receivePart(ctx, dir, p, p.FormName(), &upload); err != nil {
+			return nil, err
+		}
+	}
 
-			upload.name = p.FileName()
-			if p.FormName() == "file" {
-				upload.FileSpec.StoreFile = name
-				upload.FileSpec.StoreFileSize = size
-			} else if p.FormName() == "thumb" {
-				upload.FileSpec.StoreThumb = name
-				upload.FileSpec.StoreThumbSize = size
-			}
+	return &upload, nil
+}
 
-			if err := f.Close(); err != nil {
-				return nil, err
+// receiveBatchUpload processes a multipart/form-data that contains multiple
+// files. The form names of the parts that belong to a file are suffixed with
+// the index of that file, e.g. file0, thumb0, headers0, file1, thumb1, etc.
+// Parts without an index, i.e. token, are returned in common. The temporary
+// files of all the parts are removed if an error is returned.
+func (s *Server) receiveBatchUpload(dir string, req *http.Request) (_ *upload, _ []*upload, retErr error) {
+	ctx := req.Context()
+	mr, err := req.MultipartReader()
+	if err != nil {
+		return nil, nil, err
+	}
+	common := &upload{}
+	var uploads []*upload
+	defer func() {
+		// The common part isn't a file. Any file that it received is
+		// never used.
+		common.removeFiles()
+		if retErr != nil {
+			for _, up := range uploads {
+				up.removeFiles()
 			}
-			if err := p.Close(); err != nil {
-				return nil, err
+		}
+	}()
+
+	for {
+		s.setDeadline(ctx, time.Now().Add(10*time.Minute))
+		p, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		name, idx := splitFormName(p.FormName())
+		if idx < 0 {
+			if err := s.receivePart(ctx, dir, p, name, common); err != nil {
+				return nil, nil, err
 			}
-		} else {
-			buf := make([]byte, 2048)
-			sz, err := io.ReadFull(p, buf)
-			if err != io.ErrUnexpectedEOF && err != io.EOF {
-				return nil, fmt.Errorf("received input is more than 2KB in size: sz=%d,%q=%q", sz, p.FormName(), string(buf[:sz]))
+			continue
+		}
+		if idx >= maxBatchUploadSize {
+			return nil, nil, fmt.Errorf("too many files in batch: %d", idx+1)
+		}
+		for len(uploads) <= idx {
+			uploads = append(uploads, &upload{})
+		}
+		if err := s.receivePart(ctx, dir, p, name, uploads[idx]); err != nil {
+			return nil, nil, err
+		}
+	}
+	return common, uploads, nil
+}
+
+// receivePart processes one part of a multipart/form-data, with form name
+// name, and stores the result in upload.
+func (s *Server) receivePart(ctx context.Context, dir string, p *multipart.Part, name string, upload *upload) error {
+	if p.FileName() != "" {
+		f, fn, err := s.db.TempFile(dir)
+		if err != nil {
+			return err
+		}
+		size, err := s.copyWithCtx(ctx, f, p)
+		if err != nil {
+			if err := os.Remove(fn); err != nil {
+				log.Errorf("os.Remove(%q): %v", fn, err)
 			}
-			slurp := string(buf[:sz])
-
-			switch p.FormName() {
-			case "headers":
-				upload.FileSpec.Headers = slurp
-			case "set":
-				upload.set = slurp
-			case "dateCreated":
-				if upload.FileSpec.DateCreated, err = strconv.ParseInt(slurp, 10, 64); err != nil {
-					return nil, err
-				}
-			case "albumId":
-				upload.albumID = slurp
-			case "dateModified":
-				if upload.FileSpec.DateModified, err = strconv.ParseInt(slurp, 10, 64); err != nil {
-					return nil, err
-				}
-			case "version":
-				upload.FileSpec.Version = slurp
-			case "token":
-				upload.token = slurp
-			default:
-				log.Errorf("receiveUpload: unexpected form input: %q=%q", p.FormName(), slurp)
+			return err
+		}
+
+		if err := f.Close(); err != nil {
+			if err := os.Remove(fn); err != nil {
+				log.Errorf("os.Remove(%q): %v", fn, err)
 			}
+			return err
+		}
+
+		upload.name = p.FileName()
+		switch name {
+		case "file":
+			removeFile(upload.FileSpec.StoreFile)
+			upload.FileSpec.StoreFile = fn
+			upload.FileSpec.StoreFileSize = size
+		case "thumb":
+			removeFile(upload.FileSpec.StoreThumb)
+			upload.FileSpec.StoreThumb = fn
+			upload.FileSpec.StoreThumbSize = size
+		default:
+			log.Errorf("receiveUpload: unexpected file input: %q", p.FormName())
+			removeFile(fn)
 		}
+		return p.Close()
 	}
+	buf := make([]byte, 2048)
+	sz, err := io.ReadFull(p, buf)
+	if err != io.ErrUnexpectedEOF && err != io.EOF {
+		return fmt.Errorf("received input is more than 2KB in size: sz=%d,%q=%q", sz, p.FormName(), string(buf[:sz]))
+	}
+	slurp := string(buf[:sz])
 
-	return &upload, nil
+	switch name {
+	case "headers":
+		upload.FileSpec.Headers = slurp
+	case "set":
+		upload.set = slurp
+	case "dateCreated":
+		if upload.FileSpec.DateCreated, err = strconv.ParseInt(slurp, 10, 64); err != nil {
+			return err
+		}
+	case "albumId":
+		upload.albumID = slurp
+	case "dateModified":
+		if upload.FileSpec.DateModified, err = strconv.ParseInt(slurp, 10, 64); err != nil {
+			return err
+		}
+	case "version":
+		upload.FileSpec.Version = slurp
+	case "token":
+		upload.token = slurp
+	default:
+		log.Errorf("receiveUpload: unexpected form input: %q=%q", p.FormName(), slurp)
+	}
+	return nil
+}
+
+// removeFiles deletes the temporary files of an upload that wasn't added to
+// the database.
+func (up *upload) removeFiles() {
+	removeFile(up.FileSpec.StoreFile)
+	removeFile(up.FileSpec.StoreThumb)
+	up.FileSpec.StoreFile = ""
+	up.FileSpec.StoreThumb = ""
+}
+
+// removeFile deletes a temporary upload file, if there is one.
+func removeFile(fn string) {
+	if fn == "" {
+		return
+	}
+	if err := os.Remove(fn); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Errorf("os.Remove(%q): %v", fn, err)
+	}
+}
+
+// splitFormName splits a form name like file12 into its name and index, i.e.
+// "file" and 12. The index is -1 when the form name doesn't have one.
+func splitFormName(formName string) (string, int) {
+	name := strings.TrimRight(formName, "0123456789")
+	if name == formName {
+		return formName, -1
+	}
+	idx, err := strconv.Atoi(formName[len(name):])
+	if err != nil {
+		return formName, -1
+	}
+	return name, idx
 }
@@ -44,6 +44,7 @@ import (
 // Returns:
 //   - stingle.Response(ok)
 func (s *Server) handleWebAuthnRegister(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
 	var passKey bool
 	var keyName string
 	var discoverable bool
@@ -53,7 +54,7 @@ func (s *Server) handleWebAuthnRegister(user database.User, req *http.Request) *
 	if v := req.PostFormValue("params"); v != "" {
 		params, err := s.decodeParams(v, user)
 		if err != nil {
-			log.Errorf("decodeParams: %v", err)
+			logger.Errorf("decodeParams: %v", err)
 			return stingle.ResponseNOK()
 		}
 		passKey = params["passKey"] == "1"
@@ -63,7 +64,7 @@ func (s *Server) handleWebAuthnRegister(user database.User, req *http.Request) *
 		attestationObject = params["attestationObject"]
 		if tr := params["transports"]; tr != "" {
 			if err := json.Unmarshal([]byte(tr), &transports); err != nil {
-				log.Errorf("json.Unmarshal: %v", err)
+				logger.Errorf("json.Unmarshal: %v", err)
 				return stingle.ResponseNOK()
 			}
 		}
@@ -162,7 +163,7 @@ func (s *Server) handleWebAuthnRegister(user database.User, req *http.Request) *
 		}
 		return nil
 	}); err != nil {
-		log.Errorf("MutateUser: %v", err)
+		logger.Errorf("MutateUser: %v", err)
 		return stingle.ResponseNOK()
 	}
 	resp := stingle.ResponseOK()
@@ -224,9 +225,10 @@ func (s *Server) handleWebAuthnKeys(user database.User, req *http.Request) *stin
 // Returns:
 //   - stingle.Response(ok)
 func (s *Server) handleWebAuthnUpdateKeys(user database.User, req *http.Request) *stingle.Response {
+	logger := log.FromContext(req.Context())
 	params, err := s.decodeParams(req.PostFormValue("params"), user)
 	if err != nil {
-		log.Errorf("decodeParams: %v", err)
+		logger.Errorf("decodeParams: %v", err)
 		return stingle.ResponseNOK()
 	}
 	var updates []struct {
@@ -235,7 +237,7 @@ func (s *Server) handleWebAuthnUpdateKeys(user database.User, req *http.Request)
 		Deleted bool   `json:"deleted"`
 	}
 	if err := json.Unmarshal([]byte(params["updates"]), &updates); err != nil {
-		log.Errorf("handleWebAuthnUpdateKeys: %v", err)
+		logger.Errorf("handleWebAuthnUpdateKeys: %v", err)
 		return stingle.ResponseNOK()
 	}
 	if user.WebAuthnConfig == nil {
@@ -258,7 +260,7 @@ func (s *Server) handleWebAuthnUpdateKeys(user database.User, req *http.Request)
 		}
 		return nil
 	}); err != nil {
-		log.Errorf("MutateUser: %v", err)
+		logger.Errorf("MutateUser: %v", err)
 		return stingle.ResponseNOK()
 	}
 	return stingle.ResponseOK().
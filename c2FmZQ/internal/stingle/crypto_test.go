@@ -65,3 +65,33 @@ func TestSymmetric(t *testing.T) {
 		t.Errorf("DecryptSymmetric: want %q, got %q", want, got)
 	}
 }
+
+func FuzzDecryptMessage(f *testing.F) {
+	senderKey := MakeSecretKeyForTest()
+	receiverKey := MakeSecretKeyForTest()
+	for _, msg := range []string{"", "a", "blah blah blah 123", `{"foo":"bar"}`} {
+		f.Add(EncryptMessage([]byte(msg), receiverKey.PublicKey(), senderKey))
+	}
+	f.Add("")
+	f.Add("AAAA")
+	f.Add("not base64!")
+
+	f.Fuzz(func(t *testing.T, msg string) {
+		DecryptMessage(msg, senderKey.PublicKey(), receiverKey)
+	})
+}
+
+func FuzzSealBoxOpen(f *testing.F) {
+	key := MakeSecretKeyForTest()
+	for _, msg := range []string{"", "foo bar", string(make([]byte, 100))} {
+		f.Add(key.PublicKey().SealBox([]byte(msg)))
+	}
+	f.Add([]byte{})
+	f.Add(make([]byte, 47))
+	f.Add(make([]byte, 48))
+
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		key.SealBoxOpen(msg)
+		key.SealBoxOpenBase64(string(msg))
+	})
+}
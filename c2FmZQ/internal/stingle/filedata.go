@@ -34,6 +34,10 @@ const (
 	chunkOverhead = chacha20poly1305.NonceSizeX + poly1305Overhead
 )
 
+// ErrDecrypt is returned when encrypted data can't be decrypted, e.g. because
+// it is corrupt or it was encrypted with a different key.
+var ErrDecrypt = errors.New("decryption failed")
+
 // EncryptFile encrypts the plaintext from the reader using the SymmetricKey in
 // header, and writes the ciphertext to the writer.
 func EncryptFile(w io.Writer, header *Header) *StreamWriter {
@@ -188,7 +192,7 @@ func (r *StreamReader) readChunk() error {
 		}
 		dec, err := ae.Open(enc[:0], nonce, enc, nil)
 		if err != nil {
-			return err
+			return fmt.Errorf("%w: chunk %d: %v", ErrDecrypt, r.off/int64(r.hdr.ChunkSize), err)
 		}
 		r.buf = append(r.buf, dec...)
 	}
@@ -20,6 +20,7 @@ package stingle
 import (
 	"bytes"
 	"crypto/rand"
+	"errors"
 	"io"
 	"os"
 	"path/filepath"
@@ -116,3 +117,26 @@ func TestFileEncryption(t *testing.T) {
 		t.Errorf("Unexpected read. Want %q, got %q", want, got)
 	}
 }
+
+func TestDecryptCorruptFile(t *testing.T) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	newHeader := func() *Header {
+		return &Header{ChunkSize: 128, SymmetricKey: append([]byte(nil), key...)}
+	}
+	var buf bytes.Buffer
+	w := EncryptFile(&buf, newHeader())
+	if _, err := w.Write(bytes.Repeat([]byte("x"), 1000)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	w.Close()
+
+	enc := buf.Bytes()
+	enc[len(enc)/2] ^= 0xff
+	_, err := io.Copy(io.Discard, DecryptFile(bytes.NewReader(enc), newHeader()))
+	if !errors.Is(err, ErrDecrypt) {
+		t.Errorf("DecryptFile returned %v, want ErrDecrypt", err)
+	}
+}
@@ -51,6 +51,69 @@ func DecryptBase64Headers(hdrs string, sk *SecretKey) ([]*Header, error) {
 	return out, nil
 }
 
+// DecryptBase64FileHeader decrypts only the first of the base64-encoded
+// headers, i.e. the file header. It is about twice as fast as
+// DecryptBase64Headers when the thumbnail header isn't needed.
+func DecryptBase64FileHeader(hdrs string, sk *SecretKey) (*Header, error) {
+	parts := strings.Split(hdrs, "*")
+	if len(parts) != 2 {
+		return nil, errors.New("invalid headers")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	return DecryptHeader(bytes.NewBuffer(b), sk)
+}
+
+// The smallest possible encrypted header: the sealed box overhead (48 bytes)
+// plus a header with an empty filename (54 bytes).
+const minEncHeaderSize = 48 + 54
+
+// NormalizeBase64Headers checks that base64-encoded headers are well-formed,
+// without decrypting them, and returns them in canonical form, i.e. unpadded
+// URL-safe base64. It is used by the server, which doesn't have the keys
+// needed to decrypt the headers.
+func NormalizeBase64Headers(hdrs string) (string, error) {
+	parts := strings.Split(strings.TrimSpace(hdrs), "*")
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid headers: want 2 parts, got %d", len(parts))
+	}
+	for i, hdr := range parts {
+		b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(hdr, "="))
+		if err != nil {
+			return "", fmt.Errorf("invalid headers: part %d: %w", i, err)
+		}
+		if err := checkHeaderEnvelope(b); err != nil {
+			return "", fmt.Errorf("invalid headers: part %d: %w", i, err)
+		}
+		parts[i] = base64.RawURLEncoding.EncodeToString(b)
+	}
+	return strings.Join(parts, "*"), nil
+}
+
+// checkHeaderEnvelope checks the unencrypted parts of an encrypted header.
+func checkHeaderEnvelope(b []byte) error {
+	// 3 bytes {'S','P',1} + 32-byte file ID + 4-byte header size
+	if len(b) < 39 {
+		return errors.New("header too short")
+	}
+	if b[0] != 'S' || b[1] != 'P' {
+		return errors.New("unexpected file type")
+	}
+	if b[2] != 1 {
+		return errors.New("unexpected file version")
+	}
+	headerSize := int64(binary.BigEndian.Uint32(b[35:39]))
+	if headerSize < minEncHeaderSize || headerSize > 64*1024 {
+		return fmt.Errorf("invalid header size: %d", headerSize)
+	}
+	if got := int64(len(b) - 39); got != headerSize {
+		return fmt.Errorf("header size mismatch: want %d, got %d", headerSize, got)
+	}
+	return nil
+}
+
 // EncryptBase64Headers encrypts headers and encodes them.
 func EncryptBase64Headers(hdrs []*Header, pk PublicKey) (string, error) {
 	var s []string
@@ -142,25 +205,42 @@ func DecryptHeader(in io.Reader, sk *SecretKey) (*Header, error) {
 
 	d, err := sk.SealBoxOpen(encHeader)
 	if err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrDecrypt, err)
+	}
+	if err := parseHeader(hdr, d); err != nil {
+		hdr.Wipe()
 		return nil, err
 	}
+	hdr.setFinalizer()
+	return hdr, nil
+}
+
+// parseHeader parses a decrypted header into hdr.
+func parseHeader(hdr *Header, d []byte) error {
 	// 1-byte header.headerVersion
+	if len(d) < 1 {
+		return errors.New("invalid header version")
+	}
 	hdr.Version, d = d[0], d[1:]
+
 	// 4-byte header.chunkSize
+	if len(d) < 4 {
+		return errors.New("invalid chunk size")
+	}
 	hdr.ChunkSize, d = int32(binary.BigEndian.Uint32(d[:4])), d[4:]
 	if hdr.ChunkSize < 1 || hdr.ChunkSize > 64*1024*1024 {
-		return nil, errors.New("invalid chunk size")
+		return errors.New("invalid chunk size")
 	}
 
 	// 8-byte header.dataSize
 	if len(d) < 8 {
-		return nil, errors.New("invalid data size")
+		return errors.New("invalid data size")
 	}
 	hdr.DataSize, d = int64(binary.BigEndian.Uint64(d[:8])), d[8:]
 
 	// 32-byte SymmetricKey
 	if len(d) < 32 {
-		return nil, errors.New("invalid symmetric key")
+		return errors.New("invalid symmetric key")
 	}
 	hdr.SymmetricKey = make([]byte, 32)
 	copy(hdr.SymmetricKey, d)
@@ -168,17 +248,17 @@ func DecryptHeader(in io.Reader, sk *SecretKey) (*Header, error) {
 
 	// 1-byte FileType
 	if len(d) == 0 {
-		return nil, errors.New("invalid file type")
+		return errors.New("invalid file type")
 	}
 	hdr.FileType, d = d[0], d[1:]
 
-	// 1-byte filenameSize
-	if len(d) == 0 {
-		return nil, errors.New("invalid filename size")
+	// 4-byte filenameSize
+	if len(d) < 4 {
+		return errors.New("invalid filename size")
 	}
-	filenameSize, d := int(binary.BigEndian.Uint32(d[:4])), d[4:]
-	if filenameSize < 0 || int(filenameSize) > len(d) {
-		return nil, fmt.Errorf("invalid filename size: %d", filenameSize)
+	filenameSize, d := int64(binary.BigEndian.Uint32(d[:4])), d[4:]
+	if filenameSize > int64(len(d)) {
+		return fmt.Errorf("invalid filename size: %d", filenameSize)
 	}
 
 	// filenameSize-byte Filename
@@ -186,13 +266,10 @@ func DecryptHeader(in io.Reader, sk *SecretKey) (*Header, error) {
 
 	// 4-byte VideoDuration
 	if len(d) < 4 {
-		return nil, errors.New("invalid video duration")
+		return errors.New("invalid video duration")
 	}
 	hdr.VideoDuration = int32(binary.BigEndian.Uint32(d[:4]))
-	d = d[4:]
-
-	hdr.setFinalizer()
-	return hdr, nil
+	return nil
 }
 
 // EncryptHeader encrypts and write the file header to the writer.
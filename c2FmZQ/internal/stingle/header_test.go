@@ -19,7 +19,10 @@ package stingle
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/binary"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -51,3 +54,143 @@ func TestDecryptHeader(t *testing.T) {
 		t.Errorf("DecryptHeader returned unexpected result. Want %#v, got %#v", want, got)
 	}
 }
+
+func TestNormalizeBase64Headers(t *testing.T) {
+	sk := MakeSecretKeyForTest()
+	hdrs := NewHeaders("foo.jpg")
+	defer hdrs[0].Wipe()
+	defer hdrs[1].Wipe()
+	enc, err := EncryptBase64Headers(hdrs[:], sk.PublicKey())
+	if err != nil {
+		t.Fatalf("EncryptBase64Headers: %v", err)
+	}
+	parts := strings.Split(enc, "*")
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		t.Fatalf("DecodeString: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name, in, want string
+	}{
+		{"canonical", enc, enc},
+		{"padded", base64.URLEncoding.EncodeToString(raw) + "*" + parts[1] + "\n", enc},
+	} {
+		got, err := NormalizeBase64Headers(tc.in)
+		if err != nil {
+			t.Errorf("%s: NormalizeBase64Headers: %v", tc.name, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: NormalizeBase64Headers = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	truncated := base64.RawURLEncoding.EncodeToString(raw[:len(raw)-1])
+	badMagic := append([]byte{'X'}, raw[1:]...)
+	for _, in := range []string{
+		"",
+		"HEADERS",
+		parts[0],
+		enc + "*" + parts[1],
+		"!!!*" + parts[1],
+		truncated + "*" + parts[1],
+		base64.RawURLEncoding.EncodeToString(badMagic) + "*" + parts[1],
+		base64.RawURLEncoding.EncodeToString(raw[:39]) + "*" + parts[1],
+	} {
+		if _, err := NormalizeBase64Headers(in); err == nil {
+			t.Errorf("NormalizeBase64Headers(%q) succeeded unexpectedly", in)
+		}
+	}
+}
+
+// fuzzHeaderSeeds returns a valid encrypted header, followed by headers whose
+// encryption is valid but whose content is truncated.
+func fuzzHeaderSeeds(f *testing.F, pk PublicKey) [][]byte {
+	hdrs := NewHeaders("foo.jpg")
+	defer hdrs[0].Wipe()
+	defer hdrs[1].Wipe()
+	var buf bytes.Buffer
+	if err := EncryptHeader(&buf, hdrs[0], pk); err != nil {
+		f.Fatalf("EncryptHeader: %v", err)
+	}
+	valid := buf.Bytes()
+	seeds := [][]byte{valid}
+	for _, n := range []int{0, 1, 5, 13, 45, 46, 50, 54} {
+		enc := pk.SealBox(make([]byte, n))
+		b := append([]byte{}, valid[:35]...)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(enc)))
+		seeds = append(seeds, append(b, enc...))
+	}
+	return seeds
+}
+
+func FuzzDecryptHeader(f *testing.F) {
+	sk := MakeSecretKeyForTest()
+	for _, b := range fuzzHeaderSeeds(f, sk.PublicKey()) {
+		f.Add(b)
+		f.Add(b[:len(b)/2])
+	}
+	f.Add([]byte{})
+	f.Add([]byte("SP\x01"))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		hdr, err := DecryptHeader(bytes.NewReader(b), sk)
+		if err != nil {
+			return
+		}
+		hdr.Wipe()
+	})
+}
+
+func FuzzParseHeader(f *testing.F) {
+	sk := MakeSecretKeyForTest()
+	for _, b := range fuzzHeaderSeeds(f, sk.PublicKey()) {
+		d, err := sk.SealBoxOpen(b[39:])
+		if err != nil {
+			f.Fatalf("SealBoxOpen: %v", err)
+		}
+		f.Add(d)
+	}
+
+	f.Fuzz(func(t *testing.T, d []byte) {
+		var hdr Header
+		if err := parseHeader(&hdr, d); err != nil {
+			return
+		}
+		if len(hdr.SymmetricKey) != 32 {
+			t.Errorf("parseHeader returned a %d-byte key", len(hdr.SymmetricKey))
+		}
+	})
+}
+
+func FuzzBase64Headers(f *testing.F) {
+	sk := MakeSecretKeyForTest()
+	seeds := fuzzHeaderSeeds(f, sk.PublicKey())
+	for _, b := range seeds {
+		s := base64.RawURLEncoding.EncodeToString(b)
+		f.Add(s + "*" + base64.RawURLEncoding.EncodeToString(seeds[0]))
+		f.Add(s)
+	}
+	f.Add("")
+	f.Add("*")
+	f.Add("U1AB*U1AB")
+
+	f.Fuzz(func(t *testing.T, in string) {
+		if hdrs, err := DecryptBase64Headers(in, sk); err == nil {
+			for _, h := range hdrs {
+				h.Wipe()
+			}
+		}
+		if hdr, err := DecryptBase64FileHeader(in, sk); err == nil {
+			hdr.Wipe()
+		}
+		norm, err := NormalizeBase64Headers(in)
+		if err != nil {
+			return
+		}
+		if again, err := NormalizeBase64Headers(norm); err != nil || again != norm {
+			t.Errorf("NormalizeBase64Headers(%q) = %q, %v, want %q", norm, again, err, norm)
+		}
+	})
+}
@@ -0,0 +1,89 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package stingle
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RequestSignatureHeader is the HTTP header that carries a request signature.
+// This is a c2FmZQ extension. The Stingle app doesn't send it.
+const RequestSignatureHeader = "X-C2fmzq-Signature"
+
+// requestSignatureMessage returns the message that is signed for a request.
+func requestSignatureMessage(method, path, token string, ts int64, nonce string) []byte {
+	th := sha256.Sum256([]byte(token))
+	return []byte(strings.Join([]string{method, path, hex.EncodeToString(th[:]), strconv.FormatInt(ts, 10), nonce}, "\n"))
+}
+
+// SignRequest returns the value of the RequestSignatureHeader for a request.
+// The signature covers the method, the path, the session token, the timestamp
+// (in milliseconds), and a random nonce. It uses Authenticated Public Key
+// Encryption with the user's secret key and the server's public key, so only
+// the server can verify it.
+func SignRequest(method, path, token string, ts int64, pk PublicKey, sk *SecretKey) (string, error) {
+	n := make([]byte, 16)
+	if _, err := rand.Read(n); err != nil {
+		return "", err
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(n)
+	sig := EncryptMessage(requestSignatureMessage(method, path, token, ts, nonce), pk, sk)
+	return fmt.Sprintf("ts=%d,nonce=%s,sig=%s", ts, nonce, sig), nil
+}
+
+// VerifyRequestSignature verifies the value of the RequestSignatureHeader of a
+// request, with the user's public key and the server's secret key. It returns
+// the timestamp and the nonce of the signature. The caller is responsible for
+// rejecting stale timestamps and reused nonces.
+func VerifyRequestSignature(header, method, path, token string, pk PublicKey, sk *SecretKey) (ts int64, nonce string, err error) {
+	var sig string
+	for _, kv := range strings.Split(header, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return 0, "", errors.New("malformed signature")
+		}
+		switch k {
+		case "ts":
+			if ts, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return 0, "", errors.New("malformed signature timestamp")
+			}
+		case "nonce":
+			nonce = v
+		case "sig":
+			sig = v
+		}
+	}
+	if ts == 0 || nonce == "" || sig == "" {
+		return 0, "", errors.New("incomplete signature")
+	}
+	m, err := DecryptMessage(sig, pk, sk)
+	if err != nil {
+		return 0, "", errors.New("invalid signature")
+	}
+	if string(m) != string(requestSignatureMessage(method, path, token, ts, nonce)) {
+		return 0, "", errors.New("signature mismatch")
+	}
+	return ts, nonce, nil
+}
@@ -0,0 +1,58 @@
+//
+// Copyright 2021-2022 TTBT Enterprises LLC
+//
+// This file is part of c2FmZQ (https://c2FmZQ.org/).
+//
+// c2FmZQ is free software: you can redistribute it and/or modify it under the
+// terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// c2FmZQ is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// c2FmZQ. If not, see <https://www.gnu.org/licenses/>.
+
+package stingle
+
+import (
+	"testing"
+)
+
+func TestRequestSignature(t *testing.T) {
+	userKey := MakeSecretKeyForTest()
+	serverKey := MakeSecretKeyForTest()
+	otherKey := MakeSecretKeyForTest()
+
+	h, err := SignRequest("POST", "/v2/sync/getUpdates", "TOKEN", 12345, serverKey.PublicKey(), userKey)
+	if err != nil {
+		t.Fatalf("SignRequest failed: %v", err)
+	}
+	ts, nonce, err := VerifyRequestSignature(h, "POST", "/v2/sync/getUpdates", "TOKEN", userKey.PublicKey(), serverKey)
+	if err != nil {
+		t.Fatalf("VerifyRequestSignature failed: %v", err)
+	}
+	if ts != 12345 || nonce == "" {
+		t.Errorf("VerifyRequestSignature returned ts=%d nonce=%q", ts, nonce)
+	}
+
+	for _, tc := range []struct {
+		name, header, method, path, token string
+		pk                                PublicKey
+		sk                                *SecretKey
+	}{
+		{"method", h, "GET", "/v2/sync/getUpdates", "TOKEN", userKey.PublicKey(), serverKey},
+		{"path", h, "POST", "/v2/sync/upload", "TOKEN", userKey.PublicKey(), serverKey},
+		{"token", h, "POST", "/v2/sync/getUpdates", "OTHER", userKey.PublicKey(), serverKey},
+		{"user key", h, "POST", "/v2/sync/getUpdates", "TOKEN", otherKey.PublicKey(), serverKey},
+		{"server key", h, "POST", "/v2/sync/getUpdates", "TOKEN", userKey.PublicKey(), otherKey},
+		{"malformed", "foo", "POST", "/v2/sync/getUpdates", "TOKEN", userKey.PublicKey(), serverKey},
+		{"incomplete", "ts=12345", "POST", "/v2/sync/getUpdates", "TOKEN", userKey.PublicKey(), serverKey},
+	} {
+		if _, _, err := VerifyRequestSignature(tc.header, tc.method, tc.path, tc.token, tc.pk, tc.sk); err == nil {
+			t.Errorf("VerifyRequestSignature(%s) succeeded unexpectedly", tc.name)
+		}
+	}
+}
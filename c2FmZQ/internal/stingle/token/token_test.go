@@ -34,3 +34,24 @@ func TestTokens(t *testing.T) {
 		t.Errorf("Unexpected token. Got %+v, want {'foo', 'blah blah'}", dec)
 	}
 }
+
+func FuzzDecodeToken(f *testing.F) {
+	key := MakeKey()
+	f.Add(Mint(key, Token{Scope: "foo", Subject: 44545}, time.Hour))
+	f.Add(Mint(key, Token{Scope: "", Subject: -1}, time.Hour))
+	f.Add(Mint(key, Token{Scope: "foo", Subject: 1}, -time.Hour))
+	f.Add(Mint(MakeKey(), Token{Scope: "foo", Subject: 1}, time.Hour))
+	f.Add("")
+	f.Add("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA")
+
+	f.Fuzz(func(t *testing.T, tok string) {
+		Subject(tok)
+		dec, err := Decrypt(key, tok)
+		if err != nil {
+			return
+		}
+		if sub, err := Subject(tok); err != nil || sub != dec.Subject {
+			t.Errorf("Subject(%q) = %d, %v, want %d", tok, sub, err, dec.Subject)
+		}
+	})
+}
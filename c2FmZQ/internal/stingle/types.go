@@ -232,6 +232,10 @@ func (h *Header) Wipe() {
 	runtime.SetFinalizer(h, nil)
 }
 
+// NotImplementedError is the error returned by the server for the API calls
+// that it doesn't implement.
+const NotImplementedError = "This functionality is not yet implemented in the server"
+
 // ResponseOK returns a new Response with status OK.
 func ResponseOK() *Response {
 	return &Response{